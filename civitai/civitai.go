@@ -0,0 +1,223 @@
+// Package civitai exposes the downloader's core - the Civitai API client, the verified
+// file downloader, the download database and the file filters - for use from other Go
+// programs, without going through the civitai-downloader command line.
+//
+// The pieces are small interfaces (Lister, Fetcher, Store, Filter) with default
+// implementations (Client, Downloader, DB, FileFilter), and a Syncer that ties them
+// together the way a `civitai-downloader download` run does:
+//
+//	db, err := civitai.OpenDB("civitai.db")
+//	if err != nil { ... }
+//	defer db.Close()
+//
+//	syncer := &civitai.Syncer{
+//		Source:   civitai.NewClient(apiKey, nil),
+//		Fetcher:  civitai.NewDownloader(apiKey, nil),
+//		Store:    db,
+//		Filters:  []civitai.Filter{civitai.FileFilter{PrimaryOnly: true}},
+//		SavePath: "/srv/models",
+//	}
+//	result, err := syncer.Sync(ctx, civitai.QueryParameters{Types: []string{"LORA"}, Sort: "Newest", Limit: 100})
+//
+// Files are laid out and recorded exactly as the CLI does, so a database and save path
+// can be shared between an embedding program and the CLI (one process at a time).
+package civitai
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/api"
+	"github.com/dreamfast/go-civitai-downloader/internal/database"
+	"github.com/dreamfast/go-civitai-downloader/internal/downloader"
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+)
+
+// API and database types, shared with the CLI.
+type (
+	Model            = models.Model
+	ModelVersion     = models.ModelVersion
+	File             = models.File
+	Hashes           = models.Hashes
+	Creator          = models.Creator
+	ApiResponse      = models.ApiResponse
+	QueryParameters  = models.QueryParameters
+	DatabaseEntry    = models.DatabaseEntry
+	TrainingMetadata = models.TrainingMetadata
+	Stats            = models.Stats
+	Receipt          = downloader.Receipt
+	Index            = database.Index
+	HashAlgorithm    = helpers.HashAlgorithm
+)
+
+// Database entry statuses.
+const (
+	StatusPending    = models.StatusPending
+	StatusDownloaded = models.StatusDownloaded
+	StatusError      = models.StatusError
+	StatusCataloged  = models.StatusCataloged
+	StatusDeferred   = models.StatusDeferred
+	StatusPruned     = models.StatusPruned
+)
+
+// Secondary indexes that DB.Lookup can search.
+const (
+	IndexHash      = database.IndexHash
+	IndexCreator   = database.IndexCreator
+	IndexType      = database.IndexType
+	IndexBaseModel = database.IndexBaseModel
+	IndexTraining  = database.IndexTraining
+)
+
+// Errors returned by the default implementations. Use errors.Is to test for them.
+var (
+	ErrNotFound     = database.ErrNotFound // No database entry under the key
+	ErrHashMismatch = downloader.ErrHashMismatch
+	ErrRateLimited  = api.ErrRateLimited
+	ErrUnauthorized = api.ErrUnauthorized
+)
+
+// Lister pages through the Civitai model listing (/api/v1/models).
+type Lister interface {
+	// GetModels returns one page of models and the cursor of the next page ("" on the last).
+	GetModels(ctx context.Context, cursor string, params QueryParameters) (string, ApiResponse, error)
+}
+
+// Fetcher downloads one file and verifies it against its hashes.
+type Fetcher interface {
+	// Fetch downloads url to targetPath (the file name may change to the one the server
+	// sends, prefixed with versionID) and returns the final path and a receipt.
+	Fetch(ctx context.Context, targetPath string, url string, hashes Hashes, versionID int) (string, *Receipt, error)
+}
+
+// Store records what has been downloaded, keyed like the CLI's database ("v_<versionID>").
+type Store interface {
+	// Entry returns the entry stored under key, or ErrNotFound.
+	Entry(key string) (DatabaseEntry, error)
+	// PutEntry stores entry under key.
+	PutEntry(key string, entry DatabaseEntry) error
+}
+
+// Client is the default Lister, talking to the Civitai REST API.
+type Client struct {
+	client *api.Client
+}
+
+// NewClient creates an API client. A nil httpClient uses one with a 30 second timeout.
+func NewClient(apiKey string, httpClient *http.Client) *Client {
+	return &Client{client: api.NewClient(apiKey, httpClient, models.Config{})}
+}
+
+// GetModels implements Lister.
+func (c *Client) GetModels(ctx context.Context, cursor string, params QueryParameters) (string, ApiResponse, error) {
+	return c.client.GetModelsContext(ctx, cursor, params)
+}
+
+// Downloader is the default Fetcher. Interrupted downloads leave a checkpointed partial
+// file that the next Fetch of the same target resumes.
+type Downloader struct {
+	downloader *downloader.Downloader
+}
+
+// NewDownloader creates a file downloader. A nil httpClient uses one with a 15 minute timeout.
+func NewDownloader(apiKey string, httpClient *http.Client) *Downloader {
+	return &Downloader{downloader: downloader.NewDownloader(httpClient, apiKey)}
+}
+
+// SetTempDir stages partial files in dir instead of next to their targets.
+func (d *Downloader) SetTempDir(dir string) {
+	d.downloader.SetTempDir(dir)
+}
+
+// SetHashAlgorithms makes Fetch compute the hashes of the named algorithms (sha256, autov2,
+// blake3, crc32, md5, sha1 or one added with RegisterHashAlgorithm) of every file, recorded
+// in the receipt's ComputedHashes. SHA256 is always computed.
+func (d *Downloader) SetHashAlgorithms(names []string) error {
+	algorithms, err := helpers.ParseHashAlgorithms(names)
+	if err != nil {
+		return err
+	}
+	d.downloader.SetHashAlgorithms(algorithms)
+	return nil
+}
+
+// RegisterHashAlgorithm adds a hash algorithm that SetHashAlgorithms (and the CLI's
+// HashAlgorithms setting) can name.
+func RegisterHashAlgorithm(a HashAlgorithm) {
+	helpers.RegisterHashAlgorithm(a)
+}
+
+// Fetch implements Fetcher.
+func (d *Downloader) Fetch(ctx context.Context, targetPath string, url string, hashes Hashes, versionID int) (string, *Receipt, error) {
+	return d.downloader.DownloadFileContext(ctx, targetPath, url, hashes, versionID)
+}
+
+// DB is the default Store: the CLI's bitcask database, including its secondary indexes.
+type DB struct {
+	db *database.DB
+}
+
+// OpenDB opens (or creates) the database at path. Bitcask allows one process at a time.
+func OpenDB(path string) (*DB, error) {
+	db, err := database.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &DB{db: db}, nil
+}
+
+// Close closes the database.
+func (d *DB) Close() error {
+	return d.db.Close()
+}
+
+// Entry implements Store.
+func (d *DB) Entry(key string) (DatabaseEntry, error) {
+	var entry DatabaseEntry
+	value, err := d.db.Get([]byte(key))
+	if err != nil {
+		return entry, err
+	}
+	if err := json.Unmarshal(value, &entry); err != nil {
+		return entry, fmt.Errorf("invalid database entry %s: %w", key, err)
+	}
+	return entry, nil
+}
+
+// PutEntry implements Store.
+func (d *DB) PutEntry(key string, entry DatabaseEntry) error {
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return d.db.Put([]byte(key), value)
+}
+
+// Lookup returns the keys of the entries indexed under value (case-insensitive), e.g. every
+// file of a creator or every file with a hash. Before the indexes are built (see
+// IndexesReady) the result may be incomplete.
+func (d *DB) Lookup(idx Index, value string) ([]string, error) {
+	return d.db.Lookup(idx, value)
+}
+
+// IndexesReady reports whether Lookup covers every entry.
+func (d *DB) IndexesReady() bool {
+	return d.db.IndexesReady()
+}
+
+// Entries calls fn for every download entry in the database.
+func (d *DB) Entries(fn func(key string, entry DatabaseEntry) error) error {
+	return d.db.Fold(func(key []byte, value []byte) error {
+		if !IsEntryKey(string(key)) {
+			return nil
+		}
+		var entry DatabaseEntry
+		if json.Unmarshal(value, &entry) != nil {
+			return nil
+		}
+		return fn(string(key), entry)
+	})
+}
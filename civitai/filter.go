@@ -0,0 +1,244 @@
+package civitai
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+)
+
+// Candidate is a file found in a listing, before it is downloaded.
+type Candidate struct {
+	Model     Model        `json:"model"`
+	Version   ModelVersion `json:"version"`
+	File      File         `json:"file"`
+	ModelType string       `json:"modelType"` // The type the file is filed under (the model's type unless overridden)
+}
+
+// SizeBytes is the file size the API reports.
+func (c Candidate) SizeBytes() uint64 {
+	return uint64(c.File.SizeKB * 1024)
+}
+
+// Filter decides whether a candidate file is downloaded.
+type Filter interface {
+	// SkipReason returns why c should be skipped, or "" to download it.
+	SkipReason(c Candidate) string
+}
+
+// FilterFunc adapts a function to a Filter.
+type FilterFunc func(c Candidate) string
+
+// SkipReason implements Filter.
+func (f FilterFunc) SkipReason(c Candidate) string {
+	return f(c)
+}
+
+// FileFilter holds the CLI's file-level filters (PrimaryOnly, Pruned, Fp16,
+// IgnoreFileNameStrings, FileFormats and EmbeddingFormats). Only files in one of
+// FileFormats pass (safetensors by default), or for embeddings one of EmbeddingFormats.
+type FileFilter struct {
+	PrimaryOnly           bool     // Only the version's primary file
+	Pruned                bool     // Checkpoints: only pruned files
+	Fp16                  bool     // Checkpoints: only fp16 files
+	IgnoreFileNameStrings []string // Skip files whose name contains any of these (case-insensitive)
+	// Other types than embeddings: the formats to accept, most preferred first (default:
+	// SafeTensor only). A file a version ships in several formats is only downloaded in
+	// the preferred one.
+	FileFormats []string
+	// Embeddings: the formats to accept, most preferred first (default: SafeTensor only).
+	// An embedding shipped in several formats is only downloaded in the preferred one.
+	EmbeddingFormats []string
+}
+
+// SkipReason implements Filter.
+func (f FileFilter) SkipReason(c Candidate) string {
+	file := c.File
+	if f.PrimaryOnly && !file.Primary {
+		return "not the primary file"
+	}
+
+	// TODO: Make acceptable formats configurable?
+	if file.Metadata.Format == "" {
+		return "missing metadata format"
+	}
+	if helpers.IsEmbeddingType(c.ModelType) {
+		if reason := f.embeddingFormatSkipReason(c); reason != "" {
+			return reason
+		}
+	} else if reason := f.fileFormatSkipReason(c); reason != "" {
+		return reason
+	}
+
+	if strings.EqualFold(c.ModelType, "checkpoint") {
+		sizeStr := fmt.Sprintf("%v", file.Metadata.Size)
+		fpStr := fmt.Sprintf("%v", file.Metadata.Fp)
+		if f.Pruned && !strings.EqualFold(sizeStr, "pruned") {
+			return fmt.Sprintf("checkpoint file is not pruned (size: %s)", sizeStr)
+		}
+		if f.Fp16 && !strings.EqualFold(fpStr, "fp16") {
+			return fmt.Sprintf("checkpoint file is not fp16 (fp: %s)", fpStr)
+		}
+	}
+
+	return f.ignoredNameReason(file)
+}
+
+// ignoredNameReason returns why IgnoreFileNameStrings skips file, or "".
+func (f FileFilter) ignoredNameReason(file File) string {
+	for _, ignore := range f.IgnoreFileNameStrings {
+		if ignore != "" && strings.Contains(strings.ToLower(file.Name), strings.ToLower(ignore)) {
+			return fmt.Sprintf("file name contains ignored string '%s'", ignore)
+		}
+	}
+	return ""
+}
+
+// RestrictedCategories are the moderation categories RestrictionFilter knows: "poi" (the
+// model depicts a real person; "celebrity" is accepted for it) and "minor" (Civitai flagged
+// the model as depicting minors).
+var RestrictedCategories = []string{"poi", "minor"}
+
+// RestrictionFilter skips the files of models in restricted categories (ExcludeRestricted),
+// for mirrors that must not carry them. Its skip reasons start with "restricted", naming
+// the category, so they stand out from those of the other filters.
+type RestrictionFilter struct {
+	Categories []string // Of RestrictedCategories
+}
+
+// NewRestrictionFilter checks categories against RestrictedCategories. It returns nil if
+// none are given.
+func NewRestrictionFilter(categories []string) (*RestrictionFilter, error) {
+	f := &RestrictionFilter{}
+	for _, category := range categories {
+		category = strings.ToLower(strings.TrimSpace(category))
+		if category == "celebrity" {
+			category = "poi"
+		}
+		switch category {
+		case "":
+			continue
+		case "poi", "minor":
+			f.Categories = append(f.Categories, category)
+		default:
+			return nil, fmt.Errorf("unknown restricted category %q: use %s", category, strings.Join(RestrictedCategories, ", "))
+		}
+	}
+	if len(f.Categories) == 0 {
+		return nil, nil
+	}
+	return f, nil
+}
+
+// SkipReason implements Filter. The model-level flags of the version's model (as the
+// model-versions endpoint returns them) count too.
+func (f *RestrictionFilter) SkipReason(c Candidate) string {
+	if f == nil {
+		return ""
+	}
+	for _, category := range f.Categories {
+		switch category {
+		case "poi":
+			if c.Model.Poi || c.Version.Model.Poi {
+				return "restricted (poi): the model depicts a real person"
+			}
+		case "minor":
+			if c.Model.Minor || c.Version.Model.Minor {
+				return "restricted (minor): the model is flagged as depicting minors"
+			}
+		}
+	}
+	return ""
+}
+
+// SkipReason returns the reason of the first filter that skips c, or "".
+func SkipReason(filters []Filter, c Candidate) string {
+	for _, f := range filters {
+		if reason := f.SkipReason(c); reason != "" {
+			return reason
+		}
+	}
+	return ""
+}
+
+// formatRank returns where the format of file is in formats, or in SafeTensor only if
+// formats is empty (-1 if it isn't). A file in a pickle format that Civitai's pickle scan
+// flagged is never accepted.
+func formatRank(file File, formats []string) int {
+	if len(formats) == 0 {
+		formats = []string{"SafeTensor"}
+	}
+	for i, format := range formats {
+		if strings.EqualFold(strings.TrimSpace(format), file.Metadata.Format) {
+			if !strings.EqualFold(file.Metadata.Format, "SafeTensor") && strings.EqualFold(file.PickleScanResult, "Danger") {
+				return -1
+			}
+			return i
+		}
+	}
+	return -1
+}
+
+// preferredAlternative returns the file of c's version that is the same file as c's (as
+// same tells) in a format ranked before rank, and that the other filters would leave,
+// or nil if there is none.
+func (f FileFilter) preferredAlternative(c Candidate, rank int, formats []string, same func(a, b File) bool) *File {
+	for i, other := range c.Version.Files {
+		if other.ID == c.File.ID || !strings.EqualFold(other.Type, c.File.Type) || !same(c.File, other) {
+			continue
+		}
+		if f.PrimaryOnly && !other.Primary || f.ignoredNameReason(other) != "" {
+			continue
+		}
+		if otherRank := formatRank(other, formats); otherRank >= 0 && otherRank < rank {
+			return &c.Version.Files[i]
+		}
+	}
+	return nil
+}
+
+// fileFormatSkipReason checks a file against FileFormats. Versions sometimes ship the
+// same model as .safetensors and .ckpt or .pt: files of the same kind, precision and size
+// (pruned or full) are one file, of which only the most preferred format is downloaded.
+func (f FileFilter) fileFormatSkipReason(c Candidate) string {
+	file := c.File
+	rank := formatRank(file, f.FileFormats)
+	if rank < 0 {
+		if strings.EqualFold(file.PickleScanResult, "Danger") {
+			return fmt.Sprintf("file failed the pickle scan (format: %s)", file.Metadata.Format)
+		}
+		if len(f.FileFormats) == 0 {
+			return fmt.Sprintf("not a safetensor file (format: %s)", file.Metadata.Format)
+		}
+		return fmt.Sprintf("format %s is not in FileFormats", file.Metadata.Format)
+	}
+	sameVariant := func(a, b File) bool {
+		return strings.EqualFold(a.Metadata.Fp, b.Metadata.Fp) && strings.EqualFold(a.Metadata.Size, b.Metadata.Size)
+	}
+	if other := f.preferredAlternative(c, rank, f.FileFormats, sameVariant); other != nil {
+		return fmt.Sprintf("also available as %s (%s, preferred by FileFormats)", other.Metadata.Format, other.Name)
+	}
+	return ""
+}
+
+// embeddingFormatSkipReason checks an embedding file against EmbeddingFormats. Versions
+// often ship the same embedding as both .pt and .safetensors (and sometimes a separate
+// negative embedding); files of the same kind with the same activation token are one
+// embedding, of which only the most preferred format is downloaded.
+func (f FileFilter) embeddingFormatSkipReason(c Candidate) string {
+	file := c.File
+	rank := formatRank(file, f.EmbeddingFormats)
+	if rank < 0 {
+		if strings.EqualFold(file.PickleScanResult, "Danger") {
+			return fmt.Sprintf("embedding failed the pickle scan (format: %s)", file.Metadata.Format)
+		}
+		return fmt.Sprintf("embedding format %s is not in EmbeddingFormats", file.Metadata.Format)
+	}
+	sameToken := func(a, b File) bool {
+		return strings.EqualFold(helpers.EmbeddingToken(a.Name), helpers.EmbeddingToken(b.Name))
+	}
+	if other := f.preferredAlternative(c, rank, f.EmbeddingFormats, sameToken); other != nil {
+		return fmt.Sprintf("embedding %s is also available as %s (preferred by EmbeddingFormats)", helpers.EmbeddingToken(file.Name), other.Metadata.Format)
+	}
+	return ""
+}
@@ -0,0 +1,122 @@
+package civitai
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+)
+
+// testFile returns a model file of the given format, precision and size.
+func testFile(id int, name, format, fp, size string) File {
+	return File{ID: id, Name: name, Type: "Model", Primary: id == 1, Metadata: models.Metadata{Format: format, Fp: fp, Size: size}}
+}
+
+func TestFormatRank(t *testing.T) {
+	danger := testFile(1, "model.ckpt", "PickleTensor", "fp16", "pruned")
+	danger.PickleScanResult = "Danger"
+	dangerSafetensors := testFile(1, "model.safetensors", "SafeTensor", "fp16", "pruned")
+	dangerSafetensors.PickleScanResult = "Danger"
+
+	tests := []struct {
+		name    string
+		file    File
+		formats []string
+		want    int
+	}{
+		{"Default is SafeTensor", testFile(1, "model.safetensors", "SafeTensor", "fp16", "pruned"), nil, 0},
+		{"Default rejects pickles", testFile(1, "model.ckpt", "PickleTensor", "fp16", "pruned"), nil, -1},
+		{"Position in the list", testFile(1, "model.ckpt", "PickleTensor", "fp16", "pruned"), []string{"SafeTensor", "PickleTensor"}, 1},
+		{"Case and spaces", testFile(1, "model.ckpt", "PickleTensor", "fp16", "pruned"), []string{" pickletensor "}, 0},
+		{"Not listed", testFile(1, "model", "Diffusers", "fp16", "pruned"), []string{"SafeTensor", "PickleTensor"}, -1},
+		{"Pickle scan danger", danger, []string{"PickleTensor"}, -1},
+		{"Pickle scan danger ignored for safetensors", dangerSafetensors, nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatRank(tt.file, tt.formats); got != tt.want {
+				t.Errorf("formatRank(%s, %v) = %d, want %d", tt.file.Metadata.Format, tt.formats, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFileFormatsKeepPreferredFormat(t *testing.T) {
+	safetensors := testFile(1, "model.safetensors", "SafeTensor", "fp16", "pruned")
+	ckpt := testFile(2, "model.ckpt", "PickleTensor", "fp16", "pruned")
+	fullCkpt := testFile(2, "model-full.ckpt", "PickleTensor", "fp16", "full")
+	fp32Ckpt := testFile(2, "model-fp32.ckpt", "PickleTensor", "fp32", "pruned")
+	dangerCkpt := ckpt
+	dangerCkpt.PickleScanResult = "Danger"
+	diffusers := testFile(3, "model.zip", "Diffusers", "fp16", "pruned")
+	primaryCkpt := testFile(1, "model.ckpt", "PickleTensor", "fp16", "pruned")
+	secondarySafetensors := testFile(2, "model.safetensors", "SafeTensor", "fp16", "pruned")
+	both := []string{"SafeTensor", "PickleTensor"}
+
+	tests := []struct {
+		name   string
+		filter FileFilter
+		files  []File
+		want   []string // Names of the files that pass
+	}{
+		{"Same file in two formats", FileFilter{FileFormats: both}, []File{safetensors, ckpt}, []string{"model.safetensors"}},
+		{"Order decides the preferred format", FileFilter{FileFormats: []string{"PickleTensor", "SafeTensor"}}, []File{safetensors, ckpt}, []string{"model.ckpt"}},
+		{"Different precision", FileFilter{FileFormats: both}, []File{safetensors, fp32Ckpt}, []string{"model.safetensors", "model-fp32.ckpt"}},
+		{"Different size", FileFilter{FileFormats: both}, []File{safetensors, fullCkpt}, []string{"model.safetensors", "model-full.ckpt"}},
+		{"Pickle only", FileFilter{FileFormats: both}, []File{ckpt}, []string{"model.ckpt"}},
+		{"Pickle scan danger", FileFilter{FileFormats: both}, []File{dangerCkpt}, nil},
+		{"Pickle scan danger next to safetensors", FileFilter{FileFormats: both}, []File{safetensors, dangerCkpt}, []string{"model.safetensors"}},
+		{"Empty FileFormats is SafeTensor only", FileFilter{}, []File{safetensors, ckpt, diffusers}, []string{"model.safetensors"}},
+		{"Empty FileFormats without a safetensors file", FileFilter{}, []File{ckpt}, nil},
+		{"Format not listed", FileFilter{FileFormats: both}, []File{safetensors, diffusers}, []string{"model.safetensors"}},
+		{"Preferred file ignored by name", FileFilter{FileFormats: both, IgnoreFileNameStrings: []string{".safetensors"}}, []File{safetensors, ckpt}, []string{"model.ckpt"}},
+		{"Preferred file not primary", FileFilter{FileFormats: both, PrimaryOnly: true}, []File{primaryCkpt, secondarySafetensors}, []string{"model.ckpt"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			version := ModelVersion{ID: 10, Files: tt.files}
+			var got []string
+			for _, file := range tt.files {
+				if tt.filter.SkipReason(Candidate{Version: version, File: file, ModelType: "Checkpoint"}) == "" {
+					got = append(got, file.Name)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("files kept = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFileFormatSkipReason(t *testing.T) {
+	safetensors := testFile(1, "model.safetensors", "SafeTensor", "fp16", "pruned")
+	ckpt := testFile(2, "model.ckpt", "PickleTensor", "fp16", "pruned")
+	dangerCkpt := ckpt
+	dangerCkpt.PickleScanResult = "Danger"
+
+	tests := []struct {
+		name    string
+		formats []string
+		file    File
+		want    string
+	}{
+		{"Kept", []string{"SafeTensor", "PickleTensor"}, safetensors, ""},
+		{"Default", nil, ckpt, "not a safetensor file (format: PickleTensor)"},
+		{"Not in FileFormats", []string{"SafeTensor"}, ckpt, "format PickleTensor is not in FileFormats"},
+		{"Pickle scan", []string{"SafeTensor", "PickleTensor"}, dangerCkpt, "file failed the pickle scan (format: PickleTensor)"},
+		{"Preferred alternative", []string{"SafeTensor", "PickleTensor"}, ckpt, "also available as SafeTensor (model.safetensors, preferred by FileFormats)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := FileFilter{FileFormats: tt.formats}
+			c := Candidate{Version: ModelVersion{Files: []File{safetensors, tt.file}}, File: tt.file}
+			if got := f.fileFormatSkipReason(c); got != tt.want {
+				t.Errorf("fileFormatSkipReason(%s) = %q, want %q", tt.file.Name, got, tt.want)
+			}
+			if tt.want != "" && !strings.Contains(f.SkipReason(c), tt.want) {
+				t.Errorf("SkipReason(%s) = %q, want %q", tt.file.Name, f.SkipReason(c), tt.want)
+			}
+		})
+	}
+}
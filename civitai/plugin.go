@@ -0,0 +1,124 @@
+package civitai
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/failure"
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ExprFilter downloads only the candidates an expression accepts, for example
+//
+//	model.Stats.DownloadCount > 1000 && !("anime" in model.Tags)
+//
+// The expression sees the candidate as `model`, `version`, `file` and `modelType`, with
+// the API's fields in either their Go or JSON spelling; a missing field is null. It has
+// the operators || && ! == != < <= > >= + - * /, `in` and `not in` (list membership,
+// substring or field name), [lists] and the functions lower, upper, len and
+// matches(s, regexp). A candidate the expression cannot be evaluated for is skipped.
+type ExprFilter struct {
+	expr *helpers.Expression
+}
+
+// NewExprFilter compiles an expression filter.
+func NewExprFilter(expression string) (*ExprFilter, error) {
+	expr, err := helpers.CompileExpression(expression)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter expression %q: %w", expression, err)
+	}
+	return &ExprFilter{expr: expr}, nil
+}
+
+// SkipReason implements Filter.
+func (f *ExprFilter) SkipReason(c Candidate) string {
+	env, err := c.env()
+	if err != nil {
+		return fmt.Sprintf("cannot evaluate filter expression: %v", err)
+	}
+	ok, err := f.expr.Match(env)
+	if err != nil {
+		log.WithError(err).Warnf("Filter expression failed for %s", c.File.Name)
+		return fmt.Sprintf("filter expression failed: %v", err)
+	}
+	if !ok {
+		return "rejected by filter expression"
+	}
+	return ""
+}
+
+// env returns the candidate as the generic JSON values expressions work on.
+func (c Candidate) env() (map[string]interface{}, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	var env map[string]interface{}
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+// defaultCommandTimeout bounds a filter command that doesn't set its own timeout.
+const defaultCommandTimeout = 30 * time.Second
+
+// CommandFilter asks an external program about each candidate. The program is started once
+// per candidate with the candidate's JSON ({"model", "version", "file", "modelType"}) on
+// stdin. Exit status 0 accepts the file; exit status 1 rejects it, with the first line of
+// stdout as the reason. Anything else (the program cannot be started, another exit status,
+// a timeout) is logged and skips the file, so a broken plugin never lets everything through.
+type CommandFilter struct {
+	Command []string      // Program and arguments
+	Timeout time.Duration // Per candidate; 0 means 30 seconds
+}
+
+// SkipReason implements Filter.
+func (f CommandFilter) SkipReason(c Candidate) string {
+	if len(f.Command) == 0 {
+		return ""
+	}
+	input, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Sprintf("cannot encode candidate for filter command: %v", err)
+	}
+	timeout := f.Timeout
+	if timeout <= 0 {
+		timeout = defaultCommandTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, f.Command[0], f.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err == nil {
+		return ""
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 && ctx.Err() == nil {
+		reason, _, _ := strings.Cut(strings.TrimSpace(stdout.String()), "\n")
+		if reason == "" {
+			reason = "rejected by filter command"
+		}
+		return reason
+	}
+	if ctx.Err() != nil {
+		err = fmt.Errorf("timed out after %v", timeout)
+	}
+	log.WithField(failure.LogField, failure.Filtered).WithError(err).Warnf("Filter command %s failed for %s: %s",
+		f.Command[0], c.File.Name, strings.TrimSpace(stderr.String()))
+	return fmt.Sprintf("filter command failed: %v", err)
+}
@@ -0,0 +1,262 @@
+package civitai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/failure"
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// EntryKey returns the database key of a model version's download entry.
+func EntryKey(versionID int) string {
+	return fmt.Sprintf("v_%d", versionID)
+}
+
+// IsEntryKey reports whether key holds a download entry (rather than internal state).
+func IsEntryKey(key string) bool {
+	return strings.HasPrefix(key, "v_")
+}
+
+// DefaultPathTemplate is the layout TargetPath uses for version directories.
+const DefaultPathTemplate = helpers.DefaultPathTemplate
+
+// TargetPath returns where a file is saved: the folder slug "{type}/{model}/{base model}"
+// recorded in its database entry, and the full path
+// "{savePath}/{folder}/{versionID}-{file name}/{file name}", with the file name slugged
+// (embeddings keep their original name, their activation token). The downloader prefixes
+// the final file name with the version ID, except for embeddings.
+func TargetPath(savePath string, modelName string, modelType string, version ModelVersion, file File) (folder string, path string) {
+	dir, path, _ := TemplatePath(savePath, DefaultPathTemplate, Model{Name: modelName}, modelType, version, file)
+	return filepath.Dir(dir), path
+}
+
+// FileNameVersionID returns the version ID the downloader prefixes a file name with: none
+// for embeddings, which keep their activation token as the file name.
+func FileNameVersionID(modelType string, versionID int) int {
+	if helpers.IsEmbeddingType(modelType) {
+		return 0
+	}
+	return versionID
+}
+
+// TemplatePath is TargetPath with the version directory laid out by a path template such
+// as DefaultPathTemplate (placeholders: type, model, modelId, baseModel, creator, version,
+// versionId, file, rating, nsfwLevel). It returns the version directory relative to savePath and the full path.
+func TemplatePath(savePath string, template string, model Model, modelType string, version ModelVersion, file File) (dir string, path string, err error) {
+	modelID := model.ID
+	if modelID == 0 {
+		modelID = version.ModelId
+	}
+	dir, err = helpers.RenderPathTemplate(template, helpers.PathValues{
+		Type:      modelType,
+		Model:     model.Name,
+		ModelID:   modelID,
+		BaseModel: version.BaseModel,
+		Creator:   model.Creator.Username,
+		Version:   version.Name,
+		VersionID: version.ID,
+		File:      file.Name,
+		Nsfw:      model.Nsfw || version.Model.Nsfw,
+		NsfwLevel: model.NsfwLevel,
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	if helpers.IsEmbeddingType(modelType) {
+		return dir, filepath.Join(savePath, dir, helpers.EmbeddingFileName(file)), nil
+	}
+	baseFileName := helpers.ConvertToSlug(file.Name)
+	ext := filepath.Ext(baseFileName)
+	baseFileName = strings.TrimSuffix(baseFileName, ext)
+	if strings.ToLower(file.Metadata.Format) == "safetensor" && !strings.EqualFold(ext, ".safetensors") {
+		ext = ".safetensors"
+	}
+	if ext == "" {
+		ext = ".bin"
+		log.Warnf("File %s in version %s (%d) has no extension, defaulting to '.bin'", file.Name, version.Name, version.ID)
+	}
+	return dir, filepath.Join(savePath, dir, baseFileName+ext), nil
+}
+
+// SyncAction is what a Syncer did with a candidate file.
+type SyncAction string
+
+const (
+	SyncSkipped    SyncAction = "skipped"    // Rejected by a filter
+	SyncExisting   SyncAction = "existing"   // Already downloaded according to the store
+	SyncDownloaded SyncAction = "downloaded" // Downloaded and recorded
+	SyncFailed     SyncAction = "failed"     // Download failed; recorded with status Error
+)
+
+// SyncEvent reports the outcome for one candidate file.
+type SyncEvent struct {
+	Candidate Candidate
+	Key       string // Database key of the version
+	Action    SyncAction
+	Reason    string   // Why the file was skipped
+	Path      string   // Final path of a downloaded file
+	Receipt   *Receipt // Provenance of a downloaded file
+	Err       error    // Why the download failed
+}
+
+// SyncResult counts the outcomes of a Sync.
+type SyncResult struct {
+	Pages      int
+	Skipped    int
+	Existing   int
+	Downloaded int
+	Failed     int
+	Bytes      uint64 // Bytes transferred
+}
+
+// Syncer downloads every file of a model listing that passes its filters and isn't in its
+// store yet, recording each in the store like the CLI does. Like the CLI, it takes the
+// first file of each version that passes the filters.
+type Syncer struct {
+	Source   Lister
+	Fetcher  Fetcher
+	Store    Store
+	Filters  []Filter
+	SavePath string
+	MaxPages int // 0 = all pages
+
+	// PathTemplate lays out version directories below SavePath (default DefaultPathTemplate).
+	PathTemplate string
+
+	// TypeFor, if set, returns the model type to file a version under (default: the API's).
+	TypeFor func(model Model, version ModelVersion) string
+	// OnEvent, if set, is called after each candidate file is handled.
+	OnEvent func(SyncEvent)
+}
+
+// Sync walks the listing for params. It stops at the first listing error or when ctx is
+// cancelled; failed downloads are recorded and do not stop it.
+func (s *Syncer) Sync(ctx context.Context, params QueryParameters) (SyncResult, error) {
+	var result SyncResult
+	cursor := ""
+	for {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		nextCursor, response, err := s.Source.GetModels(ctx, cursor, params)
+		if err != nil {
+			return result, fmt.Errorf("fetching page %d: %w", result.Pages+1, err)
+		}
+		result.Pages++
+
+		for _, model := range response.Items {
+			for _, version := range model.ModelVersions {
+				if err := s.syncVersion(ctx, model, version, &result); err != nil {
+					return result, err
+				}
+			}
+		}
+		if nextCursor == "" || (s.MaxPages > 0 && result.Pages >= s.MaxPages) {
+			return result, nil
+		}
+		cursor = nextCursor
+	}
+}
+
+// syncVersion handles the first file of a version that passes the filters. It only returns
+// an error if ctx was cancelled or the store failed.
+func (s *Syncer) syncVersion(ctx context.Context, model Model, version ModelVersion, result *SyncResult) error {
+	modelType := model.Type
+	if s.TypeFor != nil {
+		modelType = s.TypeFor(model, version)
+	}
+	key := EntryKey(version.ID)
+
+	for _, file := range version.Files {
+		candidate := Candidate{Model: model, Version: version, File: file, ModelType: modelType}
+		event := SyncEvent{Candidate: candidate, Key: key}
+		if reason := SkipReason(s.Filters, candidate); reason != "" {
+			result.Skipped++
+			event.Action, event.Reason = SyncSkipped, reason
+			s.emit(event)
+			continue
+		}
+
+		existing, err := s.Store.Entry(key)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return fmt.Errorf("reading %s: %w", key, err)
+		}
+		if err == nil && existing.Status == StatusDownloaded {
+			result.Existing++
+			event.Action = SyncExisting
+			s.emit(event)
+			return nil
+		}
+
+		dir, targetPath, err := TemplatePath(s.SavePath, s.PathTemplate, model, modelType, version, file)
+		if err != nil {
+			return err
+		}
+		cleaned := version
+		cleaned.Files, cleaned.Images = nil, nil
+		entry := DatabaseEntry{
+			ModelName:  model.Name,
+			ModelType:  modelType,
+			Version:    cleaned,
+			File:       file,
+			Timestamp:  time.Now().Unix(),
+			Creator:    model.Creator,
+			Filename:   filepath.Base(targetPath),
+			Folder:     filepath.Dir(dir),
+			VersionDir: dir,
+			Status:     StatusPending,
+		}
+		if err := s.Store.PutEntry(key, entry); err != nil {
+			return fmt.Errorf("recording %s: %w", key, err)
+		}
+
+		finalPath, receipt, fetchErr := s.Fetcher.Fetch(ctx, targetPath, file.DownloadUrl, file.Hashes, FileNameVersionID(modelType, version.ID))
+		if fetchErr != nil {
+			entry.Status = StatusError
+			entry.ErrorDetails = fetchErr.Error()
+			entry.ErrorCategory = string(failure.CategoryOf(fetchErr))
+			entry.ErrorReason = string(failure.ReasonOf(fetchErr))
+			if err := s.Store.PutEntry(key, entry); err != nil {
+				return fmt.Errorf("recording %s: %w", key, err)
+			}
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			result.Failed++
+			event.Action, event.Err = SyncFailed, fetchErr
+			s.emit(event)
+			return nil
+		}
+
+		entry.Status = StatusDownloaded
+		entry.Filename = filepath.Base(finalPath)
+		if helpers.IsEmbeddingType(modelType) {
+			entry.EmbeddingToken = helpers.EmbeddingToken(entry.Filename)
+		}
+		if err := s.Store.PutEntry(key, entry); err != nil {
+			return fmt.Errorf("recording %s: %w", key, err)
+		}
+		result.Downloaded++
+		if receipt != nil {
+			result.Bytes += receipt.BytesWritten
+		}
+		event.Action, event.Path, event.Receipt = SyncDownloaded, finalPath, receipt
+		s.emit(event)
+		return nil
+	}
+	return nil
+}
+
+func (s *Syncer) emit(event SyncEvent) {
+	if s.OnEvent != nil {
+		s.OnEvent(event)
+	}
+}
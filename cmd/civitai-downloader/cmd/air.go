@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// sidecarAIRKey is the top-level sidecar field with the AIR of the version (or model).
+const sidecarAIRKey = "air"
+
+// applyAIRTarget turns download --air into the model or version ID to download: an AIR
+// with @version sets --model-version-id, one without sets --model-id.
+func applyAIRTarget() {
+	value := strings.TrimSpace(viper.GetString("air"))
+	if value == "" {
+		return
+	}
+	air, err := helpers.ParseAIR(value)
+	if err != nil {
+		log.Fatalf("Invalid --air: %v", err)
+	}
+	if air.VersionID > 0 {
+		viper.Set("modelversionid", air.VersionID)
+	} else {
+		viper.Set("modelid", air.ModelID)
+	}
+}
+
+// modelIDArg reads a model ID argument, given as a number or an AIR.
+func modelIDArg(arg string) (int, error) {
+	if helpers.IsAIR(arg) {
+		air, err := helpers.ParseAIR(arg)
+		return air.ModelID, err
+	}
+	id, err := strconv.Atoi(strings.TrimSpace(arg))
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("invalid model ID %q", arg)
+	}
+	return id, nil
+}
+
+// entryAIR returns the AIR of a stored entry's version.
+func entryAIR(entry models.DatabaseEntry) string {
+	return helpers.NewAIR(entry.ModelType, entry.Version.BaseModel, entry.Version.ModelId, entry.Version.ID).String()
+}
+
+// downloadAIR returns the AIR of the version a download job is for.
+func downloadAIR(pd potentialDownload) string {
+	modelID := pd.FullVersion.ModelId
+	if modelID == 0 {
+		modelID = pd.CleanedVersion.ModelId
+	}
+	return helpers.NewAIR(pd.ModelType, pd.BaseModel, modelID, pd.ModelVersionID).String()
+}
+
+// modelAIR returns the AIR of a model, in the ecosystem of its newest version.
+func modelAIR(model models.Model) string {
+	baseModel := ""
+	if len(model.ModelVersions) > 0 {
+		baseModel = model.ModelVersions[0].BaseModel
+	}
+	return helpers.NewAIR(model.Type, baseModel, model.ID, 0).String()
+}
@@ -0,0 +1,205 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/database"
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+)
+
+// analyzeCmd reports on the content of the downloaded files
+var analyzeCmd = &cobra.Command{
+	Use:   "analyze",
+	Short: "Analyze the content of downloaded model files (experimental)",
+	Long: `Reports on what the downloaded files hold, read from the files themselves rather
+than from Civitai. Nothing is changed; the reports are meant to guide pruning a large
+collection.
+
+--similar (experimental) groups the downloaded LoRAs (LORA, LoCon and DoRA, --type)
+that were likely trained from the same dataset, or are near-duplicates of each other,
+from their safetensors headers alone:
+
+  - the same weights (sshs_model_hash) or training run (session ID) count as identical
+  - otherwise the training tags (ss_tag_frequency) are compared, tags most LoRAs of
+    the collection have ("1girl", "solo") counting little, along with the dataset
+    folders, the output name without version and epoch suffixes, and the tensor
+    names and shapes (the network layout, not the precision)
+
+LoRAs at least --threshold alike (0-1), directly or through another one, form a group.
+Groups are listed largest first, with their files, their size and why they were
+grouped. LoRAs trained without kohya-style metadata can only be grouped by their
+output name and shapes, so they are rarely found.`,
+	Example: `  civitai-downloader analyze --similar
+  civitai-downloader analyze --similar --threshold 0.9 --json`,
+	Args: cobra.NoArgs,
+	Run:  runAnalyze,
+}
+
+func init() {
+	rootCmd.AddCommand(analyzeCmd)
+	analyzeCmd.Flags().Bool("similar", false, "Group LoRAs likely trained from the same dataset or near-duplicates (experimental)")
+	analyzeCmd.Flags().Float64("threshold", 0.8, "Least similarity (0-1) of two LoRAs of a --similar group")
+	analyzeCmd.Flags().StringSlice("type", []string{"LORA", "LoCon", "DoRA"}, "Model types --similar compares")
+	analyzeCmd.Flags().Bool("json", false, "Print the report as JSON")
+}
+
+// similarLora is a downloaded LoRA file of a --similar group.
+type similarLora struct {
+	ModelID   int    `json:"modelId"`
+	VersionID int    `json:"versionId"`
+	Model     string `json:"model"`
+	Version   string `json:"version"`
+	BaseModel string `json:"baseModel"`
+	Path      string `json:"path"`
+	Size      int64  `json:"size"`
+}
+
+// similarLink is a pair of LoRAs of a --similar group and why they are alike.
+type similarLink struct {
+	A          string   `json:"a"` // Paths
+	B          string   `json:"b"`
+	Similarity float64  `json:"similarity"`
+	Reasons    []string `json:"reasons"`
+}
+
+// similarGroup is a group of LoRAs --similar found alike.
+type similarGroup struct {
+	Members   []similarLora `json:"members"`
+	TotalSize int64         `json:"totalSize"`
+	Links     []similarLink `json:"links"`
+}
+
+func runAnalyze(cmd *cobra.Command, args []string) {
+	similar, _ := cmd.Flags().GetBool("similar")
+	threshold, _ := cmd.Flags().GetFloat64("threshold")
+	types, _ := cmd.Flags().GetStringSlice("type")
+	asJSON, _ := cmd.Flags().GetBool("json")
+
+	if !similar {
+		log.Fatal("Choose a report: --similar")
+	}
+	if threshold <= 0 || threshold > 1 {
+		log.Fatal("--threshold must be above 0 and at most 1")
+	}
+	if globalConfig.DatabasePath == "" || globalConfig.SavePath == "" {
+		log.Fatal("DatabasePath and SavePath must be set in the configuration.")
+	}
+	db, err := database.Open(globalConfig.DatabasePath)
+	if err != nil {
+		log.WithError(err).Fatalf("Failed to open database at %s", globalConfig.DatabasePath)
+	}
+	defer db.Close()
+	loadPathOverrides(db)
+
+	loras, profiles, err := collectLoraProfiles(db, types)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to read the database")
+	}
+	log.Infof("Comparing %d LoRA file(s)...", len(loras))
+	groups := similarGroups(loras, helpers.ClusterLoras(profiles, threshold))
+
+	if asJSON {
+		if groups == nil {
+			groups = []similarGroup{}
+		}
+		data, err := json.MarshalIndent(groups, "", "  ")
+		if err != nil {
+			log.WithError(err).Fatal("Failed to encode the report")
+		}
+		fmt.Println(string(data))
+		return
+	}
+	printSimilarGroups(groups, len(loras))
+}
+
+// collectLoraProfiles reads the safetensors headers of the downloaded files of the given
+// model types, sorted by path. Files that are missing or aren't safetensors are left out.
+func collectLoraProfiles(db *database.DB, types []string) ([]similarLora, []helpers.LoraProfile, error) {
+	var loras []similarLora
+	err := db.Fold(func(key []byte, value []byte) error {
+		if !strings.HasPrefix(string(key), "v_") {
+			return nil
+		}
+		var entry models.DatabaseEntry
+		if json.Unmarshal(value, &entry) != nil || entry.Status != models.StatusDownloaded || !containsFold(types, entry.ModelType) {
+			return nil
+		}
+		if !strings.EqualFold(filepath.Ext(entry.Filename), ".safetensors") {
+			return nil
+		}
+		loras = append(loras, similarLora{
+			ModelID:   entry.Version.ModelId,
+			VersionID: entry.Version.ID,
+			Model:     entry.ModelName,
+			Version:   entry.Version.Name,
+			BaseModel: entry.Version.BaseModel,
+			Path:      entryFilePath(globalConfig.SavePath, entry),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Slice(loras, func(i, j int) bool { return loras[i].Path < loras[j].Path })
+
+	kept := loras[:0]
+	var profiles []helpers.LoraProfile
+	for _, l := range loras {
+		info, err := os.Stat(l.Path)
+		if err != nil {
+			log.WithError(err).Debugf("Skipping %s", l.Path)
+			continue
+		}
+		header, err := helpers.ReadSafetensorsHeader(l.Path)
+		if err != nil {
+			log.WithError(err).Warnf("Failed to read the safetensors header of %s; skipping it", l.Path)
+			continue
+		}
+		l.Size = info.Size()
+		kept = append(kept, l)
+		profiles = append(profiles, helpers.NewLoraProfile(header))
+	}
+	return kept, profiles, nil
+}
+
+// similarGroups returns the clusters of loras as report groups.
+func similarGroups(loras []similarLora, clusters []helpers.LoraCluster) []similarGroup {
+	var groups []similarGroup
+	for _, c := range clusters {
+		var g similarGroup
+		for _, i := range c.Members {
+			g.Members = append(g.Members, loras[i])
+			g.TotalSize += loras[i].Size
+		}
+		for _, link := range c.Links {
+			g.Links = append(g.Links, similarLink{A: loras[link.A].Path, B: loras[link.B].Path, Similarity: link.Score, Reasons: link.Reasons})
+		}
+		groups = append(groups, g)
+	}
+	return groups
+}
+
+// printSimilarGroups prints each group with its files and the pairs that joined it.
+func printSimilarGroups(groups []similarGroup, compared int) {
+	grouped := 0
+	for i, g := range groups {
+		grouped += len(g.Members)
+		fmt.Printf("Group %d: %d LoRAs, %s\n", i+1, len(g.Members), helpers.BytesToSize(uint64(g.TotalSize)))
+		for _, m := range g.Members {
+			fmt.Printf("  %s - %s (%d, %s, %s)\n        %s\n", m.Model, m.Version, m.VersionID, m.BaseModel, helpers.BytesToSize(uint64(m.Size)), m.Path)
+		}
+		for _, link := range g.Links {
+			fmt.Printf("  %3.0f%%  %s ~ %s: %s\n", link.Similarity*100, filepath.Base(link.A), filepath.Base(link.B), strings.Join(link.Reasons, "; "))
+		}
+	}
+	fmt.Printf("%d of %d LoRA file(s) are in %d group(s) of similar LoRAs.\n", grouped, compared, len(groups))
+}
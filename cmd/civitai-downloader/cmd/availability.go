@@ -0,0 +1,35 @@
+package cmd
+
+import "github.com/dreamfast/go-civitai-downloader/internal/models"
+
+// Availability of an entry's file, as exports and the serve API report it, so tools
+// reading them can tell files that are there from soft-deleted ones.
+const (
+	availabilityActive          = "active"           // Downloaded and in the archive
+	availabilityRemovedUpstream = "removed_upstream" // Civitai removed the version; the local copy is kept
+	availabilityTrashed         = "trashed"          // Pruned, or moved out of the archive by RemovalPolicy "move"
+	availabilityQuarantined     = "quarantined"      // Failed verification and moved to the quarantine directory
+	availabilityNotDownloaded   = "not_downloaded"   // Pending, cataloged, deferred or failed
+)
+
+// entryAvailability returns the availability of an entry's file.
+func entryAvailability(entry models.DatabaseEntry) string {
+	switch {
+	case entry.QuarantinedAt != 0:
+		return availabilityQuarantined
+	case entry.Status == models.StatusPruned || entry.RemovalAction == "moved":
+		return availabilityTrashed
+	case entry.Status != models.StatusDownloaded:
+		return availabilityNotDownloaded
+	case entry.RemovedAt != 0:
+		return availabilityRemovedUpstream
+	}
+	return availabilityActive
+}
+
+// entryAvailable reports whether an entry's file can be used: active, or removed upstream
+// with the local copy kept.
+func entryAvailable(entry models.DatabaseEntry) bool {
+	availability := entryAvailability(entry)
+	return availability == availabilityActive || availability == availabilityRemovedUpstream
+}
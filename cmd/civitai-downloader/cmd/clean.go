@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	// Use correct relative paths for internal packages
 
@@ -12,19 +13,49 @@ import (
 	"github.com/spf13/cobra"
 )
 
+// isWithinDir reports whether path is dir or somewhere below it.
+func isWithinDir(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// partialModTime returns when the partial download at path (a .part file or its .part.ckpt
+// checkpoint) was last written to: the later of the two files' times, so a pair is always
+// removed together.
+func partialModTime(path string, info os.FileInfo) time.Time {
+	other := path + ".ckpt"
+	if strings.HasSuffix(strings.ToLower(path), ".ckpt") {
+		other = path[:len(path)-len(".ckpt")]
+	}
+	modTime := info.ModTime()
+	if otherInfo, err := os.Stat(other); err == nil && otherInfo.ModTime().After(modTime) {
+		modTime = otherInfo.ModTime()
+	}
+	return modTime
+}
+
 func init() {
 	// Assumes rootCmd is defined in root.go within the same package
 	rootCmd.AddCommand(cleanCmd)
 
 	cleanCmd.Flags().BoolP("torrents", "t", false, "Also remove *.torrent files")
 	cleanCmd.Flags().BoolP("magnets", "m", false, "Also remove *-magnet.txt files")
+	cleanCmd.Flags().BoolP("partials", "p", false, "Also remove stale partial downloads (*.part, *.part.ckpt) from TempDir")
+	cleanCmd.Flags().Duration("partial-age", 7*24*time.Hour, "With --partials, only remove partial downloads not written to for this long (0: all of them)")
 }
 
 var cleanCmd = &cobra.Command{
 	Use:   "clean",
-	Short: "Remove temporary (.tmp) files from the download directory",
+	Short: "Remove temporary (.tmp) files and stale partial downloads",
 	Long: `Recursively scans the configured SavePath and removes any files ending with the .tmp extension.
-Optionally removes *.torrent and *-magnet.txt files as well.`,
+The TempDir staging directory is scanned as well when it lives outside SavePath.
+Optionally removes *.torrent and *-magnet.txt files as well.
+
+With --partials, partial downloads left in TempDir by interrupted runs (*.part and their
+*.part.ckpt resume checkpoints) are removed too, once they haven't been written to for
+--partial-age (7 days by default). A removed partial is downloaded again from the start
+the next time; keep the age above the length of a run, as a download in progress writes
+to its partial file.`,
 	Run: runClean,
 }
 
@@ -36,6 +67,8 @@ func runClean(cmd *cobra.Command, args []string) {
 	// Get flag values
 	cleanTorrents, _ := cmd.Flags().GetBool("torrents")
 	cleanMagnets, _ := cmd.Flags().GetBool("magnets")
+	cleanPartials, _ := cmd.Flags().GetBool("partials")
+	partialAge, _ := cmd.Flags().GetDuration("partial-age")
 
 	// --- Path Validation --- (Moved up slightly)
 	if savePath == "" {
@@ -69,12 +102,16 @@ func runClean(cmd *cobra.Command, args []string) {
 	if cleanMagnets {
 		logLine += " (and *-magnet.txt files)"
 	}
+	tempDir := downloadTempDir()
+	if cleanPartials {
+		logLine += fmt.Sprintf(" (and partial downloads older than %s in %s)", partialAge, tempDir)
+	}
 	log.Info(logLine + "...")
 
-	var tmpRemoved, torrentRemoved, magnetRemoved int64
+	var tmpRemoved, torrentRemoved, magnetRemoved, partialRemoved int64
 	var filesFailed int64
 
-	walkErr := filepath.Walk(savePath, func(path string, info os.FileInfo, err error) error {
+	cleanFile := func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			log.Warnf("Error accessing path %q during scan: %v", path, err)
 			return nil
@@ -97,6 +134,10 @@ func runClean(cmd *cobra.Command, args []string) {
 		} else if cleanMagnets && strings.HasSuffix(lowerName, "-magnet.txt") {
 			shouldRemove = true
 			fileType = "-magnet.txt"
+		} else if cleanPartials && (strings.HasSuffix(lowerName, ".part") || strings.HasSuffix(lowerName, ".part.ckpt")) &&
+			isWithinDir(path, tempDir) && time.Since(partialModTime(path, info)) >= partialAge {
+			shouldRemove = true
+			fileType = "partial"
 		}
 
 		if shouldRemove {
@@ -119,14 +160,27 @@ func runClean(cmd *cobra.Command, args []string) {
 					torrentRemoved++
 				case "-magnet.txt":
 					magnetRemoved++
+				case "partial":
+					partialRemoved++
 				}
 			}
 		}
 		return nil // Continue walking
-	})
+	}
 
-	if walkErr != nil {
-		log.Errorf("Error during directory walk of %q: %v", savePath, walkErr)
+	// The staging dir is scanned too when it lives outside SavePath
+	roots := []string{savePath}
+	if !isWithinDir(tempDir, savePath) {
+		if _, err := os.Stat(tempDir); err == nil {
+			roots = append(roots, tempDir)
+		}
+	}
+	var walkErr error
+	for _, root := range roots {
+		if err := filepath.Walk(root, cleanFile); err != nil {
+			log.Errorf("Error during directory walk of %q: %v", root, err)
+			walkErr = err
+		}
 	}
 
 	// Build summary string
@@ -140,6 +194,9 @@ func runClean(cmd *cobra.Command, args []string) {
 	if magnetRemoved > 0 {
 		summaryParts = append(summaryParts, fmt.Sprintf("%d -magnet.txt file(s)", magnetRemoved))
 	}
+	if partialRemoved > 0 {
+		summaryParts = append(summaryParts, fmt.Sprintf("%d partial download file(s)", partialRemoved))
+	}
 
 	summary := "Clean complete. Removed: "
 	if len(summaryParts) > 0 {
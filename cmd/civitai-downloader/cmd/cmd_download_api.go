@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -10,10 +11,13 @@ import (
 	"strings"
 	"time"
 
-	"go-civitai-download/internal/database"
-	"go-civitai-download/internal/downloader"
-	"go-civitai-download/internal/helpers"
-	"go-civitai-download/internal/models"
+	"github.com/dreamfast/go-civitai-downloader/civitai"
+	"github.com/dreamfast/go-civitai-downloader/internal/api"
+	"github.com/dreamfast/go-civitai-downloader/internal/database"
+	"github.com/dreamfast/go-civitai-downloader/internal/downloader"
+	"github.com/dreamfast/go-civitai-downloader/internal/failure"
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -22,18 +26,49 @@ import (
 
 // --- Retry Logic Helper --- START ---
 
+// apiRequests coalesces identical API GETs that are in flight at the same time (the same
+// model or version looked up by several workers), so they make one request.
+var apiRequests helpers.Coalescer
+
+// apiResult is the outcome of a request shared through apiRequests.
+type apiResult struct {
+	resp *http.Response
+	body []byte
+}
+
 // doRequestWithRetry performs an HTTP request with exponential backoff retries.
-// It retries on network errors and specific HTTP status codes (5xx, 408, 429, 504).
+// It retries on network errors and on the HTTP statuses of globalRetryPolicy (408, 429,
+// 5xx and RetryStatusCodes), stretching the backoff by the status's multiplier.
+// A GET while the same GET (same URL and credentials) is running waits for that one and
+// returns its response and body, which callers must therefore not modify.
 func doRequestWithRetry(client *http.Client, req *http.Request, maxRetries int, initialRetryDelay time.Duration, logPrefix string) (*http.Response, []byte, error) {
+	if req.Method != http.MethodGet || req.Body != nil {
+		return doRequestWithRetryOnce(client, req, maxRetries, initialRetryDelay, logPrefix)
+	}
+	key := req.URL.String() + "\x00" + req.Header.Get("Authorization")
+	result, err, shared := apiRequests.Do(key, func() (interface{}, error) {
+		resp, body, err := doRequestWithRetryOnce(client, req, maxRetries, initialRetryDelay, logPrefix)
+		return apiResult{resp: resp, body: body}, err
+	})
+	if shared {
+		log.Debugf("[%s] Shared the response for %s with concurrent identical requests", logPrefix, req.URL.Redacted())
+	}
+	r := result.(apiResult)
+	return r.resp, r.body, err
+}
+
+// doRequestWithRetryOnce is doRequestWithRetry without coalescing.
+func doRequestWithRetryOnce(client *http.Client, req *http.Request, maxRetries int, initialRetryDelay time.Duration, logPrefix string) (*http.Response, []byte, error) {
 	var resp *http.Response
 	var err error
 	var bodyBytes []byte
 	_ = bodyBytes // Explicitly use bodyBytes to satisfy linter (used indirectly in logging/errors)
 
+	lastStatus := 0 // Status of the previous attempt (0 after a network error)
 	for attempt := 0; attempt <= maxRetries; attempt++ {
 		if attempt > 0 {
-			// Calculate backoff: initial * 2^(attempt-1)
-			backoff := initialRetryDelay * time.Duration(1<<(attempt-1))
+			// Calculate backoff: initial * 2^(attempt-1), times the multiplier of the last status
+			backoff := globalRetryPolicy.Backoff(lastStatus, initialRetryDelay*time.Duration(1<<(attempt-1)))
 			log.Infof("[%s] Retrying request for %s in %v (Attempt %d/%d)...", logPrefix, req.URL.String(), backoff, attempt+1, maxRetries+1)
 			time.Sleep(backoff)
 		}
@@ -54,6 +89,7 @@ func doRequestWithRetry(client *http.Client, req *http.Request, maxRetries int,
 		log.Debugf("[%s] Attempt %d/%d: Sending request to %s", logPrefix, attempt+1, maxRetries+1, clonedReq.URL.String())
 		resp, err = client.Do(clonedReq)
 
+		lastStatus = 0
 		if err != nil {
 			// Network-level error
 			log.WithError(err).Warnf("[%s] Attempt %d/%d failed for %s: %v", logPrefix, attempt+1, maxRetries+1, clonedReq.URL.String(), err)
@@ -78,8 +114,10 @@ func doRequestWithRetry(client *http.Client, req *http.Request, maxRetries int,
 			continue // Retry
 		}
 
-		// Check status code
-		if resp.StatusCode == http.StatusOK {
+		// Check status code; a web page instead of JSON is a challenge or a proxy error
+		page := failure.Response{Status: resp.StatusCode, Header: resp.Header, Body: bodyBytes, WithAPIKey: clonedReq.Header.Get("Authorization") != ""}
+		challenged := failure.IsChallenge(page)
+		if resp.StatusCode == http.StatusOK && !failure.IsHTML(resp.Header, bodyBytes) {
 			log.Debugf("[%s] Attempt %d/%d successful for %s", logPrefix, attempt+1, maxRetries+1, clonedReq.URL.String())
 			return resp, bodyBytes, nil // Success!
 		}
@@ -92,10 +130,9 @@ func doRequestWithRetry(client *http.Client, req *http.Request, maxRetries int,
 		log.Warnf("[%s] Attempt %d/%d for %s failed with status %s. Body: %s", logPrefix, attempt+1, maxRetries+1, clonedReq.URL.String(), resp.Status, bodySample)
 
 		// Check if status code is retryable
-		isRetryableStatus := resp.StatusCode >= 500 || // Server errors
-			resp.StatusCode == http.StatusRequestTimeout || // 408
-			resp.StatusCode == http.StatusTooManyRequests || // 429
-			resp.StatusCode == http.StatusGatewayTimeout // 504
+		lastStatus = resp.StatusCode
+		isRetryableStatus := globalRetryPolicy.Retryable(resp.StatusCode) ||
+			challenged || resp.StatusCode == http.StatusOK // Retried after the challenge cool-down
 
 		if isRetryableStatus && attempt < maxRetries {
 			log.Warnf("[%s] Status %s is retryable.", logPrefix, resp.Status)
@@ -108,7 +145,7 @@ func doRequestWithRetry(client *http.Client, req *http.Request, maxRetries int,
 			}
 			// Include body sample in final error if it's not success
 			errMsg += fmt.Sprintf(". Body: %s", bodySample)
-			return resp, bodyBytes, fmt.Errorf(errMsg)
+			return resp, bodyBytes, failure.Interpret(errors.New(errMsg), page)
 		}
 	} // End of retry loop
 
@@ -118,58 +155,63 @@ func doRequestWithRetry(client *http.Client, req *http.Request, maxRetries int,
 
 // --- Retry Logic Helper --- END ---
 
-// passesFileFilters checks if a given file passes the configured file-level filters.
-func passesFileFilters(file models.File, modelType string) bool {
+// checkSchemaEnums reports model/file type values the downloader doesn't know about yet.
+// Only returns an error in --strict-api mode; otherwise each new value is logged once.
+func checkSchemaEnums(label string, modelType string, versions []models.ModelVersion) error {
+	if err := api.CheckEnum(label, "type", modelType, api.KnownModelTypes); err != nil {
+		return err
+	}
+	for _, version := range versions {
+		for _, file := range version.Files {
+			if err := api.CheckEnum(label, "modelVersions[].files[].type", file.Type, api.KnownFileTypes); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// passesFileFilters checks if a candidate file passes ExcludeRestricted, the configured
+// file-level filters and the FilterExpression/FilterCommand plugins.
+func passesFileFilters(candidate civitai.Candidate) bool {
+	file := candidate.File
+	// Restricted categories first: nothing else can let them through
+	if reason := restrictionFilter.SkipReason(candidate); reason != "" {
+		log.WithField(failure.LogField, failure.Filtered).Infof("Skipping file %s of %s: %s.", file.Name, candidate.Model.Name, reason)
+		return false
+	}
 	// Check hash presence (essential)
 	if file.Hashes.CRC32 == "" {
 		log.Debugf("Skipping file %s: Missing CRC32 hash.", file.Name)
 		return false
 	}
-
-	// Check primary file filter
-	if viper.GetBool("primaryonly") && !file.Primary {
-		log.Debugf("Skipping non-primary file %s.", file.Name)
+	// Training data is never mixed with the model files (see IncludeTrainingData)
+	if file.Type == trainingDataFileType {
+		if viper.GetBool("includetrainingdata") {
+			log.Debugf("Skipping file %s as a model file: training data, downloaded with the version's model file.", file.Name)
+		} else {
+			log.WithField(failure.LogField, failure.Filtered).Debugf("Skipping file %s: training data (see --include-training-data).", file.Name)
+		}
 		return false
 	}
 
-	// Check format (basic check)
-	if file.Metadata.Format == "" {
-		log.Debugf("Skipping file %s: Missing metadata format.", file.Name)
-		return false
+	filter := civitai.FileFilter{
+		PrimaryOnly:           viper.GetBool("primaryonly"),
+		Pruned:                viper.GetBool("pruned"),
+		Fp16:                  viper.GetBool("fp16"),
+		IgnoreFileNameStrings: viper.GetStringSlice("ignorefilenamestrings"),
+		FileFormats:           viper.GetStringSlice("fileformats"),
+		EmbeddingFormats:      viper.GetStringSlice("embeddingformats"),
 	}
-	// TODO: Make acceptable formats configurable?
-	if strings.ToLower(file.Metadata.Format) != "safetensor" {
-		log.Debugf("Skipping non-safetensor file %s (Format: %s).", file.Name, file.Metadata.Format)
+	if reason := filter.SkipReason(candidate); reason != "" {
+		log.WithField(failure.LogField, failure.Filtered).Debugf("Skipping file %s: %s.", file.Name, reason)
 		return false
 	}
-
-	// Check checkpoint-specific filters (pruned, fp16)
-	if strings.EqualFold(modelType, "checkpoint") {
-		sizeStr := fmt.Sprintf("%v", file.Metadata.Size)
-		fpStr := fmt.Sprintf("%v", file.Metadata.Fp)
-
-		if viper.GetBool("pruned") && !strings.EqualFold(sizeStr, "pruned") {
-			log.Debugf("Skipping non-pruned file %s (Size: %s) in checkpoint model.", file.Name, sizeStr)
-			return false
-		}
-		if viper.GetBool("fp16") && !strings.EqualFold(fpStr, "fp16") {
-			log.Debugf("Skipping non-fp16 file %s (FP: %s) in checkpoint model.", file.Name, fpStr)
-			return false
-		}
-	}
-
-	// --- Filter by ignored filename substrings --- (Case-Insensitive)
-	ignoredFilenameStrings := viper.GetStringSlice("ignorefilenamestrings") // Use Viper
-	if len(ignoredFilenameStrings) > 0 {
-		for _, ignoreFileName := range ignoredFilenameStrings {
-			if ignoreFileName != "" && strings.Contains(strings.ToLower(file.Name), strings.ToLower(ignoreFileName)) {
-				log.Debugf("      - Skipping file %s: Filename contains ignored string '%s'.", file.Name, ignoreFileName)
-				return false
-			}
-		}
+	// Plugins last: they can be slow (a process per file for FilterCommand)
+	if reason := civitai.SkipReason(pluginFilters, candidate); reason != "" {
+		log.WithField(failure.LogField, failure.Filtered).Infof("Skipping file %s of %s: %s.", file.Name, candidate.Model.Name, reason)
+		return false
 	}
-
-	// If all checks passed
 	return true
 }
 
@@ -189,12 +231,14 @@ func handleSingleVersionDownload(versionID int, db *database.DB, client *http.Cl
 
 	// --- Use Retry Helper ---
 	maxRetries := viper.GetInt("maxretries")
-	initialRetryDelay := time.Duration(viper.GetInt("initialretrydelayms")) * time.Millisecond
-	// Assign the unused resp to the blank identifier `_`
-	_, bodyBytes, err := doRequestWithRetry(client, req, maxRetries, initialRetryDelay, logPrefix)
+	initialRetryDelay := globalRetryDelay
+	resp, bodyBytes, err := doRequestWithRetry(client, req, maxRetries, initialRetryDelay, logPrefix)
 	// --- End Use Retry Helper ---
 
 	if err != nil {
+		if resp != nil && (resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone) {
+			noteMissingVersion(db, versionID, cfg.SavePath) // Possibly only hidden for now
+		}
 		// Error already includes context from doRequestWithRetry (status, attempts)
 		// We might add a bit more context here if needed.
 		// If resp is not nil, the error message likely contains the status code.
@@ -214,13 +258,16 @@ func handleSingleVersionDownload(versionID int, db *database.DB, client *http.Cl
 	// bodyBytes contains the successful response body.
 
 	var versionResponse models.ModelVersion // Use the updated struct from models.go
-	if err := json.Unmarshal(bodyBytes, &versionResponse); err != nil {
+	if err := api.Decode(bodyBytes, &versionResponse, "model-version"); err != nil {
 		log.WithError(err).Errorf("Response body sample: %s", string(bodyBytes[:min(len(bodyBytes), 200)]))
 		return nil, 0, fmt.Errorf("failed to decode API response for version %d: %w", versionID, err)
 	}
 
 	log.Infof("Successfully fetched details for version %d (%s) of model %s (%s)",
 		versionResponse.ID, versionResponse.Name, versionResponse.Model.Name, versionResponse.Model.Type)
+	if err := checkSchemaEnums("model-version", versionResponse.Model.Type, []models.ModelVersion{versionResponse}); err != nil {
+		return nil, 0, err
+	}
 
 	// --- Convert to potentialDownload ---
 	var potentialDownloadsPage []potentialDownload
@@ -233,27 +280,22 @@ func handleSingleVersionDownload(versionID int, db *database.DB, client *http.Cl
 
 	for _, file := range versionResponse.Files {
 		// Use the new shared filtering function
-		if !passesFileFilters(file, versionResponse.Model.Type) {
-			continue // Skip this file if it doesn't pass filters
+		modelType := modelTypeFor(versionResponse.ModelId, versionResponse.ID, versionResponse.Model.Type)
+		model := models.Model{
+			ID:      versionResponse.ModelId,
+			Name:    versionResponse.Model.Name,
+			Type:    versionResponse.Model.Type,
+			Nsfw:    versionResponse.Model.Nsfw,
+			Poi:     versionResponse.Model.Poi,
+			Minor:   versionResponse.Model.Minor,
+			Creator: placeholderCreator,
 		}
-
-		// --- Path/Filename Construction (Copied/adapted from pagination loop) ---
-		var slug string
-		modelTypeName := helpers.ConvertToSlug(versionResponse.Model.Type)
-		baseModelStr := versionResponse.BaseModel
-		if baseModelStr == "" {
-			baseModelStr = "unknown-base"
+		if !passesFileFilters(civitai.Candidate{Model: model, Version: versionResponse, File: file, ModelType: modelType}) {
+			continue // Skip this file if it doesn't pass filters
 		}
-		baseModelSlug := helpers.ConvertToSlug(baseModelStr)
-		modelNameSlug := helpers.ConvertToSlug(versionResponse.Model.Name)
-		// --- Modify slug construction for type/base/model structure ---
-		slug = filepath.Join(modelTypeName, modelNameSlug, baseModelSlug)
-		// --- End slug construction modification ---
 
-		// --- Create version specific slug based on file name (without extension) ---
-		fileNameWithoutExt := strings.TrimSuffix(file.Name, filepath.Ext(file.Name))
-		versionSlug := fmt.Sprintf("%d-%s", versionResponse.ID, helpers.ConvertToSlug(fileNameWithoutExt))
-		// --- End version specific slug ---
+		// --- Path/Filename Construction (directory from PathTemplate, like the pagination loop) ---
+		versionDir, templatePath := targetPathFor(cfg.SavePath, models.Model{ID: versionResponse.ModelId, Name: versionResponse.Model.Name, Creator: placeholderCreator}, modelType, versionResponse, file)
 
 		baseFileName := helpers.ConvertToSlug(file.Name)
 		ext := filepath.Ext(baseFileName)
@@ -268,7 +310,7 @@ func handleSingleVersionDownload(versionID int, db *database.DB, client *http.Cl
 		finalBaseFilenameOnly := baseFileName + ext
 		dbKeySimple := strings.ToUpper(file.Hashes.CRC32)
 		metaSuffixParts := []string{dbKeySimple}
-		if strings.EqualFold(versionResponse.Model.Type, "checkpoint") {
+		if strings.EqualFold(modelType, "checkpoint") {
 			if fpStr := fmt.Sprintf("%v", file.Metadata.Fp); fpStr != "" {
 				metaSuffixParts = append(metaSuffixParts, helpers.ConvertToSlug(fpStr))
 			}
@@ -278,26 +320,32 @@ func handleSingleVersionDownload(versionID int, db *database.DB, client *http.Cl
 		}
 		metaSuffix := "-" + strings.Join(metaSuffixParts, "-")
 		constructedFileNameWithSuffix := baseFileName + metaSuffix + ext
-		// --- Modify directory path to include version ---
-		fullDirPath := filepath.Join(cfg.SavePath, slug, versionSlug)
-		// --- End directory path modification ---
+		fullDirPath := filepath.Join(cfg.SavePath, versionDir)
 		fullFilePath := filepath.Join(fullDirPath, constructedFileNameWithSuffix)
+		if helpers.IsEmbeddingType(modelType) {
+			// The file name is the embedding's activation token, so it gets no suffix
+			fullFilePath = templatePath
+			finalBaseFilenameOnly = filepath.Base(templatePath)
+		}
 		// --- End Path/Filename Construction ---
 
 		pd := potentialDownload{
 			ModelName:         versionResponse.Model.Name,
-			ModelType:         versionResponse.Model.Type,
+			ModelType:         modelType,
 			VersionName:       versionResponse.Name,
 			BaseModel:         versionResponse.BaseModel,
 			Creator:           placeholderCreator,
+			ModelNsfw:         versionResponse.Model.Nsfw, // The version response has no model tags
 			File:              file,
 			ModelVersionID:    versionResponse.ID,
 			TargetFilepath:    fullFilePath,
-			Slug:              slug,
+			Slug:              filepath.Dir(versionDir),
+			VersionDir:        versionDir,
 			FinalBaseFilename: finalBaseFilenameOnly,
 			CleanedVersion:    versionWithoutFilesImages,
 			FullVersion:       versionResponse,
 			OriginalImages:    versionResponse.Images,
+			RawVersion:        rawForSidecar(bodyBytes), // The whole response is the version
 		}
 		potentialDownloadsPage = append(potentialDownloadsPage, pd)
 		log.Debugf("Passed filters for single version: %s -> %s", file.Name, fullFilePath)
@@ -339,12 +387,14 @@ func handleSingleModelDownload(modelID int, db *database.DB, client *http.Client
 
 	// --- Use Retry Helper ---
 	maxRetries := viper.GetInt("maxretries")
-	initialRetryDelay := time.Duration(viper.GetInt("initialretrydelayms")) * time.Millisecond
-	// Assign the unused resp to the blank identifier `_`
-	_, bodyBytes, err := doRequestWithRetry(client, req, maxRetries, initialRetryDelay, logPrefix)
+	initialRetryDelay := globalRetryDelay
+	resp, bodyBytes, err := doRequestWithRetry(client, req, maxRetries, initialRetryDelay, logPrefix)
 	// --- End Use Retry Helper ---
 
 	if err != nil {
+		if resp != nil && (resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone) {
+			noteMissingModel(db, modelID, cfg.SavePath) // Possibly only hidden for now
+		}
 		// Error already includes context from doRequestWithRetry
 		finalErrMsg := fmt.Sprintf("failed to fetch model %d: %v", modelID, err)
 		if !strings.Contains(err.Error(), "Body:") && len(bodyBytes) > 0 {
@@ -359,13 +409,17 @@ func handleSingleModelDownload(modelID int, db *database.DB, client *http.Client
 	// Success case: resp.StatusCode == http.StatusOK and bodyBytes is valid
 
 	var modelResponse models.Model // Use the full Model struct
-	if err := json.Unmarshal(bodyBytes, &modelResponse); err != nil {
+	if err := api.Decode(bodyBytes, &modelResponse, "model"); err != nil {
 		log.WithError(err).Errorf("Response body sample: %s", string(bodyBytes[:min(len(bodyBytes), 200)]))
 		return nil, 0, fmt.Errorf("failed to decode API response for model %d: %w", modelID, err)
 	}
 
 	log.Infof("Successfully fetched details for model %d (%s) - Type: %s",
 		modelResponse.ID, modelResponse.Name, modelResponse.Type)
+	if err := checkSchemaEnums("model", modelResponse.Type, modelResponse.ModelVersions); err != nil {
+		return nil, 0, err
+	}
+	rawVersions := api.RawObjects(rawForSidecar(bodyBytes), "modelVersions") // Raw version JSON for sidecars
 
 	// --- Handle --model-info and --model-images --- (New Section)
 	saveFullInfo := viper.GetBool("savemodelinfo") // Viper key from download.go init
@@ -393,13 +447,11 @@ func handleSingleModelDownload(modelID int, db *database.DB, client *http.Client
 			}
 		}
 
-		// --- Modify slug construction for type/model structure (removing base model for info/images) ---
-		modelInfoSlug := filepath.Join(helpers.ConvertToSlug(modelResponse.Type), helpers.ConvertToSlug(modelResponse.Name))
-		// --- End slug construction modification ---
-		modelBaseDir := filepath.Join(cfg.SavePath, modelInfoSlug) // Path for model info/images
+		// Model info and images go to {type}/{model}, below the NSFW partition if there is one
+		modelBaseDir := modelDirFor(cfg.SavePath, modelResponse.Type, modelResponse.Name, modelResponse.ID, modelResponse.Nsfw, modelResponse.NsfwLevel)
 
 		// Pass the new modelBaseDir to saveModelInfoFile
-		if err := saveModelInfoFile(modelResponse, modelBaseDir); err != nil {
+		if err := saveModelInfoFile(modelResponse, bodyBytes, modelBaseDir); err != nil {
 			log.WithError(err).Warnf("Failed to save full model info for model %d (%s)", modelResponse.ID, modelResponse.Name)
 			// Don't stop processing just because info saving failed
 		}
@@ -421,6 +473,9 @@ func handleSingleModelDownload(modelID int, db *database.DB, client *http.Client
 				if concurrency <= 0 {
 					concurrency = 4
 				} // Default concurrency
+				if globalLowMemory {
+					concurrency = lowMemoryConcurrency
+				}
 
 				for _, version := range modelResponse.ModelVersions {
 					versionLogPrefix := fmt.Sprintf("%s v%d", logPrefix, version.ID)
@@ -498,7 +553,7 @@ func handleSingleModelDownload(modelID int, db *database.DB, client *http.Client
 			versionBaseModelLower := strings.ToLower(currentVersion.BaseModel)
 			for _, ignoreBaseModel := range ignoredBaseModels {
 				if ignoreBaseModel != "" && strings.Contains(versionBaseModelLower, strings.ToLower(ignoreBaseModel)) {
-					log.Debugf("    - Skipping version %s: Base model '%s' contains ignored string '%s'.", currentVersion.Name, currentVersion.BaseModel, ignoreBaseModel)
+					log.WithField(failure.LogField, failure.Filtered).Debugf("    - Skipping version %s: Base model '%s' contains ignored string '%s'.", currentVersion.Name, currentVersion.BaseModel, ignoreBaseModel)
 					continue // Skip to next version
 				}
 			}
@@ -512,61 +567,36 @@ func handleSingleModelDownload(modelID int, db *database.DB, client *http.Client
 	fileLoop: // Label for continue
 		for _, file := range currentVersion.Files { // Use files from currentVersion
 			// Use the shared filtering function
-			if !passesFileFilters(file, modelResponse.Type) {
+			modelType := modelTypeFor(modelResponse.ID, currentVersion.ID, modelResponse.Type)
+			if !passesFileFilters(civitai.Candidate{Model: modelResponse, Version: currentVersion, File: file, ModelType: modelType}) {
 				continue fileLoop // Skip this file if it doesn't pass filters
 			}
 
 			// --- Path/Filename Construction (using currentVersion) ---
-			var slug string // Now only used for file path
-			modelTypeName := helpers.ConvertToSlug(modelResponse.Type)
-			baseModelStr := currentVersion.BaseModel // Use currentVersion
-			if baseModelStr == "" {
-				baseModelStr = "unknown-base"
-			}
-			baseModelSlug := helpers.ConvertToSlug(baseModelStr)
-			modelNameSlug := helpers.ConvertToSlug(modelResponse.Name)
-			// --- Modify slug construction for type/model/base structure ---
-			slug = filepath.Join(modelTypeName, modelNameSlug, baseModelSlug) // Changed order for file path
-			// --- End slug construction modification ---
-
-			// --- Create version specific slug based on file name (without extension) ---
-			fileNameWithoutExt := strings.TrimSuffix(file.Name, filepath.Ext(file.Name))
-			versionSlug := fmt.Sprintf("%d-%s", currentVersion.ID, helpers.ConvertToSlug(fileNameWithoutExt))
-			// --- End version specific slug ---
-
-			baseFileName := helpers.ConvertToSlug(file.Name)
-			ext := filepath.Ext(baseFileName)
-			baseFileName = strings.TrimSuffix(baseFileName, ext)
-			if strings.ToLower(file.Metadata.Format) == "safetensor" && !strings.EqualFold(ext, ".safetensors") {
-				ext = ".safetensors"
-			}
-			if ext == "" {
-				ext = ".bin"
-				log.Warnf("File %s in version %s (%d) has no extension, defaulting to '.bin'", file.Name, currentVersion.Name, currentVersion.ID)
-			}
-			finalBaseFilenameOnly := baseFileName + ext
-			constructedFileNameOnly := baseFileName + ext // Just base + extension
-			// --- Modify directory path to include version ---
-			fullDirPath := filepath.Join(cfg.SavePath, slug, versionSlug)
-			// --- End directory path modification ---
-			fullFilePath := filepath.Join(fullDirPath, constructedFileNameOnly) // Use filename without suffix
-			// --- End Path/Filename Construction ---
+			versionDir, fullFilePath := targetPathFor(cfg.SavePath, modelResponse, modelType, currentVersion, file)
+			finalBaseFilenameOnly := filepath.Base(fullFilePath)
 
 			// Create potentialDownload using currentVersion data
 			pd := potentialDownload{
 				ModelName:         modelResponse.Name,
-				ModelType:         modelResponse.Type,
+				ModelType:         modelType,
 				VersionName:       currentVersion.Name,      // Use currentVersion
 				BaseModel:         currentVersion.BaseModel, // Use currentVersion
 				Creator:           modelResponse.Creator,
+				ModelNsfw:         modelResponse.Nsfw,
+				ModelNsfwLevel:    modelResponse.NsfwLevel,
+				ModelTags:         modelResponse.Tags,
+				Permissions:       modelResponse.Permissions(),
 				File:              file,
 				ModelVersionID:    currentVersion.ID, // Use currentVersion
 				TargetFilepath:    fullFilePath,      // Path without suffix
-				Slug:              slug,
+				Slug:              filepath.Dir(versionDir),
+				VersionDir:        versionDir,
 				FinalBaseFilename: finalBaseFilenameOnly,     // Keep original base+ext for reference
 				CleanedVersion:    versionWithoutFilesImages, // Use cleaned currentVersion
 				FullVersion:       currentVersion,            // Store the full original version data
 				OriginalImages:    currentVersion.Images,     // Use currentVersion images
+				RawVersion:        rawVersions[currentVersion.ID],
 			}
 			potentialDownloadsFromModel = append(potentialDownloadsFromModel, pd)
 			// Log the intended path *without* suffix for clarity in this phase
@@ -591,19 +621,170 @@ func handleSingleModelDownload(modelID int, db *database.DB, client *http.Client
 	return queuedFromModel, sizeFromModel, nil
 }
 
+// modelListParams returns the /models query parameters of a paginated run, without the cursor.
+func modelListParams(queryParams models.QueryParameters) url.Values {
+	params := url.Values{}
+	if queryParams.Limit > 0 {
+		params.Set("limit", fmt.Sprintf("%d", queryParams.Limit))
+	}
+	if queryParams.Query != "" {
+		params.Set("query", queryParams.Query)
+	}
+	if queryParams.Tag != "" {
+		params.Set("tag", queryParams.Tag)
+	}
+	if queryParams.Username != "" {
+		params.Set("username", queryParams.Username)
+	}
+	if len(queryParams.Types) > 0 {
+		params.Set("types", strings.Join(queryParams.Types, ","))
+	}
+	if queryParams.Sort != "" {
+		params.Set("sort", queryParams.Sort)
+	}
+	if queryParams.Period != "" {
+		params.Set("period", queryParams.Period)
+	}
+	if queryParams.Rating > 0 {
+		params.Set("rating", fmt.Sprintf("%d", queryParams.Rating))
+	}
+	if queryParams.Favorites {
+		params.Set("favorites", "true")
+	}
+	if queryParams.Hidden {
+		params.Set("hidden", "true")
+	}
+	if queryParams.PrimaryFileOnly {
+		params.Set("primaryFileOnly", "true")
+	}
+	if !queryParams.AllowNoCredit {
+		params.Set("allowNoCredit", "false")
+	}
+	if !queryParams.AllowDerivatives {
+		params.Set("allowDerivatives", "false")
+	}
+	if !queryParams.AllowDifferentLicenses {
+		params.Set("allowDifferentLicenses", "false")
+	}
+	if queryParams.AllowCommercialUse != "Any" {
+		params.Set("allowCommercialUse", queryParams.AllowCommercialUse)
+	}
+	if queryParams.Nsfw {
+		params.Set("nsfw", "true")
+	}
+	if len(queryParams.BaseModels) > 0 {
+		params.Set("baseModels", strings.Join(queryParams.BaseModels, ","))
+	}
+	return params
+}
+
+// fetchModelPage requests one page of the /models listing of queryParams, from cursor ("" for
+// the first page). It returns the models, their raw JSON (for sidecars) keyed by model ID,
+// and the cursor of the next page ("" if there is none).
+func fetchModelPage(client *http.Client, cfg *models.Config, queryParams models.QueryParameters, cursor string, pageCount int) ([]models.Model, map[int]json.RawMessage, string, error) {
+	maxRetries := viper.GetInt("maxretries")
+
+	// Construct API URL with query parameters
+	apiURL := "https://civitai.com/api/v1/models"
+	params := modelListParams(queryParams)
+	if cursor != "" {
+		params.Set("cursor", cursor)
+	}
+
+	fullURL := fmt.Sprintf("%s?%s", apiURL, params.Encode())
+	log.Debugf("API Request URL: %s", fullURL)
+	logPrefix := fmt.Sprintf("Page %d", pageCount) // For retry logging
+
+	req, err := http.NewRequest("GET", fullURL, nil)
+	if err != nil {
+		// This error is unlikely recoverable by retry, return directly.
+		return nil, nil, "", fmt.Errorf("failed to create request for page %d: %w", pageCount, err)
+	}
+	if cfg.ApiKey != "" { // Still need ApiKey from config
+		req.Header.Add("Authorization", "Bearer "+cfg.ApiKey)
+	}
+
+	_, bodyBytes, err := doRequestWithRetry(client, req, maxRetries, globalRetryDelay, logPrefix)
+	if err != nil {
+		// Error already includes context from doRequestWithRetry
+		finalErrMsg := fmt.Sprintf("failed to fetch page %d: %v", pageCount, err)
+		// Check if the error message already contains the body snippet
+		if !strings.Contains(err.Error(), "Body:") && len(bodyBytes) > 0 {
+			bodySample := string(bodyBytes)
+			if len(bodySample) > 200 {
+				bodySample = bodySample[:200] + "..."
+			}
+			finalErrMsg += fmt.Sprintf(". Last Body: %s", bodySample)
+		}
+		// Stop pagination on persistent error for a page
+		return nil, nil, "", errors.New(finalErrMsg)
+	}
+	downloadService.setPhase(fmt.Sprintf("listing models (page %d)", pageCount))
+
+	var response models.ApiResponse
+	if err := api.Decode(bodyBytes, &response, "models"); err != nil {
+		bodySample := string(bodyBytes)
+		if len(bodySample) > 500 { // Allow slightly more for JSON errors
+			bodySample = bodySample[:500] + "..."
+		}
+		return nil, nil, "", fmt.Errorf("failed to decode API response for page %d: %w. Body: %s", pageCount, err, bodySample)
+	}
+	if len(response.Items) == 0 {
+		return nil, nil, "", nil
+	}
+	rawItems := api.RawObjects(rawForSidecar(bodyBytes), "items") // Raw model JSON for sidecars, keyed by model ID
+
+	nextCursor := response.Metadata.NextCursor
+	if nextCursor != "" {
+		log.Debugf("API Metadata: TotalItems=%d, CurrentPage=%d, PageSize=%d, NextCursor=%s",
+			response.Metadata.TotalItems, response.Metadata.CurrentPage, response.Metadata.PageSize, response.Metadata.NextCursor)
+	} else {
+		log.Warn("API response missing next cursor.")
+	}
+	return response.Items, rawItems, nextCursor, nil
+}
+
 // fetchModelsPaginated handles the process of fetching models using API pagination.
-func fetchModelsPaginated(db *database.DB, client *http.Client, imageDownloader *downloader.Downloader, queryParams models.QueryParameters, cfg *models.Config, cmd *cobra.Command) ([]potentialDownload, uint64, error) {
+// If onPage is set, each page's queued downloads are passed to it as soon as the page is
+// processed instead of being collected and returned.
+func fetchModelsPaginated(db *database.DB, client *http.Client, imageDownloader *downloader.Downloader, queryParams models.QueryParameters, cfg *models.Config, cmd *cobra.Command, onPage func([]potentialDownload)) ([]potentialDownload, uint64, error) {
 	var allPotentialDownloads []potentialDownload
 	var totalQueuedSizeBytes uint64
 	pageCount := 0
 	processedModelCount := 0
 	nextCursor := "" // Start with no cursor
 
-	// Get max pages and retry config from Viper
-	maxPages := viper.GetInt("maxpages") // Viper key from download.go init
-	maxRetries := viper.GetInt("maxretries")
-	initialRetryDelay := time.Duration(viper.GetInt("initialretrydelayms")) * time.Millisecond
+	// Get max pages and API delay from Viper
+	maxPages := viper.GetInt("maxpages")     // Viper key from download.go init
 	apiDelayMs := viper.GetInt("apidelayms") // Viper key from root.go init
+	// A composed query fetches its queries first (MaxPages limits each of them)
+	query := modelListParams(queryParams).Encode()
+	if downloadComposition != nil {
+		if err := downloadComposition.evaluate(client, cfg); err != nil {
+			return nil, 0, err
+		}
+		maxPages = 0
+		query = downloadComposition.key()
+	}
+
+	// A restarted watch loop carries on with the cycle it was in
+	if downloadWatch.takeResume() {
+		if resumed := downloadWatch.resumeDownloads(db); len(resumed) > 0 {
+			log.Infof("Re-queuing %d download(s) left pending by the interrupted watch cycle", len(resumed))
+			for _, pd := range resumed {
+				totalQueuedSizeBytes += uint64(pd.File.SizeKB * 1024)
+			}
+			if onPage != nil {
+				onPage(resumed)
+			} else {
+				allPotentialDownloads = append(allPotentialDownloads, resumed...)
+			}
+		}
+	}
+	if page, cursor, ok := downloadWatch.resumePoint(query); ok {
+		pageCount, nextCursor = page, cursor
+		log.Infof("Resuming the discovery pass of the interrupted watch cycle after page %d", page)
+	}
 
 	for {
 		pageCount++
@@ -612,137 +793,38 @@ func fetchModelsPaginated(db *database.DB, client *http.Client, imageDownloader
 			break
 		}
 
-		// Construct API URL with query parameters
-		apiURL := "https://civitai.com/api/v1/models"
-		params := url.Values{}
-		// ... (param setting logic remains mostly the same, but uses queryParams struct)
-		if queryParams.Limit > 0 {
-			params.Set("limit", fmt.Sprintf("%d", queryParams.Limit))
-		}
-		if queryParams.Query != "" {
-			params.Set("query", queryParams.Query)
-		}
-		if queryParams.Tag != "" {
-			params.Set("tag", queryParams.Tag)
-		}
-		if queryParams.Username != "" {
-			params.Set("username", queryParams.Username)
-		}
-		if len(queryParams.Types) > 0 {
-			params.Set("types", strings.Join(queryParams.Types, ","))
-		}
-		if queryParams.Sort != "" {
-			params.Set("sort", queryParams.Sort)
-		}
-		if queryParams.Period != "" {
-			params.Set("period", queryParams.Period)
-		}
-		if queryParams.Rating > 0 {
-			params.Set("rating", fmt.Sprintf("%d", queryParams.Rating))
-		}
-		if queryParams.Favorites {
-			params.Set("favorites", "true")
-		}
-		if queryParams.Hidden {
-			params.Set("hidden", "true")
-		}
-		if queryParams.PrimaryFileOnly {
-			params.Set("primaryFileOnly", "true")
-		}
-		if !queryParams.AllowNoCredit {
-			params.Set("allowNoCredit", "false")
-		}
-		if !queryParams.AllowDerivatives {
-			params.Set("allowDerivatives", "false")
-		}
-		if !queryParams.AllowDifferentLicenses {
-			params.Set("allowDifferentLicenses", "false")
-		}
-		if queryParams.AllowCommercialUse != "Any" {
-			params.Set("allowCommercialUse", queryParams.AllowCommercialUse)
-		}
-		if queryParams.Nsfw {
-			params.Set("nsfw", "true")
-		}
-		if len(queryParams.BaseModels) > 0 {
-			params.Set("baseModels", strings.Join(queryParams.BaseModels, ","))
-		}
-
-		if nextCursor != "" {
-			params.Set("cursor", nextCursor)
-			log.Infof("Requesting next page %d with cursor: %s...", pageCount, nextCursor)
+		var items []models.Model
+		var rawItems map[int]json.RawMessage
+		if downloadComposition != nil {
+			// A composed query has its models already; they are processed a page at a time
+			items, rawItems, nextCursor = downloadComposition.page(pageCount, queryParams.Limit)
 		} else {
-			log.Infof("Requesting API page %d...", pageCount)
-		}
-
-		fullURL := fmt.Sprintf("%s?%s", apiURL, params.Encode())
-		log.Debugf("API Request URL: %s", fullURL)
-		logPrefix := fmt.Sprintf("Page %d", pageCount) // For retry logging
-
-		req, err := http.NewRequest("GET", fullURL, nil)
-		if err != nil {
-			// This error is unlikely recoverable by retry, return directly.
-			return allPotentialDownloads, totalQueuedSizeBytes, fmt.Errorf("failed to create request for page %d: %w", pageCount, err)
-		}
-		if cfg.ApiKey != "" { // Still need ApiKey from config
-			req.Header.Add("Authorization", "Bearer "+cfg.ApiKey)
-		}
-
-		// --- Use Retry Helper ---
-		// Assign the unused resp to the blank identifier `_`
-		_, bodyBytes, err := doRequestWithRetry(client, req, maxRetries, initialRetryDelay, logPrefix)
-		// --- End Use Retry Helper ---
-
-		if err != nil {
-			// Error already includes context from doRequestWithRetry
-			// If resp is nil, it's likely a network/read error after retries.
-			// If resp is not nil, it's a non-200 status after retries.
-			// The error message from the helper should be descriptive enough.
-			finalErrMsg := fmt.Sprintf("failed to fetch page %d: %v", pageCount, err)
-			// Check if the error message already contains the body snippet
-			if !strings.Contains(err.Error(), "Body:") && len(bodyBytes) > 0 {
-				bodySample := string(bodyBytes)
-				if len(bodySample) > 200 {
-					bodySample = bodySample[:200] + "..."
-				}
-				finalErrMsg += fmt.Sprintf(". Last Body: %s", bodySample)
+			if nextCursor != "" {
+				log.Infof("Requesting next page %d with cursor: %s...", pageCount, nextCursor)
+			} else {
+				log.Infof("Requesting API page %d...", pageCount)
 			}
-			// Stop pagination on persistent error for a page
-			return allPotentialDownloads, totalQueuedSizeBytes, fmt.Errorf(finalErrMsg)
-		}
-		// Success case: resp.StatusCode == http.StatusOK and bodyBytes is valid
-
-		var response models.ApiResponse // Use the correct struct name
-		if err := json.Unmarshal(bodyBytes, &response); err != nil {
-			// Use the bodyBytes we already have for context
-			bodySample := string(bodyBytes)
-			if len(bodySample) > 500 { // Allow slightly more for JSON errors
-				bodySample = bodySample[:500] + "..."
+			var err error
+			items, rawItems, nextCursor, err = fetchModelPage(client, cfg, queryParams, nextCursor, pageCount)
+			if err != nil {
+				return allPotentialDownloads, totalQueuedSizeBytes, err
 			}
-			return allPotentialDownloads, totalQueuedSizeBytes, fmt.Errorf("failed to decode API response for page %d: %w. Body: %s", pageCount, err, bodySample)
 		}
-
-		if len(response.Items) == 0 {
+		if len(items) == 0 {
 			log.Info("Received empty item list from API, assuming end of results.")
 			break
 		}
 
-		// Process metadata for cursor and total items
-		// ... (Cursor handling logic remains the same)
-		if response.Metadata.NextCursor != "" {
-			nextCursor = response.Metadata.NextCursor
-			log.Debugf("API Metadata: TotalItems=%d, CurrentPage=%d, PageSize=%d, NextCursor=%s",
-				response.Metadata.TotalItems, response.Metadata.CurrentPage, response.Metadata.PageSize, response.Metadata.NextCursor)
-		} else {
-			log.Warn("API response missing next cursor.")
-			nextCursor = "" // Stop loop
-		}
-
 		// --- Process Models from this Page ---
 		var potentialDownloadsThisPage []potentialDownload
-		log.Debugf("Processing %d models from request %d for potential downloads...", len(response.Items), pageCount)
+		log.Debugf("Processing %d models from request %d for potential downloads...", len(items), pageCount)
+
+		for _, model := range items {
+			if err := checkSchemaEnums("models", model.Type, model.ModelVersions); err != nil {
+				return allPotentialDownloads, totalQueuedSizeBytes, err
+			}
+			rawVersions := api.RawObjects(rawItems[model.ID], "modelVersions")
 
-		for _, model := range response.Items {
 			// --- Save Full Model Info / Images if Flag is Set ---
 			// This logic runs regardless of which versions are downloaded later
 			// Use Viper to get these boolean flags
@@ -776,13 +858,11 @@ func fetchModelsPaginated(db *database.DB, client *http.Client, imageDownloader
 					}
 				}
 
-				// --- Modify slug construction for type/model structure (removing base model for info/images) ---
-				modelInfoSlug := filepath.Join(helpers.ConvertToSlug(model.Type), modelNameSlug)
-				// --- End slug construction modification ---
-				modelBaseDir := filepath.Join(cfg.SavePath, modelInfoSlug) // Path for model info/images
+				// Model info and images go to {type}/{model}, below the NSFW partition if there is one
+				modelBaseDir := modelDirFor(cfg.SavePath, model.Type, modelNameSlug, model.ID, model.Nsfw, model.NsfwLevel)
 
 				// Pass the new modelBaseDir to saveModelInfoFile
-				if err := saveModelInfoFile(model, modelBaseDir); err != nil {
+				if err := saveModelInfoFile(model, rawItems[model.ID], modelBaseDir); err != nil {
 					log.WithError(err).Warnf("Failed to save full model info for model %d (%s)", model.ID, model.Name)
 				}
 
@@ -879,7 +959,7 @@ func fetchModelsPaginated(db *database.DB, client *http.Client, imageDownloader
 					versionBaseModelLower := strings.ToLower(currentVersion.BaseModel)
 					for _, ignoreBaseModel := range ignoredBaseModels {
 						if ignoreBaseModel != "" && strings.Contains(versionBaseModelLower, strings.ToLower(ignoreBaseModel)) {
-							log.Debugf("    - Skipping version %s: Base model '%s' contains ignored string '%s'.", currentVersion.Name, currentVersion.BaseModel, ignoreBaseModel)
+							log.WithField(failure.LogField, failure.Filtered).Debugf("    - Skipping version %s: Base model '%s' contains ignored string '%s'.", currentVersion.Name, currentVersion.BaseModel, ignoreBaseModel)
 							continue // Skip to next version
 						}
 					}
@@ -893,61 +973,36 @@ func fetchModelsPaginated(db *database.DB, client *http.Client, imageDownloader
 			fileLoop: // Label for continue
 				for _, file := range currentVersion.Files { // Use files from currentVersion
 					// Use the shared filtering function
-					if !passesFileFilters(file, model.Type) {
+					modelType := modelTypeFor(model.ID, currentVersion.ID, model.Type)
+					if !passesFileFilters(civitai.Candidate{Model: model, Version: currentVersion, File: file, ModelType: modelType}) {
 						continue fileLoop // Skip this file if it doesn't pass filters
 					}
 
 					// --- Path/Filename Construction (using currentVersion) ---
-					var slug string // Now only used for file path
-					modelTypeName := helpers.ConvertToSlug(model.Type)
-					baseModelStr := currentVersion.BaseModel // Use currentVersion
-					if baseModelStr == "" {
-						baseModelStr = "unknown-base"
-					}
-					baseModelSlug := helpers.ConvertToSlug(baseModelStr)
-					modelNameSlug := helpers.ConvertToSlug(model.Name)
-					// --- Modify slug construction for type/model/base structure ---
-					slug = filepath.Join(modelTypeName, modelNameSlug, baseModelSlug) // Changed order for file path
-					// --- End slug construction modification ---
-
-					// --- Create version specific slug based on file name (without extension) ---
-					fileNameWithoutExt := strings.TrimSuffix(file.Name, filepath.Ext(file.Name))
-					versionSlug := fmt.Sprintf("%d-%s", currentVersion.ID, helpers.ConvertToSlug(fileNameWithoutExt))
-					// --- End version specific slug ---
-
-					baseFileName := helpers.ConvertToSlug(file.Name)
-					ext := filepath.Ext(baseFileName)
-					baseFileName = strings.TrimSuffix(baseFileName, ext)
-					if strings.ToLower(file.Metadata.Format) == "safetensor" && !strings.EqualFold(ext, ".safetensors") {
-						ext = ".safetensors"
-					}
-					if ext == "" {
-						ext = ".bin"
-						log.Warnf("File %s in version %s (%d) has no extension, defaulting to '.bin'", file.Name, currentVersion.Name, currentVersion.ID)
-					}
-					finalBaseFilenameOnly := baseFileName + ext
-					constructedFileNameOnly := baseFileName + ext // Just base + extension
-					// --- Modify directory path to include version ---
-					fullDirPath := filepath.Join(cfg.SavePath, slug, versionSlug)
-					// --- End directory path modification ---
-					fullFilePath := filepath.Join(fullDirPath, constructedFileNameOnly) // Use filename without suffix
-					// --- End Path/Filename Construction ---
+					versionDir, fullFilePath := targetPathFor(cfg.SavePath, model, modelType, currentVersion, file)
+					finalBaseFilenameOnly := filepath.Base(fullFilePath)
 
 					// Create potentialDownload using currentVersion data
 					pd := potentialDownload{
 						ModelName:         model.Name,
-						ModelType:         model.Type,
+						ModelType:         modelType,
 						VersionName:       currentVersion.Name,      // Use currentVersion
 						BaseModel:         currentVersion.BaseModel, // Use currentVersion
 						Creator:           model.Creator,
+						ModelNsfw:         model.Nsfw,
+						ModelNsfwLevel:    model.NsfwLevel,
+						ModelTags:         model.Tags,
+						Permissions:       model.Permissions(),
 						File:              file,
 						ModelVersionID:    currentVersion.ID, // Use currentVersion
 						TargetFilepath:    fullFilePath,      // Path without suffix
-						Slug:              slug,
+						Slug:              filepath.Dir(versionDir),
+						VersionDir:        versionDir,
 						FinalBaseFilename: finalBaseFilenameOnly,     // Keep original base+ext for reference
 						CleanedVersion:    versionWithoutFilesImages, // Use cleaned currentVersion
 						FullVersion:       currentVersion,            // Store the full original version data
 						OriginalImages:    currentVersion.Images,     // Use currentVersion images
+						RawVersion:        rawVersions[currentVersion.ID],
 					}
 					potentialDownloadsThisPage = append(potentialDownloadsThisPage, pd)
 					// Log the intended path *without* suffix for clarity in this phase
@@ -964,13 +1019,19 @@ func fetchModelsPaginated(db *database.DB, client *http.Client, imageDownloader
 		log.Debugf("Checking %d potential downloads from page %d against database...", len(potentialDownloadsThisPage), pageCount)
 		// Assuming processPage is available after refactoring
 		queuedFromPage, sizeFromPage := processPage(db, potentialDownloadsThisPage, cfg)
+		queuedFromPage = downloadWatch.dropResumed(queuedFromPage)
 		if len(queuedFromPage) > 0 {
-			allPotentialDownloads = append(allPotentialDownloads, queuedFromPage...)
 			totalQueuedSizeBytes += sizeFromPage
 			log.Infof("Queued %d file(s) (Size: %s) from page %d after DB check.", len(queuedFromPage), helpers.BytesToSize(sizeFromPage), pageCount)
+			if onPage != nil {
+				onPage(queuedFromPage) // Blocks while the download queue is full
+			} else {
+				allPotentialDownloads = append(allPotentialDownloads, queuedFromPage...)
+			}
 		} else {
 			log.Debugf("No new files queued from page %d after DB check.", pageCount)
 		}
+		downloadWatch.pageDone(pageCount, nextCursor)
 
 		if nextCursor == "" {
 			log.Info("Finished gathering metadata: No next cursor provided by API.")
@@ -0,0 +1,162 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// queryComposition is QueryCompose: the /models listings of the named Queries, combined
+// client-side with set operations on model IDs. Each cycle lists every query in full (up to
+// its MaxPages) first; the models of the result then go through the usual version
+// selection, filters and database check, a page at a time.
+type queryComposition struct {
+	expr    *helpers.SetExpression
+	queries map[string]composedQuery
+
+	models []models.Model // The result of the last evaluate, in order
+	raw    map[int]json.RawMessage
+}
+
+// composedQuery is one of the Queries, ready to be listed.
+type composedQuery struct {
+	params   models.QueryParameters
+	maxPages int
+}
+
+// downloadComposition is the composed query of the current download run (nil: the run's
+// own query).
+var downloadComposition *queryComposition
+
+// newQueryComposition reads QueryCompose and the Queries it names. base is the run's query,
+// which the queries take their other API parameters (license filters, page size) from. It
+// returns nil if QueryCompose isn't set.
+func newQueryComposition(base models.QueryParameters) (*queryComposition, error) {
+	compose := strings.TrimSpace(viper.GetString("querycompose"))
+	if compose == "" {
+		return nil, nil
+	}
+	expr, err := helpers.ParseSetExpression(compose)
+	if err != nil {
+		return nil, fmt.Errorf("invalid QueryCompose: %w", err)
+	}
+	c := &queryComposition{expr: expr, queries: make(map[string]composedQuery)}
+	for _, name := range expr.Names() {
+		block, ok := globalConfig.Queries[name]
+		if !ok {
+			return nil, fmt.Errorf("QueryCompose uses %q, which isn't one of the Queries (%s)", name, strings.Join(sortedKeys(globalConfig.Queries), ", "))
+		}
+		params := base
+		params.Query, params.Tag, params.Username = block.Query, block.Tag, block.Username
+		params.Types, params.BaseModels = block.ModelTypes, block.BaseModels
+		params.Sort, params.Period = block.Sort, block.Period
+		if params.Sort == "" {
+			params.Sort = "Most Downloaded"
+		} else if !allowedSortOrders[params.Sort] {
+			return nil, fmt.Errorf("Queries.%s: invalid Sort %q", name, block.Sort)
+		}
+		if params.Period == "" {
+			params.Period = "AllTime"
+		} else if !allowedPeriods[params.Period] {
+			return nil, fmt.Errorf("Queries.%s: invalid Period %q", name, block.Period)
+		}
+		if block.Nsfw != nil {
+			params.Nsfw = *block.Nsfw
+		}
+		maxPages := block.MaxPages
+		if maxPages <= 0 {
+			maxPages = viper.GetInt("maxpages")
+		}
+		c.queries[name] = composedQuery{params: params, maxPages: maxPages}
+	}
+	log.Infof("Composing the download query: %s", expr)
+	return c, nil
+}
+
+// key identifies the composition and its queries, for the watch state's resume point.
+func (c *queryComposition) key() string {
+	parts := []string{"compose=" + c.expr.String()}
+	for _, name := range c.expr.Names() {
+		q := c.queries[name]
+		parts = append(parts, fmt.Sprintf("%s:%s:%d", name, modelListParams(q.params).Encode(), q.maxPages))
+	}
+	return strings.Join(parts, ";")
+}
+
+// evaluate lists every query and combines them.
+func (c *queryComposition) evaluate(client *http.Client, cfg *models.Config) error {
+	sets := make(map[string][]int, len(c.queries))
+	byID := make(map[int]models.Model)
+	c.raw = make(map[int]json.RawMessage)
+	for _, name := range c.expr.Names() {
+		q := c.queries[name]
+		ids, err := c.list(client, cfg, name, q, byID)
+		if err != nil {
+			return fmt.Errorf("listing Queries.%s: %w", name, err)
+		}
+		sets[name] = ids
+		log.Infof("Query %s: %d model(s)", name, len(ids))
+	}
+	c.models = c.models[:0]
+	for _, id := range c.expr.Eval(sets) {
+		c.models = append(c.models, byID[id])
+	}
+	log.Infof("Composed query %s: %d model(s)", c.expr, len(c.models))
+	return nil
+}
+
+// list fetches the pages of q, adding its models to byID, and returns their IDs in order.
+func (c *queryComposition) list(client *http.Client, cfg *models.Config, name string, q composedQuery, byID map[int]models.Model) ([]int, error) {
+	apiDelay := time.Duration(viper.GetInt("apidelayms")) * time.Millisecond
+	var ids []int
+	cursor := ""
+	for page := 1; q.maxPages <= 0 || page <= q.maxPages; page++ {
+		if page > 1 && apiDelay > 0 {
+			time.Sleep(apiDelay)
+		}
+		log.Debugf("Requesting page %d of query %s...", page, name)
+		items, rawItems, next, err := fetchModelPage(client, cfg, q.params, cursor, page)
+		if err != nil {
+			return nil, err
+		}
+		for _, model := range items {
+			ids = append(ids, model.ID)
+			byID[model.ID] = model
+			if raw, ok := rawItems[model.ID]; ok {
+				c.raw[model.ID] = raw
+			}
+		}
+		if len(items) == 0 || next == "" {
+			break
+		}
+		cursor = next
+	}
+	return ids, nil
+}
+
+// page returns page n (from 1) of the result, of size models, with their raw JSON and the
+// cursor of the next page ("" after the last one).
+func (c *queryComposition) page(n, size int) ([]models.Model, map[int]json.RawMessage, string) {
+	if size <= 0 {
+		size = 100
+	}
+	start := (n - 1) * size
+	if start >= len(c.models) {
+		return nil, nil, ""
+	}
+	end := min(start+size, len(c.models))
+	next := ""
+	if end < len(c.models) {
+		next = strconv.Itoa(n + 1)
+	}
+	return c.models[start:end], c.raw, next
+}
@@ -0,0 +1,295 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/dreamfast/go-civitai-downloader/civitai"
+	"github.com/dreamfast/go-civitai-downloader/internal/database"
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+
+	"github.com/gosuri/uilive"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Kinds of conflict a download run can run into, by the names ConflictPolicies uses.
+const (
+	conflictExistingFile = "existing-file" // A file that doesn't match is already at the target
+	conflictCollision    = "collision"     // The file at the target belongs to another entry
+	conflictDowngrade    = "downgrade"     // The version is older than one already downloaded
+	conflictHashChange   = "hash-change"   // The upstream file differs from the pinned hashes
+)
+
+// conflictAsk is the ConflictPolicies value that asks about each conflict of a kind.
+const conflictAsk = "ask"
+
+// conflictActions are the actions for each kind of conflict, the one that goes ahead
+// with the download first.
+var conflictActions = map[string][]string{
+	conflictExistingFile: {"replace", "keep"},
+	conflictCollision:    {"replace", "keep"},
+	conflictDowngrade:    {"download", "skip"},
+	conflictHashChange:   {"accept", "refuse"},
+}
+
+// downloadConflict describes one conflict for the prompt.
+type downloadConflict struct {
+	kind    string
+	summary string   // One line: what conflicts with what
+	details []string // Context shown below the summary
+}
+
+// conflictResolver decides conflicts by ConflictPolicies, or with InteractiveConflicts
+// (--interactive-conflicts) by asking. Prompts are taken one at a time, with the progress
+// display paused, and an answer given in capitals applies to every later conflict of the
+// same kind in the run.
+type conflictResolver struct {
+	mu          sync.Mutex
+	interactive bool
+	policies    map[string]string // Kind -> action or "ask"
+	remembered  map[string]string // Kind -> action chosen for all similar conflicts
+	progress    *uilive.Writer    // Paused while prompting; nil outside a download batch
+	input       *bufio.Reader
+}
+
+// downloadConflicts resolves the conflicts of the current download run; nil decides every
+// conflict by its default policy.
+var downloadConflicts *conflictResolver
+
+// forcedConflictPolicy returns the action the older settings force for kind, if any:
+// AllowDowngrade (--allow-downgrade) downloads downgrades and --accept-hash-change accepts
+// changed files, whatever ConflictPolicies says and without asking.
+func forcedConflictPolicy(kind string) string {
+	switch {
+	case kind == conflictDowngrade && viper.GetBool("allowdowngrade"):
+		return "download"
+	case kind == conflictHashChange && viper.GetBool("accepthashchange"):
+		return "accept"
+	}
+	return ""
+}
+
+// defaultConflictPolicy is the action for a kind without a ConflictPolicies entry: what the
+// downloader did before conflicts could be configured.
+func defaultConflictPolicy(kind string) string {
+	if forced := forcedConflictPolicy(kind); forced != "" {
+		return forced
+	}
+	switch kind {
+	case conflictExistingFile:
+		return "replace"
+	case conflictDowngrade:
+		return "skip"
+	case conflictHashChange:
+		return "refuse"
+	default:
+		return "keep" // Never overwrite another entry's file unasked
+	}
+}
+
+// newConflictResolver reads InteractiveConflicts and ConflictPolicies.
+func newConflictResolver() (*conflictResolver, error) {
+	r := &conflictResolver{
+		interactive: viper.GetBool("interactiveconflicts"),
+		policies:    make(map[string]string),
+		remembered:  make(map[string]string),
+		input:       bufio.NewReader(os.Stdin),
+	}
+	for kind, value := range viper.GetStringMapString("conflictpolicies") {
+		kind = strings.ToLower(strings.TrimSpace(kind))
+		value = strings.ToLower(strings.TrimSpace(value))
+		actions, ok := conflictActions[kind]
+		if !ok {
+			return nil, fmt.Errorf("unknown conflict %q in ConflictPolicies (use %s)", kind, strings.Join(conflictKinds(), ", "))
+		}
+		if value != conflictAsk && !containsFold(actions, value) {
+			return nil, fmt.Errorf("invalid ConflictPolicies action %q for %s (use %s or %q)", value, kind, strings.Join(actions, ", "), conflictAsk)
+		}
+		r.policies[kind] = value
+	}
+	if r.interactive || r.asks() {
+		if !helpers.IsTerminal(os.Stdin) {
+			log.Warn("Conflicts can't be asked about without a terminal; deciding them by ConflictPolicies")
+			r.interactive = false
+			for kind, value := range r.policies {
+				if value == conflictAsk {
+					delete(r.policies, kind)
+				}
+			}
+		}
+	}
+	return r, nil
+}
+
+// conflictKinds returns the kinds of conflict, sorted.
+func conflictKinds() []string {
+	kinds := make([]string, 0, len(conflictActions))
+	for kind := range conflictActions {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// asks reports whether some kind of conflict is set to "ask".
+func (r *conflictResolver) asks() bool {
+	for _, value := range r.policies {
+		if value == conflictAsk {
+			return true
+		}
+	}
+	return false
+}
+
+// policy returns the configured action for kind ("ask" if it is asked about).
+func (r *conflictResolver) policy(kind string) string {
+	if r == nil {
+		return defaultConflictPolicy(kind)
+	}
+	if forced := forcedConflictPolicy(kind); forced != "" {
+		return forced
+	}
+	if r.interactive {
+		return conflictAsk
+	}
+	if value, ok := r.policies[kind]; ok {
+		return value
+	}
+	return defaultConflictPolicy(kind)
+}
+
+// detects reports whether conflicts of kind need to be looked for: not if they would be
+// decided by going ahead with the download anyway.
+func (r *conflictResolver) detects(kind string) bool {
+	return r.policy(kind) != conflictActions[kind][0]
+}
+
+// pauseProgress makes prompts pause progress (nil: no progress display running).
+func (r *conflictResolver) pauseProgress(progress *uilive.Writer) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.progress = progress
+}
+
+// resolve returns the action for c: its policy, an answer remembered for all similar
+// conflicts, or the answer to a prompt.
+func (r *conflictResolver) resolve(c downloadConflict) string {
+	action := r.policy(c.kind)
+	if action != conflictAsk {
+		return action
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if remembered, ok := r.remembered[c.kind]; ok {
+		log.Infof("Conflict (%s): %s -> %s (chosen for all similar conflicts)", c.kind, c.summary, remembered)
+		return remembered
+	}
+	if r.progress != nil {
+		r.progress.Stop()
+		defer r.progress.Start()
+	}
+	actions := conflictActions[c.kind]
+	choices := make([]string, len(actions))
+	for i, a := range actions {
+		choices[i] = "[" + a[:1] + "]" + a[1:]
+	}
+	fmt.Printf("\nConflict (%s): %s\n", c.kind, c.summary)
+	for _, detail := range c.details {
+		fmt.Printf("  %s\n", detail)
+	}
+	for {
+		fmt.Printf("%s? Capital letter: also for all later %s conflicts (default %s): ", strings.Join(choices, " / "), c.kind, actions[len(actions)-1])
+		line, err := r.input.ReadString('\n')
+		answer := strings.TrimSpace(line)
+		if answer == "" {
+			if err != nil {
+				// Input closed: decide this and the rest by the safe default
+				log.Warnf("No answer for the %s conflict; choosing %s for it and all later ones", c.kind, actions[len(actions)-1])
+				r.remembered[c.kind] = actions[len(actions)-1]
+			}
+			action = actions[len(actions)-1]
+			break
+		}
+		if a := conflictAnswer(actions, answer); a != "" {
+			action = a
+			if answer[:1] != strings.ToLower(answer[:1]) {
+				r.remembered[c.kind] = action
+			}
+			break
+		}
+		fmt.Printf("Please answer %s.\n", strings.Join(choices, " / "))
+	}
+	log.Infof("Conflict (%s): %s -> %s", c.kind, c.summary, action)
+	return action
+}
+
+// conflictAnswer returns the action an answer picks: its first letter or its full name.
+func conflictAnswer(actions []string, answer string) string {
+	for _, a := range actions {
+		if strings.EqualFold(answer, a) || strings.EqualFold(answer, a[:1]) {
+			return a
+		}
+	}
+	return ""
+}
+
+// expectedFinalPath is where the downloader puts pd's file (unless the server names it
+// differently): the target name, prefixed with the version ID except for embeddings.
+func expectedFinalPath(pd potentialDownload) string {
+	name := filepath.Base(pd.TargetFilepath)
+	if versionID := civitai.FileNameVersionID(pd.ModelType, pd.ModelVersionID); versionID > 0 {
+		name = fmt.Sprintf("%d_%s", versionID, name)
+	}
+	return filepath.Join(filepath.Dir(pd.TargetFilepath), name)
+}
+
+// existingFileConflict looks at the file already at pd's target, if there is one. It
+// returns no conflict if there is none or it is pd's file; otherwise an existing-file
+// conflict, or a collision if the file is another entry's.
+func existingFileConflict(db *database.DB, pd potentialDownload, dbKey string) (downloadConflict, bool) {
+	path := expectedFinalPath(pd)
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return downloadConflict{}, false
+	}
+	sums, err := helpers.HashFile(path, []string{helpers.HashSHA256})
+	if err != nil {
+		log.WithError(err).Warnf("Could not check the file already at %s", path)
+		return downloadConflict{}, false
+	}
+	if helpers.SumsMatch(sums, pd.File.Hashes) {
+		return downloadConflict{}, false // The downloader finds and keeps it
+	}
+	details := []string{
+		fmt.Sprintf("On disk:  %s (%s, modified %s, SHA256 %s)", path, helpers.BytesToSize(uint64(info.Size())), info.ModTime().Format("2006-01-02 15:04"), sums[helpers.HashSHA256]),
+		fmt.Sprintf("Upstream: %s %s, file %s (%s, SHA256 %s)", pd.ModelName, pd.VersionName, pd.File.Name, helpers.BytesToSize(uint64(pd.File.SizeKB*1024)), strings.ToLower(pd.File.Hashes.SHA256)),
+	}
+	if db.IndexesReady() {
+		keys, err := db.Lookup(database.IndexHash, sums[helpers.HashSHA256])
+		if err == nil {
+			for _, key := range keys {
+				if key == dbKey {
+					continue
+				}
+				raw, err := db.Get([]byte(key))
+				var owner models.DatabaseEntry
+				if err == nil && json.Unmarshal(raw, &owner) == nil {
+					details = append(details, fmt.Sprintf("The file on disk is %s %s (%s); replacing it takes it away from that entry", owner.ModelName, owner.Version.Name, key))
+					return downloadConflict{kind: conflictCollision, summary: fmt.Sprintf("%s is already the file of %s", filepath.Base(path), key), details: details}, true
+				}
+			}
+		}
+	}
+	return downloadConflict{kind: conflictExistingFile, summary: fmt.Sprintf("%s is already on disk and doesn't match the upstream file", filepath.Base(path)), details: details}, true
+}
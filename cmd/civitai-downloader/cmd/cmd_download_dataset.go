@@ -0,0 +1,150 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Dataset modes (DatasetMode / --dataset-mode).
+const (
+	datasetModeDVC      = "dvc"
+	datasetModeGitAnnex = "git-annex"
+)
+
+// annexDirName is the directory below SavePath git-annex mode writes its batch files to.
+const annexDirName = ".civitai-annex"
+
+// annexBatchMu serialises appends to the git-annex batch files across workers.
+var annexBatchMu sync.Mutex
+
+// validateDatasetMode checks a DatasetMode value.
+func validateDatasetMode(mode string) error {
+	switch strings.ToLower(mode) {
+	case "", datasetModeDVC, datasetModeGitAnnex:
+		return nil
+	}
+	return fmt.Errorf("unknown DatasetMode %q (use %q or %q)", mode, datasetModeDVC, datasetModeGitAnnex)
+}
+
+// writeDatasetPointers writes what DatasetMode needs to track a downloaded file in a
+// dataset repository. Failures are logged; the download itself stands.
+func writeDatasetPointers(logPrefix string, pd potentialDownload, finalPath string) {
+	var err error
+	switch strings.ToLower(viper.GetString("datasetmode")) {
+	case datasetModeDVC:
+		err = writeDVCPointer(finalPath)
+	case datasetModeGitAnnex:
+		err = appendAnnexBatches(viper.GetString("savepath"), pd, finalPath)
+	default:
+		return
+	}
+	if err != nil {
+		log.WithError(err).Warnf("[%s] Failed to write %s files for %s", logPrefix, viper.GetString("datasetmode"), finalPath)
+	}
+}
+
+// writeDVCPointer writes <file>.dvc next to the file and ignores the file in git, which is
+// what `dvc add` leaves behind; `dvc commit` and `dvc push` then move it to the DVC cache
+// and remote.
+func writeDVCPointer(finalPath string) error {
+	info, err := os.Stat(finalPath)
+	if err != nil {
+		return err
+	}
+	sum, err := helpers.FileMD5(finalPath)
+	if err != nil {
+		return err
+	}
+	name := filepath.Base(finalPath)
+	if err := helpers.WriteFile(finalPath+".dvc", helpers.DVCFile(sum, info.Size(), name), 0644); err != nil {
+		return err
+	}
+	return helpers.AddGitignoreEntry(filepath.Dir(finalPath), name)
+}
+
+// annexMetadata is one line of the `git annex metadata --batch --json` input.
+type annexMetadata struct {
+	File   string              `json:"file"`
+	Fields map[string][]string `json:"fields"`
+}
+
+// appendAnnexBatches records a file in the git-annex batch files below savePath:
+// registerurl.batch ("<key> <url>", for `git annex registerurl --batch`, so clones can
+// `git annex get` the file from Civitai) and metadata.jsonl (model fields, for
+// `git annex metadata --batch --json`).
+func appendAnnexBatches(savePath string, pd potentialDownload, finalPath string) error {
+	info, err := os.Stat(finalPath)
+	if err != nil {
+		return err
+	}
+	sum := pd.File.Hashes.SHA256 // The download was verified against the API's hashes
+	if sum == "" {
+		if sum, err = helpers.FileSHA256(finalPath); err != nil {
+			return err
+		}
+	}
+	rel, err := filepath.Rel(savePath, finalPath)
+	if err != nil {
+		return err
+	}
+	key := helpers.AnnexKey(sum, info.Size(), filepath.Base(finalPath))
+
+	fields := make(map[string][]string)
+	for field, value := range map[string]string{
+		"civitai-model":     pd.ModelName,
+		"civitai-modelid":   strconv.Itoa(pd.CleanedVersion.ModelId),
+		"civitai-version":   pd.VersionName,
+		"civitai-versionid": strconv.Itoa(pd.ModelVersionID),
+		"civitai-type":      pd.ModelType,
+		"civitai-basemodel": pd.BaseModel,
+		"civitai-creator":   pd.Creator.Username,
+	} {
+		if value != "" && value != "0" {
+			fields[field] = []string{value}
+		}
+	}
+	metadata, err := json.Marshal(annexMetadata{File: filepath.ToSlash(rel), Fields: fields})
+	if err != nil {
+		return err
+	}
+
+	annexBatchMu.Lock()
+	defer annexBatchMu.Unlock()
+	dir := filepath.Join(savePath, annexDirName)
+	if err := helpers.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if pd.File.DownloadUrl != "" {
+		if err := appendLine(filepath.Join(dir, "registerurl.batch"), key+" "+pd.File.DownloadUrl); err != nil {
+			return err
+		}
+	}
+	return appendLine(filepath.Join(dir, "metadata.jsonl"), string(metadata))
+}
+
+// appendLine appends line and a newline to the file at path, creating it if needed.
+func appendLine(path, line string) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(f, line); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	helpers.ApplyFileMode(path)
+	return nil
+}
@@ -0,0 +1,385 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/database"
+	"github.com/dreamfast/go-civitai-downloader/internal/failure"
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Kinds of digest events.
+const (
+	digestDownloaded = "downloaded"
+	digestFailed     = "failed"
+)
+
+// digestEvent is one thing that happened during a digest period.
+type digestEvent struct {
+	Time      time.Time `json:"time"`
+	Kind      string    `json:"kind"`
+	Key       string    `json:"key"`
+	Model     string    `json:"model"`
+	Version   string    `json:"version"`
+	ModelType string    `json:"modelType"`
+	Creator   string    `json:"creator,omitempty"`
+	File      string    `json:"file"`
+	Bytes     uint64    `json:"bytes,omitempty"`
+	Category  string    `json:"category,omitempty"` // Failure category
+	Reason    string    `json:"reason,omitempty"`   // Recognised Civitai failure, if any
+	Error     string    `json:"error,omitempty"`
+}
+
+// digestState is what has been collected since the last digest. It is kept in a file in
+// DigestDir so a restarted watch loop carries on with the same period.
+type digestState struct {
+	PeriodStart time.Time     `json:"periodStart"`
+	Events      []digestEvent `json:"events"`
+}
+
+// digestRecorder collects download events in watch mode and writes a digest of them every
+// DigestInterval.
+type digestRecorder struct {
+	mu       sync.Mutex
+	interval time.Duration
+	dir      string
+	formats  []string // "markdown" and/or "html"
+	webhook  string
+	state    digestState
+}
+
+// downloadDigest is the digest of the running watch loop; nil when no digest is configured.
+var downloadDigest *digestRecorder
+
+const digestStateFile = "digest-state.json"
+
+// parseDigestInterval accepts "daily", "weekly", Go durations ("72h") and days ("14d").
+func parseDigestInterval(spec string) (time.Duration, error) {
+	spec = strings.ToLower(strings.TrimSpace(spec))
+	switch spec {
+	case "daily":
+		return 24 * time.Hour, nil
+	case "weekly":
+		return 7 * 24 * time.Hour, nil
+	}
+	if days, ok := strings.CutSuffix(spec, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid digest interval %q", spec)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	interval, err := time.ParseDuration(spec)
+	if err != nil || interval <= 0 {
+		return 0, fmt.Errorf("invalid digest interval %q: use daily, weekly, a number of days (14d) or a duration (72h)", spec)
+	}
+	return interval, nil
+}
+
+// newDigestRecorder reads the Digest* settings and the saved state of the current period.
+// It returns nil if DigestInterval is not set.
+func newDigestRecorder(now time.Time) (*digestRecorder, error) {
+	spec := viper.GetString("digestinterval")
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+	interval, err := parseDigestInterval(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &digestRecorder{interval: interval, dir: viper.GetString("digestdir"), webhook: strings.TrimSpace(viper.GetString("digestwebhook"))}
+	if d.dir == "" {
+		d.dir = filepath.Join(viper.GetString("savepath"), "digests")
+	}
+	switch format := strings.ToLower(strings.TrimSpace(viper.GetString("digestformat"))); format {
+	case "", "markdown", "md":
+		d.formats = []string{"markdown"}
+	case "html":
+		d.formats = []string{"html"}
+	case "both":
+		d.formats = []string{"markdown", "html"}
+	default:
+		return nil, fmt.Errorf("invalid DigestFormat %q: use markdown, html or both", format)
+	}
+	if err := helpers.MkdirAll(d.dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create digest directory %s: %w", d.dir, err)
+	}
+
+	if data, err := os.ReadFile(filepath.Join(d.dir, digestStateFile)); err == nil {
+		if err := json.Unmarshal(data, &d.state); err != nil {
+			log.WithError(err).Warnf("Ignoring unreadable digest state in %s", d.dir)
+			d.state = digestState{}
+		}
+	}
+	if d.state.PeriodStart.IsZero() {
+		d.state.PeriodStart = now
+	}
+	log.Infof("Writing a digest every %v to %s (current period started %s)", interval, d.dir, d.state.PeriodStart.Format(time.RFC1123))
+	return d, nil
+}
+
+// record adds an event to the current period. A nil recorder ignores it.
+func (d *digestRecorder) record(event digestEvent) {
+	if d == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	d.mu.Lock()
+	d.state.Events = append(d.state.Events, event)
+	d.mu.Unlock()
+}
+
+// recordDownload records the outcome of a download job. A nil recorder ignores it.
+func (d *digestRecorder) recordDownload(pd potentialDownload, dbKey string, finalPath string, err error) {
+	if d == nil {
+		return
+	}
+	event := digestEvent{
+		Key:       dbKey,
+		Model:     pd.ModelName,
+		Version:   pd.VersionName,
+		ModelType: pd.ModelType,
+		Creator:   pd.Creator.Username,
+		File:      filepath.Base(pd.TargetFilepath),
+		Kind:      digestDownloaded,
+	}
+	if err != nil {
+		event.Kind = digestFailed
+		event.Category = string(failure.CategoryOf(err))
+		event.Reason = string(failure.ReasonOf(err))
+		event.Error = err.Error()
+	} else {
+		event.File = filepath.Base(finalPath)
+		event.Bytes = uint64(pd.File.SizeKB * 1024)
+	}
+	d.record(event)
+}
+
+// emitIfDue saves the collected events and, once the period is over, writes the digest and
+// starts a new period. A nil recorder does nothing.
+func (d *digestRecorder) emitIfDue(db *database.DB, now time.Time) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if now.Sub(d.state.PeriodStart) >= d.interval {
+		report := d.buildReport(db, now)
+		if err := d.write(report); err != nil {
+			log.WithError(err).Error("Failed to write the digest; keeping its events for the next attempt")
+		} else {
+			if d.webhook != "" {
+				if err := postDigest(d.webhook, report); err != nil {
+					log.WithError(err).Warn("Failed to post the digest to DigestWebhook")
+				}
+			}
+			d.state = digestState{PeriodStart: now}
+		}
+	}
+	d.saveState()
+}
+
+// saveState writes the current period to the state file. The caller must hold d.mu.
+func (d *digestRecorder) saveState() {
+	data, err := json.MarshalIndent(d.state, "", "  ")
+	if err == nil {
+		err = helpers.WriteFile(filepath.Join(d.dir, digestStateFile), data, 0600)
+	}
+	if err != nil {
+		log.WithError(err).Warn("Failed to save the digest state")
+	}
+}
+
+// digestReport is the data a digest is rendered from.
+type digestReport struct {
+	From, To        time.Time
+	Downloaded      []digestEvent
+	Failures        []digestEvent
+	Removed         []digestEvent // Failures because the model or file no longer exists upstream
+	AddedBytes      uint64
+	ArchiveFiles    int
+	ArchiveBytes    uint64
+	FailuresByCause map[string]int
+}
+
+// buildReport summarises the period. The caller must hold d.mu.
+func (d *digestRecorder) buildReport(db *database.DB, now time.Time) digestReport {
+	report := digestReport{From: d.state.PeriodStart, To: now, FailuresByCause: make(map[string]int)}
+	for _, event := range d.state.Events {
+		switch {
+		case event.Kind == digestDownloaded:
+			report.Downloaded = append(report.Downloaded, event)
+			report.AddedBytes += event.Bytes
+		case event.Category == string(failure.NotFound):
+			report.Removed = append(report.Removed, event)
+		default:
+			report.Failures = append(report.Failures, event)
+			report.FailuresByCause[event.Category]++
+		}
+	}
+	sort.Slice(report.Downloaded, func(i, j int) bool { return report.Downloaded[i].Time.Before(report.Downloaded[j].Time) })
+
+	err := db.Fold(func(key []byte, value []byte) error {
+		if !strings.HasPrefix(string(key), "v_") {
+			return nil
+		}
+		var entry models.DatabaseEntry
+		if json.Unmarshal(value, &entry) == nil && entry.Status == models.StatusDownloaded {
+			report.ArchiveFiles++
+			report.ArchiveBytes += uint64(entry.File.SizeKB * 1024)
+		}
+		return nil
+	})
+	if err != nil {
+		log.WithError(err).Warn("Digest: failed to total the archive size")
+	}
+	return report
+}
+
+var digestFuncs = map[string]interface{}{
+	"size": helpers.BytesToSize,
+	"date": func(t time.Time) string { return t.Format("2006-01-02 15:04") },
+	"cell": func(s string) string { return strings.ReplaceAll(strings.ReplaceAll(s, "|", "\\|"), "\n", " ") },
+}
+
+const digestMarkdown = `# Civitai downloader digest
+
+{{date .From}} to {{date .To}}
+
+- **Downloaded:** {{len .Downloaded}} file(s), {{size .AddedBytes}}
+- **Failed:** {{len .Failures}}{{range $cause, $n := .FailuresByCause}} · {{$cause}}: {{$n}}{{end}}
+- **Removed upstream:** {{len .Removed}}
+- **Archive:** {{.ArchiveFiles}} file(s), {{size .ArchiveBytes}}
+{{if .Downloaded}}
+## New downloads
+
+| Model | Version | Type | Creator | File | Size |
+|---|---|---|---|---|---|
+{{range .Downloaded}}| {{cell .Model}} | {{cell .Version}} | {{cell .ModelType}} | {{cell .Creator}} | {{cell .File}} | {{size .Bytes}} |
+{{end}}{{end}}{{if .Failures}}
+## Failures
+
+| Model | File | Category | Error |
+|---|---|---|---|
+{{range .Failures}}| {{cell .Model}} | {{cell .File}} | {{.Category}} | {{cell .Error}} |
+{{end}}{{end}}{{if .Removed}}
+## Removed upstream
+
+| Model | Version | File |
+|---|---|---|
+{{range .Removed}}| {{cell .Model}} | {{cell .Version}} | {{cell .File}} |
+{{end}}{{end}}`
+
+const digestHTML = `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Civitai downloader digest {{date .To}}</title>
+<style>body{font-family:sans-serif;max-width:60em;margin:auto}table{border-collapse:collapse}td,th{border:1px solid #ccc;padding:.2em .5em;text-align:left}</style>
+</head><body>
+<h1>Civitai downloader digest</h1>
+<p>{{date .From}} to {{date .To}}</p>
+<ul>
+<li><b>Downloaded:</b> {{len .Downloaded}} file(s), {{size .AddedBytes}}</li>
+<li><b>Failed:</b> {{len .Failures}}{{range $cause, $n := .FailuresByCause}} · {{$cause}}: {{$n}}{{end}}</li>
+<li><b>Removed upstream:</b> {{len .Removed}}</li>
+<li><b>Archive:</b> {{.ArchiveFiles}} file(s), {{size .ArchiveBytes}}</li>
+</ul>
+{{if .Downloaded}}<h2>New downloads</h2>
+<table><tr><th>Model</th><th>Version</th><th>Type</th><th>Creator</th><th>File</th><th>Size</th></tr>
+{{range .Downloaded}}<tr><td>{{.Model}}</td><td>{{.Version}}</td><td>{{.ModelType}}</td><td>{{.Creator}}</td><td>{{.File}}</td><td>{{size .Bytes}}</td></tr>
+{{end}}</table>{{end}}
+{{if .Failures}}<h2>Failures</h2>
+<table><tr><th>Model</th><th>File</th><th>Category</th><th>Error</th></tr>
+{{range .Failures}}<tr><td>{{.Model}}</td><td>{{.File}}</td><td>{{.Category}}</td><td>{{.Error}}</td></tr>
+{{end}}</table>{{end}}
+{{if .Removed}}<h2>Removed upstream</h2>
+<table><tr><th>Model</th><th>Version</th><th>File</th></tr>
+{{range .Removed}}<tr><td>{{.Model}}</td><td>{{.Version}}</td><td>{{.File}}</td></tr>
+{{end}}</table>{{end}}
+</body></html>
+`
+
+var (
+	digestMarkdownTemplate = template.Must(template.New("digest").Funcs(digestFuncs).Parse(digestMarkdown))
+	digestHTMLTemplate     = htmltemplate.Must(htmltemplate.New("digest").Funcs(digestFuncs).Parse(digestHTML))
+)
+
+// renderDigest renders the report as Markdown.
+func renderDigest(report digestReport) (string, error) {
+	var buf bytes.Buffer
+	err := digestMarkdownTemplate.Execute(&buf, report)
+	return buf.String(), err
+}
+
+// write saves the digest in the configured formats as digest-<date>.md/.html.
+func (d *digestRecorder) write(report digestReport) error {
+	base := filepath.Join(d.dir, "digest-"+report.To.Format("2006-01-02-1504"))
+	for _, format := range d.formats {
+		var buf bytes.Buffer
+		path := base + ".md"
+		var err error
+		if format == "html" {
+			path = base + ".html"
+			err = digestHTMLTemplate.Execute(&buf, report)
+		} else {
+			err = digestMarkdownTemplate.Execute(&buf, report)
+		}
+		if err != nil {
+			return fmt.Errorf("rendering digest: %w", err)
+		}
+		if err := helpers.WriteFile(path, buf.Bytes(), 0600); err != nil {
+			return fmt.Errorf("writing digest %s: %w", path, err)
+		}
+		log.Infof("Wrote digest for %s to %s (%d downloaded, %d failed, %d removed upstream)",
+			report.From.Format("2006-01-02")+" - "+report.To.Format("2006-01-02"), path, len(report.Downloaded), len(report.Failures), len(report.Removed))
+	}
+	return nil
+}
+
+// discordMessageLimit is the longest message a Discord webhook accepts.
+const discordMessageLimit = 2000
+
+// postDigest posts the Markdown digest to a chat webhook. The body carries the text as both
+// "text" (Slack, Mattermost, Rocket.Chat) and "content" (Discord, truncated to its limit).
+func postDigest(webhook string, report digestReport) error {
+	text, err := renderDigest(report)
+	if err != nil {
+		return err
+	}
+	content := text
+	if runes := []rune(content); len(runes) > discordMessageLimit {
+		content = string(runes[:discordMessageLimit-1]) + "…"
+	}
+	body, err := json.Marshal(map[string]string{"text": text, "content": content})
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Values of DiskSpacePolicy.
+const (
+	diskSpaceTrim  = "trim"
+	diskSpaceAbort = "abort"
+	diskSpaceOff   = "off"
+)
+
+// filesystemBudget is the free space of one filesystem when the run started, and how much
+// of it the downloads queued so far will take.
+type filesystemBudget struct {
+	path   string // First target directory seen on it, for the log
+	free   uint64
+	queued uint64
+}
+
+// diskBudget checks, before downloads are queued, that their files (by the size the API
+// reports) fit in the free space of the filesystems they go to, keeping DiskSpaceReserve
+// free. Running out of space halfway through a batch leaves truncated partial files and
+// Error entries behind, so downloads that don't fit are not started at all.
+type diskBudget struct {
+	policy      string
+	reserve     uint64
+	filesystems map[string]*filesystemBudget // Filesystem ID -> budget
+	dirs        map[string]*filesystemBudget // Target directory -> budget (nil: unknown)
+	stopped     bool                         // "abort": a download didn't fit, queue nothing more
+	trimmed     int
+	trimmedSize uint64
+}
+
+// newDiskBudget reads DiskSpacePolicy and DiskSpaceReserve. It returns nil if the check is
+// turned off.
+func newDiskBudget() (*diskBudget, error) {
+	policy := strings.ToLower(strings.TrimSpace(viper.GetString("diskspacepolicy")))
+	switch policy {
+	case "":
+		policy = diskSpaceTrim
+	case diskSpaceTrim, diskSpaceAbort:
+	case diskSpaceOff:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("invalid DiskSpacePolicy %q (use %q, %q or %q)", policy, diskSpaceTrim, diskSpaceAbort, diskSpaceOff)
+	}
+	b := &diskBudget{policy: policy, filesystems: make(map[string]*filesystemBudget), dirs: make(map[string]*filesystemBudget)}
+	if value := strings.TrimSpace(viper.GetString("diskspacereserve")); value != "" {
+		reserve, err := helpers.ParseByteSize(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DiskSpaceReserve %q: %w", value, err)
+		}
+		b.reserve = reserve
+	}
+	return b, nil
+}
+
+// filesystem returns the budget of the filesystem dir is on, measuring its free space the
+// first time it is seen. It returns nil if the free space can't be checked.
+func (b *diskBudget) filesystem(dir string) *filesystemBudget {
+	if fs, ok := b.dirs[dir]; ok {
+		return fs
+	}
+	free, device, err := helpers.FreeSpace(dir)
+	if err != nil {
+		log.WithError(err).Debugf("Disk space: can't check %s, downloads to it are not checked", dir)
+		b.dirs[dir] = nil
+		return nil
+	}
+	fs, ok := b.filesystems[device]
+	if !ok {
+		fs = &filesystemBudget{path: dir, free: free}
+		b.filesystems[device] = fs
+	}
+	b.dirs[dir] = fs
+	return fs
+}
+
+// admit reports whether pd fits in the free space left for the run, and if so counts it
+// against it. A nil budget admits everything.
+func (b *diskBudget) admit(pd potentialDownload) bool {
+	if b == nil {
+		return true
+	}
+	if b.stopped {
+		return false
+	}
+	size := uint64(pd.File.SizeKB * 1024)
+	fs := b.filesystem(filepath.Dir(pd.TargetFilepath))
+	if fs == nil {
+		return true
+	}
+	if fs.queued+size+b.reserve <= fs.free {
+		fs.queued += size
+		return true
+	}
+	left := uint64(0)
+	if fs.free > fs.queued+b.reserve {
+		left = fs.free - fs.queued - b.reserve
+	}
+	if b.policy == diskSpaceAbort {
+		b.stopped = true
+		log.Errorf("Disk space: %s (%s) doesn't fit on the filesystem of %s: %s left of %s free, keeping %s in reserve (DiskSpaceReserve). Not queuing any more downloads (DiskSpacePolicy = %q).",
+			pd.FinalBaseFilename, helpers.BytesToSize(size), fs.path, helpers.BytesToSize(left), helpers.BytesToSize(fs.free), helpers.BytesToSize(b.reserve), b.policy)
+		return false
+	}
+	b.trimmed++
+	b.trimmedSize += size
+	log.Warnf("Disk space: skipping %s (%s), only %s left on the filesystem of %s", pd.FinalBaseFilename, helpers.BytesToSize(size), helpers.BytesToSize(left), fs.path)
+	return false
+}
+
+// report logs how many downloads were trimmed.
+func (b *diskBudget) report() {
+	if b == nil || b.trimmed == 0 {
+		return
+	}
+	log.Warnf("Disk space: skipped %d download(s) (%s) that don't fit in the free space (keeping %s in reserve). They stay in the database and are picked up by a later run once there is room.",
+		b.trimmed, helpers.BytesToSize(b.trimmedSize), helpers.BytesToSize(b.reserve))
+}
+
+// preflightDiskSpace returns the downloads of a batch that fit in the free disk space: with
+// DiskSpacePolicy "trim" the ones that fit, in queue order; with "abort" none unless they
+// all fit.
+func preflightDiskSpace(downloads []potentialDownload, budget *diskBudget) []potentialDownload {
+	if budget == nil || len(downloads) == 0 {
+		return downloads
+	}
+	fitting := make([]potentialDownload, 0, len(downloads))
+	for _, pd := range downloads {
+		if budget.admit(pd) {
+			fitting = append(fitting, pd)
+		}
+	}
+	if budget.stopped {
+		var total uint64
+		for _, pd := range downloads {
+			total += uint64(pd.File.SizeKB * 1024)
+		}
+		log.Errorf("Disk space: aborting the batch of %d download(s) (%s) before it starts. Free up space, lower DiskSpaceReserve, or set DiskSpacePolicy = %q to download what fits.",
+			len(downloads), helpers.BytesToSize(total), diskSpaceTrim)
+		return nil
+	}
+	budget.report()
+	return fitting
+}
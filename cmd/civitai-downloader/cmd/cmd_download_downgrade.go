@@ -0,0 +1,154 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/database"
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// latestLinkName is the symlink in a model directory that points to its current version.
+const latestLinkName = "latest"
+
+// downgradeGuard keeps a run that follows each model's latest upstream version from
+// storing a version older than one already downloaded: when the newer version is
+// unpublished or hidden upstream, the API's "latest" goes back to an older one.
+type downgradeGuard struct {
+	mu     sync.Mutex
+	db     *database.DB
+	newest map[int]int // Model ID -> highest downloaded version ID
+}
+
+// downloadDowngrades is the downgrade guard of the current download run; nil when older
+// versions may be downloaded (AllowDowngrade, a "download" downgrade policy, --all-versions
+// or --model-version-id).
+var downloadDowngrades *downgradeGuard
+
+// newDowngradeGuard returns the guard for a run, or nil if the run asks for versions itself
+// or downloads downgrades anyway. Call it after newConflictResolver.
+func newDowngradeGuard(db *database.DB) *downgradeGuard {
+	if !downloadConflicts.detects(conflictDowngrade) || viper.GetBool("downloadallversions") || viper.GetInt("modelversionid") != 0 {
+		return nil
+	}
+	return &downgradeGuard{db: db}
+}
+
+// skipReason returns why pd must not be downloaded, or "" if it may.
+func (g *downgradeGuard) skipReason(pd potentialDownload) string {
+	if g == nil || pd.CleanedVersion.ModelId == 0 {
+		return ""
+	}
+	g.mu.Lock()
+	if g.newest == nil {
+		g.newest = make(map[int]int)
+		err := g.db.Fold(func(key []byte, value []byte) error {
+			if !strings.HasPrefix(string(key), "v_") {
+				return nil
+			}
+			var entry models.DatabaseEntry
+			if json.Unmarshal(value, &entry) == nil && entry.Status == models.StatusDownloaded && entry.Version.ID > g.newest[entry.Version.ModelId] {
+				g.newest[entry.Version.ModelId] = entry.Version.ID
+			}
+			return nil
+		})
+		if err != nil {
+			log.WithError(err).Warn("Failed to read the downloaded versions; not checking for downgrades")
+		}
+	}
+	newest := g.newest[pd.CleanedVersion.ModelId]
+	g.mu.Unlock()
+	if newest <= pd.CleanedVersion.ID {
+		return ""
+	}
+	action := downloadConflicts.resolve(downloadConflict{
+		kind:    conflictDowngrade,
+		summary: fmt.Sprintf("%s %s (version %d) is older than the downloaded version %d", pd.ModelName, pd.VersionName, pd.CleanedVersion.ID, newest),
+		details: []string{
+			fmt.Sprintf("Upstream's latest version of the model went back to %d; the newer one may have been unpublished or hidden", pd.CleanedVersion.ID),
+		},
+	})
+	if action == "download" {
+		return ""
+	}
+	return fmt.Sprintf("version %d is older than the downloaded version %d of the model (use --allow-downgrade to download it anyway)", pd.CleanedVersion.ID, newest)
+}
+
+// currentModelEntry returns the entry a model's "latest" link should point to: the version
+// it was rolled back to, or else its newest downloaded version. ok is false if the model
+// has no downloaded version.
+func currentModelEntry(db *database.DB, modelID int) (current models.DatabaseEntry, ok bool, err error) {
+	var held models.DatabaseEntry
+	err = db.Fold(func(key []byte, value []byte) error {
+		if !strings.HasPrefix(string(key), "v_") {
+			return nil
+		}
+		var entry models.DatabaseEntry
+		if json.Unmarshal(value, &entry) != nil || entry.Version.ModelId != modelID || entry.Status != models.StatusDownloaded {
+			return nil
+		}
+		if entry.RolledBackAt > held.RolledBackAt {
+			held = entry
+		}
+		if !ok || entry.Version.ID > current.Version.ID {
+			current, ok = entry, true
+		}
+		return nil
+	})
+	if held.RolledBackAt != 0 {
+		current = held
+	}
+	return current, ok, err
+}
+
+// updateLatestLink points the "latest" symlink in a model's directory to the version
+// directory of its current version (see currentModelEntry). It returns the link's path,
+// or "" if there is nothing to link.
+func updateLatestLink(db *database.DB, savePath string, modelID int) (string, error) {
+	current, ok, err := currentModelEntry(db, modelID)
+	if err != nil || !ok {
+		return "", err
+	}
+	modelDir := entryModelDir(savePath, current)
+	versionDir := entryVersionDir(savePath, current)
+	if filepath.Clean(versionDir) == filepath.Clean(modelDir) {
+		log.Debugf("Not linking %s: versions share the model directory (PathTemplate)", filepath.Join(modelDir, latestLinkName))
+		return "", nil
+	}
+	target, err := filepath.Rel(modelDir, versionDir)
+	if err != nil {
+		target = versionDir
+	}
+
+	link := filepath.Join(modelDir, latestLinkName)
+	if existing, err := os.Readlink(link); err == nil && existing == target {
+		return link, nil
+	} else if err != nil && !os.IsNotExist(err) {
+		if info, statErr := os.Lstat(link); statErr == nil && info.Mode()&os.ModeSymlink == 0 {
+			return "", fmt.Errorf("%s exists and is not a symlink", link)
+		}
+	}
+	if err := helpers.MkdirAll(modelDir, 0755); err != nil {
+		return "", err
+	}
+	// Swap the link in with a rename, so it always points somewhere
+	tmp := link + ".relinking"
+	os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, link); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	log.Debugf("Linked %s -> %s", link, target)
+	return link, nil
+}
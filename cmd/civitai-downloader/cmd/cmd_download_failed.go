@@ -0,0 +1,142 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/database"
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// failedListFile is the default name of the failed download list in SavePath.
+const failedListFile = "failed.json"
+
+// failedListShown is the number of a run's failed downloads printed at its end.
+const failedListShown = 20
+
+// failedDownload is a download in the Error state, as the failed list records it.
+type failedDownload struct {
+	Key       string    `json:"key"`
+	VersionID int       `json:"versionId"`
+	ModelID   int       `json:"modelId"`
+	Model     string    `json:"model"`
+	Version   string    `json:"version"`
+	File      string    `json:"file"`
+	URL       string    `json:"url"`
+	Path      string    `json:"path"` // Where the file goes
+	Error     string    `json:"error"`
+	Category  string    `json:"category,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	Attempts  int       `json:"attempts"` // Failed downloads in a row
+	FailedAt  time.Time `json:"failedAt"`
+}
+
+// failedList is the failed download list written after each run.
+type failedList struct {
+	UpdatedAt time.Time        `json:"updatedAt"`
+	Failed    []failedDownload `json:"failed"`
+}
+
+// failedDownloads returns the entries in the Error state, most recent failure first.
+func failedDownloads(db *database.DB, savePath string) ([]failedDownload, error) {
+	failed := []failedDownload{}
+	err := db.Fold(func(key []byte, value []byte) error {
+		if !strings.HasPrefix(string(key), "v_") {
+			return nil
+		}
+		var entry models.DatabaseEntry
+		if json.Unmarshal(value, &entry) != nil || entry.Status != models.StatusError {
+			return nil
+		}
+		attempts := entry.FailedAttempts
+		if attempts == 0 {
+			attempts = 1 // Failed before attempts were counted
+		}
+		path := filepath.Join(entryVersionDir(savePath, entry), entry.File.Name)
+		if entry.Filename != "" {
+			path = entryFilePath(savePath, entry)
+		}
+		failed = append(failed, failedDownload{
+			Key:       string(key),
+			VersionID: entry.Version.ID,
+			ModelID:   entry.Version.ModelId,
+			Model:     entry.ModelName,
+			Version:   entry.Version.Name,
+			File:      entry.File.Name,
+			URL:       entry.File.DownloadUrl,
+			Path:      path,
+			Error:     entry.ErrorDetails,
+			Category:  entry.ErrorCategory,
+			Reason:    entry.ErrorReason,
+			Attempts:  attempts,
+			FailedAt:  time.Unix(entry.FailedAt, 0).UTC(),
+		})
+		return nil
+	})
+	sort.Slice(failed, func(i, j int) bool {
+		if !failed[i].FailedAt.Equal(failed[j].FailedAt) {
+			return failed[i].FailedAt.After(failed[j].FailedAt)
+		}
+		return failed[i].Key < failed[j].Key
+	})
+	return failed, err
+}
+
+// failedListPath returns where the failed download list is written (FailedListFile).
+func failedListPath(savePath string) string {
+	if path := viper.GetString("failedlistfile"); path != "" {
+		return path
+	}
+	return filepath.Join(savePath, failedListFile)
+}
+
+// writeFailedList writes every download in the Error state to the failed list, replacing
+// the previous one, and prints those that failed since since.
+func writeFailedList(db *database.DB, savePath string, since time.Time) {
+	failed, err := failedDownloads(db, savePath)
+	if err != nil {
+		log.WithError(err).Warn("Failed to list the failed downloads")
+		return
+	}
+	path := failedListPath(savePath)
+	data, err := json.MarshalIndent(failedList{UpdatedAt: time.Now().UTC(), Failed: failed}, "", "  ")
+	if err == nil {
+		err = helpers.WriteFile(path, append(data, '\n'), 0644)
+	}
+	if err != nil {
+		log.WithError(err).Warnf("Failed to write the failed download list %s", path)
+	}
+
+	var recent []failedDownload
+	for _, f := range failed {
+		if !f.FailedAt.Before(since.Truncate(time.Second)) {
+			recent = append(recent, f)
+		}
+	}
+	if len(recent) == 0 {
+		return
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "\n--- Failed Downloads (%d) ---\n", len(recent))
+	for i, f := range recent {
+		if i == failedListShown {
+			fmt.Fprintf(&b, "... and %d more\n", len(recent)-i)
+			break
+		}
+		attempts := ""
+		if f.Attempts > 1 {
+			attempts = fmt.Sprintf(", %d attempts", f.Attempts)
+		}
+		fmt.Fprintf(&b, "%s (%s - %s%s)\n  %s\n  %s\n", f.File, f.Model, f.Version, attempts, f.URL, f.Error)
+	}
+	fmt.Fprintf(&b, "All failed downloads are listed in %s; retry them with 'fetch --failed'.\n", path)
+	fmt.Print(b.String())
+}
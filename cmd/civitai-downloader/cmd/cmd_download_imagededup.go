@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"os"
+	"sync"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// imageRegistry remembers where each gallery image (by Civitai image ID) has been stored
+// in its original format during this run. The preview and version image pipelines share
+// it, so an image both of them want is fetched once and stored once, as hard links.
+type imageRegistry struct {
+	mu    sync.Mutex
+	paths map[int]string
+}
+
+// storedImages is the registry of the running process.
+var storedImages = &imageRegistry{paths: make(map[int]string)}
+
+// add records path as a stored copy of image id. If another copy with the same contents
+// was recorded, path is replaced by a hard link to it.
+func (r *imageRegistry) add(logPrefix string, id int, path string) {
+	if id == 0 || !viper.GetBool("dedupeimages") {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if known, ok := r.paths[id]; ok && known != path {
+		linked, err := helpers.LinkDuplicate(known, path)
+		if err == nil {
+			if linked {
+				log.Infof("[%s] Image %d: %s is a copy of %s, replaced it with a hard link", logPrefix, id, path, known)
+			}
+			return
+		}
+		if !os.IsNotExist(err) {
+			log.WithError(err).Debugf("[%s] Image %d: could not link %s to %s", logPrefix, id, path, known)
+			return
+		}
+		// The recorded copy is gone; this one takes its place
+	}
+	r.paths[id] = path
+}
+
+// lookup returns a stored copy of image id, or "" if there is none.
+func (r *imageRegistry) lookup(id int) string {
+	if id == 0 || !viper.GetBool("dedupeimages") {
+		return ""
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	path, ok := r.paths[id]
+	if !ok {
+		return ""
+	}
+	if _, err := os.Stat(path); err != nil {
+		delete(r.paths, id)
+		return ""
+	}
+	return path
+}
+
+// link creates target as a hard link to a stored copy of image id instead of downloading
+// it again. It reports whether it did; on false the caller downloads the image.
+func (r *imageRegistry) link(logPrefix string, id int, target string) bool {
+	source := r.lookup(id)
+	if source == "" {
+		return false
+	}
+	if err := os.Link(source, target); err != nil {
+		log.WithError(err).Debugf("[%s] Image %d: could not link %s to %s, downloading it", logPrefix, id, target, source)
+		return false
+	}
+	log.Debugf("[%s] Image %d: linked %s to the copy at %s", logPrefix, id, target, source)
+	return true
+}
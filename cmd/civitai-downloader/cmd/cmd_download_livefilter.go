@@ -0,0 +1,128 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+)
+
+// liveFilterSet holds filters injected into a running download batch via the control
+// interface (`ctl filter ...`). They are checked by workers right before a job starts,
+// so they only affect items that haven't begun downloading yet.
+type liveFilterSet struct {
+	mu                sync.RWMutex
+	maxSizeBytes      uint64   // 0 means no limit
+	excludeTypes      []string // Model types (case-insensitive exact match)
+	excludeBaseModels []string // Base model substrings (case-insensitive)
+	excludeNames      []string // File/model name substrings (case-insensitive)
+}
+
+// liveFilters is the filter set shared by the control handler and download workers.
+var liveFilters = &liveFilterSet{}
+
+// handleCommand applies a `filter` control command and returns a description of the result.
+// Supported forms:
+//
+//	filter show
+//	filter clear
+//	filter max-size <size>|off
+//	filter exclude-type <type>
+//	filter exclude-base-model <base model>
+//	filter exclude-name <substring>
+func (f *liveFilterSet) handleCommand(args []string) (string, error) {
+	if len(args) == 0 {
+		return "", fmt.Errorf("usage: filter show|clear|max-size <size>|exclude-type <type>|exclude-base-model <base>|exclude-name <substring>")
+	}
+	action := strings.ToLower(args[0])
+	value := strings.TrimSpace(strings.Join(args[1:], " "))
+
+	if action != "show" && action != "clear" && value == "" {
+		return "", fmt.Errorf("filter %s requires a value", action)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch action {
+	case "show":
+	case "clear":
+		f.maxSizeBytes = 0
+		f.excludeTypes = nil
+		f.excludeBaseModels = nil
+		f.excludeNames = nil
+	case "max-size":
+		if strings.EqualFold(value, "off") || value == "0" {
+			f.maxSizeBytes = 0
+			break
+		}
+		size, err := helpers.ParseByteSize(value)
+		if err != nil {
+			return "", err
+		}
+		f.maxSizeBytes = size
+	case "exclude-type":
+		f.excludeTypes = append(f.excludeTypes, value)
+	case "exclude-base-model":
+		f.excludeBaseModels = append(f.excludeBaseModels, value)
+	case "exclude-name":
+		f.excludeNames = append(f.excludeNames, value)
+	default:
+		return "", fmt.Errorf("unknown filter action '%s'", action)
+	}
+	return f.describeLocked(), nil
+}
+
+// describeLocked summarises the active filters. Caller must hold f.mu.
+func (f *liveFilterSet) describeLocked() string {
+	var parts []string
+	if f.maxSizeBytes > 0 {
+		parts = append(parts, "max-size="+helpers.BytesToSize(f.maxSizeBytes))
+	}
+	if len(f.excludeTypes) > 0 {
+		parts = append(parts, "exclude-type="+strings.Join(f.excludeTypes, ","))
+	}
+	if len(f.excludeBaseModels) > 0 {
+		parts = append(parts, "exclude-base-model="+strings.Join(f.excludeBaseModels, ","))
+	}
+	if len(f.excludeNames) > 0 {
+		parts = append(parts, "exclude-name="+strings.Join(f.excludeNames, ","))
+	}
+	if len(parts) == 0 {
+		return "no live filters active"
+	}
+	return "live filters: " + strings.Join(parts, "; ")
+}
+
+// skipReason returns why a download should be skipped under the current live filters,
+// or an empty string if it should go ahead.
+func (f *liveFilterSet) skipReason(pd potentialDownload) string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	sizeBytes := uint64(pd.File.SizeKB * 1024)
+	if f.maxSizeBytes > 0 && sizeBytes > f.maxSizeBytes {
+		return fmt.Sprintf("size %s exceeds live max-size %s", helpers.BytesToSize(sizeBytes), helpers.BytesToSize(f.maxSizeBytes))
+	}
+	for _, t := range f.excludeTypes {
+		if strings.EqualFold(pd.ModelType, t) {
+			return fmt.Sprintf("model type '%s' excluded by live filter", pd.ModelType)
+		}
+	}
+	baseLower := strings.ToLower(pd.BaseModel)
+	for _, b := range f.excludeBaseModels {
+		if strings.Contains(baseLower, strings.ToLower(b)) {
+			return fmt.Sprintf("base model '%s' excluded by live filter '%s'", pd.BaseModel, b)
+		}
+	}
+	fileLower := strings.ToLower(pd.File.Name)
+	modelLower := strings.ToLower(pd.ModelName)
+	for _, n := range f.excludeNames {
+		nLower := strings.ToLower(n)
+		if strings.Contains(fileLower, nLower) || strings.Contains(modelLower, nLower) {
+			return fmt.Sprintf("name matches live exclude-name '%s'", n)
+		}
+	}
+	return ""
+}
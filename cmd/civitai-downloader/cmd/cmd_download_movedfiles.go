@@ -0,0 +1,151 @@
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/database"
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// movedFileIndex finds the files of downloaded entries that are no longer at their recorded
+// path, because they were renamed or reorganized below SavePath by hand, by the SHA256 the
+// database has for them, so they aren't downloaded again. SavePath is scanned once, when
+// the first file turns up missing, and only files of the recorded size are hashed.
+type movedFileIndex struct {
+	mu       sync.Mutex
+	db       *database.DB
+	savePath string
+	scanned  bool
+	files    []movedFileCandidate // Untracked model files below SavePath, by size
+	sums     map[string]string    // SHA256 of the files hashed so far, by path
+	claimed  map[string]bool      // Files already matched to an entry
+}
+
+// movedFileCandidate is a model file below SavePath no entry records.
+type movedFileCandidate struct {
+	path string
+	size int64
+}
+
+// downloadMovedFiles finds moved files during a download run.
+var downloadMovedFiles *movedFileIndex
+
+// newMovedFileIndex returns an index of the files below savePath; it is filled on first use.
+func newMovedFileIndex(db *database.DB, savePath string) *movedFileIndex {
+	return &movedFileIndex{db: db, savePath: savePath, sums: make(map[string]string), claimed: make(map[string]bool)}
+}
+
+// entrySHA256 returns the SHA256 recorded for an entry's local file: computed when it was
+// downloaded, else pinned when it was first seen, else the published one.
+func entrySHA256(entry models.DatabaseEntry) string {
+	if sum := entry.LocalHashes[helpers.HashSHA256]; sum != "" {
+		return strings.ToLower(sum)
+	}
+	if entry.PinnedHashes != nil && entry.PinnedHashes.SHA256 != "" {
+		return strings.ToLower(entry.PinnedHashes.SHA256)
+	}
+	return strings.ToLower(entry.File.Hashes.SHA256)
+}
+
+// locate returns the path of a model file below SavePath that no entry records and that
+// has the SHA256 recorded for entry, or "" if there is none. A file is matched to one entry
+// only. A nil index finds nothing.
+func (x *movedFileIndex) locate(entry models.DatabaseEntry) string {
+	if x == nil {
+		return ""
+	}
+	sum := entrySHA256(entry)
+	if sum == "" || entry.File.SizeKB <= 0 {
+		return ""
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if !x.scanned {
+		x.scan()
+	}
+
+	// Civitai records sizes in KB, rounded
+	want := int64(entry.File.SizeKB * 1024)
+	from := sort.Search(len(x.files), func(i int) bool { return x.files[i].size >= want-1024 })
+	for _, f := range x.files[from:] {
+		if f.size > want+1024 {
+			break
+		}
+		if x.claimed[f.path] {
+			continue
+		}
+		got, ok := x.sums[f.path]
+		if !ok {
+			sums, err := helpers.HashFile(f.path, []string{helpers.HashSHA256})
+			if err != nil {
+				log.WithError(err).Warnf("Failed to hash %s while looking for moved files", f.path)
+			}
+			got = sums[helpers.HashSHA256]
+			x.sums[f.path] = got
+		}
+		if got == sum {
+			x.claimed[f.path] = true
+			return f.path
+		}
+	}
+	return ""
+}
+
+// scan lists the model files below SavePath that aren't the recorded file of an entry.
+func (x *movedFileIndex) scan() {
+	x.scanned = true
+	recorded := make(map[string]bool)
+	err := x.db.Fold(func(key []byte, value []byte) error {
+		if !strings.HasPrefix(string(key), "v_") {
+			return nil
+		}
+		var entry models.DatabaseEntry
+		if json.Unmarshal(value, &entry) == nil && entry.Filename != "" {
+			recorded[filepath.Clean(entryFilePath(x.savePath, entry))] = true
+		}
+		return nil
+	})
+	if err != nil {
+		log.WithError(err).Warn("Failed to read the database; moved files won't be looked for")
+		return
+	}
+	log.Infof("Scanning %s for downloaded files that were moved or renamed...", x.savePath)
+	err = filepath.WalkDir(x.savePath, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			log.WithError(err).Debugf("Skipping %s", path)
+			return nil
+		}
+		if !d.Type().IsRegular() || !adoptExtensions[strings.ToLower(filepath.Ext(path))] || recorded[filepath.Clean(path)] {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		x.files = append(x.files, movedFileCandidate{path: path, size: info.Size()})
+		return nil
+	})
+	if err != nil {
+		log.WithError(err).Warnf("Failed to scan %s for moved files", x.savePath)
+	}
+	sort.Slice(x.files, func(i, j int) bool { return x.files[i].size < x.files[j].size })
+}
+
+// relocateEntry records path, a file below savePath, as the location of entry's file.
+func relocateEntry(savePath string, entry *models.DatabaseEntry, path string) error {
+	rel, err := filepath.Rel(savePath, path)
+	if err != nil {
+		return err
+	}
+	entry.VersionDir = filepath.Dir(rel)
+	entry.Filename = filepath.Base(rel)
+	return nil
+}
@@ -0,0 +1,261 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/control"
+	"github.com/dreamfast/go-civitai-downloader/internal/database"
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// NSFW drift policies (NsfwDriftPolicy / --nsfw-drift).
+const (
+	nsfwDriftReport = "report"
+	nsfwDriftMove   = "move"
+	nsfwDriftPrune  = "prune"
+)
+
+// nsfwDriftReportFile is the JSON-lines report of drift events below SavePath.
+const nsfwDriftReportFile = "nsfw-drift.jsonl"
+
+// validateNsfwDriftPolicy checks a NsfwDriftPolicy value.
+func validateNsfwDriftPolicy(policy string) error {
+	switch strings.ToLower(policy) {
+	case "", nsfwDriftReport, nsfwDriftMove, nsfwDriftPrune:
+		return nil
+	}
+	return fmt.Errorf("unknown NsfwDriftPolicy %q (use %q, %q or %q)", policy, nsfwDriftReport, nsfwDriftMove, nsfwDriftPrune)
+}
+
+// nsfwDrift is a change of a downloaded model's classification, as reported.
+type nsfwDrift struct {
+	Time        time.Time `json:"time"`
+	Key         string    `json:"key"`
+	ModelID     int       `json:"modelId"`
+	ModelName   string    `json:"modelName"`
+	VersionID   int       `json:"versionId"`
+	File        string    `json:"file"`
+	NsfwBefore  *bool     `json:"nsfwBefore,omitempty"` // Set when the NSFW flag changed
+	NsfwAfter   *bool     `json:"nsfwAfter,omitempty"`
+	TagsAdded   []string  `json:"tagsAdded,omitempty"`
+	TagsRemoved []string  `json:"tagsRemoved,omitempty"`
+	Action      string    `json:"action"` // reported, moved, pruned or deferred (files in use)
+	MovedTo     string    `json:"movedTo,omitempty"`
+}
+
+// checkNsfwDrift compares a downloaded entry's recorded NSFW flag and tags with the ones
+// just fetched, reports changes and, if the model became NSFW, applies NsfwDriftPolicy.
+// It records the fetched classification in entry and reports whether the policy moved or
+// pruned the files (entry is updated for that as well).
+func checkNsfwDrift(db *database.DB, dbKey string, entry *models.DatabaseEntry, pd potentialDownload, savePath string) bool {
+	drift := nsfwDrift{
+		Time:      time.Now(),
+		Key:       dbKey,
+		ModelID:   entry.Version.ModelId,
+		ModelName: pd.ModelName,
+		VersionID: entry.Version.ID,
+		File:      entry.Filename,
+		Action:    "reported",
+	}
+	becameNsfw := false
+	if entry.ModelNsfw != nil && *entry.ModelNsfw != pd.ModelNsfw {
+		before, after := *entry.ModelNsfw, pd.ModelNsfw
+		drift.NsfwBefore, drift.NsfwAfter = &before, &after
+		becameNsfw = after
+	}
+	if pd.ModelTags != nil && entry.ModelTags != nil {
+		drift.TagsAdded, drift.TagsRemoved = tagChanges(entry.ModelTags, pd.ModelTags)
+	}
+
+	// The fetched classification becomes the baseline
+	nsfw := pd.ModelNsfw
+	entry.ModelNsfw = &nsfw
+	if pd.ModelTags != nil {
+		entry.ModelTags = pd.ModelTags
+	}
+	if pd.ModelNsfwLevel != 0 {
+		entry.ModelNsfwLevel = pd.ModelNsfwLevel
+	}
+	if drift.NsfwAfter == nil && len(drift.TagsAdded) == 0 && len(drift.TagsRemoved) == 0 {
+		return false
+	}
+
+	acted := false
+	policy := strings.ToLower(viper.GetString("nsfwdriftpolicy"))
+	if becameNsfw && (policy == nsfwDriftMove || policy == nsfwDriftPrune) {
+		var err error
+		if policy == nsfwDriftMove {
+			drift.MovedTo, err = moveDriftedEntry(db, savePath, entry)
+			drift.Action = "moved"
+		} else {
+			err = pruneDriftedEntry(db, savePath, entry)
+			drift.Action = "pruned"
+		}
+		if errors.Is(err, helpers.ErrFileInUse) {
+			// Keep the old baseline, so the drift is found and acted on again next run
+			entry.ModelNsfw = drift.NsfwBefore
+			drift.Action = "deferred"
+		} else if err != nil {
+			log.WithError(err).Errorf("NSFW drift: failed to %s %s (Key: %s); only reporting it", policy, entry.Filename, dbKey)
+			drift.Action, drift.MovedTo = "reported", ""
+		} else {
+			acted = true
+		}
+	}
+
+	logDrift := log.WithFields(log.Fields{control.EventField: "nsfw-drift", "key": dbKey})
+	if drift.NsfwAfter != nil {
+		logDrift = logDrift.WithField("nsfw", fmt.Sprintf("%t -> %t", *drift.NsfwBefore, *drift.NsfwAfter))
+	}
+	if len(drift.TagsAdded) > 0 {
+		logDrift = logDrift.WithField("tagsAdded", strings.Join(drift.TagsAdded, ","))
+	}
+	if len(drift.TagsRemoved) > 0 {
+		logDrift = logDrift.WithField("tagsRemoved", strings.Join(drift.TagsRemoved, ","))
+	}
+	logDrift.Warnf("NSFW drift: %s (%d) was reclassified upstream (%s %s)", pd.ModelName, drift.ModelID, drift.Action, entry.Filename)
+
+	if line, err := json.Marshal(drift); err == nil {
+		if err := appendLine(filepath.Join(savePath, nsfwDriftReportFile), string(line)); err != nil {
+			log.WithError(err).Warn("Failed to write the NSFW drift report")
+		}
+	}
+	return acted
+}
+
+// tagChanges returns the tags (case-insensitively) only in after and only in before, sorted.
+func tagChanges(before, after []string) (added, removed []string) {
+	index := func(tags []string) map[string]string {
+		m := make(map[string]string, len(tags))
+		for _, t := range tags {
+			m[strings.ToLower(strings.TrimSpace(t))] = t
+		}
+		return m
+	}
+	was, is := index(before), index(after)
+	for k, t := range is {
+		if _, ok := was[k]; !ok {
+			added = append(added, t)
+		}
+	}
+	for k, t := range was {
+		if _, ok := is[k]; !ok {
+			removed = append(removed, t)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+// driftedPaths are the files of an entry in its version directory: the ones named after
+// its model file, plus the version images if no other entry shares the directory.
+func driftedPaths(db *database.DB, savePath string, entry models.DatabaseEntry) (dir string, paths []string, err error) {
+	dir = entryVersionDir(savePath, entry)
+	users, err := versionDirUsers(db, savePath)
+	if err != nil {
+		return dir, nil, err
+	}
+	children, err := os.ReadDir(dir)
+	if err != nil {
+		return dir, nil, err
+	}
+	stem := fileStem(entry.Filename)
+	for _, child := range children {
+		switch {
+		case child.IsDir() && child.Name() == "images" && users[dir] <= 1:
+			paths = append(paths, filepath.Join(dir, child.Name()))
+		case !child.IsDir() && stem != "" && strings.HasPrefix(child.Name(), stem):
+			paths = append(paths, filepath.Join(dir, child.Name()))
+		}
+	}
+	return dir, paths, nil
+}
+
+// moveDriftedEntry moves an entry's files to the same layout below NsfwDriftDir and
+// records the new place. It returns the new version directory.
+func moveDriftedEntry(db *database.DB, savePath string, entry *models.DatabaseEntry) (string, error) {
+	driftDir := viper.GetString("nsfwdriftdir")
+	if driftDir == "" {
+		driftDir = filepath.Join(savePath, "nsfw")
+	}
+	target, err := moveEntryFiles(db, savePath, driftDir, entry)
+	if err != nil {
+		return "", err
+	}
+	entry.NsfwMovedAt = time.Now().Unix()
+	return target, nil
+}
+
+// moveEntryFiles moves an entry's files to the same layout below root and records the new
+// place. It returns the new version directory.
+func moveEntryFiles(db *database.DB, savePath, root string, entry *models.DatabaseEntry) (string, error) {
+	dir, paths, err := driftedPaths(db, savePath, *entry)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(savePath, dir)
+	if err != nil {
+		return "", err
+	}
+	target := filepath.Join(root, rel)
+	newDir, err := filepath.Rel(savePath, target)
+	if err != nil {
+		return "", err
+	}
+
+	var done []completedMove
+	for _, p := range paths {
+		if err := moveTree(p, filepath.Join(target, filepath.Base(p)), &done); err != nil {
+			rollbackMoves(done)
+			return "", err
+		}
+	}
+	removeEmptyDirs(dir, savePath)
+	entry.VersionDir = newDir
+	entry.Folder = filepath.Dir(newDir)
+	return target, nil
+}
+
+// pruneDriftedEntry deletes an entry's files and marks it Pruned, so it isn't downloaded
+// again.
+func pruneDriftedEntry(db *database.DB, savePath string, entry *models.DatabaseEntry) error {
+	if err := pruneEntryFiles(db, savePath, *entry); err != nil {
+		return err
+	}
+	entry.Status = models.StatusPruned
+	entry.ErrorDetails = "Pruned after the model was reclassified as NSFW upstream"
+	return nil
+}
+
+// pruneEntryFiles deletes an entry's files. Nothing is deleted while another process has
+// one of them open.
+func pruneEntryFiles(db *database.DB, savePath string, entry models.DatabaseEntry) error {
+	dir, paths, err := driftedPaths(db, savePath, entry)
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		if err := helpers.CheckNotInUse(p); err != nil {
+			return err
+		}
+	}
+	for _, p := range paths {
+		if err := os.RemoveAll(p); err != nil {
+			return err
+		}
+	}
+	removeEmptyDirs(dir, savePath)
+	return nil
+}
@@ -0,0 +1,164 @@
+package cmd
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// NSFW partitions (NsfwPartition / --nsfw-partition): the top-level directory below
+// SavePath each model is kept in.
+const (
+	nsfwPartitionRating = "rating" // sfw, nsfw
+	nsfwPartitionLevel  = "level"  // pg, pg13, r, x, xxx
+)
+
+// nsfwPartitionNames are the directories each partition policy creates.
+var nsfwPartitionNames = map[string][]string{
+	nsfwPartitionRating: {"sfw", "nsfw"},
+	nsfwPartitionLevel:  {"pg", "pg13", "r", "x", "xxx", "sfw", "nsfw"}, // sfw/nsfw: level unknown
+}
+
+// validateNsfwPartition checks NsfwPartition and NsfwPartitionModes.
+func validateNsfwPartition() error {
+	policy := strings.ToLower(viper.GetString("nsfwpartition"))
+	if policy != "" && nsfwPartitionNames[policy] == nil {
+		return fmt.Errorf("unknown NsfwPartition %q (use %q or %q)", viper.GetString("nsfwpartition"), nsfwPartitionRating, nsfwPartitionLevel)
+	}
+	_, err := nsfwPartitionModes()
+	return err
+}
+
+// nsfwPartitionModes returns the permissions configured for the partition directories.
+func nsfwPartitionModes() (map[string]os.FileMode, error) {
+	policy := strings.ToLower(viper.GetString("nsfwpartition"))
+	configured := viper.GetStringMapString("nsfwpartitionmodes")
+	if policy == "" || len(configured) == 0 {
+		return nil, nil
+	}
+	modes := make(map[string]os.FileMode, len(configured))
+	for name, value := range configured {
+		name = strings.ToLower(name)
+		known := false
+		for _, n := range nsfwPartitionNames[policy] {
+			known = known || n == name
+		}
+		if !known {
+			return nil, fmt.Errorf("NsfwPartitionModes: %q is not a partition of NsfwPartition %q (use %s)", name, policy, strings.Join(nsfwPartitionNames[policy], ", "))
+		}
+		mode, err := strconv.ParseUint(strings.TrimSpace(value), 8, 32)
+		if err != nil || mode > 0o777 {
+			return nil, fmt.Errorf("NsfwPartitionModes: invalid mode %q for %s (use octal, e.g. \"0750\")", value, name)
+		}
+		modes[name] = os.FileMode(mode)
+	}
+	return modes, nil
+}
+
+// nsfwPartition returns the partition directory of a model, or "" without NsfwPartition.
+func nsfwPartition(nsfw bool, level int) string {
+	switch strings.ToLower(viper.GetString("nsfwpartition")) {
+	case nsfwPartitionRating:
+		return helpers.NsfwRating(nsfw, level)
+	case nsfwPartitionLevel:
+		return helpers.NsfwLevelName(nsfw, level)
+	}
+	return ""
+}
+
+// pathTemplate returns the PathTemplate in effect. With NsfwPartition set, version
+// directories are kept below the partition's top-level directory: {rating} or {nsfwLevel}
+// is put in front of the template unless it already starts with it. With DisambiguateNames
+// the model and version names carry their IDs.
+func pathTemplate() string {
+	tmpl := viper.GetString("pathtemplate")
+	if strings.TrimSpace(tmpl) == "" {
+		tmpl = helpers.DefaultPathTemplate
+	}
+	if viper.GetBool("disambiguatenames") {
+		tmpl = helpers.DisambiguatePathTemplate(tmpl)
+	}
+	var placeholder string
+	switch strings.ToLower(viper.GetString("nsfwpartition")) {
+	case nsfwPartitionRating:
+		placeholder = "{rating}"
+	case nsfwPartitionLevel:
+		placeholder = "{nsfwLevel}"
+	default:
+		return tmpl
+	}
+	first, _, _ := strings.Cut(strings.ReplaceAll(tmpl, "\\", "/"), "/")
+	if strings.EqualFold(first, placeholder) {
+		return tmpl
+	}
+	return placeholder + "/" + tmpl
+}
+
+// modelDirFor returns the directory of a model's info file and gallery images,
+// {SavePath}/[{partition}/]{type}/{model}, or {model}-{modelId} with DisambiguateNames.
+func modelDirFor(savePath, modelType, modelName string, modelID int, nsfw bool, level int) string {
+	name := helpers.ConvertToSlug(modelName)
+	if viper.GetBool("disambiguatenames") && modelID > 0 {
+		name = fmt.Sprintf("%s-%d", name, modelID)
+	}
+	return filepath.Join(savePath, nsfwPartition(nsfw, level), helpers.ConvertToSlug(modelType), name)
+}
+
+// applyNsfwPartitionModes creates the partition directories that have a mode in
+// NsfwPartitionModes and gives it to them and everything below them: directories get the
+// mode, files the mode without execute bits.
+func applyNsfwPartitionModes(savePath string) {
+	modes, err := nsfwPartitionModes()
+	if err != nil || len(modes) == 0 {
+		return
+	}
+	names := make([]string, 0, len(modes))
+	for name := range modes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		dirMode := modes[name]
+		fileMode := dirMode &^ 0o111
+		root := filepath.Join(savePath, name)
+		if err := helpers.MkdirAll(root, dirMode); err != nil {
+			log.WithError(err).Warnf("Failed to create the %s partition %s", name, root)
+			continue
+		}
+		changed := 0
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.Type()&fs.ModeSymlink != 0 {
+				return nil
+			}
+			want := fileMode
+			if d.IsDir() {
+				want = dirMode
+			}
+			info, err := d.Info()
+			if err != nil || info.Mode().Perm() == want {
+				return nil
+			}
+			if err := os.Chmod(path, want); err != nil {
+				log.WithError(err).Warnf("Failed to set the permissions of %s", path)
+				return nil
+			}
+			changed++
+			return nil
+		})
+		if err != nil {
+			log.WithError(err).Warnf("Failed to apply the permissions of the %s partition", name)
+		}
+		if changed > 0 {
+			log.Infof("Set the permissions of %d path(s) in the %s partition to %04o", changed, name, dirMode)
+		}
+	}
+}
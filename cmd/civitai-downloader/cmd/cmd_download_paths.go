@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/dreamfast/go-civitai-downloader/civitai"
+	"github.com/dreamfast/go-civitai-downloader/internal/database"
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// modelPathOverrides are the directories (relative to SavePath) set with 'db set-path' for
+// models whose files don't follow PathTemplate, by model ID. Loaded by loadPathOverrides.
+var modelPathOverrides map[int]string
+
+// loadPathOverrides reads the path overrides for targetPathFor from db.
+func loadPathOverrides(db *database.DB) {
+	overrides, err := db.PathOverrides()
+	if err != nil {
+		log.WithError(err).Warn("Failed to read the path overrides; every model follows PathTemplate")
+	}
+	modelPathOverrides = overrides
+}
+
+// targetPathFor returns the version directory (relative to savePath) a file is saved in,
+// laid out by PathTemplate or the model's path override, and the file's full target path.
+// If the template cannot be rendered for this file the default layout is used.
+func targetPathFor(savePath string, model models.Model, modelType string, version models.ModelVersion, file models.File) (dir string, path string) {
+	template := pathTemplate()
+	dir, path, err := civitai.TemplatePath(savePath, template, model, modelType, version, file)
+	if err != nil {
+		log.WithError(err).Warnf("Using the default layout for %s (version %d)", file.Name, version.ID)
+		dir, path, _ = civitai.TemplatePath(savePath, civitai.DefaultPathTemplate, model, modelType, version, file)
+	}
+	if override, ok := modelPathOverrides[model.ID]; ok {
+		return override, filepath.Join(savePath, override, filepath.Base(path))
+	}
+	return dir, path
+}
+
+// cleanPathOverride checks a path given to 'db set-path' and returns it cleaned. It must
+// stay below SavePath.
+func cleanPathOverride(dir string) (string, error) {
+	dir = filepath.Clean(strings.TrimSpace(dir))
+	if dir == "." || !filepath.IsLocal(dir) {
+		return "", fmt.Errorf("%q is not a directory below SavePath", dir)
+	}
+	return dir, nil
+}
+
+// entryPathValues are the path template values of a stored entry, filed under modelType.
+func entryPathValues(entry models.DatabaseEntry, modelType string) helpers.PathValues {
+	return helpers.PathValues{
+		Type:      modelType,
+		Model:     entry.ModelName,
+		ModelID:   entry.Version.ModelId,
+		BaseModel: entry.Version.BaseModel,
+		Creator:   entry.Creator.Username,
+		Version:   entry.Version.Name,
+		VersionID: entry.Version.ID,
+		File:      entry.File.Name,
+		Nsfw:      entry.ModelNsfw != nil && *entry.ModelNsfw,
+		NsfwLevel: entry.ModelNsfwLevel,
+	}
+}
+
+// entryFilePath returns where a stored entry's file is: its version directory plus the
+// recorded file name.
+func entryFilePath(savePath string, entry models.DatabaseEntry) string {
+	return filepath.Join(entryVersionDir(savePath, entry), entry.Filename)
+}
+
+// entryFileNameVersionID returns the version ID the downloader prefixes an entry's file
+// name with (see civitai.FileNameVersionID). Embeddings saved before they were named by
+// their activation token keep their prefixed name.
+func entryFileNameVersionID(entry models.DatabaseEntry) int {
+	if strings.HasPrefix(entry.Filename, fmt.Sprintf("%d_", entry.Version.ID)) {
+		return entry.Version.ID
+	}
+	return civitai.FileNameVersionID(entry.ModelType, entry.Version.ID)
+}
+
+// recordEmbeddingToken sets the activation token of an embedding entry: the name its file
+// is saved under, without extension.
+func recordEmbeddingToken(entry *models.DatabaseEntry) {
+	if helpers.IsEmbeddingType(entry.ModelType) || helpers.IsEmbeddingType(entry.InferredType) {
+		entry.EmbeddingToken = helpers.EmbeddingToken(entry.Filename)
+	}
+}
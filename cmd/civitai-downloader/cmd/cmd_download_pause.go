@@ -0,0 +1,153 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/control"
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+)
+
+// pauseControl pauses the downloads of a running session (`ctl pause`, SIGUSR1) and resumes
+// them (`ctl resume`, SIGUSR2). Pausing aborts the transfers in flight, keeping their partial
+// files, and holds the workers back; resuming lets them go on, continuing the partial files
+// where they stopped. Nothing is sent while paused, so the bandwidth is free for other use.
+type pauseControl struct {
+	mu      sync.Mutex
+	paused  bool
+	since   time.Time
+	resumed chan struct{}      // Closed on resume
+	ctx     context.Context    // Of the transfers started since the last resume
+	cancel  context.CancelFunc // Aborts them on pause
+}
+
+// downloadPause is the pause state of the process, shared by the workers, the control
+// handlers and the signal handler.
+var downloadPause = newPauseControl()
+
+func newPauseControl() *pauseControl {
+	p := &pauseControl{}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	return p
+}
+
+// pause pauses the downloads. It reports whether they were running.
+func (p *pauseControl) pause(source string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.paused {
+		return false
+	}
+	p.paused = true
+	p.since = time.Now()
+	p.resumed = make(chan struct{})
+	p.cancel()
+	log.WithField(control.EventField, "paused").Infof("Downloads paused (%s); transfers in flight stop and keep their partial files", source)
+	return true
+}
+
+// resume resumes paused downloads. It reports whether they were paused.
+func (p *pauseControl) resume(source string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.paused {
+		return false
+	}
+	p.paused = false
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	close(p.resumed)
+	log.WithField(control.EventField, "resumed").Infof("Downloads resumed (%s) after %v", source, time.Since(p.since).Round(time.Second))
+	return true
+}
+
+// isPaused reports whether the downloads are paused.
+func (p *pauseControl) isPaused() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.paused
+}
+
+// transferContext returns the context to start a transfer with: it is cancelled when the
+// downloads are paused.
+func (p *pauseControl) transferContext() context.Context {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.ctx
+}
+
+// wait blocks while the downloads are paused. It reports whether it waited.
+func (p *pauseControl) wait(logPrefix string) bool {
+	p.mu.Lock()
+	if !p.paused {
+		p.mu.Unlock()
+		return false
+	}
+	resumed := p.resumed
+	p.mu.Unlock()
+	log.Debugf("%s: paused, waiting for resume", logPrefix)
+	<-resumed
+	return true
+}
+
+// handleCommand answers the `pause`, `resume` and `paused` control commands.
+func (p *pauseControl) handleCommand(command string) control.HandlerFunc {
+	return func(args []string) (string, error) {
+		if len(args) > 0 {
+			return "", fmt.Errorf("usage: %s", command)
+		}
+		switch command {
+		case "pause":
+			if !p.pause("ctl pause") {
+				return "Downloads are already paused.", nil
+			}
+			return "Downloads paused. Run 'ctl resume' to continue.", nil
+		case "resume":
+			if !p.resume("ctl resume") {
+				return "Downloads are not paused.", nil
+			}
+			return "Downloads resumed.", nil
+		}
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.paused {
+			return fmt.Sprintf("Paused since %s.", p.since.Format(time.RFC1123)), nil
+		}
+		return "Running.", nil
+	}
+}
+
+// notifyPauseSignals pauses the downloads on SIGUSR1 and resumes them on SIGUSR2, where the
+// platform has them, until the returned function is called.
+func notifyPauseSignals() (stop func()) {
+	pauseSignal, resumeSignal, ok := helpers.PauseSignals()
+	if !ok {
+		return func() {}
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, pauseSignal, resumeSignal)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case sig := <-signals:
+				if sig == pauseSignal {
+					downloadPause.pause("SIGUSR1")
+				} else {
+					downloadPause.resume("SIGUSR2")
+				}
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/database"
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// hasAnyHash reports whether the API supplied at least one hash for a file.
+func hasAnyHash(h models.Hashes) bool {
+	return h.SHA256 != "" || h.BLAKE3 != "" || h.CRC32 != "" || h.AutoV2 != ""
+}
+
+// pinFileHashes records file's hashes as the trusted pin on entry. Files without
+// hashes can't be pinned and are left alone.
+func pinFileHashes(entry *models.DatabaseEntry, file models.File) {
+	if !hasAnyHash(file.Hashes) {
+		return
+	}
+	hashes := file.Hashes
+	entry.PinnedHashes = &hashes
+	entry.PinnedFileID = file.ID
+	entry.PinnedAt = time.Now().Unix()
+}
+
+// hashPinChange compares the file about to be downloaded with the pin on entry and
+// describes the change, or returns "" if there is no pin or the hashes agree.
+// A different file ID (e.g. a different precision was selected) is not a change.
+func hashPinChange(entry models.DatabaseEntry, file models.File) string {
+	if entry.PinnedHashes == nil || entry.PinnedFileID != file.ID {
+		return ""
+	}
+	algo := helpers.HashChange(*entry.PinnedHashes, file.Hashes)
+	if algo == "" {
+		return ""
+	}
+	pinnedAt := time.Unix(entry.PinnedAt, 0).Format(time.RFC3339)
+	return fmt.Sprintf("%s of file %d (%s) changed upstream since it was first seen on %s: pinned %s, now %s",
+		algo, file.ID, file.Name, pinnedAt, pinnedHashValue(*entry.PinnedHashes, algo), pinnedHashValue(file.Hashes, algo))
+}
+
+func pinnedHashValue(h models.Hashes, algo string) string {
+	switch algo {
+	case "SHA256":
+		return h.SHA256
+	case "BLAKE3":
+		return h.BLAKE3
+	case "CRC32":
+		return h.CRC32
+	default:
+		return h.AutoV2
+	}
+}
+
+// checkHashPinForDownload looks up the DB entry for a queued download and reports a
+// hash change against its pin. It returns "" when the download may go ahead.
+func checkHashPinForDownload(db *database.DB, dbKey string, file models.File) string {
+	rawValue, err := db.Get([]byte(dbKey))
+	if err != nil {
+		return ""
+	}
+	var entry models.DatabaseEntry
+	if err := json.Unmarshal(rawValue, &entry); err != nil {
+		log.WithError(err).Debugf("Could not read DB entry %s for hash pin check", dbKey)
+		return ""
+	}
+	return hashPinChange(entry, file)
+}
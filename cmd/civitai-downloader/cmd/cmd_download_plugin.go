@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/dreamfast/go-civitai-downloader/civitai"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// pluginFilters are the user-supplied filters (FilterExpression, FilterCommand) of the
+// current download run, applied after the built-in file filters.
+var pluginFilters []civitai.Filter
+
+// newPluginFilters builds the plugin filters from FilterExpression and FilterCommand.
+func newPluginFilters() ([]civitai.Filter, error) {
+	var filters []civitai.Filter
+	if expression := strings.TrimSpace(viper.GetString("filterexpression")); expression != "" {
+		filter, err := civitai.NewExprFilter(expression)
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("Filtering files with expression: %s", expression)
+		filters = append(filters, filter)
+	}
+	if command := strings.Fields(viper.GetString("filtercommand")); len(command) > 0 {
+		if _, err := exec.LookPath(command[0]); err != nil {
+			return nil, fmt.Errorf("filter command %q not found: %w", command[0], err)
+		}
+		log.Infof("Filtering files with command: %s", strings.Join(command, " "))
+		filters = append(filters, civitai.CommandFilter{Command: command})
+	}
+	return filters, nil
+}
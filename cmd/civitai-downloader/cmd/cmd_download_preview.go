@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"image"
+	_ "image/gif" // Register decoders for image.Decode
+	_ "image/jpeg"
+	"image/png"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/downloader"
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// savePreviewImage saves the version's preview as <model file>.preview.png next to the
+// model file (the name A1111/Forge/ComfyUI look for). The image is chosen by
+// helpers.SelectPreviewImage; the returned choice is recorded in the sidecar.
+// Returns nil if the version has no usable image or saving failed.
+func savePreviewImage(logPrefix string, pd potentialDownload, modelFilePath string, imageDownloader *downloader.Downloader) *helpers.PreviewChoice {
+	choice, ok := helpers.SelectPreviewImage(pd.OriginalImages, viper.GetBool("nsfw"))
+	if !ok {
+		log.Debugf("[%s] No usable preview image for %s (%s)", logPrefix, pd.ModelName, pd.VersionName)
+		return nil
+	}
+
+	stem := strings.TrimSuffix(modelFilePath, filepath.Ext(modelFilePath))
+	previewPath := stem + ".preview.png"
+	if _, err := os.Stat(previewPath); err == nil {
+		log.Debugf("[%s] Preview %s already exists", logPrefix, filepath.Base(previewPath))
+		choice.File = filepath.Base(previewPath)
+		return &choice
+	}
+	if imageDownloader == nil {
+		log.Warnf("[%s] Image downloader is nil, cannot save preview.", logPrefix)
+		return nil
+	}
+
+	ext := ".jpeg"
+	if u, err := url.Parse(choice.URL); err == nil {
+		if e := filepath.Ext(u.Path); e != "" && len(e) <= 5 {
+			ext = strings.ToLower(e)
+		}
+	}
+	// Start from the version image if that pipeline already stored it
+	downloaded := ""
+	if stored := storedImages.lookup(choice.ImageID); stored != "" {
+		source := stem + ".preview-source" + filepath.Ext(stored)
+		if storedImages.link(logPrefix, choice.ImageID, source) {
+			downloaded = source
+		}
+	}
+	if downloaded == "" {
+		var err error
+		downloaded, err = imageDownloader.DownloadFile(stem+".preview-source"+ext, choice.URL, models.Hashes{}, 0)
+		if err != nil {
+			log.WithError(err).Warnf("[%s] Failed to download preview image %d for %s", logPrefix, choice.ImageID, pd.ModelName)
+			return nil
+		}
+	}
+
+	finalPath, err := convertToPNG(downloaded, previewPath)
+	if err != nil {
+		// Formats the standard library can't decode (e.g. WebP) are kept as-is
+		finalPath = stem + ".preview" + filepath.Ext(downloaded)
+		log.WithError(err).Debugf("[%s] Keeping preview in its original format as %s", logPrefix, filepath.Base(finalPath))
+		if renameErr := os.Rename(downloaded, finalPath); renameErr != nil {
+			log.WithError(renameErr).Warnf("[%s] Failed to move preview into place", logPrefix)
+			os.Remove(downloaded)
+			return nil
+		}
+		storedImages.add(logPrefix, choice.ImageID, finalPath)
+	}
+
+	choice.File = filepath.Base(finalPath)
+	log.Infof("[%s] Saved preview %s (image %d, %s)", logPrefix, choice.File, choice.ImageID, choice.Reason)
+	return &choice
+}
+
+// convertToPNG re-encodes src as a PNG at dst and removes src on success.
+func convertToPNG(src, dst string) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	img, _, err := image.Decode(in)
+	in.Close()
+	if err != nil {
+		return "", err
+	}
+
+	// Encode in the staging dir; the finished PNG is moved next to the model
+	tempDir := downloadTempDir()
+	if err := os.MkdirAll(tempDir, 0700); err != nil {
+		return "", err
+	}
+	out, err := os.CreateTemp(tempDir, filepath.Base(dst)+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	tmp := out.Name()
+	if err := png.Encode(out, img); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := os.Chmod(tmp, 0644); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := helpers.MoveFile(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	os.Remove(src)
+	return dst, nil
+}
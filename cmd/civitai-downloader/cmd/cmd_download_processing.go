@@ -12,10 +12,11 @@ import (
 	"sync/atomic"
 	"time"
 
-	"go-civitai-download/internal/database"
-	"go-civitai-download/internal/downloader"
-	"go-civitai-download/internal/helpers"
-	"go-civitai-download/internal/models"
+	"github.com/dreamfast/go-civitai-downloader/internal/database"
+	"github.com/dreamfast/go-civitai-downloader/internal/downloader"
+	"github.com/dreamfast/go-civitai-downloader/internal/failure"
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
@@ -41,6 +42,7 @@ func imageDownloadWorkerInternal(id int, jobs <-chan imageDownloadJob, imageDown
 		// Check if image exists already
 		if _, statErr := os.Stat(job.TargetPath); statErr == nil {
 			log.Debugf("[%s-Worker-%d] Skipping image %s - already exists.", logPrefix, id, job.LogFilename)
+			storedImages.add(logPrefix, job.ImageID, job.TargetPath)
 			continue
 		} else if !os.IsNotExist(statErr) {
 			log.WithError(statErr).Warnf("[%s-Worker-%d] Failed to check status of target image file %s. Skipping.", logPrefix, id, job.TargetPath)
@@ -48,6 +50,12 @@ func imageDownloadWorkerInternal(id int, jobs <-chan imageDownloadJob, imageDown
 			continue
 		}
 
+		// The preview pipeline may already have fetched it
+		if storedImages.link(logPrefix, job.ImageID, job.TargetPath) {
+			atomic.AddInt64(successCounter, 1)
+			continue
+		}
+
 		// Download the image
 		log.Debugf("[%s-Worker-%d] Downloading image %s from %s", logPrefix, id, job.LogFilename, job.SourceURL)
 		_, dlErr := imageDownloader.DownloadFile(job.TargetPath, job.SourceURL, models.Hashes{}, 0)
@@ -57,6 +65,7 @@ func imageDownloadWorkerInternal(id int, jobs <-chan imageDownloadJob, imageDown
 			atomic.AddInt64(failureCounter, 1)
 		} else {
 			log.Debugf("[%s-Worker-%d] Downloaded image %s successfully.", logPrefix, id, job.LogFilename)
+			storedImages.add(logPrefix, job.ImageID, job.TargetPath)
 			atomic.AddInt64(successCounter, 1)
 		}
 	}
@@ -99,9 +108,14 @@ func processPage(db *database.DB, pageDownloads []potentialDownload, cfg *models
 				Creator:      pd.Creator,                       // Store the creator struct
 				Filename:     filepath.Base(pd.TargetFilepath), // Use the calculated filename
 				Folder:       pd.Slug,                          // Use the calculated folder slug
+				VersionDir:   pd.VersionDir,                    // The rendered PathTemplate
+				ModelNsfw:    &pd.ModelNsfw,                    // Baseline for NSFW drift checks
+				ModelTags:    pd.ModelTags,                     // Nil if the response listed none
+				Permissions:  pd.Permissions,                   // Nil for version lookups
 				Status:       models.StatusPending,             // Use constant
 				ErrorDetails: "",                               // Use correct field name
 			}
+			newEntry.ModelNsfwLevel = pd.ModelNsfwLevel // Renders {rating}/{nsfwLevel} again in migrate-paths
 			// Marshal the new entry to JSON before putting into DB
 			entryBytes, marshalErr := json.Marshal(newEntry)
 			if marshalErr != nil {
@@ -131,20 +145,35 @@ func processPage(db *database.DB, pageDownloads []potentialDownload, cfg *models
 			case models.StatusDownloaded:
 				log.Debugf("DB Status for %s (VersionID: %d, Key: %s) is Downloaded. Checking filesystem...", pd.FinalBaseFilename, pd.CleanedVersion.ID, dbKey)
 
-				// Construct the path using the FILENAME STORED IN THE DB ENTRY, which includes the prepended ID.
-				expectedPathFromDB := filepath.Join(filepath.Dir(pd.TargetFilepath), entry.Filename)
+				// Construct the path using the LOCATION STORED IN THE DB ENTRY; the filename includes the prepended ID.
+				// It differs from the target path if PathTemplate changed or the type was detected.
+				expectedPathFromDB := entryFilePath(cfg.SavePath, entry)
 				log.Debugf("Checking for file existence at: %s (based on DB entry filename)", expectedPathFromDB)
 
 				// Check if the file *actually* exists on disk using the DB filename
-				if _, statErr := os.Stat(expectedPathFromDB); os.IsNotExist(statErr) {
+				_, statErr := os.Stat(expectedPathFromDB)
+				if os.IsNotExist(statErr) {
+					// Renamed or reorganized by hand? Look for it by its recorded hash
+					if moved := downloadMovedFiles.locate(entry); moved != "" {
+						if relocateErr := relocateEntry(cfg.SavePath, &entry, moved); relocateErr == nil {
+							log.Infof("%s (Key: %s) is not at %s, but %s has its SHA256; recording the new location.", pd.FinalBaseFilename, dbKey, expectedPathFromDB, moved)
+							expectedPathFromDB, statErr = moved, nil
+						}
+					}
+				}
+				if os.IsNotExist(statErr) {
 					// File is missing despite DB saying downloaded!
 					log.Warnf("File %s marked as downloaded in DB (Key: %s), but not found on disk! Re-queuing.", expectedPathFromDB, dbKey)
 					shouldQueue = true
 					// Update status back to Pending and clear error
 					entry.Status = models.StatusPending
 					entry.ErrorDetails = ""
+					entry.ErrorCategory = ""
+					entry.ErrorReason = ""
 					// Update other fields that might change
 					entry.Folder = pd.Slug
+					entry.VersionDir = pd.VersionDir
+					entry.NsfwMovedAt = 0
 					entry.Version = pd.CleanedVersion
 					entry.File = pd.File
 					// Update DB entry to reflect Pending status
@@ -159,15 +188,28 @@ func processPage(db *database.DB, pageDownloads []potentialDownload, cfg *models
 					// End of handling missing file
 				} else if statErr == nil {
 					// File *does* exist, proceed with original skip logic + metadata check
-					log.Infof("Skipping %s (VersionID: %d, Key: %s) - File exists and DB status is Downloaded.", pd.TargetFilepath, pd.CleanedVersion.ID, dbKey)
-					// Update fields that might change between runs
-					entry.Folder = pd.Slug
+					log.Infof("Skipping %s (VersionID: %d, Key: %s) - File exists and DB status is Downloaded.", expectedPathFromDB, pd.CleanedVersion.ID, dbKey)
+					downloadRunStats.skip(skippedDownloaded)
+					noteSeenUpstream(dbKey, &entry, cfg.SavePath) // Listed again: not removed
+					// A model reclassified as NSFW may be moved or pruned (NsfwDriftPolicy)
+					drifted := checkNsfwDrift(db, dbKey, &entry, pd, cfg.SavePath)
+					if dir := filepath.Dir(expectedPathFromDB); !drifted && dir != filepath.Dir(pd.TargetFilepath) && entry.InferredType == "" && entry.NsfwMovedAt == 0 {
+						log.Warnf("%s is not where PathTemplate puts it (%s); run 'migrate-paths' to move it", dir, filepath.Dir(pd.TargetFilepath))
+					}
+					// Entries downloaded before hash pinning existed: pin what was recorded at download time
+					if entry.PinnedHashes == nil {
+						pinFileHashes(&entry, entry.File)
+					}
+					if change := hashPinChange(entry, pd.File); change != "" {
+						log.Warnf("Upstream file for %s (Key: %s) no longer matches the local copy: %s", pd.TargetFilepath, dbKey, change)
+					}
+					// Update fields that might change between runs (the file stays where it is)
 					entry.Version = pd.CleanedVersion // Update associated metadata version
 					entry.File = pd.File              // Update file details (URL might change)
 
 					// --- START: Save Metadata Check for Existing Download ---
 					// Use Viper to check if metadata saving is enabled
-					if viper.GetBool("savemetadata") {
+					if viper.GetBool("savemetadata") && !drifted {
 						// Derive metadata path from the expected path based on the DB entry filename
 						metadataPath := strings.TrimSuffix(expectedPathFromDB, filepath.Ext(expectedPathFromDB)) + ".json"
 
@@ -178,7 +220,7 @@ func processPage(db *database.DB, pageDownloads []potentialDownload, cfg *models
 							if jsonErr != nil {
 								log.WithError(jsonErr).Warnf("Failed to marshal full version metadata for existing file %s", pd.TargetFilepath)
 							} else {
-								if writeErr := os.WriteFile(metadataPath, jsonData, 0644); writeErr != nil {
+								if writeErr := helpers.WriteFile(metadataPath, jsonData, 0644); writeErr != nil {
 									log.WithError(writeErr).Warnf("Failed to write version metadata file %s", metadataPath)
 								}
 							}
@@ -203,14 +245,27 @@ func processPage(db *database.DB, pageDownloads []potentialDownload, cfg *models
 					shouldQueue = false
 					// Optionally update DB entry here too, or just skip?
 				}
-			case models.StatusPending, models.StatusError:
+			case models.StatusPruned:
+				log.Infof("Skipping %s (VersionID: %d, Key: %s) - %s.", pd.TargetFilepath, pd.CleanedVersion.ID, dbKey, entry.ErrorDetails)
+				downloadRunStats.skip(skippedPruned)
+				shouldQueue = false
+			case models.StatusPending, models.StatusDownloading, models.StatusError, models.StatusCataloged, models.StatusDeferred:
+				if reason := refusedSkipReason(entry, pd.CleanedVersion); reason != "" {
+					log.WithField(failure.LogField, failure.Filtered).Infof("Skipping %s (VersionID: %d, Key: %s) - %s.", pd.TargetFilepath, pd.CleanedVersion.ID, dbKey, reason)
+					downloadRunStats.skip(skippedRefused)
+					shouldQueue = false
+					break
+				}
 				log.Infof("Re-queuing %s (VersionID: %d, Key: %s) - Status is %s.", pd.TargetFilepath, pd.CleanedVersion.ID, dbKey, entry.Status)
 				shouldQueue = true
 				// Update status back to Pending and clear error if any
 				entry.Status = models.StatusPending
 				entry.ErrorDetails = ""
+				entry.ErrorCategory = ""
+				entry.ErrorReason = ""
 				// Update fields that might change
 				entry.Folder = pd.Slug
+				entry.VersionDir = pd.VersionDir
 				entry.Version = pd.CleanedVersion
 				entry.File = pd.File
 				// entry.Timestamp = time.Now().Unix() // Optionally update timestamp?
@@ -230,6 +285,15 @@ func processPage(db *database.DB, pageDownloads []potentialDownload, cfg *models
 		}
 
 		if shouldQueue {
+			// Quotas leave the entry as it is, so a later run with room to spare picks it up
+			if reason := downloadDowngrades.skipReason(pd); reason != "" {
+				log.WithField(failure.LogField, failure.Filtered).Warnf("Skipping %s (Key: %s) - downgrade: %s", pd.TargetFilepath, dbKey, reason)
+				continue
+			}
+			if reason := downloadQuotas.skipReason(pd, dbKey); reason != "" {
+				log.WithField(failure.LogField, failure.Filtered).Infof("Skipping %s (Key: %s) - quota: %s", pd.TargetFilepath, dbKey, reason)
+				continue
+			}
 			downloadsToQueue = append(downloadsToQueue, pd)
 			queuedSizeBytes += uint64(pd.File.SizeKB * 1024)
 			log.Debugf("Added confirmed download to queue: %s (Model: %s)", pd.File.Name, pd.ModelName)
@@ -239,14 +303,46 @@ func processPage(db *database.DB, pageDownloads []potentialDownload, cfg *models
 	return downloadsToQueue, queuedSizeBytes
 }
 
+// refusedSkipReason returns why a download Civitai refused last time isn't retried yet, or
+// "" to retry it: the version is still in early access, or it needs a login and there is
+// still no API key.
+func refusedSkipReason(entry models.DatabaseEntry, version models.ModelVersion) string {
+	if entry.Status != models.StatusError {
+		return ""
+	}
+	switch failure.Reason(entry.ErrorReason) {
+	case failure.EarlyAccess:
+		if ends, ok := earlyAccessEnds(version); ok && time.Now().Before(ends) {
+			return fmt.Sprintf("in early access until %s", ends.Local().Format("2006-01-02 15:04"))
+		}
+	case failure.LoginRequired:
+		if viper.GetString("apikey") == "" {
+			return "Civitai only allows it when logged in; set ApiKey (or --api-key) to download it"
+		}
+	}
+	return ""
+}
+
+// earlyAccessEnds returns when a version's early access ends, if it has one.
+func earlyAccessEnds(version models.ModelVersion) (time.Time, bool) {
+	if version.EarlyAccessTimeFrame <= 0 || version.PublishedAt == "" {
+		return time.Time{}, false
+	}
+	published, err := time.Parse(time.RFC3339Nano, version.PublishedAt)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return published.AddDate(0, 0, version.EarlyAccessTimeFrame), true
+}
+
 // saveModelInfoFile saves the full model metadata to a .json file.
 // It saves the file to {modelBaseDir}/{model.ID}.json.
-func saveModelInfoFile(model models.Model, modelBaseDir string) error {
+func saveModelInfoFile(model models.Model, rawModel json.RawMessage, modelBaseDir string) error {
 	// The base directory is now passed directly
 	infoDirPath := modelBaseDir
 
 	// Ensure the directory exists
-	if err := os.MkdirAll(infoDirPath, 0700); err != nil {
+	if err := helpers.MkdirAll(infoDirPath, 0700); err != nil {
 		log.WithError(err).Errorf("Failed to create model info directory: %s", infoDirPath)
 		return fmt.Errorf("failed to create directory %s: %w", infoDirPath, err)
 	}
@@ -261,14 +357,14 @@ func saveModelInfoFile(model models.Model, modelBaseDir string) error {
 	filePath := filepath.Join(infoDirPath, fileName)
 
 	// Marshal the full model info
-	jsonData, jsonErr := json.MarshalIndent(model, "", "  ")
+	jsonData, jsonErr := marshalSidecar(model, rawModel, sidecarField{Key: sidecarAIRKey, Value: modelAIR(model)})
 	if jsonErr != nil {
 		log.WithError(jsonErr).Warnf("Failed to marshal full model info for model %d (%s)", model.ID, model.Name)
 		return fmt.Errorf("failed to marshal model info for %d: %w", model.ID, jsonErr)
 	}
 
 	// Write the file (overwrite if exists)
-	if writeErr := os.WriteFile(filePath, jsonData, 0600); writeErr != nil {
+	if writeErr := helpers.WriteFile(filePath, jsonData, 0600); writeErr != nil {
 		log.WithError(writeErr).Warnf("Failed to write model info file %s", filePath)
 		return fmt.Errorf("failed to write model info file %s: %w", filePath, writeErr)
 	}
@@ -294,7 +390,7 @@ func downloadImages(logPrefix string, images []models.ModelImage, baseDir string
 
 	log.Infof("[%s] Attempting concurrent download for %d images to %s (Concurrency: %d)", logPrefix, len(images), baseDir, numWorkers)
 
-	if err := os.MkdirAll(baseDir, 0755); err != nil {
+	if err := helpers.MkdirAll(baseDir, 0755); err != nil {
 		log.WithError(err).Errorf("[%s] Failed to create base directory for images: %s", logPrefix, baseDir)
 		return 0, len(images) // Cannot proceed, count all as failed
 	}
@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/database"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The download queue lives in the database, so a run that is killed (or loses power) can
+// be picked up by the next one without listing the API again:
+//
+//   - Pending without QueuedAt: planned, found by the listing but not handed to a worker yet
+//   - Pending with QueuedAt: queued for a worker
+//   - Downloading: a worker started the download (the partial file is resumed)
+//   - Error: failed; retried when the listing returns it, or with fetch --failed (listed in
+//     failed.json after each run)
+//
+// Any other status ends the queued state (see updateDbEntry).
+
+// interruptedDownloads returns the downloads a previous run queued but never finished,
+// rebuilt from their stored entries and marked Pending again.
+func interruptedDownloads(db *database.DB) []potentialDownload {
+	return storedDownloadsWhere(db, nil, "interrupted", func(entry models.DatabaseEntry) bool {
+		return entry.QueuedAt != 0 && (entry.Status == models.StatusPending || entry.Status == models.StatusDownloading)
+	})
+}
+
+// markQueued records in entry's DB record that its download was handed to the workers.
+func markQueued(db *database.DB, key string, entry models.DatabaseEntry) {
+	entry.QueuedAt = time.Now().Unix()
+	entryBytes, err := json.Marshal(entry)
+	if err == nil {
+		err = db.Put([]byte(key), entryBytes)
+	}
+	if err != nil {
+		log.WithError(err).Warnf("Failed to record %s as queued; a crash before it is downloaded won't resume it", key)
+	}
+}
+
+// releaseQueued takes a download a worker skipped out of the queue. The entry stays
+// Pending, so a later listing that returns it still picks it up.
+func releaseQueued(db *database.DB, key string) {
+	if err := updateDbEntry(db, key, models.StatusPending, func(entry *models.DatabaseEntry) {
+		entry.QueuedAt = 0
+	}); err != nil {
+		log.Warnf("Failed to take %s out of the download queue: %v", key, err)
+	}
+}
+
+// withResumed returns the resumed downloads followed by those of queued that aren't
+// among them.
+func withResumed(resumed, queued []potentialDownload) []potentialDownload {
+	if len(resumed) == 0 {
+		return queued
+	}
+	seen := make(map[int]bool, len(resumed))
+	for _, pd := range resumed {
+		seen[pd.ModelVersionID] = true
+	}
+	downloads := append([]potentialDownload{}, resumed...)
+	for _, pd := range queued {
+		if !seen[pd.ModelVersionID] {
+			downloads = append(downloads, pd)
+		}
+	}
+	return downloads
+}
@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// queueOrders are the orders the download queue can be put in (QueueOrder): "api" keeps
+// the order the API listed the files in.
+var queueOrders = []string{"api", "newest", "smallest", "largest", "popular"}
+
+// downloadQueueOrder reads QueueOrder.
+func downloadQueueOrder() (string, error) {
+	order := strings.ToLower(strings.TrimSpace(viper.GetString("queueorder")))
+	if order == "" {
+		return "api", nil
+	}
+	for _, known := range queueOrders {
+		if order == known {
+			return order, nil
+		}
+	}
+	return "", fmt.Errorf("invalid QueueOrder %q: use %s", order, strings.Join(queueOrders, ", "))
+}
+
+// sortDownloadQueue puts downloads in order: "newest" by the version's publish date, newest
+// first; "smallest" and "largest" by file size; "popular" by the version's download count,
+// most first. Ties keep the API order. Downloads in resumed (interrupted ones with partial
+// files) stay in front, in their own order.
+func sortDownloadQueue(downloads []potentialDownload, order string, resumed []potentialDownload) {
+	var less func(a, b potentialDownload) bool
+	switch order {
+	case "newest":
+		less = func(a, b potentialDownload) bool { return queuePublishedAt(a).After(queuePublishedAt(b)) }
+	case "smallest":
+		less = func(a, b potentialDownload) bool { return a.File.SizeKB < b.File.SizeKB }
+	case "largest":
+		less = func(a, b potentialDownload) bool { return a.File.SizeKB > b.File.SizeKB }
+	case "popular":
+		less = func(a, b potentialDownload) bool { return queueDownloadCount(a) > queueDownloadCount(b) }
+	default:
+		return
+	}
+	first := make(map[int]bool, len(resumed))
+	for _, pd := range resumed {
+		first[pd.ModelVersionID] = true
+	}
+	sort.SliceStable(downloads, func(i, j int) bool {
+		a, b := downloads[i], downloads[j]
+		if first[a.ModelVersionID] || first[b.ModelVersionID] {
+			return first[a.ModelVersionID] && !first[b.ModelVersionID]
+		}
+		return less(a, b)
+	})
+}
+
+// queuePublishedAt returns when the version of pd was published (zero if unknown).
+func queuePublishedAt(pd potentialDownload) time.Time {
+	published := pd.FullVersion.PublishedAt
+	if published == "" {
+		published = pd.CleanedVersion.PublishedAt
+	}
+	t, err := time.Parse(time.RFC3339Nano, published)
+	if err != nil {
+		t, _ = time.Parse(time.RFC3339, published)
+	}
+	return t
+}
+
+// queueDownloadCount returns the download count of the version of pd.
+func queueDownloadCount(pd potentialDownload) int {
+	return max(pd.FullVersion.Stats.DownloadCount, pd.CleanedVersion.Stats.DownloadCount)
+}
@@ -0,0 +1,210 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/database"
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// quotaLimit is a soft limit on the archive share of one creator or one model type.
+// Zero fields mean no limit.
+type quotaLimit struct {
+	maxBytes uint64
+	maxFiles int
+}
+
+// quotaTracker enforces MaxBytesPerCreator/MaxFilesPerCreator and MaxBytesPerType/
+// MaxFilesPerType while downloads are queued. Usage starts from the Downloaded entries in
+// the database and grows with every file queued in this run.
+type quotaTracker struct {
+	mu      sync.Mutex
+	db      *database.DB
+	creator quotaLimit
+	types   map[string]quotaLimit // Lower-case model type -> limit
+	// usage maps a bucket ("creator:<name>" or "type:<type>", lower case) to the size of
+	// every entry counted against it, keyed by DB key so a re-queued file is not counted twice
+	usage  map[string]map[string]uint64
+	loaded bool // Whole database already folded into usage (no secondary indexes)
+}
+
+// downloadQuotas is the quota tracker of the current download run; nil when no quota is set.
+var downloadQuotas *quotaTracker
+
+// newQuotaTracker reads the quota settings. It returns nil if none is configured.
+func newQuotaTracker(db *database.DB) (*quotaTracker, error) {
+	q := &quotaTracker{db: db, types: make(map[string]quotaLimit), usage: make(map[string]map[string]uint64)}
+
+	if value := strings.TrimSpace(viper.GetString("maxbytespercreator")); value != "" && value != "0" {
+		size, err := helpers.ParseByteSize(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MaxBytesPerCreator %q: %w", value, err)
+		}
+		q.creator.maxBytes = size
+	}
+	q.creator.maxFiles = viper.GetInt("maxfilespercreator")
+
+	for modelType, value := range viper.GetStringMapString("maxbytespertype") {
+		size, err := helpers.ParseByteSize(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MaxBytesPerType for %s %q: %w", modelType, value, err)
+		}
+		limit := q.types[strings.ToLower(modelType)]
+		limit.maxBytes = size
+		q.types[strings.ToLower(modelType)] = limit
+	}
+	for modelType, value := range viper.GetStringMapString("maxfilespertype") {
+		count, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid MaxFilesPerType for %s %q: %w", modelType, value, err)
+		}
+		limit := q.types[strings.ToLower(modelType)]
+		limit.maxFiles = count
+		q.types[strings.ToLower(modelType)] = limit
+	}
+
+	if q.creator == (quotaLimit{}) && len(q.types) == 0 {
+		return nil, nil
+	}
+	return q, nil
+}
+
+// entryModelType is the type an entry is filed under: the detected type if there is one.
+func entryModelType(entry models.DatabaseEntry) string {
+	if entry.InferredType != "" {
+		return entry.InferredType
+	}
+	return entry.ModelType
+}
+
+// bucketUsage returns the usage of a bucket, loading it from the database on first use.
+// The caller must hold q.mu.
+func (q *quotaTracker) bucketUsage(idx database.Index, value string) map[string]uint64 {
+	bucket := quotaBucket(idx, value)
+	if usage, ok := q.usage[bucket]; ok {
+		return usage
+	}
+	usage := make(map[string]uint64)
+	q.usage[bucket] = usage
+
+	if !q.db.IndexesReady() {
+		q.loadAll()
+		return q.usage[bucket]
+	}
+	keys, err := q.db.Lookup(idx, value)
+	if err != nil {
+		log.WithError(err).Warnf("Quota: failed to look up current usage of %s", bucket)
+		return usage
+	}
+	err = foldCandidates(q.db, [][]string{keys}, func(key []byte, raw []byte) error {
+		var entry models.DatabaseEntry
+		if json.Unmarshal(raw, &entry) != nil || entry.Status != models.StatusDownloaded {
+			return nil
+		}
+		// Index keys can be stale; count the entry only if it still belongs here
+		if (idx == database.IndexCreator && strings.EqualFold(entry.Creator.Username, value)) ||
+			(idx == database.IndexType && strings.EqualFold(entryModelType(entry), value)) {
+			usage[string(key)] = uint64(entry.File.SizeKB * 1024)
+		}
+		return nil
+	})
+	if err != nil {
+		log.WithError(err).Warnf("Quota: failed to read current usage of %s", bucket)
+	}
+	return usage
+}
+
+// loadAll folds every Downloaded entry into usage, for databases without secondary indexes.
+// The caller must hold q.mu.
+func (q *quotaTracker) loadAll() {
+	if q.loaded {
+		return
+	}
+	q.loaded = true
+	err := q.db.Fold(func(key []byte, raw []byte) error {
+		if !strings.HasPrefix(string(key), "v_") {
+			return nil
+		}
+		var entry models.DatabaseEntry
+		if json.Unmarshal(raw, &entry) != nil || entry.Status != models.StatusDownloaded {
+			return nil
+		}
+		size := uint64(entry.File.SizeKB * 1024)
+		for _, bucket := range []string{quotaBucket(database.IndexCreator, entry.Creator.Username), quotaBucket(database.IndexType, entryModelType(entry))} {
+			if q.usage[bucket] == nil {
+				q.usage[bucket] = make(map[string]uint64)
+			}
+			q.usage[bucket][string(key)] = size
+		}
+		return nil
+	})
+	if err != nil {
+		log.WithError(err).Warn("Quota: failed to scan the database for current usage")
+	}
+}
+
+func quotaBucket(idx database.Index, value string) string {
+	kind := "type"
+	if idx == database.IndexCreator {
+		kind = "creator"
+	}
+	return kind + ":" + strings.ToLower(value)
+}
+
+// skipReason returns why pd would exceed a quota, or "" if it fits, in which case the file is
+// counted against its creator and type. A nil tracker has no quotas.
+func (q *quotaTracker) skipReason(pd potentialDownload, dbKey string) string {
+	if q == nil {
+		return ""
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	size := uint64(pd.File.SizeKB * 1024)
+	type check struct {
+		usage map[string]uint64
+		limit quotaLimit
+		what  string
+		name  string
+	}
+	var checks []check
+	if creator := pd.Creator.Username; creator != "" && q.creator != (quotaLimit{}) {
+		checks = append(checks, check{q.bucketUsage(database.IndexCreator, creator), q.creator, "creator", creator})
+	}
+	if limit, ok := q.types[strings.ToLower(pd.ModelType)]; ok && pd.ModelType != "" {
+		checks = append(checks, check{q.bucketUsage(database.IndexType, pd.ModelType), limit, "type", pd.ModelType})
+	}
+
+	for _, c := range checks {
+		if _, counted := c.usage[dbKey]; counted {
+			continue // Already part of the archive (e.g. re-queued after the file went missing)
+		}
+		var used uint64
+		for _, entrySize := range c.usage {
+			used += entrySize
+		}
+		setting := "PerCreator"
+		if c.what == "type" {
+			setting = "PerType"
+		}
+		if c.limit.maxFiles > 0 && len(c.usage)+1 > c.limit.maxFiles {
+			return fmt.Sprintf("%s %s already has %d file(s) (MaxFiles%s %d)", c.what, c.name, len(c.usage), setting, c.limit.maxFiles)
+		}
+		if c.limit.maxBytes > 0 && used+size > c.limit.maxBytes {
+			return fmt.Sprintf("%s %s would use %s of its %s quota (MaxBytes%s)", c.what, c.name,
+				helpers.BytesToSize(used+size), helpers.BytesToSize(c.limit.maxBytes), setting)
+		}
+	}
+	for _, c := range checks {
+		c.usage[dbKey] = size
+	}
+	return ""
+}
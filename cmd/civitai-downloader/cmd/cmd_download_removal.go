@@ -0,0 +1,338 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/control"
+	"github.com/dreamfast/go-civitai-downloader/internal/database"
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Upstream removal policies (RemovalPolicy / --removal-policy), applied once a removal
+// is confirmed.
+const (
+	removalReport = "report"
+	removalMove   = "move"
+	removalPrune  = "prune"
+)
+
+// removalReportFile is the JSON-lines report of upstream removals below SavePath.
+const removalReportFile = "removed-upstream.jsonl"
+
+// The RemovalGracePeriod and RemovalChecks used when they aren't set.
+const (
+	defaultRemovalGracePeriod = "72h"
+	defaultRemovalChecks      = 3
+)
+
+// removalSettings are the RemovalGracePeriod, RemovalChecks and RemovalPolicy in effect.
+type removalSettings struct {
+	grace  time.Duration
+	checks int
+	policy string
+}
+
+// spacing is how far apart the checks that count toward a confirmation must be, so the
+// RemovalChecks checks cover the grace period.
+func (s removalSettings) spacing() time.Duration {
+	if s.checks > 1 {
+		return s.grace / time.Duration(s.checks-1)
+	}
+	return s.grace
+}
+
+// parseRemovalGracePeriod accepts Go durations ("72h"), days ("3d") and "0" (no grace).
+func parseRemovalGracePeriod(spec string) (time.Duration, error) {
+	spec = strings.ToLower(strings.TrimSpace(spec))
+	if spec == "" {
+		spec = defaultRemovalGracePeriod
+	}
+	if spec == "0" {
+		return 0, nil
+	}
+	if days, ok := strings.CutSuffix(spec, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid RemovalGracePeriod %q", spec)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	grace, err := time.ParseDuration(spec)
+	if err != nil || grace < 0 {
+		return 0, fmt.Errorf("invalid RemovalGracePeriod %q: use a duration (72h) or a number of days (3d)", spec)
+	}
+	return grace, nil
+}
+
+// loadRemovalSettings reads and checks the Removal* settings.
+func loadRemovalSettings() (removalSettings, error) {
+	var s removalSettings
+	var err error
+	if s.grace, err = parseRemovalGracePeriod(viper.GetString("removalgraceperiod")); err != nil {
+		return s, err
+	}
+	if s.checks = viper.GetInt("removalchecks"); s.checks == 0 {
+		s.checks = defaultRemovalChecks
+	} else if s.checks < 0 {
+		return s, fmt.Errorf("invalid RemovalChecks %d (use 1 or more)", s.checks)
+	}
+	s.policy = strings.ToLower(viper.GetString("removalpolicy"))
+	switch s.policy {
+	case "":
+		s.policy = removalReport
+	case removalReport, removalMove, removalPrune:
+	default:
+		return s, fmt.Errorf("unknown RemovalPolicy %q (use %q, %q or %q)", viper.GetString("removalpolicy"), removalReport, removalMove, removalPrune)
+	}
+	return s, nil
+}
+
+// removalEvent is a change of a tracked version's upstream state, as reported.
+type removalEvent struct {
+	Time         time.Time `json:"time"`
+	Key          string    `json:"key"`
+	ModelID      int       `json:"modelId"`
+	ModelName    string    `json:"modelName"`
+	VersionID    int       `json:"versionId"`
+	File         string    `json:"file"`
+	MissingSince time.Time `json:"missingSince"`
+	Checks       int       `json:"checks"`
+	Action       string    `json:"action"` // missing, restored, reported, moved, pruned or deferred (files in use)
+	MovedTo      string    `json:"movedTo,omitempty"`
+}
+
+// tracksRemoval reports whether an entry is a local copy whose upstream removal matters.
+func tracksRemoval(entry models.DatabaseEntry) bool {
+	return entry.Status == models.StatusDownloaded && entry.RemovedAt == 0
+}
+
+// removalCheckDue reports whether an entry with a suspected removal should be checked again.
+func removalCheckDue(entry models.DatabaseEntry, s removalSettings, now time.Time) bool {
+	return entry.MissingSince != 0 && tracksRemoval(entry) && now.Sub(time.Unix(entry.MissingCheckedAt, 0)) >= s.spacing()
+}
+
+// noteMissingUpstream records that Civitai answered 404 for a downloaded version. The
+// first 404 only starts the grace period (models are often hidden during a review); the
+// removal is confirmed, and RemovalPolicy applied, once RemovalChecks checks at least the
+// spacing apart found it missing and RemovalGracePeriod has passed since the first.
+func noteMissingUpstream(db *database.DB, key, savePath string, s removalSettings, now time.Time) {
+	raw, err := db.Get([]byte(key))
+	var stored models.DatabaseEntry
+	if err != nil || json.Unmarshal(raw, &stored) != nil || !tracksRemoval(stored) {
+		return // Only local copies are tracked
+	}
+	var event *removalEvent
+	err = updateDbEntry(db, key, models.StatusDownloaded, func(entry *models.DatabaseEntry) {
+		switch {
+		case entry.MissingSince == 0:
+			entry.MissingSince, entry.MissingCheckedAt, entry.MissingChecks = now.Unix(), now.Unix(), 1
+			log.Warnf("%s (version %d) is missing upstream; it counts as removed if it is still missing after %v (%d checks)",
+				entry.ModelName, entry.Version.ID, s.grace, s.checks)
+			missing := newRemovalEvent(key, *entry, "missing", now)
+			event = &missing
+		case now.Sub(time.Unix(entry.MissingCheckedAt, 0)) >= s.spacing():
+			entry.MissingCheckedAt = now.Unix()
+			entry.MissingChecks++
+			log.Infof("%s (version %d) is still missing upstream (check %d of %d, missing since %s)",
+				entry.ModelName, entry.Version.ID, entry.MissingChecks, s.checks, time.Unix(entry.MissingSince, 0).Format(time.RFC1123))
+		default:
+			return // Too soon after the last check to count
+		}
+		if entry.MissingChecks < s.checks || now.Sub(time.Unix(entry.MissingSince, 0)) < s.grace {
+			return
+		}
+		event = confirmRemoval(db, key, savePath, entry, s, now)
+	})
+	if err != nil {
+		log.WithError(err).Warnf("Failed to record the upstream removal of %s", key)
+		return
+	}
+	if event != nil {
+		writeRemovalEvent(savePath, *event)
+	}
+}
+
+// confirmRemoval marks an entry removed upstream and applies RemovalPolicy to its files.
+// Files in use keep the removal pending, so the next check acts on it.
+func confirmRemoval(db *database.DB, key, savePath string, entry *models.DatabaseEntry, s removalSettings, now time.Time) *removalEvent {
+	event := newRemovalEvent(key, *entry, "reported", now)
+	var err error
+	switch s.policy {
+	case removalMove:
+		dir := viper.GetString("removaldir")
+		if dir == "" {
+			dir = filepath.Join(savePath, "removed")
+		}
+		event.MovedTo, err = moveEntryFiles(db, savePath, dir, entry)
+		event.Action = "moved"
+	case removalPrune:
+		err = pruneEntryFiles(db, savePath, *entry)
+		event.Action = "pruned"
+	}
+	if errors.Is(err, helpers.ErrFileInUse) {
+		event.Action = "deferred"
+		return &event
+	} else if err != nil {
+		log.WithError(err).Errorf("Upstream removal: failed to %s %s (Key: %s); only reporting it", s.policy, entry.Filename, key)
+		event.Action, event.MovedTo = "reported", ""
+	}
+
+	entry.RemovedAt = now.Unix()
+	entry.RemovalAction = event.Action
+	if event.Action == "pruned" {
+		entry.Status = models.StatusPruned
+		entry.ErrorDetails = "Pruned after the model was removed upstream"
+	}
+	log.WithFields(log.Fields{control.EventField: "removed-upstream", "key": key}).Warnf("%s (version %d) was removed upstream: missing since %s on %d checks (%s %s)",
+		entry.ModelName, entry.Version.ID, time.Unix(entry.MissingSince, 0).Format(time.RFC1123), entry.MissingChecks, event.Action, entry.Filename)
+	return &event
+}
+
+// noteSeenUpstream clears a suspected or confirmed removal of an entry Civitai lists
+// again. It reports whether the entry changed; the caller stores it.
+func noteSeenUpstream(key string, entry *models.DatabaseEntry, savePath string) bool {
+	if entry.MissingSince == 0 && entry.RemovedAt == 0 {
+		return false
+	}
+	switch {
+	case entry.RemovalAction == "moved":
+		log.Infof("%s (version %d), removed upstream on %s, is back; run 'migrate-paths' to move it back from %s", entry.ModelName, entry.Version.ID, time.Unix(entry.RemovedAt, 0).Format(time.RFC1123), entry.VersionDir)
+	case entry.RemovedAt != 0:
+		log.Infof("%s (version %d), removed upstream on %s, is back", entry.ModelName, entry.Version.ID, time.Unix(entry.RemovedAt, 0).Format(time.RFC1123))
+	default:
+		log.Infof("%s (version %d) is back upstream after %d check(s); it was only hidden", entry.ModelName, entry.Version.ID, entry.MissingChecks)
+	}
+	writeRemovalEvent(savePath, newRemovalEvent(key, *entry, "restored", time.Now()))
+	entry.MissingSince, entry.MissingChecks, entry.MissingCheckedAt = 0, 0, 0
+	entry.RemovedAt, entry.RemovalAction = 0, ""
+	return true
+}
+
+// Which versions recheckRemovals looks up.
+const (
+	recheckDue       = iota // Suspected removals whose next check is due
+	recheckSuspected        // Every suspected removal
+	recheckAll              // Every downloaded version
+)
+
+// recheckRemovals looks versions up on Civitai again, so a suspected removal is confirmed
+// (or cleared) without waiting for a run that asks for the version. A lookup that fails
+// with anything but a 404 leaves the version's state alone.
+func recheckRemovals(db *database.DB, client *http.Client, savePath string, mode int) (checked, missing int, err error) {
+	s, err := loadRemovalSettings()
+	if err != nil {
+		return 0, 0, err
+	}
+	now := time.Now()
+	var keys []string
+	err = db.Fold(func(key []byte, value []byte) error {
+		if !strings.HasPrefix(string(key), "v_") {
+			return nil
+		}
+		var entry models.DatabaseEntry
+		if json.Unmarshal(value, &entry) != nil {
+			return nil
+		}
+		switch {
+		case mode == recheckAll && entry.Status == models.StatusDownloaded, // Confirmed removals may have come back
+			mode == recheckSuspected && entry.MissingSince != 0 && tracksRemoval(entry),
+			removalCheckDue(entry, s, now):
+			keys = append(keys, string(key))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("error scanning the database: %w", err)
+	}
+
+	delay := time.Duration(viper.GetInt("apidelayms")) * time.Millisecond
+	for i, key := range keys {
+		if i > 0 && delay > 0 {
+			time.Sleep(delay)
+		}
+		versionID, _ := strconv.Atoi(strings.TrimPrefix(key, "v_"))
+		_, status, getErr := adoptAPIGet(client, fmt.Sprintf("https://civitai.com/api/v1/model-versions/%d", versionID), fmt.Sprintf("Version %d", versionID))
+		switch {
+		case status == http.StatusNotFound || status == http.StatusGone:
+			missing++
+			noteMissingUpstream(db, key, savePath, s, time.Now())
+		case getErr != nil:
+			log.WithError(getErr).Warnf("Failed to check version %d upstream", versionID)
+			continue
+		default:
+			if updateErr := updateDbEntry(db, key, models.StatusDownloaded, func(entry *models.DatabaseEntry) {
+				noteSeenUpstream(key, entry, savePath)
+			}); updateErr != nil {
+				log.WithError(updateErr).Warnf("Failed to clear the suspected removal of %s", key)
+			}
+		}
+		checked++
+	}
+	return checked, missing, nil
+}
+
+// noteMissingModel records a 404 for every downloaded version of a model.
+func noteMissingModel(db *database.DB, modelID int, savePath string) {
+	s, err := loadRemovalSettings()
+	if err != nil {
+		log.WithError(err).Warn("Not tracking the upstream removal")
+		return
+	}
+	var keys []string
+	db.Fold(func(key []byte, value []byte) error {
+		var entry models.DatabaseEntry
+		if strings.HasPrefix(string(key), "v_") && json.Unmarshal(value, &entry) == nil && entry.Version.ModelId == modelID && tracksRemoval(entry) {
+			keys = append(keys, string(key))
+		}
+		return nil
+	})
+	for _, key := range keys {
+		noteMissingUpstream(db, key, savePath, s, time.Now())
+	}
+}
+
+// noteMissingVersion records a 404 for a version if it was downloaded.
+func noteMissingVersion(db *database.DB, versionID int, savePath string) {
+	if !db.Has([]byte(fmt.Sprintf("v_%d", versionID))) {
+		return
+	}
+	s, err := loadRemovalSettings()
+	if err != nil {
+		log.WithError(err).Warn("Not tracking the upstream removal")
+		return
+	}
+	noteMissingUpstream(db, fmt.Sprintf("v_%d", versionID), savePath, s, time.Now())
+}
+
+func newRemovalEvent(key string, entry models.DatabaseEntry, action string, now time.Time) removalEvent {
+	return removalEvent{
+		Time:         now,
+		Key:          key,
+		ModelID:      entry.Version.ModelId,
+		ModelName:    entry.ModelName,
+		VersionID:    entry.Version.ID,
+		File:         entry.Filename,
+		MissingSince: time.Unix(entry.MissingSince, 0),
+		Checks:       entry.MissingChecks,
+		Action:       action,
+	}
+}
+
+func writeRemovalEvent(savePath string, event removalEvent) {
+	if line, err := json.Marshal(event); err == nil {
+		if err := appendLine(filepath.Join(savePath, removalReportFile), string(line)); err != nil {
+			log.WithError(err).Warn("Failed to write the upstream removal report")
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package cmd
+
+import (
+	"strings"
+
+	"github.com/dreamfast/go-civitai-downloader/civitai"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// restrictionFilter skips the models of the restricted categories of ExcludeRestricted in
+// the current download run, before any other filter is asked.
+var restrictionFilter *civitai.RestrictionFilter
+
+// newRestrictionFilter reads ExcludeRestricted. It returns nil if no category is excluded.
+func newRestrictionFilter() (*civitai.RestrictionFilter, error) {
+	filter, err := civitai.NewRestrictionFilter(viper.GetStringSlice("excluderestricted"))
+	if err != nil || filter == nil {
+		return nil, err
+	}
+	log.Infof("Excluding restricted models: %s", strings.Join(filter.Categories, ", "))
+	return filter, nil
+}
@@ -0,0 +1,220 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/downloader"
+	"github.com/dreamfast/go-civitai-downloader/internal/failure"
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Reasons a file of a run was skipped, as the run summary counts them.
+const (
+	skippedDownloaded = "already downloaded"
+	skippedOnDisk     = "already on disk" // A matching file was found where the download goes
+	skippedPruned     = "pruned"
+	skippedRefused    = "refused" // Downgrades, changed files and the like (see refusedSkipReason)
+	skippedFiltered   = "filtered"
+	skippedKept       = "kept existing file"
+	skippedDeferred   = "deferred"
+)
+
+// topRunErrors is the number of error groups the run summary lists.
+const topRunErrors = 5
+
+// runStats counts what a download run did with its files, for the summary printed (and
+// written to RunSummaryFile) when it ends.
+type runStats struct {
+	mu        sync.Mutex
+	started   time.Time
+	firstByte time.Time // Start of the first download of a file
+	lastByte  time.Time // End of the last one
+	summary   runSummary
+	errors    map[string]*runError
+	guard     *downloader.ChallengeGuard // Counts the run's Cloudflare challenges; may be nil
+}
+
+// runSummary is the summary of a download run, as written to RunSummaryFile.
+type runSummary struct {
+	StartedAt        time.Time      `json:"startedAt"`
+	FinishedAt       time.Time      `json:"finishedAt"`
+	ElapsedSeconds   float64        `json:"elapsedSeconds"`
+	Downloaded       int            `json:"downloaded"`
+	Skipped          int            `json:"skipped"`
+	SkippedBy        map[string]int `json:"skippedBy,omitempty"`
+	Failed           int            `json:"failed"`
+	BytesTransferred uint64         `json:"bytesTransferred"`
+	// Bytes per second while files were downloading (from the start of the first download
+	// to the end of the last)
+	AverageSpeed float64    `json:"averageBytesPerSecond"`
+	TopErrors    []runError `json:"topErrors,omitempty"`
+	// Requests Cloudflare challenged, and how long the cool-downs after them paused all requests
+	Challenges          int     `json:"challenges"`
+	ChallengePausedSecs float64 `json:"challengePausedSeconds"`
+}
+
+// runError is a group of failed downloads with the same failure category and reason.
+type runError struct {
+	Category string `json:"category"`
+	Reason   string `json:"reason,omitempty"`
+	Count    int    `json:"count"`
+	Example  string `json:"example"` // The error of the last one
+}
+
+// downloadRunStats are the statistics of the current download run (cycle, in watch mode).
+var downloadRunStats *runStats
+
+// newRunStats starts the statistics of a run. The challenge counts of guard start over.
+func newRunStats(now time.Time, guard *downloader.ChallengeGuard) *runStats {
+	guard.ResetStats()
+	return &runStats{started: now, errors: make(map[string]*runError), guard: guard}
+}
+
+// skip counts a file that was not downloaded for reason. A nil runStats ignores it.
+func (s *runStats) skip(reason string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.summary.Skipped++
+	if s.summary.SkippedBy == nil {
+		s.summary.SkippedBy = make(map[string]int)
+	}
+	s.summary.SkippedBy[reason]++
+}
+
+// recordDownload counts the outcome of a download started at start. A file that turned out
+// to be on disk already counts as skipped. A nil runStats ignores it.
+func (s *runStats) recordDownload(start time.Time, receipt *downloader.Receipt, err error) {
+	if s == nil {
+		return
+	}
+	if err == nil && receipt != nil && receipt.Verification == downloader.VerificationExistingFile {
+		s.skip(skippedOnDisk)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.summary.Failed++
+		category, reason := string(failure.CategoryOf(err)), string(failure.ReasonOf(err))
+		key := category + "/" + reason
+		group, ok := s.errors[key]
+		if !ok {
+			group = &runError{Category: category, Reason: reason}
+			s.errors[key] = group
+		}
+		group.Count++
+		group.Example = err.Error()
+		return
+	}
+	s.summary.Downloaded++
+	if receipt != nil {
+		s.summary.BytesTransferred += receipt.BytesWritten
+	}
+	if s.firstByte.IsZero() || start.Before(s.firstByte) {
+		s.firstByte = start
+	}
+	if now := time.Now(); now.After(s.lastByte) {
+		s.lastByte = now
+	}
+}
+
+// finish completes the summary of the run at now.
+func (s *runStats) finish(now time.Time) runSummary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	summary := s.summary
+	summary.StartedAt, summary.FinishedAt = s.started, now
+	summary.ElapsedSeconds = now.Sub(s.started).Seconds()
+	if active := s.lastByte.Sub(s.firstByte).Seconds(); active > 0 {
+		summary.AverageSpeed = float64(summary.BytesTransferred) / active
+	}
+	challenges, paused := s.guard.Stats()
+	summary.Challenges, summary.ChallengePausedSecs = challenges, paused.Seconds()
+	summary.TopErrors = make([]runError, 0, len(s.errors))
+	for _, group := range s.errors {
+		summary.TopErrors = append(summary.TopErrors, *group)
+	}
+	sort.Slice(summary.TopErrors, func(i, j int) bool {
+		a, b := summary.TopErrors[i], summary.TopErrors[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.Category+a.Reason < b.Category+b.Reason
+	})
+	if len(summary.TopErrors) > topRunErrors {
+		summary.TopErrors = summary.TopErrors[:topRunErrors]
+	}
+	return summary
+}
+
+// report prints the summary of the run and writes it to RunSummaryFile if that is set. A
+// nil runStats does nothing.
+func (s *runStats) report() {
+	if s == nil {
+		return
+	}
+	summary := s.finish(time.Now())
+	elapsed := time.Duration(summary.ElapsedSeconds * float64(time.Second)).Round(time.Second)
+
+	var b strings.Builder
+	b.WriteString("\n--- Run Summary ---\n")
+	fmt.Fprintf(&b, "Downloaded: %d (%s", summary.Downloaded, helpers.BytesToSize(summary.BytesTransferred))
+	if summary.AverageSpeed > 0 {
+		fmt.Fprintf(&b, ", %s/s on average", helpers.BytesToSize(uint64(summary.AverageSpeed)))
+	}
+	b.WriteString(")\n")
+	fmt.Fprintf(&b, "Skipped:    %d", summary.Skipped)
+	if len(summary.SkippedBy) > 0 {
+		reasons := make([]string, 0, len(summary.SkippedBy))
+		for _, reason := range sortedKeys(summary.SkippedBy) {
+			reasons = append(reasons, fmt.Sprintf("%s %d", reason, summary.SkippedBy[reason]))
+		}
+		fmt.Fprintf(&b, " (%s)", strings.Join(reasons, ", "))
+	}
+	b.WriteString("\n")
+	fmt.Fprintf(&b, "Failed:     %d\n", summary.Failed)
+	fmt.Fprintf(&b, "Elapsed:    %s\n", elapsed)
+	paused := time.Duration(summary.ChallengePausedSecs * float64(time.Second)).Round(time.Second)
+	if summary.Challenges > 0 {
+		fmt.Fprintf(&b, "Challenged: %d (requests paused for %s)\n", summary.Challenges, paused)
+	}
+	if len(summary.TopErrors) > 0 {
+		b.WriteString("Top errors:\n")
+		for _, group := range summary.TopErrors {
+			label := group.Category
+			if group.Reason != "" {
+				label += " (" + group.Reason + ")"
+			}
+			fmt.Fprintf(&b, "  %dx %s: %s\n", group.Count, label, group.Example)
+		}
+	}
+	fmt.Print(b.String())
+	if summary.Challenges > 0 {
+		log.WithField(failure.ReasonField, failure.Challenge).Warnf("Cloudflare challenged %d request(s); requests were paused for %s in total. Consider lowering --concurrency or raising ApiDelayMs.", summary.Challenges, paused)
+	}
+
+	path := viper.GetString("runsummaryfile")
+	if path == "" {
+		return
+	}
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err == nil {
+		err = helpers.WriteFile(path, append(data, '\n'), 0644)
+	}
+	if err != nil {
+		log.WithError(err).Errorf("Failed to write the run summary to %s", path)
+		return
+	}
+	log.Infof("Run summary written to %s", path)
+}
@@ -0,0 +1,242 @@
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/downloader"
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// serviceStatusInterval is how often the status line is sent to systemd (if it changed).
+const serviceStatusInterval = 5 * time.Second
+
+// serviceNotifier keeps systemd informed when the download command runs as a Type=notify
+// service: it reports readiness, a status line (what is being listed and downloaded, how
+// many files wait for a worker) and, with WatchdogSec=, pings the watchdog. The pings stop
+// once nothing has moved for WatchdogHangTimeout (no bytes written, no API page, no file
+// started or finished), so systemd restarts a download that hangs instead of a process
+// that merely stays alive. Waiting on purpose (between watch cycles, outside the download
+// windows, paused) never counts as hanging.
+type serviceNotifier struct {
+	mu          sync.Mutex
+	watchdog    time.Duration // WatchdogSec= of the unit (0: not watched)
+	hangTimeout time.Duration // 0: ping as long as the process runs
+	cycle       int           // Watch cycle (0: a single run)
+	phase       string        // What the run does, e.g. "listing models (page 3)"
+	idle        bool          // The phase is a wait on purpose
+	files       map[int]string
+	queued      int
+	progress    time.Time // Last sign of progress
+	written     uint64    // downloader.TotalWritten when last checked
+	status      string    // Last status sent
+	hung        bool      // The pings were stopped
+	done        chan struct{}
+}
+
+// downloadService is the notifier of a download command run by systemd; nil otherwise.
+var downloadService *serviceNotifier
+
+// startServiceNotifier reports readiness to systemd and starts the status updates and
+// watchdog pings, if the process runs as a Type=notify service. Call the returned function
+// when the command ends.
+func startServiceNotifier() (stop func(), err error) {
+	hangTimeout := 15 * time.Minute
+	if spec := strings.TrimSpace(viper.GetString("watchdoghangtimeout")); spec != "" {
+		if hangTimeout, err = time.ParseDuration(spec); err != nil || hangTimeout < 0 {
+			return nil, fmt.Errorf("invalid WatchdogHangTimeout %q: use a duration such as 15m (0 turns hang detection off)", spec)
+		}
+	}
+	s := &serviceNotifier{
+		watchdog:    helpers.SdWatchdog(),
+		hangTimeout: hangTimeout,
+		phase:       "starting",
+		files:       make(map[int]string),
+		progress:    time.Now(),
+		written:     downloader.TotalWritten(),
+		done:        make(chan struct{}),
+	}
+	if sent, err := helpers.SdNotify("READY=1\nSTATUS=Starting"); !sent {
+		if err != nil {
+			log.WithError(err).Warn("Failed to notify systemd; status updates and watchdog pings disabled")
+		}
+		return func() {}, nil
+	}
+	if s.watchdog > 0 {
+		log.Infof("Running as a systemd service: pinging the watchdog every %v", s.watchdog/2)
+	} else {
+		log.Info("Running as a systemd service: sending status updates")
+	}
+	downloadService = s
+	interval := serviceStatusInterval
+	if s.watchdog > 0 && s.watchdog/2 < interval {
+		interval = s.watchdog / 2
+	}
+	go s.loop(interval)
+	return func() {
+		close(s.done)
+		downloadService = nil
+		helpers.SdNotify("STOPPING=1")
+	}, nil
+}
+
+// loop sends the status and watchdog pings every interval until the notifier is stopped.
+func (s *serviceNotifier) loop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			s.tick(now)
+		}
+	}
+}
+
+// tick sends the status if it changed and, unless the run hangs, a watchdog ping.
+func (s *serviceNotifier) tick(now time.Time) {
+	s.mu.Lock()
+	if written := downloader.TotalWritten(); written != s.written {
+		s.written, s.progress = written, now
+	}
+	waiting := s.idle || downloadPause.isPaused() || !downloadWindow.open(now)
+	if waiting {
+		s.progress = now
+	}
+	var state []string
+	if status := s.statusLine(); status != s.status {
+		s.status = status
+		state = append(state, "STATUS="+status)
+	}
+	if s.watchdog > 0 {
+		stalled := now.Sub(s.progress)
+		switch {
+		case s.hangTimeout == 0 || stalled < s.hangTimeout:
+			if s.hung {
+				log.Infof("The download run is moving again; resuming systemd watchdog pings")
+				s.hung = false
+			}
+			state = append(state, "WATCHDOG=1")
+		case !s.hung:
+			log.Errorf("Nothing has moved for %v (no bytes written, no API page, no file started or finished); stopping systemd watchdog pings so the service is restarted", stalled.Round(time.Second))
+			s.hung = true
+		}
+	}
+	s.mu.Unlock()
+	if len(state) > 0 {
+		if _, err := helpers.SdNotify(strings.Join(state, "\n")); err != nil {
+			log.WithError(err).Debug("Failed to notify systemd")
+		}
+	}
+}
+
+// statusLine describes what the run does, e.g. "Cycle 3: downloading a.safetensors,
+// b.safetensors; 12 queued".
+func (s *serviceNotifier) statusLine() string {
+	parts := []string{s.phase}
+	if len(s.files) > 0 {
+		names := make([]string, 0, len(s.files))
+		for _, worker := range sortedIntKeys(s.files) {
+			names = append(names, s.files[worker])
+		}
+		parts = append(parts, "downloading "+strings.Join(names, ", "))
+	}
+	if s.queued > 0 {
+		parts = append(parts, fmt.Sprintf("%d queued", s.queued))
+	}
+	status := strings.Join(parts, "; ")
+	if s.cycle > 0 {
+		status = fmt.Sprintf("Cycle %d: %s", s.cycle, status)
+	}
+	return strings.ToUpper(status[:1]) + status[1:]
+}
+
+// setCycle records the watch cycle that runs. A nil notifier ignores it.
+func (s *serviceNotifier) setCycle(cycle int) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cycle = cycle
+}
+
+// setPhase records what the run does, which counts as progress. A nil notifier ignores it.
+func (s *serviceNotifier) setPhase(phase string) {
+	s.update(phase, false)
+}
+
+// setWaiting records a wait on purpose, e.g. for the next watch cycle. A nil notifier
+// ignores it.
+func (s *serviceNotifier) setWaiting(phase string) {
+	s.update(phase, true)
+}
+
+func (s *serviceNotifier) update(phase string, idle bool) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.phase, s.idle, s.progress = phase, idle, time.Now()
+}
+
+// queuedFile counts a file handed to the workers. A nil notifier ignores it.
+func (s *serviceNotifier) queuedFile() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queued++
+}
+
+// tookFile counts a queued file a worker took. A nil notifier ignores it.
+func (s *serviceNotifier) tookFile() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queued = max(s.queued-1, 0)
+	s.progress = time.Now()
+}
+
+// fileStarted records that worker is downloading the file name. A nil notifier ignores it.
+func (s *serviceNotifier) fileStarted(worker int, name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[worker] = name
+	s.progress = time.Now()
+}
+
+// fileFinished records that worker is done with its download. A nil notifier ignores it.
+func (s *serviceNotifier) fileFinished(worker int) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.files, worker)
+	s.progress = time.Now()
+}
+
+// sortedIntKeys returns the keys of m in ascending order.
+func sortedIntKeys[V any](m map[int]V) []int {
+	keys := make([]int, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Ints(keys)
+	return keys
+}
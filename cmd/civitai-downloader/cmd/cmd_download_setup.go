@@ -3,7 +3,7 @@ package cmd
 import (
 	"fmt"
 
-	"go-civitai-download/internal/models"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// sizeBudget caps the total size (as the API reports it) of the files one download run
+// queues, MaxTotalSize. Downloads are taken in queue order until the next one would go over
+// the budget; from then on nothing more is queued, and the downloads already running finish.
+// In watch mode each cycle has a budget of its own.
+type sizeBudget struct {
+	limit       uint64
+	queued      uint64
+	stopped     bool // A download didn't fit, queue nothing more
+	skipped     int
+	skippedSize uint64
+}
+
+// newSizeBudget reads MaxTotalSize. It returns nil if no budget is set.
+func newSizeBudget() (*sizeBudget, error) {
+	value := strings.TrimSpace(viper.GetString("maxtotalsize"))
+	if value == "" || value == "0" {
+		return nil, nil
+	}
+	limit, err := helpers.ParseByteSize(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MaxTotalSize %q: %w", value, err)
+	}
+	if limit == 0 {
+		return nil, nil
+	}
+	return &sizeBudget{limit: limit}, nil
+}
+
+// exhausted reports whether the budget has stopped queuing. A nil budget never does.
+func (b *sizeBudget) exhausted() bool {
+	return b != nil && b.stopped
+}
+
+// admit reports whether pd fits in what is left of the budget, and if so counts it against
+// it. A nil budget admits everything.
+func (b *sizeBudget) admit(pd potentialDownload) bool {
+	if b == nil {
+		return true
+	}
+	size := uint64(pd.File.SizeKB * 1024)
+	if !b.stopped && b.queued+size <= b.limit {
+		b.queued += size
+		return true
+	}
+	if !b.stopped {
+		b.stopped = true
+		log.Infof("Size budget: %s (%s) would take the run over its %s budget (%s queued, MaxTotalSize). Not queuing any more downloads.",
+			pd.FinalBaseFilename, helpers.BytesToSize(size), helpers.BytesToSize(b.limit), helpers.BytesToSize(b.queued))
+	}
+	b.skipped++
+	b.skippedSize += size
+	return false
+}
+
+// report logs how many downloads were left for a later run.
+func (b *sizeBudget) report() {
+	if b == nil || b.skipped == 0 {
+		return
+	}
+	log.Infof("Size budget: left %d download(s) (%s) for a later run after queuing %s of the %s budget. They stay in the database and are picked up by the next run.",
+		b.skipped, helpers.BytesToSize(b.skippedSize), helpers.BytesToSize(b.queued), helpers.BytesToSize(b.limit))
+}
+
+// admitDownload reports whether pd is queued by a run that downloads while still paging:
+// within the size budget and, if so, in the free disk space.
+func admitDownload(pd potentialDownload, diskSpace *diskBudget, budget *sizeBudget) bool {
+	if budget.exhausted() {
+		return budget.admit(pd) // Only counts it as left over
+	}
+	return diskSpace.admit(pd) && budget.admit(pd)
+}
+
+// preflightSizeBudget returns the downloads of a batch that fit in the size budget, in
+// queue order up to the first one that doesn't.
+func preflightSizeBudget(downloads []potentialDownload, budget *sizeBudget) []potentialDownload {
+	if budget == nil || len(downloads) == 0 {
+		return downloads
+	}
+	fitting := make([]potentialDownload, 0, len(downloads))
+	for _, pd := range downloads {
+		if budget.admit(pd) {
+			fitting = append(fitting, pd)
+		}
+	}
+	budget.report()
+	return fitting
+}
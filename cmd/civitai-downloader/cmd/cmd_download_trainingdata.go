@@ -0,0 +1,224 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/downloader"
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// trainingDataFileType is the API file type of the training data creators attach to a version.
+const trainingDataFileType = "Training Data"
+
+// trainingDataDirName is the default directory below SavePath training data goes to.
+const trainingDataDirName = "training-data"
+
+// Reasons a training data attachment was skipped, as the training data summary counts them.
+const (
+	trainingSkippedTooLarge = "over MaxTrainingDataSize"
+	trainingSkippedBudget   = "over MaxTrainingDataTotal"
+	trainingSkippedIgnored  = "ignored file name"
+	trainingSkippedOnDisk   = "already on disk"
+	trainingSkippedBadName  = "unusable file name"
+)
+
+// trainingDataFetcher downloads the training data attachments of the versions a run
+// downloads (IncludeTrainingData). They are kept apart from the model files, in a tree of
+// their own below TrainingDataDir that mirrors the version directories, and have size caps
+// of their own: MaxTrainingDataSize per attachment and MaxTrainingDataTotal per run.
+type trainingDataFetcher struct {
+	dir      string
+	maxSize  uint64 // 0 = no limit
+	maxTotal uint64 // 0 = no limit
+	ignore   []string
+
+	mu         sync.Mutex
+	reserved   uint64 // Size of the attachments this run started downloading
+	downloaded int
+	bytes      uint64
+	failed     int
+	skipped    map[string]int
+}
+
+// downloadTrainingData fetches the training data of the current download run. It is nil
+// unless IncludeTrainingData is set.
+var downloadTrainingData *trainingDataFetcher
+
+// newTrainingDataFetcher reads the training data settings. It returns nil if
+// IncludeTrainingData is off.
+func newTrainingDataFetcher(savePath string) (*trainingDataFetcher, error) {
+	if !viper.GetBool("includetrainingdata") {
+		return nil, nil
+	}
+	f := &trainingDataFetcher{
+		dir:     viper.GetString("trainingdatadir"),
+		ignore:  viper.GetStringSlice("ignorefilenamestrings"),
+		skipped: make(map[string]int),
+	}
+	if f.dir == "" {
+		f.dir = filepath.Join(savePath, trainingDataDirName)
+	}
+	for _, setting := range []struct {
+		name  string
+		limit *uint64
+	}{{"MaxTrainingDataSize", &f.maxSize}, {"MaxTrainingDataTotal", &f.maxTotal}} {
+		value := strings.TrimSpace(viper.GetString(strings.ToLower(setting.name)))
+		if value == "" || value == "0" {
+			continue
+		}
+		size, err := helpers.ParseByteSize(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %w", setting.name, value, err)
+		}
+		*setting.limit = size
+	}
+	return f, nil
+}
+
+// trainingDataFiles returns the training data attachments of a version.
+func trainingDataFiles(version models.ModelVersion) []models.File {
+	var files []models.File
+	for _, file := range version.Files {
+		if file.Type == trainingDataFileType {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// skipReason returns why file must not be downloaded, or "" if it may, in which case its
+// size is counted against MaxTrainingDataTotal.
+func (f *trainingDataFetcher) skipReason(file models.File) string {
+	for _, ignore := range f.ignore {
+		if ignore != "" && strings.Contains(strings.ToLower(file.Name), strings.ToLower(ignore)) {
+			return trainingSkippedIgnored
+		}
+	}
+	size := uint64(file.SizeKB * 1024)
+	if f.maxSize > 0 && size > f.maxSize {
+		return trainingSkippedTooLarge
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.maxTotal > 0 && f.reserved+size > f.maxTotal {
+		return trainingSkippedBudget
+	}
+	f.reserved += size
+	return ""
+}
+
+// fetch downloads the training data attachments of pd, whose model file was just
+// downloaded, to TrainingDataDir/<version directory>/. Failures are logged and counted;
+// the model download stands. A nil fetcher does nothing.
+func (f *trainingDataFetcher) fetch(logPrefix string, pd potentialDownload, fileDownloader *downloader.Downloader) {
+	if f == nil {
+		return
+	}
+	files := trainingDataFiles(pd.FullVersion)
+	if len(files) == 0 {
+		return
+	}
+	dir := filepath.Join(f.dir, pd.VersionDir)
+	for _, file := range files {
+		// The API's file name is only trusted as a single path element inside dir
+		name := helpers.ConvertToSlug(filepath.Base(file.Name))
+		if !filepath.IsLocal(name) {
+			log.Warnf("[%s] Skipping training data of %s: unusable file name %q.", logPrefix, pd.ModelName, file.Name)
+			f.count(trainingSkippedBadName, 0, nil)
+			continue
+		}
+		if reason := f.skipReason(file); reason != "" {
+			log.Infof("[%s] Skipping training data %s of %s (%s): %s (%s).", logPrefix, file.Name, pd.ModelName, pd.VersionName, reason, helpers.BytesToSize(uint64(file.SizeKB*1024)))
+			f.count(reason, 0, nil)
+			continue
+		}
+		if err := helpers.MkdirAll(dir, 0700); err != nil {
+			log.WithError(err).Errorf("[%s] Failed to create training data directory %s", logPrefix, dir)
+			f.release(file)
+			f.count("", 0, err)
+			return
+		}
+		log.Infof("[%s] Downloading training data %s of %s (%s)...", logPrefix, file.Name, pd.ModelName, pd.VersionName)
+		finalPath, receipt, err := fileDownloader.DownloadFileWithReceipt(filepath.Join(dir, name), file.DownloadUrl, file.Hashes, pd.ModelVersionID)
+		if err != nil {
+			log.WithError(err).Errorf("[%s] Failed to download training data %s of %s", logPrefix, file.Name, pd.ModelName)
+			f.release(file)
+			f.count("", 0, err)
+			continue
+		}
+		if receipt != nil && receipt.Verification == downloader.VerificationExistingFile {
+			f.release(file)
+			f.count(trainingSkippedOnDisk, 0, nil)
+			continue
+		}
+		var written uint64
+		if receipt != nil {
+			written = receipt.BytesWritten
+		}
+		log.Infof("[%s] Saved training data to %s", logPrefix, finalPath)
+		f.count("", written, nil)
+	}
+}
+
+// release gives the size of an attachment that was not written back to MaxTrainingDataTotal.
+func (f *trainingDataFetcher) release(file models.File) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if size := uint64(file.SizeKB * 1024); size < f.reserved {
+		f.reserved -= size
+	} else {
+		f.reserved = 0
+	}
+}
+
+// count records the outcome of an attachment: skipped for reason, downloaded (written
+// bytes) or failed (err).
+func (f *trainingDataFetcher) count(reason string, written uint64, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case reason != "":
+		f.skipped[reason]++
+	case err != nil:
+		f.failed++
+	default:
+		f.downloaded++
+		f.bytes += written
+	}
+}
+
+// report prints what the run did with training data, if it met any. A nil fetcher does
+// nothing.
+func (f *trainingDataFetcher) report() {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	skipped := 0
+	reasons := make([]string, 0, len(f.skipped))
+	for _, reason := range sortedKeys(f.skipped) {
+		skipped += f.skipped[reason]
+		reasons = append(reasons, fmt.Sprintf("%s %d", reason, f.skipped[reason]))
+	}
+	if f.downloaded+f.failed+skipped == 0 {
+		return
+	}
+	var b strings.Builder
+	b.WriteString("\n--- Training Data ---\n")
+	fmt.Fprintf(&b, "Downloaded: %d (%s) to %s\n", f.downloaded, helpers.BytesToSize(f.bytes), f.dir)
+	fmt.Fprintf(&b, "Skipped:    %d", skipped)
+	if len(reasons) > 0 {
+		fmt.Fprintf(&b, " (%s)", strings.Join(reasons, ", "))
+	}
+	b.WriteString("\n")
+	fmt.Fprintf(&b, "Failed:     %d\n", f.failed)
+	fmt.Print(b.String())
+}
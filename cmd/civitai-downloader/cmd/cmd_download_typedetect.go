@@ -0,0 +1,198 @@
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/database"
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Sidecar fields recording what was learned from the file itself.
+const (
+	sidecarInferredTypeKey = "inferredType"
+	sidecarTrainingKey     = "trainingMetadata"
+)
+
+// inferredType is the sidecar record of a model type detected from the file itself.
+type inferredType struct {
+	APIType string `json:"apiType"`
+	Type    string `json:"type"`
+	Reason  string `json:"reason"`
+}
+
+// modelTypeFor returns the model type to file a version under: a TypeOverrides entry for the
+// version ID or model ID (in that order) if there is one, otherwise the type the API reported.
+func modelTypeFor(modelID, versionID int, apiType string) string {
+	overrides := viper.GetStringMapString("typeoverrides")
+	for _, id := range []int{versionID, modelID} {
+		if override, ok := overrides[strconv.Itoa(id)]; ok && override != "" {
+			if override != apiType {
+				log.Debugf("Using type override %s for %d (API reports %q)", override, id, apiType)
+			}
+			return override
+		}
+	}
+	return apiType
+}
+
+// isUnknownModelType reports whether the API gave no useful type for a model.
+func isUnknownModelType(modelType string) bool {
+	return modelType == "" || strings.EqualFold(modelType, "Other")
+}
+
+// detectOtherType inspects a downloaded safetensors file whose model type is unknown ("Other")
+// and, if its header identifies the type, moves it to where PathTemplate puts that type.
+// pd.Slug, pd.VersionDir and pd.TargetFilepath are updated to the new location. It returns the file's (possibly new)
+// path and the detection, or nil if the type was not changed.
+func detectOtherType(logPrefix string, pd *potentialDownload, finalPath string) (string, *inferredType) {
+	if !viper.GetBool("detectothertypes") || !isUnknownModelType(pd.ModelType) ||
+		!strings.EqualFold(filepath.Ext(finalPath), ".safetensors") {
+		return finalPath, nil
+	}
+
+	info, err := os.Stat(finalPath)
+	if err != nil {
+		return finalPath, nil
+	}
+	header, err := helpers.ReadSafetensorsHeader(finalPath)
+	if err != nil {
+		log.WithError(err).Debugf("[%s] Cannot read safetensors header of %s for type detection", logPrefix, finalPath)
+		return finalPath, nil
+	}
+	detected, reason := helpers.InferModelType(header, info.Size())
+	if detected == "" {
+		log.Infof("[%s] Could not detect the type of %s; leaving it under %q", logPrefix, filepath.Base(finalPath), pd.ModelType)
+		return finalPath, nil
+	}
+
+	// Lay the version out again with the detected type
+	values := helpers.PathValues{
+		Type:      detected,
+		Model:     pd.ModelName,
+		ModelID:   pd.CleanedVersion.ModelId,
+		BaseModel: pd.BaseModel,
+		Creator:   pd.Creator.Username,
+		Version:   pd.VersionName,
+		VersionID: pd.ModelVersionID,
+		File:      pd.File.Name,
+		Nsfw:      pd.ModelNsfw,
+		NsfwLevel: pd.ModelNsfwLevel,
+	}
+	newVersionDir, err := helpers.RenderPathTemplate(pathTemplate(), values)
+	if err != nil {
+		newVersionDir, _ = helpers.RenderPathTemplate(helpers.DefaultPathTemplate, values)
+	}
+	if override, ok := modelPathOverrides[pd.CleanedVersion.ModelId]; ok {
+		newVersionDir = override // The override doesn't depend on the type
+	}
+	oldDir := filepath.Dir(finalPath)
+	newDir := filepath.Join(viper.GetString("savepath"), newVersionDir)
+	newPath := filepath.Join(newDir, filepath.Base(finalPath))
+
+	result := &inferredType{APIType: pd.ModelType, Type: detected, Reason: reason}
+	if newDir == oldDir {
+		log.Infof("[%s] Detected type %s for %s (%s); PathTemplate files it in the same place", logPrefix, detected, filepath.Base(finalPath), reason)
+		return finalPath, result
+	}
+	if _, err := os.Stat(newPath); err == nil {
+		log.Warnf("[%s] Detected %s for %s, but %s already exists; not moving it", logPrefix, detected, finalPath, newPath)
+		return finalPath, result
+	}
+	if err := helpers.MkdirAll(newDir, 0700); err != nil {
+		log.WithError(err).Warnf("[%s] Detected %s for %s but could not create %s", logPrefix, detected, finalPath, newDir)
+		return finalPath, result
+	}
+	if err := helpers.MoveFile(finalPath, newPath); err != nil {
+		log.WithError(err).Warnf("[%s] Detected %s for %s but could not move it", logPrefix, detected, finalPath)
+		return finalPath, result
+	}
+	removeEmptyDirs(oldDir, viper.GetString("savepath"))
+
+	log.Infof("[%s] Detected type %s for %s (%s); moved to %s", logPrefix, detected, filepath.Base(finalPath), reason, newDir)
+	pd.Slug = filepath.Dir(newVersionDir)
+	pd.VersionDir = newVersionDir
+	pd.TargetFilepath = filepath.Join(newDir, filepath.Base(pd.TargetFilepath))
+	return newPath, result
+}
+
+// removeEmptyDirs removes dir and its parents while they are empty, stopping at root.
+func removeEmptyDirs(dir, root string) {
+	root = filepath.Clean(root)
+	for dir = filepath.Clean(dir); dir != root && isWithinDir(dir, root); dir = filepath.Dir(dir) {
+		if err := os.Remove(dir); err != nil {
+			return // Not empty (or not removable)
+		}
+	}
+}
+
+// readTrainingMetadata returns the training metadata embedded in a downloaded safetensors
+// file, or nil if it is not a safetensors file or carries none. Other entries in the
+// database trained in the same run (re-uploads of the same weights) are logged.
+func readTrainingMetadata(logPrefix string, db *database.DB, dbKey string, finalPath string) *models.TrainingMetadata {
+	if !strings.EqualFold(filepath.Ext(finalPath), ".safetensors") {
+		return nil
+	}
+	header, err := helpers.ReadSafetensorsHeader(finalPath)
+	if err != nil {
+		log.WithError(err).Debugf("[%s] Cannot read safetensors header of %s for training metadata", logPrefix, finalPath)
+		return nil
+	}
+	training := helpers.ExtractTrainingMetadata(header)
+	if training == nil {
+		return nil
+	}
+	log.Debugf("[%s] Training metadata for %s: base %q, dim %d, alpha %g", logPrefix, filepath.Base(finalPath), training.BaseModel, training.NetworkDim, training.NetworkAlpha)
+
+	if duplicates := findTrainingDuplicates(db, dbKey, helpers.TrainingFingerprint(training)); len(duplicates) > 0 {
+		log.Warnf("[%s] %s has the same training fingerprint as %s; it is likely a re-upload of the same weights",
+			logPrefix, filepath.Base(finalPath), strings.Join(duplicates, ", "))
+	}
+	return training
+}
+
+// findTrainingDuplicates returns the keys of entries other than dbKey whose recorded training
+// metadata has the given fingerprint, ordered by key.
+func findTrainingDuplicates(db *database.DB, dbKey string, fingerprint string) []string {
+	if fingerprint == "" {
+		return nil
+	}
+	var candidates [][]string
+	if db.IndexesReady() {
+		keys, err := db.Lookup(database.IndexTraining, fingerprint)
+		if err != nil {
+			log.WithError(err).Debug("Failed to look up training duplicates")
+			return nil
+		}
+		candidates = append(candidates, keys)
+	}
+
+	var keys []string
+	err := foldCandidates(db, candidates, func(key []byte, value []byte) error {
+		keyStr := string(key)
+		if !strings.HasPrefix(keyStr, "v_") || keyStr == dbKey {
+			return nil
+		}
+		var entry models.DatabaseEntry
+		if err := json.Unmarshal(value, &entry); err != nil {
+			return nil
+		}
+		if helpers.TrainingFingerprint(entry.Training) == fingerprint {
+			keys = append(keys, keyStr)
+		}
+		return nil
+	})
+	if err != nil {
+		log.WithError(err).Debug("Failed to scan the database for training duplicates")
+	}
+	sort.Strings(keys)
+	return keys
+}
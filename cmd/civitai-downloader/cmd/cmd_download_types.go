@@ -1,6 +1,10 @@
 package cmd
 
-import "go-civitai-download/internal/models"
+import (
+	"encoding/json"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+)
 
 // potentialDownload holds information about a file identified during the metadata scan phase.
 type potentialDownload struct {
@@ -9,15 +13,21 @@ type potentialDownload struct {
 	VersionName       string
 	BaseModel         string
 	Creator           models.Creator
-	File              models.File // Contains URL, Hashes, SizeKB etc.
-	ModelVersionID    int         // Add Model Version ID
-	TargetFilepath    string      // Full calculated path for download
-	Slug              string      // Folder structure
-	FinalBaseFilename string      // Base filename part without ID prefix or metadata suffix (e.g., wan_cowgirl_v1.3.safetensors)
+	ModelNsfw         bool                     // The model's NSFW flag
+	ModelNsfwLevel    int                      // The model's nsfwLevel bit mask (0 if the response didn't list it)
+	ModelTags         []string                 // The model's tags (nil if the response didn't list them)
+	Permissions       *models.ModelPermissions // The model's license terms (nil if the response didn't list them)
+	File              models.File              // Contains URL, Hashes, SizeKB etc.
+	ModelVersionID    int                      // Add Model Version ID
+	TargetFilepath    string                   // Full calculated path for download
+	Slug              string                   // Folder structure
+	VersionDir        string                   // Version directory relative to SavePath (rendered PathTemplate)
+	FinalBaseFilename string                   // Base filename part without ID prefix or metadata suffix (e.g., wan_cowgirl_v1.3.safetensors)
 	// Store cleaned version separately for potential later use in DB entry
 	CleanedVersion models.ModelVersion
 	FullVersion    models.ModelVersion
 	OriginalImages []models.ModelImage // Add original images for potential download
+	RawVersion     json.RawMessage     // Raw API JSON for the version (incl. unknown fields), used for the metadata sidecar
 }
 
 // Represents a download task to be processed by a worker.
@@ -0,0 +1,302 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	_ "time/tzdata" // WatchTimezone must work on hosts and containers without a zoneinfo database
+
+	"github.com/dreamfast/go-civitai-downloader/internal/control"
+	"github.com/dreamfast/go-civitai-downloader/internal/database"
+	"github.com/dreamfast/go-civitai-downloader/internal/failure"
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// downloadSchedule restricts file downloads to the configured DownloadWindows, evaluated
+// in WatchTimezone.
+type downloadSchedule struct {
+	windows  []helpers.TimeWindow
+	location *time.Location
+}
+
+// downloadWindow is the schedule of the running download command; nil (no restriction)
+// without DownloadWindows. Watch mode defers files found outside it, a single run waits.
+var downloadWindow *downloadSchedule
+
+// windowRecheck bounds a wait for a download window, so a machine that was suspended or
+// had its clock changed doesn't sleep past the opening.
+const windowRecheck = 5 * time.Minute
+
+// newDownloadSchedule reads DownloadWindows and WatchTimezone. It returns nil if no window is set.
+func newDownloadSchedule() (*downloadSchedule, error) {
+	return parseSchedule(viper.GetStringSlice("downloadwindows"))
+}
+
+// parseSchedule reads time windows, evaluated in WatchTimezone. It returns nil if specs
+// holds no window.
+func parseSchedule(specs []string) (*downloadSchedule, error) {
+	var windows []helpers.TimeWindow
+	for _, spec := range specs {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		window, err := helpers.ParseTimeWindow(spec)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, window)
+	}
+	if len(windows) == 0 {
+		return nil, nil
+	}
+
+	location := time.Local
+	if zone := strings.TrimSpace(viper.GetString("watchtimezone")); zone != "" {
+		var err error
+		if location, err = time.LoadLocation(zone); err != nil {
+			return nil, fmt.Errorf("invalid WatchTimezone %q: %w", zone, err)
+		}
+	}
+	return &downloadSchedule{windows: windows, location: location}, nil
+}
+
+// open reports whether downloads may run at now. A nil schedule is always open.
+func (s *downloadSchedule) open(now time.Time) bool {
+	return s == nil || helpers.InTimeWindows(s.windows, now.In(s.location))
+}
+
+// nextOpen returns when the next download window opens (now if one is open).
+func (s *downloadSchedule) nextOpen(now time.Time) time.Time {
+	if s == nil {
+		return now
+	}
+	return helpers.NextTimeWindowStart(s.windows, now.In(s.location))
+}
+
+// windowClock is the time transfers are measured against the download windows with.
+var windowClock = time.Now
+
+// transferContext returns the context to start a transfer with: parent, also cancelled
+// when the download window open now closes, so the transfer stops there and keeps its
+// partial file. A nil schedule, or windows that never close, only add a CancelFunc.
+func (s *downloadSchedule) transferContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if s == nil {
+		return context.WithCancel(parent)
+	}
+	now := windowClock()
+	closes := helpers.NextTimeWindowEnd(s.windows, now.In(s.location))
+	if closes.IsZero() {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, closes.Sub(now))
+}
+
+// waitOpen blocks until a download window is open, logging once with logPrefix how long
+// the wait is. A nil schedule never waits.
+func (s *downloadSchedule) waitOpen(logPrefix string) {
+	logged := false
+	for now := time.Now(); !s.open(now); now = time.Now() {
+		opens := s.nextOpen(now)
+		if !logged {
+			log.Infof("%s: outside the download window; pausing until %s", logPrefix, opens.Format("Mon 15:04 MST"))
+			logged = true
+		}
+		wait := opens.Sub(now)
+		if wait > windowRecheck {
+			wait = windowRecheck
+		}
+		time.Sleep(wait)
+	}
+	if logged {
+		log.Infof("%s: download window open; resuming", logPrefix)
+	}
+}
+
+// deferDownloads marks queued downloads Deferred, so a cycle inside a window picks them up.
+func deferDownloads(db *database.DB, downloads []potentialDownload) {
+	for _, pd := range downloads {
+		dbKey := fmt.Sprintf("v_%d", pd.ModelVersionID)
+		if err := updateDbEntry(db, dbKey, models.StatusDeferred, nil); err != nil {
+			log.Warnf("Failed to defer %s (Key: %s): %v", pd.File.Name, dbKey, err)
+		}
+	}
+}
+
+// deferredDownloads returns the Deferred entries that are not already queued, rebuilt from
+// their stored metadata (discoveries are not necessarily returned by the API again), and
+// marks them Pending.
+func deferredDownloads(db *database.DB, queued []potentialDownload) []potentialDownload {
+	downloads := storedDownloads(db, queued, models.StatusDeferred)
+	if len(downloads) > 0 {
+		log.Infof("Resuming %d download(s) deferred outside the download window", len(downloads))
+	}
+	return downloads
+}
+
+// storedDownloads returns the entries with status that are not already queued, rebuilt
+// from their stored metadata, and marks them Pending.
+func storedDownloads(db *database.DB, queued []potentialDownload, status string) []potentialDownload {
+	return storedDownloadsWhere(db, queued, strings.ToLower(status), func(entry models.DatabaseEntry) bool {
+		return entry.Status == status
+	})
+}
+
+// storedDownloadsWhere is storedDownloads for the entries match selects; what describes
+// them in log messages.
+func storedDownloadsWhere(db *database.DB, queued []potentialDownload, what string, match func(models.DatabaseEntry) bool) []potentialDownload {
+	inQueue := make(map[int]bool, len(queued))
+	for _, pd := range queued {
+		inQueue[pd.ModelVersionID] = true
+	}
+
+	var entries []catalogMatch
+	err := db.Fold(func(key []byte, value []byte) error {
+		if !strings.HasPrefix(string(key), "v_") {
+			return nil
+		}
+		var entry models.DatabaseEntry
+		if err := json.Unmarshal(value, &entry); err != nil || !match(entry) || inQueue[entry.Version.ID] {
+			return nil
+		}
+		entries = append(entries, catalogMatch{Key: string(key), Entry: entry})
+		return nil
+	})
+	if err != nil {
+		log.WithError(err).Warnf("Failed to scan the database for %s downloads", what)
+	}
+	// Entries placed by 'queue import' go first, in their order
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i].Entry.QueuePosition, entries[j].Entry.QueuePosition
+		return a != 0 && (b == 0 || a < b)
+	})
+
+	var downloads []potentialDownload
+	for _, m := range entries {
+		if m.Entry.File.DownloadUrl == "" {
+			continue
+		}
+		versionDir := entryVersionDir(viper.GetString("savepath"), m.Entry)
+		targetPath := filepath.Join(versionDir, strings.TrimPrefix(m.Entry.Filename, fmt.Sprintf("%d_", m.Entry.Version.ID)))
+		pd := potentialDownloadFromEntry(m.Entry, targetPath)
+		if reason := downloadQuotas.skipReason(pd, m.Key); reason != "" {
+			log.WithField(failure.LogField, failure.Filtered).Infof("Skipping %s %s (Key: %s) - quota: %s", what, targetPath, m.Key, reason)
+			continue
+		}
+		if err := updateDbEntry(db, m.Key, models.StatusPending, nil); err != nil {
+			continue
+		}
+		downloads = append(downloads, pd)
+	}
+	return downloads
+}
+
+// runWatch runs a download cycle every interval until interrupted. Each cycle discovers
+// new files like a normal download run; outside the download windows they are recorded
+// as Deferred, and the loop wakes up early when a window opens so they get downloaded.
+func runWatch(cmd *cobra.Command, args []string, intervalSpec string) {
+	interval, err := time.ParseDuration(intervalSpec)
+	if err != nil || interval <= 0 {
+		log.Fatalf("Invalid watch interval %q: use a duration such as 30m or 6h", intervalSpec)
+	}
+	if downloadWindow, err = newDownloadSchedule(); err != nil {
+		log.Fatalf("Invalid download window settings: %v", err)
+	}
+	if downloadDigest, err = newDigestRecorder(time.Now()); err != nil {
+		log.Fatalf("Invalid digest settings: %v", err)
+	}
+	stopService, err := startServiceNotifier()
+	if err != nil {
+		log.Fatalf("Invalid systemd watchdog settings: %v", err)
+	}
+	defer stopService()
+	jobs, err := loadWatchJobs()
+	if err != nil {
+		log.Fatalf("Invalid maintenance job settings: %v", err)
+	}
+	viper.Set("skipconfirmation", true) // Nobody is there to answer the prompt
+	downloadWatch = loadWatchProgress()
+	saved := downloadWatch.snapshot()
+	resume := downloadWatch.interrupted()
+
+	// The control interface stays up between cycles, so 'ctl tail' can follow the loop
+	watchControlServer = startControlServer()
+	if watchControlServer != nil {
+		defer watchControlServer.Close()
+	}
+
+	stop := make(chan os.Signal, 1)
+	if downloadWindow != nil {
+		log.Infof("Watch mode: checking every %v; downloads only within %s (%s)",
+			interval, strings.Join(viper.GetStringSlice("downloadwindows"), ", "), downloadWindow.location)
+	} else {
+		log.Infof("Watch mode: checking every %v", interval)
+	}
+	for _, job := range jobs {
+		log.Infof("Maintenance job %s every %v: %s", job.name, job.interval, strings.Join(job.command, " "))
+	}
+
+	first := 1
+	switch {
+	case resume:
+		first = saved.Cycle
+		if saved.Cursor != "" {
+			log.Infof("Resuming watch cycle %d (started %s) after page %d", saved.Cycle, saved.CycleStarted.Format(time.RFC1123), saved.Page)
+		} else {
+			log.Infof("Resuming watch cycle %d (started %s)", saved.Cycle, saved.CycleStarted.Format(time.RFC1123))
+		}
+	case saved.Cycle > 0:
+		first = saved.Cycle + 1
+		if wait := time.Until(saved.NextCycle); wait > 0 {
+			log.Infof("Watch cycle %d is due at %s", first, saved.NextCycle.In(time.Local).Format(time.RFC1123))
+			downloadService.setWaiting("next watch cycle at " + saved.NextCycle.In(time.Local).Format("Mon 15:04 MST"))
+			if !waitForCycle(stop, saved.NextCycle, jobs) {
+				return
+			}
+		}
+	}
+
+	for cycle := first; ; cycle++ {
+		started := time.Now()
+		if resume {
+			started = saved.CycleStarted // The interval counts from the interrupted start
+		}
+		downloadWatch.startCycle(cycle, resume)
+		downloadService.setCycle(cycle)
+		downloadService.setPhase("starting")
+		resume = false
+		if downloadWindow.open(time.Now()) {
+			log.WithField(control.EventField, "cycle-started").Infof("--- Watch cycle %d ---", cycle)
+		} else {
+			log.WithField(control.EventField, "cycle-started").Infof("--- Watch cycle %d (outside the download window: new files are deferred until %s) ---",
+				cycle, downloadWindow.nextOpen(time.Now()).Format("Mon 15:04 MST"))
+		}
+		runDownloadCycle(cmd, args)
+
+		next := started.Add(interval)
+		if now := time.Now(); !downloadWindow.open(now) {
+			if opens := downloadWindow.nextOpen(now); opens.Before(next) {
+				next = opens // Download what was deferred as soon as the window opens
+			}
+		}
+		log.WithField(control.EventField, "cycle-finished").Infof("Next watch cycle at %s", next.In(time.Local).Format(time.RFC1123))
+		downloadWatch.endCycle(next)
+		downloadService.setWaiting("finished; next cycle at " + next.In(time.Local).Format("Mon 15:04 MST"))
+
+		// Only the wait (and the maintenance jobs in it) is interruptible gracefully; a signal
+		// during a cycle ends the process as it would a normal download run (the watch state
+		// resumes the cycle next time)
+		if !waitForCycle(stop, next, jobs) {
+			return
+		}
+	}
+}
@@ -0,0 +1,387 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/control"
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// watchJobCommands are the commands of the WatchJobs that may leave Command out.
+// {SavePath} in an argument is replaced by the configured SavePath.
+var watchJobCommands = map[string][]string{
+	"verify":        {"db", "verify", "--sample", "5%"},
+	"stats":         {"storage", "report", "--json"},
+	"prune":         {"clean"},
+	"compact":       {"db", "compact"},
+	"check-removed": {"db", "check-removed", "--suspected"},
+	"report":        {"report", "--format", reportMarkdown, "--out", "{SavePath}/report"},
+}
+
+// watchJobOutputs are the default Output files of the WatchJobs with a default Command.
+var watchJobOutputs = map[string]string{
+	"stats": "storage-report.json",
+}
+
+// watchJobStopDelay is how long a stopped job has to exit before it is killed.
+const watchJobStopDelay = 30 * time.Second
+
+// watchJob is a maintenance job the watch loop runs between download cycles.
+type watchJob struct {
+	name     string
+	interval time.Duration
+	command  []string
+	windows  *downloadSchedule // nil: any time
+	timeout  time.Duration     // 0: no limit
+	output   string            // File for standard output; "" relays it to the log
+
+	concurrent []string // Jobs it may run alongside; "*" is any
+}
+
+// loadWatchJobs reads and checks the WatchJobs tables, sorted by name.
+func loadWatchJobs() ([]watchJob, error) {
+	savePath := viper.GetString("savepath")
+	var jobs []watchJob
+	for name, config := range globalConfig.WatchJobs {
+		job := watchJob{name: name, command: config.Command, output: config.Output, concurrent: config.Concurrent}
+		if len(job.command) == 0 {
+			job.command = watchJobCommands[name]
+			if job.output == "" {
+				job.output = watchJobOutputs[name]
+			}
+		}
+		if len(job.command) == 0 {
+			return nil, fmt.Errorf("WatchJobs.%s: set Command (only %s have a default one)", name, strings.Join(sortedKeys(watchJobCommands), ", "))
+		}
+		job.command = append([]string(nil), job.command...)
+		for i, arg := range job.command {
+			job.command[i] = strings.ReplaceAll(arg, "{SavePath}", savePath)
+		}
+		var err error
+		if job.interval, err = parseWatchJobDuration(config.Interval); err != nil || job.interval <= 0 {
+			return nil, fmt.Errorf("WatchJobs.%s: invalid Interval %q: use a duration (24h) or a number of days (7d)", name, config.Interval)
+		}
+		if strings.TrimSpace(config.Timeout) != "" {
+			if job.timeout, err = parseWatchJobDuration(config.Timeout); err != nil || job.timeout <= 0 {
+				return nil, fmt.Errorf("WatchJobs.%s: invalid Timeout %q", name, config.Timeout)
+			}
+		}
+		if job.windows, err = parseSchedule(config.Windows); err != nil {
+			return nil, fmt.Errorf("WatchJobs.%s: %w", name, err)
+		}
+		if job.output != "" && !filepath.IsAbs(job.output) {
+			job.output = filepath.Join(savePath, job.output)
+		}
+		for _, other := range job.concurrent {
+			if _, ok := globalConfig.WatchJobs[other]; !ok && other != "*" {
+				return nil, fmt.Errorf("WatchJobs.%s: Concurrent names %q, which is not one of the WatchJobs", name, other)
+			}
+		}
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].name < jobs[j].name })
+	return jobs, nil
+}
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// parseWatchJobDuration accepts Go durations ("24h") and days ("7d").
+func parseWatchJobDuration(spec string) (time.Duration, error) {
+	spec = strings.ToLower(strings.TrimSpace(spec))
+	if days, ok := strings.CutSuffix(spec, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(spec)
+}
+
+// due returns when the job is next due: an interval after it last started (now if it
+// never ran), put off to the next opening of its windows.
+func (j watchJob) due(lastRun, now time.Time) time.Time {
+	due := now
+	if !lastRun.IsZero() {
+		due = lastRun.Add(j.interval)
+	}
+	if !j.windows.open(due) {
+		due = j.windows.nextOpen(due)
+	}
+	return due
+}
+
+// concurrentWith reports whether j and other may run at the same time: either of them
+// lists the other (or "*") in Concurrent.
+func (j watchJob) concurrentWith(other watchJob) bool {
+	allows := func(a, b watchJob) bool {
+		for _, name := range a.concurrent {
+			if name == "*" || name == b.name {
+				return true
+			}
+		}
+		return false
+	}
+	return allows(j, other) || allows(other, j)
+}
+
+// waitForCycle waits until the next cycle is due, running the maintenance jobs that fall
+// due in the meantime, earliest due first. A due job waits for the running ones unless
+// Concurrent lets it run alongside all of them, and jobs never run during a cycle: no job
+// starts once the cycle is due, and the cycle starts when the running ones end. It returns
+// false if an interrupt or SIGTERM came first, after stopping the running jobs.
+func waitForCycle(stop chan os.Signal, next time.Time, jobs []watchJob) bool {
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(stop)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	running := make(map[string]watchJob)
+	finished := make(chan string)
+	for {
+		now := time.Now()
+		if !now.Before(next) && len(running) == 0 {
+			return true
+		}
+		wake := next
+		if now.Before(next) {
+			dues := make(map[string]time.Time, len(jobs))
+			order := make([]watchJob, 0, len(jobs))
+			for _, job := range jobs {
+				if _, ok := running[job.name]; !ok {
+					dues[job.name] = job.due(downloadWatch.jobRun(job.name), now)
+					order = append(order, job)
+				}
+			}
+			sort.SliceStable(order, func(i, k int) bool { return dues[order[i].name].Before(dues[order[k].name]) })
+			for _, job := range order {
+				due := dues[job.name]
+				if due.After(now) {
+					if due.Before(wake) {
+						wake = due // A job's windows may change what is due first by then
+					}
+					continue
+				}
+				if !due.Before(next) {
+					continue
+				}
+				compatible := true
+				for _, other := range running {
+					compatible = compatible && job.concurrentWith(other)
+				}
+				if !compatible {
+					continue // Started once the jobs it can't run alongside have finished
+				}
+				running[job.name] = job
+				go func() {
+					runWatchJob(ctx, job)
+					finished <- job.name
+				}()
+			}
+		}
+
+		var timer *time.Timer
+		var wakeUp <-chan time.Time // nil: only a job finishing or a signal wakes the loop
+		if now.Before(wake) {
+			timer = time.NewTimer(wake.Sub(now))
+			wakeUp = timer.C
+		}
+		select {
+		case sig := <-stop:
+			if len(running) > 0 {
+				log.Infof("Received %v, stopping the maintenance jobs and watch mode.", sig)
+			} else {
+				log.Infof("Received %v, stopping watch mode.", sig)
+			}
+			if timer != nil {
+				timer.Stop()
+			}
+			cancel()
+			for len(running) > 0 {
+				delete(running, <-finished)
+			}
+			return false
+		case name := <-finished:
+			delete(running, name)
+		case <-wakeUp:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// runWatchJob runs a maintenance job as a child process with the configuration of this
+// one, and records that it ran, whether or not it succeeded (a failing job is not retried
+// before its next interval). A job stopped by cancelling parent is not recorded.
+func runWatchJob(parent context.Context, job watchJob) {
+	started := time.Now()
+	logger := log.WithField("job", job.name)
+	exe, err := os.Executable()
+	if err != nil {
+		logger.WithField(control.EventField, "job-failed").WithError(err).Error("Cannot run maintenance job: executable not found")
+		downloadWatch.recordJob(job.name, started)
+		return
+	}
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if job.timeout > 0 {
+		ctx, cancel = context.WithTimeout(parent, job.timeout)
+	} else {
+		ctx, cancel = context.WithCancel(parent)
+	}
+	defer cancel()
+	var args []string
+	if configFile := viper.ConfigFileUsed(); configFile != "" {
+		args = append(args, "--config", configFile)
+	}
+	if workspaceFlag != "" {
+		args = append(args, "--workspace", workspaceFlag)
+	}
+	c := exec.CommandContext(ctx, exe, append(args, job.command...)...)
+	// Stopped jobs get an interrupt first, to clean up as after Ctrl-C
+	c.Cancel = func() error { return c.Process.Signal(os.Interrupt) }
+	c.WaitDelay = watchJobStopDelay
+	stderr := &jobLogWriter{logger: logger}
+	c.Stderr = stderr // Stdin stays empty, so prompts get no answer
+
+	var out *os.File
+	stdout := &jobLogWriter{logger: logger}
+	if job.output != "" {
+		if err = helpers.MkdirAll(filepath.Dir(job.output), 0755); err == nil {
+			out, err = os.Create(job.output + ".tmp")
+		}
+		if err != nil {
+			logger.WithField(control.EventField, "job-failed").WithError(err).Errorf("Cannot write the output of maintenance job %s", job.name)
+			downloadWatch.recordJob(job.name, started)
+			return
+		}
+		c.Stdout = out
+	} else {
+		c.Stdout = stdout
+	}
+
+	logger.WithField(control.EventField, "job-started").Infof("Running maintenance job %s: %s", job.name, strings.Join(job.command, " "))
+	if err = c.Start(); err == nil {
+		err = c.Wait()
+	}
+	if parent.Err() != nil {
+		logger.Infof("Stopped maintenance job %s", job.name)
+		if out != nil {
+			out.Close()
+			os.Remove(out.Name())
+		}
+		return
+	}
+	stderr.flush()
+	stdout.flush()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("stopped after the Timeout of %v", job.timeout)
+	}
+	if out != nil {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(out.Name(), job.output)
+		}
+		if err == nil {
+			helpers.ApplyFileMode(job.output)
+		} else {
+			os.Remove(out.Name())
+		}
+	}
+	downloadWatch.recordJob(job.name, started)
+
+	took := time.Since(started).Round(time.Second)
+	if err != nil {
+		logger.WithField(control.EventField, "job-failed").WithError(err).Errorf("Maintenance job %s failed after %v", job.name, took)
+		return
+	}
+	if job.output != "" {
+		logger.WithField(control.EventField, "job-finished").Infof("Maintenance job %s finished in %v; output in %s", job.name, took, job.output)
+	} else {
+		logger.WithField(control.EventField, "job-finished").Infof("Maintenance job %s finished in %v", job.name, took)
+	}
+}
+
+// jobLogWriter relays what a job writes as log entries, one per line.
+type jobLogWriter struct {
+	mu     sync.Mutex
+	logger *log.Entry
+	buf    []byte
+}
+
+func (w *jobLogWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.log(string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// flush relays a last line without a line break.
+func (w *jobLogWriter) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.log(string(w.buf))
+	w.buf = nil
+}
+
+// jobLogLine matches the entries of a job's own log, in logrus's text format.
+var jobLogLine = regexp.MustCompile(`^time="[^"]*" level=(\w+) msg=("(?:[^"\\]|\\.)*"|\S*)(.*)$`)
+
+// log relays a line, at its own level if it is a log entry of the job.
+func (w *jobLogWriter) log(line string) {
+	line = strings.TrimRight(line, "\r ")
+	if line == "" {
+		return
+	}
+	level := log.InfoLevel
+	if m := jobLogLine.FindStringSubmatch(line); m != nil {
+		if parsed, err := log.ParseLevel(m[1]); err == nil {
+			level = parsed
+		}
+		msg := m[2]
+		if unquoted, err := strconv.Unquote(msg); err == nil {
+			msg = unquoted
+		}
+		line = msg + m[3] // Fields of the entry stay as text
+	}
+	if level <= log.ErrorLevel {
+		level = log.ErrorLevel // A job's fatal error doesn't end the loop
+	}
+	w.logger.Log(level, line)
+}
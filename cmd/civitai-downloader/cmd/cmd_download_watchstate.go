@@ -0,0 +1,234 @@
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/database"
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// watchStateFile is the file below SavePath the watch loop keeps its progress in.
+const watchStateFile = "watch-state.json"
+
+// watchState is the progress of the watch loop, saved so a restarted loop (after a crash,
+// an upgrade or a reboot) carries on where the last one stopped instead of starting the
+// discovery pass over.
+type watchState struct {
+	Cycle        int       `json:"cycle"`
+	CycleStarted time.Time `json:"cycleStarted"`
+	// Query identifies the listing being paged through; a changed query starts over.
+	Query string `json:"query,omitempty"`
+	// Page is the last page that was fully processed, Cursor the one of the page after it.
+	// Both are cleared once the discovery pass is finished.
+	Page   int    `json:"page,omitempty"`
+	Cursor string `json:"cursor,omitempty"`
+	// NextCycle is when the next cycle is due, set while the loop waits for it.
+	NextCycle time.Time `json:"nextCycle,omitempty"`
+	// ChallengeUntil is the end of a Cloudflare cool-down still running.
+	ChallengeUntil time.Time `json:"challengeUntil,omitempty"`
+	// Jobs holds when each maintenance job (WatchJobs) last started.
+	Jobs    map[string]time.Time `json:"jobs,omitempty"`
+	SavedAt time.Time            `json:"savedAt"`
+}
+
+// watchProgress persists the state of the watch loop. Pages are checkpointed from the
+// discovery goroutine while workers download, so every access holds mu and the file is
+// replaced atomically.
+type watchProgress struct {
+	mu       sync.Mutex
+	path     string
+	state    watchState
+	resuming bool         // The current cycle continues an interrupted one
+	resumed  map[int]bool // Version IDs re-queued from the interrupted cycle
+}
+
+// downloadWatch is the progress of the running watch loop; nil outside watch mode.
+var downloadWatch *watchProgress
+
+// loadWatchProgress reads the saved state of the watch loop, if any.
+func loadWatchProgress() *watchProgress {
+	w := &watchProgress{path: filepath.Join(viper.GetString("savepath"), watchStateFile)}
+	data, err := os.ReadFile(w.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.WithError(err).Warnf("Failed to read the watch state %s; starting afresh", w.path)
+		}
+		return w
+	}
+	if err := json.Unmarshal(data, &w.state); err != nil {
+		log.WithError(err).Warnf("Ignoring unreadable watch state %s", w.path)
+		w.state = watchState{}
+	}
+	globalChallengeGuard.Hold(w.state.ChallengeUntil)
+	return w
+}
+
+// interrupted reports whether the saved cycle was stopped before it ended.
+func (w *watchProgress) interrupted() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.state.Cycle > 0 && w.state.NextCycle.IsZero()
+}
+
+// snapshot returns a copy of the state.
+func (w *watchProgress) snapshot() watchState {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.state
+}
+
+// startCycle records the start of a cycle, or of the resumption of an interrupted one.
+func (w *watchProgress) startCycle(cycle int, resume bool) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.resuming, w.resumed = resume, nil
+	if !resume {
+		w.state = watchState{Cycle: cycle, CycleStarted: time.Now(), Jobs: w.state.Jobs}
+	}
+	w.state.NextCycle = time.Time{}
+	w.save()
+}
+
+// takeResume reports whether the current cycle continues an interrupted one, once.
+func (w *watchProgress) takeResume() bool {
+	if w == nil {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	resuming := w.resuming
+	w.resuming = false
+	return resuming
+}
+
+// resumePoint returns the page and cursor to continue a listing from, and whether the
+// saved progress applies to it. Progress of another query is dropped.
+func (w *watchProgress) resumePoint(query string) (page int, cursor string, ok bool) {
+	if w == nil {
+		return 0, "", false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.state.Cursor == "" {
+		w.state.Query = query
+		return 0, "", false
+	}
+	if w.state.Query != query {
+		log.Info("The download filters changed since the watch state was saved; starting the discovery pass over")
+		w.state.Query, w.state.Page, w.state.Cursor = query, 0, ""
+		w.save()
+		return 0, "", false
+	}
+	return w.state.Page, w.state.Cursor, true
+}
+
+// resumeDownloads returns the Pending downloads left by the interrupted cycle: files
+// queued from the pages before the resume point, which are not listed again, and files
+// the cycle didn't get to download or was still downloading.
+func (w *watchProgress) resumeDownloads(db *database.DB) []potentialDownload {
+	downloads := storedDownloadsWhere(db, nil, "pending", func(entry models.DatabaseEntry) bool {
+		return entry.Status == models.StatusPending || entry.Status == models.StatusDownloading
+	})
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.resumed = make(map[int]bool, len(downloads))
+	for _, pd := range downloads {
+		w.resumed[pd.ModelVersionID] = true
+	}
+	return downloads
+}
+
+// dropResumed removes downloads that were already re-queued by resumeDownloads.
+func (w *watchProgress) dropResumed(queued []potentialDownload) []potentialDownload {
+	if w == nil {
+		return queued
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.resumed) == 0 {
+		return queued
+	}
+	kept := queued[:0]
+	for _, pd := range queued {
+		if !w.resumed[pd.ModelVersionID] {
+			kept = append(kept, pd)
+		}
+	}
+	return kept
+}
+
+// pageDone checkpoints a processed page and the cursor of the next one ("" when it was
+// the last page).
+func (w *watchProgress) pageDone(page int, nextCursor string) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.state.Page, w.state.Cursor = page, nextCursor
+	w.save()
+}
+
+// endCycle records that the cycle is over and when the next one is due.
+func (w *watchProgress) endCycle(next time.Time) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.resuming = false
+	w.state.Page, w.state.Cursor = 0, ""
+	w.state.NextCycle = next
+	w.save()
+}
+
+// jobRun returns when a maintenance job last started (zero if it never ran).
+func (w *watchProgress) jobRun(name string) time.Time {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.state.Jobs[name]
+}
+
+// recordJob records the start of a maintenance job that ran.
+func (w *watchProgress) recordJob(name string, started time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.state.Jobs == nil {
+		w.state.Jobs = make(map[string]time.Time)
+	}
+	w.state.Jobs[name] = started
+	w.save()
+}
+
+// save writes the state file through a temporary file, so a crash never leaves a torn
+// one behind. The caller must hold w.mu.
+func (w *watchProgress) save() {
+	w.state.ChallengeUntil = time.Time{}
+	if until := globalChallengeGuard.Until(); until.After(time.Now()) {
+		w.state.ChallengeUntil = until
+	}
+	w.state.SavedAt = time.Now()
+	data, err := json.MarshalIndent(w.state, "", "  ")
+	if err == nil {
+		tmp := w.path + ".tmp"
+		if err = helpers.WriteFile(tmp, data, 0600); err == nil {
+			if err = os.Rename(tmp, w.path); err != nil {
+				os.Remove(tmp)
+			}
+		}
+	}
+	if err != nil {
+		log.WithError(err).Warn("Failed to save the watch state")
+	}
+}
@@ -1,18 +1,24 @@
 package cmd
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
 	"path/filepath"
 	"strings"
 	"sync"
 	"time"
 
-	index "go-civitai-download/index"
-	"go-civitai-download/internal/database"
-	"go-civitai-download/internal/downloader"
-	"go-civitai-download/internal/models"
+	"github.com/dreamfast/go-civitai-downloader/civitai"
+	index "github.com/dreamfast/go-civitai-downloader/index"
+	"github.com/dreamfast/go-civitai-downloader/internal/control"
+	"github.com/dreamfast/go-civitai-downloader/internal/database"
+	"github.com/dreamfast/go-civitai-downloader/internal/downloader"
+	"github.com/dreamfast/go-civitai-downloader/internal/failure"
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
 
 	"github.com/blevesearch/bleve/v2"
 	"github.com/gosuri/uilive"
@@ -20,6 +26,67 @@ import (
 	"github.com/spf13/viper"
 )
 
+// modelFileIndexItem builds the search index document for a model file stored at filePath
+// (for cataloged entries, the path the file would be downloaded to).
+func modelFileIndexItem(pd potentialDownload, filePath string) index.Item {
+	// Calculate directory paths
+	directoryPath := filepath.Dir(filePath)
+	baseModelPath := filepath.Dir(directoryPath)
+	modelPath := filepath.Dir(baseModelPath)
+
+	// Parse PublishedAt timestamp
+	publishedAtTime := time.Time{}
+	if pd.FullVersion.PublishedAt != "" {
+		var errParse error
+		publishedAtTime, errParse = time.Parse(time.RFC3339Nano, pd.FullVersion.PublishedAt)
+		if errParse != nil {
+			publishedAtTime, errParse = time.Parse(time.RFC3339, pd.FullVersion.PublishedAt)
+			if errParse != nil {
+				log.WithError(errParse).Warnf("Failed to parse PublishedAt time '%s' for indexing", pd.FullVersion.PublishedAt)
+				// Keep publishedAtTime as zero time
+			}
+		}
+	}
+
+	return index.Item{
+		ID:            fmt.Sprintf("v_%d", pd.ModelVersionID), // Use the same key format as DB
+		Type:          "model_file",
+		Name:          pd.File.Name,                  // Use the original file name
+		Description:   pd.CleanedVersion.Description, // Use model version description if available
+		FilePath:      filePath,
+		DirectoryPath: directoryPath,
+		BaseModelPath: baseModelPath,
+		ModelPath:     modelPath,
+		ModelName:     pd.ModelName,
+		VersionName:   pd.VersionName,
+		BaseModel:     pd.BaseModel,
+		CreatorName:   pd.Creator.Username,
+		Tags:          pd.FullVersion.TrainedWords, // Use TrainedWords as tags for now
+		// New Fields
+		PublishedAt:          publishedAtTime,                             // Parsed time.Time
+		VersionDownloadCount: float64(pd.FullVersion.Stats.DownloadCount), // Convert int to float64
+		VersionRating:        pd.FullVersion.Stats.Rating,                 // float64
+		VersionRatingCount:   float64(pd.FullVersion.Stats.RatingCount),   // Convert int to float64
+		FileSizeKB:           pd.File.SizeKB,                              // float64
+		FileFormat:           pd.File.Metadata.Format,                     // string
+		FilePrecision:        pd.File.Metadata.Fp,                         // string
+		FileSizeType:         pd.File.Metadata.Size,                       // string
+	}
+}
+
+// setEntryError records err on a DB entry together with its failure category, counting the
+// failed attempt.
+func setEntryError(entry *models.DatabaseEntry, err error) {
+	entry.ErrorDetails = err.Error()
+	entry.ErrorCategory = string(failure.CategoryOf(err))
+	entry.ErrorReason = string(failure.ReasonOf(err))
+	entry.FailedAt = time.Now().Unix()
+	entry.FailedAttempts++
+	if errors.Is(err, downloader.ErrQuarantined) {
+		entry.QuarantinedAt = entry.FailedAt
+	}
+}
+
 // updateDbEntry encapsulates the logic for getting, updating, and putting a database entry.
 // It takes the database connection, the key, the new status (string), and an optional function
 // to apply further modifications to the entry before saving.
@@ -45,6 +112,16 @@ func updateDbEntry(db *database.DB, key string, newStatus string, updateFunc fun
 	if updateFunc != nil {
 		updateFunc(&entry)
 	}
+	if entry.ErrorDetails == "" {
+		entry.ErrorCategory, entry.ErrorReason = "", "" // A cleared error takes its category with it
+		entry.QuarantinedAt = 0
+	}
+	if entry.Status == models.StatusDownloaded {
+		entry.FailedAttempts = 0
+	}
+	if entry.Status != models.StatusPending && entry.Status != models.StatusDownloading {
+		entry.QueuedAt, entry.QueuePosition = 0, 0 // Out of the download queue
+	}
 
 	// Marshal updated entry back to JSON
 	updatedEntryBytes, marshalErr := json.Marshal(entry)
@@ -64,11 +141,12 @@ func updateDbEntry(db *database.DB, key string, newStatus string, updateFunc fun
 }
 
 // handleMetadataSaving checks the config and calls saveMetadataFile if needed.
-func handleMetadataSaving(logPrefix string, pd potentialDownload, finalPath string, finalStatus string, writer *uilive.Writer) {
+// extras are additional top-level sidecar fields (download receipt, preview selection).
+func handleMetadataSaving(logPrefix string, pd potentialDownload, finalPath string, finalStatus string, extras []sidecarField, writer *uilive.Writer) {
 	if viper.GetBool("savemetadata") {
 		if finalStatus == models.StatusDownloaded {
 			log.Debugf("[%s] Saving metadata for successfully downloaded file: %s", logPrefix, finalPath)
-			if metaErr := saveMetadataFile(pd, finalPath); metaErr != nil {
+			if metaErr := saveMetadataFile(pd, finalPath, extras...); metaErr != nil {
 				// Error already logged by saveMetadataFile
 				if writer != nil {
 					fmt.Fprintf(writer.Newline(), "[%s] Error saving metadata for %s: %v\n", logPrefix, filepath.Base(finalPath), metaErr)
@@ -82,6 +160,37 @@ func handleMetadataSaving(logPrefix string, pd potentialDownload, finalPath stri
 	}
 }
 
+// transferFile downloads the file of pd. A pause (`ctl pause`, SIGUSR1) aborts the
+// transfer, keeping the partial file, which is continued on resume. So does the download
+// window closing: a single run waits for the next window and continues the file, watch
+// mode (deferOnClose) leaves it to a cycle inside a window and reports it deferred.
+func transferFile(id int, pd potentialDownload, fileDownloader *downloader.Downloader, writer *uilive.Writer, deferOnClose bool) (string, *downloader.Receipt, bool, error) {
+	name := filepath.Base(pd.TargetFilepath)
+	for {
+		if downloadPause.wait(fmt.Sprintf("Worker %d", id)) {
+			fmt.Fprintf(writer.Newline(), "Worker %d: Resuming %s...\n", id, name)
+		}
+		paused := downloadPause.transferContext()
+		ctx, cancel := downloadWindow.transferContext(paused)
+		finalPath, receipt, err := fileDownloader.DownloadFileContext(ctx, pd.TargetFilepath, pd.File.DownloadUrl, pd.File.Hashes, civitai.FileNameVersionID(pd.ModelType, pd.ModelVersionID))
+		windowClosed := paused.Err() == nil && errors.Is(ctx.Err(), context.DeadlineExceeded)
+		cancel()
+		switch {
+		case err == nil || ctx.Err() == nil:
+			return finalPath, receipt, false, err
+		case !windowClosed:
+			fmt.Fprintf(writer.Newline(), "Worker %d: Paused %s\n", id, name)
+		case deferOnClose:
+			log.WithField(failure.LogField, failure.Filtered).Infof("Worker %d: Deferring %s: the download window closed; the partial file is continued in a later cycle", id, pd.TargetFilepath)
+			fmt.Fprintf(writer.Newline(), "Worker %d: Download window closed, deferred %s\n", id, name)
+			return "", receipt, true, err
+		default:
+			fmt.Fprintf(writer.Newline(), "Worker %d: Download window closed, paused %s\n", id, name)
+			downloadWindow.waitOpen(fmt.Sprintf("Worker %d", id))
+		}
+	}
+}
+
 // downloadWorker handles the actual download of a file and updates the database.
 // It now also accepts an imageDownloader, bleveIndex, and concurrencyLevel.
 func downloadWorker(id int, jobs <-chan downloadJob, db *database.DB, fileDownloader *downloader.Downloader, imageDownloader *downloader.Downloader, wg *sync.WaitGroup, writer *uilive.Writer, concurrencyLevel int, bleveIndex bleve.Index) {
@@ -90,114 +199,181 @@ func downloadWorker(id int, jobs <-chan downloadJob, db *database.DB, fileDownlo
 	for job := range jobs {
 		pd := job.PotentialDownload
 		dbKey := job.DatabaseKey // Use the key passed in the job
-		log.Infof("Worker %d: Processing job for %s", id, pd.TargetFilepath)
+		downloadService.tookFile()
+
+		// Live filters (set via `ctl filter ...`) apply to jobs that haven't started yet.
+		// The DB entry stays Pending so a later run can still pick it up.
+		if reason := liveFilters.skipReason(pd); reason != "" {
+			log.WithField(failure.LogField, failure.Filtered).Infof("Worker %d: Skipping %s: %s", id, pd.TargetFilepath, reason)
+			fmt.Fprintf(writer.Newline(), "Worker %d: Skipped %s (%s)\n", id, filepath.Base(pd.TargetFilepath), reason)
+			releaseQueued(db, dbKey)
+			downloadRunStats.skip(skippedFiltered)
+			continue
+		}
+
+		// Jobs still queued when the download window closes wait for the next one: watch mode
+		// defers them to a later cycle, a single run pauses the worker
+		if downloadWatch == nil {
+			downloadWindow.waitOpen(fmt.Sprintf("Worker %d", id))
+		} else if !downloadWindow.open(time.Now()) {
+			log.WithField(failure.LogField, failure.Filtered).Infof("Worker %d: Deferring %s: outside the download window", id, pd.TargetFilepath)
+			if updateErr := updateDbEntry(db, dbKey, models.StatusDeferred, nil); updateErr != nil {
+				log.Errorf("Worker %d: Failed to defer %s: %v", id, dbKey, updateErr)
+			}
+			downloadRunStats.skip(skippedDeferred)
+			continue
+		}
+
+		// Trust-on-first-use: refuse a re-download whose hashes differ from the ones first seen
+		// for this version's file, unless --accept-hash-change or the hash-change policy
+		// accepts it.
+		acceptHashChange := viper.GetBool("accepthashchange")
+		if change := checkHashPinForDownload(db, dbKey, pd.File); change != "" {
+			action := downloadConflicts.resolve(downloadConflict{
+				kind:    conflictHashChange,
+				summary: fmt.Sprintf("the upstream file of %s %s changed since it was first downloaded", pd.ModelName, pd.VersionName),
+				details: []string{change, "The file may have been swapped upstream, or re-uploaded by its creator"},
+			})
+			if action != "accept" {
+				log.Errorf("Worker %d: REFUSING download of %s: %s. The file may have been swapped upstream; re-run with --accept-hash-change to trust the new file.", id, pd.TargetFilepath, change)
+				fmt.Fprintf(writer.Newline(), "Worker %d: HASH CHANGED for %s, refusing download (see log)\n", id, filepath.Base(pd.TargetFilepath))
+				updateErr := updateDbEntry(db, dbKey, models.StatusError, func(entry *models.DatabaseEntry) {
+					entry.ErrorDetails = "Hash pin mismatch: " + change
+					entry.ErrorCategory = string(failure.Verification)
+					entry.ErrorReason = ""
+					entry.FailedAt = time.Now().Unix()
+					entry.FailedAttempts++
+				})
+				if updateErr != nil {
+					log.Errorf("Worker %d: Failed to update DB status after hash pin mismatch: %v", id, updateErr)
+				}
+				pinErr := failure.New(failure.Verification, "Hash pin mismatch: "+change)
+				downloadDigest.recordDownload(pd, dbKey, "", pinErr)
+				downloadRunStats.recordDownload(time.Now(), nil, pinErr)
+				continue
+			}
+			log.Warnf("Worker %d: Accepting hash change for %s: %s", id, pd.TargetFilepath, change)
+			acceptHashChange = true
+		}
+
+		// A file already at the target that isn't this version's file is replaced by the
+		// download unless the existing-file or collision policy keeps it. Kept: the entry
+		// stays Pending, like a filtered download.
+		if downloadConflicts.detects(conflictExistingFile) || downloadConflicts.detects(conflictCollision) {
+			if c, ok := existingFileConflict(db, pd, dbKey); ok && downloadConflicts.resolve(c) == "keep" {
+				log.WithField(failure.LogField, failure.Filtered).Infof("Worker %d: Skipping %s: keeping the file already there (%s conflict)", id, pd.TargetFilepath, c.kind)
+				fmt.Fprintf(writer.Newline(), "Worker %d: Kept the existing %s\n", id, filepath.Base(expectedFinalPath(pd)))
+				releaseQueued(db, dbKey)
+				downloadRunStats.skip(skippedKept)
+				continue
+			}
+		}
+
+		log.WithFields(log.Fields{control.EventField: "download-started", "key": dbKey}).Infof("Worker %d: Processing job for %s", id, pd.TargetFilepath)
 		fmt.Fprintf(writer.Newline(), "Worker %d: Preparing %s...\n", id, filepath.Base(pd.TargetFilepath))
 
 		// Ensure directory exists
 		dirPath := filepath.Dir(pd.TargetFilepath)
-		if err := os.MkdirAll(dirPath, 0700); err != nil {
+		if err := helpers.MkdirAll(dirPath, 0700); err != nil {
 			log.WithError(err).Errorf("Worker %d: Failed to create directory %s", id, dirPath)
 			// Update DB status to Error using the helper
 			updateErr := updateDbEntry(db, dbKey, models.StatusError, func(entry *models.DatabaseEntry) {
-				entry.ErrorDetails = fmt.Sprintf("Failed to create directory: %v", err)
+				setEntryError(entry, fmt.Errorf("failed to create directory: %w", err))
 			})
 			if updateErr != nil {
 				// Log the error from the helper function
 				log.Errorf("Worker %d: Failed to update DB status after mkdir error: %v", id, updateErr)
 			}
 			fmt.Fprintf(writer.Newline(), "Worker %d: Error creating directory for %s: %v\n", id, filepath.Base(pd.TargetFilepath), err)
+			downloadRunStats.recordDownload(time.Now(), nil, fmt.Errorf("failed to create directory: %w", err))
 			continue // Skip to next job
 		}
 
 		// --- Perform Download ---
+		// Recorded so a run killed mid-download resumes this file first
+		if updateErr := updateDbEntry(db, dbKey, models.StatusDownloading, nil); updateErr != nil {
+			log.Warnf("Worker %d: Failed to mark %s as downloading: %v", id, dbKey, updateErr)
+		}
 		startTime := time.Now()
 		fmt.Fprintf(writer.Newline(), "Worker %d: Checking/Downloading %s...\n", id, filepath.Base(pd.TargetFilepath))
 
 		// Initiate download - it returns the final path and error
-		finalPath, downloadErr := fileDownloader.DownloadFile(pd.TargetFilepath, pd.File.DownloadUrl, pd.File.Hashes, pd.ModelVersionID)
+		downloadService.fileStarted(id, filepath.Base(pd.TargetFilepath))
+		finalPath, receipt, deferred, downloadErr := transferFile(id, pd, fileDownloader, writer, downloadWatch != nil)
+		downloadService.fileFinished(id)
+		if deferred {
+			if updateErr := updateDbEntry(db, dbKey, models.StatusDeferred, nil); updateErr != nil {
+				log.Errorf("Worker %d: Failed to defer %s: %v", id, dbKey, updateErr)
+			}
+			downloadRunStats.skip(skippedDeferred)
+			continue
+		}
+
+		// Files the API labels "Other" are re-filed under the type their header reveals
+		var detected *inferredType
+		var training *models.TrainingMetadata
+		if downloadErr == nil {
+			finalPath, detected = detectOtherType(fmt.Sprintf("Worker %d", id), &pd, finalPath)
+			if receipt != nil {
+				receipt.FinalPath = finalPath
+			}
+			training = readTrainingMetadata(fmt.Sprintf("Worker %d", id), db, dbKey, finalPath)
+		}
 
 		// --- Update DB Based on Result ---
 		finalStatus := models.StatusError // Default to error
-		errMsg := ""
-		if downloadErr != nil {
-			errMsg = downloadErr.Error()
-			finalStatus = models.StatusError
-		} else {
+		if downloadErr == nil {
 			finalStatus = models.StatusDownloaded
 		}
 
+		downloadDigest.recordDownload(pd, dbKey, finalPath, downloadErr)
+		downloadRunStats.recordDownload(startTime, receipt, downloadErr)
+
 		// Use the helper function to update the DB entry
 		updateErr := updateDbEntry(db, dbKey, finalStatus, func(entry *models.DatabaseEntry) {
 			if downloadErr != nil {
 				// Update error details on failure
-				entry.ErrorDetails = errMsg
-				log.WithError(downloadErr).Errorf("Worker %d: Failed to download %s", id, pd.TargetFilepath)
+				setEntryError(entry, downloadErr)
+				log.WithError(downloadErr).WithFields(log.Fields{control.EventField: "download-failed", "key": dbKey, failure.LogField: entry.ErrorCategory}).Errorf("Worker %d: Failed to download %s", id, pd.TargetFilepath)
 				fmt.Fprintf(writer.Newline(), "Worker %d: Error downloading %s: %v\n", id, filepath.Base(pd.TargetFilepath), downloadErr)
-
-				// Attempt to remove partially downloaded file
-				if removeErr := os.Remove(pd.TargetFilepath); removeErr != nil && !os.IsNotExist(removeErr) {
-					log.WithError(removeErr).Warnf("Worker %d: Failed to remove potentially partial file %s after download error", id, pd.TargetFilepath)
-				}
+				// The target is left alone: downloads are staged in <name>.part, so a file
+				// there is the previous good copy, not a partial
 			} else {
 				// Update fields on success
 				duration := time.Since(startTime)
-				log.Infof("Worker %d: Successfully downloaded %s in %v", id, finalPath, duration)
+				log.WithFields(log.Fields{control.EventField: "download-finished", "key": dbKey}).Infof("Worker %d: Successfully downloaded %s in %v", id, finalPath, duration)
 				entry.ErrorDetails = ""                   // Clear any previous error
 				entry.Filename = filepath.Base(finalPath) // Update filename in DB
-				entry.File = pd.File                      // Update File struct
-				entry.Version = pd.CleanedVersion         // Update Version struct
+				entry.Folder = pd.Slug                    // Changes if the type was detected
+				entry.VersionDir = pd.VersionDir
+				if detected != nil {
+					entry.InferredType = detected.Type
+				}
+				recordEmbeddingToken(entry)
+				entry.Training = training
+				if receipt != nil && receipt.ComputedHashes != nil {
+					entry.LocalHashes = receipt.ComputedHashes
+				}
+				entry.File = pd.File              // Update File struct
+				entry.Version = pd.CleanedVersion // Update Version struct
+				entry.NsfwMovedAt = 0
+				noteSeenUpstream(dbKey, entry, globalConfig.SavePath)
+				nsfw := pd.ModelNsfw // Baseline for NSFW drift checks
+				entry.ModelNsfw = &nsfw
+				if pd.ModelTags != nil {
+					entry.ModelTags = pd.ModelTags
+				}
+				if pd.ModelNsfwLevel != 0 {
+					entry.ModelNsfwLevel = pd.ModelNsfwLevel
+				}
+				if entry.PinnedHashes == nil || entry.PinnedFileID != pd.File.ID || acceptHashChange {
+					pinFileHashes(entry, pd.File) // First sighting (or accepted change) becomes the pin
+				}
 				fmt.Fprintf(writer.Newline(), "Worker %d: Success downloading %s\n", id, filepath.Base(finalPath))
 
 				// --- Index Item with Bleve --- START ---
 				if bleveIndex != nil {
-					// Calculate directory paths
-					directoryPath := filepath.Dir(finalPath)
-					baseModelPath := filepath.Dir(directoryPath)
-					modelPath := filepath.Dir(baseModelPath)
-
-					// Parse PublishedAt timestamp
-					publishedAtTime := time.Time{}
-					if pd.FullVersion.PublishedAt != "" {
-						var errParse error
-						publishedAtTime, errParse = time.Parse(time.RFC3339Nano, pd.FullVersion.PublishedAt)
-						if errParse != nil {
-							publishedAtTime, errParse = time.Parse(time.RFC3339, pd.FullVersion.PublishedAt)
-							if errParse != nil {
-								log.WithError(errParse).Warnf("Worker %d: Failed to parse PublishedAt time '%s' for indexing", id, pd.FullVersion.PublishedAt)
-								// Keep publishedAtTime as zero time
-							}
-						}
-					}
-
-					// Get file metadata
-					fileFormat := pd.File.Metadata.Format // Already string
-					filePrecision := pd.File.Metadata.Fp  // Already string
-					fileSizeType := pd.File.Metadata.Size // Already string
-
-					itemToIndex := index.Item{
-						ID:            fmt.Sprintf("v_%d", pd.ModelVersionID), // Use the same key format as DB
-						Type:          "model_file",
-						Name:          pd.File.Name,                  // Use the original file name
-						Description:   pd.CleanedVersion.Description, // Use model version description if available
-						FilePath:      finalPath,
-						DirectoryPath: directoryPath,
-						BaseModelPath: baseModelPath,
-						ModelPath:     modelPath,
-						ModelName:     pd.ModelName,
-						VersionName:   pd.VersionName,
-						BaseModel:     pd.BaseModel,
-						CreatorName:   pd.Creator.Username,
-						Tags:          pd.FullVersion.TrainedWords, // Use TrainedWords as tags for now
-						// New Fields
-						PublishedAt:          publishedAtTime,                             // Parsed time.Time
-						VersionDownloadCount: float64(pd.FullVersion.Stats.DownloadCount), // Convert int to float64
-						VersionRating:        pd.FullVersion.Stats.Rating,                 // float64
-						VersionRatingCount:   float64(pd.FullVersion.Stats.RatingCount),   // Convert int to float64
-						FileSizeKB:           pd.File.SizeKB,                              // float64
-						FileFormat:           fileFormat,                                  // string
-						FilePrecision:        filePrecision,                               // string
-						FileSizeType:         fileSizeType,                                // string
-					}
+					itemToIndex := modelFileIndexItem(pd, finalPath)
 					if indexErr := index.IndexItem(bleveIndex, itemToIndex); indexErr != nil {
 						log.WithError(indexErr).Errorf("Worker %d: Failed to index downloaded item %s (ID: %s)", id, finalPath, itemToIndex.ID)
 						// Don't treat indexing failure as a download failure
@@ -215,11 +391,17 @@ func downloadWorker(id int, jobs <-chan downloadJob, db *database.DB, fileDownlo
 			fmt.Fprintf(writer.Newline(), "Worker %d: DB Error updating status for %s\n", id, pd.FinalBaseFilename)
 		}
 
-		// --- Metadata Saving ---
-		logPrefix := fmt.Sprintf("Worker %d", id)
-		handleMetadataSaving(logPrefix, pd, finalPath, finalStatus, writer)
+		if finalStatus == models.StatusDownloaded {
+			writeDatasetPointers(fmt.Sprintf("Worker %d", id), pd, finalPath)
+			if viper.GetBool("latestlink") && updateErr == nil {
+				if _, err := updateLatestLink(db, globalConfig.SavePath, pd.CleanedVersion.ModelId); err != nil {
+					log.WithError(err).Warnf("Worker %d: Failed to update the latest link of %s", id, pd.ModelName)
+				}
+			}
+		}
 
 		// --- Download Version Images if Enabled and Successful ---
+		// Before the preview, which then reuses the gallery copy of its image
 		saveVersionImages := viper.GetBool("saveversionimages")
 		if saveVersionImages && finalStatus == models.StatusDownloaded {
 			logPrefix := fmt.Sprintf("Worker %d Img", id)
@@ -235,6 +417,27 @@ func downloadWorker(id int, jobs <-chan downloadJob, db *database.DB, fileDownlo
 				logPrefix, pd.ModelName, pd.VersionName, imgSuccess, imgFail)
 		}
 		// --- End Download Version Images ---
+
+		// Training data attachments go to a tree of their own (IncludeTrainingData)
+		if finalStatus == models.StatusDownloaded {
+			downloadTrainingData.fetch(fmt.Sprintf("Worker %d", id), pd, fileDownloader)
+		}
+
+		// --- Metadata Saving ---
+		logPrefix := fmt.Sprintf("Worker %d", id)
+		sidecarExtras := receiptField(receipt)
+		if detected != nil {
+			sidecarExtras = append(sidecarExtras, sidecarField{Key: sidecarInferredTypeKey, Value: detected})
+		}
+		if training != nil {
+			sidecarExtras = append(sidecarExtras, sidecarField{Key: sidecarTrainingKey, Value: training})
+		}
+		if finalStatus == models.StatusDownloaded && viper.GetBool("savepreview") {
+			if choice := savePreviewImage(logPrefix, pd, finalPath, imageDownloader); choice != nil {
+				sidecarExtras = append(sidecarExtras, sidecarField{Key: sidecarPreviewKey, Value: choice})
+			}
+		}
+		handleMetadataSaving(logPrefix, pd, finalPath, finalStatus, sidecarExtras, writer)
 	}
 	log.Debugf("Worker %d finished", id)
 	fmt.Fprintf(writer.Newline(), "Worker %d: Finished job processing.\n", id) // Final update for the worker
@@ -242,25 +445,27 @@ func downloadWorker(id int, jobs <-chan downloadJob, db *database.DB, fileDownlo
 
 // saveMetadataFile saves the cleaned model version metadata to a .json file.
 // It derives the metadata filename from the provided modelFilePath.
-func saveMetadataFile(pd potentialDownload, modelFilePath string) error {
+// extras are appended to the sidecar as additional top-level fields.
+func saveMetadataFile(pd potentialDownload, modelFilePath string, extras ...sidecarField) error {
 	// Calculate metadata path based on the model file path
 	metadataPath := strings.TrimSuffix(modelFilePath, filepath.Ext(modelFilePath)) + ".json"
 	// Ensure the target directory exists
 	dirPath := filepath.Dir(metadataPath)
-	if err := os.MkdirAll(dirPath, 0700); err != nil {
+	if err := helpers.MkdirAll(dirPath, 0700); err != nil {
 		log.WithError(err).Errorf("Failed to create directory for metadata file: %s", dirPath)
 		return fmt.Errorf("failed to create directory %s: %w", dirPath, err)
 	}
 
-	// Marshal the full version info
-	jsonData, jsonErr := json.MarshalIndent(pd.FullVersion, "", "  ")
+	// Marshal the full version info (raw API JSON if we have it, so new/unknown fields survive)
+	extras = append([]sidecarField{{Key: sidecarAIRKey, Value: downloadAIR(pd)}}, extras...)
+	jsonData, jsonErr := marshalSidecar(pd.FullVersion, pd.RawVersion, extras...)
 	if jsonErr != nil {
 		log.WithError(jsonErr).Warnf("Failed to marshal metadata for %s", modelFilePath)
 		return fmt.Errorf("failed to marshal metadata for %s: %w", pd.ModelName, jsonErr)
 	}
 
 	// Write the file
-	if writeErr := os.WriteFile(metadataPath, jsonData, 0600); writeErr != nil {
+	if writeErr := helpers.WriteFile(metadataPath, jsonData, 0600); writeErr != nil {
 		log.WithError(writeErr).Warnf("Failed to write metadata file %s", metadataPath)
 		return fmt.Errorf("failed to write metadata file %s: %w", metadataPath, writeErr)
 	}
@@ -268,3 +473,86 @@ func saveMetadataFile(pd potentialDownload, modelFilePath string) error {
 	log.Debugf("Saved metadata to %s", metadataPath)
 	return nil
 }
+
+// Top-level sidecar fields added alongside the API JSON.
+const (
+	sidecarReceiptKey = "downloadReceipt"
+	sidecarPreviewKey = "previewSelection"
+)
+
+// sidecarField is an extra top-level field appended to a metadata sidecar.
+type sidecarField struct {
+	Key   string
+	Value interface{}
+}
+
+// receiptField returns the sidecar field for a download receipt, or nil if there is none.
+func receiptField(receipt *downloader.Receipt) []sidecarField {
+	if receipt == nil {
+		return nil
+	}
+	return []sidecarField{{Key: sidecarReceiptKey, Value: receipt}}
+}
+
+// marshalSidecar returns indented JSON for a metadata sidecar. The raw API JSON is
+// preferred so fields our structs don't model yet are preserved; v is the fallback.
+// extras are appended as additional top-level fields, in order.
+func marshalSidecar(v interface{}, raw json.RawMessage, extras ...sidecarField) ([]byte, error) {
+	var base []byte
+	if len(raw) > 0 && json.Valid(raw) {
+		base = raw
+	} else {
+		if len(raw) > 0 {
+			log.Debug("Raw API JSON is not valid, falling back to struct marshalling.")
+		}
+		var err error
+		if base, err = json.Marshal(v); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, extra := range extras {
+		withExtra, err := appendJSONField(base, extra.Key, extra.Value)
+		if err != nil {
+			log.WithError(err).Warnf("Could not add %s to sidecar", extra.Key)
+			continue
+		}
+		base = withExtra
+	}
+
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, base, "", "  "); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// appendJSONField adds key: value to the end of a JSON object without disturbing the
+// order of its existing fields.
+func appendJSONField(object []byte, key string, value interface{}) ([]byte, error) {
+	trimmed := bytes.TrimSpace(object)
+	if len(trimmed) < 2 || trimmed[0] != '{' || trimmed[len(trimmed)-1] != '}' {
+		return nil, fmt.Errorf("sidecar JSON is not an object")
+	}
+	keyJSON, err := json.Marshal(key)
+	if err != nil {
+		return nil, err
+	}
+	valueJSON, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	body := bytes.TrimSpace(trimmed[1 : len(trimmed)-1])
+	var out bytes.Buffer
+	out.WriteByte('{')
+	out.Write(body)
+	if len(body) > 0 {
+		out.WriteByte(',')
+	}
+	out.Write(keyJSON)
+	out.WriteByte(':')
+	out.Write(valueJSON)
+	out.WriteByte('}')
+	return out.Bytes(), nil
+}
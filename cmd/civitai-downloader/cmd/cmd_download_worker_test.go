@@ -0,0 +1,105 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/downloader"
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+
+	"github.com/gosuri/uilive"
+)
+
+func TestTransferFilePausesWhenTheWindowCloses(t *testing.T) {
+	// A partial file is kept once it holds a verified checkpoint, so the first request
+	// serves a little more than one and then stalls until the transfer is cancelled
+	content := bytes.Repeat([]byte("0123456789abcdef"), int(downloader.CheckpointInterval+1<<20)/16)
+	sum := sha256.Sum256(content)
+	var mu sync.Mutex
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		mu.Unlock()
+		w.Header().Set("ETag", `"model"`)
+		if r.Header.Get("Range") != "" {
+			http.ServeContent(w, r, "model.safetensors", time.Time{}, bytes.NewReader(content))
+			return
+		}
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.Write(content[:downloader.CheckpointInterval+512<<10])
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	window, err := helpers.ParseTimeWindow("06:00-07:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedWindow, savedClock := downloadWindow, windowClock
+	defer func() { downloadWindow, windowClock = savedWindow, savedClock }()
+	downloadWindow = &downloadSchedule{windows: []helpers.TimeWindow{window}, location: time.UTC}
+	// The window closes two seconds into the transfer
+	clockStart := time.Date(2026, time.January, 5, 6, 59, 58, 0, time.UTC)
+	started := time.Now()
+	windowClock = func() time.Time { return clockStart.Add(time.Since(started)) }
+
+	tempDir := t.TempDir()
+	fileDownloader := downloader.NewDownloader(nil, "")
+	fileDownloader.SetTempDir(tempDir)
+	pd := potentialDownload{
+		ModelType:      "LORA",
+		ModelVersionID: 1,
+		TargetFilepath: filepath.Join(t.TempDir(), "model.safetensors"),
+		File: models.File{
+			DownloadUrl: server.URL + "/model",
+			Hashes:      models.Hashes{SHA256: hex.EncodeToString(sum[:])},
+		},
+	}
+	writer := uilive.New()
+	writer.Out = io.Discard
+
+	_, _, deferred, err := transferFile(1, pd, fileDownloader, writer, true)
+	if !deferred || err == nil {
+		t.Fatalf("transfer at window close: deferred = %v, err = %v; want it deferred with the cancellation", deferred, err)
+	}
+	if _, err := os.Stat(pd.TargetFilepath); !os.IsNotExist(err) {
+		t.Errorf("target exists after the window closed (stat error %v)", err)
+	}
+	parts, _ := filepath.Glob(filepath.Join(tempDir, "*.part"))
+	if len(parts) != 1 {
+		t.Fatalf("partial files in TempDir = %v, want one", parts)
+	}
+	if info, err := os.Stat(parts[0]); err != nil || info.Size() == 0 || info.Size() >= int64(len(content)) {
+		t.Fatalf("partial file %s: %v, want part of the file", parts[0], err)
+	}
+
+	// A later cycle inside the window continues the partial file
+	windowClock = func() time.Time { return clockStart.Add(-30 * time.Minute) }
+	finalPath, _, deferred, err := transferFile(1, pd, fileDownloader, writer, true)
+	if deferred || err != nil {
+		t.Fatalf("transfer inside the window: deferred = %v, err = %v", deferred, err)
+	}
+	if data, err := os.ReadFile(finalPath); err != nil || !bytes.Equal(data, content) {
+		t.Fatalf("downloaded file %s: %v, want the served content", finalPath, err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if last := ranges[len(ranges)-1]; !strings.HasPrefix(last, "bytes=") || last == "bytes=0-" {
+		t.Errorf("Range of the last request = %q, want it to continue the partial file", last)
+	}
+}
@@ -7,7 +7,6 @@ import (
 	"io"
 	"net/http"
 	"net/url"
-	"os"
 	"path/filepath"
 	"strconv"
 	"sync"
@@ -19,9 +18,11 @@ import (
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
-	index "go-civitai-download/index"
-	"go-civitai-download/internal/downloader"
-	"go-civitai-download/internal/models"
+	index "github.com/dreamfast/go-civitai-downloader/index"
+	"github.com/dreamfast/go-civitai-downloader/internal/api"
+	"github.com/dreamfast/go-civitai-downloader/internal/downloader"
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
 )
 
 // runImages orchestrates the fetching and downloading of images based on command-line flags.
@@ -74,6 +75,7 @@ func runImages(cmd *cobra.Command, args []string) {
 	log.Info("Fetching image list from Civitai API...")
 
 	var allImages []models.ImageApiItem
+	rawImages := make(map[int]json.RawMessage) // Raw JSON per image ID (keeps fields our structs don't know)
 	baseURL := "https://civitai.com/api/v1/images"
 	params := url.Values{}
 
@@ -174,7 +176,7 @@ func runImages(cmd *cobra.Command, args []string) {
 		}
 
 		var response models.ImageApiResponse
-		if err := json.Unmarshal(bodyBytes, &response); err != nil {
+		if err := api.Decode(bodyBytes, &response, "images"); err != nil {
 			loopErr = fmt.Errorf("failed to decode image API response (Page %d): %w", pageCount, err)
 			log.WithError(err).Errorf("Response body sample: %s", string(bodyBytes[:min(len(bodyBytes), 200)]))
 			break
@@ -187,6 +189,9 @@ func runImages(cmd *cobra.Command, args []string) {
 
 		log.Infof("Received %d images from API page %d. Adding to list...", len(response.Items), pageCount)
 		allImages = append(allImages, response.Items...)
+		for id, raw := range api.RawObjects(rawForSidecar(bodyBytes), "items") {
+			rawImages[id] = raw
+		}
 
 		nextCursor = response.Metadata.NextCursor
 		if nextCursor == "" {
@@ -249,11 +254,13 @@ func runImages(cmd *cobra.Command, args []string) {
 		Timeout:   0,
 	}
 	dl := downloader.NewDownloader(downloadClient, globalConfig.ApiKey)
+	dl.SetTempDir(downloadTempDir())
+	dl.SetStallTimeout(time.Duration(viper.GetInt("stalltimeoutsec")) * time.Second)
 
 	// --- Target Directory ---
 	finalBaseTargetDir := targetDir
 	log.Infof("Ensuring base target directory exists: %s", finalBaseTargetDir)
-	if err := os.MkdirAll(finalBaseTargetDir, 0755); err != nil {
+	if err := helpers.MkdirAll(finalBaseTargetDir, 0755); err != nil {
 		log.WithError(err).Fatalf("Failed to create base target directory: %s", finalBaseTargetDir)
 	}
 
@@ -285,6 +292,7 @@ func runImages(cmd *cobra.Command, args []string) {
 			SourceURL: image.URL,
 			ImageID:   image.ID,
 			Metadata:  image,
+			RawJSON:   rawImages[image.ID],
 		}
 		jobs <- job
 		queuedCount++
@@ -11,10 +11,10 @@ import (
 	"sync/atomic"
 	"time"
 
-	index "go-civitai-download/index"
-	"go-civitai-download/internal/downloader"
-	"go-civitai-download/internal/helpers"
-	"go-civitai-download/internal/models"
+	index "github.com/dreamfast/go-civitai-downloader/index"
+	"github.com/dreamfast/go-civitai-downloader/internal/downloader"
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
 
 	"github.com/blevesearch/bleve/v2"
 	"github.com/gosuri/uilive"
@@ -26,18 +26,19 @@ type imageJob struct {
 	SourceURL string
 	ImageID   int
 	Metadata  models.ImageApiItem
+	RawJSON   json.RawMessage // Raw API item, preferred for the metadata sidecar when available
 }
 
 // --- Helper to save metadata --- START ---
-func saveMetadataJSON(id int, job imageJob, targetPath string, writer *uilive.Writer) {
+func saveMetadataJSON(id int, job imageJob, targetPath string, receipt *downloader.Receipt, writer *uilive.Writer) {
 	baseFilename := filepath.Base(targetPath)
 	metadataPath := strings.TrimSuffix(targetPath, filepath.Ext(targetPath)) + ".json"
-	jsonData, jsonErr := json.MarshalIndent(job.Metadata, "", "  ")
+	jsonData, jsonErr := marshalSidecar(job.Metadata, job.RawJSON, receiptField(receipt)...)
 	if jsonErr != nil {
 		log.WithError(jsonErr).Warnf("Worker %d: Failed to marshal image metadata for %s", id, baseFilename)
 		fmt.Fprintf(writer.Newline(), "Worker %d: Error marshalling metadata for %s\n", id, baseFilename)
 	} else {
-		if writeErr := os.WriteFile(metadataPath, jsonData, 0644); writeErr != nil {
+		if writeErr := helpers.WriteFile(metadataPath, jsonData, 0644); writeErr != nil {
 			log.WithError(writeErr).Warnf("Worker %d: Failed to write image metadata file %s", id, metadataPath)
 			fmt.Fprintf(writer.Newline(), "Worker %d: Error writing metadata file for %s\n", id, baseFilename)
 		} else {
@@ -93,7 +94,7 @@ func imageDownloadWorker(id int, jobs <-chan imageJob, downloader *downloader.Do
 		}
 
 		// Ensure the target subdirectory exists
-		if err := os.MkdirAll(targetSubDir, 0755); err != nil {
+		if err := helpers.MkdirAll(targetSubDir, 0755); err != nil {
 			log.WithError(err).Errorf("Worker %d: Failed to create target directory %s for image %d, skipping download.", id, targetSubDir, job.ImageID)
 			fmt.Fprintf(writer.Newline(), "Worker %d: Error creating dir for %s, skipping\n", id, filename)
 			atomic.AddInt64(failureCounter, 1) // Count as failure
@@ -114,7 +115,7 @@ func imageDownloadWorker(id int, jobs <-chan imageJob, downloader *downloader.Do
 				metadataPath := strings.TrimSuffix(targetPath, filepath.Ext(targetPath)) + ".json"
 				if _, metaErr := os.Stat(metadataPath); os.IsNotExist(metaErr) {
 					log.Infof("Worker %d: Image exists, but metadata %s is missing. Saving metadata.", id, filepath.Base(metadataPath))
-					saveMetadataJSON(id, job, targetPath, writer) // Call helper to save
+					saveMetadataJSON(id, job, targetPath, nil, writer) // Call helper to save
 				} else if metaErr == nil {
 					log.Debugf("Worker %d: Metadata file %s also exists.", id, filepath.Base(metadataPath))
 				} else {
@@ -132,7 +133,7 @@ func imageDownloadWorker(id int, jobs <-chan imageJob, downloader *downloader.Do
 		startTime := time.Now()
 
 		// Use DownloadFile with the constructed targetPath
-		_, dlErr := downloader.DownloadFile(targetPath, job.SourceURL, models.Hashes{}, 0)
+		_, receipt, dlErr := downloader.DownloadFileWithReceipt(targetPath, job.SourceURL, models.Hashes{}, 0)
 
 		if dlErr != nil {
 			log.WithError(dlErr).Errorf("Worker %d: Failed to download image %s from %s", id, targetPath, job.SourceURL)
@@ -151,7 +152,7 @@ func imageDownloadWorker(id int, jobs <-chan imageJob, downloader *downloader.Do
 
 			// --- Save Metadata if Enabled (after successful download) ---
 			if saveMeta {
-				saveMetadataJSON(id, job, targetPath, writer) // Call helper to save
+				saveMetadataJSON(id, job, targetPath, receipt, writer) // Call helper to save
 			}
 			// --- End Save Metadata ---
 
@@ -45,6 +45,7 @@ func init() {
 	// Share the searchQuery variable with the models command
 	searchImagesCmd.Flags().StringVarP(&searchQuery, "query", "q", "", "Search query (uses Bleve query string syntax)")
 	searchImagesCmd.MarkFlagRequired("query")
+	searchImagesCmd.Flags().String("sort", "score", "Order of the hits: score, id, or a field such as modelName")
 }
 
 // runSearchImages determines the image index path and calls the shared search logic.
@@ -66,5 +67,6 @@ func runSearchImages(cmd *cobra.Command, args []string) {
 	}
 
 	// Call the shared search logic
-	runSearchLogic(indexPath, searchQuery)
+	order, _ := cmd.Flags().GetString("sort")
+	runSearchLogic(indexPath, searchQuery, thumbnailProtocol(cmd), order)
 }
@@ -57,6 +57,7 @@ func init() {
 	// Use Flags for flags specific to this command
 	searchModelsCmd.Flags().StringVarP(&searchQuery, "query", "q", "", "Search query (uses Bleve query string syntax)")
 	searchModelsCmd.MarkFlagRequired("query")
+	searchModelsCmd.Flags().String("sort", "score", "Order of the hits: score, id, or a field such as modelName or -publishedAt")
 }
 
 // runSearchModels determines the model index path and calls the shared search logic.
@@ -75,5 +76,6 @@ func runSearchModels(cmd *cobra.Command, args []string) {
 	}
 
 	// Call the shared search logic
-	runSearchLogic(indexPath, searchQuery)
+	order, _ := cmd.Flags().GetString("sort")
+	runSearchLogic(indexPath, searchQuery, thumbnailProtocol(cmd), order)
 }
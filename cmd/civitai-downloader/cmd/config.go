@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/config"
+)
+
+// configCmd is the parent for configuration helpers
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Work with configuration files and profiles",
+}
+
+// configCaptureCmd freezes the effective configuration into a TOML profile
+var configCaptureCmd = &cobra.Command{
+	Use:   "capture <profile.toml> [-- <command> [flags...]]",
+	Short: "Write the effective configuration (flags + env + file) to a new TOML profile",
+	Long: `Resolves the effective configuration the same way a command would (flags override
+environment variables, which override the config file, which overrides defaults) and writes
+it to a new TOML profile that can later be used with --config.
+
+To freeze a command line, pass it after "--": its flags are parsed exactly as that command
+would parse them, but the command itself is not run.
+
+The API key is left out unless --include-api-key is given.`,
+	Example: `  civitai-downloader config capture sdxl-loras.toml -- download -t LORA -b "SDXL 1.0" --primary-only --metadata
+  civitai-downloader --config sdxl-loras.toml download`,
+	Args: cobra.MinimumNArgs(1),
+	Run:  runConfigCapture,
+}
+
+func init() {
+	rootCmd.AddCommand(configCmd)
+	configCmd.AddCommand(configCaptureCmd)
+
+	configCaptureCmd.Flags().Bool("force", false, "Overwrite the profile if it already exists")
+	configCaptureCmd.Flags().Bool("include-api-key", false, "Include the API key in the profile")
+}
+
+func runConfigCapture(cmd *cobra.Command, args []string) {
+	force, _ := cmd.Flags().GetBool("force")
+	includeApiKey, _ := cmd.Flags().GetBool("include-api-key")
+	profilePath := args[0]
+	captured := args[1:]
+
+	// Parse the captured command line so its viper-bound flags take effect
+	source := "current configuration"
+	if len(captured) > 0 {
+		target, targetArgs, err := rootCmd.Find(captured)
+		if err != nil || target == rootCmd {
+			log.Fatalf("Unknown command in captured command line: %s", strings.Join(captured, " "))
+		}
+		if err := target.ParseFlags(targetArgs); err != nil {
+			log.Fatalf("Invalid flags for '%s': %v", target.CommandPath(), err)
+		}
+		source = strings.Join(captured, " ")
+	}
+
+	cfg := config.Capture(viper.GetViper(), includeApiKey)
+
+	header := fmt.Sprintf("Captured by 'civitai-downloader config capture' on %s\nSource: %s", time.Now().Format(time.RFC3339), source)
+	if used := viper.ConfigFileUsed(); used != "" {
+		header += "\nBase config file: " + used
+	}
+	if err := config.WriteProfile(profilePath, cfg, header, force); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Wrote profile %s\n", profilePath)
+	if !includeApiKey {
+		fmt.Println("The API key was not included; set it with --include-api-key, the ApiKey field or --api-key.")
+	}
+}
@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/config"
+	"github.com/dreamfast/go-civitai-downloader/internal/control"
+)
+
+// ctlSocketFlag holds the value of the --socket flag for ctl
+var ctlSocketFlag string
+
+// ctlCmd sends commands to a running download via its control socket
+var ctlCmd = &cobra.Command{
+	Use:   "ctl <command> [args...]",
+	Short: "Send a control command to a running download",
+	Long: `Sends a command to a running 'download' process over its local control socket.
+
+Available commands:
+  filter show                          Show live filters
+  filter clear                         Remove all live filters
+  filter max-size <size>|off           Skip not-yet-started files larger than <size> (e.g. 4GB)
+  filter exclude-type <type>           Skip not-yet-started files of a model type (e.g. Checkpoint)
+  filter exclude-base-model <base>     Skip not-yet-started files whose base model contains <base>
+  filter exclude-name <substring>      Skip not-yet-started files whose file/model name contains <substring>
+  pause                                Pause the downloads: transfers in flight stop and keep their partial files
+  resume                               Resume paused downloads where they stopped
+  paused                               Show whether the downloads are paused
+  tail                                 Stream the process's logs and events (see 'ctl tail --help')
+
+Every command is recorded in the control audit log (ctl_audit.log) next to the socket.`,
+	Example: `  civitai-downloader ctl filter max-size 4GB
+  civitai-downloader ctl pause
+  civitai-downloader --workspace sdxl ctl filter exclude-type Checkpoint`,
+	Args: cobra.MinimumNArgs(1),
+	Run:  runCtl,
+}
+
+func init() {
+	rootCmd.AddCommand(ctlCmd)
+	ctlCmd.PersistentFlags().StringVar(&ctlSocketFlag, "socket", "", "Path to the control socket (default: derived from workspace/SavePath)")
+}
+
+// controlEvents keeps the recent log entries of the process for 'ctl tail'.
+var (
+	controlEvents     = control.NewHub(500)
+	controlEventsOnce sync.Once
+)
+
+// watchControlServer is the control interface of the running watch loop, kept up between
+// cycles; nil otherwise (each download phase then starts its own).
+var watchControlServer *control.Server
+
+// controlSocketPath returns the control socket location for the current workspace/SavePath.
+func controlSocketPath() string {
+	if workspaceDir != "" {
+		return filepath.Join(workspaceDir, "ctl.sock")
+	}
+	if savePath := viper.GetString("savepath"); savePath != "" {
+		return filepath.Join(savePath, ".civitai-downloader.sock")
+	}
+	return ".civitai-downloader.sock"
+}
+
+// controlAuditPath returns where control commands are audited.
+func controlAuditPath() string {
+	if workspaceDir != "" {
+		return filepath.Join(workspaceDir, config.WorkspaceLogsDir, "ctl_audit.log")
+	}
+	if savePath := viper.GetString("savepath"); savePath != "" {
+		return filepath.Join(savePath, "ctl_audit.log")
+	}
+	return "ctl_audit.log"
+}
+
+// startControlServer starts the control interface for a running batch and registers
+// the handlers. Failure to start is logged but never fatal: the batch runs without it.
+func startControlServer() *control.Server {
+	socketPath := controlSocketPath()
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0700); err != nil {
+		log.WithError(err).Warn("Failed to create control socket directory; control interface disabled.")
+		return nil
+	}
+	controlEventsOnce.Do(func() { log.AddHook(controlEvents) })
+	server := control.NewServer(socketPath, controlAuditPath())
+	server.Handle("filter", liveFilters.handleCommand)
+	for _, command := range []string{"pause", "resume", "paused"} {
+		server.Handle(command, downloadPause.handleCommand(command))
+	}
+	server.HandleStream("tail", streamControlEvents)
+	if err := server.Start(); err != nil {
+		log.WithError(err).Warn("Control interface disabled.")
+		return nil
+	}
+	return server
+}
+
+// ctlSocket returns the --socket path, or the one of the current workspace/SavePath.
+func ctlSocket() string {
+	if ctlSocketFlag != "" {
+		return ctlSocketFlag
+	}
+	return controlSocketPath()
+}
+
+func runCtl(cmd *cobra.Command, args []string) {
+	resp, err := control.Send(ctlSocket(), args[0], args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !resp.OK {
+		log.Fatalf("Command failed: %s", resp.Error)
+	}
+	fmt.Println(resp.Message)
+}
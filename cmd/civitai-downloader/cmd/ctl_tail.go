@@ -0,0 +1,150 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/control"
+	"github.com/dreamfast/go-civitai-downloader/internal/failure"
+)
+
+// ctlTailCmd streams the logs and events of a running download
+var ctlTailCmd = &cobra.Command{
+	Use:   "tail",
+	Short: "Stream the logs and events of a running download",
+	Long: `Connects to the control socket of a running download (or watch loop) and prints its
+log entries as they happen, starting with the last --lines of them. Events are the
+entries that mark progress: cycle-started, cycle-finished, download-started,
+download-finished, download-failed, nsfw-drift, removed-upstream, and job-started,
+job-finished and job-failed for the maintenance jobs (WatchJobs).
+
+Only entries at the log level the process runs with are available (--log-level on the
+download); --level filters further. --category keeps the entries logged with one of the
+error categories (network, rate-limit, auth, not-found, disk, verification, filtered,
+unknown). The stream ends when the process stops its control interface.`,
+	Example: `  civitai-downloader ctl tail --events
+  civitai-downloader ctl tail --logs --level warn --category disk,network
+  civitai-downloader --workspace sdxl ctl tail --json | jq .`,
+	Args: cobra.NoArgs,
+	Run:  runCtlTail,
+}
+
+func init() {
+	ctlCmd.AddCommand(ctlTailCmd)
+	ctlTailCmd.Flags().Bool("events", false, "Only show events")
+	ctlTailCmd.Flags().Bool("logs", false, "Only show log entries that aren't events")
+	ctlTailCmd.Flags().String("level", "info", "Least severe level to show: trace, debug, info, warn, error")
+	ctlTailCmd.Flags().StringSlice("category", nil, "Only show entries with one of these error categories")
+	ctlTailCmd.Flags().IntP("lines", "n", 20, "Recent entries to show first (0 for none)")
+	ctlTailCmd.Flags().Bool("json", false, "Print each entry as a JSON object")
+}
+
+// streamControlEvents is the "tail" stream of the control interface: the last args[0]
+// (default 20) log entries, then every new one.
+func streamControlEvents(args []string, send func(v interface{}) error, done <-chan struct{}) error {
+	lines := 20
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid line count %q", args[0])
+		}
+		lines = n
+	}
+	recent, events, cancel := controlEvents.Subscribe(lines)
+	defer cancel()
+	for _, event := range recent {
+		if err := send(event); err != nil {
+			return err
+		}
+	}
+	for {
+		select {
+		case <-done:
+			return nil
+		case event := <-events:
+			if err := send(event); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func runCtlTail(cmd *cobra.Command, args []string) {
+	onlyEvents, _ := cmd.Flags().GetBool("events")
+	onlyLogs, _ := cmd.Flags().GetBool("logs")
+	levelName, _ := cmd.Flags().GetString("level")
+	categories, _ := cmd.Flags().GetStringSlice("category")
+	lines, _ := cmd.Flags().GetInt("lines")
+	asJSON, _ := cmd.Flags().GetBool("json")
+
+	if onlyEvents && onlyLogs {
+		log.Fatal("Give at most one of --events and --logs.")
+	}
+	minLevel, err := log.ParseLevel(levelName)
+	if err != nil {
+		log.Fatalf("Invalid --level: %v", err)
+	}
+	wanted := make(map[string]bool, len(categories))
+	for _, c := range categories {
+		wanted[strings.ToLower(strings.TrimSpace(c))] = true
+	}
+	if lines < 0 {
+		lines = 0
+	}
+
+	err = control.Stream(ctlSocket(), "tail", []string{strconv.Itoa(lines)}, func(raw json.RawMessage) error {
+		var event control.Event
+		if err := json.Unmarshal(raw, &event); err != nil {
+			return fmt.Errorf("invalid entry from the control socket: %w", err)
+		}
+		if level, err := log.ParseLevel(event.Level); err == nil && level > minLevel {
+			return nil
+		}
+		if (onlyEvents && event.Event == "") || (onlyLogs && event.Event != "") {
+			return nil
+		}
+		if len(wanted) > 0 && !wanted[fmt.Sprint(event.Fields[failure.LogField])] {
+			return nil
+		}
+		if asJSON {
+			_, err := fmt.Fprintln(os.Stdout, string(raw))
+			return err
+		}
+		_, err := fmt.Fprintln(os.Stdout, formatTailEvent(event))
+		return err
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Fprintln(os.Stderr, "The control interface closed.")
+}
+
+// formatTailEvent renders an entry as one line: time, level, event, message and fields.
+func formatTailEvent(event control.Event) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %-5.5s ", event.Time.Local().Format("2006-01-02 15:04:05"), strings.ToUpper(event.Level))
+	if event.Event != "" {
+		fmt.Fprintf(&b, "[%s] ", event.Event)
+	}
+	b.WriteString(event.Message)
+	keys := make([]string, 0, len(event.Fields))
+	for k := range event.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		value := fmt.Sprint(event.Fields[k])
+		if strings.ContainsAny(value, " \t\"") {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(&b, " %s=%s", k, value)
+	}
+	return b.String()
+}
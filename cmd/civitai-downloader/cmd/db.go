@@ -8,14 +8,16 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"text/tabwriter"
 	"time"
 
-	"go-civitai-download/internal/database"
-	"go-civitai-download/internal/downloader"
-	"go-civitai-download/internal/helpers"
-	"go-civitai-download/internal/models"
+	"github.com/dreamfast/go-civitai-downloader/internal/database"
+	"github.com/dreamfast/go-civitai-downloader/internal/downloader"
+	"github.com/dreamfast/go-civitai-downloader/internal/failure"
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -43,7 +45,12 @@ var dbVerifyCmd = &cobra.Command{
 	Use:   "verify",
 	Short: "Verify database entries against the filesystem and optionally prompt for redownload",
 	Long: `Checks if the files listed in the database exist at their expected locations,
-optionally verifies their hashes, and prompts to redownload missing or mismatched files.`,
+optionally verifies their hashes, and prompts to redownload missing or mismatched files.
+
+--sample checks a random sample weighted toward the least recently verified files, and
+--max-duration stops after a time limit, for a quick health check between full passes.`,
+	Example: `  civitai-downloader db verify --sample 5%
+  civitai-downloader db verify --max-duration 30m --yes`,
 	Run: runDbVerify,
 }
 
@@ -60,10 +67,34 @@ in the database entry identified by the provided Model Version ID (used as the d
 // dbSearchCmd represents the command to search database entries by model name
 var dbSearchCmd = &cobra.Command{
 	Use:   "search [MODEL_NAME_QUERY]",
-	Short: "Search database entries by model name",
+	Short: "Search database entries by model name, trigger word or embedding token",
 	Long: `Searches database entries for models whose names contain the provided query text (case-insensitive).
-Prints matching entries.`,
-	Args: cobra.ExactArgs(1), // Requires exactly one argument
+Prints matching entries.
+
+--trigger matches the trained (trigger) words recorded for each version, and --token matches
+the activation token of embeddings (the embedding's file name, which is what UIs like
+A1111/ComfyUI use to invoke it). Both print the local file that teaches the word.
+
+--network-dim and --training-tag match the training metadata embedded in downloaded
+safetensors files (network rank and the tags of the training captions), and --duplicates
+lists files whose embedded tensor hash or training session is shared with another entry,
+i.e. re-uploads of the same weights.
+
+--creator, --type, --base-model, --hash, --trigger, --token and --duplicates are answered
+from the database's secondary indexes, so only the matching entries are read.
+Filters can be combined; at least a query or one of the flags is required.
+
+--thumbnails shows the matches as a grid of their preview images in terminals that
+support the kitty or sixel image protocol (the <model>.preview.png, or else the first
+saved version image), and as the usual table elsewhere.`,
+	Example: `  civitai-downloader db search "pony"
+  civitai-downloader db search --trigger "pixel art"
+  civitai-downloader db search --token easynegative
+  civitai-downloader db search --network-dim 32 --training-tag 1girl
+  civitai-downloader db search --duplicates
+  civitai-downloader db search --creator someone --type LORA --base-model "SDXL 1.0"
+  civitai-downloader db search --type LORA --base-model "SDXL 1.0" --thumbnails`,
+	Args: cobra.MaximumNArgs(1),
 	Run:  runDbSearch,
 }
 
@@ -76,16 +107,37 @@ func init() {
 
 	// Add flags specific to db view if needed (e.g., filtering)
 	// dbViewCmd.Flags().StringP("filter", "f", "", "Filter results (e.g., by model name)")
+	dbViewCmd.Flags().String("sort", "id", "Order of the entries: "+strings.Join(entrySortOrders, ", "))
 
 	// Add flags specific to db verify
 	dbVerifyCmd.Flags().Bool("check-hash", true, "Perform hash check for existing files")
 	dbVerifyCmd.Flags().BoolP("yes", "y", false, "Automatically attempt to redownload missing/mismatched files without prompting")
+	dbVerifyCmd.Flags().Bool("accept-hash-change", false, "Allow redownloads of files whose hashes changed since they were first recorded")
+	dbVerifyCmd.Flags().String("sample", "", "Only check a random sample of the files, as a percentage (\"5%\") or a count (\"200\"), weighted toward the least recently verified")
+	dbVerifyCmd.Flags().Duration("max-duration", 0, "Stop checking files after this long (e.g. 30m); the least recently verified are checked first")
+
+	dbSearchCmd.Flags().String("trigger", "", "Match versions whose trained/trigger words include this word or phrase (case-insensitive)")
+	dbSearchCmd.Flags().String("token", "", "Match embeddings (TextualInversion) whose activation token is this word (case-insensitive)")
+	dbSearchCmd.Flags().Int("network-dim", 0, "Match files whose embedded training metadata has this network dim (rank)")
+	dbSearchCmd.Flags().String("training-tag", "", "Match files whose embedded training tags include this tag (case-insensitive)")
+	dbSearchCmd.Flags().String("creator", "", "Match versions uploaded by this creator (case-insensitive)")
+	dbSearchCmd.Flags().String("type", "", "Match this model type, as reported by the API or detected (e.g. LORA, Checkpoint)")
+	dbSearchCmd.Flags().String("base-model", "", "Match this base model (e.g. \"SDXL 1.0\")")
+	dbSearchCmd.Flags().String("hash", "", "Match files with this AutoV2, SHA256, CRC32 or BLAKE3 hash, or one of their HashAlgorithms (case-insensitive)")
+	dbSearchCmd.Flags().Bool("duplicates", false, "Match files trained in the same run as another entry (same embedded tensor hash or session ID)")
+	dbSearchCmd.Flags().String("sort", "id", "Order of the matches: "+strings.Join(entrySortOrders, ", ")+" (--duplicates lists groups together unless given)")
+	addThumbnailsFlag(dbSearchCmd.Flags())
 
 	// Add flags specific to db redownload if needed (e.g., force overwrite without hash check?)
 	// dbRedownloadCmd.Flags().Bool("force", false, "Force redownload even if file exists and hash matches")
+	dbRedownloadCmd.Flags().Bool("accept-hash-change", false, "Allow the redownload even if the file's hashes changed since they were first recorded")
 }
 
 func runDbView(cmd *cobra.Command, args []string) {
+	order, _ := cmd.Flags().GetString("sort")
+	if err := sortListedEntries(nil, order); err != nil {
+		log.Fatal(err)
+	}
 	log.Info("Viewing database entries...")
 
 	// Use globalConfig loaded by PersistentPreRunE
@@ -104,7 +156,7 @@ func runDbView(cmd *cobra.Command, args []string) {
 	fmt.Fprintln(tw, "Model Name\tVersion Name\tFilename\tFolder\tType\tBase Model\tCreator\tStatus\tDB Key (VersionID)")
 	fmt.Fprintln(tw, "----------\t------------\t--------\t------\t----\t----------\t-------\t------\t------------------")
 
-	count := 0
+	var listed []listedEntry
 	// Use Fold to iterate over key-value pairs
 	errFold := db.Fold(func(key []byte, value []byte) error {
 		keyStr := string(key)
@@ -121,9 +173,20 @@ func runDbView(cmd *cobra.Command, args []string) {
 			return nil // Continue folding over other keys
 		}
 
+		listed = append(listed, listedEntry{Key: keyStr, Entry: entry})
+		return nil
+	})
+
+	if errFold != nil {
+		log.WithError(errFold).Error("Error occurred during database scan (Fold)")
+	}
+
+	sortListedEntries(listed, order)
+	for _, item := range listed {
+		entry := item.Entry
 		// Print table row using the added fields, including Status
 		// Extract version ID from key for display
-		versionIDStr := strings.TrimPrefix(keyStr, "v_")
+		versionIDStr := strings.TrimPrefix(item.Key, "v_")
 		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
 			entry.ModelName, // Use added ModelName
 			entry.Version.Name,
@@ -135,18 +198,12 @@ func runDbView(cmd *cobra.Command, args []string) {
 			entry.Status,           // Added Status field
 			versionIDStr,           // Display the version ID
 		)
-		count++
-		return nil
-	})
-
-	if errFold != nil {
-		log.WithError(errFold).Error("Error occurred during database scan (Fold)")
 	}
 
 	if err := tw.Flush(); err != nil {
 		log.WithError(err).Error("Error flushing table writer for db view")
 	}
-	log.Infof("Displayed %d entries.", count)
+	log.Infof("Displayed %d entries.", len(listed))
 }
 
 type verificationProblem struct {
@@ -159,6 +216,13 @@ func runDbVerify(cmd *cobra.Command, args []string) {
 	log.Info("Verifying database entries against filesystem...")
 	checkHashFlag, _ := cmd.Flags().GetBool("check-hash")
 	autoRedownloadFlag, _ := cmd.Flags().GetBool("yes")
+	acceptHashChangeFlag, _ := cmd.Flags().GetBool("accept-hash-change")
+	sampleFlag, _ := cmd.Flags().GetString("sample")
+	maxDurationFlag, _ := cmd.Flags().GetDuration("max-duration")
+	sampleSize, err := parseVerifySample(sampleFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	// --- Basic Config Checks ---
 	if globalConfig.DatabasePath == "" {
@@ -181,8 +245,9 @@ func runDbVerify(cmd *cobra.Command, args []string) {
 	}
 	defer db.Close()
 
-	var totalEntries, foundOk, foundHashMismatch, missing int
+	var totalEntries, foundOk, foundHashMismatch, missing, cataloged int
 	var problemsToAddress []verificationProblem // List to store entries needing attention
+	var candidates []verifyCandidate
 
 	log.Info("Scanning database entries...")
 	// Use Fold for potentially better efficiency than Keys()
@@ -200,10 +265,42 @@ func runDbVerify(cmd *cobra.Command, args []string) {
 			log.WithError(err).Warnf("Failed to unmarshal JSON for key %s, skipping verification for this entry.", keyStr)
 			return nil // Continue folding
 		}
+		if entry.Status == models.StatusCataloged {
+			cataloged++ // Metadata-only entry, no file expected on disk
+			return nil
+		}
+		if entry.Status == models.StatusPruned {
+			return nil // Deleted on purpose (NsfwDriftPolicy "prune")
+		}
+		candidates = append(candidates, verifyCandidate{Key: keyStr, Entry: entry})
+		return nil
+	})
+	if errFold != nil {
+		log.WithError(errFold).Error("Error occurred during database scan (Fold)")
+	}
+
+	// Least recently verified first, so a time-limited pass gets to the stalest files
+	fileCount := len(candidates)
+	candidates = orderVerifyCandidates(candidates, sampleSize.of(fileCount), time.Now())
+	if sampleSize.set() {
+		log.Infof("Sampling %d of %d files, weighted toward the least recently verified.", len(candidates), fileCount)
+	}
+	var deadline time.Time
+	if maxDurationFlag > 0 {
+		deadline = time.Now().Add(maxDurationFlag)
+	}
+	checked := 0
+	for _, candidate := range candidates {
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			log.Warnf("Reached --max-duration after %d of %d files; the rest are left for the next pass.", checked, len(candidates))
+			break
+		}
+		checked++
+		keyStr, entry := candidate.Key, candidate.Entry
 
 		// Construct the expected full path using globalConfig and entry data
 		// Ensure the path uses the stored Filename and Folder
-		expectedPath := filepath.Join(globalConfig.SavePath, entry.Folder, entry.Filename)
+		expectedPath := entryFilePath(globalConfig.SavePath, entry)
 
 		// --- Check Main Model File --- (Simplified logic)
 		mainFileFound := false
@@ -215,7 +312,9 @@ func runDbVerify(cmd *cobra.Command, args []string) {
 			// File exists
 			mainFileFound = true
 			if checkHashFlag {
-				if helpers.CheckHash(expectedPath, entry.File.Hashes) {
+				hashMatches := helpers.CheckHash(expectedPath, entry.File.Hashes)
+				recordVerified(db, keyStr, entry.Status)
+				if hashMatches {
 					hashOK = true
 					foundOk++
 					log.WithFields(log.Fields{"path": expectedPath, "status": entry.Status}).Info("[OK] File exists and hash matches.")
@@ -243,6 +342,9 @@ func runDbVerify(cmd *cobra.Command, args []string) {
 
 		// --- Add to problems list if missing or mismatch --- (moved down)
 		if problemReason != "" {
+			if entry.Status == models.StatusDownloaded {
+				db.RecordEvent(database.NewHistoryEvent(database.EventVerifyFailed, keyStr, entry, problemReason))
+			}
 			problemsToAddress = append(problemsToAddress, verificationProblem{
 				Entry:  entry,
 				Reason: problemReason,
@@ -254,7 +356,7 @@ func runDbVerify(cmd *cobra.Command, args []string) {
 		if mainFileFound && hashOK && viper.GetBool("savemetadata") {
 			// Construct metadata filepath based on expectedPath (which already has the final filename)
 			metaFilename := strings.TrimSuffix(entry.Filename, filepath.Ext(entry.Filename)) + ".json"
-			metaFilepath := filepath.Join(globalConfig.SavePath, entry.Folder, metaFilename)
+			metaFilepath := filepath.Join(entryVersionDir(globalConfig.SavePath, entry), metaFilename)
 
 			if _, metaStatErr := os.Stat(metaFilepath); metaStatErr != nil {
 				if os.IsNotExist(metaStatErr) {
@@ -268,9 +370,9 @@ func runDbVerify(cmd *cobra.Command, args []string) {
 					} else {
 						// Ensure directory exists BEFORE writing
 						metaDir := filepath.Dir(metaFilepath)
-						if mkdirErr := os.MkdirAll(metaDir, 0700); mkdirErr != nil {
+						if mkdirErr := helpers.MkdirAll(metaDir, 0700); mkdirErr != nil {
 							log.WithError(mkdirErr).Errorf("Failed to create directory for metadata file %s", metaFilepath)
-						} else if writeErr := os.WriteFile(metaFilepath, jsonData, 0600); writeErr != nil {
+						} else if writeErr := helpers.WriteFile(metaFilepath, jsonData, 0600); writeErr != nil {
 							log.WithError(writeErr).Errorf("Failed to write metadata file %s", metaFilepath)
 						} else {
 							log.WithField("path", metaFilepath).Info("[METADATA CREATED] Successfully wrote metadata file.")
@@ -287,20 +389,17 @@ func runDbVerify(cmd *cobra.Command, args []string) {
 		} else if viper.GetBool("savemetadata") && (!mainFileFound || !hashOK) {
 			// Log skipping metadata check because main file is missing or hash mismatch
 			metaFilename := strings.TrimSuffix(entry.Filename, filepath.Ext(entry.Filename)) + ".json"
-			metaFilepath := filepath.Join(globalConfig.SavePath, entry.Folder, metaFilename)
+			metaFilepath := filepath.Join(entryVersionDir(globalConfig.SavePath, entry), metaFilename)
 			log.WithField("path", metaFilepath).Debug("[METADATA SKIP] Skipping metadata check/creation because main file is missing or has hash mismatch.")
 		}
 		// --- End Check/Create Metadata File ---
-
-		return nil // Continue folding
-	})
-
-	if errFold != nil {
-		log.WithError(errFold).Error("Error occurred during database scan (Fold)")
 	}
 
-	log.Infof("Initial Scan Summary: Total Entries=%d, OK=%d, Missing=%d, Mismatch=%d",
-		totalEntries, foundOk, missing, foundHashMismatch)
+	log.Infof("Initial Scan Summary: Total Entries=%d, OK=%d, Missing=%d, Mismatch=%d, Cataloged (not downloaded)=%d",
+		totalEntries, foundOk, missing, foundHashMismatch, cataloged)
+	if sampleSize.set() || checked < len(candidates) {
+		logVerifyConfidence(checked, fileCount, missing+foundHashMismatch)
+	}
 
 	// --- Prompt for Redownloads --- (New Section)
 	if len(problemsToAddress) > 0 {
@@ -332,6 +431,11 @@ func runDbVerify(cmd *cobra.Command, args []string) {
 				}
 			}
 
+			if change := hashPinChange(entry, entry.File); change != "" && confirm && !acceptHashChangeFlag {
+				log.Errorf("Not redownloading %s: %s. Use --accept-hash-change to trust the new file.", entry.Filename, change)
+				confirm = false
+			}
+
 			if confirm {
 				redownloadAttempts++
 
@@ -351,28 +455,56 @@ func runDbVerify(cmd *cobra.Command, args []string) {
 						Transport: globalHttpTransport,
 					}
 					fileDownloader = downloader.NewDownloader(httpClient, globalConfig.ApiKey)
+					fileDownloader.SetTempDir(downloadTempDir())
+					fileDownloader.SetSegments(viper.GetInt("downloadsegments"))
+					fileDownloader.SetRetries(viper.GetInt("maxretries"), globalRetryDelay, globalRetryPolicy)
+					fileDownloader.SetStallTimeout(time.Duration(viper.GetInt("stalltimeoutsec")) * time.Second)
+					fileDownloader.SetHashAlgorithms(globalHashAlgorithms)
+					fileDownloader.SetKeepMismatched(globalKeepMismatched)
+					fileDownloader.SetQuarantineDir(globalQuarantineDir)
+					fileDownloader.SetMismatchRetries(viper.GetInt("mismatchretries"))
+					fileDownloader.SetAria2(globalAria2)
+					fileDownloader.SetMirrors(viper.GetStringSlice("mirrorurls"))
+					fileDownloader.SetPreallocate(viper.GetBool("preallocate"))
+					fileDownloader.SetHostOverrides(globalHostOverrides)
 					log.Debug("Downloader initialized.")
 				}
 
 				// --- Perform Redownload using existing logic ---
-				targetPath := filepath.Join(globalConfig.SavePath, entry.Folder, entry.Filename)
+				targetPath := entryFilePath(globalConfig.SavePath, entry)
 				downloadUrl := entry.File.DownloadUrl
 				hashes := entry.File.Hashes
-				versionID := entry.Version.ID // Use the version ID from the entry
+				versionID := entryFileNameVersionID(entry) // Use the version ID from the entry
 				dbKey := problem.DbKey
 
 				log.Infof("Attempting redownload: %s -> %s", downloadUrl, targetPath)
 				// Ensure directory exists (important for redownload)
-				if err := os.MkdirAll(filepath.Dir(targetPath), 0700); err != nil {
+				if err := helpers.MkdirAll(filepath.Dir(targetPath), 0700); err != nil {
 					log.WithError(err).Errorf("Failed to create directory for redownload: %s", filepath.Dir(targetPath))
 					updateDbEntry(db, dbKey, models.StatusError, func(e *models.DatabaseEntry) {
-						e.ErrorDetails = fmt.Sprintf("Mkdir failed: %v", err)
+						setEntryError(e, fmt.Errorf("mkdir failed: %w", err))
 					})
 					redownloadFail++
 					continue // Next problem
 				}
+				quarantined := false
+				if problem.Reason == "Hash Mismatch" && globalQuarantineDir != "" {
+					quarantinedPath, err := downloader.QuarantineFile(globalQuarantineDir, targetPath, downloader.QuarantineReason{
+						Reason:         "db verify: hash mismatch",
+						OriginalPath:   targetPath,
+						URL:            downloadUrl,
+						ModelVersionID: entry.Version.ID,
+						ExpectedHashes: hashes,
+					})
+					if err != nil {
+						log.WithError(err).Warnf("Failed to quarantine %s before redownloading it", targetPath)
+					} else {
+						log.Infof("Quarantined %s as %s", targetPath, quarantinedPath)
+						quarantined = true
+					}
+				}
 
-				finalPath, downloadErr := fileDownloader.DownloadFile(targetPath, downloadUrl, hashes, versionID)
+				finalPath, receipt, downloadErr := fileDownloader.DownloadFileWithReceipt(targetPath, downloadUrl, hashes, versionID)
 
 				// --- Update DB and Handle Metadata ---
 				finalStatus := models.StatusError
@@ -387,10 +519,17 @@ func runDbVerify(cmd *cobra.Command, args []string) {
 
 				updateErr := updateDbEntry(db, dbKey, finalStatus, func(e *models.DatabaseEntry) {
 					if downloadErr != nil {
-						e.ErrorDetails = downloadErr.Error()
+						setEntryError(e, downloadErr)
+						if quarantined {
+							e.QuarantinedAt = e.FailedAt // The old copy is in quarantine and nothing replaced it
+						}
 					} else {
 						e.ErrorDetails = ""                   // Clear error on success
 						e.Filename = filepath.Base(finalPath) // Update filename if ID was prepended
+						recordEmbeddingToken(e)
+						if receipt.ComputedHashes != nil {
+							e.LocalHashes = receipt.ComputedHashes
+						}
 						// Update File and Version structs? Maybe not necessary here unless they changed upstream?
 					}
 				})
@@ -407,7 +546,7 @@ func runDbVerify(cmd *cobra.Command, args []string) {
 						CleanedVersion: entry.Version, // Use the version from the DB entry
 					}
 					// Call handleMetadataSaving (pass nil for writer as we are not using uilive here)
-					handleMetadataSaving("VerifyRedownload", pdForMeta, finalPath, finalStatus, nil)
+					handleMetadataSaving("VerifyRedownload", pdForMeta, finalPath, finalStatus, receiptField(receipt), nil)
 				}
 			} else {
 				log.Infof("Skipping redownload for %s (%s).", entry.Filename, entry.Folder)
@@ -463,28 +602,16 @@ func runDbRedownload(cmd *cobra.Command, args []string) {
 		log.WithError(err).Fatalf("Failed to unmarshal database entry for key %s", dbKey)
 	}
 
-	// Reconstruct the expected full path using globalConfig
-	expectedPath := filepath.Join(globalConfig.SavePath, entry.Folder, entry.Filename)
-	log.Infof("Target path for redownload: %s", expectedPath)
-	log.Infof("Download URL from DB: %s", entry.File.DownloadUrl)
-
-	// Ensure target directory exists
-	if !helpers.CheckAndMakeDir(filepath.Dir(expectedPath)) {
-		log.Fatalf("Failed to ensure directory exists: %s", filepath.Dir(expectedPath))
+	// Refuse if the recorded file no longer matches the hashes first seen for it
+	acceptHashChange, _ := cmd.Flags().GetBool("accept-hash-change")
+	if change := hashPinChange(entry, entry.File); change != "" {
+		if !acceptHashChange {
+			log.Fatalf("Refusing redownload of %s: %s. Re-run with --accept-hash-change to trust the new file.", dbKey, change)
+		}
+		log.Warnf("Accepting hash change for %s (--accept-hash-change): %s", dbKey, change)
 	}
 
-	// Initialize downloader using the helper function from download.go
-	log.Debug("Initializing HTTP client for redownload...")
-	// createDownloaderClient is in download.go, cannot be called directly here.
-	// Create a new client instance for this command.
-	// TODO: Refactor client creation/sharing?
-	downloaderHttpClient := &http.Client{Timeout: 30 * time.Minute} // Longer timeout for downloads
-	fileDownloader := downloader.NewDownloader(downloaderHttpClient, globalConfig.ApiKey)
-
-	// Perform the download, checking the error
-	// Pass the Model Version ID from the database entry
-	finalPath, err := fileDownloader.DownloadFile(expectedPath, entry.File.DownloadUrl, entry.File.Hashes, entry.Version.ID)
-
+	finalPath, err := redownloadEntry(db, dbKey, entry, acceptHashChange)
 	if err == nil {
 		log.Infof("Successfully redownloaded and verified: %s", finalPath)
 	} else {
@@ -495,6 +622,8 @@ func runDbRedownload(cmd *cobra.Command, args []string) {
 		})
 		if errors.Is(err, downloader.ErrHashMismatch) {
 			logEntry.WithError(err).Error("Redownload failed: Hash mismatch after download.")
+		} else if reason := failure.ReasonOf(err); reason != "" {
+			logEntry.WithError(err).Errorf("Redownload refused by Civitai (%s).", reason)
 		} else if errors.Is(err, downloader.ErrHttpStatus) {
 			logEntry.WithError(err).Error("Redownload failed: Unexpected HTTP status.")
 		} else if errors.Is(err, downloader.ErrFileSystem) {
@@ -509,9 +638,199 @@ func runDbRedownload(cmd *cobra.Command, args []string) {
 	}
 }
 
+// redownloadEntry downloads an entry's file again from its recorded URL to its recorded
+// location and records the hash pin (first download or accepted change).
+func redownloadEntry(db *database.DB, dbKey string, entry models.DatabaseEntry, acceptHashChange bool) (string, error) {
+	// Reconstruct the expected full path using globalConfig
+	expectedPath := entryFilePath(globalConfig.SavePath, entry)
+	log.Infof("Target path for redownload: %s", expectedPath)
+	log.Infof("Download URL from DB: %s", entry.File.DownloadUrl)
+
+	// Ensure target directory exists
+	if !helpers.CheckAndMakeDir(filepath.Dir(expectedPath)) {
+		return "", fmt.Errorf("%w: failed to create directory %s", downloader.ErrFileSystem, filepath.Dir(expectedPath))
+	}
+
+	// Initialize downloader using the helper function from download.go
+	log.Debug("Initializing HTTP client for redownload...")
+	// createDownloaderClient is in download.go, cannot be called directly here.
+	// Create a new client instance for this command.
+	// TODO: Refactor client creation/sharing?
+	downloaderHttpClient := &http.Client{Transport: globalHttpTransport} // No total timeout: large files take long; stalls are caught by StallTimeoutSec
+	fileDownloader := downloader.NewDownloader(downloaderHttpClient, globalConfig.ApiKey)
+	fileDownloader.SetTempDir(downloadTempDir())
+	fileDownloader.SetSegments(viper.GetInt("downloadsegments"))
+	fileDownloader.SetRetries(viper.GetInt("maxretries"), globalRetryDelay, globalRetryPolicy)
+	fileDownloader.SetStallTimeout(time.Duration(viper.GetInt("stalltimeoutsec")) * time.Second)
+	fileDownloader.SetHashAlgorithms(globalHashAlgorithms)
+	fileDownloader.SetKeepMismatched(globalKeepMismatched)
+	fileDownloader.SetQuarantineDir(globalQuarantineDir)
+	fileDownloader.SetMismatchRetries(viper.GetInt("mismatchretries"))
+	fileDownloader.SetAria2(globalAria2)
+	fileDownloader.SetMirrors(viper.GetStringSlice("mirrorurls"))
+	fileDownloader.SetPreallocate(viper.GetBool("preallocate"))
+	fileDownloader.SetHostOverrides(globalHostOverrides)
+
+	// Perform the download, checking the error
+	// Pass the Model Version ID from the database entry
+	finalPath, err := fileDownloader.DownloadFile(expectedPath, entry.File.DownloadUrl, entry.File.Hashes, entryFileNameVersionID(entry))
+	if err != nil {
+		return "", err
+	}
+	if entry.PinnedHashes == nil || acceptHashChange || entry.Status != models.StatusDownloaded {
+		errUpdate := updateDbEntry(db, dbKey, models.StatusDownloaded, func(e *models.DatabaseEntry) {
+			if e.PinnedHashes == nil || acceptHashChange {
+				pinFileHashes(e, entry.File)
+			}
+		})
+		if errUpdate != nil {
+			log.WithError(errUpdate).Warnf("Failed to record the redownload of %s", dbKey)
+		}
+	}
+	return finalPath, nil
+}
+
+// trainingDuplicateKeys returns the keys of entries that share their training fingerprint
+// with another entry, grouped by fingerprint.
+func trainingDuplicateKeys(db *database.DB) ([]string, error) {
+	var groups [][]string
+	if db.IndexesReady() {
+		var err error
+		if groups, err = db.IndexGroups(database.IndexTraining, 2); err != nil {
+			return nil, err
+		}
+	} else {
+		byFingerprint := make(map[string][]string)
+		err := db.Fold(func(key []byte, value []byte) error {
+			if !strings.HasPrefix(string(key), "v_") {
+				return nil
+			}
+			var entry models.DatabaseEntry
+			if err := json.Unmarshal(value, &entry); err != nil {
+				return nil
+			}
+			if fingerprint := helpers.TrainingFingerprint(entry.Training); fingerprint != "" {
+				byFingerprint[fingerprint] = append(byFingerprint[fingerprint], string(key))
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, keys := range byFingerprint {
+			if len(keys) > 1 {
+				sort.Strings(keys)
+				groups = append(groups, keys)
+			}
+		}
+		sort.Slice(groups, func(i, j int) bool { return groups[i][0] < groups[j][0] })
+	}
+
+	var keys []string
+	for _, group := range groups {
+		keys = append(keys, group...)
+	}
+	return keys, nil
+}
+
+// foldCandidates calls fn for every entry whose key is in all of keySets, in the order of
+// the first set. With no sets the whole database is folded instead. Index lookups can be
+// stale, so fn must still check its filters against the entry.
+func foldCandidates(db *database.DB, keySets [][]string, fn func(key []byte, value []byte) error) error {
+	if len(keySets) == 0 {
+		return db.Fold(fn)
+	}
+	counts := make(map[string]int)
+	for _, set := range keySets {
+		seen := make(map[string]bool, len(set))
+		for _, key := range set {
+			if !seen[key] {
+				seen[key] = true
+				counts[key]++
+			}
+		}
+	}
+	for _, key := range keySets[0] {
+		if counts[key] != len(keySets) {
+			continue
+		}
+		counts[key] = 0 // Visit each key once
+		value, err := db.Get([]byte(key))
+		if err != nil {
+			if !errors.Is(err, database.ErrNotFound) {
+				log.WithError(err).Warnf("Failed to read entry %s", key)
+			}
+			continue
+		}
+		if err := fn([]byte(key), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// entryHasHash reports whether any of the entry's file hashes, published or computed
+// locally, is hash, ignoring case.
+func entryHasHash(entry models.DatabaseEntry, hash string) bool {
+	hashes := entry.File.Hashes
+	for _, local := range entry.LocalHashes {
+		if strings.EqualFold(local, hash) {
+			return true
+		}
+	}
+	return containsFold([]string{hashes.AutoV2, hashes.SHA256, hashes.CRC32, hashes.BLAKE3}, hash)
+}
+
+// containsFold reports whether list holds s, ignoring case.
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
 func runDbSearch(cmd *cobra.Command, args []string) {
-	searchTerm := strings.ToLower(args[0]) // Case-insensitive search
-	log.Infof("Searching database entries for model name containing: '%s'", searchTerm)
+	searchTerm := ""
+	if len(args) > 0 {
+		searchTerm = strings.ToLower(args[0]) // Case-insensitive search
+	}
+	trigger, _ := cmd.Flags().GetString("trigger")
+	token, _ := cmd.Flags().GetString("token")
+	networkDim, _ := cmd.Flags().GetInt("network-dim")
+	trainingTag, _ := cmd.Flags().GetString("training-tag")
+	duplicatesOnly, _ := cmd.Flags().GetBool("duplicates")
+	creator, _ := cmd.Flags().GetString("creator")
+	modelType, _ := cmd.Flags().GetString("type")
+	baseModel, _ := cmd.Flags().GetString("base-model")
+	hash, _ := cmd.Flags().GetString("hash")
+	trigger = strings.TrimSpace(trigger)
+	token = strings.TrimSpace(token)
+	trainingTag = strings.TrimSpace(trainingTag)
+	creator = strings.TrimSpace(creator)
+	modelType = strings.TrimSpace(modelType)
+	baseModel = strings.TrimSpace(baseModel)
+	hash = strings.TrimSpace(hash)
+	order, _ := cmd.Flags().GetString("sort")
+	if err := sortListedEntries(nil, order); err != nil {
+		log.Fatal(err)
+	}
+	if searchTerm == "" && trigger == "" && token == "" && networkDim == 0 && trainingTag == "" && !duplicatesOnly &&
+		creator == "" && modelType == "" && baseModel == "" && hash == "" {
+		log.Fatal("Provide a model name query and/or a filter flag (see --help).")
+	}
+	showFiles := trigger != "" || token != "" || duplicatesOnly
+
+	if searchTerm != "" {
+		log.Infof("Searching database entries for model name containing: '%s'", searchTerm)
+	}
+	if trigger != "" {
+		log.Infof("Matching trigger word: '%s'", trigger)
+	}
+	if token != "" {
+		log.Infof("Matching embedding token: '%s'", token)
+	}
 
 	// Use globalConfig loaded by PersistentPreRunE
 	if globalConfig.DatabasePath == "" {
@@ -524,12 +843,62 @@ func runDbSearch(cmd *cobra.Command, args []string) {
 	}
 	defer db.Close()
 
+	// Filters backed by a secondary index narrow the entries read; the rest are checked per entry
+	var keySets [][]string
+	duplicateKeys := make(map[string]bool)
+	if duplicatesOnly {
+		keys, err := trainingDuplicateKeys(db)
+		if err != nil {
+			log.WithError(err).Fatal("Error occurred while scanning training fingerprints")
+		}
+		for _, key := range keys {
+			duplicateKeys[key] = true
+		}
+		keySets = append(keySets, keys) // First, so groups are printed together
+	}
+	if db.IndexesReady() {
+		for _, filter := range []struct {
+			index database.Index
+			value string
+		}{
+			{database.IndexCreator, creator},
+			{database.IndexType, modelType},
+			{database.IndexBaseModel, baseModel},
+			{database.IndexHash, hash},
+			{database.IndexTrigger, trigger},
+			{database.IndexTrigger, token},
+		} {
+			if filter.value == "" {
+				continue
+			}
+			keys, err := db.Lookup(filter.index, filter.value)
+			if err != nil {
+				log.WithError(err).Fatal("Error occurred during index lookup")
+			}
+			keySets = append(keySets, keys)
+		}
+	} else {
+		log.Debug("Database indexes are not built yet; scanning all entries")
+	}
+
+	// With --thumbnails, matches are shown as a grid of their previews instead of the table
+	var grid *thumbnailGrid
+	if protocol := thumbnailProtocol(cmd); protocol != "" {
+		grid = newThumbnailGrid(protocol)
+	}
 	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
-	fmt.Fprintln(tw, "Model Name\tVersion Name\tFilename\tFolder\tType\tBase Model\tCreator\tStatus\tDB Key (VersionID)")
-	fmt.Fprintln(tw, "----------\t------------\t--------\t------\t----\t----------\t-------\t------\t------------------")
+	switch {
+	case grid != nil: // No table
+	case showFiles:
+		fmt.Fprintln(tw, "Model Name\tVersion Name\tType\tBase Model\tStatus\tDB Key (VersionID)\tTrigger Words\tLocal File")
+		fmt.Fprintln(tw, "----------\t------------\t----\t----------\t------\t------------------\t-------------\t----------")
+	default:
+		fmt.Fprintln(tw, "Model Name\tVersion Name\tFilename\tFolder\tType\tBase Model\tCreator\tStatus\tDB Key (VersionID)")
+		fmt.Fprintln(tw, "----------\t------------\t--------\t------\t----\t----------\t-------\t------\t------------------")
+	}
 
-	matchCount := 0
-	errFold := db.Fold(func(key []byte, value []byte) error {
+	var matches []listedEntry
+	errFold := foldCandidates(db, keySets, func(key []byte, value []byte) error {
 		keyStr := string(key)
 		// Skip non-version keys
 		if !strings.HasPrefix(keyStr, "v_") {
@@ -543,11 +912,82 @@ func runDbSearch(cmd *cobra.Command, args []string) {
 			return nil
 		}
 
+		if creator != "" && !strings.EqualFold(entry.Creator.Username, creator) {
+			return nil
+		}
+		if modelType != "" && !strings.EqualFold(entry.ModelType, modelType) && !strings.EqualFold(entry.InferredType, modelType) {
+			return nil
+		}
+		if baseModel != "" && !strings.EqualFold(entry.Version.BaseModel, baseModel) {
+			return nil
+		}
+		if hash != "" && !entryHasHash(entry, hash) {
+			return nil
+		}
+
 		// Perform case-insensitive substring search
-		if strings.Contains(strings.ToLower(entry.ModelName), searchTerm) {
-			matchCount++
-			// Extract version ID from key for display
-			versionIDStr := strings.TrimPrefix(keyStr, "v_")
+		if searchTerm != "" && !strings.Contains(strings.ToLower(entry.ModelName), searchTerm) {
+			return nil
+		}
+		triggerWords := helpers.TriggerPhrases(entry.Version.TrainedWords)
+		if trigger != "" && !containsFold(triggerWords, trigger) {
+			return nil
+		}
+		if token != "" {
+			embeddingToken := helpers.EntryEmbeddingToken(entry)
+			if embeddingToken == "" {
+				return nil // Not an embedding
+			}
+			if !strings.EqualFold(embeddingToken, token) && !containsFold(triggerWords, token) {
+				return nil
+			}
+		}
+		if networkDim != 0 && (entry.Training == nil || entry.Training.NetworkDim != networkDim) {
+			return nil
+		}
+		if trainingTag != "" && (entry.Training == nil || !containsFold(entry.Training.Tags, trainingTag)) {
+			return nil
+		}
+		if duplicatesOnly && !duplicateKeys[keyStr] {
+			return nil
+		}
+
+		matches = append(matches, listedEntry{Key: keyStr, Entry: entry})
+		return nil
+	})
+
+	if errFold != nil {
+		log.WithError(errFold).Error("Error occurred during database scan (Fold)")
+	}
+
+	// Groups of duplicates stay together, in the order they were found, unless asked otherwise
+	if !duplicatesOnly || cmd.Flags().Changed("sort") {
+		sortListedEntries(matches, order)
+	}
+	for _, match := range matches {
+		entry := match.Entry
+		triggerWords := helpers.TriggerPhrases(entry.Version.TrainedWords)
+		// Extract version ID from key for display
+		versionIDStr := strings.TrimPrefix(match.Key, "v_")
+		if grid != nil {
+			caption := []string{entry.ModelName, entry.Version.Name, versionIDStr + " " + entry.Status}
+			if showFiles {
+				caption = append(caption, strings.Join(triggerWords, ", "))
+			}
+			grid.add(previewImageFor(entryFilePath(globalConfig.SavePath, entry)), caption...)
+		} else if showFiles {
+			localPath := entryFilePath(globalConfig.SavePath, entry)
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				entry.ModelName,
+				entry.Version.Name,
+				entry.ModelType,
+				entry.Version.BaseModel,
+				entry.Status,
+				versionIDStr,
+				strings.Join(triggerWords, ", "),
+				localPath,
+			)
+		} else {
 			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
 				entry.ModelName,
 				entry.Version.Name,
@@ -560,15 +1000,13 @@ func runDbSearch(cmd *cobra.Command, args []string) {
 				versionIDStr, // Display the version ID
 			)
 		}
-		return nil
-	})
-
-	if errFold != nil {
-		log.WithError(errFold).Error("Error occurred during database scan (Fold)")
 	}
 
+	if grid != nil {
+		grid.flush()
+	}
 	if err := tw.Flush(); err != nil {
 		log.WithError(err).Error("Error flushing table writer for db search")
 	}
-	log.Infof("Found %d matching entries for query '%s'.", matchCount, searchTerm)
+	log.Infof("Found %d matching entries.", len(matches))
 }
@@ -0,0 +1,584 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	index "github.com/dreamfast/go-civitai-downloader/index"
+	"github.com/dreamfast/go-civitai-downloader/internal/api"
+	"github.com/dreamfast/go-civitai-downloader/internal/database"
+	"github.com/dreamfast/go-civitai-downloader/internal/downloader"
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// dbAdoptCmd adds model files acquired outside the downloader to the archive
+var dbAdoptCmd = &cobra.Command{
+	Use:   "adopt <file|dir>...",
+	Short: "Add model files acquired elsewhere (e.g. by torrent) to the archive",
+	Long: `Adds model files that were not downloaded by this tool - typically ones fetched with a
+torrent client - to the archive, as if they had been downloaded here.
+
+Every file is hashed (SHA256). Without --verify-remote, only files whose hash matches a
+version already in the database (e.g. cataloged with 'download --metadata-only') are
+adopted, at that version's recorded location. With --verify-remote, each file is
+identified through Civitai's by-hash endpoint instead: the version and model metadata
+are fetched, the file is placed and named where PathTemplate puts that version, and the
+sidecar, preview, version images and model info are saved as the download settings
+say. Directories are scanned for model files (.safetensors, .ckpt, .pt, .pth, .bin,
+.gguf, .sft, .onnx, .zip).
+
+By default the archive gets a hard link to the file, so a torrent client can keep
+seeding it; across filesystems it is copied. Use --mode to copy, move or symlink instead.`,
+	Example: `  civitai-downloader db adopt ~/torrents/complete --verify-remote --dry-run
+  civitai-downloader db adopt ~/torrents/complete/detail_tweaker.safetensors --verify-remote --yes`,
+	Args: cobra.MinimumNArgs(1),
+	Run:  runDbAdopt,
+}
+
+func init() {
+	dbCmd.AddCommand(dbAdoptCmd)
+	dbAdoptCmd.Flags().Bool("verify-remote", false, "Identify files through Civitai's by-hash endpoint and fetch their metadata and previews")
+	dbAdoptCmd.Flags().String("mode", adoptHardlink, "How files get into the archive: hardlink (falls back to copy), copy, move or symlink")
+	dbAdoptCmd.Flags().Bool("dry-run", false, "Identify the files and show where they would go, without changing anything")
+	dbAdoptCmd.Flags().BoolP("yes", "y", false, "Skip the confirmation prompt")
+	dbAdoptCmd.Flags().Bool("force", false, "Replace files at the target location whose contents differ")
+}
+
+// Adopt modes (--mode).
+const (
+	adoptHardlink = "hardlink"
+	adoptCopy     = "copy"
+	adoptMove     = "move"
+	adoptSymlink  = "symlink"
+)
+
+// adoptExtensions are the model file extensions picked up when scanning directories.
+var adoptExtensions = map[string]bool{
+	".safetensors": true, ".ckpt": true, ".pt": true, ".pth": true, ".bin": true,
+	".gguf": true, ".sft": true, ".onnx": true, ".zip": true,
+}
+
+// sidecarAdoptedKey is the sidecar field recording where an adopted file came from.
+const sidecarAdoptedKey = "adopted"
+
+// adoptRecord is the sidecar record of an adopted file.
+type adoptRecord struct {
+	Source     string    `json:"source"`
+	Mode       string    `json:"mode"`
+	SHA256     string    `json:"sha256"`
+	AdoptedAt  time.Time `json:"adoptedAt"`
+	IdentifyBy string    `json:"identifiedBy"` // "database" or "civitai"
+}
+
+// adoptCandidate is a file to adopt and what was found out about it.
+type adoptCandidate struct {
+	Source   string
+	Size     int64
+	SHA256   string
+	Key      string // DB key of the version; "" if unidentified
+	Existing *models.DatabaseEntry
+	PD       potentialDownload
+	Model    *models.Model // Fetched model (--verify-remote); nil otherwise
+	RawModel []byte
+	Target   string
+	Remote   bool   // Identified through the API
+	Skip     string // Why the file is not adopted; "" to adopt it
+	Present  bool   // Target already has these contents; only the entry is recorded
+}
+
+func runDbAdopt(cmd *cobra.Command, args []string) {
+	verifyRemote, _ := cmd.Flags().GetBool("verify-remote")
+	mode, _ := cmd.Flags().GetString("mode")
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+	skipConfirm, _ := cmd.Flags().GetBool("yes")
+	force, _ := cmd.Flags().GetBool("force")
+
+	mode = strings.ToLower(mode)
+	switch mode {
+	case adoptHardlink, adoptCopy, adoptMove, adoptSymlink:
+	default:
+		log.Fatalf("Unknown --mode %q (use %s, %s, %s or %s)", mode, adoptHardlink, adoptCopy, adoptMove, adoptSymlink)
+	}
+	if globalConfig.DatabasePath == "" || globalConfig.SavePath == "" {
+		log.Fatal("DatabasePath and SavePath must be set in the configuration.")
+	}
+	if err := helpers.ValidatePathTemplate(pathTemplate()); err != nil {
+		log.Fatalf("Invalid PathTemplate: %v", err)
+	}
+	if err := validateNsfwPartition(); err != nil {
+		log.Fatal(err)
+	}
+
+	files, err := collectAdoptFiles(args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(files) == 0 {
+		fmt.Println("No model files found.")
+		return
+	}
+
+	db, err := database.Open(globalConfig.DatabasePath)
+	if err != nil {
+		log.WithError(err).Fatalf("Failed to open database at %s", globalConfig.DatabasePath)
+	}
+	defer db.Close()
+	loadPathOverrides(db)
+
+	apiClient := &http.Client{Timeout: time.Duration(globalConfig.ApiClientTimeoutSec) * time.Second, Transport: globalHttpTransport}
+	modelCache := make(map[int]*adoptModel)
+	var candidates []*adoptCandidate
+	targets := make(map[string]string) // Target -> source, to catch two files for one place
+	for _, path := range files {
+		c := identifyAdoptFile(db, apiClient, modelCache, path, verifyRemote)
+		if c.Skip == "" {
+			planAdoptTarget(c, force)
+		}
+		if c.Skip == "" && !c.Present {
+			if other, ok := targets[c.Target]; ok {
+				c.Skip = fmt.Sprintf("same version file as %s", other)
+			} else {
+				targets[c.Target] = c.Source
+			}
+		}
+		candidates = append(candidates, c)
+	}
+
+	adopt := 0
+	for _, c := range candidates {
+		switch {
+		case c.Skip != "":
+			fmt.Printf("  skip   %s: %s\n", c.Source, c.Skip)
+		case c.Present:
+			adopt++
+			fmt.Printf("  record %s (%s) - already at %s\n", c.Source, c.Key, c.Target)
+		default:
+			adopt++
+			fmt.Printf("  %-6s %s (%s) -> %s\n", mode, c.Source, c.Key, c.Target)
+		}
+	}
+	fmt.Printf("%d of %d file(s) can be adopted.\n", adopt, len(candidates))
+	if dryRun || adopt == 0 {
+		return
+	}
+	if !skipConfirm {
+		fmt.Printf("Adopt %d file(s)? (y/N) ", adopt)
+		reader := bufio.NewReader(os.Stdin)
+		input, _ := reader.ReadString('\n')
+		if strings.ToLower(strings.TrimSpace(input)) != "y" {
+			fmt.Println("Aborted.")
+			return
+		}
+	}
+
+	imageDownloader := downloader.NewDownloader(&http.Client{Timeout: 0, Transport: globalHttpTransport}, globalConfig.ApiKey)
+	indexPath := globalConfig.BleveIndexPath
+	if indexPath == "" {
+		indexPath = filepath.Join(globalConfig.SavePath, "civitai.bleve")
+	}
+	bleveIndex, err := index.OpenOrCreateIndex(indexPath)
+	if err != nil {
+		log.WithError(err).Warnf("Failed to open search index at %s; adopted files won't be indexed", indexPath)
+		bleveIndex = nil
+	} else {
+		defer bleveIndex.Close()
+	}
+
+	adopted, failed := 0, 0
+	savedModelInfo := make(map[int]bool)
+	for _, c := range candidates {
+		if c.Skip != "" {
+			continue
+		}
+		if err := adoptFile(db, c, mode); err != nil {
+			log.WithError(err).Errorf("Failed to adopt %s", c.Source)
+			failed++
+			continue
+		}
+		adopted++
+
+		logPrefix := "adopt"
+		if c.Remote {
+			if viper.GetBool("saveversionimages") {
+				downloadImages(logPrefix, c.PD.OriginalImages, filepath.Join(filepath.Dir(c.Target), "images"), imageDownloader, 1)
+			}
+			if c.Model != nil && viper.GetBool("savemodelinfo") && !savedModelInfo[c.Model.ID] {
+				savedModelInfo[c.Model.ID] = true
+				modelDir := modelDirFor(globalConfig.SavePath, c.Model.Type, c.Model.Name, c.Model.ID, c.Model.Nsfw, c.Model.NsfwLevel)
+				if err := saveModelInfoFile(*c.Model, c.RawModel, modelDir); err != nil {
+					log.WithError(err).Warnf("Failed to save model info for %s", c.Model.Name)
+				}
+			}
+		}
+		extras := []sidecarField{{Key: sidecarAdoptedKey, Value: adoptRecord{
+			Source: c.Source, Mode: mode, SHA256: c.SHA256, AdoptedAt: time.Now().UTC(), IdentifyBy: adoptIdentifiedBy(c),
+		}}}
+		if c.Remote && viper.GetBool("savepreview") {
+			if choice := savePreviewImage(logPrefix, c.PD, c.Target, imageDownloader); choice != nil {
+				extras = append(extras, sidecarField{Key: sidecarPreviewKey, Value: choice})
+			}
+		}
+		handleMetadataSaving(logPrefix, c.PD, c.Target, models.StatusDownloaded, extras, nil)
+		writeDatasetPointers(logPrefix, c.PD, c.Target)
+		if bleveIndex != nil {
+			if err := index.IndexItem(bleveIndex, modelFileIndexItem(c.PD, c.Target)); err != nil {
+				log.WithError(err).Warnf("Failed to index %s", c.Target)
+			}
+		}
+		fmt.Printf("Adopted %s -> %s\n", c.Source, c.Target)
+	}
+	fmt.Printf("Adopt complete. Adopted: %d, Failed: %d\n", adopted, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// collectAdoptFiles expands the arguments into files: files are taken as given,
+// directories are scanned for model files.
+func collectAdoptFiles(args []string) ([]string, error) {
+	var files []string
+	seen := make(map[string]bool)
+	add := func(path string) {
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+		if !seen[path] {
+			seen[path] = true
+			files = append(files, path)
+		}
+	}
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			add(arg)
+			continue
+		}
+		err = filepath.WalkDir(arg, func(path string, d os.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.Type().IsRegular() && adoptExtensions[strings.ToLower(filepath.Ext(path))] {
+				add(path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// adoptModel is a model fetched for adoption, shared by its files.
+type adoptModel struct {
+	Model models.Model
+	Raw   []byte
+	Err   error
+}
+
+// identifyAdoptFile hashes a file and finds its version, in the database or (remote) on
+// Civitai.
+func identifyAdoptFile(db *database.DB, client *http.Client, modelCache map[int]*adoptModel, path string, remote bool) *adoptCandidate {
+	c := &adoptCandidate{Source: path}
+	info, err := os.Stat(path)
+	if err != nil {
+		c.Skip = err.Error()
+		return c
+	}
+	c.Size = info.Size()
+	log.Infof("Hashing %s (%s)", path, helpers.BytesToSize(uint64(c.Size)))
+	if c.SHA256, err = helpers.FileSHA256(path); err != nil {
+		c.Skip = fmt.Sprintf("hashing failed: %v", err)
+		return c
+	}
+
+	if keys, err := db.Lookup(database.IndexHash, c.SHA256); err == nil {
+		for _, key := range keys {
+			raw, err := db.Get([]byte(key))
+			if err != nil {
+				continue
+			}
+			var entry models.DatabaseEntry
+			if json.Unmarshal(raw, &entry) == nil && strings.EqualFold(entry.File.Hashes.SHA256, c.SHA256) {
+				c.Key, c.Existing = key, &entry
+				break
+			}
+		}
+	}
+	if !remote {
+		if c.Existing == nil {
+			c.Skip = "not in the database (use --verify-remote to identify it on Civitai)"
+			return c
+		}
+		c.PD = potentialDownloadFromEntry(*c.Existing, "")
+		return c
+	}
+
+	version, raw, err := fetchVersionByHash(client, c.SHA256)
+	if err != nil {
+		c.Skip = err.Error()
+		return c
+	}
+	var file models.File
+	found := false
+	for _, f := range version.Files {
+		if strings.EqualFold(f.Hashes.SHA256, c.SHA256) {
+			file, found = f, true
+			break
+		}
+	}
+	if !found {
+		c.Skip = fmt.Sprintf("version %d lists no file with this SHA256", version.ID)
+		return c
+	}
+	if c.Existing != nil && c.Existing.Version.ID != version.ID {
+		log.Warnf("%s is recorded as %s in the database, but Civitai lists it under version %d", path, c.Key, version.ID)
+	}
+
+	cached, ok := modelCache[version.ModelId]
+	if !ok {
+		cached = &adoptModel{}
+		cached.Model, cached.Raw, cached.Err = fetchAdoptModel(client, version.ModelId)
+		cached.Raw = rawForSidecar(cached.Raw) // Only the decoded model is kept in low-memory mode
+		modelCache[version.ModelId] = cached
+	}
+	model := models.Model{
+		ID: version.ModelId, Name: version.Model.Name, Type: version.Model.Type,
+		Nsfw: version.Model.Nsfw, Poi: version.Model.Poi, Minor: version.Model.Minor, Creator: models.Creator{Username: "unknown_creator"},
+	}
+	rawVersion := json.RawMessage(raw)
+	if cached.Err == nil {
+		model = cached.Model
+		if rv, ok := api.RawObjects(cached.Raw, "modelVersions")[version.ID]; ok {
+			rawVersion = rv
+		}
+		c.Model, c.RawModel = &cached.Model, cached.Raw
+	} else {
+		log.WithError(cached.Err).Warnf("Failed to fetch model %d; its creator and tags are unknown", version.ModelId)
+	}
+
+	modelType := modelTypeFor(model.ID, version.ID, model.Type)
+	versionDir, targetPath := targetPathFor(globalConfig.SavePath, model, modelType, version, file)
+	cleaned := version
+	cleaned.Files, cleaned.Images = nil, nil
+	c.Key = fmt.Sprintf("v_%d", version.ID)
+	c.Remote = true
+	c.PD = potentialDownload{
+		ModelName:         model.Name,
+		ModelType:         modelType,
+		VersionName:       version.Name,
+		BaseModel:         version.BaseModel,
+		Creator:           model.Creator,
+		ModelNsfw:         model.Nsfw,
+		ModelNsfwLevel:    model.NsfwLevel,
+		ModelTags:         model.Tags,
+		File:              file,
+		ModelVersionID:    version.ID,
+		TargetFilepath:    targetPath,
+		Slug:              filepath.Dir(versionDir),
+		VersionDir:        versionDir,
+		FinalBaseFilename: filepath.Base(targetPath),
+		CleanedVersion:    cleaned,
+		FullVersion:       version,
+		OriginalImages:    version.Images,
+		RawVersion:        rawVersion,
+	}
+	return c
+}
+
+// planAdoptTarget decides where a file goes and whether something is in the way.
+func planAdoptTarget(c *adoptCandidate, force bool) {
+	versionID := c.PD.ModelVersionID
+	if c.Remote {
+		// The name a download gets: "<versionID>_" and the uploaded file name
+		c.Target = filepath.Join(globalConfig.SavePath, c.PD.VersionDir, fmt.Sprintf("%d_%s", versionID, filepath.Base(c.PD.File.Name)))
+	} else {
+		name := c.Existing.Filename
+		if name == "" || !strings.HasPrefix(name, fmt.Sprintf("%d_", versionID)) {
+			name = fmt.Sprintf("%d_%s", versionID, filepath.Base(c.Existing.File.Name))
+		}
+		c.Target = filepath.Join(entryVersionDir(globalConfig.SavePath, *c.Existing), name)
+	}
+	c.PD.TargetFilepath = c.Target
+
+	// Already archived: the version's recorded file has these contents
+	if c.Existing != nil && c.Existing.Status == models.StatusDownloaded {
+		if recorded := entryFilePath(globalConfig.SavePath, *c.Existing); sameFileHash(recorded, c.SHA256) {
+			c.Skip = fmt.Sprintf("already archived as %s", recorded)
+			return
+		}
+	}
+	if samePath(c.Target, c.Source) {
+		c.Present = true
+		return
+	}
+	if _, err := os.Lstat(c.Target); err == nil {
+		if sameFileHash(c.Target, c.SHA256) {
+			c.Present = true
+		} else if !force {
+			c.Skip = fmt.Sprintf("%s exists with other contents (use --force to replace it)", c.Target)
+		}
+	}
+}
+
+// adoptFile puts the file in place and records the version as Downloaded.
+func adoptFile(db *database.DB, c *adoptCandidate, mode string) error {
+	if !c.Present {
+		if err := helpers.MkdirAll(filepath.Dir(c.Target), 0755); err != nil {
+			return err
+		}
+		if err := placeAdoptedFile(c.Source, c.Target, mode); err != nil {
+			return err
+		}
+	}
+
+	training := readTrainingMetadata("adopt", db, c.Key, c.Target)
+	var entry models.DatabaseEntry
+	if c.Existing != nil {
+		entry = *c.Existing
+	}
+	entry.Timestamp = time.Now().Unix()
+	entry.Filename = filepath.Base(c.Target)
+	entry.Status = models.StatusDownloaded
+	entry.ErrorDetails, entry.ErrorCategory, entry.ErrorReason = "", "", ""
+	entry.Training = training
+	if c.Remote {
+		entry.ModelName = c.PD.ModelName
+		entry.ModelType = c.PD.ModelType
+		entry.Version = c.PD.CleanedVersion
+		entry.File = c.PD.File
+		entry.Creator = c.PD.Creator
+		entry.Folder = c.PD.Slug
+		entry.VersionDir = c.PD.VersionDir
+		nsfw := c.PD.ModelNsfw
+		entry.ModelNsfw = &nsfw
+		if c.PD.ModelTags != nil {
+			entry.ModelTags = c.PD.ModelTags
+		}
+		if c.PD.ModelNsfwLevel != 0 {
+			entry.ModelNsfwLevel = c.PD.ModelNsfwLevel
+		}
+	}
+	if entry.PinnedHashes == nil || entry.PinnedFileID != entry.File.ID {
+		pinFileHashes(&entry, entry.File)
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return db.Put([]byte(c.Key), data)
+}
+
+// placeAdoptedFile puts src at dst the way mode says. An existing dst is replaced.
+func placeAdoptedFile(src, dst, mode string) error {
+	switch mode {
+	case adoptMove:
+		return helpers.MoveFile(src, dst)
+	case adoptCopy:
+		return helpers.CopyFile(src, dst)
+	case adoptSymlink:
+		return replaceWith(dst, func(tmp string) error { return os.Symlink(src, tmp) })
+	}
+	err := replaceWith(dst, func(tmp string) error { return os.Link(src, tmp) })
+	var linkErr *os.LinkError
+	if errors.As(err, &linkErr) {
+		log.Debugf("Cannot hard link %s (%v); copying it", src, err)
+		return helpers.CopyFile(src, dst)
+	}
+	return err
+}
+
+// replaceWith creates dst through create under a temp name and renames it into place.
+func replaceWith(dst string, create func(tmp string) error) error {
+	tmp := dst + ".adopting"
+	os.Remove(tmp)
+	if err := create(tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// samePath reports whether a and b name the same file.
+func samePath(a, b string) bool {
+	ai, errA := os.Stat(a)
+	bi, errB := os.Stat(b)
+	return errA == nil && errB == nil && os.SameFile(ai, bi)
+}
+
+// adoptIdentifiedBy names how a candidate was identified, for the sidecar.
+func adoptIdentifiedBy(c *adoptCandidate) string {
+	if c.Remote {
+		return "civitai"
+	}
+	return "database"
+}
+
+// fetchVersionByHash looks a file hash up with Civitai's by-hash endpoint.
+func fetchVersionByHash(client *http.Client, sha256Hex string) (models.ModelVersion, []byte, error) {
+	var version models.ModelVersion
+	body, status, err := adoptAPIGet(client, fmt.Sprintf("https://civitai.com/api/v1/model-versions/by-hash/%s", sha256Hex), "by-hash")
+	if status == http.StatusNotFound {
+		return version, nil, errors.New("unknown to Civitai (by-hash lookup found nothing)")
+	}
+	if err != nil {
+		return version, nil, err
+	}
+	if err := api.Decode(body, &version, "model-version"); err != nil {
+		return version, nil, fmt.Errorf("failed to decode the by-hash response: %w", err)
+	}
+	return version, body, nil
+}
+
+// fetchAdoptModel fetches a model for the creator, tags and model info of adopted files.
+func fetchAdoptModel(client *http.Client, modelID int) (models.Model, []byte, error) {
+	var model models.Model
+	body, _, err := adoptAPIGet(client, fmt.Sprintf("https://civitai.com/api/v1/models/%d", modelID), fmt.Sprintf("Model %d", modelID))
+	if err != nil {
+		return model, nil, err
+	}
+	if err := api.Decode(body, &model, "model"); err != nil {
+		return model, nil, fmt.Errorf("failed to decode model %d: %w", modelID, err)
+	}
+	return model, body, nil
+}
+
+// adoptAPIGet sends an API GET with the configured retries and returns the body and
+// status (0 if there was no response).
+func adoptAPIGet(client *http.Client, url, logPrefix string) ([]byte, int, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if globalConfig.ApiKey != "" {
+		req.Header.Add("Authorization", "Bearer "+globalConfig.ApiKey)
+	}
+	maxRetries := viper.GetInt("maxretries")
+	initialRetryDelay := globalRetryDelay
+	resp, body, err := doRequestWithRetry(client, req, maxRetries, initialRetryDelay, logPrefix)
+	status := 0
+	if resp != nil {
+		status = resp.StatusCode
+	}
+	return body, status, err
+}
@@ -0,0 +1,297 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/api"
+	"github.com/dreamfast/go-civitai-downloader/internal/database"
+	"github.com/dreamfast/go-civitai-downloader/internal/failure"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// dbBackfillCmd fills in the fields entries of older releases lack from the API
+var dbBackfillCmd = &cobra.Command{
+	Use:   "backfill",
+	Short: "Fill in the metadata older entries lack (hashes, base model, trained words, permissions)",
+	Long: `Finds the entries recorded by older releases (or from lookups that didn't list
+everything) that lack newer fields: the file's hashes, the version's base model and
+trained words, and the model's permissions (license terms). Each model with such
+entries is looked up once on Civitai, and only the missing fields of its entries are
+filled in; what an entry already has is never replaced. A version the model no longer
+lists is looked up on its own, which gives everything but the permissions.
+
+Requests are spaced by ApiDelayMs and retried like other API calls. Each model's
+entries are saved right after its lookup and marked with backfilledAt, so an
+interrupted run (or one stopped by a rate limit) continues with the models it didn't
+get to; --retry looks up the marked entries that still lack fields again. --limit
+caps the models looked up per run, and --check only reports what is missing.
+File hashes that were filled in are API hashes: run 'db verify' to check the files
+against them.`,
+	Example: `  civitai-downloader db backfill --check
+  civitai-downloader db backfill --limit 500`,
+	Args: cobra.NoArgs,
+	Run:  runDbBackfill,
+}
+
+func init() {
+	dbCmd.AddCommand(dbBackfillCmd)
+	dbBackfillCmd.Flags().Bool("check", false, "Only report the entries with missing fields")
+	dbBackfillCmd.Flags().Int("limit", 0, "Look up at most this many models (0 for all)")
+	dbBackfillCmd.Flags().Bool("retry", false, "Also look up entries an earlier backfill couldn't complete")
+}
+
+// Fields db backfill fills in.
+const (
+	backfillHashes       = "hashes"
+	backfillBaseModel    = "base model"
+	backfillTrainedWords = "trained words"
+	backfillPermissions  = "permissions"
+)
+
+// backfillMissing returns the backfilled fields the entry lacks.
+func backfillMissing(entry models.DatabaseEntry) []string {
+	var missing []string
+	if entry.File.Hashes.SHA256 == "" {
+		missing = append(missing, backfillHashes)
+	}
+	if entry.Version.BaseModel == "" {
+		missing = append(missing, backfillBaseModel)
+	}
+	if entry.Version.TrainedWords == nil { // Listed as [] when a version has none
+		missing = append(missing, backfillTrainedWords)
+	}
+	if entry.Permissions == nil {
+		missing = append(missing, backfillPermissions)
+	}
+	return missing
+}
+
+// fillFromVersion fills the missing version and file fields of an entry from the
+// version as the API lists it.
+func fillFromVersion(entry *models.DatabaseEntry, version models.ModelVersion) {
+	if entry.Version.BaseModel == "" {
+		entry.Version.BaseModel = version.BaseModel
+	}
+	if entry.Version.TrainedWords == nil && version.TrainedWords != nil {
+		entry.Version.TrainedWords = version.TrainedWords
+	}
+	for _, file := range version.Files {
+		if file.ID != entry.File.ID && (entry.File.ID != 0 || file.Name != entry.File.Name) {
+			continue
+		}
+		h := &entry.File.Hashes
+		for have, api := range map[*string]string{&h.SHA256: file.Hashes.SHA256, &h.AutoV2: file.Hashes.AutoV2, &h.CRC32: file.Hashes.CRC32, &h.BLAKE3: file.Hashes.BLAKE3} {
+			if *have == "" {
+				*have = api
+			}
+		}
+		break
+	}
+}
+
+func runDbBackfill(cmd *cobra.Command, args []string) {
+	checkOnly, _ := cmd.Flags().GetBool("check")
+	limit, _ := cmd.Flags().GetInt("limit")
+	retry, _ := cmd.Flags().GetBool("retry")
+
+	if globalConfig.DatabasePath == "" {
+		log.Fatal("Database path is not set in the configuration. Please check config file or path.")
+	}
+	db, err := database.Open(globalConfig.DatabasePath)
+	if err != nil {
+		log.WithError(err).Fatalf("Failed to open database at %s", globalConfig.DatabasePath)
+	}
+	defer db.Close()
+
+	byModel := make(map[int][]string) // Model ID -> keys of its entries to backfill
+	fieldCounts := make(map[string]int)
+	entries, skipped := 0, 0
+	err = db.Fold(func(key []byte, value []byte) error {
+		if !strings.HasPrefix(string(key), "v_") {
+			return nil
+		}
+		var entry models.DatabaseEntry
+		if json.Unmarshal(value, &entry) != nil {
+			return nil
+		}
+		missing := backfillMissing(entry)
+		if len(missing) == 0 {
+			return nil
+		}
+		if entry.BackfilledAt != 0 && !retry {
+			skipped++
+			return nil
+		}
+		for _, field := range missing {
+			fieldCounts[field]++
+		}
+		entries++
+		byModel[entry.Version.ModelId] = append(byModel[entry.Version.ModelId], string(key))
+		return nil
+	})
+	if err != nil {
+		log.WithError(err).Fatal("Failed to read the database")
+	}
+
+	if entries == 0 {
+		if skipped > 0 {
+			fmt.Printf("Nothing to backfill; %d entr(ies) still lack fields after an earlier backfill (use --retry to look them up again).\n", skipped)
+		} else {
+			fmt.Println("Nothing to backfill: every entry has the current fields.")
+		}
+		return
+	}
+	var counts []string
+	for _, field := range []string{backfillHashes, backfillBaseModel, backfillTrainedWords, backfillPermissions} {
+		if fieldCounts[field] > 0 {
+			counts = append(counts, fmt.Sprintf("%d without %s", fieldCounts[field], field))
+		}
+	}
+	fmt.Printf("%d entr(ies) of %d model(s) lack fields: %s.\n", entries, len(byModel), strings.Join(counts, ", "))
+	if checkOnly {
+		return
+	}
+
+	modelIDs := make([]int, 0, len(byModel))
+	for id := range byModel {
+		modelIDs = append(modelIDs, id)
+	}
+	sort.Ints(modelIDs)
+	if limit > 0 && len(modelIDs) > limit {
+		modelIDs = modelIDs[:limit]
+	}
+
+	client := &http.Client{Timeout: time.Duration(globalConfig.ApiClientTimeoutSec) * time.Second, Transport: globalHttpTransport}
+	delay := time.Duration(viper.GetInt("apidelayms")) * time.Millisecond
+	var stats backfillStats
+	// lookup GETs an API object into v. It returns false without an error for one that is
+	// gone upstream, and an error of the RateLimit category once Civitai throttles us.
+	lookup := func(path, label, kind string, v any) (bool, error) {
+		if stats.requests > 0 && delay > 0 {
+			time.Sleep(delay)
+		}
+		stats.requests++
+		body, status, err := adoptAPIGet(client, "https://civitai.com/api/v1/"+path, label)
+		if status == http.StatusNotFound || status == http.StatusGone {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		return true, api.Decode(body, v, kind)
+	}
+	stopped := func(err error) bool {
+		if failure.CategoryOf(err) != failure.RateLimit {
+			return false
+		}
+		log.WithError(err).Warn("Civitai is limiting the requests; stopping. Run db backfill again later to continue.")
+		stats.print()
+		return true
+	}
+
+	for _, modelID := range modelIDs {
+		var model models.Model
+		haveModel, err := lookup(fmt.Sprintf("models/%d", modelID), fmt.Sprintf("Model %d", modelID), "model", &model)
+		if err != nil {
+			if stopped(err) {
+				return
+			}
+			log.WithError(err).Warnf("Failed to look model %d up; it is left for the next run", modelID)
+			continue
+		}
+		if !haveModel {
+			log.Infof("Model %d is no longer on Civitai; looking its versions up on their own", modelID)
+		}
+		stats.models++
+
+		for _, key := range byModel[modelID] {
+			raw, err := db.Get([]byte(key))
+			if err != nil {
+				continue
+			}
+			var entry models.DatabaseEntry
+			if json.Unmarshal(raw, &entry) != nil {
+				continue
+			}
+			before, hadHashes := len(backfillMissing(entry)), entry.File.Hashes.SHA256 != ""
+
+			var version *models.ModelVersion
+			if haveModel {
+				if entry.Permissions == nil {
+					entry.Permissions = model.Permissions()
+				}
+				for i := range model.ModelVersions {
+					if model.ModelVersions[i].ID == entry.Version.ID {
+						version = &model.ModelVersions[i]
+						break
+					}
+				}
+			}
+			// A version lookup doesn't list permissions, so it is only worth it for the rest
+			if missing := backfillMissing(entry); version == nil && len(missing) > 0 && (len(missing) > 1 || entry.Permissions != nil) {
+				var v models.ModelVersion
+				found, err := lookup(fmt.Sprintf("model-versions/%d", entry.Version.ID), fmt.Sprintf("Version %d", entry.Version.ID), "model-version", &v)
+				if err != nil {
+					if stopped(err) {
+						return
+					}
+					log.WithError(err).Warnf("Failed to look version %d up; it is left for the next run", entry.Version.ID)
+					continue
+				}
+				if found {
+					version = &v
+				} else {
+					log.Infof("Version %d (%s) is no longer on Civitai", entry.Version.ID, key)
+				}
+			}
+			if version != nil {
+				fillFromVersion(&entry, *version)
+			}
+
+			missing := backfillMissing(entry)
+			if len(missing) > 0 {
+				stats.incomplete++
+				log.Infof("%s (%s): still without %s", key, entry.ModelName, strings.Join(missing, ", "))
+			}
+			if len(missing) < before {
+				stats.updated++
+				if !hadHashes && entry.File.Hashes.SHA256 != "" {
+					stats.hashes++
+				}
+			}
+			if err := updateDbEntry(db, key, entry.Status, func(e *models.DatabaseEntry) {
+				e.File.Hashes = entry.File.Hashes
+				e.Version.BaseModel, e.Version.TrainedWords = entry.Version.BaseModel, entry.Version.TrainedWords
+				e.Permissions = entry.Permissions
+				e.BackfilledAt = time.Now().Unix()
+			}); err != nil {
+				log.WithError(err).Warnf("Failed to save the backfilled fields of %s", key)
+			}
+		}
+	}
+	stats.print()
+	if remaining := len(byModel) - len(modelIDs); remaining > 0 {
+		fmt.Printf("%d model(s) left for the next run (--limit).\n", remaining)
+	}
+}
+
+// backfillStats counts what a db backfill run did.
+type backfillStats struct {
+	requests, models, updated, incomplete, hashes int
+}
+
+func (s backfillStats) print() {
+	fmt.Printf("Looked up %d model(s) with %d request(s): %d entr(ies) updated, %d still lacking fields.\n", s.models, s.requests, s.updated, s.incomplete)
+	if s.hashes > 0 {
+		fmt.Printf("%d entr(ies) got their file hashes; run 'db verify' to check the files against them.\n", s.hashes)
+	}
+}
@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/database"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// dbCheckRemovedCmd asks Civitai about every downloaded version to notice upstream removals
+var dbCheckRemovedCmd = &cobra.Command{
+	Use:   "check-removed",
+	Short: "Check whether downloaded versions still exist on Civitai",
+	Long: `Looks every downloaded version up on Civitai. A version the API answers 404 for is
+not treated as removed right away, since models are often hidden only while a review
+runs: the first 404 starts RemovalGracePeriod, and the removal is confirmed once
+RemovalChecks checks spread over that period found it missing. Only then is
+RemovalPolicy applied (report, move to RemovalDir or prune). A version that is found
+again clears its suspected or confirmed removal. Every change is appended to
+[SavePath]/removed-upstream.jsonl.
+
+Download runs already check the suspected removals that are due; run this now and then
+(e.g. from cron) to find new ones among versions no query lists anymore. --suspected
+only checks the versions with a suspected removal, ignoring the spacing of the checks.`,
+	Example: `  civitai-downloader db check-removed
+  civitai-downloader db check-removed --suspected`,
+	Run: runDbCheckRemoved,
+}
+
+func init() {
+	dbCmd.AddCommand(dbCheckRemovedCmd)
+	dbCheckRemovedCmd.Flags().Bool("suspected", false, "Only check the versions already missing upstream")
+}
+
+func runDbCheckRemoved(cmd *cobra.Command, args []string) {
+	suspected, _ := cmd.Flags().GetBool("suspected")
+
+	if globalConfig.DatabasePath == "" {
+		log.Fatal("Database path is not set in the configuration. Please check config file or path.")
+	}
+	if _, err := loadRemovalSettings(); err != nil {
+		log.Fatal(err)
+	}
+
+	db, err := database.Open(globalConfig.DatabasePath)
+	if err != nil {
+		log.WithError(err).Fatalf("Failed to open database at %s", globalConfig.DatabasePath)
+	}
+	defer db.Close()
+	loadPathOverrides(db)
+
+	apiClient := &http.Client{Timeout: time.Duration(globalConfig.ApiClientTimeoutSec) * time.Second, Transport: globalHttpTransport}
+	mode := recheckAll
+	if suspected {
+		mode = recheckSuspected
+	}
+	checked, missing, err := recheckRemovals(db, apiClient, globalConfig.SavePath, mode)
+	if err != nil {
+		log.Fatalf("Checking for upstream removals failed: %v", err)
+	}
+	fmt.Printf("Checked %d version(s): %d missing upstream.\n", checked, missing)
+	if missing > 0 {
+		fmt.Printf("See %s for the state of each.\n", filepath.Join(globalConfig.SavePath, removalReportFile))
+	}
+}
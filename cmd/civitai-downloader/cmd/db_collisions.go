@@ -0,0 +1,180 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/database"
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// dbCollisionsCmd lists the names that more than one model or version in the library has
+var dbCollisionsCmd = &cobra.Command{
+	Use:   "collisions",
+	Short: "List models and versions that share a name, and directories they share",
+	Long: `Audits the library for names that don't tell things apart: models of the same type whose
+names slug the same (and so get the same {type}/{model} directory), versions of one model
+with the same name, and version directories that hold files of more than one model.
+
+Each model is listed with its ID and model directory, so it shows whether the names
+still collide on disk. Set DisambiguateNames = true to put the IDs into {model},
+{version} and the model directories, then run migrate-paths to move the files already
+downloaded.`,
+	Args: cobra.NoArgs,
+	Run:  runDbCollisions,
+}
+
+func init() {
+	dbCmd.AddCommand(dbCollisionsCmd)
+}
+
+// collisionModel is a model as the audit sees it.
+type collisionModel struct {
+	ID       int
+	Name     string
+	Dir      string                  // Model directory, relative to SavePath
+	Versions map[string]map[int]bool // Version name slug -> IDs of the versions with it
+}
+
+func runDbCollisions(cmd *cobra.Command, args []string) {
+	if globalConfig.DatabasePath == "" || globalConfig.SavePath == "" {
+		log.Fatal("DatabasePath and SavePath must be set in the configuration.")
+	}
+	db, err := database.Open(globalConfig.DatabasePath)
+	if err != nil {
+		log.WithError(err).Fatalf("Failed to open database at %s", globalConfig.DatabasePath)
+	}
+	defer db.Close()
+	loadPathOverrides(db)
+
+	byName := make(map[string]map[int]*collisionModel) // type/name slug -> models
+	dirModels := make(map[string]map[int]bool)         // Version directory -> model IDs
+	err = db.Fold(func(key []byte, value []byte) error {
+		if !strings.HasPrefix(string(key), "v_") {
+			return nil
+		}
+		var entry models.DatabaseEntry
+		if json.Unmarshal(value, &entry) != nil {
+			return nil
+		}
+		modelID := entry.Version.ModelId
+		name := helpers.ConvertToSlug(entry.ModelType) + "/" + helpers.ConvertToSlug(entry.ModelName)
+		if byName[name] == nil {
+			byName[name] = make(map[int]*collisionModel)
+		}
+		m := byName[name][modelID]
+		if m == nil {
+			dir, _ := filepath.Rel(globalConfig.SavePath, entryModelDir(globalConfig.SavePath, entry))
+			m = &collisionModel{ID: modelID, Name: entry.ModelName, Dir: dir, Versions: make(map[string]map[int]bool)}
+			byName[name][modelID] = m
+		}
+		version := helpers.ConvertToSlug(entry.Version.Name)
+		if m.Versions[version] == nil {
+			m.Versions[version] = make(map[int]bool)
+		}
+		m.Versions[version][entry.Version.ID] = true
+
+		dir, _ := filepath.Rel(globalConfig.SavePath, entryVersionDir(globalConfig.SavePath, entry))
+		if dirModels[dir] == nil {
+			dirModels[dir] = make(map[int]bool)
+		}
+		dirModels[dir][modelID] = true
+		return nil
+	})
+	if err != nil {
+		log.WithError(err).Fatal("Failed to read the database")
+	}
+
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	sharedNames, sharedModelDirs := 0, 0
+	for _, name := range names {
+		group := byName[name]
+		if len(group) < 2 {
+			continue
+		}
+		if sharedNames == 0 {
+			fmt.Println("Models sharing a name:")
+		}
+		sharedNames++
+		dirs := make(map[string]bool)
+		for _, m := range sortedCollisionModels(group) {
+			fmt.Printf("  %-40s %8d  %s\n", m.Name, m.ID, m.Dir)
+			dirs[m.Dir] = true
+		}
+		if len(dirs) < len(group) {
+			sharedModelDirs++
+		}
+	}
+
+	sharedVersions := 0
+	for _, name := range names {
+		for _, m := range sortedCollisionModels(byName[name]) {
+			var dupes []string
+			for version, ids := range m.Versions {
+				if len(ids) > 1 {
+					dupes = append(dupes, fmt.Sprintf("%s (%d versions)", version, len(ids)))
+				}
+			}
+			if len(dupes) == 0 {
+				continue
+			}
+			if sharedVersions == 0 {
+				fmt.Println("Versions sharing a name within a model:")
+			}
+			sharedVersions++
+			sort.Strings(dupes)
+			fmt.Printf("  %s (%d): %s\n", m.Name, m.ID, strings.Join(dupes, ", "))
+		}
+	}
+
+	var sharedDirs []string
+	for dir, ids := range dirModels {
+		if len(ids) > 1 {
+			sharedDirs = append(sharedDirs, dir)
+		}
+	}
+	sort.Strings(sharedDirs)
+	if len(sharedDirs) > 0 {
+		fmt.Println("Version directories holding files of more than one model:")
+	}
+	for _, dir := range sharedDirs {
+		ids := make([]string, 0, len(dirModels[dir]))
+		for id := range dirModels[dir] {
+			ids = append(ids, fmt.Sprint(id))
+		}
+		sort.Strings(ids)
+		fmt.Printf("  %s: models %s\n", dir, strings.Join(ids, ", "))
+	}
+
+	if sharedNames == 0 && sharedVersions == 0 && len(sharedDirs) == 0 {
+		fmt.Println("No models or versions share a name.")
+		return
+	}
+	fmt.Printf("%d name(s) shared by several models (%d in one model directory), %d model(s) with versions sharing a name, %d shared version director(ies).\n",
+		sharedNames, sharedModelDirs, sharedVersions, len(sharedDirs))
+	if sharedModelDirs > 0 || len(sharedDirs) > 0 {
+		fmt.Println("Set DisambiguateNames = true and run migrate-paths to give them directories of their own.")
+	}
+}
+
+// sortedCollisionModels returns the models of a name group by ID.
+func sortedCollisionModels(group map[int]*collisionModel) []*collisionModel {
+	list := make([]*collisionModel, 0, len(group))
+	for _, m := range group {
+		list = append(list, m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
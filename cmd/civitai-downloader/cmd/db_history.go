@@ -0,0 +1,296 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/database"
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// dbHistoryCmd lists the event log of the library, or reconstructs the library at a date
+var dbHistoryCmd = &cobra.Command{
+	Use:   "history",
+	Short: "Show what happened to the library's files, or what it held at a past date",
+	Long: `Every change of a downloaded file is recorded in the database as it happens: a file
+added (downloaded or adopted), replaced by one with other hashes, moved, pruned by a
+policy, or removed (the entry was deleted or stopped being downloaded), and every file
+'db verify' found missing or mismatched. The log is only ever added to.
+
+Without --at the events are listed oldest first; an "added" event for a model that
+already had a version in the library is shown as "upgraded". --since and --until take
+a date (2025-06-01), a time (2025-06-01T14:00) or an age (7d, 12h).
+
+--at reconstructs the library at a date instead: the files it held then, with their
+paths at the time. Files downloaded before the log was started count from the time
+their entry was created.`,
+	Example: `  civitai-downloader db history --since 30d
+  civitai-downloader db history --model-id 4201
+  civitai-downloader db history --event pruned,removed --json
+  civitai-downloader db history --at 2025-06-01`,
+	Args: cobra.NoArgs,
+	Run:  runDbHistory,
+}
+
+func init() {
+	dbCmd.AddCommand(dbHistoryCmd)
+	dbHistoryCmd.Flags().Int("model-id", 0, "Only events of this model")
+	dbHistoryCmd.Flags().Int("version-id", 0, "Only events of this model version")
+	dbHistoryCmd.Flags().String("since", "", "Only events at or after this date, time or age (e.g. 2025-06-01, 7d)")
+	dbHistoryCmd.Flags().String("until", "", "Only events before this date, time or age")
+	dbHistoryCmd.Flags().StringSlice("event", nil, "Only these kinds of event (added, upgraded, replaced, moved, pruned, removed, verify-failed)")
+	dbHistoryCmd.Flags().String("at", "", "List the files the library held at this date, time or age instead")
+	dbHistoryCmd.Flags().Bool("json", false, "Print JSON lines instead of a table")
+}
+
+// eventUpgraded labels an added version of a model that already had one in the library.
+const eventUpgraded = "upgraded"
+
+// parseHistoryTime reads a date ("2006-01-02", local), a time ("2006-01-02T15:04" or
+// RFC 3339) or an age before now ("7d", "12h").
+func parseHistoryTime(value string, now time.Time) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	if age, err := parseWatchJobDuration(value); err == nil && age >= 0 {
+		return now.Add(-age), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q (use 2025-06-01, 2025-06-01T14:00 or an age such as 7d)", value)
+}
+
+// labelUpgrades renames the "added" events of models that already had another version in
+// the library at the time to "upgraded". events must be all events, oldest first.
+func labelUpgrades(events []database.HistoryEvent) {
+	present := make(map[int]map[string]bool) // Model ID -> keys in the library
+	for i, event := range events {
+		keys := present[event.ModelID]
+		if keys == nil {
+			keys = make(map[string]bool)
+			present[event.ModelID] = keys
+		}
+		switch event.Event {
+		case database.EventAdded:
+			for key := range keys {
+				if key != event.Key {
+					events[i].Event = eventUpgraded
+					break
+				}
+			}
+			keys[event.Key] = true
+		case database.EventReplaced, database.EventMoved, database.EventVerifyFailed:
+			keys[event.Key] = true // Was in the library, if from before the log
+		case database.EventPruned, database.EventRemoved:
+			delete(keys, event.Key)
+		}
+	}
+}
+
+// libraryFile is a file of the library at some time.
+type libraryFile struct {
+	Key         string  `json:"key"`
+	ModelID     int     `json:"modelId"`
+	ModelName   string  `json:"modelName"`
+	VersionID   int     `json:"versionId"`
+	VersionName string  `json:"versionName,omitempty"`
+	Path        string  `json:"path"`
+	SHA256      string  `json:"sha256,omitempty"`
+	SizeKB      float64 `json:"sizeKB,omitempty"`
+	Since       string  `json:"since"` // When it was added (or its entry created, if before the log)
+}
+
+// libraryAt reconstructs the files the library held at t from the events (all of them,
+// oldest first) and the current entries. A key's state at t is the one its last event
+// up to t left; a key whose first event is later and isn't "added" was in the library
+// from when its entry was created, as is a downloaded entry without any event.
+func libraryAt(events []database.HistoryEvent, entries map[string]models.DatabaseEntry, t time.Time) []libraryFile {
+	byKey := make(map[string][]database.HistoryEvent)
+	for _, event := range events {
+		byKey[event.Key] = append(byKey[event.Key], event)
+	}
+	var files []libraryFile
+	fromEvent := func(event database.HistoryEvent, since time.Time) libraryFile {
+		return libraryFile{
+			Key: event.Key, ModelID: event.ModelID, ModelName: event.ModelName, VersionID: event.VersionID, VersionName: event.VersionName,
+			Path: event.Path(), SHA256: event.SHA256, SizeKB: event.SizeKB, Since: since.Format(time.RFC3339),
+		}
+	}
+	for key, keyEvents := range byKey {
+		var last *database.HistoryEvent
+		var added time.Time
+		for i := range keyEvents {
+			if keyEvents[i].Time.After(t) {
+				break
+			}
+			last = &keyEvents[i]
+			if last.Event == database.EventAdded {
+				added = last.Time
+			}
+		}
+		if last == nil {
+			// Nothing recorded up to t: only a file from before the log can have been there
+			first := keyEvents[0]
+			entry, ok := entries[key]
+			created := time.Unix(entry.Timestamp, 0)
+			if first.Event == database.EventAdded || !ok || entry.Timestamp == 0 || created.After(t) {
+				continue
+			}
+			file := fromEvent(first, created)
+			switch first.Event {
+			case database.EventMoved:
+				file.Path = first.From
+			case database.EventReplaced:
+				file.SHA256 = first.PrevSHA256
+			}
+			files = append(files, file)
+			continue
+		}
+		switch last.Event {
+		case database.EventPruned, database.EventRemoved:
+			continue
+		}
+		if added.IsZero() {
+			added = time.Unix(entries[key].Timestamp, 0)
+		}
+		files = append(files, fromEvent(*last, added))
+	}
+	for key, entry := range entries {
+		created := time.Unix(entry.Timestamp, 0)
+		if _, logged := byKey[key]; logged || entry.Status != models.StatusDownloaded || entry.Timestamp == 0 || created.After(t) {
+			continue
+		}
+		file := fromEvent(database.NewHistoryEvent("", key, entry, ""), created)
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files
+}
+
+func runDbHistory(cmd *cobra.Command, args []string) {
+	modelID, _ := cmd.Flags().GetInt("model-id")
+	versionID, _ := cmd.Flags().GetInt("version-id")
+	sinceFlag, _ := cmd.Flags().GetString("since")
+	untilFlag, _ := cmd.Flags().GetString("until")
+	kinds, _ := cmd.Flags().GetStringSlice("event")
+	atFlag, _ := cmd.Flags().GetString("at")
+	jsonOut, _ := cmd.Flags().GetBool("json")
+
+	now := time.Now()
+	var since, until, at time.Time
+	var err error
+	for _, f := range []struct {
+		value string
+		into  *time.Time
+	}{{sinceFlag, &since}, {untilFlag, &until}, {atFlag, &at}} {
+		if f.value == "" {
+			continue
+		}
+		if *f.into, err = parseHistoryTime(f.value, now); err != nil {
+			log.Fatal(err)
+		}
+	}
+	for _, kind := range kinds {
+		switch strings.ToLower(kind) {
+		case database.EventAdded, eventUpgraded, database.EventReplaced, database.EventMoved, database.EventPruned, database.EventRemoved, database.EventVerifyFailed:
+		default:
+			log.Fatalf("Unknown event %q (use added, upgraded, replaced, moved, pruned, removed or verify-failed)", kind)
+		}
+	}
+
+	if globalConfig.DatabasePath == "" {
+		log.Fatal("Database path is not set in the configuration. Please check config file or path.")
+	}
+	db, err := database.Open(globalConfig.DatabasePath)
+	if err != nil {
+		log.WithError(err).Fatalf("Failed to open database at %s", globalConfig.DatabasePath)
+	}
+	defer db.Close()
+
+	events, err := db.History(nil)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to read the history")
+	}
+
+	if atFlag != "" {
+		entries := make(map[string]models.DatabaseEntry)
+		err := db.Fold(func(key []byte, value []byte) error {
+			var entry models.DatabaseEntry
+			if strings.HasPrefix(string(key), "v_") && json.Unmarshal(value, &entry) == nil {
+				entries[string(key)] = entry
+			}
+			return nil
+		})
+		if err != nil {
+			log.WithError(err).Fatal("Failed to read the database")
+		}
+		printLibraryAt(libraryAt(events, entries, at), modelID, versionID, at, jsonOut)
+		return
+	}
+
+	labelUpgrades(events)
+	shown := 0
+	for _, event := range events {
+		if (modelID != 0 && event.ModelID != modelID) || (versionID != 0 && event.VersionID != versionID) ||
+			(!since.IsZero() && event.Time.Before(since)) || (!until.IsZero() && !event.Time.Before(until)) ||
+			(len(kinds) > 0 && !containsFold(kinds, event.Event)) {
+			continue
+		}
+		shown++
+		if jsonOut {
+			line, _ := json.Marshal(event)
+			fmt.Println(string(line))
+			continue
+		}
+		detail := event.Detail
+		switch {
+		case event.From != "":
+			detail = "from " + event.From
+		case event.PrevSHA256 != "":
+			detail = "was SHA256 " + event.PrevSHA256
+		}
+		fmt.Printf("%s  %-13s %-10s %s - %s  %s", event.Time.Local().Format("2006-01-02 15:04"), event.Event, event.Key, event.ModelName, event.VersionName, event.Path())
+		if detail != "" {
+			fmt.Printf("  (%s)", detail)
+		}
+		fmt.Println()
+	}
+	if !jsonOut {
+		if len(events) == 0 {
+			fmt.Println("No history recorded yet; events are recorded from now on.")
+		} else {
+			fmt.Fprintf(os.Stderr, "%d event(s); the log starts %s.\n", shown, events[0].Time.Local().Format("2006-01-02 15:04"))
+		}
+	}
+}
+
+// printLibraryAt prints the files of a reconstructed library.
+func printLibraryAt(files []libraryFile, modelID, versionID int, at time.Time, jsonOut bool) {
+	var total float64
+	count := 0
+	for _, file := range files {
+		if (modelID != 0 && file.ModelID != modelID) || (versionID != 0 && file.VersionID != versionID) {
+			continue
+		}
+		count++
+		total += file.SizeKB
+		if jsonOut {
+			line, _ := json.Marshal(file)
+			fmt.Println(string(line))
+			continue
+		}
+		fmt.Printf("%-10s %s - %s  %s\n", file.Key, file.ModelName, file.VersionName, file.Path)
+	}
+	if !jsonOut {
+		fmt.Fprintf(os.Stderr, "%d file(s), %s, in the library at %s.\n", count, helpers.BytesToSize(uint64(total*1024)), at.Local().Format("2006-01-02 15:04"))
+	}
+}
@@ -0,0 +1,127 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/database"
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// dbCompactCmd rewrites the database to reclaim the space of old records
+var dbCompactCmd = &cobra.Command{
+	Use:   "compact",
+	Short: "Rewrite the database to reclaim the space of overwritten and deleted records",
+	Long: `The database appends every write, so entries that are updated often (every run
+refreshes the entries it sees) leave old copies behind and the files grow far beyond
+their content. compact rewrites the store with only the current value of every key and
+reports the size before and after.
+
+Run it while no other command uses the database.`,
+	Run: runDbCompact,
+}
+
+// dbFsckCmd checks every record of the database and repairs what it can
+var dbFsckCmd = &cobra.Command{
+	Use:   "fsck",
+	Short: "Check the database's records and repair recoverable inconsistencies",
+	Long: `Reads every record and checks that it decodes, that entries have the version ID of
+their key, a known status and a file name when downloaded, that the secondary indexes
+match the entries, and that bookkeeping keys (page states, path overrides, the schema
+version) hold valid values.
+
+With --repair a backup is taken (<DatabasePath>.backup-<timestamp>) and the recoverable
+problems are fixed: missing version IDs and statuses are filled in, stale error fields
+cleared, invalid page states dropped and the indexes rebuilt. Unreadable records and
+entries that contradict their key are only reported. The command exits with status 1
+while problems remain.`,
+	Example: `  civitai-downloader db fsck
+  civitai-downloader db fsck --repair && civitai-downloader db compact`,
+	Run: runDbFsck,
+}
+
+func init() {
+	dbCmd.AddCommand(dbCompactCmd)
+	dbCmd.AddCommand(dbFsckCmd)
+	dbFsckCmd.Flags().Bool("repair", false, "Back the database up and fix the recoverable problems")
+}
+
+func runDbCompact(cmd *cobra.Command, args []string) {
+	if globalConfig.DatabasePath == "" {
+		log.Fatal("Database path is not set in the configuration. Please check config file or path.")
+	}
+
+	db, err := database.Open(globalConfig.DatabasePath)
+	if err != nil {
+		log.WithError(err).Fatalf("Failed to open database at %s", globalConfig.DatabasePath)
+	}
+	defer db.Close()
+
+	before, after, err := db.Compact()
+	if err != nil {
+		log.Fatalf("Compacting the database failed: %v", err)
+	}
+	fmt.Printf("Keys:        %d\n", after.Keys)
+	fmt.Printf("Before:      %s in %d file(s) (%s reclaimable)\n", helpers.BytesToSize(uint64(before.Size)), before.Datafiles, helpers.BytesToSize(uint64(before.Reclaimable)))
+	fmt.Printf("After:       %s in %d file(s)\n", helpers.BytesToSize(uint64(after.Size)), after.Datafiles)
+	if saved := before.Size - after.Size; saved > 0 {
+		fmt.Printf("Reclaimed:   %s\n", helpers.BytesToSize(uint64(saved)))
+	}
+}
+
+func runDbFsck(cmd *cobra.Command, args []string) {
+	repair, _ := cmd.Flags().GetBool("repair")
+
+	if globalConfig.DatabasePath == "" {
+		log.Fatal("Database path is not set in the configuration. Please check config file or path.")
+	}
+
+	db, err := database.Open(globalConfig.DatabasePath)
+	if err != nil {
+		log.WithError(err).Fatalf("Failed to open database at %s", globalConfig.DatabasePath)
+	}
+	defer db.Close()
+
+	report, err := db.Fsck(globalConfig.DatabasePath, repair)
+	if err != nil {
+		if report.BackupPath != "" {
+			log.Errorf("Repair stopped part-way; the original database is preserved at %s", report.BackupPath)
+		}
+		log.Fatalf("Database check failed: %v", err)
+	}
+
+	fmt.Printf("Keys checked:   %d (%d entries)\n", report.Keys, report.Entries)
+	fixable := 0
+	for _, issue := range report.Issues {
+		state := "unfixable"
+		switch {
+		case issue.Fixed:
+			state = "fixed"
+		case issue.Fixable:
+			state = "fixable"
+			fixable++
+		}
+		fmt.Printf("  [%s] %s: %s (%s)\n", state, issue.Key, issue.Detail, issue.Kind)
+	}
+	if report.BackupPath != "" {
+		fmt.Printf("Backup:         %s\n", report.BackupPath)
+	}
+	unfixed := report.Unfixed()
+	switch {
+	case len(report.Issues) == 0:
+		fmt.Println("No problems found.")
+	case len(unfixed) == 0:
+		fmt.Printf("Repaired %d problem(s).\n", len(report.Issues))
+	default:
+		fmt.Printf("%d problem(s) remain", len(unfixed))
+		if fixable > 0 {
+			fmt.Printf(", %d of them fixable with --repair", fixable)
+		}
+		fmt.Println(".")
+		db.Close()
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,164 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/database"
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// dbSetPathCmd keeps a model's files in a fixed directory instead of the PathTemplate layout
+var dbSetPathCmd = &cobra.Command{
+	Use:   "set-path <model-id> [<relative-path>]",
+	Short: "Keep a model's files in a custom directory instead of the PathTemplate layout",
+	Long: `Sets a path override for a model: its files are kept in <relative-path> (below SavePath)
+instead of the directory PathTemplate puts them in, e.g. for a checkpoint a workflow
+expects at a fixed place. Every version of the model shares the directory.
+
+The versions already in the database are moved there right away, the same way
+migrate-paths moves them, and the model's "latest" link is updated. From then on
+downloads, db verify, db adopt, migrate-paths and the latest link use the override;
+clean covers it as part of SavePath. --clear removes the override and moves the
+files back to where PathTemplate puts them.`,
+	Example: `  civitai-downloader db set-path 133005 checkpoints/juggernaut --dry-run
+  civitai-downloader db set-path 133005 --clear --yes`,
+	Args: cobra.RangeArgs(1, 2),
+	Run:  runDbSetPath,
+}
+
+func init() {
+	dbCmd.AddCommand(dbSetPathCmd)
+	dbSetPathCmd.Flags().Bool("clear", false, "Remove the override; the files go back to the PathTemplate layout")
+	dbSetPathCmd.Flags().Bool("dry-run", false, "Only list the moves")
+	dbSetPathCmd.Flags().BoolP("yes", "y", false, "Skip the confirmation prompt")
+	dbSetPathCmd.Flags().StringSlice("relink", []string{}, "Directory with symlinks into SavePath (e.g. a UI's models folder) to retarget (repeatable)")
+}
+
+func runDbSetPath(cmd *cobra.Command, args []string) {
+	clearOverride, _ := cmd.Flags().GetBool("clear")
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+	skipConfirm, _ := cmd.Flags().GetBool("yes")
+	relinkDirs, _ := cmd.Flags().GetStringSlice("relink")
+
+	modelID, err := modelIDArg(args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	if clearOverride == (len(args) == 2) {
+		log.Fatal("Give either a <relative-path> or --clear.")
+	}
+	var dir string
+	if !clearOverride {
+		if dir, err = cleanPathOverride(args[1]); err != nil {
+			log.Fatal(err)
+		}
+	}
+	template := pathTemplate()
+	if err := helpers.ValidatePathTemplate(template); err != nil {
+		log.Fatalf("Invalid PathTemplate: %v", err)
+	}
+	if err := validateNsfwPartition(); err != nil {
+		log.Fatal(err)
+	}
+	if globalConfig.DatabasePath == "" || globalConfig.SavePath == "" {
+		log.Fatal("DatabasePath and SavePath must be set in the configuration.")
+	}
+
+	db, err := database.Open(globalConfig.DatabasePath)
+	if err != nil {
+		log.WithError(err).Fatalf("Failed to open database at %s", globalConfig.DatabasePath)
+	}
+	defer db.Close()
+
+	overrides, err := db.PathOverrides()
+	if err != nil {
+		log.WithError(err).Fatal("Failed to read the database")
+	}
+	previous, had := overrides[modelID]
+	if clearOverride && !had {
+		fmt.Printf("Model %d has no path override.\n", modelID)
+		return
+	}
+	if !clearOverride && had && previous == dir {
+		fmt.Printf("Model %d already has the path override %s; checking its files.\n", modelID, dir)
+	}
+	if clearOverride {
+		delete(overrides, modelID)
+	} else {
+		overrides[modelID] = dir
+	}
+
+	plan, conflicts, err := planEntryMoves(db, globalConfig.SavePath, "", template, overrides, modelID)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to plan the moves")
+	}
+	for _, conflict := range conflicts {
+		log.Error(conflict)
+	}
+	if len(conflicts) > 0 {
+		log.Fatalf("%d files would end up in the same place; choose another directory", len(conflicts))
+	}
+
+	if clearOverride {
+		fmt.Printf("Removing the path override %s of model %d.\n", previous, modelID)
+	} else {
+		fmt.Printf("Keeping the files of model %d in %s.\n", modelID, dir)
+	}
+	moves, dbOnly := 0, 0
+	if len(plan) > 0 {
+		fmt.Printf("%d entries to move:\n", len(plan))
+		moves, dbOnly = printPathMigration(plan)
+		fmt.Printf("%d director(ies) to move, %d database-only update(s).\n", moves, dbOnly)
+	}
+	if dryRun {
+		fmt.Println("Dry run: nothing was changed.")
+		return
+	}
+	if !skipConfirm && len(plan) > 0 {
+		reader := bufio.NewReader(os.Stdin)
+		fmt.Print("Proceed? (y/N): ")
+		input, _ := reader.ReadString('\n')
+		if strings.ToLower(strings.TrimSpace(input)) != "y" {
+			fmt.Println("Aborted.")
+			return
+		}
+	}
+
+	if clearOverride {
+		err = db.DeletePathOverride(modelID)
+	} else {
+		err = db.SetPathOverride(modelID, dir)
+	}
+	if err != nil {
+		log.WithError(err).Fatal("Failed to save the path override")
+	}
+	if err := applyPathMigration(db, plan, relinkDirs); err != nil {
+		// Put the override back, so the database matches the files again
+		var restoreErr error
+		if had {
+			restoreErr = db.SetPathOverride(modelID, previous)
+		} else {
+			restoreErr = db.DeletePathOverride(modelID)
+		}
+		if restoreErr != nil {
+			log.WithError(restoreErr).Error("Failed to restore the path override")
+		}
+		log.WithError(err).Fatal("Moving the files failed; rolled back")
+	}
+	if link, err := updateLatestLink(db, globalConfig.SavePath, modelID); err != nil {
+		log.WithError(err).Warn("Failed to update the latest link")
+	} else if link != "" {
+		fmt.Printf("Updated %s.\n", link)
+	}
+	if clearOverride {
+		fmt.Printf("Model %d follows PathTemplate again.\n", modelID)
+	} else {
+		fmt.Printf("Model %d is kept in %s.\n", modelID, dir)
+	}
+}
@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/database"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// dbUpgradeCmd migrates databases written by older releases to the current layout
+var dbUpgradeCmd = &cobra.Command{
+	Use:   "upgrade",
+	Short: "Migrate a database from an older release to the current layout",
+	Long: `Detects entries written by older releases of this tool (CRC32-keyed entries,
+entries without a download status) and migrates them in place to the current
+"v_<modelVersionID>" layout, so existing downloads keep being recognised instead
+of being fetched again.
+
+A full copy of the database is written to <DatabasePath>.backup-<timestamp> before
+anything is changed. Use --check to only report what would be migrated.`,
+	Run: runDbUpgrade,
+}
+
+// dbReindexCmd rebuilds the secondary indexes from the entries
+var dbReindexCmd = &cobra.Command{
+	Use:   "reindex",
+	Short: "Rebuild the database's secondary indexes",
+	Long: `Drops and rebuilds the secondary indexes (by file hash, creator, model type, base
+model and training fingerprint) that db search and duplicate detection use instead of
+scanning every entry. They are kept up to date on every write and built automatically
+the first time a database is opened by this release; rebuild them if an older release
+has written to the database since.`,
+	Run: runDbReindex,
+}
+
+func init() {
+	dbCmd.AddCommand(dbUpgradeCmd)
+	dbCmd.AddCommand(dbReindexCmd)
+	dbUpgradeCmd.Flags().Bool("check", false, "Only report legacy entries, don't migrate")
+}
+
+func runDbReindex(cmd *cobra.Command, args []string) {
+	if globalConfig.DatabasePath == "" {
+		log.Fatal("Database path is not set in the configuration. Please check config file or path.")
+	}
+
+	db, err := database.Open(globalConfig.DatabasePath)
+	if err != nil {
+		log.WithError(err).Fatalf("Failed to open database at %s", globalConfig.DatabasePath)
+	}
+	defer db.Close()
+
+	if !db.IndexesReady() {
+		log.Fatal("The database needs 'civitai-downloader db upgrade' first; it builds the indexes as part of the migration.")
+	}
+	indexed, err := db.RebuildIndexes()
+	if err != nil {
+		log.Fatalf("Rebuilding indexes failed: %v", err)
+	}
+	fmt.Printf("Indexed %d entries.\n", indexed)
+}
+
+func runDbUpgrade(cmd *cobra.Command, args []string) {
+	checkOnly, _ := cmd.Flags().GetBool("check")
+
+	if globalConfig.DatabasePath == "" {
+		log.Fatal("Database path is not set in the configuration. Please check config file or path.")
+	}
+
+	db, err := database.Open(globalConfig.DatabasePath)
+	if err != nil {
+		log.WithError(err).Fatalf("Failed to open database at %s", globalConfig.DatabasePath)
+	}
+	defer db.Close()
+
+	report, err := db.DetectLegacy()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("Schema version:         %d (current: %d)\n", report.SchemaVersion, database.CurrentSchemaVersion)
+	fmt.Printf("Current-format entries: %d\n", report.VersionedChecks)
+	fmt.Printf("Legacy-keyed entries:   %d\n", len(report.LegacyKeys))
+	fmt.Printf("Entries without status: %d\n", len(report.MissingStatus))
+	if len(report.UnreadableKeys) > 0 {
+		fmt.Printf("Unrecognised keys:      %d (left untouched)\n", len(report.UnreadableKeys))
+		for _, key := range report.UnreadableKeys {
+			log.Debugf("Unrecognised key: %s", key)
+		}
+	}
+
+	if !report.NeedsUpgrade() {
+		fmt.Println("Database is up to date.")
+		return
+	}
+	if checkOnly {
+		fmt.Println("Run without --check to migrate.")
+		return
+	}
+
+	result, err := db.Upgrade(globalConfig.DatabasePath)
+	if err != nil {
+		if result.BackupPath != "" {
+			log.Errorf("Upgrade stopped part-way; the original database is preserved at %s", result.BackupPath)
+		}
+		log.Fatalf("Database upgrade failed: %v", err)
+	}
+
+	fmt.Printf("Backup:                 %s\n", result.BackupPath)
+	fmt.Printf("Migrated to v_<id>:     %d\n", result.Migrated)
+	fmt.Printf("Already tracked:        %d (legacy copy removed)\n", result.AlreadyPresent)
+	fmt.Printf("Status filled in:       %d\n", result.StatusFilled)
+	if len(result.Skipped) > 0 {
+		fmt.Printf("Skipped:                %d\n", len(result.Skipped))
+		for _, s := range result.Skipped {
+			log.Warnf("Skipped %s", s)
+		}
+	}
+	fmt.Println("Database upgrade complete.")
+}
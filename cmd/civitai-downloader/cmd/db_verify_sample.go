@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/database"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// verifyCandidate is a database entry db verify checks the file of.
+type verifyCandidate struct {
+	Key   string
+	Entry models.DatabaseEntry
+}
+
+// lastVerified returns when the entry's file was last hash-checked, or downloaded if it
+// never was.
+func (c verifyCandidate) lastVerified() int64 {
+	if c.Entry.VerifiedAt != 0 {
+		return c.Entry.VerifiedAt
+	}
+	return c.Entry.Timestamp
+}
+
+// verifySample is the size of a db verify --sample: a percentage or a count of the files.
+type verifySample struct {
+	percent float64
+	count   int
+}
+
+// parseVerifySample parses --sample, "5%" or "200"; "" checks every file.
+func parseVerifySample(s string) (verifySample, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return verifySample{}, nil
+	}
+	if pct, ok := strings.CutSuffix(s, "%"); ok {
+		percent, err := strconv.ParseFloat(strings.TrimSpace(pct), 64)
+		if err != nil || percent <= 0 || percent > 100 {
+			return verifySample{}, fmt.Errorf("invalid --sample %q (use a percentage above 0 and up to 100, e.g. \"5%%\")", s)
+		}
+		return verifySample{percent: percent}, nil
+	}
+	count, err := strconv.Atoi(s)
+	if err != nil || count <= 0 {
+		return verifySample{}, fmt.Errorf("invalid --sample %q (use a percentage, e.g. \"5%%\", or a number of files)", s)
+	}
+	return verifySample{count: count}, nil
+}
+
+// set reports whether a sample was asked for.
+func (s verifySample) set() bool {
+	return s.percent > 0 || s.count > 0
+}
+
+// of returns how many of n files the sample takes (n without a sample, at least 1).
+func (s verifySample) of(n int) int {
+	switch {
+	case s.percent > 0:
+		return min(n, max(1, int(math.Ceil(float64(n)*s.percent/100))))
+	case s.count > 0:
+		return min(n, s.count)
+	}
+	return n
+}
+
+// orderVerifyCandidates returns size of the candidates, least recently verified first.
+// A smaller size draws a weighted random sample: the chance of a file to be picked grows
+// with the time since it was last verified, so repeated samples cover the whole archive
+// while checking every file now and then.
+func orderVerifyCandidates(candidates []verifyCandidate, size int, now time.Time) []verifyCandidate {
+	if size < len(candidates) {
+		// Weighted sampling without replacement (Efraimidis-Spirakis): the largest
+		// log(u)/weight win
+		keys := make(map[string]float64, len(candidates))
+		for _, c := range candidates {
+			hours := max(0, now.Sub(time.Unix(c.lastVerified(), 0)).Hours())
+			keys[c.Key] = math.Log(1-rand.Float64()) / (hours + 1)
+		}
+		sort.Slice(candidates, func(i, j int) bool { return keys[candidates[i].Key] > keys[candidates[j].Key] })
+		candidates = candidates[:size]
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].lastVerified() < candidates[j].lastVerified() })
+	return candidates
+}
+
+// recordVerified stores when an entry's file was hash-checked.
+func recordVerified(db *database.DB, key, status string) {
+	if err := updateDbEntry(db, key, status, func(e *models.DatabaseEntry) {
+		e.VerifiedAt = time.Now().Unix()
+	}); err != nil {
+		log.WithError(err).Warnf("Failed to record the verification of %s", key)
+	}
+}
+
+// logVerifyConfidence logs what a partial pass says about the whole archive: the share of
+// problem files among those checked, with the upper end of its 95% (Wilson) interval.
+func logVerifyConfidence(checked, total, problems int) {
+	if checked == 0 {
+		return
+	}
+	n, p, z := float64(checked), float64(problems)/float64(checked), 1.96
+	upper := (p + z*z/(2*n) + z*math.Sqrt(p*(1-p)/n+z*z/(4*n*n))) / (1 + z*z/n)
+	log.Infof("Checked %d of %d files (%.1f%%): %d missing or mismatched (%.2f%%). With 95%% confidence at most %.2f%% of the archive has problems; run a full verify to find them all.",
+		checked, total, 100*n/float64(max(total, 1)), problems, 100*p, 100*upper)
+}
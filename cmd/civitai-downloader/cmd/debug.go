@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime/trace"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// traceFile is the execution trace being written for this run (--debug-trace), if any
+var traceFile *os.File
+
+func init() {
+	rootCmd.PersistentFlags().String("debug-pprof", "", "Serve net/http/pprof profiles on this address during the run, e.g. localhost:6060 or :6060")
+	rootCmd.PersistentFlags().String("debug-trace", "", "Write a runtime execution trace of the run to this file (view with go tool trace)")
+}
+
+// startDebugInstrumentation starts the --debug-pprof server and the --debug-trace capture,
+// if either flag is given. The trace is finished by stopDebugInstrumentation, which also
+// runs when the command exits through log.Fatal.
+func startDebugInstrumentation(pprofAddr, tracePath string) error {
+	if pprofAddr != "" {
+		listener, err := net.Listen("tcp", pprofAddr)
+		if err != nil {
+			return fmt.Errorf("--debug-pprof: %w", err)
+		}
+		// Own mux rather than http.DefaultServeMux, so the profiles are only reachable here
+		mux := http.NewServeMux()
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		go func() {
+			if err := http.Serve(listener, mux); err != nil && !errors.Is(err, net.ErrClosed) {
+				log.WithError(err).Warn("pprof server stopped")
+			}
+		}()
+		log.Infof("Serving pprof profiles on http://%s/debug/pprof/", listener.Addr())
+	}
+
+	if tracePath != "" && traceFile == nil {
+		f, err := os.Create(tracePath)
+		if err != nil {
+			return fmt.Errorf("--debug-trace: %w", err)
+		}
+		if err := trace.Start(f); err != nil {
+			f.Close()
+			return fmt.Errorf("--debug-trace: %w", err)
+		}
+		traceFile = f
+		log.RegisterExitHandler(stopDebugInstrumentation)
+		log.Infof("Writing an execution trace of this run to %s", tracePath)
+	}
+	return nil
+}
+
+// stopDebugInstrumentation finishes the --debug-trace capture, if one is running.
+func stopDebugInstrumentation() {
+	if traceFile == nil {
+		return
+	}
+	trace.Stop()
+	if err := traceFile.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write execution trace %s: %v\n", traceFile.Name(), err)
+	}
+	traceFile = nil
+}
@@ -2,12 +2,16 @@ package cmd
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
-	"go-civitai-download/internal/api"
-	"go-civitai-download/internal/database"
-	"go-civitai-download/internal/downloader"
-	"go-civitai-download/internal/models"
+	"github.com/dreamfast/go-civitai-downloader/civitai"
+	"github.com/dreamfast/go-civitai-downloader/internal/api"
+	"github.com/dreamfast/go-civitai-downloader/internal/control"
+	"github.com/dreamfast/go-civitai-downloader/internal/database"
+	"github.com/dreamfast/go-civitai-downloader/internal/downloader"
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
 	"net"
 	"net/http"
 	"os"
@@ -20,9 +24,10 @@ import (
 	"github.com/gosuri/uilive"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 
-	index "go-civitai-download/index"
+	index "github.com/dreamfast/go-civitai-downloader/index"
 )
 
 // downloadCmd represents the download command
@@ -45,6 +50,8 @@ func init() {
 	downloadCmd.Flags().IntP("concurrency", "c", 0, "Number of concurrent downloads (overrides config)")
 	// Bind the flag to Viper using the struct field name as the key
 	viper.BindPFlag("concurrency", downloadCmd.Flags().Lookup("concurrency"))
+	downloadCmd.Flags().Int("segments", 0, "Connections to download each large file over, each fetching its own byte range (overrides config)")
+	viper.BindPFlag("downloadsegments", downloadCmd.Flags().Lookup("segments"))
 
 	// --- Query Parameter Flags (Mostly mirroring Config struct) ---
 	// Authentication
@@ -68,6 +75,8 @@ func init() {
 	viper.BindPFlag("limit", downloadCmd.Flags().Lookup("limit"))
 	downloadCmd.Flags().IntP("max-pages", "p", 0, "Maximum number of pages to process (0 for unlimited)")
 	viper.BindPFlag("maxpages", downloadCmd.Flags().Lookup("max-pages"))
+	downloadCmd.Flags().String("compose", "", "Combine the named Queries of the config with | (union), & (intersection) and - (difference), e.g. \"top_sdxl_loras - disliked\" (overrides config)")
+	viper.BindPFlag("querycompose", downloadCmd.Flags().Lookup("compose"))
 	downloadCmd.Flags().String("sort", "", "Sort order (newest, oldest, highest_rated, etc. - overrides config)")
 	viper.BindPFlag("sort", downloadCmd.Flags().Lookup("sort"))
 	downloadCmd.Flags().String("period", "", "Time period for sort (Day, Week, Month, Year, AllTime - overrides config)")
@@ -76,6 +85,8 @@ func init() {
 	viper.BindPFlag("modelid", downloadCmd.Flags().Lookup("model-id")) // Should match config struct field if exists
 	downloadCmd.Flags().Int("model-version-id", 0, "Download only a specific model version ID")
 	viper.BindPFlag("modelversionid", downloadCmd.Flags().Lookup("model-version-id")) // Should match config struct field if exists
+	downloadCmd.Flags().String("air", "", "Download only the model or version an AIR names, e.g. urn:air:sdxl:lora:civitai:328553@368189")
+	viper.BindPFlag("air", downloadCmd.Flags().Lookup("air"))
 
 	// File & Version Selection
 	downloadCmd.Flags().Bool("primary-only", false, "Only download the primary file for a version (overrides config)")
@@ -84,12 +95,20 @@ func init() {
 	viper.BindPFlag("pruned", downloadCmd.Flags().Lookup("pruned"))
 	downloadCmd.Flags().Bool("fp16", false, "Prefer fp16 models (overrides config)")
 	viper.BindPFlag("fp16", downloadCmd.Flags().Lookup("fp16"))
+	downloadCmd.Flags().StringSlice("file-formats", []string{}, "File formats to download, most preferred first, e.g. SafeTensor,GGUF; of a file shipped in several only the first is downloaded (default SafeTensor, overrides config)")
+	viper.BindPFlag("fileformats", downloadCmd.Flags().Lookup("file-formats"))
 	downloadCmd.Flags().Bool("all-versions", false, "Download all versions of a model, not just the latest (overrides config)")
 	viper.BindPFlag("downloadallversions", downloadCmd.Flags().Lookup("all-versions"))
 	downloadCmd.Flags().StringSlice("ignore-base-models", []string{}, "Base models to ignore (comma-separated or multiple flags, overrides config)")
 	viper.BindPFlag("ignorebasemodels", downloadCmd.Flags().Lookup("ignore-base-models"))
 	downloadCmd.Flags().StringSlice("ignore-filename-strings", []string{}, "Substrings in filenames to ignore (comma-separated or multiple flags, overrides config)")
 	viper.BindPFlag("ignorefilenamestrings", downloadCmd.Flags().Lookup("ignore-filename-strings"))
+	downloadCmd.Flags().String("filter-expression", "", "Only download files this expression accepts, e.g. 'model.Stats.DownloadCount > 1000' (overrides config)")
+	viper.BindPFlag("filterexpression", downloadCmd.Flags().Lookup("filter-expression"))
+	downloadCmd.Flags().String("filter-command", "", "Program (and arguments) deciding on each file: candidate JSON on stdin, exit 0 accepts, 1 rejects (overrides config)")
+	viper.BindPFlag("filtercommand", downloadCmd.Flags().Lookup("filter-command"))
+	downloadCmd.Flags().StringSlice("exclude-restricted", nil, "Never download models of these restricted categories: poi (real people), minor (overrides config)")
+	viper.BindPFlag("excluderestricted", downloadCmd.Flags().Lookup("exclude-restricted"))
 
 	// Saving & Behavior
 	downloadCmd.Flags().BoolP("yes", "y", false, "Skip confirmation prompt before downloading (overrides config)")
@@ -100,10 +119,89 @@ func init() {
 	viper.BindPFlag("savemodelinfo", downloadCmd.Flags().Lookup("model-info"))
 	downloadCmd.Flags().Bool("version-images", false, "Save version preview images (overrides config)") // Renamed flag
 	viper.BindPFlag("saveversionimages", downloadCmd.Flags().Lookup("version-images"))
+	downloadCmd.Flags().Bool("preview", false, "Save a <model>.preview.png next to each downloaded file, chosen from the version's images (overrides config)")
+	viper.BindPFlag("savepreview", downloadCmd.Flags().Lookup("preview"))
+	downloadCmd.Flags().Bool("dedupe-images", true, "Fetch images shared by the preview and the image galleries once, storing copies as hard links (overrides config)")
+	viper.BindPFlag("dedupeimages", downloadCmd.Flags().Lookup("dedupe-images"))
+	downloadCmd.Flags().String("dataset-mode", "", "Write the pointer/metadata files a dataset repository tracks downloads with: dvc or git-annex (overrides config)")
+	viper.BindPFlag("datasetmode", downloadCmd.Flags().Lookup("dataset-mode"))
+	downloadCmd.Flags().String("nsfw-drift", "report", "What to do with downloaded models reclassified as NSFW upstream: report, move or prune (overrides config)")
+	viper.BindPFlag("nsfwdriftpolicy", downloadCmd.Flags().Lookup("nsfw-drift"))
+	downloadCmd.Flags().String("nsfw-drift-dir", "", "Where --nsfw-drift move puts reclassified models (default: [SavePath]/nsfw) (overrides config)")
+	viper.BindPFlag("nsfwdriftdir", downloadCmd.Flags().Lookup("nsfw-drift-dir"))
+	downloadCmd.Flags().String("removal-grace", defaultRemovalGracePeriod, "How long a downloaded version must stay missing upstream before it counts as removed, e.g. 72h or 3d (overrides config)")
+	viper.BindPFlag("removalgraceperiod", downloadCmd.Flags().Lookup("removal-grace"))
+	downloadCmd.Flags().String("removal-policy", "report", "What to do with downloaded versions removed upstream: report, move or prune (overrides config)")
+	viper.BindPFlag("removalpolicy", downloadCmd.Flags().Lookup("removal-policy"))
+	downloadCmd.Flags().String("removal-dir", "", "Where --removal-policy move puts removed versions (default: [SavePath]/removed) (overrides config)")
+	viper.BindPFlag("removaldir", downloadCmd.Flags().Lookup("removal-dir"))
+	downloadCmd.Flags().Bool("allow-downgrade", false, "Download a model's latest upstream version even if a newer version of it is already downloaded (overrides config)")
+	viper.BindPFlag("allowdowngrade", downloadCmd.Flags().Lookup("allow-downgrade"))
+	downloadCmd.Flags().Bool("latest-link", false, "Keep a 'latest' symlink to the newest downloaded version in each model directory (overrides config)")
+	viper.BindPFlag("latestlink", downloadCmd.Flags().Lookup("latest-link"))
 	downloadCmd.Flags().Bool("model-images", false, "Save model gallery images (overrides config)") // Renamed flag
 	viper.BindPFlag("savemodelimages", downloadCmd.Flags().Lookup("model-images"))
-	downloadCmd.Flags().Bool("meta-only", false, "Only download/update metadata files, skip model downloads (overrides config)") // Renamed flag
-	viper.BindPFlag("downloadmetaonly", downloadCmd.Flags().Lookup("meta-only"))
+	downloadCmd.Flags().Bool("metadata-only", false, "Catalog mode: save metadata, model info and previews for every match, but no model files (overrides config)")
+	viper.BindPFlag("downloadmetaonly", downloadCmd.Flags().Lookup("metadata-only"))
+	// --meta-only is the original name of --metadata-only
+	downloadCmd.Flags().SetNormalizeFunc(func(f *pflag.FlagSet, name string) pflag.NormalizedName {
+		if name == "meta-only" {
+			name = "metadata-only"
+		}
+		return pflag.NormalizedName(name)
+	})
+	downloadCmd.Flags().Bool("detect-type", true, "Detect the real type (LORA, Checkpoint, ...) of safetensors files the API labels \"Other\" and file them accordingly (overrides config)")
+	viper.BindPFlag("detectothertypes", downloadCmd.Flags().Lookup("detect-type"))
+	downloadCmd.Flags().StringToString("type-override", map[string]string{}, "File a model/version ID under the given type, e.g. 12345=LORA (repeatable, overrides API type and detection)")
+	viper.BindPFlag("typeoverrides", downloadCmd.Flags().Lookup("type-override"))
+	downloadCmd.Flags().String("max-bytes-per-creator", "", "Soft quota: skip files that would take a creator's archived total over this size, e.g. 50GB (overrides config)")
+	viper.BindPFlag("maxbytespercreator", downloadCmd.Flags().Lookup("max-bytes-per-creator"))
+	downloadCmd.Flags().Int("max-files-per-creator", 0, "Soft quota: maximum number of archived files per creator, 0 for no limit (overrides config)")
+	viper.BindPFlag("maxfilespercreator", downloadCmd.Flags().Lookup("max-files-per-creator"))
+	downloadCmd.Flags().StringToString("max-bytes-per-type", map[string]string{}, "Soft quota per model type, e.g. checkpoint=500GB (repeatable, overrides config)")
+	viper.BindPFlag("maxbytespertype", downloadCmd.Flags().Lookup("max-bytes-per-type"))
+	downloadCmd.Flags().StringToInt("max-files-per-type", map[string]int{}, "Soft quota on the number of files per model type, e.g. checkpoint=100 (repeatable, overrides config)")
+	viper.BindPFlag("maxfilespertype", downloadCmd.Flags().Lookup("max-files-per-type"))
+	downloadCmd.Flags().String("max-total-size", "", "Stop queuing new files once the run's downloads add up to this size, e.g. 50GB (overrides config)")
+	viper.BindPFlag("maxtotalsize", downloadCmd.Flags().Lookup("max-total-size"))
+	downloadCmd.Flags().String("queue-order", "", "Order of the download queue: api, newest, smallest, largest or popular (overrides config)")
+	viper.BindPFlag("queueorder", downloadCmd.Flags().Lookup("queue-order"))
+	downloadCmd.Flags().String("summary-file", "", "Also write the end-of-run summary as JSON to this file (overrides config)")
+	viper.BindPFlag("runsummaryfile", downloadCmd.Flags().Lookup("summary-file"))
+	downloadCmd.Flags().String("failed-file", "", "Where to list the failed downloads as JSON after each run (default: [SavePath]/failed.json, overrides config)")
+	viper.BindPFlag("failedlistfile", downloadCmd.Flags().Lookup("failed-file"))
+	downloadCmd.Flags().Bool("include-training-data", false, "Also download the training data creators attach to the versions downloaded, into a tree of its own (overrides config)")
+	viper.BindPFlag("includetrainingdata", downloadCmd.Flags().Lookup("include-training-data"))
+	downloadCmd.Flags().String("training-data-dir", "", "Where training data goes (default: [SavePath]/training-data, overrides config)")
+	viper.BindPFlag("trainingdatadir", downloadCmd.Flags().Lookup("training-data-dir"))
+	downloadCmd.Flags().String("max-training-data-size", "", "Skip training data attachments larger than this, e.g. 2GB (overrides config)")
+	viper.BindPFlag("maxtrainingdatasize", downloadCmd.Flags().Lookup("max-training-data-size"))
+	downloadCmd.Flags().String("max-training-data-total", "", "Stop downloading training data once the run's attachments add up to this size, e.g. 20GB (overrides config)")
+	viper.BindPFlag("maxtrainingdatatotal", downloadCmd.Flags().Lookup("max-training-data-total"))
+	downloadCmd.Flags().String("watch", "", "Watch mode: repeat the download run at this interval (e.g. 6h) until interrupted (overrides config)")
+	viper.BindPFlag("watchinterval", downloadCmd.Flags().Lookup("watch"))
+	downloadCmd.Flags().StringSlice("download-window", []string{}, "Watch mode: only download files within these local-time windows, e.g. \"Mon-Fri 22:00-06:00\" (repeatable, overrides config)")
+	viper.BindPFlag("downloadwindows", downloadCmd.Flags().Lookup("download-window"))
+	downloadCmd.Flags().String("timezone", "", "Watch mode: IANA time zone for --download-window, e.g. Europe/Berlin (default: system local time)")
+	viper.BindPFlag("watchtimezone", downloadCmd.Flags().Lookup("timezone"))
+	downloadCmd.Flags().String("digest", "", "Watch mode: write a digest this often: daily, weekly, 14d or a duration (overrides config)")
+	viper.BindPFlag("digestinterval", downloadCmd.Flags().Lookup("digest"))
+	downloadCmd.Flags().String("digest-dir", "", "Directory for digests (default: {SavePath}/digests, overrides config)")
+	viper.BindPFlag("digestdir", downloadCmd.Flags().Lookup("digest-dir"))
+	downloadCmd.Flags().String("digest-format", "markdown", "Digest format: markdown, html or both (overrides config)")
+	viper.BindPFlag("digestformat", downloadCmd.Flags().Lookup("digest-format"))
+	downloadCmd.Flags().String("digest-webhook", "", "Also post the digest to this Discord/Slack/Mattermost webhook URL (overrides config)")
+	viper.BindPFlag("digestwebhook", downloadCmd.Flags().Lookup("digest-webhook"))
+	downloadCmd.Flags().String("watchdog-hang-timeout", "", "Under systemd with WatchdogSec=: stop the watchdog pings once nothing has moved for this long, e.g. 15m (0 = never; overrides config)")
+	viper.BindPFlag("watchdoghangtimeout", downloadCmd.Flags().Lookup("watchdog-hang-timeout"))
+	downloadCmd.Flags().Bool("accept-hash-change", false, "Allow re-downloading a version whose file hashes changed since they were first recorded")
+	viper.BindPFlag("accepthashchange", downloadCmd.Flags().Lookup("accept-hash-change"))
+	downloadCmd.Flags().Bool("interactive-conflicts", false, "Ask about each conflict (existing file, collision, downgrade, changed upstream file) instead of deciding by ConflictPolicies (overrides config)")
+	viper.BindPFlag("interactiveconflicts", downloadCmd.Flags().Lookup("interactive-conflicts"))
+	downloadCmd.Flags().Bool("resume", false, "Only finish the downloads an interrupted run left queued, without listing the API")
+	viper.BindPFlag("resumeonly", downloadCmd.Flags().Lookup("resume"))
+	downloadCmd.Flags().Bool("dry-run", false, "List and filter as usual, then print the files that would be downloaded (sizes, destinations, total) without downloading them")
+	viper.BindPFlag("downloaddryrun", downloadCmd.Flags().Lookup("dry-run"))
 }
 
 var logLevel string
@@ -111,6 +209,23 @@ var logFormat string
 
 // setupDownloadEnvironment handles the initialization of database, downloaders, and concurrency settings.
 func setupDownloadEnvironment(cmd *cobra.Command, cfg *models.Config) (db *database.DB, fileDownloader *downloader.Downloader, imageDownloader *downloader.Downloader, concurrencyLevel int, err error) {
+	if err = helpers.ValidatePathTemplate(pathTemplate()); err != nil {
+		err = fmt.Errorf("invalid PathTemplate: %w", err)
+		return
+	}
+	if err = validateDatasetMode(viper.GetString("datasetmode")); err != nil {
+		return
+	}
+	if err = validateNsfwDriftPolicy(viper.GetString("nsfwdriftpolicy")); err != nil {
+		return
+	}
+	if err = validateNsfwPartition(); err != nil {
+		return
+	}
+	if _, err = loadRemovalSettings(); err != nil {
+		return
+	}
+
 	// --- Database Setup ---
 	dbPath := cfg.DatabasePath
 	if dbPath == "" {
@@ -158,10 +273,32 @@ func setupDownloadEnvironment(cmd *cobra.Command, cfg *models.Config) (db *datab
 		Transport: globalHttpTransport,
 	}
 	fileDownloader = downloader.NewDownloader(mainHttpClient, cfg.ApiKey)
+	fileDownloader.SetTempDir(downloadTempDir())
+	fileDownloader.SetSegments(viper.GetInt("downloadsegments"))
+	fileDownloader.SetRetries(viper.GetInt("maxretries"), globalRetryDelay, globalRetryPolicy)
+	fileDownloader.SetStallTimeout(time.Duration(viper.GetInt("stalltimeoutsec")) * time.Second)
+	fileDownloader.SetHashAlgorithms(globalHashAlgorithms)
+	fileDownloader.SetKeepMismatched(globalKeepMismatched)
+	fileDownloader.SetQuarantineDir(globalQuarantineDir)
+	fileDownloader.SetMismatchRetries(viper.GetInt("mismatchretries"))
+	fileDownloader.SetAria2(globalAria2)
+	fileDownloader.SetMirrors(viper.GetStringSlice("mirrorurls"))
+	fileDownloader.SetPreallocate(viper.GetBool("preallocate"))
+	fileDownloader.SetHostOverrides(globalHostOverrides)
+	if globalAria2 != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		version, aria2Err := globalAria2.Version(ctx)
+		cancel()
+		if aria2Err != nil {
+			err = fmt.Errorf("aria2c at %s (Aria2RpcUrl) can't be reached: %w", viper.GetString("aria2rpcurl"), aria2Err)
+			return
+		}
+		log.Infof("Model downloads are handed to aria2 %s at %s", version, viper.GetString("aria2rpcurl"))
+	}
 
 	// --- Setup Image Downloader ---
 	// Use correct viper keys corresponding to bound flags
-	if viper.GetBool("saveversionimages") || viper.GetBool("savemodelimages") {
+	if viper.GetBool("saveversionimages") || viper.GetBool("savemodelimages") || viper.GetBool("savepreview") {
 		log.Debug("Image saving enabled, creating image downloader instance.")
 		// Create a separate client instance for image downloader, but reuse the global transport
 		imgHttpClient := &http.Client{
@@ -169,6 +306,8 @@ func setupDownloadEnvironment(cmd *cobra.Command, cfg *models.Config) (db *datab
 			Transport: globalHttpTransport,
 		}
 		imageDownloader = downloader.NewDownloader(imgHttpClient, cfg.ApiKey)
+		imageDownloader.SetTempDir(downloadTempDir())
+		imageDownloader.SetStallTimeout(time.Duration(viper.GetInt("stalltimeoutsec")) * time.Second)
 	}
 	// Add debug log here
 	if imageDownloader != nil {
@@ -180,9 +319,20 @@ func setupDownloadEnvironment(cmd *cobra.Command, cfg *models.Config) (db *datab
 	return
 }
 
-// handleMetadataOnlyMode handles the logic when --download-meta-only is specified.
-// It saves metadata for the queued files and returns true if the program should exit.
-func handleMetadataOnlyMode(downloadsToQueue []potentialDownload, cfg *models.Config) (shouldExit bool) {
+// downloadTempDir returns where partial downloads and other staging files are written:
+// TempDir if set, otherwise a .staging directory under SavePath.
+func downloadTempDir() string {
+	if dir := viper.GetString("tempdir"); dir != "" {
+		return dir
+	}
+	return filepath.Join(viper.GetString("savepath"), ".staging")
+}
+
+// handleMetadataOnlyMode handles the logic when --metadata-only is specified.
+// It saves sidecars (and previews) for the queued files, indexes them for search and marks
+// their DB entries Cataloged, without downloading any model file. It returns true if the
+// program should exit.
+func handleMetadataOnlyMode(downloadsToQueue []potentialDownload, db *database.DB, imageDownloader *downloader.Downloader, bleveIndex bleve.Index) (shouldExit bool) {
 	log.Info("--- Metadata-Only Mode Activated --- ")
 	if len(downloadsToQueue) == 0 {
 		log.Info("No new files found for which to save metadata.")
@@ -198,7 +348,7 @@ func handleMetadataOnlyMode(downloadsToQueue []potentialDownload, cfg *models.Co
 		// before the .json suffix is added by saveMetadataFile.
 		baseFilename := pd.FinalBaseFilename // e.g., my_model_v1.safetensors
 		finalFilenameWithID := baseFilename
-		if pd.ModelVersionID > 0 { // Prepend ID if available
+		if civitai.FileNameVersionID(pd.ModelType, pd.ModelVersionID) > 0 { // Prepend ID if available (not for embeddings)
 			finalFilenameWithID = fmt.Sprintf("%d_%s", pd.ModelVersionID, baseFilename)
 		}
 		dir := filepath.Dir(pd.TargetFilepath) // Get the target directory
@@ -207,19 +357,50 @@ func handleMetadataOnlyMode(downloadsToQueue []potentialDownload, cfg *models.Co
 		log.Debugf("Using base path for meta-only JSON derivation: %s", finalPathForMeta)
 		// --- End Path Reconstruction ---
 
+		if err := helpers.MkdirAll(dir, 0700); err != nil {
+			log.WithError(err).Warnf("Failed to create directory %s for metadata", dir)
+			failedCount++
+			continue
+		}
+
+		// Nothing downloaded, so no receipt; the preview is still useful for browsing the catalog
+		var extras []sidecarField
+		if viper.GetBool("savepreview") && imageDownloader != nil {
+			if choice := savePreviewImage("Catalog", pd, finalPathForMeta, imageDownloader); choice != nil {
+				extras = append(extras, sidecarField{Key: sidecarPreviewKey, Value: choice})
+			}
+		}
+
 		// Pass the potential download struct and the reconstructed path
-		err := saveMetadataFile(pd, finalPathForMeta)
+		err := saveMetadataFile(pd, finalPathForMeta, extras...)
 		if err != nil {
 			// Use ModelVersionID for logging
 			log.Warnf("Failed to save metadata for %s (VersionID: %d): %v", pd.File.Name, pd.ModelVersionID, err)
 			failedCount++
-		} else {
-			savedCount++
+			continue
+		}
+		savedCount++
+
+		dbKey := fmt.Sprintf("v_%d", pd.CleanedVersion.ID)
+		updateErr := updateDbEntry(db, dbKey, models.StatusCataloged, func(entry *models.DatabaseEntry) {
+			entry.Filename = filepath.Base(finalPathForMeta)
+			recordEmbeddingToken(entry)
+			entry.File = pd.File
+			entry.Version = pd.CleanedVersion
+		})
+		if updateErr != nil {
+			log.Warnf("Failed to mark %s (Key: %s) as cataloged: %v", pd.File.Name, dbKey, updateErr)
+		}
+
+		if bleveIndex != nil {
+			item := modelFileIndexItem(pd, finalPathForMeta)
+			if indexErr := index.IndexItem(bleveIndex, item); indexErr != nil {
+				log.WithError(indexErr).Warnf("Failed to index cataloged item %s (ID: %s)", finalPathForMeta, item.ID)
+			}
 		}
-		// Note: We don't change DB status here.
 	}
 
-	log.Infof("Metadata-only mode finished. Saved: %d, Failed: %d", savedCount, failedCount)
+	log.Infof("Metadata-only mode finished. Cataloged: %d, Failed: %d", savedCount, failedCount)
 	return true // Exit after processing
 }
 
@@ -275,75 +456,144 @@ func confirmDownload(downloadsToQueue []potentialDownload) bool {
 	return true
 }
 
+// printDownloadPlan prints the files a dry run would download, in queue order, with their
+// sizes and destinations and the total size.
+func printDownloadPlan(downloadsToQueue []potentialDownload) {
+	var total uint64
+	var b strings.Builder
+	b.WriteString("\n--- Download Plan (dry run) ---\n")
+	for _, pd := range downloadsToQueue {
+		size := uint64(pd.File.SizeKB * 1024)
+		total += size
+		fmt.Fprintf(&b, "%10s  %s (%s - %s, %s, %s)\n            -> %s\n", helpers.BytesToSize(size), pd.FinalBaseFilename, pd.ModelName, pd.VersionName, pd.ModelType, pd.BaseModel, pd.TargetFilepath)
+	}
+	fmt.Fprintf(&b, "%d file(s), %s in total. Nothing was downloaded.\n", len(downloadsToQueue), helpers.BytesToSize(total))
+	fmt.Print(b.String())
+}
+
 // executeDownloads manages the worker pool and queues download jobs.
 func executeDownloads(downloadsToQueue []potentialDownload, db *database.DB, fileDownloader *downloader.Downloader, imageDownloader *downloader.Downloader, concurrencyLevel int, cfg *models.Config, bleveIndex bleve.Index) {
 	log.Info("--- Starting Phase 3: Download Execution --- ")
+	downloadService.setPhase("downloading")
+	pool := startDownloadPool(db, fileDownloader, imageDownloader, concurrencyLevel, concurrencyLevel, bleveIndex)
+	for _, pd := range downloadsToQueue {
+		pool.queue(pd)
+	}
+	pool.wait()
+	log.Info("--- Finished Phase 3: Download Execution --- ")
+}
+
+// pipelineQueueSize bounds the jobs waiting for a worker when downloads run while pages are
+// still being fetched: about one API page at the maximum Limit. A full queue blocks the
+// enumeration until workers catch up.
+const pipelineQueueSize = 100
+
+// downloadPool is a set of running download workers fed through a bounded job queue.
+type downloadPool struct {
+	db            *database.DB
+	jobs          chan downloadJob
+	wg            sync.WaitGroup
+	writer        *uilive.Writer
+	ctlServer     *control.Server
+	queued        map[string]bool // DB keys already queued, so a re-listed file isn't queued twice
+	failedToQueue int
+}
 
+// startDownloadPool starts concurrencyLevel download workers, the progress writer and the
+// control interface. Queue jobs with queue and call wait when done.
+func startDownloadPool(db *database.DB, fileDownloader *downloader.Downloader, imageDownloader *downloader.Downloader, concurrencyLevel int, queueSize int, bleveIndex bleve.Index) *downloadPool {
+	p := &downloadPool{
+		db:     db,
+		jobs:   make(chan downloadJob, queueSize),
+		writer: uilive.New(),
+		queued: make(map[string]bool),
+	}
 	// Initialize uilive writer for progress updates
-	writer := uilive.New()
-	writer.Start()
-	defer writer.Stop() // Ensure writer stops even if there are errors
+	p.writer.Start()
+	downloadConflicts.pauseProgress(p.writer)
 
-	var wg sync.WaitGroup
-	downloadJobs := make(chan downloadJob, concurrencyLevel) // Buffered channel
+	// Start the control interface so filters can be changed while the batch runs (watch
+	// mode keeps its own up between cycles)
+	if watchControlServer == nil {
+		p.ctlServer = startControlServer()
+	}
 
 	// Start download workers
 	log.Infof("Starting %d download workers...", concurrencyLevel)
 	for i := 0; i < concurrencyLevel; i++ {
-		wg.Add(1)
-		// Pass necessary components to the worker
+		p.wg.Add(1)
 		// Pass imageDownloader, writer, concurrencyLevel, and bleveIndex
-		go downloadWorker(i+1, downloadJobs, db, fileDownloader, imageDownloader, &wg, writer, concurrencyLevel, bleveIndex)
+		go downloadWorker(i+1, p.jobs, db, fileDownloader, imageDownloader, &p.wg, p.writer, concurrencyLevel, bleveIndex)
 	}
+	return p
+}
 
-	// Queue downloads
-	queuedCount := 0
-	failedToQueueCount := 0
-	for _, pd := range downloadsToQueue {
-		// --- Calculate DB Key and Check Preconditions ---
-		// Ensure ModelVersion ID exists before calculating key and checking DB
-		if pd.CleanedVersion.ID == 0 {
-			log.Errorf("Cannot process download for %s (Model: %s) - CleanedVersion ID is missing! Skipping queue.", pd.File.Name, pd.ModelName)
-			failedToQueueCount++
-			continue
-		}
-		// Calculate key using version ID with prefix (as it was originally)
-		dbKey := fmt.Sprintf("v_%d", pd.CleanedVersion.ID)
+// queue hands pd to the workers, blocking while the queue is full. It returns false if the
+// download was not queued.
+func (p *downloadPool) queue(pd potentialDownload) bool {
+	// --- Calculate DB Key and Check Preconditions ---
+	// Ensure ModelVersion ID exists before calculating key and checking DB
+	if pd.CleanedVersion.ID == 0 {
+		log.Errorf("Cannot process download for %s (Model: %s) - CleanedVersion ID is missing! Skipping queue.", pd.File.Name, pd.ModelName)
+		p.failedToQueue++
+		return false
+	}
+	// Calculate key using version ID with prefix (as it was originally)
+	dbKey := fmt.Sprintf("v_%d", pd.CleanedVersion.ID)
+	if p.queued[dbKey] {
+		log.Debugf("%s (Key: %s) is already queued.", pd.FinalBaseFilename, dbKey)
+		return false
+	}
 
-		// Check DB status before queueing (should be Pending)
-		rawValue, errGet := db.Get([]byte(dbKey))
-		if errGet != nil {
-			log.Warnf("Failed to get DB entry %s before queueing download job for %s. Skipping queue.", dbKey, pd.FinalBaseFilename)
-			failedToQueueCount++
-			continue
-		}
-		var entry models.DatabaseEntry
-		if errUnmarshal := json.Unmarshal(rawValue, &entry); errUnmarshal != nil {
-			log.Warnf("Failed to unmarshal DB entry %s before queueing download job for %s. Skipping queue.", dbKey, pd.FinalBaseFilename)
-			failedToQueueCount++
-			continue
-		}
+	// Check DB status before queueing (should be Pending)
+	rawValue, errGet := p.db.Get([]byte(dbKey))
+	if errGet != nil {
+		log.Warnf("Failed to get DB entry %s before queueing download job for %s. Skipping queue.", dbKey, pd.FinalBaseFilename)
+		p.failedToQueue++
+		return false
+	}
+	var entry models.DatabaseEntry
+	if errUnmarshal := json.Unmarshal(rawValue, &entry); errUnmarshal != nil {
+		log.Warnf("Failed to unmarshal DB entry %s before queueing download job for %s. Skipping queue.", dbKey, pd.FinalBaseFilename)
+		p.failedToQueue++
+		return false
+	}
 
-		if entry.Status != models.StatusPending {
-			log.Warnf("DB entry %s for %s is not in Pending state (Status: %s). Skipping queue.", dbKey, pd.FinalBaseFilename, entry.Status)
-			failedToQueueCount++
-			continue
-		}
+	if entry.Status != models.StatusPending {
+		log.Warnf("DB entry %s for %s is not in Pending state (Status: %s). Skipping queue.", dbKey, pd.FinalBaseFilename, entry.Status)
+		p.failedToQueue++
+		return false
+	}
 
-		// Add job to the channel
-		job := downloadJob{
-			PotentialDownload: pd,
-			DatabaseKey:       dbKey,
-		}
-		downloadJobs <- job
-		queuedCount++
+	// Add job to the channel
+	markQueued(p.db, dbKey, entry)
+	p.queued[dbKey] = true
+	downloadService.queuedFile()
+	p.jobs <- downloadJob{
+		PotentialDownload: pd,
+		DatabaseKey:       dbKey,
 	}
+	return true
+}
 
-	close(downloadJobs) // Close channel once all jobs are sent
-	log.Infof("Queued %d download jobs. Waiting for workers to finish... (%d jobs failed to queue)", queuedCount, failedToQueueCount)
+// wait closes the queue and waits for the workers to finish.
+func (p *downloadPool) wait() {
+	close(p.jobs) // Close channel once all jobs are sent
+	log.Infof("Queued %d download jobs. Waiting for workers to finish... (%d jobs failed to queue)", len(p.queued), p.failedToQueue)
+	p.wg.Wait() // Wait for all workers to complete
+	downloadConflicts.pauseProgress(nil)
+	p.writer.Stop()
+	if p.ctlServer != nil {
+		p.ctlServer.Close()
+	}
+}
 
-	wg.Wait() // Wait for all workers to complete
-	log.Info("--- Finished Phase 3: Download Execution --- ")
+// streamDownloads reports whether downloads can start while later pages are still being
+// fetched. That needs a run without the confirmation prompt (which shows the total first)
+// that downloads files now: not catalog mode or a dry run, and not outside a watch download
+// window.
+func streamDownloads() bool {
+	return viper.GetBool("skipconfirmation") && !viper.GetBool("downloadmetaonly") && !viper.GetBool("downloaddryrun") && downloadWindow.open(time.Now())
 }
 
 // runDownload is the main execution function for the download command.
@@ -353,6 +603,56 @@ func runDownload(cmd *cobra.Command, args []string) {
 
 	// Config is loaded by PersistentPreRunE in root.go
 	// REMOVED: globalConfig = models.LoadConfig()
+	applyAIRTarget()
+	defer notifyPauseSignals()()
+	if viper.GetBool("downloaddryrun") && viper.GetBool("downloadmetaonly") {
+		log.Fatal("--dry-run lists the files a run would download; it can't be combined with --metadata-only")
+	}
+
+	if interval := strings.TrimSpace(viper.GetString("watchinterval")); interval != "" {
+		if viper.GetBool("resumeonly") {
+			log.Fatal("--resume can't be combined with watch mode, which resumes an interrupted cycle by itself")
+		}
+		if viper.GetBool("downloaddryrun") {
+			log.Fatal("--dry-run can't be combined with watch mode")
+		}
+		runWatch(cmd, args, interval)
+		return
+	}
+	var err error
+	if downloadWindow, err = newDownloadSchedule(); err != nil {
+		log.Fatalf("Invalid download window settings: %v", err)
+	}
+	stopService, err := startServiceNotifier()
+	if err != nil {
+		log.Fatalf("Invalid systemd watchdog settings: %v", err)
+	}
+	defer stopService()
+	runDownloadCycle(cmd, args)
+}
+
+// runDownloadCycle performs one complete download run: discovery, confirmation and downloads.
+func runDownloadCycle(cmd *cobra.Command, args []string) {
+	started := time.Now()
+	downloadRunStats = newRunStats(started, globalChallengeGuard)
+	defer downloadRunStats.report()
+
+	// Metadata-only (catalog) mode also saves model info and previews unless turned off explicitly
+	if viper.GetBool("downloadmetaonly") {
+		for _, key := range []string{"savemodelinfo", "savepreview"} {
+			if !viper.IsSet(key) {
+				viper.Set(key, true)
+			}
+		}
+	}
+
+	// A dry run lists and filters like any other run but saves no files along the way, and
+	// models reclassified as NSFW or removed upstream are only reported
+	if viper.GetBool("downloaddryrun") {
+		for key, value := range map[string]any{"savemodelinfo": false, "savemodelimages": false, "savemetadata": false, "nsfwdriftpolicy": "report", "removalpolicy": "report"} {
+			viper.Set(key, value)
+		}
+	}
 
 	// --- Initialize Environment ---
 	db, fileDownloader, imageDownloader, concurrencyLevel, err := setupDownloadEnvironment(cmd, &globalConfig)
@@ -365,6 +665,64 @@ func runDownload(cmd *cobra.Command, args []string) {
 			log.Errorf("Error closing database: %v", err)
 		}
 	}()
+	// A dry run only reads the database: the entries the listing plans, updates and page
+	// states are discarded, and it sends no digest and leaves the serve badges alone (as
+	// does a run whose confirmation is declined)
+	writeSummary := true
+	if viper.GetBool("downloaddryrun") {
+		db.SetReadOnly()
+	} else {
+		defer func() { downloadDigest.emitIfDue(db, time.Now()) }() // Runs before the database is closed
+		// For the serve badges
+		defer func() {
+			if writeSummary {
+				writeArchiveSummary(db, globalConfig.SavePath)
+			}
+		}()
+		defer writeFailedList(db, globalConfig.SavePath, started) // Printed before the run summary
+	}
+	// Quotas limit what the archive stores, so catalog mode (no model files) ignores them
+	if !viper.GetBool("downloadmetaonly") {
+		downloadQuotas, err = newQuotaTracker(db)
+		if err != nil {
+			log.Fatalf("Invalid quota settings: %v", err)
+		}
+	}
+	if downloadConflicts, err = newConflictResolver(); err != nil {
+		log.Fatalf("Invalid conflict settings: %v", err)
+	}
+	downloadDowngrades = newDowngradeGuard(db)
+	downloadMovedFiles = newMovedFileIndex(db, globalConfig.SavePath)
+	if downloadTrainingData, err = newTrainingDataFetcher(globalConfig.SavePath); err != nil {
+		log.Fatalf("Invalid training data settings: %v", err)
+	}
+	defer downloadTrainingData.report() // Printed before the run summary
+	loadPathOverrides(db)
+	applyNsfwPartitionModes(globalConfig.SavePath)
+	defer applyNsfwPartitionModes(globalConfig.SavePath) // Files created by the run get the partition's mode too
+	if pluginFilters, err = newPluginFilters(); err != nil {
+		log.Fatalf("Invalid filter plugin settings: %v", err)
+	}
+	if restrictionFilter, err = newRestrictionFilter(); err != nil {
+		log.Fatalf("Invalid ExcludeRestricted: %v", err)
+	}
+	var diskSpace *diskBudget
+	if !viper.GetBool("downloadmetaonly") {
+		if diskSpace, err = newDiskBudget(); err != nil {
+			log.Fatalf("Invalid disk space settings: %v", err)
+		}
+	}
+	// The size budget caps the model files a run downloads, so catalog mode ignores it too
+	var budget *sizeBudget
+	if !viper.GetBool("downloadmetaonly") {
+		if budget, err = newSizeBudget(); err != nil {
+			log.Fatalf("Invalid size budget: %v", err)
+		}
+	}
+	queueOrder, err := downloadQueueOrder()
+	if err != nil {
+		log.Fatalf("Invalid queue order: %v", err)
+	}
 	// --- End Environment Initialization ---
 
 	// --- Initialize Bleve Index --- START ---
@@ -414,27 +772,17 @@ func runDownload(cmd *cobra.Command, args []string) {
 	}
 
 	// Wrap the transport for logging if enabled (similar to root.go)
-	var finalMetadataTransport http.RoundTripper = metadataTransport
+	finalMetadataTransport := downloader.NewHostOverrideTransport(downloader.NewBandwidthTransport(downloader.NewChallengeTransport(downloader.NewHostRateTransport(metadataTransport, globalHostRateLimits), globalChallengeGuard), globalBandwidthLimits), globalHostOverrides)
 	if viper.GetBool("logapirequests") { // Check Viper directly
 		log.Debug("API request logging enabled, wrapping metadata HTTP transport.")
 		// Use the main api.log file for metadata calls as well
-		logFilePath := "api.log"
-		// --- Use viper.GetString to get the save path consistent with root.go ---
-		savePath := viper.GetString("savepath")
-		if savePath != "" {
-			if _, statErr := os.Stat(savePath); statErr == nil {
-				logFilePath = filepath.Join(savePath, logFilePath)
-			} else {
-				log.Warnf("SavePath '%s' (from Viper) not found, saving %s to current directory.", savePath, logFilePath)
-			}
-		}
-		// --- End save path consistency change ---
+		logFilePath := apiLogFilePath()
 		log.Infof("Metadata API logging will append to file: %s", logFilePath)
-		// Need to import "go-civitai-download/internal/api"
-		loggingMetaTransport, err := api.NewLoggingTransport(metadataTransport, logFilePath)
+		// Need to import "github.com/dreamfast/go-civitai-downloader/internal/api"
+		loggingMetaTransport, err := api.NewLoggingTransport(finalMetadataTransport, logFilePath)
 		if err != nil {
 			log.WithError(err).Error("Failed to initialize API logging transport for metadata client, logging disabled for it.")
-			// Keep finalMetadataTransport as metadataTransport
+			// Keep finalMetadataTransport unwrapped
 		} else {
 			finalMetadataTransport = loggingMetaTransport // Use the wrapped transport
 		}
@@ -446,10 +794,19 @@ func runDownload(cmd *cobra.Command, args []string) {
 		Transport: finalMetadataTransport, // Use the final transport
 	}
 	// --- End Setup Metadata HTTP Client ---
+	// Versions missing upstream are checked again when due, confirming or clearing the removal
+	defer func() {
+		if _, _, err := recheckRemovals(db, metadataClient, globalConfig.SavePath, recheckDue); err != nil {
+			log.WithError(err).Warn("Failed to check suspected upstream removals")
+		}
+	}()
 
 	// Pass address of globalConfig (needed by legacy parts, but Viper is preferred for new checks)
 	// Also ensure queryParams uses Viper directly
 	queryParams := setupQueryParams(&globalConfig, cmd) // setupQueryParams already uses Viper
+	if downloadComposition, err = newQueryComposition(queryParams); err != nil {
+		log.Fatalf("Invalid query composition: %v", err)
+	}
 
 	modelVersionID := viper.GetInt("modelversionid") // Viper key from init()
 	modelID := viper.GetInt("modelid")               // Viper key from init()
@@ -457,7 +814,22 @@ func runDownload(cmd *cobra.Command, args []string) {
 	var downloadsToQueue []potentialDownload // Holds downloads confirmed for queueing after DB check
 	var loopErr error                        // Store loop errors
 
-	if modelVersionID > 0 {
+	// Downloads a killed run left queued go first, rebuilt from the database (watch mode
+	// resumes its interrupted cycle itself)
+	var resumed []potentialDownload
+	if downloadWatch == nil && !viper.GetBool("downloadmetaonly") {
+		if resumed = interruptedDownloads(db); len(resumed) > 0 {
+			log.Infof("Resuming %d download(s) left queued by an interrupted run", len(resumed))
+		}
+	}
+
+	if viper.GetBool("resumeonly") {
+		if len(resumed) == 0 {
+			log.Info("No interrupted downloads to resume.")
+			return
+		}
+		log.Info("--- Skipping Phase 1: only resuming interrupted downloads ---")
+	} else if modelVersionID > 0 {
 		log.Infof("--- Processing specific Model Version ID: %d (Model ID flag ignored) ---", modelVersionID)
 		// Use the metadataClient initialized above
 		downloadsToQueue, _, loopErr = handleSingleVersionDownload(modelVersionID, db, metadataClient, &globalConfig, cmd)
@@ -478,10 +850,50 @@ func runDownload(cmd *cobra.Command, args []string) {
 			return // Exit if single model fetch/process failed
 		}
 		log.Info("--- Finished processing single model ID ---")
+	} else if streamDownloads() {
+		// --- Pagination with downloads starting as pages come in ---
+		log.Info("--- Starting Phase 1+3: Metadata Gathering with Concurrent Downloads --- (Pagination)")
+		downloadService.setPhase("listing models")
+		pool := startDownloadPool(db, fileDownloader, imageDownloader, concurrencyLevel, pipelineQueueSize, bleveIndex)
+		for _, pd := range resumed {
+			if admitDownload(pd, diskSpace, budget) {
+				pool.queue(pd)
+			}
+		}
+		if downloadWatch != nil && downloadWindow != nil {
+			deferred := deferredDownloads(db, nil)
+			sortDownloadQueue(deferred, queueOrder, nil)
+			for _, pd := range deferred {
+				if admitDownload(pd, diskSpace, budget) {
+					pool.queue(pd)
+				}
+			}
+		}
+		_, _, loopErr = fetchModelsPaginated(db, metadataClient, imageDownloader, queryParams, &globalConfig, cmd, func(page []potentialDownload) {
+			// Pages are queued as they come in, so each page is ordered on its own
+			sortDownloadQueue(page, queueOrder, nil)
+			for _, pd := range page {
+				if admitDownload(pd, diskSpace, budget) {
+					pool.queue(pd)
+				}
+			}
+		})
+		downloadService.setPhase("downloading")
+		pool.wait()
+		diskSpace.report()
+		budget.report()
+		if loopErr != nil {
+			log.Errorf("Metadata gathering stopped with error: %v (files already queued were still downloaded)", loopErr)
+			return
+		}
+		log.Info("--- Finished Phase 1+3: Metadata Gathering with Concurrent Downloads ---")
+		log.Info("Download process complete.")
+		return
 	} else {
 		// --- Existing Pagination Logic ---
 		log.Info("--- Starting Phase 1: Metadata Gathering & DB Check --- (Pagination)")
-		downloadsToQueue, _, loopErr = fetchModelsPaginated(db, metadataClient, imageDownloader, queryParams, &globalConfig, cmd)
+		downloadService.setPhase("listing models")
+		downloadsToQueue, _, loopErr = fetchModelsPaginated(db, metadataClient, imageDownloader, queryParams, &globalConfig, cmd, nil)
 
 		if loopErr != nil {
 			log.Errorf("Metadata gathering phase finished with error: %v", loopErr)
@@ -490,33 +902,64 @@ func runDownload(cmd *cobra.Command, args []string) {
 		}
 		log.Info("--- Finished Phase 1: Metadata Gathering & DB Check ---")
 	}
+	downloadsToQueue = withResumed(resumed, downloadsToQueue)
 
 	// =============================================
 	// Phase 1.5: Handle Metadata-Only Mode
 	// =============================================
 	// Use viper to check meta-only flag
 	if viper.GetBool("downloadmetaonly") { // Viper key from init()
-		if handleMetadataOnlyMode(downloadsToQueue, &globalConfig) {
+		if handleMetadataOnlyMode(downloadsToQueue, db, imageDownloader, bleveIndex) {
 			return // Exit if the handler function indicates we should.
 		}
 	}
 
+	// Watch mode outside its download windows: keep what was found for the next window
+	if downloadWatch != nil && downloadWindow != nil {
+		if !downloadWindow.open(time.Now()) {
+			if len(downloadsToQueue) > 0 {
+				deferDownloads(db, downloadsToQueue)
+				log.Infof("Deferred %d download(s) until the download window opens.", len(downloadsToQueue))
+			}
+			return
+		}
+		downloadsToQueue = append(downloadsToQueue, deferredDownloads(db, downloadsToQueue)...)
+	}
+
 	// =============================================
 	// Phase 2: Summary & Confirmation
 	// =============================================
+	// Downloads are put in queue order, then the ones that don't fit on disk or in the size
+	// budget are dropped, so the summary shows what will run
+	sortDownloadQueue(downloadsToQueue, queueOrder, resumed)
+	if downloadsToQueue = preflightDiskSpace(downloadsToQueue, diskSpace); diskSpace != nil && diskSpace.stopped {
+		return
+	}
+	downloadsToQueue = preflightSizeBudget(downloadsToQueue, budget)
+	if viper.GetBool("downloaddryrun") {
+		printDownloadPlan(downloadsToQueue)
+		return
+	}
 	// Confirmation logic moved to confirmDownload function
 	if !confirmDownload(downloadsToQueue) {
+		// Finding nothing to download still counts as a sync for the badges; a declined run doesn't
+		writeSummary = len(downloadsToQueue) == 0
 		return // Exit if user cancels
 	}
 
 	// =============================================
 	// Phase 3: Download Execution
 	// =============================================
+	// A single run started outside the download windows waits for the next one
+	if downloadWatch == nil && len(downloadsToQueue) > 0 {
+		downloadWindow.waitOpen("Downloads")
+	}
 	// Call the function to execute downloads, passing the index
 	executeDownloads(downloadsToQueue, db, fileDownloader, imageDownloader, concurrencyLevel, &globalConfig, bleveIndex)
 
 	// =============================================
 	// Phase 4: Final Summary
 	// =============================================
+	// The run summary (deferred above) reports the Cloudflare challenges of every path
 	log.Info("Download process complete.")
 }
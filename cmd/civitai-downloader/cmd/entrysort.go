@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+)
+
+// entrySortOrders are the orders database listings can be sorted in (--sort).
+var entrySortOrders = []string{"id", "name", "creator", "type", "base-model", "status"}
+
+// listedEntry is a database entry of a listing, with its key.
+type listedEntry struct {
+	Key   string
+	Entry models.DatabaseEntry
+}
+
+// versionID returns the version ID of the entry, from its key if the entry lacks it.
+func (e listedEntry) versionID() int {
+	if e.Entry.Version.ID != 0 {
+		return e.Entry.Version.ID
+	}
+	id, _ := strconv.Atoi(strings.TrimPrefix(e.Key, "v_"))
+	return id
+}
+
+// sortListedEntries sorts a listing by order: "id" sorts by version ID; the others by
+// that field (see helpers.CollateLess), then model name, version name and version ID,
+// so the same entries always come out in the same order.
+func sortListedEntries(list []listedEntry, order string) error {
+	var field func(models.DatabaseEntry) string
+	switch strings.ToLower(order) {
+	case "", "id":
+	case "name":
+		field = func(models.DatabaseEntry) string { return "" }
+	case "creator":
+		field = func(e models.DatabaseEntry) string { return e.Creator.Username }
+	case "type":
+		field = func(e models.DatabaseEntry) string {
+			if e.InferredType != "" {
+				return e.InferredType
+			}
+			return e.ModelType
+		}
+	case "base-model":
+		field = func(e models.DatabaseEntry) string { return e.Version.BaseModel }
+	case "status":
+		field = func(e models.DatabaseEntry) string { return e.Status }
+	default:
+		return fmt.Errorf("invalid --sort %q: use %s", order, strings.Join(entrySortOrders, ", "))
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if field != nil {
+			for _, pair := range [][2]string{
+				{field(a.Entry), field(b.Entry)},
+				{a.Entry.ModelName, b.Entry.ModelName},
+				{a.Entry.Version.Name, b.Entry.Version.Name},
+			} {
+				if pair[0] != pair[1] {
+					return helpers.CollateLess(pair[0], pair[1])
+				}
+			}
+		}
+		if a.versionID() != b.versionID() {
+			return a.versionID() < b.versionID()
+		}
+		return a.Key < b.Key
+	})
+	return nil
+}
@@ -0,0 +1,343 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	index "github.com/dreamfast/go-civitai-downloader/index"
+	"github.com/dreamfast/go-civitai-downloader/internal/database"
+	"github.com/dreamfast/go-civitai-downloader/internal/downloader"
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+)
+
+// fetchCmd downloads model files for entries previously cataloged with --metadata-only
+var fetchCmd = &cobra.Command{
+	Use:   "fetch [<model-id|version-id|air|query>]",
+	Short: "Download model files for cataloged entries",
+	Long: `Downloads the model files for entries cataloged with 'download --metadata-only'.
+
+The argument selects entries from the local database: a number matches a model ID or a
+model version ID, an AIR (urn:air:...:civitai:<model>@<version>) its model or version,
+and anything else matches model and version names (case-insensitive).
+The download URL, hashes and target folder stored at catalog time are reused, so no API
+calls are made. The catalog sidecar is updated with the download receipt and the entry
+is marked Downloaded.
+
+With --failed, the downloads whose last attempt failed (the ones listed in failed.json
+after each download run) are fetched again; the argument is optional then.`,
+	Example: `  civitai-downloader fetch 12345
+  civitai-downloader fetch "detail tweaker" --yes
+  civitai-downloader fetch --failed`,
+	Args: cobra.MaximumNArgs(1),
+	Run:  runFetch,
+}
+
+func init() {
+	rootCmd.AddCommand(fetchCmd)
+	fetchCmd.Flags().BoolP("yes", "y", false, "Skip the confirmation prompt")
+	fetchCmd.Flags().Bool("include-failed", false, "Also fetch matching entries that are Pending, Downloading or Error, not just Cataloged")
+	fetchCmd.Flags().Bool("failed", false, "Fetch the downloads that failed (all of them without an argument)")
+	fetchCmd.Flags().Bool("accept-hash-change", false, "Allow downloading a version whose file hashes changed since they were first recorded")
+}
+
+// catalogMatch is a database entry selected by fetch.
+type catalogMatch struct {
+	Key   string
+	Entry models.DatabaseEntry
+}
+
+// selectCatalogEntries returns the entries matching selector with one of the given statuses,
+// ordered by DB key.
+func selectCatalogEntries(db *database.DB, selector string, statuses []string) ([]catalogMatch, error) {
+	id, idErr := strconv.Atoi(selector)
+	query := strings.ToLower(strings.TrimSpace(selector))
+	var air helpers.AIR
+	if helpers.IsAIR(selector) {
+		var err error
+		if air, err = helpers.ParseAIR(selector); err != nil {
+			return nil, err
+		}
+	}
+
+	var matches []catalogMatch
+	err := db.Fold(func(key []byte, value []byte) error {
+		keyStr := string(key)
+		if !strings.HasPrefix(keyStr, "v_") {
+			return nil
+		}
+		var entry models.DatabaseEntry
+		if err := json.Unmarshal(value, &entry); err != nil {
+			log.WithError(err).Warnf("Skipping unreadable entry %s", keyStr)
+			return nil
+		}
+		if !containsFold(statuses, entry.Status) {
+			return nil
+		}
+		if air.ModelID > 0 {
+			if entry.Version.ModelId != air.ModelID || (air.VersionID > 0 && entry.Version.ID != air.VersionID) {
+				return nil
+			}
+		} else if idErr == nil {
+			if entry.Version.ModelId != id && entry.Version.ID != id {
+				return nil
+			}
+		} else if !strings.Contains(strings.ToLower(entry.ModelName+" "+entry.Version.Name), query) {
+			return nil
+		}
+		matches = append(matches, catalogMatch{Key: keyStr, Entry: entry})
+		return nil
+	})
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Key < matches[j].Key })
+	return matches, err
+}
+
+// entryVersionDir returns the directory a version's file is saved in: the recorded
+// VersionDir, or for entries from before path templates {SavePath}/{Folder}/{versionID}-{fileNameSlug},
+// matching the download path construction.
+func entryVersionDir(savePath string, entry models.DatabaseEntry) string {
+	if entry.VersionDir != "" {
+		return filepath.Join(savePath, entry.VersionDir)
+	}
+	fileNameWithoutExt := strings.TrimSuffix(entry.File.Name, filepath.Ext(entry.File.Name))
+	versionSlug := fmt.Sprintf("%d-%s", entry.Version.ID, helpers.ConvertToSlug(fileNameWithoutExt))
+	return filepath.Join(savePath, entry.Folder, versionSlug)
+}
+
+// entryModelDir returns the directory of an entry's model, {SavePath}/{type}/{model} (below
+// the NSFW partition if there is one), where the model info file and gallery images are saved.
+func entryModelDir(savePath string, entry models.DatabaseEntry) string {
+	return modelDirFor(savePath, entry.ModelType, entry.ModelName, entry.Version.ModelId, entry.ModelNsfw != nil && *entry.ModelNsfw, entry.ModelNsfwLevel)
+}
+
+// potentialDownloadFromEntry rebuilds the download job for a stored entry, so the worker's
+// sidecar and index helpers can be reused without asking the API again.
+func potentialDownloadFromEntry(entry models.DatabaseEntry, targetPath string) potentialDownload {
+	return potentialDownload{
+		ModelName:         entry.ModelName,
+		ModelType:         entry.ModelType,
+		VersionName:       entry.Version.Name,
+		BaseModel:         entry.Version.BaseModel,
+		Creator:           entry.Creator,
+		ModelNsfw:         entry.ModelNsfw != nil && *entry.ModelNsfw, // The worker keeps it as the drift baseline
+		ModelNsfwLevel:    entry.ModelNsfwLevel,
+		ModelTags:         entry.ModelTags,
+		Permissions:       entry.Permissions,
+		File:              entry.File,
+		ModelVersionID:    entry.Version.ID,
+		TargetFilepath:    targetPath,
+		Slug:              entry.Folder,
+		VersionDir:        entry.VersionDir,
+		FinalBaseFilename: filepath.Base(targetPath),
+		CleanedVersion:    entry.Version,
+		FullVersion:       entry.Version,
+	}
+}
+
+func runFetch(cmd *cobra.Command, args []string) {
+	skipConfirm, _ := cmd.Flags().GetBool("yes")
+	includeFailed, _ := cmd.Flags().GetBool("include-failed")
+	onlyFailed, _ := cmd.Flags().GetBool("failed")
+	acceptHashChange, _ := cmd.Flags().GetBool("accept-hash-change")
+
+	selector := ""
+	if len(args) == 1 {
+		selector = args[0]
+	} else if !onlyFailed {
+		log.Fatal("Give a model ID, version ID, AIR or query, or --failed.")
+	}
+
+	if globalConfig.DatabasePath == "" {
+		log.Fatal("Database path is not set in the configuration.")
+	}
+	if globalConfig.SavePath == "" {
+		log.Fatal("Save path is not set in the configuration.")
+	}
+
+	schedule, err := newDownloadSchedule()
+	if err != nil {
+		log.Fatalf("Invalid download window settings: %v", err)
+	}
+
+	db, err := database.Open(globalConfig.DatabasePath)
+	if err != nil {
+		log.WithError(err).Fatalf("Failed to open database at %s", globalConfig.DatabasePath)
+	}
+	defer db.Close()
+
+	statuses := []string{models.StatusCataloged}
+	if includeFailed {
+		statuses = append(statuses, models.StatusPending, models.StatusDownloading, models.StatusError)
+	} else if onlyFailed {
+		statuses = []string{models.StatusError}
+	}
+	matches, err := selectCatalogEntries(db, selector, statuses)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to scan the database")
+	}
+	if len(matches) == 0 {
+		fmt.Printf("No %s entries match '%s'.\n", strings.Join(statuses, "/"), selector)
+		return
+	}
+	if onlyFailed || includeFailed {
+		defer writeFailedList(db, globalConfig.SavePath, time.Now())
+	}
+
+	var totalKB float64
+	fmt.Printf("%d file(s) to fetch:\n", len(matches))
+	for _, m := range matches {
+		totalKB += m.Entry.File.SizeKB
+		fmt.Printf("  %s  %s - %s (%s, %s)\n", m.Key, m.Entry.ModelName, m.Entry.Version.Name, m.Entry.File.Name, helpers.BytesToSize(uint64(m.Entry.File.SizeKB*1024)))
+	}
+	fmt.Printf("Total size: %s\n", helpers.BytesToSize(uint64(totalKB*1024)))
+
+	if !skipConfirm {
+		reader := bufio.NewReader(os.Stdin)
+		fmt.Print("Proceed with download? (y/N): ")
+		input, _ := reader.ReadString('\n')
+		if strings.ToLower(strings.TrimSpace(input)) != "y" {
+			fmt.Println("Aborted.")
+			return
+		}
+	}
+
+	fileDownloader := downloader.NewDownloader(&http.Client{Timeout: 0, Transport: globalHttpTransport}, globalConfig.ApiKey)
+	fileDownloader.SetTempDir(downloadTempDir())
+	fileDownloader.SetSegments(globalConfig.DownloadSegments)
+	fileDownloader.SetRetries(viper.GetInt("maxretries"), globalRetryDelay, globalRetryPolicy)
+	fileDownloader.SetStallTimeout(time.Duration(viper.GetInt("stalltimeoutsec")) * time.Second)
+	fileDownloader.SetHashAlgorithms(globalHashAlgorithms)
+	fileDownloader.SetKeepMismatched(globalKeepMismatched)
+	fileDownloader.SetQuarantineDir(globalQuarantineDir)
+	fileDownloader.SetMismatchRetries(viper.GetInt("mismatchretries"))
+	fileDownloader.SetAria2(globalAria2)
+	fileDownloader.SetMirrors(viper.GetStringSlice("mirrorurls"))
+	fileDownloader.SetPreallocate(viper.GetBool("preallocate"))
+	fileDownloader.SetHostOverrides(globalHostOverrides)
+
+	indexPath := globalConfig.BleveIndexPath
+	if indexPath == "" {
+		indexPath = filepath.Join(globalConfig.SavePath, "civitai.bleve")
+	}
+	bleveIndex, err := index.OpenOrCreateIndex(indexPath)
+	if err != nil {
+		log.WithError(err).Warnf("Failed to open search index at %s; fetched files won't be re-indexed", indexPath)
+	} else {
+		defer bleveIndex.Close()
+	}
+
+	var fetched, failed int
+	for _, m := range matches {
+		entry := m.Entry
+		if entry.File.DownloadUrl == "" {
+			log.Errorf("%s has no stored download URL; re-catalog it with 'download --metadata-only'", m.Key)
+			failed++
+			continue
+		}
+		if change := hashPinChange(entry, entry.File); change != "" && !acceptHashChange {
+			log.Errorf("Refusing fetch of %s: %s. Re-run with --accept-hash-change to trust the new file.", m.Key, change)
+			failed++
+			continue
+		}
+
+		// The catalog stored the name with the "<versionID>_" prefix the downloader adds itself
+		versionDir := entryVersionDir(globalConfig.SavePath, entry)
+		catalogPath := filepath.Join(versionDir, entry.Filename)
+		targetPath := filepath.Join(versionDir, strings.TrimPrefix(entry.Filename, fmt.Sprintf("%d_", entry.Version.ID)))
+		schedule.waitOpen("Fetch")
+		log.Infof("Fetching %s -> %s", m.Key, targetPath)
+
+		finalPath, receipt, downloadErr := fileDownloader.DownloadFileWithReceipt(targetPath, entry.File.DownloadUrl, entry.File.Hashes, entryFileNameVersionID(entry))
+		if downloadErr != nil {
+			log.WithError(downloadErr).Errorf("Fetch failed for %s", m.Key)
+			failed++
+			// Stay cataloged so the same fetch can be retried
+			status := entry.Status
+			if status == models.StatusPending || status == models.StatusDownloading {
+				status = models.StatusError
+			}
+			if updateErr := updateDbEntry(db, m.Key, status, func(e *models.DatabaseEntry) {
+				setEntryError(e, downloadErr)
+			}); updateErr != nil {
+				log.Errorf("Failed to record fetch error for %s: %v", m.Key, updateErr)
+			}
+			continue
+		}
+		fetched++
+
+		training := readTrainingMetadata("fetch", db, m.Key, finalPath)
+		updateErr := updateDbEntry(db, m.Key, models.StatusDownloaded, func(e *models.DatabaseEntry) {
+			e.ErrorDetails = ""
+			e.Filename = filepath.Base(finalPath)
+			recordEmbeddingToken(e)
+			e.Training = training
+			if receipt.ComputedHashes != nil {
+				e.LocalHashes = receipt.ComputedHashes
+			}
+			if e.PinnedHashes == nil || e.PinnedFileID != e.File.ID || acceptHashChange {
+				pinFileHashes(e, e.File)
+			}
+		})
+		if updateErr != nil {
+			log.Errorf("Failed to mark %s as downloaded: %v", m.Key, updateErr)
+		}
+
+		pd := potentialDownloadFromEntry(entry, targetPath)
+		updateCatalogSidecar(pd, catalogPath, finalPath, receipt, training)
+		if bleveIndex != nil {
+			item := modelFileIndexItem(pd, finalPath)
+			if indexErr := index.IndexItem(bleveIndex, item); indexErr != nil {
+				log.WithError(indexErr).Warnf("Failed to re-index %s", finalPath)
+			}
+		}
+		fmt.Printf("Fetched %s\n", finalPath)
+	}
+
+	fmt.Printf("Fetch complete. Downloaded: %d, Failed: %d\n", fetched, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// updateCatalogSidecar adds the download receipt to the sidecar written at catalog time,
+// keeping its stored API JSON, plus any training metadata read from the file. If the server named the file differently, the sidecar and
+// preview are moved to match the downloaded file.
+func updateCatalogSidecar(pd potentialDownload, catalogPath, finalPath string, receipt *downloader.Receipt, training *models.TrainingMetadata) {
+	catalogStem := strings.TrimSuffix(catalogPath, filepath.Ext(catalogPath))
+	finalStem := strings.TrimSuffix(finalPath, filepath.Ext(finalPath))
+
+	if raw, err := os.ReadFile(catalogStem + ".json"); err == nil && json.Valid(raw) {
+		pd.RawVersion = raw
+	}
+	extras := receiptField(receipt)
+	if training != nil {
+		extras = append(extras, sidecarField{Key: sidecarTrainingKey, Value: training})
+	}
+	if err := saveMetadataFile(pd, finalPath, extras...); err != nil {
+		return // Already logged
+	}
+	if catalogStem == finalStem {
+		return
+	}
+
+	os.Remove(catalogStem + ".json")
+	for _, suffix := range []string{".preview.png", ".preview.webp"} {
+		if _, err := os.Stat(catalogStem + suffix); err == nil {
+			if err := os.Rename(catalogStem+suffix, finalStem+suffix); err != nil {
+				log.WithError(err).Warnf("Failed to rename preview %s", catalogStem+suffix)
+			}
+		}
+	}
+}
@@ -0,0 +1,367 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/database"
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+)
+
+// installCmd unpacks a bundle written by package into this archive
+var installCmd = &cobra.Command{
+	Use:   "install <bundle>",
+	Short: "Install a model bundle made by 'package'",
+	Long: `Unpacks a bundle written by 'package' (.tar.zst, .tar.gz or .tar) and adds it to this
+archive as if it had been downloaded here: every file is checked against the manifest's
+size and SHA256 before anything is placed, the version files go where the configured
+PathTemplate puts them, and the versions are recorded in the database as Downloaded
+(and added to the search index, if there is one).
+
+Files already present with the same contents are left alone; files present with other
+contents stop the install unless --force is given. A bad or incomplete bundle changes
+nothing.`,
+	Example: `  civitai-downloader install ./bundles/58390-detail_tweaker.tar.zst --dry-run
+  civitai-downloader install /media/usb/58390-detail_tweaker.tar.zst --yes`,
+	Args: cobra.ExactArgs(1),
+	Run:  runInstall,
+}
+
+func init() {
+	rootCmd.AddCommand(installCmd)
+	installCmd.Flags().Bool("dry-run", false, "Verify the bundle and show where its files would go, without installing")
+	installCmd.Flags().BoolP("yes", "y", false, "Skip the confirmation prompt")
+	installCmd.Flags().Bool("force", false, "Overwrite existing files whose contents differ from the bundle's")
+}
+
+// installFile is a verified bundle file and where it goes.
+type installFile struct {
+	bundleManifestEntry
+	Staged string // Extracted copy
+	Target string // Final location
+	Exists bool   // Target already has these contents
+	Differ bool   // Target exists with other contents
+}
+
+func runInstall(cmd *cobra.Command, args []string) {
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+	skipConfirm, _ := cmd.Flags().GetBool("yes")
+	force, _ := cmd.Flags().GetBool("force")
+
+	if globalConfig.DatabasePath == "" || globalConfig.SavePath == "" {
+		log.Fatal("DatabasePath and SavePath must be set in the configuration.")
+	}
+	if err := helpers.ValidatePathTemplate(pathTemplate()); err != nil {
+		log.Fatalf("Invalid PathTemplate: %v", err)
+	}
+	if err := validateNsfwPartition(); err != nil {
+		log.Fatal(err)
+	}
+	savePath := globalConfig.SavePath
+	if err := helpers.MkdirAll(savePath, 0755); err != nil {
+		log.WithError(err).Fatalf("Failed to create %s", savePath)
+	}
+	// Extracted into TempDir like any other staging; placing the files moves them across
+	// filesystems if TempDir is on another disk
+	tempDir := downloadTempDir()
+	if err := os.MkdirAll(tempDir, 0700); err != nil {
+		log.WithError(err).Fatalf("Failed to create %s", tempDir)
+	}
+	staging, err := os.MkdirTemp(tempDir, "install-")
+	if err != nil {
+		log.WithError(err).Fatal("Failed to create a staging directory")
+	}
+	defer os.RemoveAll(staging)
+
+	fmt.Printf("Verifying %s...\n", args[0])
+	manifest, files, err := extractBundle(args[0], staging)
+	if err != nil {
+		log.WithError(err).Fatal("The bundle failed verification; nothing was installed")
+	}
+	if len(manifest.Entries) == 0 {
+		log.Fatal("The bundle has no versions to install.")
+	}
+	entries, err := planInstall(savePath, manifest, files)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to place the bundle's files")
+	}
+
+	var place, same, differ int
+	fmt.Printf("Bundle: %s (%d), %d versions, %d files, verified.\n", manifest.ModelName, manifest.ModelID, len(manifest.Entries), len(files))
+	for _, f := range files {
+		rel, _ := filepath.Rel(savePath, f.Target)
+		switch {
+		case f.Exists:
+			same++
+			fmt.Printf("  = %s (already present)\n", rel)
+		case f.Differ:
+			differ++
+			fmt.Printf("  ! %s (exists with other contents)\n", rel)
+		default:
+			place++
+			fmt.Printf("  + %s\n", rel)
+		}
+	}
+	if differ > 0 && !force {
+		log.Fatalf("%d files exist with other contents; use --force to overwrite them", differ)
+	}
+	if dryRun {
+		fmt.Printf("Dry run: %d files would be placed, %d are already present.\n", place+differ, same)
+		return
+	}
+	if !skipConfirm {
+		fmt.Printf("Install %d files and record %d versions? (y/N) ", place+differ, len(entries))
+		reader := bufio.NewReader(os.Stdin)
+		input, _ := reader.ReadString('\n')
+		if strings.ToLower(strings.TrimSpace(input)) != "y" {
+			fmt.Println("Aborted.")
+			return
+		}
+	}
+
+	db, err := database.Open(globalConfig.DatabasePath)
+	if err != nil {
+		log.WithError(err).Fatalf("Failed to open database at %s", globalConfig.DatabasePath)
+	}
+	defer db.Close()
+
+	for _, f := range files {
+		if f.Exists {
+			continue
+		}
+		if err := helpers.MkdirAll(filepath.Dir(f.Target), 0755); err != nil {
+			log.WithError(err).Fatalf("Failed to create the directory for %s", f.Target)
+		}
+		if err := helpers.MoveFile(f.Staged, f.Target); err != nil {
+			log.WithError(err).Fatalf("Failed to place %s", f.Target)
+		}
+	}
+	if err := updateMigratedEntries(db, entries); err != nil {
+		log.WithError(err).Fatal("Failed to record the versions in the database")
+	}
+	reindexMigratedEntries(entries)
+	fmt.Printf("Installed %s: %d files placed, %d already present, %d versions recorded.\n", manifest.ModelName, place+differ, same, len(entries))
+}
+
+// extractBundle extracts a bundle's files below staging and verifies them: every file
+// must match the manifest's size and SHA256, and every file in the manifest must be there.
+func extractBundle(bundlePath, staging string) (bundleManifest, []installFile, error) {
+	var manifest bundleManifest
+	f, err := os.Open(bundlePath)
+	if err != nil {
+		return manifest, nil, err
+	}
+	defer f.Close()
+	r, wait, err := bundleReader(f)
+	if err != nil {
+		return manifest, nil, err
+	}
+
+	tr := tar.NewReader(r)
+	type stagedFile struct {
+		size int64
+		sum  string
+	}
+	extracted := make(map[string]stagedFile) // "<root>/files/<path>" -> contents
+	var root string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return manifest, nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := path.Clean(hdr.Name)
+		if path.Base(name) == "manifest.json" && path.Dir(path.Dir(name)) == "." {
+			root = path.Dir(name)
+			if err := json.NewDecoder(io.LimitReader(tr, 64<<20)).Decode(&manifest); err != nil {
+				return manifest, nil, fmt.Errorf("reading manifest.json: %w", err)
+			}
+			continue
+		}
+		dir, rel, ok := strings.Cut(name, "/files/")
+		if !ok || dir == ".." || strings.Contains(dir, "/") || !safeBundlePath(rel) {
+			continue // README.md and SHA256SUMS
+		}
+		size, sum, err := stageBundleFile(tr, filepath.Join(staging, dir, filepath.FromSlash(rel)))
+		if err != nil {
+			return manifest, nil, fmt.Errorf("extracting %s: %w", rel, err)
+		}
+		extracted[name] = stagedFile{size: size, sum: sum}
+	}
+	io.Copy(io.Discard, r) // Let the decompressor finish
+	if err := wait(); err != nil {
+		return manifest, nil, err
+	}
+	if root == "" {
+		return manifest, nil, errors.New("not a bundle: there is no manifest.json")
+	}
+	if manifest.FormatVersion > bundleFormatVersion {
+		return manifest, nil, fmt.Errorf("bundle format %d is newer than this version supports (%d)", manifest.FormatVersion, bundleFormatVersion)
+	}
+
+	var files []installFile
+	for _, want := range manifest.Files {
+		if !safeBundlePath(want.Path) {
+			return manifest, nil, fmt.Errorf("unsafe path in the manifest: %q", want.Path)
+		}
+		name := root + "/files/" + want.Path
+		got, ok := extracted[name]
+		if !ok {
+			return manifest, nil, fmt.Errorf("%s is in the manifest but not in the bundle", want.Path)
+		}
+		delete(extracted, name)
+		if got.size != want.Size {
+			return manifest, nil, fmt.Errorf("%s is %d bytes, the manifest says %d", want.Path, got.size, want.Size)
+		}
+		if !strings.EqualFold(got.sum, want.SHA256) {
+			return manifest, nil, fmt.Errorf("%s has SHA256 %s, the manifest says %s", want.Path, got.sum, want.SHA256)
+		}
+		files = append(files, installFile{bundleManifestEntry: want, Staged: filepath.Join(staging, root, filepath.FromSlash(want.Path))})
+	}
+	for name := range extracted {
+		return manifest, nil, fmt.Errorf("%s is not in the manifest", name)
+	}
+	return manifest, files, nil
+}
+
+// bundleReader decompresses a bundle by its magic bytes: zstd (with the zstd program),
+// gzip or a plain tar. wait reports errors of the decompressor once the tar has been read.
+func bundleReader(f io.Reader) (r io.Reader, wait func() error, err error) {
+	br := bufio.NewReader(f)
+	magic, _ := br.Peek(4)
+	switch {
+	case bytes.Equal(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		zstd := exec.Command("zstd", "-q", "-d", "-c")
+		zstd.Stdin = br
+		zstd.Stderr = os.Stderr
+		out, err := zstd.StdoutPipe()
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := zstd.Start(); err != nil {
+			return nil, nil, fmt.Errorf("zstd bundles need the zstd program: %w", err)
+		}
+		return out, zstd.Wait, nil
+	case len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b:
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, nil, err
+		}
+		return gz, gz.Close, nil
+	}
+	return br, func() error { return nil }, nil
+}
+
+// safeBundlePath reports whether a manifest path stays below the save path.
+func safeBundlePath(p string) bool {
+	clean := path.Clean(p)
+	return p != "" && clean == p && !path.IsAbs(clean) && clean != ".." && !strings.HasPrefix(clean, "../") && !strings.Contains(p, "\\")
+}
+
+// stageBundleFile writes a file of the bundle to staged and returns its size and SHA256.
+func stageBundleFile(r io.Reader, staged string) (int64, string, error) {
+	if err := helpers.MkdirAll(filepath.Dir(staged), 0755); err != nil {
+		return 0, "", err
+	}
+	out, err := os.Create(staged)
+	if err != nil {
+		return 0, "", err
+	}
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(out, hasher), r)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return size, hex.EncodeToString(hasher.Sum(nil)), err
+}
+
+// planInstall decides where each file goes: files in a version's directory move to the
+// directory the current PathTemplate gives that version, everything else (model info and
+// images) keeps its place below SavePath. It returns the entries to record.
+func planInstall(savePath string, manifest bundleManifest, files []installFile) ([]pathMigration, error) {
+	template := pathTemplate()
+	type versionMove struct {
+		from string // Version directory in the bundle, with forward slashes
+		to   string // Relative to savePath
+	}
+	var moves []versionMove
+	var entries []pathMigration
+	for _, be := range manifest.Entries {
+		entry := be.Entry
+		modelType := entry.ModelType
+		if entry.InferredType != "" {
+			modelType = entry.InferredType
+		}
+		newDir, err := helpers.RenderPathTemplate(template, entryPathValues(entry, modelType))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", be.Key, err)
+		}
+		from := filepath.ToSlash(entryVersionDir("", entry))
+		if !bundleHasFile(files, path.Join(from, entry.Filename)) {
+			log.Warnf("%s: the bundle has no model file %s, not recording it", be.Key, entry.Filename)
+			continue
+		}
+		moves = append(moves, versionMove{from: from, to: newDir})
+		entry.Status = models.StatusDownloaded
+		entry.ErrorDetails = ""
+		entries = append(entries, pathMigration{Key: be.Key, Entry: entry, To: filepath.Join(savePath, newDir), NewDir: newDir})
+	}
+	// Longest version directory first, in case one contains another
+	sort.Slice(moves, func(i, j int) bool { return len(moves[i].from) > len(moves[j].from) })
+
+	for i := range files {
+		f := &files[i]
+		target := filepath.Join(savePath, filepath.FromSlash(f.Path))
+		for _, m := range moves {
+			if rest, ok := strings.CutPrefix(f.Path, m.from+"/"); ok {
+				target = filepath.Join(savePath, m.to, filepath.FromSlash(rest))
+				break
+			}
+		}
+		f.Target = target
+		if _, err := os.Stat(target); err == nil {
+			f.Exists = sameFileHash(target, f.SHA256)
+			f.Differ = !f.Exists
+		}
+	}
+	return entries, nil
+}
+
+// bundleHasFile reports whether the bundle has a file at p (relative to files/).
+func bundleHasFile(files []installFile, p string) bool {
+	for _, f := range files {
+		if f.Path == p {
+			return true
+		}
+	}
+	return false
+}
+
+// sameFileHash reports whether the file at path has the given SHA256.
+func sameFileHash(path, sha256Hex string) bool {
+	sum, err := helpers.FileSHA256(path)
+	return err == nil && strings.EqualFold(sum, sha256Hex)
+}
@@ -0,0 +1,488 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	index "github.com/dreamfast/go-civitai-downloader/index"
+	"github.com/dreamfast/go-civitai-downloader/internal/database"
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+)
+
+// migratePathsCmd moves downloaded versions to the layout of a new path template
+var migratePathsCmd = &cobra.Command{
+	Use:   "migrate-paths",
+	Short: "Move downloaded files to a new PathTemplate layout",
+	Long: `Computes where every database entry belongs under --to-template (default: the
+configured PathTemplate), lists the moves, and performs them: version directories are
+moved, the database entries are updated, the search index is refreshed for moved files,
+and symlinks under the --relink directories that point into moved paths are retargeted.
+
+The current location of an entry is the one recorded in the database, or the one
+--from-template gives for it. If a move or a database update fails, everything done so
+far is rolled back. Run it without other downloader processes using the database.`,
+	Example: `  civitai-downloader migrate-paths --to-template "{type}/{creator}/{model}/{versionId}-{file}" --dry-run
+  civitai-downloader migrate-paths --to-template "{type}/{creator}/{model}/{versionId}-{file}" --relink ~/ComfyUI/models --yes`,
+	Args: cobra.NoArgs,
+	Run:  runMigratePaths,
+}
+
+func init() {
+	rootCmd.AddCommand(migratePathsCmd)
+	migratePathsCmd.Flags().String("from-template", "", "Template the files are currently laid out by (default: the location recorded for each entry)")
+	migratePathsCmd.Flags().String("to-template", "", "Template to move the files to (default: PathTemplate from config)")
+	migratePathsCmd.Flags().Bool("dry-run", false, "Only list the moves")
+	migratePathsCmd.Flags().BoolP("yes", "y", false, "Skip the confirmation prompt")
+	migratePathsCmd.Flags().StringSlice("relink", []string{}, "Directory with symlinks into SavePath (e.g. a UI's models folder) to retarget (repeatable)")
+}
+
+// pathMigration is the planned move of one entry's version directory.
+type pathMigration struct {
+	Key      string
+	Entry    models.DatabaseEntry
+	From, To string // Absolute version directories
+	NewDir   string // To, relative to SavePath
+	Present  bool   // From exists on disk
+	Shared   bool   // From also holds other entries' files: only this entry's files are moved
+}
+
+// completedMove is a rename done by the migration, undone in reverse order on rollback.
+type completedMove struct {
+	From, To string
+}
+
+func runMigratePaths(cmd *cobra.Command, args []string) {
+	fromTemplate, _ := cmd.Flags().GetString("from-template")
+	toTemplate, _ := cmd.Flags().GetString("to-template")
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+	skipConfirm, _ := cmd.Flags().GetBool("yes")
+	relinkDirs, _ := cmd.Flags().GetStringSlice("relink")
+
+	if err := validateNsfwPartition(); err != nil {
+		log.Fatal(err)
+	}
+	if toTemplate == "" {
+		toTemplate = pathTemplate()
+	}
+	for _, tmpl := range []string{fromTemplate, toTemplate} {
+		if tmpl == "" {
+			continue
+		}
+		if err := helpers.ValidatePathTemplate(tmpl); err != nil {
+			log.Fatalf("Invalid template: %v", err)
+		}
+	}
+	if globalConfig.DatabasePath == "" || globalConfig.SavePath == "" {
+		log.Fatal("DatabasePath and SavePath must be set in the configuration.")
+	}
+
+	db, err := database.Open(globalConfig.DatabasePath)
+	if err != nil {
+		log.WithError(err).Fatalf("Failed to open database at %s", globalConfig.DatabasePath)
+	}
+	defer db.Close()
+
+	plan, conflicts, err := planPathMigration(db, globalConfig.SavePath, fromTemplate, toTemplate)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to plan the migration")
+	}
+	for _, conflict := range conflicts {
+		log.Error(conflict)
+	}
+	if len(conflicts) > 0 {
+		log.Fatalf("%d entries would end up in the same place; use a template that includes {versionId}", len(conflicts))
+	}
+	if len(plan) == 0 {
+		fmt.Println("Every entry is already where the template puts it.")
+		return
+	}
+
+	fmt.Printf("%d entries to migrate to %q:\n", len(plan), toTemplate)
+	moves, dbOnly := printPathMigration(plan)
+	fmt.Printf("%d director(ies) to move, %d database-only update(s).\n", moves, dbOnly)
+	if dryRun {
+		fmt.Println("Dry run: nothing was changed.")
+		return
+	}
+	if !skipConfirm {
+		reader := bufio.NewReader(os.Stdin)
+		fmt.Print("Proceed with the migration? (y/N): ")
+		input, _ := reader.ReadString('\n')
+		if strings.ToLower(strings.TrimSpace(input)) != "y" {
+			fmt.Println("Aborted.")
+			return
+		}
+	}
+
+	if err := applyPathMigration(db, plan, relinkDirs); err != nil {
+		log.WithError(err).Error("Migration failed; rolled back")
+		os.Exit(1)
+	}
+	fmt.Printf("Migration complete: %d entries now follow %q.\n", len(plan), toTemplate)
+	if toTemplate != pathTemplate() && toTemplate != viper.GetString("pathtemplate") {
+		fmt.Println("Set PathTemplate to the same template so new downloads use it too.")
+	}
+}
+
+// printPathMigration lists the moves of the plan and returns how many directories move
+// and how many entries only get their recorded location updated.
+func printPathMigration(plan []pathMigration) (moves, dbOnly int) {
+	for _, m := range plan {
+		fromRel, _ := filepath.Rel(globalConfig.SavePath, m.From)
+		switch {
+		case m.From == m.To:
+			dbOnly++
+			fmt.Printf("  %s  %s (already in place, recording it)\n", m.Key, m.NewDir)
+		case !m.Present:
+			dbOnly++
+			fmt.Printf("  %s  (no files) %s -> %s\n", m.Key, fromRel, m.NewDir)
+		case m.Shared:
+			moves++
+			fmt.Printf("  %s  %s -> %s (only %s*; the directory is shared)\n", m.Key, fromRel, m.NewDir, fileStem(m.Entry.Filename))
+		default:
+			moves++
+			fmt.Printf("  %s  %s -> %s\n", m.Key, fromRel, m.NewDir)
+		}
+	}
+	return moves, dbOnly
+}
+
+// applyPathMigration performs the plan: it moves the files, records the new locations,
+// refreshes the search index and retargets the symlinks below relinkDirs. If a move or a
+// database update fails, everything done so far is rolled back and the error returned.
+func applyPathMigration(db *database.DB, plan []pathMigration, relinkDirs []string) error {
+	done, err := executePathMigration(plan)
+	if err == nil {
+		err = updateMigratedEntries(db, plan)
+	}
+	if err != nil {
+		rollbackMoves(done)
+		return err
+	}
+	moves := 0
+	for _, m := range plan {
+		if !m.Present {
+			continue
+		}
+		moves++
+		dir := m.From // A shared directory stays; a moved one leaves its parents behind
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			dir = filepath.Dir(dir)
+		}
+		removeEmptyDirs(dir, globalConfig.SavePath)
+	}
+	log.Infof("Moved %d director(ies) and updated %d database entries", moves, len(plan))
+
+	reindexMigratedEntries(plan)
+	if len(relinkDirs) > 0 {
+		relinked := relinkSymlinks(relinkDirs, done)
+		fmt.Printf("Retargeted %d symlink(s).\n", relinked)
+	}
+	applyNsfwPartitionModes(globalConfig.SavePath)
+	return nil
+}
+
+// planPathMigration lists the entries whose version directory changes. conflicts names
+// entries whose files would collide at their new place.
+func planPathMigration(db *database.DB, savePath, fromTemplate, toTemplate string) (plan []pathMigration, conflicts []string, err error) {
+	overrides, err := db.PathOverrides()
+	if err != nil {
+		return nil, nil, err
+	}
+	return planEntryMoves(db, savePath, fromTemplate, toTemplate, overrides, 0)
+}
+
+// planEntryMoves lists the entries whose version directory changes when they are laid out
+// by toTemplate, or by overrides for the models that have one. With modelID set only that
+// model's entries move; the others stay where they are, but are checked for collisions.
+func planEntryMoves(db *database.DB, savePath, fromTemplate, toTemplate string, overrides map[int]string, modelID int) (plan []pathMigration, conflicts []string, err error) {
+	var all []pathMigration
+	owners := make(map[string]int)     // Current directory -> number of entries in it
+	targets := make(map[string]string) // New file path -> key
+	moving := make(map[string]bool)    // Keys of the entries that move
+	err = db.Fold(func(key []byte, value []byte) error {
+		keyStr := string(key)
+		if !strings.HasPrefix(keyStr, "v_") {
+			return nil
+		}
+		var entry models.DatabaseEntry
+		if err := json.Unmarshal(value, &entry); err != nil {
+			log.WithError(err).Warnf("Skipping unreadable entry %s", keyStr)
+			return nil
+		}
+		if entry.NsfwMovedAt != 0 || entry.RemovalAction == "moved" {
+			return nil // Kept apart below NsfwDriftDir or RemovalDir
+		}
+		modelType := entry.ModelType
+		if entry.InferredType != "" {
+			modelType = entry.InferredType
+		}
+		values := entryPathValues(entry, modelType)
+
+		from := entryVersionDir(savePath, entry)
+		if fromTemplate != "" {
+			rel, err := helpers.RenderPathTemplate(fromTemplate, values)
+			if err != nil {
+				return fmt.Errorf("%s: %w", keyStr, err)
+			}
+			from = filepath.Join(savePath, rel)
+		}
+		newDir, to := entry.VersionDir, from
+		if modelID == 0 || entry.Version.ModelId == modelID {
+			moving[keyStr] = true
+			if newDir, err = helpers.RenderPathTemplate(toTemplate, values); err != nil {
+				return fmt.Errorf("%s: %w", keyStr, err)
+			}
+			if override, ok := overrides[entry.Version.ModelId]; ok {
+				newDir = override // Set with 'db set-path'
+			}
+			to = filepath.Join(savePath, newDir)
+		}
+
+		_, statErr := os.Stat(from)
+		owners[from]++
+		if entry.Filename != "" {
+			target := filepath.Join(to, entry.Filename)
+			if other, ok := targets[target]; ok && (moving[keyStr] || moving[other]) {
+				conflicts = append(conflicts, fmt.Sprintf("%s and %s would both be %s", other, keyStr, target))
+			}
+			targets[target] = keyStr
+		}
+		if !moving[keyStr] || from == to && entry.VersionDir == newDir {
+			return nil
+		}
+		all = append(all, pathMigration{Key: keyStr, Entry: entry, From: from, To: to, NewDir: newDir, Present: statErr == nil})
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, m := range all {
+		m.Shared = owners[m.From] > 1
+		if m.Present && m.From == m.To {
+			m.Present = false // Already in place; only the recorded location changes
+		}
+		plan = append(plan, m)
+	}
+	sort.Slice(plan, func(i, j int) bool { return plan[i].Key < plan[j].Key })
+	return plan, conflicts, nil
+}
+
+// executePathMigration performs the moves of the plan, stopping at the first error. It
+// returns the renames done so far.
+func executePathMigration(plan []pathMigration) ([]completedMove, error) {
+	var done []completedMove
+	for _, m := range plan {
+		if !m.Present {
+			continue
+		}
+		if m.Shared {
+			entries, err := os.ReadDir(m.From)
+			if err != nil {
+				return done, err
+			}
+			stem := fileStem(m.Entry.Filename)
+			for _, e := range entries {
+				if e.IsDir() || stem == "" || !strings.HasPrefix(e.Name(), stem) {
+					continue
+				}
+				if err := moveTree(filepath.Join(m.From, e.Name()), filepath.Join(m.To, e.Name()), &done); err != nil {
+					return done, fmt.Errorf("%s: %w", m.Key, err)
+				}
+			}
+			continue
+		}
+		if err := moveTree(m.From, m.To, &done); err != nil {
+			return done, fmt.Errorf("%s: %w", m.Key, err)
+		}
+	}
+	return done, nil
+}
+
+// moveTree moves src to dst, merging directories that already exist at dst. Existing
+// files are never overwritten.
+func moveTree(src, dst string, done *[]completedMove) error {
+	dstInfo, err := os.Lstat(dst)
+	if os.IsNotExist(err) {
+		if err := helpers.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+			return err
+		}
+		if err := os.Rename(src, dst); err != nil {
+			return err
+		}
+		*done = append(*done, completedMove{From: src, To: dst})
+		log.Debugf("Moved %s -> %s", src, dst)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	srcInfo, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if !srcInfo.IsDir() || !dstInfo.IsDir() {
+		return fmt.Errorf("%s already exists", dst)
+	}
+	children, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		if err := moveTree(filepath.Join(src, child.Name()), filepath.Join(dst, child.Name()), done); err != nil {
+			return err
+		}
+	}
+	os.Remove(src) // Emptied by the merge; recreated on rollback
+	return nil
+}
+
+// rollbackMoves undoes renames in reverse order.
+func rollbackMoves(done []completedMove) {
+	for i := len(done) - 1; i >= 0; i-- {
+		move := done[i]
+		if err := helpers.MkdirAll(filepath.Dir(move.From), 0700); err != nil {
+			log.WithError(err).Errorf("Rollback: cannot recreate %s", filepath.Dir(move.From))
+			continue
+		}
+		if err := os.Rename(move.To, move.From); err != nil {
+			log.WithError(err).Errorf("Rollback: cannot move %s back to %s", move.To, move.From)
+			continue
+		}
+		removeEmptyDirs(filepath.Dir(move.To), globalConfig.SavePath)
+	}
+	log.Infof("Rolled back %d move(s)", len(done))
+}
+
+// updateMigratedEntries records the new locations. If a write fails, the entries already
+// updated are restored.
+func updateMigratedEntries(db *database.DB, plan []pathMigration) error {
+	var written []pathMigration
+	for _, m := range plan {
+		entry := m.Entry
+		entry.VersionDir = m.NewDir
+		entry.Folder = filepath.Dir(m.NewDir)
+		value, err := json.Marshal(entry)
+		if err == nil {
+			err = db.Put([]byte(m.Key), value)
+		}
+		if err != nil {
+			for _, w := range written {
+				if old, marshalErr := json.Marshal(w.Entry); marshalErr == nil {
+					if putErr := db.Put([]byte(w.Key), old); putErr != nil {
+						log.WithError(putErr).Errorf("Rollback: cannot restore database entry %s", w.Key)
+					}
+				}
+			}
+			return fmt.Errorf("updating %s: %w", m.Key, err)
+		}
+		written = append(written, m)
+	}
+	return nil
+}
+
+// reindexMigratedEntries points the search index at the new locations of moved files.
+func reindexMigratedEntries(plan []pathMigration) {
+	indexPath := globalConfig.BleveIndexPath
+	if indexPath == "" {
+		indexPath = filepath.Join(globalConfig.SavePath, "civitai.bleve")
+	}
+	if _, err := os.Stat(indexPath); err != nil {
+		return // No index to update
+	}
+	bleveIndex, err := index.OpenOrCreateIndex(indexPath)
+	if err != nil {
+		log.WithError(err).Warnf("Failed to open search index at %s; run 'index' to refresh it", indexPath)
+		return
+	}
+	defer bleveIndex.Close()
+	for _, m := range plan {
+		if m.Entry.Status != models.StatusDownloaded {
+			continue
+		}
+		newPath := filepath.Join(m.To, m.Entry.Filename)
+		entry := m.Entry
+		entry.VersionDir, entry.Folder = m.NewDir, filepath.Dir(m.NewDir)
+		item := modelFileIndexItem(potentialDownloadFromEntry(entry, newPath), newPath)
+		if err := index.IndexItem(bleveIndex, item); err != nil {
+			log.WithError(err).Warnf("Failed to re-index %s", newPath)
+		}
+	}
+}
+
+// relinkSymlinks retargets symlinks below dirs that point into a moved path, keeping
+// relative links relative. It returns how many were changed.
+func relinkSymlinks(dirs []string, done []completedMove) int {
+	relinked := 0
+	for _, dir := range dirs {
+		err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+			if err != nil || d.Type()&os.ModeSymlink == 0 {
+				return nil
+			}
+			target, err := os.Readlink(path)
+			if err != nil {
+				return nil
+			}
+			absTarget := target
+			if !filepath.IsAbs(target) {
+				absTarget = filepath.Join(filepath.Dir(path), target)
+			}
+			newTarget := movedPath(filepath.Clean(absTarget), done)
+			if newTarget == "" {
+				return nil
+			}
+			if !filepath.IsAbs(target) {
+				if rel, err := filepath.Rel(filepath.Dir(path), newTarget); err == nil {
+					newTarget = rel
+				}
+			}
+			tmp := path + ".relinking"
+			os.Remove(tmp)
+			if err := os.Symlink(newTarget, tmp); err != nil {
+				log.WithError(err).Warnf("Cannot retarget symlink %s", path)
+				return nil
+			}
+			if err := os.Rename(tmp, path); err != nil {
+				os.Remove(tmp)
+				log.WithError(err).Warnf("Cannot retarget symlink %s", path)
+				return nil
+			}
+			log.Infof("Retargeted %s -> %s", path, newTarget)
+			relinked++
+			return nil
+		})
+		if err != nil {
+			log.WithError(err).Warnf("Failed to scan %s for symlinks", dir)
+		}
+	}
+	return relinked
+}
+
+// movedPath returns where path is after the moves, or "" if none of them moved it.
+func movedPath(path string, done []completedMove) string {
+	for i := len(done) - 1; i >= 0; i-- {
+		move := done[i]
+		if isWithinDir(path, move.From) {
+			rel, err := filepath.Rel(move.From, path)
+			if err == nil {
+				return filepath.Join(move.To, rel)
+			}
+		}
+	}
+	return ""
+}
+
+// fileStem is name without its extension.
+func fileStem(name string) string {
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
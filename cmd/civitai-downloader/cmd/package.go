@@ -0,0 +1,567 @@
+package cmd
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/database"
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+)
+
+// packageCmd bundles everything downloaded for one model into a single archive
+var packageCmd = &cobra.Command{
+	Use:   "package <model-id>",
+	Short: "Bundle a downloaded model into a verifiable archive",
+	Long: `Bundles everything downloaded for a model - the model files of all its Downloaded
+versions, their metadata sidecars and previews, version and model images, and the
+model info file - into one archive for handing a complete copy to someone else.
+
+The archive holds a single directory with:
+  manifest.json  The model, its database entries and every file with size and SHA256
+  SHA256SUMS     Checksums of the files, for 'sha256sum -c SHA256SUMS'
+  README.md      A summary of the model, its versions and files
+  files/         The files, laid out as they are below SavePath
+
+The archive is compressed with zstd if the zstd program is available, otherwise with
+gzip. Its own SHA256 is written next to it as <archive>.sha256.
+
+--scrub strips metadata from the bundled images (PNG, JPEG and WebP, previews
+included) and from the Civitai image data in the JSON files, for sharing a bundle
+without who made the images or how to reproduce them exactly. It takes any of:
+  usernames  Author and copyright text, XMP and IPTC blocks, Civitai usernames
+  seeds      Seeds and variation seeds, and ComfyUI workflows
+  comments   Text chunks and comments that aren't generation parameters
+  <name>     A generation parameter as A1111 writes it, e.g. "Model hash"
+The rest of the generation parameters (prompt, negative prompt, sampler, steps, CFG,
+size, model) are kept. Files on disk are not changed; the manifest hashes the
+scrubbed copies. A file that can't be scrubbed (a damaged image, invalid JSON) is left
+out of the bundle and listed as such in the manifest and README.`,
+	Example: `  civitai-downloader package 58390 --out ./bundles
+  civitai-downloader package 58390 --out ./bundles --compression gzip
+  civitai-downloader package 58390 --scrub usernames,seeds,comments --scrub "Model hash"`,
+	Args: cobra.ExactArgs(1),
+	Run:  runPackage,
+}
+
+func init() {
+	rootCmd.AddCommand(packageCmd)
+	packageCmd.Flags().String("out", ".", "Directory to write the archive to")
+	packageCmd.Flags().String("compression", "auto", "Archive compression: zstd, gzip, none or auto (zstd if the zstd program is installed, else gzip)")
+	packageCmd.Flags().Bool("force", false, "Overwrite an existing archive")
+	packageCmd.Flags().StringSlice("scrub", nil, "Strip image metadata: usernames, seeds, comments or a generation parameter name (repeatable)")
+}
+
+// bundleFormatVersion is the manifest format written by package.
+const bundleFormatVersion = 1
+
+// bundleManifest is manifest.json in a model bundle.
+type bundleManifest struct {
+	FormatVersion int                   `json:"formatVersion"`
+	CreatedAt     time.Time             `json:"createdAt"`
+	CreatedBy     string                `json:"createdBy"` // civitai-downloader version
+	PathTemplate  string                `json:"pathTemplate,omitempty"`
+	ModelID       int                   `json:"modelId"`
+	ModelName     string                `json:"modelName"`
+	ModelType     string                `json:"modelType"`
+	Creator       string                `json:"creator,omitempty"`
+	Scrubbed      []string              `json:"scrubbed,omitempty"`    // --scrub fields stripped from image metadata
+	NotScrubbed   []string              `json:"notScrubbed,omitempty"` // Files left out because they couldn't be scrubbed
+	Entries       []bundleEntry         `json:"entries"`
+	Files         []bundleManifestEntry `json:"files"`
+}
+
+// bundleEntry is a database entry carried in a bundle.
+type bundleEntry struct {
+	Key          string               `json:"key"`
+	AIR          string               `json:"air"`
+	Availability string               `json:"availability"` // active, removed_upstream or trashed
+	Entry        models.DatabaseEntry `json:"entry"`
+}
+
+// bundleManifestEntry is a file in a bundle. Path is relative to the bundle's files/
+// directory, which mirrors SavePath.
+type bundleManifestEntry struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	Role   string `json:"role"` // model, sidecar, preview, image, modelinfo or other
+}
+
+// bundleSource is a file to put in a bundle.
+type bundleSource struct {
+	Source string // Absolute path on disk
+	Path   string // Relative to SavePath, with forward slashes
+	Role   string
+	Data   []byte // Scrubbed contents to bundle instead of the file's, if not nil
+}
+
+func runPackage(cmd *cobra.Command, args []string) {
+	outDir, _ := cmd.Flags().GetString("out")
+	compression, _ := cmd.Flags().GetString("compression")
+	force, _ := cmd.Flags().GetBool("force")
+	scrub, _ := cmd.Flags().GetStringSlice("scrub")
+
+	modelID, err := modelIDArg(args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	compression, err = resolveBundleCompression(compression)
+	if err != nil {
+		log.Fatal(err)
+	}
+	scrubFields, err := helpers.ParseScrubFields(scrub)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if globalConfig.DatabasePath == "" || globalConfig.SavePath == "" {
+		log.Fatal("DatabasePath and SavePath must be set in the configuration.")
+	}
+
+	db, err := database.Open(globalConfig.DatabasePath)
+	if err != nil {
+		log.WithError(err).Fatalf("Failed to open database at %s", globalConfig.DatabasePath)
+	}
+	defer db.Close()
+
+	matches, err := selectCatalogEntries(db, args[0], []string{models.StatusDownloaded})
+	if err != nil {
+		log.WithError(err).Fatal("Failed to read the database")
+	}
+	var entries []catalogMatch
+	for _, m := range matches {
+		if m.Entry.Version.ModelId == modelID {
+			entries = append(entries, m)
+		}
+	}
+	if len(entries) == 0 {
+		log.Fatalf("No downloaded versions of model %d in the database.", modelID)
+	}
+
+	shared, err := versionDirUsers(db, globalConfig.SavePath)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to read the database")
+	}
+	sources, missing := collectBundleSources(globalConfig.SavePath, entries, shared)
+	for _, m := range missing {
+		log.Warnf("Model file missing, not bundled: %s", m)
+	}
+	if len(missing) == len(entries) {
+		log.Fatalf("None of the model files of model %d are on disk.", modelID)
+	}
+
+	first := entries[0].Entry
+	manifest := bundleManifest{
+		FormatVersion: bundleFormatVersion,
+		CreatedAt:     time.Now().UTC().Truncate(time.Second),
+		CreatedBy:     "civitai-downloader " + Version,
+		PathTemplate:  globalConfig.PathTemplate,
+		ModelID:       modelID,
+		ModelName:     first.ModelName,
+		ModelType:     first.ModelType,
+		Creator:       first.Creator.Username,
+	}
+	if !scrubFields.Empty() {
+		manifest.Scrubbed = scrub
+	}
+	for _, m := range entries {
+		if _, err := os.Stat(entryFilePath(globalConfig.SavePath, m.Entry)); err == nil {
+			manifest.Entries = append(manifest.Entries, bundleEntry{Key: m.Key, AIR: entryAIR(m.Entry), Availability: entryAvailability(m.Entry), Entry: m.Entry})
+		}
+	}
+
+	if !scrubFields.Empty() {
+		var scrubbed int
+		sources, manifest.NotScrubbed, scrubbed = scrubBundleSources(sources, scrubFields)
+		fmt.Printf("Scrubbed metadata from %d files.\n", scrubbed)
+		if len(manifest.NotScrubbed) > 0 {
+			fmt.Printf("Left out %d files that couldn't be scrubbed.\n", len(manifest.NotScrubbed))
+		}
+	}
+
+	fmt.Printf("Hashing %d files of %s (%d)...\n", len(sources), first.ModelName, modelID)
+	var total int64
+	for _, src := range sources {
+		f, err := hashBundleSource(src)
+		if err != nil {
+			log.WithError(err).Fatalf("Failed to read %s", src.Source)
+		}
+		total += f.Size
+		manifest.Files = append(manifest.Files, f)
+	}
+
+	name := bundleName(modelID, first.ModelName, compression)
+	archivePath := filepath.Join(outDir, name)
+	if _, err := os.Stat(archivePath); err == nil && !force {
+		log.Fatalf("%s already exists (use --force to overwrite)", archivePath)
+	}
+	if err := helpers.MkdirAll(outDir, 0755); err != nil {
+		log.WithError(err).Fatalf("Failed to create %s", outDir)
+	}
+
+	fmt.Printf("Writing %s (%s before compression)...\n", archivePath, helpers.BytesToSize(uint64(total)))
+	sum, err := writeBundle(archivePath, compression, manifest, sources)
+	if err != nil {
+		os.Remove(archivePath)
+		log.WithError(err).Fatal("Failed to write the bundle")
+	}
+	if err := helpers.WriteFile(archivePath+".sha256", []byte(sum+"  "+name+"\n"), 0644); err != nil {
+		log.WithError(err).Warn("Failed to write the archive checksum")
+	}
+	fmt.Printf("Packaged %d versions, %d files: %s\n", len(manifest.Entries), len(manifest.Files), archivePath)
+	fmt.Printf("SHA256: %s\n", sum)
+}
+
+// resolveBundleCompression checks the --compression value and resolves "auto".
+func resolveBundleCompression(compression string) (string, error) {
+	switch strings.ToLower(compression) {
+	case "auto", "":
+		if _, err := exec.LookPath("zstd"); err == nil {
+			return "zstd", nil
+		}
+		log.Info("zstd is not installed; compressing with gzip")
+		return "gzip", nil
+	case "zstd", "zst":
+		if _, err := exec.LookPath("zstd"); err != nil {
+			return "", fmt.Errorf("zstd compression needs the zstd program: %w", err)
+		}
+		return "zstd", nil
+	case "gzip", "gz":
+		return "gzip", nil
+	case "none":
+		return "none", nil
+	}
+	return "", fmt.Errorf("unknown compression %q (use zstd, gzip, none or auto)", compression)
+}
+
+// bundleName is the archive file name for a model.
+func bundleName(modelID int, modelName, compression string) string {
+	name := fmt.Sprintf("%d-%s.tar", modelID, helpers.ConvertToSlug(modelName))
+	switch compression {
+	case "zstd":
+		return name + ".zst"
+	case "gzip":
+		return name + ".gz"
+	}
+	return name
+}
+
+// versionDirUsers counts the entries per version directory, to tell directories that hold
+// one version's files from shared ones.
+func versionDirUsers(db *database.DB, savePath string) (map[string]int, error) {
+	users := make(map[string]int)
+	err := db.Fold(func(key []byte, value []byte) error {
+		if !strings.HasPrefix(string(key), "v_") {
+			return nil
+		}
+		var entry models.DatabaseEntry
+		if json.Unmarshal(value, &entry) == nil {
+			users[entryVersionDir(savePath, entry)]++
+		}
+		return nil
+	})
+	return users, err
+}
+
+// collectBundleSources lists the files stored for the entries: each version directory
+// (only the files named after the model file if other versions share it) and the model
+// info file and images. It also returns the entries whose model file is missing.
+func collectBundleSources(savePath string, entries []catalogMatch, dirUsers map[string]int) (sources []bundleSource, missing []string) {
+	seen := make(map[string]bool)
+	add := func(path, role string) {
+		rel, err := filepath.Rel(savePath, path)
+		if err != nil || strings.HasPrefix(rel, "..") || seen[path] {
+			return
+		}
+		seen[path] = true
+		sources = append(sources, bundleSource{Source: path, Path: filepath.ToSlash(rel), Role: role})
+	}
+	addTree := func(dir, role string) {
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode().IsRegular() && !strings.HasSuffix(path, ".part") {
+				add(path, role)
+			}
+			return nil
+		})
+	}
+
+	for _, m := range entries {
+		dir := entryVersionDir(savePath, m.Entry)
+		modelFile := filepath.Join(dir, m.Entry.Filename)
+		if _, err := os.Stat(modelFile); err != nil {
+			missing = append(missing, modelFile)
+			continue
+		}
+		add(modelFile, "model")
+
+		stem := fileStem(m.Entry.Filename)
+		dirEntries, _ := os.ReadDir(dir)
+		for _, de := range dirEntries {
+			path := filepath.Join(dir, de.Name())
+			switch {
+			case de.IsDir() && de.Name() == "images" && dirUsers[dir] <= 1:
+				addTree(path, "image")
+			case de.IsDir(), !strings.HasPrefix(de.Name(), stem) && dirUsers[dir] > 1, strings.HasSuffix(de.Name(), ".part"):
+				// Another version's, or not a finished file
+			default:
+				add(path, bundleRole(de.Name(), stem))
+			}
+		}
+	}
+
+	// Model info and model images live in {type}/{model}
+	first := entries[0].Entry
+	modelDir := entryModelDir(savePath, first)
+	if infos, _ := filepath.Glob(filepath.Join(modelDir, fmt.Sprintf("%d-*.json", first.Version.ModelId))); len(infos) > 0 {
+		for _, info := range infos {
+			add(info, "modelinfo")
+		}
+		addTree(filepath.Join(modelDir, "images"), "image")
+	}
+	sort.Slice(sources, func(i, j int) bool { return sources[i].Path < sources[j].Path })
+	return sources, missing
+}
+
+// bundleRole classifies a file next to a model file.
+func bundleRole(name, stem string) string {
+	switch {
+	case strings.HasPrefix(name, stem+".preview."):
+		return "preview"
+	case name == stem+".json":
+		return "sidecar"
+	}
+	return "other"
+}
+
+// scrubBundleSources scrubs the sources that carry image metadata. A file that can't be
+// scrubbed is left out rather than bundled with its metadata: it returns the sources to
+// bundle, the paths of those left out and how many files were changed.
+func scrubBundleSources(sources []bundleSource, fields helpers.ScrubFields) ([]bundleSource, []string, int) {
+	kept := sources[:0]
+	var left []string
+	scrubbed := 0
+	for _, src := range sources {
+		changed, err := scrubBundleSource(&src, fields)
+		if err != nil {
+			log.WithError(err).Warnf("Failed to scrub %s, leaving it out of the bundle", src.Source)
+			left = append(left, src.Path)
+			continue
+		}
+		if changed {
+			scrubbed++
+		}
+		kept = append(kept, src)
+	}
+	return kept, left, scrubbed
+}
+
+// scrubBundleSource strips the selected metadata from an image, preview or JSON file
+// and keeps the result in src.Data. It reports whether anything was stripped.
+func scrubBundleSource(src *bundleSource, fields helpers.ScrubFields) (bool, error) {
+	isJSON := strings.EqualFold(filepath.Ext(src.Path), ".json")
+	switch {
+	case src.Role == "image" || src.Role == "preview":
+	case isJSON && (src.Role == "sidecar" || src.Role == "modelinfo"):
+	default:
+		return false, nil
+	}
+	data, err := os.ReadFile(src.Source)
+	if err != nil {
+		return false, err
+	}
+	var scrubbed []byte
+	var changed bool
+	if isJSON {
+		scrubbed, changed, err = helpers.ScrubImageJSON(data, fields)
+	} else {
+		scrubbed, changed, err = helpers.ScrubImageMetadata(data, fields)
+	}
+	if err != nil || !changed {
+		return false, err
+	}
+	src.Data = scrubbed
+	return true, nil
+}
+
+// hashBundleSource sizes and hashes a file for the manifest.
+func hashBundleSource(src bundleSource) (bundleManifestEntry, error) {
+	if src.Data != nil {
+		sum := sha256.Sum256(src.Data)
+		return bundleManifestEntry{Path: src.Path, Size: int64(len(src.Data)), SHA256: hex.EncodeToString(sum[:]), Role: src.Role}, nil
+	}
+	f, err := os.Open(src.Source)
+	if err != nil {
+		return bundleManifestEntry{}, err
+	}
+	defer f.Close()
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, f)
+	if err != nil {
+		return bundleManifestEntry{}, err
+	}
+	return bundleManifestEntry{Path: src.Path, Size: size, SHA256: hex.EncodeToString(hasher.Sum(nil)), Role: src.Role}, nil
+}
+
+// writeBundle writes the archive and returns its SHA256.
+func writeBundle(archivePath, compression string, manifest bundleManifest, sources []bundleSource) (string, error) {
+	out, err := os.Create(archivePath)
+	if err != nil {
+		return "", err
+	}
+	helpers.ApplyFileMode(archivePath)
+	defer out.Close()
+	hasher := sha256.New()
+	sink := io.MultiWriter(out, hasher)
+
+	var compressed io.WriteCloser
+	var zstd *exec.Cmd
+	switch compression {
+	case "zstd":
+		zstd = exec.Command("zstd", "-q", "-T0", "-c")
+		zstd.Stdout = sink
+		zstd.Stderr = os.Stderr
+		if compressed, err = zstd.StdinPipe(); err != nil {
+			return "", err
+		}
+		if err := zstd.Start(); err != nil {
+			return "", err
+		}
+	case "gzip":
+		compressed = gzip.NewWriter(sink)
+	default:
+		compressed = nopWriteCloser{sink}
+	}
+
+	root := strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(filepath.Base(archivePath), ".zst"), ".gz"), ".tar")
+	tw := tar.NewWriter(compressed)
+	err = writeBundleEntries(tw, root, manifest, sources)
+	if closeErr := tw.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := compressed.Close(); err == nil {
+		err = closeErr
+	}
+	if zstd != nil {
+		if waitErr := zstd.Wait(); err == nil && waitErr != nil {
+			err = fmt.Errorf("zstd: %w", waitErr)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := out.Sync(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// writeBundleEntries writes the manifest, checksums, README and files below root.
+func writeBundleEntries(tw *tar.Writer, root string, manifest bundleManifest, sources []bundleSource) error {
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	var sums strings.Builder
+	for _, f := range manifest.Files {
+		fmt.Fprintf(&sums, "%s  files/%s\n", f.SHA256, f.Path)
+	}
+	for _, meta := range []struct {
+		name string
+		data []byte
+	}{
+		{"manifest.json", manifestJSON},
+		{"SHA256SUMS", []byte(sums.String())},
+		{"README.md", []byte(bundleReadme(manifest))},
+	} {
+		hdr := &tar.Header{Name: root + "/" + meta.name, Mode: 0644, Size: int64(len(meta.data)), ModTime: manifest.CreatedAt}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(meta.data); err != nil {
+			return err
+		}
+	}
+
+	for i, src := range sources {
+		want := manifest.Files[i]
+		f, err := os.Open(src.Source)
+		if err != nil {
+			return err
+		}
+		info, err := f.Stat()
+		if err == nil && src.Data == nil && info.Size() != want.Size {
+			err = fmt.Errorf("%s changed while packaging", src.Source)
+		}
+		if err == nil {
+			hdr := &tar.Header{Name: root + "/files/" + src.Path, Mode: 0644, Size: want.Size, ModTime: info.ModTime()}
+			if err = tw.WriteHeader(hdr); err == nil {
+				if src.Data != nil {
+					_, err = tw.Write(src.Data)
+				} else {
+					_, err = io.CopyN(tw, f, want.Size)
+				}
+			}
+		}
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bundleReadme is the README.md of a bundle.
+func bundleReadme(m bundleManifest) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n", m.ModelName)
+	fmt.Fprintf(&b, "- Civitai model: [%d](https://civitai.com/models/%d)\n", m.ModelID, m.ModelID)
+	fmt.Fprintf(&b, "- Type: %s\n", m.ModelType)
+	if m.Creator != "" {
+		fmt.Fprintf(&b, "- Creator: %s\n", m.Creator)
+	}
+	fmt.Fprintf(&b, "- Packaged: %s by %s\n", m.CreatedAt.Format(time.RFC3339), m.CreatedBy)
+	if len(m.Scrubbed) > 0 {
+		fmt.Fprintf(&b, "- Image metadata scrubbed: %s\n", strings.Join(m.Scrubbed, ", "))
+	}
+	b.WriteString("\n")
+
+	b.WriteString("## Versions\n\n| Version | ID | Base model | File | Size |\n|---|---|---|---|---|\n")
+	for _, e := range m.Entries {
+		fmt.Fprintf(&b, "| %s | %d | %s | %s | %s |\n", e.Entry.Version.Name, e.Entry.Version.ID, e.Entry.Version.BaseModel,
+			e.Entry.Filename, helpers.BytesToSize(uint64(e.Entry.File.SizeKB*1024)))
+	}
+
+	b.WriteString("\n## Files\n\n| File | Role | Size |\n|---|---|---|\n")
+	for _, f := range m.Files {
+		fmt.Fprintf(&b, "| `files/%s` | %s | %s |\n", f.Path, f.Role, helpers.BytesToSize(uint64(f.Size)))
+	}
+	if len(m.NotScrubbed) > 0 {
+		b.WriteString("\n## Not included\n\nThese files couldn't be scrubbed, so they were left out:\n\n")
+		for _, path := range m.NotScrubbed {
+			fmt.Fprintf(&b, "- `files/%s`\n", path)
+		}
+	}
+
+	b.WriteString("\n## Verifying\n\n```bash\nsha256sum -c SHA256SUMS\n```\n\n")
+	b.WriteString("`files/` mirrors the downloader's save directory; `manifest.json` lists every file with its SHA256 and carries the database entries of the versions.\n")
+	return b.String()
+}
+
+// nopWriteCloser adds a no-op Close to a writer.
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
@@ -0,0 +1,143 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+)
+
+// testPNG returns a PNG signature followed by a tEXt chunk per keyword/text pair and IEND.
+func testPNG(text ...string) []byte {
+	var b bytes.Buffer
+	b.WriteString("\x89PNG\r\n\x1a\n")
+	chunk := func(chunkType string, body []byte) {
+		binary.Write(&b, binary.BigEndian, uint32(len(body)))
+		b.WriteString(chunkType)
+		b.Write(body)
+		binary.Write(&b, binary.BigEndian, crc32.ChecksumIEEE(append([]byte(chunkType), body...)))
+	}
+	for i := 0; i+1 < len(text); i += 2 {
+		chunk("tEXt", []byte(text[i]+"\x00"+text[i+1]))
+	}
+	chunk("IEND", nil)
+	return b.Bytes()
+}
+
+// readBundle returns the files of an uncompressed bundle by their name below its root.
+func readBundle(t *testing.T, archivePath string) map[string][]byte {
+	t.Helper()
+	f, err := os.Open(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	files := make(map[string][]byte)
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, name, _ := strings.Cut(hdr.Name, "/")
+		files[name] = data
+	}
+}
+
+func TestPackageLeavesOutFilesThatCannotBeScrubbed(t *testing.T) {
+	savePath := t.TempDir()
+	good := testPNG("Author", "alice", "parameters", "a cat\nSteps: 20, Seed: 42")
+	corrupt := testPNG("Author", "alice")
+	corrupt = corrupt[:len(corrupt)-6] // Cuts the IEND chunk short
+	files := map[string][]byte{
+		"model.safetensors":        []byte("weights"),
+		"model.preview.png":        good,
+		"images/corrupt.png":       corrupt,
+		"model.json":               []byte(`{"images": [{"username": "alice", "meta": {"seed": 42}}`), // Cut short
+		"images/not-an-image.webm": []byte("video"),
+	}
+	var sources []bundleSource
+	for _, path := range []string{"model.safetensors", "model.preview.png", "images/corrupt.png", "model.json", "images/not-an-image.webm"} {
+		source := filepath.Join(savePath, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(source), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(source, files[path], 0644); err != nil {
+			t.Fatal(err)
+		}
+		role := "image"
+		switch path {
+		case "model.safetensors":
+			role = "model"
+		case "model.preview.png":
+			role = "preview"
+		case "model.json":
+			role = "sidecar"
+		}
+		sources = append(sources, bundleSource{Source: source, Path: path, Role: role})
+	}
+
+	fields, err := helpers.ParseScrubFields([]string{"usernames"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := bundleManifest{ModelID: 1, ModelName: "Test", Scrubbed: []string{"usernames"}}
+	sources, manifest.NotScrubbed, _ = scrubBundleSources(sources, fields)
+	if want := []string{"images/corrupt.png", "model.json"}; !reflect.DeepEqual(manifest.NotScrubbed, want) {
+		t.Errorf("files not scrubbed = %v, want %v", manifest.NotScrubbed, want)
+	}
+	for _, src := range sources {
+		f, err := hashBundleSource(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifest.Files = append(manifest.Files, f)
+	}
+	archivePath := filepath.Join(t.TempDir(), "1-test.tar")
+	if _, err := writeBundle(archivePath, "none", manifest, sources); err != nil {
+		t.Fatalf("writeBundle: %v", err)
+	}
+
+	bundle := readBundle(t, archivePath)
+	for _, path := range []string{"images/corrupt.png", "model.json"} {
+		if _, ok := bundle["files/"+path]; ok {
+			t.Errorf("%s is in the bundle, though it couldn't be scrubbed", path)
+		}
+	}
+	for _, path := range []string{"model.safetensors", "images/not-an-image.webm"} {
+		if !bytes.Equal(bundle["files/"+path], files[path]) {
+			t.Errorf("%s = %q, want it bundled as it is", path, bundle["files/"+path])
+		}
+	}
+	preview, ok := bundle["files/model.preview.png"]
+	if !ok || bytes.Contains(preview, []byte("alice")) || !bytes.Contains(preview, []byte("Seed: 42")) {
+		t.Errorf("preview = %q, want it bundled without the author and with the parameters", preview)
+	}
+	var written bundleManifest
+	if err := json.Unmarshal(bundle["manifest.json"], &written); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(written.NotScrubbed, manifest.NotScrubbed) || len(written.Files) != 3 {
+		t.Errorf("manifest lists %d files and %v not scrubbed, want 3 and %v", len(written.Files), written.NotScrubbed, manifest.NotScrubbed)
+	}
+	readme := string(bundle["README.md"])
+	if !strings.Contains(readme, "## Not included") || !strings.Contains(readme, "`files/images/corrupt.png`") {
+		t.Errorf("README doesn't list the files left out:\n%s", readme)
+	}
+}
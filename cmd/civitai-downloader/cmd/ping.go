@@ -0,0 +1,186 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/api"
+)
+
+// Exit codes of ping, so scripts can tell why the API isn't usable.
+const (
+	pingExitOK          = 0
+	pingExitUnreachable = 1 // Unreachable, timing out or answering with errors
+	pingExitAuth        = 2 // API key rejected (or missing with --require-auth)
+	pingExitRateLimited = 3 // Rate limited, or less headroom than --min-remaining
+)
+
+var pingCmd = &cobra.Command{
+	Use:   "ping",
+	Short: "Check that the Civitai API is reachable, the API key works and requests are left",
+	Long: `Makes a single cheap request to the Civitai API (a one-item model listing) and,
+if an API key is configured, checks it against the account endpoint. Prints
+reachability, latency, the authenticated account and the rate limit headroom
+the API reports. Nothing is retried.
+
+Exit codes:
+  0  The API is usable
+  1  The API is unreachable, timed out or answered with an error
+  2  The API key was rejected (or none is configured and --require-auth is set)
+  3  Rate limited, or fewer requests left than --min-remaining`,
+	Example: `  civitai-downloader ping && civitai-downloader download --tag anime
+  civitai-downloader ping --json --require-auth`,
+	Args: cobra.NoArgs,
+	Run:  runPing,
+}
+
+func init() {
+	rootCmd.AddCommand(pingCmd)
+
+	pingCmd.Flags().Duration("timeout", 10*time.Second, "Give up on the API after this long")
+	pingCmd.Flags().Bool("json", false, "Print the result as JSON")
+	pingCmd.Flags().Bool("require-auth", false, "Fail (exit code 2) if no valid API key is configured")
+	pingCmd.Flags().Int("min-remaining", 1, "Fail (exit code 3) if the API reports fewer requests left than this")
+}
+
+// pingResult is the --json output of ping.
+type pingResult struct {
+	Status         string  `json:"status"` // ok, unreachable, error, unauthorized or rate_limited
+	Reachable      bool    `json:"reachable"`
+	HTTPStatus     int     `json:"httpStatus,omitempty"`
+	LatencyMs      int64   `json:"latencyMs"`
+	Auth           string  `json:"auth"` // none, ok, rejected or unknown
+	Username       string  `json:"username,omitempty"`
+	Tier           string  `json:"tier,omitempty"`
+	RateLimit      *int    `json:"rateLimit,omitempty"`
+	RateRemaining  *int    `json:"rateRemaining,omitempty"`
+	RateResetSecs  float64 `json:"rateResetSeconds,omitempty"`
+	RetryAfterSecs float64 `json:"retryAfterSeconds,omitempty"`
+	Error          string  `json:"error,omitempty"`
+}
+
+func runPing(cmd *cobra.Command, args []string) {
+	timeout, _ := cmd.Flags().GetDuration("timeout")
+	asJSON, _ := cmd.Flags().GetBool("json")
+	requireAuth, _ := cmd.Flags().GetBool("require-auth")
+	minRemaining, _ := cmd.Flags().GetInt("min-remaining")
+
+	transport := globalHttpTransport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	client := api.NewClient(globalConfig.ApiKey, &http.Client{Timeout: timeout, Transport: transport}, globalConfig)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	health := client.Ping(ctx)
+	cancel()
+
+	status, code := "ok", pingExitOK
+	switch {
+	case !health.Reachable:
+		status, code = "unreachable", pingExitUnreachable
+	case health.AuthStatus == "rejected":
+		status, code = "unauthorized", pingExitAuth
+	case errors.Is(health.Err, api.ErrRateLimited):
+		status, code = "rate_limited", pingExitRateLimited
+	case health.Err != nil:
+		status, code = "error", pingExitUnreachable
+	case requireAuth && health.AuthStatus != "ok":
+		status, code = "unauthorized", pingExitAuth
+		if health.AuthStatus == "none" {
+			health.Err = errors.New("no API key configured")
+		} else {
+			health.Err = errors.New("the API key could not be verified")
+		}
+	case health.RateLimit.Remaining >= 0 && health.RateLimit.Remaining < minRemaining:
+		status, code = "rate_limited", pingExitRateLimited
+		health.Err = fmt.Errorf("only %d requests left (--min-remaining %d)", health.RateLimit.Remaining, minRemaining)
+	}
+
+	if asJSON {
+		printPingJSON(status, health)
+	} else {
+		printPing(status, health)
+	}
+	os.Exit(code)
+}
+
+// printPing prints the concise human-readable status.
+func printPing(status string, h api.Health) {
+	if h.Reachable {
+		fmt.Printf("API:        reachable (HTTP %d, %s)\n", h.Status, h.Latency.Round(time.Millisecond))
+	} else {
+		fmt.Printf("API:        unreachable after %s\n", h.Latency.Round(time.Millisecond))
+	}
+
+	switch h.AuthStatus {
+	case "none":
+		fmt.Println("Auth:       no API key configured")
+	case "ok":
+		account := h.Username
+		if h.Tier != "" {
+			account += " (" + h.Tier + ")"
+		}
+		fmt.Printf("Auth:       ok, %s\n", account)
+	case "rejected":
+		fmt.Println("Auth:       API key rejected")
+	default:
+		fmt.Println("Auth:       API key sent, but the API didn't confirm it")
+	}
+
+	rl := h.RateLimit
+	switch {
+	case rl.RetryAfter > 0:
+		fmt.Printf("Rate limit: exhausted, retry after %s\n", rl.RetryAfter)
+	case rl.Remaining >= 0 && rl.Limit >= 0:
+		fmt.Printf("Rate limit: %d of %d requests left", rl.Remaining, rl.Limit)
+	case rl.Remaining >= 0:
+		fmt.Printf("Rate limit: %d requests left", rl.Remaining)
+	case h.Reachable:
+		fmt.Println("Rate limit: not reported by the API")
+	}
+	if rl.RetryAfter <= 0 && rl.Remaining >= 0 {
+		if rl.ResetIn > 0 {
+			fmt.Printf(", resets in %s", rl.ResetIn)
+		}
+		fmt.Println()
+	}
+
+	if h.Err != nil {
+		fmt.Printf("Status:     %s: %v\n", status, h.Err)
+	} else {
+		fmt.Printf("Status:     %s\n", status)
+	}
+}
+
+// printPingJSON prints the status as a single JSON object.
+func printPingJSON(status string, h api.Health) {
+	result := pingResult{
+		Status:         status,
+		Reachable:      h.Reachable,
+		HTTPStatus:     h.Status,
+		LatencyMs:      h.Latency.Milliseconds(),
+		Auth:           h.AuthStatus,
+		Username:       h.Username,
+		Tier:           h.Tier,
+		RateResetSecs:  h.RateLimit.ResetIn.Seconds(),
+		RetryAfterSecs: h.RateLimit.RetryAfter.Seconds(),
+	}
+	if h.RateLimit.Limit >= 0 {
+		result.RateLimit = &h.RateLimit.Limit
+	}
+	if h.RateLimit.Remaining >= 0 {
+		result.RateRemaining = &h.RateLimit.Remaining
+	}
+	if h.Err != nil {
+		result.Error = h.Err.Error()
+	}
+	out, _ := json.Marshal(result)
+	fmt.Println(string(out))
+}
@@ -0,0 +1,315 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/database"
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+)
+
+// queueDroppedDetails is the error details of an entry 'queue import --prune-dropped' pruned.
+const queueDroppedDetails = "dropped from the download queue by 'queue import'"
+
+// queueCmd works on the download queue kept in the database
+var queueCmd = &cobra.Command{
+	Use:   "queue",
+	Short: "Export the download queue to JSON and load an edited one back",
+	Long: `The download queue is kept in the database: the files a listing found (Pending) and
+the downloads an interrupted run left behind (Downloading). 'queue export' writes it to
+a JSON file, which can be reordered or edited with any tool, and 'queue import' loads
+it back, so large batches can be ordered any way without a flag for every ordering.`,
+}
+
+// queueExportCmd writes the download queue as JSON
+var queueExportCmd = &cobra.Command{
+	Use:   "export [file]",
+	Short: "Write the download queue to a JSON file (stdout without one)",
+	Long: `Writes the Pending and Downloading entries of the database as a JSON snapshot, in the
+order the next run would take them: entries placed by an earlier import first, then
+the other queued ones, then those planned but not queued yet, by model name.
+
+Each item has the version ID, model, version, type, base model, creator, file name,
+size in bytes and status, whether it is queued already, and a priority of 0.`,
+	Example: `  civitai-downloader queue export queue.json
+  civitai-downloader queue export | jq '.items |= sort_by(.size)' > queue.json`,
+	Args: cobra.MaximumNArgs(1),
+	Run:  runQueueExport,
+}
+
+// queueImportCmd loads an edited download queue
+var queueImportCmd = &cobra.Command{
+	Use:   "import <file>",
+	Short: "Load an edited download queue snapshot back (- reads stdin)",
+	Long: `Loads a snapshot written by 'queue export', after it was reordered or edited. Only the
+versionId and priority of the items are read.
+
+The items are queued in the order of the file, those with a higher priority first (ties
+keep the file order), and the next 'download' run, or 'download --resume' without
+listing the API, downloads them first and in that order. Items no longer Pending or
+Downloading (downloaded since the export, say) are skipped.
+
+Queue entries missing from the file are dropped: they are taken out of the queue but
+stay Pending, so a later listing that returns them finds them again. With
+--prune-dropped they are marked Pruned instead, so they are never downloaded (db
+redownload still fetches one).`,
+	Example: `  civitai-downloader queue import queue.json --dry-run
+  civitai-downloader queue import queue.json --prune-dropped --yes`,
+	Args: cobra.ExactArgs(1),
+	Run:  runQueueImport,
+}
+
+func init() {
+	rootCmd.AddCommand(queueCmd)
+	queueCmd.AddCommand(queueExportCmd)
+	queueCmd.AddCommand(queueImportCmd)
+	queueImportCmd.Flags().Bool("prune-dropped", false, "Mark the queue entries missing from the file Pruned, so they are never downloaded")
+	queueImportCmd.Flags().Bool("dry-run", false, "Only show what would change")
+	queueImportCmd.Flags().BoolP("yes", "y", false, "Skip the confirmation prompt")
+}
+
+// queueSnapshot is the download queue as 'queue export' writes it.
+type queueSnapshot struct {
+	ExportedAt time.Time   `json:"exportedAt"`
+	Items      []queueItem `json:"items"`
+}
+
+// queueItem is an entry of the download queue. Import reads VersionID and Priority only.
+type queueItem struct {
+	VersionID int    `json:"versionId"`
+	ModelID   int    `json:"modelId"`
+	Model     string `json:"model"`
+	Version   string `json:"version"`
+	Type      string `json:"type"`
+	BaseModel string `json:"baseModel"`
+	Creator   string `json:"creator,omitempty"`
+	File      string `json:"file"`
+	Size      uint64 `json:"size"`
+	Status    string `json:"status"`
+	Queued    bool   `json:"queued,omitempty"` // Handed to the workers: the next run resumes it
+	Priority  int    `json:"priority"`         // Higher goes first on import
+}
+
+// queuedEntries returns the Pending and Downloading entries, in the order the next run
+// takes them (see queueExportCmd).
+func queuedEntries(db *database.DB) ([]catalogMatch, error) {
+	var entries []catalogMatch
+	err := db.Fold(func(key []byte, value []byte) error {
+		if !strings.HasPrefix(string(key), "v_") {
+			return nil
+		}
+		var entry models.DatabaseEntry
+		if json.Unmarshal(value, &entry) != nil || entry.Status != models.StatusPending && entry.Status != models.StatusDownloading {
+			return nil
+		}
+		entries = append(entries, catalogMatch{Key: string(key), Entry: entry})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i].Entry, entries[j].Entry
+		if (a.QueuePosition != 0) != (b.QueuePosition != 0) {
+			return a.QueuePosition != 0
+		}
+		if a.QueuePosition != b.QueuePosition {
+			return a.QueuePosition < b.QueuePosition
+		}
+		if (a.QueuedAt != 0) != (b.QueuedAt != 0) {
+			return a.QueuedAt != 0
+		}
+		if a.QueuedAt != b.QueuedAt {
+			return a.QueuedAt < b.QueuedAt
+		}
+		if a.ModelName != b.ModelName {
+			return helpers.CollateLess(a.ModelName, b.ModelName)
+		}
+		return a.Version.ID < b.Version.ID
+	})
+	return entries, nil
+}
+
+// openQueueDatabase opens the database of the download queue.
+func openQueueDatabase() *database.DB {
+	if globalConfig.DatabasePath == "" {
+		log.Fatal("DatabasePath must be set in the configuration.")
+	}
+	db, err := database.Open(globalConfig.DatabasePath)
+	if err != nil {
+		log.WithError(err).Fatalf("Failed to open database at %s", globalConfig.DatabasePath)
+	}
+	return db
+}
+
+func runQueueExport(cmd *cobra.Command, args []string) {
+	db := openQueueDatabase()
+	defer db.Close()
+	entries, err := queuedEntries(db)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to read the database")
+	}
+
+	snapshot := queueSnapshot{ExportedAt: time.Now().UTC(), Items: make([]queueItem, 0, len(entries))}
+	for _, m := range entries {
+		e := m.Entry
+		snapshot.Items = append(snapshot.Items, queueItem{
+			VersionID: e.Version.ID,
+			ModelID:   e.Version.ModelId,
+			Model:     e.ModelName,
+			Version:   e.Version.Name,
+			Type:      e.ModelType,
+			BaseModel: e.Version.BaseModel,
+			Creator:   e.Creator.Username,
+			File:      e.File.Name,
+			Size:      uint64(e.File.SizeKB * 1024),
+			Status:    e.Status,
+			Queued:    e.QueuedAt != 0,
+		})
+	}
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		log.WithError(err).Fatal("Failed to encode the queue")
+	}
+	if len(args) == 0 {
+		fmt.Println(string(data))
+		return
+	}
+	if err := helpers.WriteFile(args[0], append(data, '\n'), 0644); err != nil {
+		log.WithError(err).Fatalf("Failed to write %s", args[0])
+	}
+	log.Infof("Exported %d queue entries to %s", len(snapshot.Items), args[0])
+}
+
+func runQueueImport(cmd *cobra.Command, args []string) {
+	pruneDropped, _ := cmd.Flags().GetBool("prune-dropped")
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+	skipConfirm, _ := cmd.Flags().GetBool("yes")
+
+	var data []byte
+	var err error
+	if args[0] == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(args[0])
+	}
+	if err != nil {
+		log.WithError(err).Fatalf("Failed to read %s", args[0])
+	}
+	var snapshot queueSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		log.WithError(err).Fatalf("%s is not a queue snapshot", args[0])
+	}
+	sort.SliceStable(snapshot.Items, func(i, j int) bool { return snapshot.Items[i].Priority > snapshot.Items[j].Priority })
+
+	db := openQueueDatabase()
+	defer db.Close()
+	entries, err := queuedEntries(db)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to read the database")
+	}
+	inQueue := make(map[string]models.DatabaseEntry, len(entries))
+	for _, m := range entries {
+		inQueue[m.Key] = m.Entry
+	}
+
+	var order []string
+	listed := make(map[string]bool)
+	skipped := 0
+	for _, item := range snapshot.Items {
+		key := fmt.Sprintf("v_%d", item.VersionID)
+		if listed[key] {
+			log.Warnf("Version %d is listed more than once; keeping its first place", item.VersionID)
+			continue
+		}
+		listed[key] = true
+		if _, ok := inQueue[key]; !ok {
+			log.Warnf("Version %d (%s) is not Pending or Downloading any more; skipping it", item.VersionID, item.File)
+			skipped++
+			continue
+		}
+		order = append(order, key)
+	}
+	var dropped []string
+	for _, m := range entries {
+		if !listed[m.Key] {
+			dropped = append(dropped, m.Key)
+		}
+	}
+
+	fmt.Printf("%d entries to queue in the order of %s, %d skipped.\n", len(order), args[0], skipped)
+	for i, key := range order {
+		if i == 10 {
+			fmt.Printf("  ... and %d more\n", len(order)-i)
+			break
+		}
+		e := inQueue[key]
+		fmt.Printf("  %3d. %s (%s - %s)\n", i+1, e.File.Name, e.ModelName, e.Version.Name)
+	}
+	if len(dropped) > 0 {
+		if pruneDropped {
+			fmt.Printf("%d entries to drop and mark Pruned.\n", len(dropped))
+		} else {
+			fmt.Printf("%d entries to drop (they stay Pending for a later listing).\n", len(dropped))
+		}
+	}
+	if dryRun {
+		fmt.Println("Dry run: nothing was changed.")
+		return
+	}
+	if len(order) == 0 && len(dropped) == 0 {
+		return
+	}
+	if !skipConfirm {
+		reader := bufio.NewReader(os.Stdin)
+		fmt.Print("Proceed? (y/N): ")
+		input, _ := reader.ReadString('\n')
+		if strings.ToLower(strings.TrimSpace(input)) != "y" {
+			fmt.Println("Aborted.")
+			return
+		}
+	}
+
+	now := time.Now().Unix()
+	failed := 0
+	for i, key := range order {
+		position := i + 1
+		if err := updateDbEntry(db, key, inQueue[key].Status, func(entry *models.DatabaseEntry) {
+			entry.QueuePosition = position
+			if entry.QueuedAt == 0 {
+				entry.QueuedAt = now
+			}
+		}); err != nil {
+			failed++
+		}
+	}
+	for _, key := range dropped {
+		var err error
+		if pruneDropped {
+			err = updateDbEntry(db, key, models.StatusPruned, func(entry *models.DatabaseEntry) {
+				entry.ErrorDetails = queueDroppedDetails
+			})
+		} else {
+			err = updateDbEntry(db, key, inQueue[key].Status, func(entry *models.DatabaseEntry) {
+				entry.QueuedAt, entry.QueuePosition = 0, 0
+			})
+		}
+		if err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		log.Fatalf("Failed to update %d entries; run the import again", failed)
+	}
+	log.Infof("Queued %d entries and dropped %d; the next download run takes them in this order", len(order), len(dropped))
+}
@@ -0,0 +1,441 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/database"
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// Report formats.
+const (
+	reportObsidian = "obsidian" // Wiki-links and embeds
+	reportMarkdown = "markdown" // Plain relative Markdown links
+)
+
+// Vault layout written by report.
+const (
+	reportModelsDir      = "Models"
+	reportCreatorsDir    = "Creators"
+	reportAttachmentsDir = "Attachments"
+	reportIndexNote      = "Civitai Library.md"
+	// reportMarker is the frontmatter line of generated notes; notes without it are never
+	// overwritten, so notes of your own in the vault are safe.
+	reportMarker = "generated-by: civitai-downloader"
+)
+
+// reportCmd exports the library as a Markdown vault
+var reportCmd = &cobra.Command{
+	Use:   "report",
+	Short: "Export the downloaded library as Markdown notes (e.g. an Obsidian vault)",
+	Long: `Writes one Markdown note per downloaded model to --out, for browsing the library
+and linking it from your own prompt notes:
+
+  Models/<model>.md       YAML frontmatter (model and version IDs, type, base models,
+                          creator, tags, trigger words, local paths), the preview of
+                          each version and its files
+  Creators/<creator>.md   Links to the creator's models
+  Civitai Library.md      Every model by type
+
+With --format obsidian, notes link each other with [[wiki-links]] and embed the previews
+with ![[...]]; --format markdown uses plain relative links, for other Markdown tools.
+Previews are copied to Attachments/ (--previews none leaves them out), since vault apps
+only show images inside the vault.
+
+Running it again updates the notes. Notes it didn't write (without its
+"generated-by: civitai-downloader" frontmatter) are never overwritten, and notes of
+models no longer downloaded are left in place.`,
+	Example: `  civitai-downloader report --format obsidian --out ~/vault/Civitai
+  civitai-downloader report --format markdown --out ./library --previews none`,
+	Args: cobra.NoArgs,
+	Run:  runReport,
+}
+
+func init() {
+	rootCmd.AddCommand(reportCmd)
+	reportCmd.Flags().String("format", reportObsidian, "Note format: obsidian or markdown")
+	reportCmd.Flags().String("out", "", "Vault directory to write the notes to (required)")
+	reportCmd.Flags().String("previews", "copy", "Previews: copy (into Attachments/) or none")
+	reportCmd.MarkFlagRequired("out")
+}
+
+// reportModel is a model of the library with its downloaded versions.
+type reportModel struct {
+	ID       int
+	Name     string
+	Type     string
+	Creator  string
+	Tags     []string
+	Note     string // Note name without .md, unique in the vault
+	Versions []models.DatabaseEntry
+}
+
+// reportVault writes the notes of one format.
+type reportVault struct {
+	dir      string
+	format   string
+	previews bool
+	written  int
+	skipped  int
+}
+
+func runReport(cmd *cobra.Command, args []string) {
+	format, _ := cmd.Flags().GetString("format")
+	outDir, _ := cmd.Flags().GetString("out")
+	previews, _ := cmd.Flags().GetString("previews")
+
+	format = strings.ToLower(format)
+	if format != reportObsidian && format != reportMarkdown {
+		log.Fatalf("Invalid --format %q: use obsidian or markdown", format)
+	}
+	if previews != "copy" && previews != "none" {
+		log.Fatalf("Invalid --previews %q: use copy or none", previews)
+	}
+	if globalConfig.DatabasePath == "" || globalConfig.SavePath == "" {
+		log.Fatal("DatabasePath and SavePath must be set in the configuration.")
+	}
+
+	db, err := database.Open(globalConfig.DatabasePath)
+	if err != nil {
+		log.WithError(err).Fatalf("Failed to open database at %s", globalConfig.DatabasePath)
+	}
+	defer db.Close()
+	loadPathOverrides(db)
+
+	library, err := collectReportModels(db)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to read the database")
+	}
+	if len(library) == 0 {
+		log.Fatal("No downloaded models in the database.")
+	}
+
+	vault := &reportVault{dir: outDir, format: format, previews: previews == "copy"}
+	for _, dir := range []string{reportModelsDir, reportCreatorsDir, reportAttachmentsDir} {
+		if err := helpers.MkdirAll(filepath.Join(outDir, dir), 0755); err != nil {
+			log.WithError(err).Fatalf("Failed to create %s", filepath.Join(outDir, dir))
+		}
+	}
+	creators := make(map[string][]*reportModel)
+	for _, m := range library {
+		vault.writeNote(filepath.Join(reportModelsDir, m.Note+".md"), vault.modelNote(m))
+		if m.Creator != "" {
+			creators[m.Creator] = append(creators[m.Creator], m)
+		}
+	}
+	for creator, own := range creators {
+		vault.writeNote(filepath.Join(reportCreatorsDir, reportNoteName(creator)+".md"), vault.creatorNote(creator, own))
+	}
+	vault.writeNote(reportIndexNote, vault.indexNote(library))
+
+	fmt.Printf("Wrote %d note(s) for %d model(s) by %d creator(s) to %s.\n", vault.written, len(library), len(creators), outDir)
+	if vault.skipped > 0 {
+		fmt.Printf("Left %d note(s) alone that were not written by this command.\n", vault.skipped)
+	}
+}
+
+// collectReportModels groups the downloaded entries by model, sorted by name, and gives
+// each model a unique note name.
+func collectReportModels(db *database.DB) ([]*reportModel, error) {
+	byID := make(map[int]*reportModel)
+	err := db.Fold(func(key []byte, value []byte) error {
+		if !strings.HasPrefix(string(key), "v_") {
+			return nil
+		}
+		var entry models.DatabaseEntry
+		if json.Unmarshal(value, &entry) != nil || entry.Status != models.StatusDownloaded {
+			return nil
+		}
+		m := byID[entry.Version.ModelId]
+		if m == nil {
+			m = &reportModel{ID: entry.Version.ModelId, Name: entry.ModelName}
+			byID[entry.Version.ModelId] = m
+		}
+		m.Versions = append(m.Versions, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	library := make([]*reportModel, 0, len(byID))
+	names := make(map[string]int)
+	for _, m := range byID {
+		// Newest version first; it has the model's current type, creator and tags
+		sort.Slice(m.Versions, func(i, j int) bool { return m.Versions[i].Version.ID > m.Versions[j].Version.ID })
+		latest := m.Versions[0]
+		m.Type = latest.ModelType
+		if latest.InferredType != "" {
+			m.Type = latest.InferredType
+		}
+		m.Creator = latest.Creator.Username
+		m.Tags = latest.ModelTags
+		m.Note = reportNoteName(m.Name)
+		names[strings.ToLower(m.Note)]++
+		library = append(library, m)
+	}
+	for _, m := range library {
+		if names[strings.ToLower(m.Note)] > 1 {
+			m.Note = fmt.Sprintf("%s (%d)", m.Note, m.ID) // Models sharing a name
+		}
+	}
+	sort.Slice(library, func(i, j int) bool {
+		if library[i].Name != library[j].Name {
+			return helpers.CollateLess(library[i].Name, library[j].Name)
+		}
+		return library[i].ID < library[j].ID
+	})
+	return library, nil
+}
+
+// reportNoteName turns a name into a note file name working in Obsidian and on every OS.
+func reportNoteName(name string) string {
+	cleaned := strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '\\', ':', '*', '?', '"', '<', '>', '|', '#', '^', '[', ']':
+			return '-'
+		}
+		if r < 0x20 {
+			return -1
+		}
+		return r
+	}, name)
+	cleaned = strings.Trim(strings.TrimSpace(cleaned), ".")
+	if cleaned == "" {
+		cleaned = "Untitled"
+	}
+	return cleaned
+}
+
+// reportTag turns a Civitai tag into an Obsidian tag (no spaces or punctuation but - _ /).
+func reportTag(tag string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(strings.TrimSpace(tag)) {
+		switch {
+		case r == ' ':
+			b.WriteRune('-')
+		case r == '-' || r == '_' || r == '/' || r >= 0x80 ||
+			(r >= 'a' && r <= 'z') || (r >= '0' && r <= '9'):
+			b.WriteRune(r)
+		}
+	}
+	if strings.Trim(b.String(), "0123456789") == "" {
+		return "" // Obsidian tags need a character that isn't a digit
+	}
+	return b.String()
+}
+
+// link links from a note in a subdirectory (or the vault root with fromRoot) to the note.
+func (v *reportVault) link(note, label string, fromRoot bool) string {
+	if v.format == reportObsidian {
+		if label == "" || label == filepath.Base(note) {
+			return "[[" + note + "]]"
+		}
+		return "[[" + note + "|" + label + "]]"
+	}
+	target := note + ".md"
+	if !fromRoot {
+		target = "../" + target
+	}
+	if label == "" {
+		label = filepath.Base(note)
+	}
+	return fmt.Sprintf("[%s](%s)", label, strings.ReplaceAll(target, " ", "%20"))
+}
+
+// embed shows an attachment in a model note.
+func (v *reportVault) embed(attachment string) string {
+	if v.format == reportObsidian {
+		return "![[" + reportAttachmentsDir + "/" + attachment + "]]"
+	}
+	return fmt.Sprintf("![](../%s/%s)", reportAttachmentsDir, strings.ReplaceAll(attachment, " ", "%20"))
+}
+
+// copyPreview copies the version's preview into the vault and returns its attachment name
+// ("" if there is none, or previews are off).
+func (v *reportVault) copyPreview(entry models.DatabaseEntry) string {
+	if !v.previews {
+		return ""
+	}
+	source := previewImageFor(entryFilePath(globalConfig.SavePath, entry))
+	if source == "" {
+		return ""
+	}
+	name := fmt.Sprintf("%d-%d%s", entry.Version.ModelId, entry.Version.ID, strings.ToLower(filepath.Ext(source)))
+	target := filepath.Join(v.dir, reportAttachmentsDir, name)
+	if src, err := os.Stat(source); err == nil {
+		if dst, err := os.Stat(target); err == nil && dst.Size() == src.Size() && !dst.ModTime().Before(src.ModTime()) {
+			return name // Already copied
+		}
+	}
+	if err := helpers.CopyFile(source, target); err != nil {
+		log.WithError(err).Warnf("Failed to copy preview %s into the vault", source)
+		return ""
+	}
+	return name
+}
+
+// frontmatterLine renders a YAML key with a JSON-encoded value (JSON is valid YAML, which
+// saves quoting names with colons or quotes by hand). Empty values are left out.
+func frontmatterLine(b *strings.Builder, key string, value interface{}) {
+	switch v := value.(type) {
+	case string:
+		if v == "" {
+			return
+		}
+	case []string:
+		if len(v) == 0 {
+			return
+		}
+	}
+	encoded, _ := json.Marshal(value)
+	fmt.Fprintf(b, "%s: %s\n", key, encoded)
+}
+
+// modelNote renders the note of a model.
+func (v *reportVault) modelNote(m *reportModel) string {
+	var baseModels, triggers, paths, tags, airs, availability []string
+	seen := make(map[string]bool)
+	for _, entry := range m.Versions {
+		if b := entry.Version.BaseModel; b != "" && !seen["base:"+b] {
+			seen["base:"+b] = true
+			baseModels = append(baseModels, b)
+		}
+		for _, word := range helpers.TriggerPhrases(entry.Version.TrainedWords) {
+			if !seen["trigger:"+word] {
+				seen["trigger:"+word] = true
+				triggers = append(triggers, word)
+			}
+		}
+		paths = append(paths, entryFilePath(globalConfig.SavePath, entry))
+		airs = append(airs, entryAIR(entry))
+		availability = append(availability, entryAvailability(entry))
+	}
+	for _, tag := range m.Tags {
+		if t := reportTag(tag); t != "" && !seen["tag:"+t] {
+			seen["tag:"+t] = true
+			tags = append(tags, t)
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("---\n" + reportMarker + "\n")
+	frontmatterLine(&b, "civitai-model-id", m.ID)
+	frontmatterLine(&b, "type", m.Type)
+	frontmatterLine(&b, "base-models", baseModels)
+	if v.format == reportObsidian && m.Creator != "" {
+		frontmatterLine(&b, "creator", v.link(reportCreatorsDir+"/"+reportNoteName(m.Creator), m.Creator, false)) // A link property
+	} else {
+		frontmatterLine(&b, "creator", m.Creator)
+	}
+	frontmatterLine(&b, "tags", tags)
+	frontmatterLine(&b, "triggers", triggers)
+	frontmatterLine(&b, "paths", paths)
+	frontmatterLine(&b, "air", airs)
+	frontmatterLine(&b, "availability", availability) // One per path
+	frontmatterLine(&b, "url", fmt.Sprintf("https://civitai.com/models/%d", m.ID))
+	b.WriteString("---\n\n")
+
+	fmt.Fprintf(&b, "# %s\n\n", m.Name)
+	line := m.Type
+	if m.Creator != "" {
+		line += " by " + v.link(reportCreatorsDir+"/"+reportNoteName(m.Creator), m.Creator, false)
+	}
+	fmt.Fprintf(&b, "%s · [Civitai](https://civitai.com/models/%d)\n", line, m.ID)
+
+	for _, entry := range m.Versions {
+		fmt.Fprintf(&b, "\n## %s\n\n", entry.Version.Name)
+		if attachment := v.copyPreview(entry); attachment != "" {
+			b.WriteString(v.embed(attachment) + "\n\n")
+		}
+		fmt.Fprintf(&b, "- Version ID: %d ([Civitai](https://civitai.com/models/%d?modelVersionId=%d))\n", entry.Version.ID, m.ID, entry.Version.ID)
+		fmt.Fprintf(&b, "- AIR: `%s`\n", entryAIR(entry))
+		if entry.Version.BaseModel != "" {
+			fmt.Fprintf(&b, "- Base model: %s\n", entry.Version.BaseModel)
+		}
+		if words := helpers.TriggerPhrases(entry.Version.TrainedWords); len(words) > 0 {
+			fmt.Fprintf(&b, "- Trigger words: `%s`\n", strings.Join(words, "`, `"))
+		}
+		if entry.Version.PublishedAt != "" {
+			fmt.Fprintf(&b, "- Published: %s\n", strings.SplitN(entry.Version.PublishedAt, "T", 2)[0])
+		}
+		fmt.Fprintf(&b, "- File: `%s` (%s)\n", entryFilePath(globalConfig.SavePath, entry), helpers.BytesToSize(uint64(entry.File.SizeKB*1024)))
+		if availability := entryAvailability(entry); availability != availabilityActive {
+			fmt.Fprintf(&b, "- Availability: %s\n", strings.ReplaceAll(availability, "_", " "))
+		}
+	}
+	return b.String()
+}
+
+// creatorNote renders the note of a creator.
+func (v *reportVault) creatorNote(creator string, own []*reportModel) string {
+	var b strings.Builder
+	b.WriteString("---\n" + reportMarker + "\n")
+	frontmatterLine(&b, "civitai-creator", creator)
+	frontmatterLine(&b, "url", "https://civitai.com/user/"+creator)
+	b.WriteString("---\n\n")
+	fmt.Fprintf(&b, "# %s\n\n", creator)
+	for _, m := range own {
+		fmt.Fprintf(&b, "- %s (%s)\n", v.link(reportModelsDir+"/"+m.Note, m.Name, false), m.Type)
+	}
+	return b.String()
+}
+
+// indexNote renders the note listing every model by type.
+func (v *reportVault) indexNote(library []*reportModel) string {
+	byType := make(map[string][]*reportModel)
+	var types []string
+	for _, m := range library {
+		if byType[m.Type] == nil {
+			types = append(types, m.Type)
+		}
+		byType[m.Type] = append(byType[m.Type], m)
+	}
+	sort.Strings(types)
+
+	var b strings.Builder
+	b.WriteString("---\n" + reportMarker + "\n---\n\n# Civitai Library\n\n")
+	fmt.Fprintf(&b, "%d models, exported %s.\n", len(library), time.Now().Format("2006-01-02 15:04"))
+	for _, t := range types {
+		name := t
+		if name == "" {
+			name = "Unknown type"
+		}
+		fmt.Fprintf(&b, "\n## %s\n\n", name)
+		for _, m := range byType[t] {
+			fmt.Fprintf(&b, "- %s\n", v.link(reportModelsDir+"/"+m.Note, m.Name, true))
+		}
+	}
+	return b.String()
+}
+
+// writeNote writes a note below the vault, unless a note not generated by report is there.
+func (v *reportVault) writeNote(rel, content string) {
+	path := filepath.Join(v.dir, rel)
+	if existing, err := os.ReadFile(path); err == nil {
+		if string(existing) == content {
+			v.written++
+			return
+		}
+		if !strings.Contains(string(existing), "\n"+reportMarker+"\n") {
+			log.Warnf("Not overwriting %s: it was not written by this command", path)
+			v.skipped++
+			return
+		}
+	}
+	if err := helpers.WriteFile(path, []byte(content), 0644); err != nil {
+		log.WithError(err).Warnf("Failed to write %s", path)
+		return
+	}
+	v.written++
+}
@@ -0,0 +1,182 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/database"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+)
+
+// rollbackCmd makes an older version the current one of a model
+var rollbackCmd = &cobra.Command{
+	Use:   "rollback <model-id> --to-version <version-id>",
+	Short: "Make an older version of a model its current one",
+	Long: `Makes an older downloaded version of a model its current one: the "latest" symlink in
+the model directory is pointed at it and stays there, even when newer versions are
+downloaded, until the rollback is released with --release.
+
+The version must be in the database. If its file is no longer on disk, it is downloaded
+again from Civitai (checked against the recorded hashes) before the link is moved. The
+newer versions are kept as they are.`,
+	Example: `  civitai-downloader rollback 58390 --to-version 62833
+  civitai-downloader rollback 58390 --release`,
+	Args: cobra.ExactArgs(1),
+	Run:  runRollback,
+}
+
+func init() {
+	rootCmd.AddCommand(rollbackCmd)
+	rollbackCmd.Flags().Int("to-version", 0, "Model version ID to roll back to")
+	rollbackCmd.Flags().Bool("release", false, "Release a rollback: point the latest link at the newest downloaded version again")
+	rollbackCmd.Flags().BoolP("yes", "y", false, "Download a missing version file without prompting")
+}
+
+func runRollback(cmd *cobra.Command, args []string) {
+	modelID, err := modelIDArg(args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	toVersion, _ := cmd.Flags().GetInt("to-version")
+	release, _ := cmd.Flags().GetBool("release")
+	skipConfirm, _ := cmd.Flags().GetBool("yes")
+	if (toVersion == 0) == !release {
+		log.Fatal("Give either --to-version <version-id> or --release.")
+	}
+	if globalConfig.DatabasePath == "" || globalConfig.SavePath == "" {
+		log.Fatal("DatabasePath and SavePath must be set in the configuration.")
+	}
+
+	db, err := database.Open(globalConfig.DatabasePath)
+	if err != nil {
+		log.WithError(err).Fatalf("Failed to open database at %s", globalConfig.DatabasePath)
+	}
+	defer db.Close()
+
+	versions, err := modelVersionEntries(db, modelID)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to read the database")
+	}
+	if len(versions) == 0 {
+		log.Fatalf("Model %d has no versions in the database.", modelID)
+	}
+
+	if !release {
+		target, ok := findVersionEntry(versions, toVersion)
+		if !ok {
+			log.Fatalf("Version %d of model %d is not in the database; download it first with 'download --model-version-id %d'.", toVersion, modelID, toVersion)
+		}
+		if err := ensureVersionFile(db, target, skipConfirm); err != nil {
+			log.Fatal(err)
+		}
+		// Re-read: the download updates the entry
+		if versions, err = modelVersionEntries(db, modelID); err != nil {
+			log.WithError(err).Fatal("Failed to read the database")
+		}
+		var newer []string
+		for _, m := range versions {
+			if m.Entry.Version.ID > toVersion && m.Entry.Status == models.StatusDownloaded {
+				newer = append(newer, fmt.Sprintf("%d (%s)", m.Entry.Version.ID, m.Entry.Version.Name))
+			}
+		}
+		if len(newer) == 0 {
+			fmt.Printf("Version %d is the newest downloaded version of model %d; releasing any rollback instead.\n", toVersion, modelID)
+			release = true
+		} else {
+			fmt.Printf("Newer versions kept on disk: %s\n", strings.Join(newer, ", "))
+		}
+	}
+
+	now := time.Now().Unix()
+	for _, m := range versions {
+		held := int64(0)
+		if !release && m.Entry.Version.ID == toVersion {
+			held = now
+		}
+		if m.Entry.RolledBackAt == held {
+			continue
+		}
+		err := updateDbEntry(db, m.Key, m.Entry.Status, func(e *models.DatabaseEntry) {
+			e.RolledBackAt = held
+		})
+		if err != nil {
+			log.WithError(err).Fatalf("Failed to update %s", m.Key)
+		}
+	}
+
+	link, err := updateLatestLink(db, globalConfig.SavePath, modelID)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to update the latest link")
+	}
+	current, _, _ := currentModelEntry(db, modelID)
+	if release {
+		fmt.Printf("Released the rollback of model %d; its current version is %d (%s).\n", modelID, current.Version.ID, current.Version.Name)
+	} else {
+		fmt.Printf("Rolled model %d back to version %d (%s).\n", modelID, current.Version.ID, current.Version.Name)
+	}
+	if link != "" {
+		fmt.Printf("%s -> %s\n", link, entryVersionDir(globalConfig.SavePath, current))
+	}
+}
+
+// modelVersionEntries returns the entries of a model's versions, oldest version first.
+func modelVersionEntries(db *database.DB, modelID int) ([]catalogMatch, error) {
+	var matches []catalogMatch
+	err := db.Fold(func(key []byte, value []byte) error {
+		if !strings.HasPrefix(string(key), "v_") {
+			return nil
+		}
+		var entry models.DatabaseEntry
+		if json.Unmarshal(value, &entry) == nil && entry.Version.ModelId == modelID {
+			matches = append(matches, catalogMatch{Key: string(key), Entry: entry})
+		}
+		return nil
+	})
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Entry.Version.ID < matches[j].Entry.Version.ID })
+	return matches, err
+}
+
+// findVersionEntry returns the entry of versionID among versions.
+func findVersionEntry(versions []catalogMatch, versionID int) (catalogMatch, bool) {
+	for _, m := range versions {
+		if m.Entry.Version.ID == versionID {
+			return m, true
+		}
+	}
+	return catalogMatch{}, false
+}
+
+// ensureVersionFile makes sure a version's file is on disk, downloading it again (after
+// asking, unless skipConfirm) if it is missing or was never downloaded.
+func ensureVersionFile(db *database.DB, m catalogMatch, skipConfirm bool) error {
+	path := entryFilePath(globalConfig.SavePath, m.Entry)
+	if _, err := os.Stat(path); err == nil && m.Entry.Status == models.StatusDownloaded {
+		return nil
+	}
+	if m.Entry.File.DownloadUrl == "" {
+		return fmt.Errorf("version %d is not on disk and has no recorded download URL", m.Entry.Version.ID)
+	}
+	if change := hashPinChange(m.Entry, m.Entry.File); change != "" {
+		return fmt.Errorf("refusing to download version %d again: %s", m.Entry.Version.ID, change)
+	}
+	if !skipConfirm {
+		fmt.Printf("Version %d (%s) is not on disk (status %s). Download it again from Civitai? (y/N) ", m.Entry.Version.ID, m.Entry.Filename, m.Entry.Status)
+		reader := bufio.NewReader(os.Stdin)
+		input, _ := reader.ReadString('\n')
+		if strings.ToLower(strings.TrimSpace(input)) != "y" {
+			return fmt.Errorf("aborted: version %d is not on disk", m.Entry.Version.ID)
+		}
+	}
+	if _, err := redownloadEntry(db, m.Key, m.Entry, false); err != nil {
+		return fmt.Errorf("failed to download version %d again: %w", m.Entry.Version.ID, err)
+	}
+	return nil
+}
@@ -5,14 +5,21 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus" // Import logrus for config loading message
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
-	"go-civitai-download/internal/api"
-	"go-civitai-download/internal/config"
-	"go-civitai-download/internal/models"
+	"github.com/dreamfast/go-civitai-downloader/internal/api"
+	"github.com/dreamfast/go-civitai-downloader/internal/config"
+	"github.com/dreamfast/go-civitai-downloader/internal/downloader"
+	"github.com/dreamfast/go-civitai-downloader/internal/failure"
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
 )
 
 // cfgFile holds the path to the config file specified by the user
@@ -24,18 +31,68 @@ var logApiFlag bool
 // savePathFlag holds the value of the --save-path flag
 var savePathFlag string
 
+// tempDirFlag holds the value of the --temp-dir flag
+var tempDirFlag string
+
 // apiDelayFlag holds the value of the --api-delay flag
 var apiDelayFlag int
 
 // apiTimeoutFlag holds the value of the --api-timeout flag
 var apiTimeoutFlag int
 
+// workspaceFlag holds the value of the --workspace flag
+var workspaceFlag string
+
+// workspaceDir is the resolved root directory of the active workspace (empty if none)
+var workspaceDir string
+
+// strictApiFlag holds the value of the --strict-api flag
+var strictApiFlag bool
+
 // globalConfig holds the loaded configuration
 var globalConfig models.Config
 
 // globalHttpTransport holds the globally configured HTTP transport (base or logging-wrapped)
 var globalHttpTransport http.RoundTripper
 
+// globalBandwidthLimits holds the bandwidth budget of each transfer class, shared by all
+// HTTP clients of the process (a nil limiter means unlimited)
+var globalBandwidthLimits map[string]*helpers.BandwidthLimiter
+
+// globalHostRateLimits space out the requests to the hosts of HostRateLimits, shared by
+// all HTTP clients of the process
+var globalHostRateLimits []*downloader.HostRateLimit
+
+// globalHostOverrides sends the requests of all HTTP clients of the process to ApiBaseUrl
+// and the CdnHostOverrides hosts (nil when neither is set)
+var globalHostOverrides *downloader.HostOverrides
+
+// globalChallengeGuard holds all HTTP clients of the process back after a Cloudflare
+// challenge (nil when ChallengeCooldownSec is 0)
+var globalChallengeGuard *downloader.ChallengeGuard
+
+// globalRetryPolicy decides which HTTP statuses API requests and downloads retry and how
+// long they back off (RetryStatusCodes and RetryBackoffMultipliers)
+var globalRetryPolicy *downloader.RetryPolicy
+
+// globalRetryDelay is the wait before the first retry of a request (RetryDelay)
+var globalRetryDelay time.Duration
+
+// globalHashAlgorithms are the hashes computed of downloaded model files (HashAlgorithms)
+var globalHashAlgorithms []string
+
+// globalKeepMismatched keeps downloads that fail hash verification (HashMismatchPolicy "keep")
+var globalKeepMismatched bool
+
+// globalAria2 is the aria2c that model downloads are handed to (Aria2RpcUrl), or nil
+var globalAria2 *downloader.Aria2
+
+// globalQuarantineDir receives downloads that fail hash verification (HashMismatchPolicy "quarantine")
+var globalQuarantineDir string
+
+// globalLowMemory is the LowMemory (--low-memory) profile: no raw API JSON is kept in memory
+var globalLowMemory bool
+
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:   "civitai-downloader",
@@ -53,6 +110,7 @@ from Civitai.com based on specified criteria.`,
 func Execute() {
 	// cobra.OnInitialize(initConfig) // We use PersistentPreRunE now
 	err := rootCmd.Execute()
+	stopDebugInstrumentation()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error executing command: %v\n", err)
 		os.Exit(1)
@@ -60,9 +118,15 @@ func Execute() {
 }
 
 func init() {
+	// Tag every logged error with its failure category (errorCategory in JSON logs)
+	log.AddHook(failure.Hook{})
+
 	// Add persistent flags that apply to all commands
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "config.toml", "Configuration file path")
 
+	// Add persistent flag for selecting a workspace (independent config/DB/cache/log root)
+	rootCmd.PersistentFlags().StringVar(&workspaceFlag, "workspace", "", "Workspace name; uses ~/.config/civitai-downloader/workspaces/<name>/ for config, database, cache and logs")
+
 	// Add persistent flag for API logging
 	rootCmd.PersistentFlags().BoolVar(&logApiFlag, "log-api", false, "Log API requests/responses to api.log (overrides config)")
 	viper.BindPFlag("logapirequests", rootCmd.PersistentFlags().Lookup("log-api"))
@@ -71,6 +135,16 @@ func init() {
 	rootCmd.PersistentFlags().StringVar(&savePathFlag, "save-path", "", "Directory to save models (overrides config)")
 	viper.BindPFlag("savepath", rootCmd.PersistentFlags().Lookup("save-path"))
 
+	// Add persistent flag for the staging directory
+	rootCmd.PersistentFlags().StringVar(&tempDirFlag, "temp-dir", "", "Directory for partial downloads and other temp files (overrides config, default [SavePath]/.staging)")
+	viper.BindPFlag("tempdir", rootCmd.PersistentFlags().Lookup("temp-dir"))
+
+	// Add persistent flag for the layout of version directories
+	rootCmd.PersistentFlags().String("path-template", "", "Layout of version directories below the save path, e.g. {type}/{creator}/{model}/{versionId}-{file} (overrides config)")
+	viper.BindPFlag("pathtemplate", rootCmd.PersistentFlags().Lookup("path-template"))
+	rootCmd.PersistentFlags().String("nsfw-partition", "", "Keep models below a top-level directory per NSFW rating: \"rating\" (sfw/nsfw) or \"level\" (pg ... xxx) (overrides config)")
+	viper.BindPFlag("nsfwpartition", rootCmd.PersistentFlags().Lookup("nsfw-partition"))
+
 	// Add persistent flag for API delay
 	// Default value 0 or negative means "use config or viper default"
 	rootCmd.PersistentFlags().IntVar(&apiDelayFlag, "api-delay", -1, "Delay between API calls in ms (overrides config, -1 uses config default)")
@@ -81,9 +155,49 @@ func init() {
 	rootCmd.PersistentFlags().IntVar(&apiTimeoutFlag, "api-timeout", -1, "Timeout for API HTTP client in seconds (overrides config, -1 uses config default)")
 	viper.BindPFlag("apiclienttimeoutsec", rootCmd.PersistentFlags().Lookup("api-timeout"))
 
+	// Add persistent flag for strict API decoding
+	rootCmd.PersistentFlags().BoolVar(&strictApiFlag, "strict-api", false, "Fail on API schema drift (unknown fields/values) and save the offending payload (overrides config)")
+	viper.BindPFlag("strictapi", rootCmd.PersistentFlags().Lookup("strict-api"))
+
+	// Add persistent flag for the API etiquette profile
+	rootCmd.PersistentFlags().String("etiquette", "", "API etiquette profile: conservative (recommended), default or aggressive (overrides config)")
+	viper.BindPFlag("etiquetteprofile", rootCmd.PersistentFlags().Lookup("etiquette"))
+
+	// Add persistent flag for the low-memory profile
+	rootCmd.PersistentFlags().Bool("low-memory", false, "Use little memory: one download at a time, small API pages and buffers, no raw API JSON kept (overrides config)")
+	viper.BindPFlag("lowmemory", rootCmd.PersistentFlags().Lookup("low-memory"))
+
+	// Add persistent flags for the bandwidth budgets of each transfer class
+	rootCmd.PersistentFlags().String("bandwidth-metadata", "", "Bandwidth budget for API JSON per second, e.g. 1MB (overrides config, default unlimited)")
+	viper.BindPFlag("bandwidthmetadata", rootCmd.PersistentFlags().Lookup("bandwidth-metadata"))
+	rootCmd.PersistentFlags().String("bandwidth-previews", "", "Bandwidth budget for preview and gallery images per second, e.g. 2MB (overrides config, default unlimited)")
+	viper.BindPFlag("bandwidthpreviews", rootCmd.PersistentFlags().Lookup("bandwidth-previews"))
+	rootCmd.PersistentFlags().String("bandwidth-binaries", "", "Bandwidth budget for model files per second, e.g. 20MB (overrides config, default unlimited)")
+	viper.BindPFlag("bandwidthbinaries", rootCmd.PersistentFlags().Lookup("bandwidth-binaries"))
+	rootCmd.PersistentFlags().String("limit-rate", "", "Cap on all downloads together, e.g. 10MB/s (overrides config, default unlimited)")
+	viper.BindPFlag("limitrate", rootCmd.PersistentFlags().Lookup("limit-rate"))
+	rootCmd.PersistentFlags().StringSlice("host-rate-limit", []string{}, "Request rate for a host, e.g. *.cloudflarestorage.com=1/s (repeatable, overrides config)")
+	viper.BindPFlag("hostratelimits", rootCmd.PersistentFlags().Lookup("host-rate-limit"))
+	rootCmd.PersistentFlags().String("api-base-url", "", "Send API requests to this Civitai-compatible API instead, e.g. https://civitai-mirror.example.com/api/v1 (overrides config)")
+	viper.BindPFlag("apibaseurl", rootCmd.PersistentFlags().Lookup("api-base-url"))
+	rootCmd.PersistentFlags().StringToString("cdn-host-override", map[string]string{}, "Send requests for a host to another, e.g. image.civitai.com=images.example.com (repeatable, overrides config)")
+	viper.BindPFlag("cdnhostoverrides", rootCmd.PersistentFlags().Lookup("cdn-host-override"))
+	rootCmd.PersistentFlags().Int("challenge-cooldown", 60, "Pause all requests this many seconds after a Cloudflare challenge (overrides config, 0 disables)")
+	viper.BindPFlag("challengecooldownsec", rootCmd.PersistentFlags().Lookup("challenge-cooldown"))
+	rootCmd.PersistentFlags().Int("stall-timeout", 60, "Give up on a download connection that receives nothing this many seconds, to resume it (overrides config, 0 disables)")
+	viper.BindPFlag("stalltimeoutsec", rootCmd.PersistentFlags().Lookup("stall-timeout"))
+	rootCmd.PersistentFlags().Bool("preallocate", false, "Reserve each model file's full size on disk before writing it (overrides config)")
+	viper.BindPFlag("preallocate", rootCmd.PersistentFlags().Lookup("preallocate"))
+
 	// Set Viper defaults (these are applied only if not set in config file or by flag)
 	viper.SetDefault("apidelayms", 200)         // Default polite delay
 	viper.SetDefault("apiclienttimeoutsec", 60) // Default timeout
+	viper.SetDefault("maxretries", 3)
+	viper.SetDefault("mismatchretries", 1)
+	viper.SetDefault("fileformats", []string{"SafeTensor"})
+	viper.SetDefault("embeddingformats", []string{"SafeTensor", "PickleTensor"})
+	viper.SetDefault("diskspacereserve", "1GB")
+	viper.SetDefault("hashalgorithms", []string{helpers.HashSHA256, helpers.HashAutoV2, helpers.HashBLAKE3, helpers.HashCRC32})
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
@@ -93,6 +207,27 @@ func init() {
 // loadGlobalConfig attempts to load the configuration and applies flag overrides.
 // It also sets up the global HTTP transport based on logging settings.
 func loadGlobalConfig(cmd *cobra.Command, args []string) error {
+	pprofAddr, _ := cmd.Flags().GetString("debug-pprof")
+	tracePath, _ := cmd.Flags().GetString("debug-trace")
+	if err := startDebugInstrumentation(pprofAddr, tracePath); err != nil {
+		return err
+	}
+
+	// --- Resolve Workspace ---
+	if workspaceFlag != "" {
+		dir, err := config.WorkspaceDir(workspaceFlag)
+		if err != nil {
+			return fmt.Errorf("failed to resolve workspace: %w", err)
+		}
+		workspaceDir = dir
+		// An explicit --config still wins over the workspace config file
+		if configFlag := cmd.Flag("config"); configFlag == nil || !configFlag.Changed {
+			cfgFile = filepath.Join(workspaceDir, config.WorkspaceConfigFile)
+		}
+		log.Infof("Using workspace '%s' at %s", workspaceFlag, workspaceDir)
+	}
+	// --- End Resolve Workspace ---
+
 	// --- Configure Viper to read the config file ---
 	if cfgFile != "" {
 		// Use config file from the flag.
@@ -142,13 +277,85 @@ func loadGlobalConfig(cmd *cobra.Command, args []string) error {
 		// return fmt.Errorf("failed to load config: %w", err)
 	}
 
+	// --- Apply Workspace Path Defaults ---
+	// Anything the workspace config leaves empty is placed inside the workspace root,
+	// so each workspace has its own database, index and downloads.
+	if workspaceDir != "" {
+		config.ApplyWorkspaceDefaults(&globalConfig, workspaceDir)
+		viper.SetDefault("savepath", globalConfig.SavePath)
+		viper.SetDefault("databasepath", globalConfig.DatabasePath)
+		viper.SetDefault("bleveindexpath", globalConfig.BleveIndexPath)
+		log.Debugf("Workspace defaults applied: SavePath=%s, DatabasePath=%s, BleveIndexPath=%s", globalConfig.SavePath, globalConfig.DatabasePath, globalConfig.BleveIndexPath)
+	}
+
 	// --- REMOVED: Manual merge of loaded config values into Viper ---
 	// Viper automatically handles precedence of config file vs flags when flags are bound.
 	// Relying on viper.Get*() functions ensures the correct value is used.
 
 	log.Debug("Config loaded (or attempted). Viper will manage value precedence.")
 
-	baseTransport := http.DefaultTransport
+	// --- API Decoding Mode ---
+	api.SetStrictMode(viper.GetBool("strictapi"))
+	api.SetPayloadDir(apiPayloadDir())
+	if api.StrictMode() {
+		log.Info("Strict API decoding enabled: schema drift will abort and save the payload.")
+	}
+
+	if err := applyEtiquetteProfile(); err != nil {
+		return err
+	}
+	applyLowMemory()
+
+	limits, err := bandwidthLimits()
+	if err != nil {
+		return err
+	}
+	globalBandwidthLimits = limits
+	if globalHostRateLimits, err = downloader.ParseHostRateLimits(viper.GetStringSlice("hostratelimits")); err != nil {
+		return fmt.Errorf("HostRateLimits: %w", err)
+	}
+	for _, l := range globalHostRateLimits {
+		log.Infof("Rate limit for %s: one request every %v per host", l.Pattern, l.Interval)
+	}
+	if globalHostOverrides, err = downloader.ParseHostOverrides(viper.GetString("apibaseurl"), viper.GetStringMapString("cdnhostoverrides")); err != nil {
+		return err
+	}
+	if globalHostOverrides != nil {
+		log.Infof("API requests go to %s", globalHostOverrides.APIBase())
+		for _, h := range globalHostOverrides.Hosts() {
+			log.Infof("Host override: %s", h)
+		}
+	}
+	if err := setOutputPermissions(); err != nil {
+		return err
+	}
+	if globalRetryPolicy, err = retryPolicy(); err != nil {
+		return err
+	}
+	if globalRetryDelay, err = retryDelay(); err != nil {
+		return err
+	}
+	if globalHashAlgorithms, err = helpers.ParseHashAlgorithms(viper.GetStringSlice("hashalgorithms")); err != nil {
+		return fmt.Errorf("HashAlgorithms: %w", err)
+	}
+	if helpers.VerifyAlgorithms, err = helpers.ParseVerifyAlgorithms(viper.GetStringSlice("verifyhashes")); err != nil {
+		return fmt.Errorf("VerifyHashes: %w", err)
+	}
+	policy, err := hashMismatchPolicy()
+	if err != nil {
+		return err
+	}
+	globalKeepMismatched = policy == "keep"
+	globalQuarantineDir = ""
+	if policy == "quarantine" {
+		globalQuarantineDir = quarantineDir()
+	}
+	globalAria2 = nil
+	if endpoint := viper.GetString("aria2rpcurl"); endpoint != "" {
+		globalAria2 = downloader.NewAria2(endpoint, viper.GetString("aria2rpcsecret"), nil)
+	}
+	globalChallengeGuard = downloader.NewChallengeGuard(time.Duration(viper.GetInt("challengecooldownsec")) * time.Second)
+	baseTransport := downloader.NewHostOverrideTransport(downloader.NewBandwidthTransport(downloader.NewChallengeTransport(downloader.NewHostRateTransport(http.DefaultTransport, globalHostRateLimits), globalChallengeGuard), globalBandwidthLimits), globalHostOverrides)
 
 	// Check if API logging is enabled using Viper
 	globalHttpTransport = baseTransport // Default to base transport
@@ -157,18 +364,7 @@ func loadGlobalConfig(cmd *cobra.Command, args []string) error {
 	if viper.GetBool("logapirequests") {
 		log.Debug("API request logging enabled (via Viper), wrapping global HTTP transport.")
 		// Define log file path
-		logFilePath := "api.log"
-		// Attempt to resolve relative to SavePath if possible, otherwise use current dir
-		// Get SavePath using Viper
-		savePath := viper.GetString("savepath")
-		if savePath != "" {
-			// Ensure SavePath exists (it might not if config loading failed partially)
-			if _, statErr := os.Stat(savePath); statErr == nil {
-				logFilePath = filepath.Join(savePath, logFilePath)
-			} else {
-				log.Warnf("SavePath '%s' (from Viper) not found, saving api.log to current directory.", savePath)
-			}
-		}
+		logFilePath := apiLogFilePath()
 		log.Infof("API logging to file: %s", logFilePath)
 
 		// Initialize the logging transport
@@ -186,3 +382,230 @@ func loadGlobalConfig(cmd *cobra.Command, args []string) error {
 	// BUT: Rely on viper.Get*() for values potentially overridden by flags.
 	return nil
 }
+
+// bandwidthLimits builds the limiters of the BandwidthMetadata, BandwidthPreviews and
+// BandwidthBinaries budgets, and of LimitRate for all of them together.
+func bandwidthLimits() (map[string]*helpers.BandwidthLimiter, error) {
+	limits := make(map[string]*helpers.BandwidthLimiter)
+	for class, key := range map[string]string{
+		helpers.BandwidthMetadata: "bandwidthmetadata",
+		helpers.BandwidthPreviews: "bandwidthpreviews",
+		helpers.BandwidthBinaries: "bandwidthbinaries",
+		helpers.BandwidthTotal:    "limitrate",
+	} {
+		value := strings.TrimSpace(viper.GetString(key))
+		if lower := strings.ToLower(value); strings.HasSuffix(lower, "/s") {
+			value = value[:len(value)-2] // "10MB/s"
+		}
+		if value == "" {
+			continue
+		}
+		perSecond, err := helpers.ParseByteSize(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s budget %q: %w", class, value, err)
+		}
+		limits[class] = helpers.NewBandwidthLimiter(perSecond)
+		if class == helpers.BandwidthTotal {
+			log.Infof("Bandwidth limit for all transfers together: %s/s", helpers.BytesToSize(perSecond))
+			continue
+		}
+		log.Infof("Bandwidth budget for %s: %s/s", class, helpers.BytesToSize(perSecond))
+	}
+	return limits, nil
+}
+
+// retryPolicy builds the HTTP retry policy from RetryStatusCodes and RetryBackoffMultipliers.
+func retryPolicy() (*downloader.RetryPolicy, error) {
+	multipliers := make(map[string]float64)
+	for status, value := range viper.GetStringMap("retrybackoffmultipliers") {
+		m, err := strconv.ParseFloat(fmt.Sprint(value), 64)
+		if err != nil {
+			return nil, fmt.Errorf("RetryBackoffMultipliers: invalid multiplier %v for %s", value, status)
+		}
+		multipliers[status] = m
+	}
+	policy, err := downloader.NewRetryPolicy(viper.GetIntSlice("retrystatuscodes"), multipliers)
+	if err != nil {
+		return nil, fmt.Errorf("RetryStatusCodes/RetryBackoffMultipliers: %w", err)
+	}
+	log.Debugf("HTTP retry policy: %s", policy)
+	return policy, nil
+}
+
+// defaultRetryDelay is the RetryDelay of configurations that don't set it.
+const defaultRetryDelay = 2 * time.Second
+
+// retryDelay reads RetryDelay, a duration ("2s", "500ms"). InitialRetryDelayMs, which
+// older configurations may set instead, is still honoured.
+func retryDelay() (time.Duration, error) {
+	value := strings.TrimSpace(viper.GetString("retrydelay"))
+	if value == "" {
+		if viper.IsSet("initialretrydelayms") {
+			return time.Duration(viper.GetInt("initialretrydelayms")) * time.Millisecond, nil
+		}
+		return defaultRetryDelay, nil
+	}
+	delay, err := time.ParseDuration(value)
+	if err != nil || delay < 0 {
+		return 0, fmt.Errorf("RetryDelay: invalid duration %q (e.g. \"2s\")", value)
+	}
+	return delay, nil
+}
+
+// hashMismatchPolicy reads HashMismatchPolicy: whether a downloaded file whose hashes don't
+// match the API's is deleted ("delete", the default), kept next to the target ("keep") or
+// moved into the quarantine directory ("quarantine").
+func hashMismatchPolicy() (string, error) {
+	switch value := strings.ToLower(strings.TrimSpace(viper.GetString("hashmismatchpolicy"))); value {
+	case "", "delete":
+		return "delete", nil
+	case "keep", "quarantine":
+		return value, nil
+	default:
+		return "", fmt.Errorf("HashMismatchPolicy: invalid value %q (use \"delete\", \"keep\" or \"quarantine\")", value)
+	}
+}
+
+// etiquetteProfile is a bundle of the settings that decide how hard a run leans on Civitai.
+type etiquetteProfile struct {
+	apiDelayMs  int    // ApiDelayMs
+	concurrency int    // Concurrency (and images --concurrency)
+	segments    int    // DownloadSegments
+	maxRetries  int    // MaxRetries
+	retryDelay  string // RetryDelay
+}
+
+// etiquetteProfiles are the EtiquetteProfile (--etiquette) presets. "default" is what an
+// unset EtiquetteProfile has always meant.
+var etiquetteProfiles = map[string]etiquetteProfile{
+	"conservative": {apiDelayMs: 1000, concurrency: 2, segments: 1, maxRetries: 2, retryDelay: "10s"},
+	"default":      {apiDelayMs: 200, concurrency: 4, segments: 0, maxRetries: 3, retryDelay: "2s"},
+	"aggressive":   {apiDelayMs: 50, concurrency: 8, segments: 4, maxRetries: 5, retryDelay: "1s"},
+}
+
+// applyEtiquetteProfile makes the settings of the EtiquetteProfile (--etiquette) preset the
+// defaults of this run. Anything set in the config file or by a flag still wins, so a
+// profile can be tuned one knob at a time.
+func applyEtiquetteProfile() error {
+	name := strings.ToLower(strings.TrimSpace(viper.GetString("etiquetteprofile")))
+	if name == "" {
+		return nil
+	}
+	profile, ok := etiquetteProfiles[name]
+	if !ok {
+		return fmt.Errorf("EtiquetteProfile: invalid value %q (use \"conservative\", \"default\" or \"aggressive\")", name)
+	}
+	viper.SetDefault("apidelayms", profile.apiDelayMs)
+	viper.SetDefault("concurrency", profile.concurrency)
+	viper.SetDefault("images.concurrency", profile.concurrency)
+	viper.SetDefault("downloadsegments", profile.segments)
+	viper.SetDefault("maxretries", profile.maxRetries)
+	if !viper.IsSet("initialretrydelayms") { // The older setting still wins, as without a profile
+		viper.SetDefault("retrydelay", profile.retryDelay)
+	}
+	log.Infof("Etiquette profile %s: %d ms between API calls, %d downloads at once, %d retries from %s",
+		name, viper.GetInt("apidelayms"), viper.GetInt("concurrency"), viper.GetInt("maxretries"), viper.GetString("retrydelay"))
+	return nil
+}
+
+// The LowMemory profile, for devices with little RAM such as a Raspberry Pi serving a NAS.
+const (
+	lowMemoryConcurrency = 1       // Downloads (and images, torrents) at once
+	lowMemoryPageLimit   = 20      // Models or images per API page
+	lowMemoryCopyBuffer  = 8 << 10 // Bytes downloads and hashing stream through
+	lowMemoryGCPercent   = 50      // Collect garbage once the heap has grown by half
+)
+
+// applyLowMemory turns on the LowMemory (--low-memory) profile if it is set: it caps
+// concurrency and API page sizes, downloads each file over one connection, streams through
+// small buffers, looks for API schema drift without a second decode of each page, keeps no
+// raw API JSON for sidecars (they are written from the decoded structs) and collects
+// garbage sooner.
+func applyLowMemory() {
+	globalLowMemory = viper.GetBool("lowmemory")
+	api.SetLowMemory(globalLowMemory)
+	if !globalLowMemory {
+		return
+	}
+	for key, limit := range map[string]int{
+		"concurrency":        lowMemoryConcurrency,
+		"images.concurrency": lowMemoryConcurrency,
+		"limit":              lowMemoryPageLimit,
+		"images.limit":       lowMemoryPageLimit,
+	} {
+		if n := viper.GetInt(key); n <= 0 || n > limit {
+			viper.Set(key, limit)
+		}
+	}
+	viper.Set("downloadsegments", 1)
+	helpers.SetCopyBufferSize(lowMemoryCopyBuffer)
+	debug.SetGCPercent(lowMemoryGCPercent)
+	log.Infof("Low-memory mode: %d download at a time over one connection, %d items per API page, no raw API JSON kept", lowMemoryConcurrency, lowMemoryPageLimit)
+}
+
+// rawForSidecar returns raw, API JSON to keep for a metadata sidecar, or nil in low-memory
+// mode, where sidecars are written from the decoded structs.
+func rawForSidecar(raw []byte) []byte {
+	if globalLowMemory {
+		return nil
+	}
+	return raw
+}
+
+// setOutputPermissions configures the FileMode, DirMode and Chown given to what the tool
+// writes below SavePath.
+func setOutputPermissions() error {
+	fileMode, err := helpers.ParseFileMode(viper.GetString("filemode"))
+	if err != nil {
+		return fmt.Errorf("FileMode: %w", err)
+	}
+	dirMode, err := helpers.ParseFileMode(viper.GetString("dirmode"))
+	if err != nil {
+		return fmt.Errorf("DirMode: %w", err)
+	}
+	uid, gid, err := helpers.ParseOwner(viper.GetString("chown"))
+	if err != nil {
+		return fmt.Errorf("Chown: %w", err)
+	}
+	helpers.SetOutputPermissions(fileMode, dirMode, uid, gid)
+	return nil
+}
+
+// apiLogFilePath returns the location of api.log. Inside a workspace it goes to the
+// workspace logs directory; otherwise it is resolved relative to SavePath if that
+// exists, falling back to the current directory.
+func apiLogFilePath() string {
+	logFilePath := "api.log"
+	if workspaceDir != "" {
+		return filepath.Join(workspaceDir, config.WorkspaceLogsDir, logFilePath)
+	}
+	// Get SavePath using Viper
+	savePath := viper.GetString("savepath")
+	if savePath != "" {
+		// Ensure SavePath exists (it might not if config loading failed partially)
+		if _, statErr := os.Stat(savePath); statErr == nil {
+			logFilePath = filepath.Join(savePath, logFilePath)
+		} else {
+			log.Warnf("SavePath '%s' (from Viper) not found, saving api.log to current directory.", savePath)
+		}
+	}
+	return logFilePath
+}
+
+// quarantineDir returns where files that fail verification are moved with HashMismatchPolicy
+// "quarantine": [SavePath]/quarantine.
+func quarantineDir() string {
+	return filepath.Join(viper.GetString("savepath"), "quarantine")
+}
+
+// apiPayloadDir returns where offending API payloads are saved in --strict-api mode:
+// the workspace cache if a workspace is active, otherwise [SavePath]/api_payloads.
+func apiPayloadDir() string {
+	if workspaceDir != "" {
+		return filepath.Join(workspaceDir, config.WorkspaceCacheDir, "api_payloads")
+	}
+	if savePath := viper.GetString("savepath"); savePath != "" {
+		return filepath.Join(savePath, "api_payloads")
+	}
+	return "api_payloads"
+}
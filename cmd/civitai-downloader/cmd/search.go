@@ -15,14 +15,18 @@ var searchCmd = &cobra.Command{
 	Use:   "search",
 	Short: "Search the Bleve index for downloaded models or images",
 	Long: `Provides subcommands to search the Bleve index created during downloads.
-Use 'search models' or 'search images'.`,
+Use 'search models' or 'search images'.
+
+--thumbnails shows the hits as a grid of images in terminals that support the kitty or
+sixel image protocol: the image itself, or the preview of a model file.`,
 	// No Run function, this is a parent command
 }
 
 func init() {
 	rootCmd.AddCommand(searchCmd)
 
-	// No flags defined here, they belong to subcommands (models, images)
+	// The query flag belongs to the subcommands (models, images); --thumbnails is shared
+	addThumbnailsFlag(searchCmd.PersistentFlags())
 }
 
 // runSearch has been moved to search_logic.go as runSearchLogic
@@ -2,8 +2,11 @@ package cmd
 
 import (
 	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
 
-	index "go-civitai-download/index"
+	index "github.com/dreamfast/go-civitai-downloader/index"
 
 	"github.com/blevesearch/bleve/v2" // Import bleve package directly
 	log "github.com/sirupsen/logrus"
@@ -11,8 +14,9 @@ import (
 )
 
 // runSearchLogic executes the search against a specific index path.
-// It's called by the subcommand Run functions.
-func runSearchLogic(indexPath string, query string) {
+// It's called by the subcommand Run functions. With a terminal image protocol the hits are
+// shown as a thumbnail grid instead of their fields.
+func runSearchLogic(indexPath string, query string, thumbnails string, order string) {
 	// Logging should already be initialized by the time this is called
 	log.Debugf("runSearchLogic called with indexPath: %s, query: %s", indexPath, query)
 
@@ -48,7 +52,7 @@ func runSearchLogic(indexPath string, query string) {
 
 	log.Infof("Performing search with query: %s", query)
 
-	searchResults, err := index.SearchIndex(bleveIndex, query)
+	searchResults, err := index.SearchIndex(bleveIndex, query, searchSortBy(order)...)
 	if err != nil {
 		log.Errorf("Error performing search: %v", err)
 		return
@@ -59,13 +63,24 @@ func runSearchLogic(indexPath string, query string) {
 		searchResults.Total,
 		searchResults.Took)
 
-	if searchResults.Total > 0 {
+	if searchResults.Total > 0 && thumbnails != "" {
+		grid := newThumbnailGrid(thumbnails)
+		for _, hit := range searchResults.Hits {
+			grid.add(hitThumbnail(hit.Fields), hitField(hit.Fields, "modelName", "name"), hitField(hit.Fields, "versionName", "creatorName"), hit.ID)
+		}
+		grid.flush()
+	} else if searchResults.Total > 0 {
 		fmt.Println("--- Search Results ---")
 		for i, hit := range searchResults.Hits {
 			fmt.Printf("[%d] ID: %s (Score: %.2f)\n", i+1, hit.ID, hit.Score)
-			// Print requested fields (all fields are requested by SearchIndex)
-			for field, value := range hit.Fields {
-				fmt.Printf("  %s: %v\n", field, value)
+			// Print requested fields (all fields are requested by SearchIndex), by name
+			fields := make([]string, 0, len(hit.Fields))
+			for field := range hit.Fields {
+				fields = append(fields, field)
+			}
+			sort.Strings(fields)
+			for _, field := range fields {
+				fmt.Printf("  %s: %v\n", field, hit.Fields[field])
 			}
 			fmt.Println("---")
 		}
@@ -73,3 +88,40 @@ func runSearchLogic(indexPath string, query string) {
 		fmt.Println("No results found matching your query.")
 	}
 }
+
+// searchSortBy turns --sort into bleve's sort order: "score" (best first), "id", or an
+// indexed field, descending with a leading "-". Ties are broken by ID, so the same index
+// lists the same hits in the same order.
+func searchSortBy(order string) []string {
+	switch order = strings.TrimSpace(order); order {
+	case "", "score":
+		return []string{"-_score", "_id"}
+	case "id":
+		return []string{"_id"}
+	}
+	return []string{order, "_id"}
+}
+
+// hitField returns the first of the fields the hit has, as text.
+func hitField(fields map[string]interface{}, names ...string) string {
+	for _, name := range names {
+		if value, ok := fields[name]; ok && value != nil && fmt.Sprint(value) != "" {
+			return fmt.Sprint(value)
+		}
+	}
+	return ""
+}
+
+// hitThumbnail returns the image to show for a hit: the file itself for images, or the
+// preview of a model file.
+func hitThumbnail(fields map[string]interface{}) string {
+	path := hitField(fields, "filePath")
+	if path == "" {
+		return ""
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".png", ".jpg", ".jpeg", ".gif":
+		return path
+	}
+	return previewImageFor(path)
+}
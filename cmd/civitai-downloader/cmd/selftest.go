@@ -0,0 +1,409 @@
+package cmd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/database"
+	"github.com/dreamfast/go-civitai-downloader/internal/downloader"
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+)
+
+// selftestCmd is a burn-in check of the storage the library goes to
+var selftestCmd = &cobra.Command{
+	Use:   "selftest",
+	Short: "Burn in new storage: download synthetic files through the full pipeline and verify them",
+	Long: `Checks the storage below SavePath before a long sync is pointed at it. A local
+HTTP server serves synthetic model files (random, incompressible data with known
+SHA256s), and the built-in downloader fetches them the way it fetches models: through
+TempDir with resume checkpoints, segments, retries and stall detection as configured,
+hash-checked, flushed and moved into place. Every file is then read back from disk and
+hashed again. Write and read throughput are reported at the end, and the files are
+removed unless --keep is given. Nothing is sent to Civitai.
+
+--sample re-hashes that many random downloaded files of the library against the
+database instead, measuring read throughput on real data without writing anything.
+
+Reads right after the writes can come from the page cache; use a --size larger than
+the machine's memory to measure the disks themselves. The exit code is 1 if any file
+failed.`,
+	Example: `  civitai-downloader selftest --size 50GB
+  civitai-downloader selftest --size 200GB --files 40 --dir /mnt/new-array/burn-in
+  civitai-downloader selftest --sample 20`,
+	Args: cobra.NoArgs,
+	Run:  runSelftest,
+}
+
+func init() {
+	rootCmd.AddCommand(selftestCmd)
+	selftestCmd.Flags().String("size", "10GB", "Total size of the synthetic files, e.g. 50GB")
+	selftestCmd.Flags().Int("files", 0, "Number of synthetic files (default: one per 2GB, at least the concurrency)")
+	selftestCmd.Flags().String("dir", "", "Directory to write the files to (default: a .selftest directory below SavePath)")
+	selftestCmd.Flags().Int("concurrency", 0, "Files downloaded at once (default: Concurrency)")
+	selftestCmd.Flags().Bool("keep", false, "Keep the files (and the directory) afterwards")
+	selftestCmd.Flags().Int("sample", 0, "Instead, re-hash this many random downloaded files of the library against the database")
+}
+
+// selftestFileSize is the size per synthetic file --files defaults to.
+const selftestFileSize = 2 << 30
+
+// selftestBlockSize is the unit the synthetic data is generated in; any block can be made
+// on its own, so the server can answer range requests (resumes and segments).
+const selftestBlockSize = 1 << 20
+
+// syntheticFile is the content of a synthetic file: random bytes made from the seed and
+// the block number, so it is the same every time and doesn't compress.
+type syntheticFile struct {
+	name string
+	seed uint64
+	size int64
+}
+
+// reader returns a reader of the file's content. It keeps the block it made last, as
+// callers read far less than a block at a time; it is not safe for concurrent use.
+func (f syntheticFile) reader() *io.SectionReader {
+	return io.NewSectionReader(&syntheticReader{file: f, index: -1, block: make([]byte, selftestBlockSize)}, 0, f.size)
+}
+
+// syntheticReader reads a syntheticFile.
+type syntheticReader struct {
+	file  syntheticFile
+	index int64 // Of the block in block, -1 for none
+	block []byte
+}
+
+// ReadAt implements io.ReaderAt.
+func (r *syntheticReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.file.size {
+		return 0, io.EOF
+	}
+	n := 0
+	for n < len(p) && off < r.file.size {
+		index := off / selftestBlockSize
+		if index != r.index {
+			r.file.block(index, r.block)
+			r.index = index
+		}
+		start := int(off - index*selftestBlockSize)
+		end := min(selftestBlockSize, int(r.file.size-index*selftestBlockSize))
+		copied := copy(p[n:], r.block[start:end])
+		n += copied
+		off += int64(copied)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// block fills b with block index of the file.
+func (f syntheticFile) block(index int64, b []byte) {
+	var seed [32]byte
+	binary.LittleEndian.PutUint64(seed[0:], f.seed)
+	binary.LittleEndian.PutUint64(seed[8:], uint64(index))
+	rand.NewChaCha8(seed).Read(b)
+}
+
+// sha256 returns the SHA256 of the file's content.
+func (f syntheticFile) sha256() string {
+	hasher := sha256.New()
+	io.Copy(hasher, f.reader())
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// selftestResult is the outcome of one file.
+type selftestResult struct {
+	file     syntheticFile
+	path     string
+	err      error
+	verified bool
+}
+
+func runSelftest(cmd *cobra.Command, args []string) {
+	sizeFlag, _ := cmd.Flags().GetString("size")
+	files, _ := cmd.Flags().GetInt("files")
+	dir, _ := cmd.Flags().GetString("dir")
+	concurrency, _ := cmd.Flags().GetInt("concurrency")
+	keep, _ := cmd.Flags().GetBool("keep")
+	sample, _ := cmd.Flags().GetInt("sample")
+
+	if concurrency <= 0 {
+		concurrency = max(1, viper.GetInt("concurrency"))
+	}
+	if sample > 0 {
+		if !runSelftestSample(sample, concurrency) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	total, err := helpers.ParseByteSize(sizeFlag)
+	if err != nil || total == 0 {
+		log.Fatalf("Invalid --size %q: use a size such as 50GB", sizeFlag)
+	}
+	if files <= 0 {
+		files = max(concurrency, int((total+selftestFileSize-1)/selftestFileSize))
+	}
+	if uint64(files) > total {
+		files = int(total)
+	}
+	if dir == "" {
+		if globalConfig.SavePath == "" {
+			log.Fatal("SavePath must be set in the configuration, or --dir given.")
+		}
+		dir = filepath.Join(globalConfig.SavePath, ".selftest")
+	}
+	if _, err := os.Stat(dir); err == nil {
+		log.Fatalf("%s already exists; remove it or choose another --dir", dir)
+	}
+	if free, _, err := helpers.FreeSpace(filepath.Dir(dir)); err == nil && free < total {
+		log.Fatalf("Not enough free space for a %s self-test on the filesystem of %s: %s free", helpers.BytesToSize(total), dir, helpers.BytesToSize(free))
+	}
+	if err := helpers.MkdirAll(dir, 0700); err != nil {
+		log.WithError(err).Fatalf("Failed to create %s", dir)
+	}
+	if !keep {
+		defer os.RemoveAll(dir)
+	}
+
+	// The synthetic files split the size evenly, the first ones taking the remainder
+	runSeed := uint64(time.Now().UnixNano())
+	synthetic := make([]syntheticFile, files)
+	for i := range synthetic {
+		size := int64(total / uint64(files))
+		if uint64(i) < total%uint64(files) {
+			size++
+		}
+		synthetic[i] = syntheticFile{name: fmt.Sprintf("selftest-%03d.safetensors", i+1), seed: runSeed + uint64(i), size: size}
+	}
+
+	fmt.Printf("Self-test: %d files, %s in total, %d at a time, to %s\n", files, helpers.BytesToSize(total), concurrency, dir)
+	fmt.Println("Preparing the synthetic data...")
+	hashes := make([]string, files)
+	parallelEach(files, concurrency, func(i int) { hashes[i] = synthetic[i].sha256() })
+
+	server, baseURL, err := startSelftestServer(synthetic)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to start the self-test server")
+	}
+	defer server.Close()
+
+	fileDownloader := newSelftestDownloader()
+	results := make([]selftestResult, files)
+
+	// Phase 1: download through the pipeline (staging, checkpoints, verification, move)
+	fmt.Println("Writing...")
+	var written atomic.Int64
+	writeStart := time.Now()
+	parallelEach(files, concurrency, func(i int) {
+		f := synthetic[i]
+		target := filepath.Join(dir, f.name)
+		path, _, err := fileDownloader.DownloadFileContext(context.Background(), target, baseURL+"/"+f.name,
+			models.Hashes{SHA256: strings.ToUpper(hashes[i])}, 0)
+		results[i] = selftestResult{file: f, path: path, err: err}
+		if err == nil {
+			written.Add(f.size)
+		} else {
+			log.WithError(err).Errorf("Self-test: writing %s failed", f.name)
+		}
+	})
+	writeTime := time.Since(writeStart)
+
+	// Phase 2: read everything back and hash it again
+	fmt.Println("Reading back...")
+	var read atomic.Int64
+	readStart := time.Now()
+	parallelEach(files, concurrency, func(i int) {
+		r := &results[i]
+		if r.err != nil {
+			return
+		}
+		sums, err := helpers.HashFile(r.path, []string{helpers.HashSHA256})
+		switch {
+		case err != nil:
+			r.err = fmt.Errorf("reading back: %w", err)
+		case !strings.EqualFold(sums[helpers.HashSHA256], hashes[i]):
+			r.err = fmt.Errorf("read back with SHA256 %s, written with %s", sums[helpers.HashSHA256], hashes[i])
+		default:
+			r.verified = true
+			read.Add(r.file.size)
+			return
+		}
+		log.WithError(r.err).Errorf("Self-test: %s failed", r.file.name)
+	})
+	readTime := time.Since(readStart)
+
+	failed := 0
+	for _, r := range results {
+		if !r.verified {
+			failed++
+		}
+	}
+	fmt.Println()
+	fmt.Printf("Written:  %s in %v (%s/s)\n", helpers.BytesToSize(uint64(written.Load())), writeTime.Round(time.Millisecond), selftestRate(written.Load(), writeTime))
+	fmt.Printf("Read:     %s in %v (%s/s)\n", helpers.BytesToSize(uint64(read.Load())), readTime.Round(time.Millisecond), selftestRate(read.Load(), readTime))
+	fmt.Printf("Verified: %d of %d files\n", files-failed, files)
+	if keep {
+		fmt.Printf("The files are kept in %s\n", dir)
+	}
+	if failed > 0 {
+		fmt.Printf("FAILED: %d files didn't make it to disk intact (see the log)\n", failed)
+		server.Close()
+		if !keep {
+			os.RemoveAll(dir)
+		}
+		os.Exit(1)
+	}
+	fmt.Println("PASSED")
+}
+
+// startSelftestServer serves the synthetic files on a loopback port, with range requests.
+func startSelftestServer(files []syntheticFile) (*http.Server, string, error) {
+	byName := make(map[string]syntheticFile, len(files))
+	for _, f := range files {
+		byName[f.name] = f
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, "", err
+	}
+	modTime := time.Now()
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, ok := byName[strings.TrimPrefix(r.URL.Path, "/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", f.name))
+		w.Header().Set("ETag", fmt.Sprintf("%q", fmt.Sprintf("%x-%d", f.seed, f.size)))
+		http.ServeContent(w, r, f.name, modTime, f.reader())
+	})}
+	go server.Serve(listener)
+	return server, "http://" + listener.Addr().String(), nil
+}
+
+// newSelftestDownloader returns a downloader set up like the one of download, talking to
+// the local server directly: no bandwidth limits, host rate limits, overrides or aria2.
+func newSelftestDownloader() *downloader.Downloader {
+	d := downloader.NewDownloader(&http.Client{Transport: &http.Transport{Proxy: nil}}, "")
+	d.SetTempDir(downloadTempDir())
+	d.SetSegments(viper.GetInt("downloadsegments"))
+	d.SetRetries(viper.GetInt("maxretries"), globalRetryDelay, globalRetryPolicy)
+	d.SetStallTimeout(time.Duration(viper.GetInt("stalltimeoutsec")) * time.Second)
+	d.SetHashAlgorithms(globalHashAlgorithms)
+	d.SetMismatchRetries(0) // A mismatch is what the test is looking for
+	d.SetPreallocate(viper.GetBool("preallocate"))
+	return d
+}
+
+// runSelftestSample re-hashes a random sample of the library's downloaded files and
+// reports whether all of them matched.
+func runSelftestSample(sample, concurrency int) bool {
+	if globalConfig.DatabasePath == "" || globalConfig.SavePath == "" {
+		log.Fatal("DatabasePath and SavePath must be set in the configuration.")
+	}
+	db, err := database.Open(globalConfig.DatabasePath)
+	if err != nil {
+		log.WithError(err).Fatalf("Failed to open database at %s", globalConfig.DatabasePath)
+	}
+	var candidates []verifyCandidate
+	err = db.Fold(func(key, value []byte) error {
+		if !strings.HasPrefix(string(key), "v_") {
+			return nil
+		}
+		var entry models.DatabaseEntry
+		if json.Unmarshal(value, &entry) == nil && entry.Status == models.StatusDownloaded && entry.File.Hashes.SHA256 != "" {
+			candidates = append(candidates, verifyCandidate{Key: string(key), Entry: entry})
+		}
+		return nil
+	})
+	db.Close()
+	if err != nil {
+		log.WithError(err).Fatal("Failed to read the database")
+	}
+	if len(candidates) == 0 {
+		log.Fatal("No downloaded files with a SHA256 in the database to sample.")
+	}
+	rand.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+	candidates = candidates[:min(sample, len(candidates))]
+
+	fmt.Printf("Self-test: re-hashing %d of the library's downloaded files, %d at a time\n", len(candidates), concurrency)
+	var read atomic.Int64
+	var failed atomic.Int32
+	start := time.Now()
+	parallelEach(len(candidates), concurrency, func(i int) {
+		entry := candidates[i].Entry
+		path := entryFilePath(globalConfig.SavePath, entry)
+		info, err := os.Stat(path)
+		if err == nil {
+			var sums map[string]string
+			if sums, err = helpers.HashFile(path, []string{helpers.HashSHA256}); err == nil && !strings.EqualFold(sums[helpers.HashSHA256], entry.File.Hashes.SHA256) {
+				err = fmt.Errorf("SHA256 %s, expected %s", sums[helpers.HashSHA256], entry.File.Hashes.SHA256)
+			}
+		}
+		if err != nil {
+			failed.Add(1)
+			log.WithError(err).Errorf("Self-test: %s (%s) failed", path, candidates[i].Key)
+			return
+		}
+		read.Add(info.Size())
+	})
+	took := time.Since(start)
+	fmt.Println()
+	fmt.Printf("Read:     %s in %v (%s/s)\n", helpers.BytesToSize(uint64(read.Load())), took.Round(time.Millisecond), selftestRate(read.Load(), took))
+	fmt.Printf("Verified: %d of %d files\n", len(candidates)-int(failed.Load()), len(candidates))
+	if failed.Load() > 0 {
+		fmt.Printf("FAILED: %d files are missing or don't match the database (see the log; 'db verify' can re-download them)\n", failed.Load())
+		return false
+	}
+	fmt.Println("PASSED")
+	return true
+}
+
+// parallelEach calls fn for 0..n-1, at most workers at a time.
+func parallelEach(n, workers int, fn func(i int)) {
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < min(workers, n); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+}
+
+// selftestRate formats bytes per second over d.
+func selftestRate(bytes int64, d time.Duration) string {
+	if d <= 0 {
+		return helpers.BytesToSize(0)
+	}
+	return helpers.BytesToSize(uint64(float64(bytes) / d.Seconds()))
+}
@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/selfupdate"
+)
+
+// Version is the release version of this build. It is set at build time via
+// -ldflags "-X github.com/dreamfast/go-civitai-downloader/cmd/civitai-downloader/cmd.Version=v1.2.3" (see Makefile).
+var Version = "dev"
+
+// defaultUpdateRepo is the GitHub repository releases are published to.
+const defaultUpdateRepo = "dreamfast/go-civitai-downloader"
+
+var selfUpdateCmd = &cobra.Command{
+	Use:   "self-update",
+	Short: "Update civitai-downloader to the latest GitHub release",
+	Long: `Checks the latest GitHub release and, if it is newer than the running version,
+downloads the binary for this platform, verifies it against the release's
+checksums.txt (SHA256) and replaces the running executable in place.
+
+checksums.txt is not signed: it guards against corrupted downloads, not against
+a release published by someone else. Updates are only as trustworthy as HTTPS
+and the GitHub repository they come from.
+
+Use --check-only to just report whether an update is available.`,
+	Run: runSelfUpdate,
+}
+
+func init() {
+	rootCmd.AddCommand(selfUpdateCmd)
+	rootCmd.Version = Version
+
+	selfUpdateCmd.Flags().Bool("check-only", false, "Only check for a newer release, don't install it")
+	selfUpdateCmd.Flags().Bool("force", false, "Install the latest release even if it isn't newer (e.g. from a dev build)")
+	selfUpdateCmd.Flags().String("repo", defaultUpdateRepo, "GitHub repository (owner/name) to fetch releases from")
+}
+
+func runSelfUpdate(cmd *cobra.Command, args []string) {
+	checkOnly, _ := cmd.Flags().GetBool("check-only")
+	force, _ := cmd.Flags().GetBool("force")
+	repo, _ := cmd.Flags().GetString("repo")
+
+	updater := &selfupdate.Updater{
+		Repo:       repo,
+		BinaryName: "civitai-downloader",
+		Client:     &http.Client{Timeout: 5 * time.Minute, Transport: globalHttpTransport},
+	}
+
+	release, err := updater.LatestRelease()
+	if err != nil {
+		log.Fatalf("Failed to check for updates: %v", err)
+	}
+
+	fmt.Printf("Current version: %s\n", Version)
+	fmt.Printf("Latest release:  %s (%s)\n", release.TagName, release.HTMLURL)
+
+	if Version == "dev" {
+		fmt.Println("Running a development build, so the installed version can't be compared.")
+		if !force {
+			fmt.Println("Use --force to install the latest release over this build.")
+			return
+		}
+	} else if selfupdate.CompareVersions(Version, release.TagName) >= 0 && !force {
+		fmt.Println("Already up to date.")
+		return
+	}
+	if _, ok := selfupdate.FindAsset(release, updater.AssetName()); !ok {
+		log.Fatalf("Release %s has no binary for this platform (%s).", release.TagName, updater.AssetName())
+	}
+	if checkOnly {
+		fmt.Printf("Update available: %s -> %s (asset %s)\n", Version, release.TagName, updater.AssetName())
+		return
+	}
+
+	exePath, err := os.Executable()
+	if err != nil {
+		log.Fatalf("Cannot determine the running executable: %v", err)
+	}
+	if resolved, err := filepath.EvalSymlinks(exePath); err == nil {
+		exePath = resolved
+	}
+
+	log.Infof("Updating %s to %s...", exePath, release.TagName)
+	if err := updater.Apply(release, exePath); err != nil {
+		log.Fatalf("Self-update failed: %v", err)
+	}
+	fmt.Printf("Updated to %s.\n", release.TagName)
+}
@@ -0,0 +1,278 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/database"
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// archiveSummaryFile is the summary below SavePath every download run writes when it ends.
+// serve reads it rather than the database, which a running download holds.
+const archiveSummaryFile = "archive-summary.json"
+
+// archiveSummary is the state of the archive the serve badges show.
+type archiveSummary struct {
+	Models   int       `json:"models"`   // Models with at least one available file
+	Files    int       `json:"files"`    // Available files: active or removed upstream, not trashed or quarantined
+	Bytes    uint64    `json:"bytes"`    // As reported by the API for the available files
+	LastSync time.Time `json:"lastSync"` // When the last download run ended
+	// Availability counts the entries by the availability of their file (active, trashed, ...).
+	Availability map[string]int `json:"availability,omitempty"`
+	// FailedAt are the times of the failed attempts within the 24 hours before the summary
+	// was written (entries still failing), so the count stays right as they age out.
+	FailedAt []int64 `json:"failedAt,omitempty"`
+}
+
+// failuresSince counts the failures at or after t.
+func (s archiveSummary) failuresSince(t time.Time) int {
+	n := 0
+	for _, at := range s.FailedAt {
+		if at >= t.Unix() {
+			n++
+		}
+	}
+	return n
+}
+
+// summarizeArchive counts the downloaded models, files and bytes and the recent failures.
+func summarizeArchive(db *database.DB, now time.Time) (archiveSummary, error) {
+	summary := archiveSummary{Availability: make(map[string]int)}
+	modelIDs := make(map[int]bool)
+	cutoff := now.Add(-24 * time.Hour).Unix()
+	err := db.Fold(func(key []byte, value []byte) error {
+		if !strings.HasPrefix(string(key), "v_") {
+			return nil
+		}
+		var entry models.DatabaseEntry
+		if json.Unmarshal(value, &entry) != nil {
+			return nil
+		}
+		summary.Availability[entryAvailability(entry)]++
+		switch {
+		case entryAvailable(entry):
+			summary.Files++
+			summary.Bytes += uint64(entry.File.SizeKB * 1024)
+			modelIDs[entry.Version.ModelId] = true
+		case entry.ErrorDetails != "" && entry.FailedAt >= cutoff:
+			summary.FailedAt = append(summary.FailedAt, entry.FailedAt)
+		}
+		return nil
+	})
+	summary.Models = len(modelIDs)
+	return summary, err
+}
+
+// readArchiveSummary reads the summary the last download run wrote.
+func readArchiveSummary(savePath string) (archiveSummary, error) {
+	var summary archiveSummary
+	data, err := os.ReadFile(filepath.Join(savePath, archiveSummaryFile))
+	if err != nil {
+		return summary, err
+	}
+	err = json.Unmarshal(data, &summary)
+	return summary, err
+}
+
+// writeArchiveSummary records the state of the archive at the end of a download run.
+func writeArchiveSummary(db *database.DB, savePath string) {
+	now := time.Now()
+	summary, err := summarizeArchive(db, now)
+	if err != nil {
+		log.WithError(err).Warn("Failed to summarize the archive")
+		return
+	}
+	summary.LastSync = now
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return
+	}
+	path := filepath.Join(savePath, archiveSummaryFile)
+	if err := helpers.WriteFile(path, data, 0644); err != nil {
+		log.WithError(err).Warnf("Failed to write the archive summary %s", path)
+	}
+}
+
+// serveCmd serves the archive status as shields.io endpoint badges
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Serve archive status badges (shields.io endpoint JSON) over HTTP",
+	Long: `Serves small JSON documents in the shields.io endpoint badge format, to embed the
+state of the archive in a wiki or dashboard:
+
+  /badges/models.json       Models with at least one available file
+  /badges/size.json         Total size of the available files, in TB
+  /badges/last-sync.json    When the last download run ended
+  /badges/failures.json     Files whose download failed in the last 24 hours
+  /summary.json             All of the above as plain values, plus the number of entries
+                            by availability (active, removed_upstream, trashed,
+                            quarantined, not_downloaded)
+
+Available files are the downloaded ones that are still in the archive: trashed (pruned or
+moved away) and quarantined files are not counted.
+
+The numbers come from [SavePath]/archive-summary.json, which every download run writes
+when it ends, so serve never holds the database a download needs; it is read again at
+most every --refresh. Until a download has written it, the database is summarized once.`,
+	Example: `  civitai-downloader serve --listen :8787
+  # Badge: https://img.shields.io/endpoint?url=https://archive.example.com/badges/size.json`,
+	Args: cobra.NoArgs,
+	Run:  runServe,
+}
+
+func init() {
+	rootCmd.AddCommand(serveCmd)
+	serveCmd.Flags().String("listen", "127.0.0.1:8787", "Address to listen on")
+	serveCmd.Flags().Duration("refresh", 5*time.Minute, "How often the summary is read again")
+}
+
+// summaryCache keeps the last summary for the refresh interval.
+type summaryCache struct {
+	mu         sync.Mutex
+	refresh    time.Duration
+	summary    archiveSummary
+	read       time.Time
+	summarized bool // The database was summarized for want of a summary file
+}
+
+// get returns the current summary, reading it again once it is older than the refresh.
+func (c *summaryCache) get() archiveSummary {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.read.IsZero() && time.Since(c.read) < c.refresh {
+		return c.summary
+	}
+	c.read = time.Now()
+	summary, err := readArchiveSummary(globalConfig.SavePath)
+	switch {
+	case err == nil:
+		c.summary = summary
+	case os.IsNotExist(err) && !c.summarized:
+		// No download run has written one yet (last sync stays "never")
+		c.summarized = true
+		db, err := database.Open(globalConfig.DatabasePath)
+		if err != nil {
+			log.WithError(err).Warn("Failed to open the database to summarize the archive")
+			return c.summary
+		}
+		defer db.Close()
+		if c.summary, err = summarizeArchive(db, time.Now()); err != nil {
+			log.WithError(err).Warn("Failed to summarize the archive")
+		}
+	case !os.IsNotExist(err):
+		log.WithError(err).Warnf("Failed to read the archive summary")
+	}
+	return c.summary
+}
+
+// shieldsBadge is the shields.io endpoint badge schema.
+type shieldsBadge struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	Label         string `json:"label"`
+	Message       string `json:"message"`
+	Color         string `json:"color"`
+	CacheSeconds  int    `json:"cacheSeconds,omitempty"`
+}
+
+// summaryBadges renders each badge from a summary.
+var summaryBadges = map[string]func(s archiveSummary, now time.Time) shieldsBadge{
+	"models": func(s archiveSummary, _ time.Time) shieldsBadge {
+		return shieldsBadge{Label: "models", Message: fmt.Sprintf("%d", s.Models), Color: "blue"}
+	},
+	"size": func(s archiveSummary, _ time.Time) shieldsBadge {
+		return shieldsBadge{Label: "archive", Message: fmt.Sprintf("%.2f TB", float64(s.Bytes)/1e12), Color: "blue"}
+	},
+	"last-sync": func(s archiveSummary, now time.Time) shieldsBadge {
+		if s.LastSync.IsZero() {
+			return shieldsBadge{Label: "last sync", Message: "never", Color: "lightgrey"}
+		}
+		age := now.Sub(s.LastSync)
+		color := "brightgreen"
+		switch {
+		case age > 72*time.Hour:
+			color = "red"
+		case age > 24*time.Hour:
+			color = "yellow"
+		}
+		return shieldsBadge{Label: "last sync", Message: agoString(age), Color: color}
+	},
+	"failures": func(s archiveSummary, now time.Time) shieldsBadge {
+		failures := s.failuresSince(now.Add(-24 * time.Hour))
+		color := "brightgreen"
+		switch {
+		case failures >= 10:
+			color = "red"
+		case failures > 0:
+			color = "orange"
+		}
+		return shieldsBadge{Label: "failures (24h)", Message: fmt.Sprintf("%d", failures), Color: color}
+	},
+}
+
+// agoString renders an age the way a badge has room for: "just now", "5m ago", "3h ago", "2d ago".
+func agoString(age time.Duration) string {
+	switch {
+	case age < time.Minute:
+		return "just now"
+	case age < time.Hour:
+		return fmt.Sprintf("%dm ago", int(age.Minutes()))
+	case age < 48*time.Hour:
+		return fmt.Sprintf("%dh ago", int(age.Hours()))
+	}
+	return fmt.Sprintf("%dd ago", int(age.Hours()/24))
+}
+
+func runServe(cmd *cobra.Command, args []string) {
+	listen, _ := cmd.Flags().GetString("listen")
+	refresh, _ := cmd.Flags().GetDuration("refresh")
+	if globalConfig.DatabasePath == "" {
+		log.Fatal("Database path is not set in the configuration. Please check config file or path.")
+	}
+
+	cache := &summaryCache{refresh: refresh}
+	writeJSON := func(w http.ResponseWriter, v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(refresh.Seconds())))
+		json.NewEncoder(w).Encode(v)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/summary.json", func(w http.ResponseWriter, r *http.Request) {
+		s, now := cache.get(), time.Now()
+		writeJSON(w, map[string]interface{}{
+			"models":       s.Models,
+			"files":        s.Files,
+			"bytes":        s.Bytes,
+			"failures24h":  s.failuresSince(now.Add(-24 * time.Hour)),
+			"lastSync":     s.LastSync,
+			"availability": s.Availability,
+		})
+	})
+	mux.HandleFunc("/badges/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/badges/"), ".json")
+		render, ok := summaryBadges[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		badge := render(cache.get(), time.Now())
+		badge.SchemaVersion = 1
+		badge.CacheSeconds = max(300, int(refresh.Seconds())) // shields.io's minimum
+		writeJSON(w, badge)
+	})
+
+	log.Infof("Serving archive badges on http://%s/badges/ (models, size, last-sync, failures)", listen)
+	if err := http.ListenAndServe(listen, mux); err != nil {
+		log.Fatalf("Serve stopped: %v", err)
+	}
+}
@@ -0,0 +1,530 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/database"
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+)
+
+// Storage categories of the files below SavePath.
+const (
+	storageModels   = "models"
+	storagePreviews = "previews"
+	storageImages   = "images"
+	storageMetadata = "metadata"
+	storageTorrents = "torrents"
+	storageTemp     = "temp"
+	storageDatabase = "database"
+	storageOther    = "other"
+)
+
+// storageJPEGQuality is the quality PNG images are re-encoded at to estimate their
+// compression potential.
+const storageJPEGQuality = 90
+
+// storageCmd is the parent of the storage commands
+var storageCmd = &cobra.Command{
+	Use:   "storage",
+	Short: "Inspect how the archive uses disk space",
+}
+
+// storageReportCmd summarizes the space saved and the space that could still be saved
+var storageReportCmd = &cobra.Command{
+	Use:   "report",
+	Short: "Report dedupe savings, remaining duplicates and reclaimable space",
+	Long: `Scans SavePath and reports how much space is saved by hard links (DedupeImages,
+db adopt --mode hardlink) and symlinks (latest links, db adopt --mode symlink), how many
+bytes are still stored more than once, how much smaller the PNG previews and images would
+be as JPEG (estimated from a sample), and the largest categories of reclaimable space,
+each with the option or command that reclaims it.
+
+Files of the same size are hashed to find duplicates; model files use the SHA256
+recorded in the database instead. Nothing is changed.`,
+	Args: cobra.NoArgs,
+	Run:  runStorageReport,
+}
+
+func init() {
+	rootCmd.AddCommand(storageCmd)
+	storageCmd.AddCommand(storageReportCmd)
+	storageReportCmd.Flags().Int("top", 10, "Number of largest duplicate groups to list (0 for none)")
+	storageReportCmd.Flags().Int("sample", 20, "Number of PNG images to re-encode for the compression estimate (0 to skip it)")
+	storageReportCmd.Flags().Bool("json", false, "Print the report as JSON")
+}
+
+// storageUsage is the space used by the files of a category.
+type storageUsage struct {
+	Files int    `json:"files"`
+	Bytes uint64 `json:"bytes"`
+}
+
+// storageDuplicate is a set of files with identical contents stored separately.
+type storageDuplicate struct {
+	Category    string   `json:"category"`
+	Size        uint64   `json:"size"`
+	Reclaimable uint64   `json:"reclaimable"`
+	Paths       []string `json:"paths"`
+}
+
+// storageReclaimable is a category of space that can be reclaimed, and how.
+type storageReclaimable struct {
+	Name     string `json:"name"`
+	Bytes    uint64 `json:"bytes"`
+	Estimate bool   `json:"estimate,omitempty"`
+	Hint     string `json:"hint"`
+}
+
+// storageReport is the result of storage report (and its --json output).
+type storageReport struct {
+	SavePath       string                  `json:"savePath"`
+	Files          int                     `json:"files"`
+	ApparentBytes  uint64                  `json:"apparentBytes"` // Every path counted, as du --apparent-size -l would
+	StoredBytes    uint64                  `json:"storedBytes"`   // Each file's contents counted once
+	Categories     map[string]storageUsage `json:"categories"`    // By stored bytes
+	HardLinks      storageUsage            `json:"hardLinks"`     // Extra links to a file and the bytes they save
+	HardLinksBy    map[string]storageUsage `json:"hardLinksByCategory"`
+	Symlinks       storageUsage            `json:"symlinks"` // Links to files below SavePath and the bytes they save
+	DirSymlinks    int                     `json:"dirSymlinks"`
+	DuplicateBytes uint64                  `json:"duplicateBytes"`
+	DuplicatesBy   map[string]storageUsage `json:"duplicatesByCategory"`
+	Duplicates     []storageDuplicate      `json:"duplicates,omitempty"` // Largest first, up to --top
+	PNGImages      storageUsage            `json:"pngImages"`
+	PNGSampled     int                     `json:"pngSampled"`
+	PNGSavings     uint64                  `json:"pngSavingsEstimate"`
+	Untracked      storageUsage            `json:"untrackedModelFiles"`
+	Reclaimable    []storageReclaimable    `json:"reclaimable"`
+}
+
+// storageFile is a regular file found by the scan.
+type storageFile struct {
+	Path     string
+	Category string
+	Info     os.FileInfo
+}
+
+func runStorageReport(cmd *cobra.Command, args []string) {
+	top, _ := cmd.Flags().GetInt("top")
+	sample, _ := cmd.Flags().GetInt("sample")
+	asJSON, _ := cmd.Flags().GetBool("json")
+	savePath := globalConfig.SavePath
+	if savePath == "" {
+		log.Fatal("SavePath must be set in the configuration.")
+	}
+	savePath, _ = filepath.Abs(savePath)
+	if info, err := os.Stat(savePath); err != nil || !info.IsDir() {
+		log.Fatalf("SavePath %s is not an accessible directory", savePath)
+	}
+
+	// The database is optional: it only saves hashing model files and finds untracked ones
+	var dbHashes map[string]string
+	if globalConfig.DatabasePath != "" {
+		db, err := database.Open(globalConfig.DatabasePath)
+		if err != nil {
+			log.WithError(err).Warnf("Failed to open database at %s; hashing model files and not checking for untracked ones", globalConfig.DatabasePath)
+		} else {
+			dbHashes, err = storageDbHashes(db, savePath)
+			db.Close()
+			if err != nil {
+				log.WithError(err).Fatal("Failed to read the database")
+			}
+		}
+	}
+
+	log.Infof("Scanning %s...", savePath)
+	report := storageReport{
+		SavePath:     savePath,
+		Categories:   make(map[string]storageUsage),
+		HardLinksBy:  make(map[string]storageUsage),
+		DuplicatesBy: make(map[string]storageUsage),
+	}
+	files, err := scanStorage(&report, savePath)
+	if err != nil {
+		log.WithError(err).Fatalf("Failed to scan %s", savePath)
+	}
+	stored := countHardLinks(&report, files)
+	report.Duplicates = findStorageDuplicates(&report, stored, dbHashes)
+	if top >= 0 && len(report.Duplicates) > top {
+		report.Duplicates = report.Duplicates[:top]
+	}
+	estimatePNGSavings(&report, stored, sample)
+	if dbHashes != nil {
+		for _, f := range stored {
+			if _, ok := dbHashes[f.Path]; !ok && f.Category == storageModels {
+				report.Untracked.Files++
+				report.Untracked.Bytes += uint64(f.Info.Size())
+			}
+		}
+	}
+	report.Reclaimable = storageReclaimables(report)
+
+	if asJSON {
+		out, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(out))
+		return
+	}
+	printStorageReport(report)
+}
+
+// storageDbHashes maps the absolute path of each downloaded file to its recorded SHA256.
+func storageDbHashes(db *database.DB, savePath string) (map[string]string, error) {
+	hashes := make(map[string]string)
+	err := db.Fold(func(key []byte, value []byte) error {
+		if !strings.HasPrefix(string(key), "v_") {
+			return nil
+		}
+		var entry models.DatabaseEntry
+		if json.Unmarshal(value, &entry) != nil || entry.Status != models.StatusDownloaded {
+			return nil
+		}
+		path, _ := filepath.Abs(entryFilePath(savePath, entry))
+		hashes[path] = strings.ToLower(entry.File.Hashes.SHA256)
+		return nil
+	})
+	return hashes, err
+}
+
+// storageCategory returns the category of a file below SavePath.
+func storageCategory(path string) string {
+	name := strings.ToLower(filepath.Base(path))
+	ext := filepath.Ext(name)
+	if globalConfig.DatabasePath != "" {
+		if dbPath, err := filepath.Abs(globalConfig.DatabasePath); err == nil && isWithinDir(path, dbPath) {
+			return storageDatabase
+		}
+	}
+	switch {
+	case ext == ".tmp", ext == ".part", ext == ".moving", ext == ".linking", ext == ".adopting", ext == ".relinking":
+		return storageTemp
+	case ext == ".torrent", strings.HasSuffix(name, "-magnet.txt"):
+		return storageTorrents
+	case strings.Contains(name, ".preview."), strings.Contains(name, ".preview-source."):
+		return storagePreviews
+	case strings.Contains(filepath.ToSlash(path), "/images/"):
+		return storageImages
+	case adoptExtensions[ext]:
+		return storageModels
+	case ext == ".json", ext == ".jsonl", ext == ".txt", ext == ".md", ext == ".html", ext == ".dvc":
+		return storageMetadata
+	}
+	return storageOther
+}
+
+// scanStorage walks savePath, counting symlinks and returning the regular files.
+func scanStorage(report *storageReport, savePath string) ([]storageFile, error) {
+	var files []storageFile
+	err := filepath.WalkDir(savePath, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			log.WithError(err).Warnf("Skipping %s", path)
+			return nil
+		}
+		switch {
+		case d.Type()&os.ModeSymlink != 0:
+			target, err := os.Stat(path)
+			if err != nil {
+				return nil // Dangling
+			}
+			resolved, err := filepath.EvalSymlinks(path)
+			if err != nil || !isWithinDir(resolved, savePath) {
+				return nil
+			}
+			if target.IsDir() {
+				report.DirSymlinks++
+			} else if target.Mode().IsRegular() {
+				report.Symlinks.Files++
+				report.Symlinks.Bytes += uint64(target.Size())
+			}
+		case d.Type().IsRegular():
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			files = append(files, storageFile{Path: path, Category: storageCategory(path), Info: info})
+			report.Files++
+			report.ApparentBytes += uint64(info.Size())
+		}
+		return nil
+	})
+	return files, err
+}
+
+// bySize groups files by their size.
+func bySize(files []storageFile) map[int64][]storageFile {
+	sizes := make(map[int64][]storageFile)
+	for _, f := range files {
+		sizes[f.Info.Size()] = append(sizes[f.Info.Size()], f)
+	}
+	return sizes
+}
+
+// countHardLinks counts the extra links among files (paths of a file already seen) and
+// returns one path per stored file.
+func countHardLinks(report *storageReport, files []storageFile) []storageFile {
+	var stored []storageFile
+	for size, group := range bySize(files) {
+		var seen []storageFile
+		for _, f := range group {
+			linked := false
+			for _, s := range seen {
+				if os.SameFile(s.Info, f.Info) {
+					linked = true
+					break
+				}
+			}
+			if linked {
+				report.HardLinks.Files++
+				report.HardLinks.Bytes += uint64(size)
+				usage := report.HardLinksBy[f.Category]
+				usage.Files++
+				usage.Bytes += uint64(size)
+				report.HardLinksBy[f.Category] = usage
+				continue
+			}
+			seen = append(seen, f)
+			stored = append(stored, f)
+			report.StoredBytes += uint64(size)
+			usage := report.Categories[f.Category]
+			usage.Files++
+			usage.Bytes += uint64(size)
+			report.Categories[f.Category] = usage
+		}
+	}
+	sort.Slice(stored, func(i, j int) bool { return stored[i].Path < stored[j].Path })
+	return stored
+}
+
+// findStorageDuplicates finds stored files with identical contents and returns them
+// grouped, largest reclaimable group first.
+func findStorageDuplicates(report *storageReport, stored []storageFile, dbHashes map[string]string) []storageDuplicate {
+	var groups []storageDuplicate
+	for size, candidates := range bySize(stored) {
+		if size == 0 || len(candidates) < 2 {
+			continue
+		}
+		byHash := make(map[string][]storageFile)
+		for _, f := range candidates {
+			if f.Category == storageDatabase || f.Category == storageTemp {
+				continue
+			}
+			sum := dbHashes[f.Path]
+			if sum == "" {
+				var err error
+				if sum, err = helpers.FileSHA256(f.Path); err != nil {
+					log.WithError(err).Warnf("Failed to hash %s", f.Path)
+					continue
+				}
+			}
+			byHash[sum] = append(byHash[sum], f)
+		}
+		for _, same := range byHash {
+			if len(same) < 2 {
+				continue
+			}
+			group := storageDuplicate{Category: same[0].Category, Size: uint64(size), Reclaimable: uint64(size) * uint64(len(same)-1)}
+			for i, f := range same {
+				group.Paths = append(group.Paths, f.Path)
+				if i == 0 {
+					continue
+				}
+				usage := report.DuplicatesBy[f.Category]
+				usage.Files++
+				usage.Bytes += uint64(size)
+				report.DuplicatesBy[f.Category] = usage
+			}
+			report.DuplicateBytes += group.Reclaimable
+			groups = append(groups, group)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Reclaimable != groups[j].Reclaimable {
+			return groups[i].Reclaimable > groups[j].Reclaimable
+		}
+		return groups[i].Paths[0] < groups[j].Paths[0]
+	})
+	return groups
+}
+
+// estimatePNGSavings re-encodes a sample of the PNG previews and images as JPEG and
+// extrapolates the savings to all of them.
+func estimatePNGSavings(report *storageReport, stored []storageFile, sample int) {
+	var pngs []storageFile
+	for _, f := range stored {
+		if (f.Category == storagePreviews || f.Category == storageImages) && strings.EqualFold(filepath.Ext(f.Path), ".png") {
+			pngs = append(pngs, f)
+			report.PNGImages.Files++
+			report.PNGImages.Bytes += uint64(f.Info.Size())
+		}
+	}
+	if sample <= 0 || len(pngs) == 0 {
+		return
+	}
+	// Spread the sample evenly over the (path-sorted) files
+	step := float64(len(pngs)) / float64(sample)
+	if step < 1 {
+		step = 1
+	}
+	var before, after uint64
+	for i := 0.0; int(i) < len(pngs) && report.PNGSampled < sample; i += step {
+		f := pngs[int(i)]
+		size, err := jpegSize(f.Path)
+		if err != nil {
+			log.WithError(err).Debugf("Not sampling %s", f.Path)
+			continue
+		}
+		before += uint64(f.Info.Size())
+		after += size
+		report.PNGSampled++
+	}
+	if before > after {
+		report.PNGSavings = uint64(float64(report.PNGImages.Bytes) * float64(before-after) / float64(before))
+	}
+}
+
+// jpegSize returns the size of a PNG image re-encoded as JPEG.
+func jpegSize(path string) (uint64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	counter := &helpers.CounterWriter{Writer: io.Discard}
+	if err := jpeg.Encode(counter, flattenImage(img), &jpeg.Options{Quality: storageJPEGQuality}); err != nil {
+		return 0, err
+	}
+	return counter.Total, nil
+}
+
+// flattenImage returns img as an opaque RGBA image, as JPEG stores it.
+func flattenImage(img image.Image) image.Image {
+	bounds := img.Bounds()
+	flat := image.NewRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			i := flat.PixOffset(x, y)
+			flat.Pix[i], flat.Pix[i+1], flat.Pix[i+2], flat.Pix[i+3] = uint8(r>>8), uint8(g>>8), uint8(b>>8), 0xff
+		}
+	}
+	return flat
+}
+
+// storageReclaimables lists the categories of reclaimable space, largest first.
+func storageReclaimables(report storageReport) []storageReclaimable {
+	imageDuplicates := report.DuplicatesBy[storageImages].Bytes + report.DuplicatesBy[storagePreviews].Bytes
+	imageHint := "enable DedupeImages (--dedupe-images) to store identical images as hard links"
+	if viper.GetBool("dedupeimages") {
+		imageHint = "DedupeImages links copies as images are saved; these predate it or were saved where links aren't possible"
+	}
+	var otherDuplicates uint64
+	for category, usage := range report.DuplicatesBy {
+		switch category {
+		case storageImages, storagePreviews, storageModels:
+		default:
+			otherDuplicates += usage.Bytes
+		}
+	}
+	all := []storageReclaimable{
+		{Name: "Duplicate model files", Bytes: report.DuplicatesBy[storageModels].Bytes, Hint: "the same file is stored at several paths; keep one and hard-link the others"},
+		{Name: "Duplicate images and previews", Bytes: imageDuplicates, Hint: imageHint},
+		{Name: "Other duplicate files", Bytes: otherDuplicates, Hint: "identical sidecars or other files; hard-link or remove the copies"},
+		{Name: "PNG previews and images as JPEG", Bytes: report.PNGSavings, Estimate: true, Hint: fmt.Sprintf("re-encoding at quality %d (estimated from %d samples; transparency is lost)", storageJPEGQuality, report.PNGSampled)},
+		{Name: "Temporary files", Bytes: report.Categories[storageTemp].Bytes, Hint: "left over from interrupted runs; remove them with 'clean'"},
+		{Name: "Torrent and magnet files", Bytes: report.Categories[storageTorrents].Bytes, Hint: "can be generated again; remove them with 'clean --torrents --magnets'"},
+		{Name: "Untracked model files", Bytes: report.Untracked.Bytes, Hint: "not in the database; record them with 'db adopt' or remove them"},
+	}
+	var reclaimable []storageReclaimable
+	for _, r := range all {
+		if r.Bytes > 0 {
+			reclaimable = append(reclaimable, r)
+		}
+	}
+	sort.SliceStable(reclaimable, func(i, j int) bool { return reclaimable[i].Bytes > reclaimable[j].Bytes })
+	return reclaimable
+}
+
+// storageCategoryOrder is the order categories are printed in.
+var storageCategoryOrder = []string{storageModels, storagePreviews, storageImages, storageMetadata, storageTorrents, storageTemp, storageDatabase, storageOther}
+
+// percentOf formats part as a percentage of whole.
+func percentOf(part, whole uint64) string {
+	if whole == 0 {
+		return "0%"
+	}
+	return fmt.Sprintf("%.1f%%", float64(part)*100/float64(whole))
+}
+
+// printStorageReport prints the human-readable report.
+func printStorageReport(r storageReport) {
+	size := helpers.BytesToSize
+	fmt.Printf("Storage report for %s\n\n", r.SavePath)
+	fmt.Printf("Files:         %d (%s, %s stored)\n", r.Files, size(r.ApparentBytes), size(r.StoredBytes))
+	for _, category := range storageCategoryOrder {
+		if usage, ok := r.Categories[category]; ok {
+			fmt.Printf("  %-11s %8d files  %10s  %6s\n", category, usage.Files, size(usage.Bytes), percentOf(usage.Bytes, r.StoredBytes))
+		}
+	}
+
+	saved := r.HardLinks.Bytes + r.Symlinks.Bytes
+	fmt.Printf("\nSaved:         %s (%s of what the archive would take without links)\n", size(saved), percentOf(saved, r.StoredBytes+saved))
+	fmt.Printf("  hard links  %8d files  %10s\n", r.HardLinks.Files, size(r.HardLinks.Bytes))
+	for _, category := range storageCategoryOrder {
+		if usage, ok := r.HardLinksBy[category]; ok {
+			fmt.Printf("    %-9s %8d files  %10s\n", category, usage.Files, size(usage.Bytes))
+		}
+	}
+	fmt.Printf("  symlinks    %8d files  %10s (and %d directory links)\n", r.Symlinks.Files, size(r.Symlinks.Bytes), r.DirSymlinks)
+
+	fmt.Printf("\nDuplicates:    %s stored more than once\n", size(r.DuplicateBytes))
+	for _, category := range storageCategoryOrder {
+		if usage, ok := r.DuplicatesBy[category]; ok {
+			fmt.Printf("  %-11s %8d copies %10s\n", category, usage.Files, size(usage.Bytes))
+		}
+	}
+	for _, d := range r.Duplicates {
+		fmt.Printf("  %s x%d (%s reclaimable):\n", size(d.Size), len(d.Paths), size(d.Reclaimable))
+		for _, p := range d.Paths {
+			if rel, err := filepath.Rel(r.SavePath, p); err == nil {
+				p = rel
+			}
+			fmt.Printf("    %s\n", p)
+		}
+	}
+
+	if r.PNGImages.Files > 0 {
+		fmt.Printf("\nPNG images:    %d (%s)", r.PNGImages.Files, size(r.PNGImages.Bytes))
+		if r.PNGSampled > 0 {
+			fmt.Printf(", about %s smaller as JPEG (quality %d, %d sampled)", size(r.PNGSavings), storageJPEGQuality, r.PNGSampled)
+		}
+		fmt.Println()
+	}
+
+	fmt.Println("\nReclaimable, largest first:")
+	if len(r.Reclaimable) == 0 {
+		fmt.Println("  nothing")
+	}
+	for _, rc := range r.Reclaimable {
+		amount := size(rc.Bytes)
+		if rc.Estimate {
+			amount = "~" + amount
+		}
+		fmt.Printf("  %-32s %11s  %s\n", rc.Name, amount, rc.Hint)
+	}
+}
@@ -0,0 +1,392 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/api"
+	"github.com/dreamfast/go-civitai-downloader/internal/database"
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+)
+
+// successorsCmd looks for newer-ecosystem successors of the models of an older one
+var successorsCmd = &cobra.Command{
+	Use:   "successors",
+	Short: "Suggest SDXL/Flux successors of downloaded SD 1.5 models by the same creator",
+	Long: `Helps migrate a library to a newer ecosystem. For every downloaded model whose
+versions are all for an older base model (--from, SD 1.x by default), lists the models
+of its creator on Civitai that have a version for a newer one (--to: SDXL, Pony,
+Illustrious, NoobAI and Flux by default), of the same type and with a similar name.
+
+Names are compared without base model and version words ("XL", "SD1.5", "v2", ...), so
+"Detail Tweaker" finds "Detail Tweaker XL". A newer version of the model itself always
+counts. Suggestions below --min-similarity are left out; the best --max per model are
+listed with links, and marked when they are already downloaded.
+
+With --queue, the best suggestion of each model that isn't downloaded yet is cataloged
+as with 'download --metadata-only' (sidecar, database entry), so 'fetch <model-id>'
+downloads it later.`,
+	Example: `  civitai-downloader successors
+  civitai-downloader successors --to Flux --min-similarity 0.7
+  civitai-downloader successors --queue --yes`,
+	Args: cobra.NoArgs,
+	Run:  runSuccessors,
+}
+
+func init() {
+	rootCmd.AddCommand(successorsCmd)
+	successorsCmd.Flags().StringSlice("from", []string{"SD 1"}, "Base models (prefixes) of the models to find successors for")
+	successorsCmd.Flags().StringSlice("to", []string{"SDXL", "Pony", "Illustrious", "NoobAI", "Flux"}, "Base models (prefixes) successors are for")
+	successorsCmd.Flags().Float64("min-similarity", 0.6, "Least name similarity (0-1) of a suggestion")
+	successorsCmd.Flags().Int("max", 3, "Suggestions listed per model")
+	successorsCmd.Flags().Bool("queue", false, "Catalog the best suggestion of each model for 'fetch'")
+	successorsCmd.Flags().BoolP("yes", "y", false, "Skip the confirmation prompt of --queue")
+	successorsCmd.Flags().Bool("json", false, "Print the report as JSON")
+}
+
+// successorModel is a downloaded model of an older ecosystem.
+type successorModel struct {
+	ID          int                  `json:"modelId"`
+	Name        string               `json:"name"`
+	Type        string               `json:"type"`
+	Creator     string               `json:"creator"`
+	BaseModels  []string             `json:"baseModels"`
+	Suggestions []successorCandidate `json:"suggestions"`
+}
+
+// successorCandidate is a model suggested as the successor of a successorModel.
+type successorCandidate struct {
+	ModelID    int     `json:"modelId"`
+	VersionID  int     `json:"versionId"` // Newest version for a --to base model
+	Name       string  `json:"name"`
+	Version    string  `json:"version"`
+	BaseModel  string  `json:"baseModel"`
+	Similarity float64 `json:"similarity"`
+	URL        string  `json:"url"`
+	Downloaded bool    `json:"downloaded,omitempty"`
+}
+
+func runSuccessors(cmd *cobra.Command, args []string) {
+	from, _ := cmd.Flags().GetStringSlice("from")
+	to, _ := cmd.Flags().GetStringSlice("to")
+	minSimilarity, _ := cmd.Flags().GetFloat64("min-similarity")
+	maxSuggestions, _ := cmd.Flags().GetInt("max")
+	queue, _ := cmd.Flags().GetBool("queue")
+	skipConfirm, _ := cmd.Flags().GetBool("yes")
+	asJSON, _ := cmd.Flags().GetBool("json")
+
+	if len(from) == 0 || len(to) == 0 {
+		log.Fatal("--from and --to need at least one base model each")
+	}
+	if globalConfig.DatabasePath == "" || globalConfig.SavePath == "" {
+		log.Fatal("DatabasePath and SavePath must be set in the configuration.")
+	}
+	db, err := database.Open(globalConfig.DatabasePath)
+	if err != nil {
+		log.WithError(err).Fatalf("Failed to open database at %s", globalConfig.DatabasePath)
+	}
+	defer db.Close()
+	loadPathOverrides(db)
+
+	legacy, downloaded, err := collectLegacyModels(db, from)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to read the database")
+	}
+	if len(legacy) == 0 {
+		fmt.Printf("No downloaded models are only for %s.\n", strings.Join(from, ", "))
+		return
+	}
+
+	byCreator := make(map[string][]*successorModel)
+	var creators []string
+	for _, m := range legacy {
+		if m.Creator == "" {
+			continue // Nobody to ask about
+		}
+		if byCreator[m.Creator] == nil {
+			creators = append(creators, m.Creator)
+		}
+		byCreator[m.Creator] = append(byCreator[m.Creator], m)
+	}
+	sort.Slice(creators, func(i, j int) bool { return helpers.CollateLess(creators[i], creators[j]) })
+
+	httpClient := &http.Client{Timeout: time.Duration(globalConfig.ApiClientTimeoutSec) * time.Second, Transport: globalHttpTransport}
+	client := api.NewClient(globalConfig.ApiKey, httpClient, globalConfig)
+	delay := time.Duration(viper.GetInt("apidelayms")) * time.Millisecond
+	log.Infof("Looking for successors of %d model(s) by %d creator(s)...", len(legacy), len(creators))
+	for i, creator := range creators {
+		if i > 0 && delay > 0 {
+			time.Sleep(delay)
+		}
+		published, err := creatorModels(client, creator, delay)
+		if err != nil {
+			log.WithError(err).Warnf("Failed to list the models of %s; skipping them", creator)
+			continue
+		}
+		for _, m := range byCreator[creator] {
+			m.Suggestions = suggestSuccessors(m, published, to, minSimilarity, downloaded)
+			if maxSuggestions >= 0 && len(m.Suggestions) > maxSuggestions {
+				m.Suggestions = m.Suggestions[:maxSuggestions]
+			}
+		}
+	}
+
+	if asJSON {
+		out, _ := json.MarshalIndent(legacy, "", "  ")
+		fmt.Println(string(out))
+	} else {
+		printSuccessors(legacy)
+	}
+	if queue {
+		queueSuccessors(legacy, db, httpClient, skipConfirm)
+	}
+}
+
+// collectLegacyModels returns the downloaded models whose every downloaded version is for
+// a base model of from, sorted by name, and the IDs of all downloaded versions.
+func collectLegacyModels(db *database.DB, from []string) ([]*successorModel, map[int]bool, error) {
+	byID := make(map[int]*successorModel)
+	newer := make(map[int]bool) // Models with a downloaded version for another base model
+	downloaded := make(map[int]bool)
+	err := db.Fold(func(key []byte, value []byte) error {
+		if !strings.HasPrefix(string(key), "v_") {
+			return nil
+		}
+		var entry models.DatabaseEntry
+		if json.Unmarshal(value, &entry) != nil || entry.Status != models.StatusDownloaded {
+			return nil
+		}
+		downloaded[entry.Version.ID] = true
+		if !baseModelIn(entry.Version.BaseModel, from) {
+			newer[entry.Version.ModelId] = true
+			return nil
+		}
+		m := byID[entry.Version.ModelId]
+		if m == nil {
+			m = &successorModel{ID: entry.Version.ModelId, Name: entry.ModelName, Type: entry.ModelType, Creator: entry.Creator.Username}
+			byID[m.ID] = m
+		}
+		if !containsFold(m.BaseModels, entry.Version.BaseModel) {
+			m.BaseModels = append(m.BaseModels, entry.Version.BaseModel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var legacy []*successorModel
+	for id, m := range byID {
+		if !newer[id] {
+			legacy = append(legacy, m)
+		}
+	}
+	sort.Slice(legacy, func(i, j int) bool {
+		if legacy[i].Name != legacy[j].Name {
+			return helpers.CollateLess(legacy[i].Name, legacy[j].Name)
+		}
+		return legacy[i].ID < legacy[j].ID
+	})
+	return legacy, downloaded, nil
+}
+
+// creatorModels lists every model of a creator on Civitai.
+func creatorModels(client *api.Client, username string, delay time.Duration) ([]models.Model, error) {
+	params := models.QueryParameters{
+		Username: username,
+		Limit:    100,
+		Sort:     "Newest",
+		Period:   "AllTime",
+		Nsfw:     globalConfig.Nsfw,
+	}
+	var all []models.Model
+	cursor := ""
+	for {
+		next, resp, err := client.GetModels(cursor, params)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, resp.Items...)
+		if next == "" || next == cursor {
+			return all, nil
+		}
+		cursor = next
+		if delay > 0 {
+			time.Sleep(delay)
+		}
+	}
+}
+
+// suggestSuccessors returns the models of published of m's type with a version for a base
+// model of to, whose name is at least minSimilarity like m's, most similar first.
+func suggestSuccessors(m *successorModel, published []models.Model, to []string, minSimilarity float64, downloaded map[int]bool) []successorCandidate {
+	var suggestions []successorCandidate
+	for _, p := range published {
+		if !strings.EqualFold(p.Type, m.Type) {
+			continue
+		}
+		var newest *models.ModelVersion
+		for i, v := range p.ModelVersions {
+			if baseModelIn(v.BaseModel, to) && (newest == nil || v.ID > newest.ID) {
+				newest = &p.ModelVersions[i]
+			}
+		}
+		if newest == nil {
+			continue
+		}
+		similarity := 1.0 // A newer version of the model itself
+		if p.ID != m.ID {
+			similarity = nameSimilarity(m.Name, p.Name)
+		}
+		if similarity < minSimilarity {
+			continue
+		}
+		suggestions = append(suggestions, successorCandidate{
+			ModelID:    p.ID,
+			VersionID:  newest.ID,
+			Name:       p.Name,
+			Version:    newest.Name,
+			BaseModel:  newest.BaseModel,
+			Similarity: similarity,
+			URL:        fmt.Sprintf("https://civitai.com/models/%d?modelVersionId=%d", p.ID, newest.ID),
+			Downloaded: downloaded[newest.ID],
+		})
+	}
+	sort.Slice(suggestions, func(i, j int) bool {
+		if suggestions[i].Similarity != suggestions[j].Similarity {
+			return suggestions[i].Similarity > suggestions[j].Similarity
+		}
+		return suggestions[i].ModelID < suggestions[j].ModelID
+	})
+	return suggestions
+}
+
+// baseModelIn reports whether a base model starts with one of prefixes (ignoring case).
+func baseModelIn(baseModel string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if p = strings.TrimSpace(p); p != "" && strings.HasPrefix(strings.ToLower(baseModel), strings.ToLower(p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// successorNoise are name words that say which base model or version a model is for.
+var successorNoise = regexp.MustCompile(`^(sd|sd1|sd15|sd2|sd21|sdxl|xl|sdxl10|flux|flux1|fluxd|dev|schnell|pony|ponyxl|illustrious|il|noob|noobai|lora|lycoris|locon|checkpoint|model|v\d+|\d+)$`)
+
+// nameWords splits a model name into lowercase words, dropping successorNoise.
+func nameWords(name string) string {
+	var words []string
+	for _, w := range strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r >= 0x80)
+	}) {
+		if !successorNoise.MatchString(w) {
+			words = append(words, w)
+		}
+	}
+	return strings.Join(words, "")
+}
+
+// nameSimilarity compares two model names as the Dice coefficient of the letter pairs of
+// their words (see nameWords): 1 for the same words, 0 for nothing in common.
+func nameSimilarity(a, b string) float64 {
+	pairs := func(s string) map[string]int {
+		runes := []rune(s)
+		counts := make(map[string]int)
+		for i := 0; i+1 < len(runes); i++ {
+			counts[string(runes[i:i+2])]++
+		}
+		return counts
+	}
+	wa, wb := nameWords(a), nameWords(b)
+	if wa == "" || wb == "" {
+		return 0
+	}
+	if wa == wb {
+		return 1
+	}
+	pa, pb := pairs(wa), pairs(wb)
+	shared, total := 0, 0
+	for p, n := range pa {
+		shared += min(n, pb[p])
+		total += n
+	}
+	for _, n := range pb {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+	return 2 * float64(shared) / float64(total)
+}
+
+// printSuccessors prints the suggestions of each model that has any.
+func printSuccessors(legacy []*successorModel) {
+	found := 0
+	for _, m := range legacy {
+		if len(m.Suggestions) == 0 {
+			continue
+		}
+		found++
+		fmt.Printf("%s (%d, %s, %s) by %s\n", m.Name, m.ID, m.Type, strings.Join(m.BaseModels, ", "), m.Creator)
+		for _, s := range m.Suggestions {
+			mark := ""
+			if s.Downloaded {
+				mark = " [downloaded]"
+			}
+			fmt.Printf("  %3.0f%%  %s - %s (%s)%s\n        %s\n", s.Similarity*100, s.Name, s.Version, s.BaseModel, mark, s.URL)
+		}
+	}
+	fmt.Printf("%d of %d model(s) have a suggested successor.\n", found, len(legacy))
+}
+
+// queueSuccessors catalogs the best suggestion of each model that isn't downloaded, for
+// fetch to download.
+func queueSuccessors(legacy []*successorModel, db *database.DB, client *http.Client, skipConfirm bool) {
+	var versionIDs []int
+	seen := make(map[int]bool)
+	for _, m := range legacy {
+		if len(m.Suggestions) == 0 || m.Suggestions[0].Downloaded || seen[m.Suggestions[0].VersionID] {
+			continue
+		}
+		seen[m.Suggestions[0].VersionID] = true
+		versionIDs = append(versionIDs, m.Suggestions[0].VersionID)
+	}
+	if len(versionIDs) == 0 {
+		fmt.Println("Nothing to queue.")
+		return
+	}
+	if !skipConfirm {
+		fmt.Printf("Catalog %d suggested version(s) for 'fetch'? (y/N) ", len(versionIDs))
+		reader := bufio.NewReader(os.Stdin)
+		input, _ := reader.ReadString('\n')
+		if strings.ToLower(strings.TrimSpace(input)) != "y" {
+			fmt.Println("Aborted.")
+			return
+		}
+	}
+
+	var queued []potentialDownload
+	for _, id := range versionIDs {
+		pds, _, err := handleSingleVersionDownload(id, db, client, &globalConfig, nil)
+		if err != nil {
+			log.WithError(err).Warnf("Failed to look up version %d; not queueing it", id)
+			continue
+		}
+		queued = append(queued, pds...)
+	}
+	handleMetadataOnlyMode(queued, db, nil, nil)
+	fmt.Printf("Queued %d file(s); download them with 'civitai-downloader fetch <model-id>'.\n", len(queued))
+}
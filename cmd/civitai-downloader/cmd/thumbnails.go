@@ -0,0 +1,180 @@
+package cmd
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// Thumbnail size in terminal cells, and the cell size in pixels that sixel thumbnails are
+// drawn for (kitty scales them to the cells itself; sixel terminals don't, so the captions
+// line up with the images only as far as the font is close to 10x20 pixels).
+const (
+	thumbnailCols   = 16
+	thumbnailRows   = 8
+	thumbnailGap    = 2
+	thumbnailCellPx = 10
+)
+
+// thumbnailsFlagUsage is the usage of the --thumbnails flag of the commands that list models.
+const thumbnailsFlagUsage = "Show preview thumbnails inline: auto (detect the terminal), kitty, sixel or off; a bare --thumbnails is auto (give one as --thumbnails=sixel)"
+
+// addThumbnailsFlag adds --thumbnails to a command's flag set.
+func addThumbnailsFlag(flags *pflag.FlagSet) {
+	flags.String("thumbnails", "off", thumbnailsFlagUsage)
+	flags.Lookup("thumbnails").NoOptDefVal = "auto"
+}
+
+// thumbnailProtocol returns the image protocol --thumbnails asks for, or "" for text output
+// (thumbnails off, an unknown terminal or output that isn't a terminal).
+func thumbnailProtocol(cmd *cobra.Command) string {
+	value, _ := cmd.Flags().GetString("thumbnails")
+	protocol, err := helpers.ParseTermGraphics(value)
+	if err != nil {
+		log.Fatalf("Invalid --thumbnails: %v", err)
+	}
+	switch {
+	case protocol == "" && strings.EqualFold(value, "auto"):
+		log.Info("This terminal doesn't look like it shows kitty or sixel images; listing as text (force one with --thumbnails=kitty or --thumbnails=sixel).")
+	case protocol != "" && !helpers.IsTerminal(os.Stdout):
+		log.Debug("Output is not a terminal; listing as text.")
+		return ""
+	}
+	return protocol
+}
+
+// previewImageFor returns the local image that best shows a model file: its
+// <model>.preview.png, or else the first version image saved next to it ("" if none).
+func previewImageFor(modelFile string) string {
+	stem := strings.TrimSuffix(modelFile, filepath.Ext(modelFile))
+	for _, suffix := range []string{".preview.png", ".preview.jpeg", ".preview.jpg", ".preview.gif"} {
+		if _, err := os.Stat(stem + suffix); err == nil {
+			return stem + suffix
+		}
+	}
+	images, _ := filepath.Glob(filepath.Join(filepath.Dir(modelFile), "images", "*"))
+	sort.Strings(images)
+	for _, path := range images {
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".png", ".jpg", ".jpeg", ".gif":
+			return path
+		}
+	}
+	return ""
+}
+
+// loadThumbnailSource decodes an image for a thumbnail, or returns nil (an empty tile).
+func loadThumbnailSource(path string) image.Image {
+	if path == "" {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f) // Decoders registered by cmd_download_preview.go
+	if err != nil {
+		log.WithError(err).Debugf("Cannot show %s as a thumbnail", path)
+		return nil
+	}
+	return img
+}
+
+// thumbnailCell is one tile of the grid: an image (or none) and a few caption lines.
+type thumbnailCell struct {
+	image   string
+	caption []string
+}
+
+// thumbnailGrid prints thumbnails in rows as wide as the terminal, with their captions below.
+// Each row is drawn as one image, which keeps the layout to plain line breaks.
+type thumbnailGrid struct {
+	protocol string
+	perRow   int
+	cells    []thumbnailCell
+}
+
+// newThumbnailGrid returns a grid for the protocol, as wide as $COLUMNS (or 80 columns).
+func newThumbnailGrid(protocol string) *thumbnailGrid {
+	columns, err := strconv.Atoi(os.Getenv("COLUMNS"))
+	if err != nil || columns <= 0 {
+		columns = 80
+	}
+	return &thumbnailGrid{protocol: protocol, perRow: max(1, columns/(thumbnailCols+thumbnailGap))}
+}
+
+// add queues a tile, printing the row once it is full.
+func (g *thumbnailGrid) add(imagePath string, caption ...string) {
+	g.cells = append(g.cells, thumbnailCell{image: imagePath, caption: caption})
+	if len(g.cells) == g.perRow {
+		g.flush()
+	}
+}
+
+// flush prints the queued tiles as a row.
+func (g *thumbnailGrid) flush() {
+	if len(g.cells) == 0 {
+		return
+	}
+	cells := g.cells
+	g.cells = nil
+
+	tileW, tileH := thumbnailCols*thumbnailCellPx, thumbnailRows*2*thumbnailCellPx // Cells are twice as high as wide
+	stepW := (thumbnailCols + thumbnailGap) * thumbnailCellPx
+	var bg color.Color = color.Transparent
+	if g.protocol == helpers.TermGraphicsSixel {
+		bg = color.Black // No transparency in the sixels written
+	}
+	row := helpers.FitImage(nil, stepW*len(cells)-thumbnailGap*thumbnailCellPx, tileH, bg)
+	tileBg := color.RGBA{0x30, 0x30, 0x30, 0xff} // Shows where a tile without an image is
+	for i, cell := range cells {
+		tile := helpers.FitImage(loadThumbnailSource(cell.image), tileW, tileH, tileBg)
+		for y := 0; y < tileH; y++ {
+			for x := 0; x < tileW; x++ {
+				row.Set(i*stepW+x, y, tile.At(x, y))
+			}
+		}
+	}
+	cols := len(cells)*(thumbnailCols+thumbnailGap) - thumbnailGap
+	if err := helpers.WriteTermImage(os.Stdout, g.protocol, row, cols, thumbnailRows); err != nil {
+		log.WithError(err).Warn("Failed to write thumbnails")
+	}
+
+	lines := 0
+	for _, cell := range cells {
+		lines = max(lines, len(cell.caption))
+	}
+	for line := 0; line < lines; line++ {
+		var b strings.Builder
+		for _, cell := range cells {
+			text := ""
+			if line < len(cell.caption) {
+				text = cell.caption[line]
+			}
+			b.WriteString(fitCaption(text, thumbnailCols+thumbnailGap))
+		}
+		fmt.Println(strings.TrimRight(b.String(), " "))
+	}
+	fmt.Println()
+}
+
+// fitCaption pads or cuts text to exactly width runes, leaving a space before the next tile.
+func fitCaption(text string, width int) string {
+	runes := []rune(text)
+	if len(runes) > width-thumbnailGap {
+		runes = append(runes[:width-thumbnailGap-1], '…')
+	}
+	return string(runes) + strings.Repeat(" ", width-len(runes))
+}
@@ -20,15 +20,18 @@ import (
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
-	index "go-civitai-download/index"
-	"go-civitai-download/internal/database"
-	"go-civitai-download/internal/models"
+	index "github.com/dreamfast/go-civitai-downloader/index"
+	"github.com/dreamfast/go-civitai-downloader/internal/database"
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
 )
 
 // Struct to hold job parameters for torrent workers
 type torrentJob struct {
 	SourcePath     string
 	Trackers       []string
+	WebSeeds       []string // BEP 19 web seeds (url-list), already pointing at SourcePath's parent
+	PieceLength    int64    // 0 chooses one for the size of SourcePath
 	OutputDir      string
 	Overwrite      bool
 	GenerateMagnet bool
@@ -116,10 +119,10 @@ func torrentWorker(id int, jobs <-chan torrentJob, wg *sync.WaitGroup, successCo
 	defer wg.Done()
 	log.Debugf("Torrent Worker %d starting", id)
 	for job := range jobs {
-		log.WithFields(job.LogFields).Infof("Worker %d: Processing torrent job for model directory %s", id, job.SourcePath)
+		log.WithFields(job.LogFields).Infof("Worker %d: Processing torrent job for %s", id, job.SourcePath)
 		// Generate torrent for the entire model directory
 		// Capture magnetPath (_), as we don't need it for indexing anymore, but need the magnetURI
-		torrentPath, _, magnetURI, err := generateTorrentFile(job.SourcePath, job.Trackers, job.OutputDir, job.Overwrite, job.GenerateMagnet)
+		torrentPath, _, magnetURI, err := generateTorrentFile(job.SourcePath, job.Trackers, job.WebSeeds, job.PieceLength, job.OutputDir, job.Overwrite, job.GenerateMagnet)
 		if err != nil {
 			log.WithFields(job.LogFields).WithError(err).Errorf("Worker %d: Failed to generate torrent for %s", id, job.SourcePath)
 			failureCounter.Add(1)
@@ -134,7 +137,7 @@ func torrentWorker(id int, jobs <-chan torrentJob, wg *sync.WaitGroup, successCo
 			// Pass the actual magnetURI string
 			if err := updateModelTorrentIndex(job, torrentPath, magnetURI); err != nil {
 				// Log the error from the helper, but don't count as torrent generation failure
-				log.WithFields(job.LogFields).WithError(err).Error("Worker %d: Index update failed after successful torrent generation.", id)
+				log.WithFields(job.LogFields).WithError(err).Errorf("Worker %d: Index update failed after successful torrent generation.", id)
 			}
 		}
 	} // end for job := range jobs
@@ -144,6 +147,8 @@ func torrentWorker(id int, jobs <-chan torrentJob, wg *sync.WaitGroup, successCo
 var (
 	torrentModelIDs     []int
 	announceURLs        []string
+	webSeedURLs         []string
+	torrentPaths        []string
 	torrentOutputDir    string
 	overwriteTorrents   bool
 	generateMagnetLinks bool
@@ -154,12 +159,27 @@ var torrentCmd = &cobra.Command{
 	Short: "Generate .torrent files for downloaded models (one per model directory)",
 	Long: `Generates a single BitTorrent metainfo (.torrent) file for each downloaded model's main directory,
 encompassing all its downloaded versions and files. Requires access to the download history database
-and the downloaded files themselves. You must specify tracker announce URLs.`,
+and the downloaded files themselves. You must specify tracker announce URLs, web seeds or both.
+
+--path exports any files or directories instead, e.g. a whole type directory or the archive,
+one torrent each. --web-seed adds the URL the save path is served at over HTTP as a web seed,
+so peers can fetch pieces from that mirror when no one seeds them.`,
+	Example: `  civitai-downloader torrent --announce udp://tracker.opentrackr.org:1337/announce
+  civitai-downloader torrent --path /data/civitai/lora --web-seed https://mirror.example/civitai/ -o ./torrents`,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		if len(announceURLs) == 0 {
-			return errors.New("at least one --announce URL is required")
+		if len(announceURLs) == 0 && len(webSeedURLs) == 0 {
+			return errors.New("at least one --announce or --web-seed URL is required")
+		}
+		if len(torrentPaths) > 0 && len(torrentModelIDs) > 0 {
+			return errors.New("--path and --model-id can't be combined")
+		}
+		for _, seed := range webSeedURLs {
+			if u, err := url.Parse(seed); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("--web-seed %q: not an http(s) URL", seed)
+			}
 		}
 
+		_ = viper.BindPFlag("concurrency", cmd.Flags().Lookup("concurrency"))
 		concurrency := viper.GetInt("concurrency") // Use viper
 		if concurrency <= 0 {
 			log.Warnf("Invalid concurrency value %d, defaulting to 4", concurrency)
@@ -167,6 +187,9 @@ and the downloaded files themselves. You must specify tracker announce URLs.`,
 		}
 
 		savePath := viper.GetString("savepath") // Use viper
+		if len(torrentPaths) > 0 {
+			return runTorrentJobs(pathTorrentJobs(torrentPaths, savePath), concurrency)
+		}
 		if savePath == "" {
 			log.Error("Save path is not configured (--save-path or config file)")
 			return errors.New("save path is not configured (--save-path or config file)")
@@ -224,6 +247,11 @@ and the downloaded files themselves. You must specify tracker announce URLs.`,
 				log.WithError(err).Warnf("Failed to unmarshal JSON for key %s, skipping", keyStr)
 				return nil
 			}
+			// Soft-deleted files are not shared
+			if availability := entryAvailability(entry); availability == availabilityTrashed || availability == availabilityQuarantined {
+				log.Debugf("Skipping %s: %s", keyStr, availability)
+				return nil
+			}
 
 			// Filter by specific model IDs if provided
 			if len(torrentModelIDs) > 0 {
@@ -280,6 +308,8 @@ and the downloaded files themselves. You must specify tracker announce URLs.`,
 				job := torrentJob{
 					SourcePath:     modelDir, // Target the model directory
 					Trackers:       announceURLs,
+					WebSeeds:       webSeedsFor(webSeedURLs, savePath, modelDir),
+					PieceLength:    modelTorrentPieceLength,
 					OutputDir:      torrentOutputDir, // If empty, torrent goes *inside* modelDir
 					Overwrite:      overwriteTorrents,
 					GenerateMagnet: generateMagnetLinks,
@@ -313,51 +343,117 @@ and the downloaded files themselves. You must specify tracker announce URLs.`,
 			return nil
 		}
 
-		log.Infof("Generating torrents for %d unique model directories using %d workers...", len(modelDirsToProcess), concurrency)
+		jobs := make([]torrentJob, 0, len(modelDirsToProcess))
+		for _, job := range modelDirsToProcess {
+			jobs = append(jobs, job)
+		}
+		return runTorrentJobs(jobs, concurrency)
+	},
+}
 
-		// --- Worker Pool Setup ---
-		jobs := make(chan torrentJob, concurrency) // Buffered channel
-		var wg sync.WaitGroup
-		var successCounter atomic.Int64
-		var failureCounter atomic.Int64
+// runTorrentJobs generates the torrents of jobs with concurrency workers.
+func runTorrentJobs(jobList []torrentJob, concurrency int) error {
+	log.Infof("Generating torrents for %d unique directories using %d workers...", len(jobList), concurrency)
 
-		// Start workers
-		for i := 1; i <= concurrency; i++ {
-			wg.Add(1)
-			go torrentWorker(i, jobs, &wg, &successCounter, &failureCounter)
-		}
+	// --- Worker Pool Setup ---
+	jobs := make(chan torrentJob, concurrency) // Buffered channel
+	var wg sync.WaitGroup
+	var successCounter atomic.Int64
+	var failureCounter atomic.Int64
 
-		// --- Queue Jobs ---
-		queuedJobs := 0
-		for _, job := range modelDirsToProcess {
-			jobs <- job
-			queuedJobs++
-		}
+	// Start workers
+	for i := 1; i <= concurrency; i++ {
+		wg.Add(1)
+		go torrentWorker(i, jobs, &wg, &successCounter, &failureCounter)
+	}
+
+	// --- Queue Jobs ---
+	queuedJobs := 0
+	for _, job := range jobList {
+		jobs <- job
+		queuedJobs++
+	}
+
+	close(jobs) // Signal no more jobs
+	log.Infof("Queued %d torrent jobs. Waiting for workers...", queuedJobs)
+
+	// --- Wait for Workers ---
+	wg.Wait()
 
-		close(jobs) // Signal no more jobs
-		log.Infof("Queued %d model directory jobs for torrent generation. Waiting for workers...", queuedJobs)
+	// --- Final Summary ---
+	successCount := successCounter.Load()
+	failCount := failureCounter.Load()
 
-		// --- Wait for Workers ---
-		wg.Wait()
+	log.Infof("Torrent generation complete. Success: %d, Failed: %d", successCount, failCount)
+	if failCount > 0 {
+		log.Errorf("%d torrents failed to generate", failCount)
+		return fmt.Errorf("%d torrents failed to generate", failCount)
+	}
+	return nil
+}
 
-		// --- Final Summary ---
-		successCount := successCounter.Load()
-		failCount := failureCounter.Load()
+// modelTorrentPieceLength is the piece length of the torrent of a model directory.
+const modelTorrentPieceLength = 512 * 1024 // 512 KiB
+
+// pathTorrentJobs returns a job for each --path: a file or directory exported as it is,
+// with a piece length fitting its size since it may hold a whole collection. The torrents
+// aren't indexed, as a path needn't be one model.
+func pathTorrentJobs(paths []string, savePath string) []torrentJob {
+	var jobs []torrentJob
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		path = filepath.Clean(path)
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+		jobs = append(jobs, torrentJob{
+			SourcePath:     path,
+			Trackers:       announceURLs,
+			WebSeeds:       webSeedsFor(webSeedURLs, savePath, path),
+			OutputDir:      torrentOutputDir,
+			Overwrite:      overwriteTorrents,
+			GenerateMagnet: generateMagnetLinks,
+			LogFields:      log.Fields{"path": path},
+		})
+	}
+	return jobs
+}
 
-		log.Infof("Torrent generation complete. Success: %d, Failed: %d", successCount, failCount)
-		if failCount > 0 {
-			log.Errorf("%d torrents failed to generate", failCount)
-			return fmt.Errorf("%d torrents failed to generate", failCount)
+// webSeedsFor returns the web seeds (BEP 19) of the torrent of sourcePath. Each base is
+// where savePath is served over HTTP; a client appends the torrent's name (and the paths of
+// its files) to a web seed, so it gets the directory holding sourcePath below savePath. A
+// sourcePath outside savePath must be served from its parent directory at the base itself.
+func webSeedsFor(bases []string, savePath, sourcePath string) []string {
+	rel := ""
+	if savePath != "" {
+		if absSave, err := filepath.Abs(savePath); err == nil {
+			if absSource, err := filepath.Abs(sourcePath); err == nil {
+				if r, err := filepath.Rel(absSave, filepath.Dir(absSource)); err == nil && r != "." && r != ".." && !strings.HasPrefix(r, ".."+string(filepath.Separator)) {
+					rel = filepath.ToSlash(r)
+				}
+			}
 		}
-		return nil
-	},
+	}
+	var seeds []string
+	for _, base := range bases {
+		seed := strings.TrimSuffix(base, "/") + "/"
+		if rel != "" {
+			for _, part := range strings.Split(rel, "/") {
+				seed += url.PathEscape(part) + "/"
+			}
+		}
+		seeds = append(seeds, seed)
+	}
+	return seeds
 }
 
-// generateTorrentFile creates a .torrent file for the given sourcePath (directory).
+// generateTorrentFile creates a .torrent file for the given sourcePath (a directory or a file),
+// with the web seeds and piece length (0 to choose one for its size).
 // It can optionally also create a text file containing the magnet link.
 // It returns the path to the generated .torrent file, the magnet link file (if created),
 // the magnet URI string itself, or an error.
-func generateTorrentFile(sourcePath string, trackers []string, outputDir string, overwrite bool, generateMagnetLinks bool) (torrentFilePath string, magnetFilePath string, magnetURI string, err error) {
+func generateTorrentFile(sourcePath string, trackers []string, webSeeds []string, pieceLength int64, outputDir string, overwrite bool, generateMagnetLinks bool) (torrentFilePath string, magnetFilePath string, magnetURI string, err error) {
 	stat, err := os.Stat(sourcePath)
 	if os.IsNotExist(err) {
 		log.WithField("path", sourcePath).Error("Source path not found for torrent generation")
@@ -365,9 +461,9 @@ func generateTorrentFile(sourcePath string, trackers []string, outputDir string,
 	} else if err != nil {
 		log.WithError(err).WithField("path", sourcePath).Error("Error stating source path")
 		return "", "", "", fmt.Errorf("error stating source path %s: %w", sourcePath, err)
-	} else if !stat.IsDir() {
-		log.WithField("path", sourcePath).Error("Source path is not a directory")
-		return "", "", "", fmt.Errorf("source path is not a directory: %s", sourcePath)
+	} else if !stat.IsDir() && !stat.Mode().IsRegular() {
+		log.WithField("path", sourcePath).Error("Source path is not a directory or a file")
+		return "", "", "", fmt.Errorf("source path is not a directory or a file: %s", sourcePath)
 	}
 
 	// Use the directory name (which should be the model name slug) for the torrent file
@@ -375,14 +471,16 @@ func generateTorrentFile(sourcePath string, trackers []string, outputDir string,
 	var outPath string
 	if outputDir != "" {
 		// Ensure output directory exists
-		if err := os.MkdirAll(outputDir, 0755); err != nil {
+		if err := helpers.MkdirAll(outputDir, 0755); err != nil {
 			log.WithError(err).WithField("dir", outputDir).Error("Error creating output directory")
 			return "", "", "", fmt.Errorf("error creating output directory %s: %w", outputDir, err)
 		}
 		outPath = filepath.Join(outputDir, torrentFileName)
-	} else {
+	} else if stat.IsDir() {
 		// Place the torrent file *inside* the source (model) directory
 		outPath = filepath.Join(sourcePath, torrentFileName)
+	} else {
+		outPath = filepath.Join(filepath.Dir(sourcePath), torrentFileName) // Next to a file
 	}
 	torrentFilePath = outPath // Assign to return variable
 
@@ -429,17 +527,16 @@ func generateTorrentFile(sourcePath string, trackers []string, outputDir string,
 		mi.Announce = validTrackers[0] // Set primary announce
 		mi.AnnounceList = make([][]string, 1)
 		mi.AnnounceList[0] = validTrackers // Add all valid trackers to the first tier
-	} else {
+	} else if len(webSeeds) == 0 {
 		log.Error("No valid tracker URLs could be added to the torrent.")
 		// Consider returning an error if trackers are essential
 		// return "", "", "", errors.New("no valid tracker URLs provided or parsed")
 	}
 
+	mi.UrlList = webSeeds
 	mi.CreatedBy = "go-civitai-download"
 	mi.CreationDate = time.Now().Unix() // Add creation date
 
-	// Use a reasonable piece length (adjust if needed for very large/small files)
-	const pieceLength = 512 * 1024 // 512 KiB
 	info := metainfo.Info{
 		PieceLength: pieceLength,
 		Name:        filepath.Base(sourcePath), // Set the base name in the info dict
@@ -454,7 +551,7 @@ func generateTorrentFile(sourcePath string, trackers []string, outputDir string,
 	}
 
 	// Check if any files were actually added
-	if len(info.Files) == 0 && info.Length == 0 {
+	if len(info.Files) == 0 && info.Length == 0 && stat.IsDir() {
 		// This might happen for an empty directory, check if it's intentional
 		if !stat.IsDir() { // Should not happen due to earlier check, but safety first
 			log.WithField("path", sourcePath).Error("Source path is not a directory after check.")
@@ -488,6 +585,7 @@ func generateTorrentFile(sourcePath string, trackers []string, outputDir string,
 		log.WithError(err).WithField("path", outPath).Error("Error creating torrent file")
 		return "", "", "", fmt.Errorf("error creating torrent file %s: %w", outPath, err)
 	}
+	helpers.ApplyFileMode(outPath)
 	// Use defer with a closure to check close error
 	defer func() {
 		closeErr := f.Close()
@@ -534,6 +632,9 @@ func generateTorrentFile(sourcePath string, trackers []string, outputDir string,
 			}
 		}
 	}
+	for _, seed := range mi.UrlList {
+		magnetParts = append(magnetParts, fmt.Sprintf("ws=%s", url.QueryEscape(seed)))
+	}
 	// Assign the generated magnet URI to the return variable
 	magnetURI = strings.Join(magnetParts, "&")
 
@@ -583,6 +684,7 @@ func writeMagnetFile(filePath string, magnetURI string) error {
 	if err != nil {
 		return fmt.Errorf("error creating magnet file %s: %w", filePath, err)
 	}
+	helpers.ApplyFileMode(filePath)
 	// Use defer with a closure to check close error
 	defer func() {
 		closeErr := f.Close()
@@ -607,6 +709,8 @@ func init() {
 
 	// Flags definition using Viper binding where appropriate
 	torrentCmd.Flags().StringSliceVar(&announceURLs, "announce", []string{}, "Tracker announce URL (repeatable)")
+	torrentCmd.Flags().StringSliceVar(&webSeedURLs, "web-seed", []string{}, "URL the save path is served at over HTTP, added to each torrent as a web seed (repeatable)")
+	torrentCmd.Flags().StringSliceVar(&torrentPaths, "path", []string{}, "File or directory to make a torrent of instead of each model directory, e.g. a type directory or the whole archive (repeatable)")
 	torrentCmd.Flags().IntSliceVar(&torrentModelIDs, "model-id", []int{}, "Specific model ID(s) to generate torrents for (comma-separated or repeated). Default: all downloaded models.")
 	torrentCmd.Flags().StringVarP(&torrentOutputDir, "output-dir", "o", "", "Directory to save generated .torrent files (default: place inside each model's directory)")
 	torrentCmd.Flags().BoolVarP(&overwriteTorrents, "overwrite", "f", false, "Overwrite existing .torrent files")
@@ -619,7 +723,7 @@ func init() {
 	_ = viper.BindPFlag("torrent.magnetlinks", torrentCmd.Flags().Lookup("magnet-links"))
 
 	// Concurrency is often a command-line only setting, but could be bound too
+	// Bound when the command runs (not here) so it doesn't steal the "concurrency" key from download's -c
 	torrentCmd.Flags().IntP("concurrency", "c", 4, "Number of concurrent torrent generation workers")
-	_ = viper.BindPFlag("concurrency", torrentCmd.Flags().Lookup("concurrency")) // Bind concurrency
 
 }
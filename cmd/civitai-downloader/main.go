@@ -1,8 +1,8 @@
 package main
 
 import (
-	"go-civitai-download/cmd/civitai-downloader/cmd"
-	"go-civitai-download/internal/api"
+	"github.com/dreamfast/go-civitai-downloader/cmd/civitai-downloader/cmd"
+	"github.com/dreamfast/go-civitai-downloader/internal/api"
 )
 
 func main() {
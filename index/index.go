@@ -74,11 +74,15 @@ func IndexItem(index bleve.Index, item Item) error {
 	return index.Index(item.ID, item)
 }
 
-// SearchIndex performs a search query against the index.
-func SearchIndex(index bleve.Index, query string) (*bleve.SearchResult, error) {
+// SearchIndex performs a search query against the index. sortBy orders the hits as
+// bleve's SearchRequest.SortBy does (e.g. "-_score", "_id"); by default by score.
+func SearchIndex(index bleve.Index, query string, sortBy ...string) (*bleve.SearchResult, error) {
 	searchQuery := bleve.NewQueryStringQuery(query)
 	searchRequest := bleve.NewSearchRequest(searchQuery)
 	searchRequest.Fields = []string{"*"} // Request all stored fields
+	if len(sortBy) > 0 {
+		searchRequest.SortBy(sortBy)
+	}
 	searchResults, err := index.Search(searchRequest)
 	if err != nil {
 		return nil, err
@@ -2,8 +2,7 @@ package api
 
 import (
 	"bytes"
-	"encoding/json"
-	"errors"
+	"context"
 	"fmt"
 	"io"
 	"net/http"
@@ -12,17 +11,19 @@ import (
 	"os"
 	"time"
 
-	"go-civitai-download/internal/models"
+	"github.com/dreamfast/go-civitai-downloader/internal/failure"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
 
 	log "github.com/sirupsen/logrus"
 )
 
 // Custom Error Types
 var (
-	ErrRateLimited  = errors.New("API rate limit exceeded")
-	ErrUnauthorized = errors.New("API request unauthorized (check API key)")
-	ErrNotFound     = errors.New("API resource not found")
-	ErrServerError  = errors.New("API server error")
+	ErrRateLimited  = failure.New(failure.RateLimit, "API rate limit exceeded")
+	ErrUnauthorized = failure.New(failure.Auth, "API request unauthorized (check API key)")
+	ErrNotFound     = failure.New(failure.NotFound, "API resource not found")
+	ErrServerError  = failure.New(failure.Network, "API server error")
+	ErrHtmlPage     = failure.New(failure.Network, "API answered with a web page instead of JSON")
 )
 
 const CivitaiApiBaseUrl = "https://civitai.com/api/v1"
@@ -106,6 +107,12 @@ func NewClient(apiKey string, httpClient *http.Client, cfg models.Config) *Clien
 // GetModels fetches models based on query parameters, using cursor pagination.
 // Accepts the cursor for the next page. Returns the next cursor and the response.
 func (c *Client) GetModels(cursor string, queryParams models.QueryParameters) (string, models.ApiResponse, error) {
+	return c.GetModelsContext(context.Background(), cursor, queryParams)
+}
+
+// GetModelsContext is GetModels with a context. Cancelling ctx aborts the request and any
+// retry backoff, returning ctx's error.
+func (c *Client) GetModelsContext(ctx context.Context, cursor string, queryParams models.QueryParameters) (string, models.ApiResponse, error) {
 	values := url.Values{}
 	// Add other parameters first
 	values.Add("sort", queryParams.Sort)
@@ -143,7 +150,7 @@ func (c *Client) GetModels(cursor string, queryParams models.QueryParameters) (s
 	// No change to main logger here
 	// log.Debugf("Requesting URL: %s", reqURL)
 
-	req, err := http.NewRequest("GET", reqURL, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", reqURL, nil)
 	if err != nil {
 		log.WithError(err).Errorf("Error creating request for %s", reqURL)
 		// Wrap the underlying error
@@ -205,7 +212,9 @@ func (c *Client) GetModels(cursor string, queryParams models.QueryParameters) (s
 			lastErr = fmt.Errorf("http request failed (attempt %d/%d): %w", attempt+1, maxRetries, err)
 			if attempt < maxRetries-1 { // Only log retry warning if not the last attempt
 				log.WithError(err).Warnf("Retrying (%d/%d)...", attempt+1, maxRetries)
-				time.Sleep(time.Duration(attempt+1) * 2 * time.Second) // Exponential backoff
+				if sleepErr := sleepContext(ctx, time.Duration(attempt+1)*2*time.Second); sleepErr != nil { // Exponential backoff
+					return "", models.ApiResponse{}, sleepErr
+				}
 				continue
 			}
 			break // Max retries reached on HTTP error
@@ -218,7 +227,10 @@ func (c *Client) GetModels(cursor string, queryParams models.QueryParameters) (s
 		case http.StatusTooManyRequests:
 			lastErr = ErrRateLimited
 		case http.StatusUnauthorized, http.StatusForbidden:
-			lastErr = ErrUnauthorized
+			// Tell a rejected key from a login wall or a Cloudflare challenge
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+			lastErr = failure.Interpret(ErrUnauthorized, failure.Response{Status: resp.StatusCode, Header: resp.Header, Body: body, WithAPIKey: c.ApiKey != ""})
 			goto RequestFailed // Non-retryable auth error
 		case http.StatusNotFound:
 			lastErr = ErrNotFound
@@ -230,7 +242,7 @@ func (c *Client) GetModels(cursor string, queryParams models.QueryParameters) (s
 				lastErr = fmt.Errorf("%w (status code %d)", ErrServerError, resp.StatusCode)
 			} else {
 				// Other client-side errors (4xx) are likely not retryable
-				lastErr = fmt.Errorf("API request failed with status %d", resp.StatusCode)
+				lastErr = failure.Wrap(failure.ForHTTPStatus(resp.StatusCode), fmt.Errorf("API request failed with status %d", resp.StatusCode))
 				goto RequestFailed
 			}
 		}
@@ -247,7 +259,9 @@ func (c *Client) GetModels(cursor string, queryParams models.QueryParameters) (s
 				sleepDuration = time.Duration(attempt+1) * 3 * time.Second
 				log.WithError(lastErr).Warnf("Server error. Retrying (%d/%d) after %s...", attempt+1, maxRetries, sleepDuration)
 			}
-			time.Sleep(sleepDuration)
+			if sleepErr := sleepContext(ctx, sleepDuration); sleepErr != nil {
+				return "", models.ApiResponse{}, sleepErr
+			}
 		} else {
 			log.WithError(lastErr).Errorf("Request failed after %d attempts with status %d", maxRetries, resp.StatusCode)
 		}
@@ -270,8 +284,16 @@ ProcessResponse:
 		return "", models.ApiResponse{}, fmt.Errorf("error reading response body: %w", err)
 	}
 
+	// A proxy error page or a challenge that got through with 200 isn't worth decoding
+	if failure.IsHTML(resp.Header, body) {
+		if page := (failure.Response{Status: resp.StatusCode, Header: resp.Header, Body: body}); failure.IsChallenge(page) {
+			return "", models.ApiResponse{}, failure.Interpret(ErrHtmlPage, page)
+		}
+		return "", models.ApiResponse{}, ErrHtmlPage
+	}
+
 	var response models.ApiResponse
-	err = json.Unmarshal(body, &response)
+	err = Decode(body, &response, "models")
 	if err != nil {
 		log.WithError(err).Errorf("Error unmarshalling response JSON")
 		// Log the body that caused the error (already logged to api.log if enabled)
@@ -282,3 +304,15 @@ ProcessResponse:
 	// Return the next cursor provided by the API
 	return response.Metadata.NextCursor, response, nil
 }
+
+// sleepContext waits for d, or until ctx is done, in which case it returns ctx's error.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
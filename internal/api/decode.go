@@ -0,0 +1,344 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime/trace"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrSchemaDrift indicates the API response didn't match the structs we decode into
+// (unknown fields, unknown enum values or changed field types). Only returned in strict mode.
+var ErrSchemaDrift = errors.New("api schema drift detected")
+
+// KnownModelTypes lists the model "type" values the downloader knows how to handle.
+var KnownModelTypes = []string{
+	"Checkpoint", "TextualInversion", "Hypernetwork", "AestheticGradient", "LORA", "LoCon", "DoRA",
+	"Controlnet", "Upscaler", "MotionModule", "VAE", "Poses", "Wildcards", "Workflows", "Detection", "Other",
+}
+
+// KnownFileTypes lists the file "type" values seen on model version files.
+var KnownFileTypes = []string{
+	"Model", "Pruned Model", "Training Data", "VAE", "Config", "Archive", "Negative",
+}
+
+var (
+	strictMode bool
+	lowMemory  bool
+	payloadDir string
+	// seenDrift de-duplicates drift warnings so each field/value is only logged once per run
+	seenDrift sync.Map
+)
+
+// SetStrictMode toggles strict API decoding. In strict mode any schema drift is a hard
+// error and the offending payload is written to the payload directory.
+func SetStrictMode(strict bool) {
+	strictMode = strict
+}
+
+// StrictMode reports whether strict API decoding is enabled.
+func StrictMode() bool {
+	return strictMode
+}
+
+// SetLowMemory makes Decode look for unknown fields while reading the payload token by
+// token, instead of decoding it a second time into a generic tree (several times the size
+// of the body for a page of models).
+func SetLowMemory(low bool) {
+	lowMemory = low
+}
+
+// SetPayloadDir sets where offending payloads are saved in strict mode.
+// If empty, payloads are saved to the current directory.
+func SetPayloadDir(dir string) {
+	payloadDir = dir
+}
+
+// Decode unmarshals an API response body into v, tolerating schema drift.
+// Unknown fields and fields whose type changed are logged once (per field path) and
+// otherwise ignored, so callers still get everything that could be decoded.
+// Callers that want to keep unknown fields should hold on to the raw body.
+// In strict mode drift is returned as an error wrapping ErrSchemaDrift, after the
+// payload has been saved for bug reports. label identifies the endpoint in logs
+// and payload file names (e.g. "models", "model-version").
+func Decode(body []byte, v interface{}, label string) error {
+	defer trace.StartRegion(context.Background(), "api decode").End()
+	var problems []string
+
+	if err := json.Unmarshal(body, v); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if !errors.As(err, &typeErr) {
+			// Syntax errors etc. can't be tolerated in either mode
+			if strictMode {
+				path := savePayload(body, label)
+				return fmt.Errorf("failed to decode %s response (payload saved to %s): %w", label, path, err)
+			}
+			return fmt.Errorf("failed to decode %s response: %w", label, err)
+		}
+		// Type mismatches are skipped by encoding/json, the rest of the struct is still filled.
+		problems = append(problems, fmt.Sprintf("field '%s' has unexpected type %s (expected %s)", normalizeFieldPath(typeErr.Field), typeErr.Value, typeErr.Type))
+	}
+
+	// Walk the generic form of the payload looking for fields the structs don't know about
+	unknown := make(map[string]struct{})
+	if lowMemory {
+		if err := findUnknownFieldsStream(json.NewDecoder(bytes.NewReader(body)), reflect.TypeOf(v), "", unknown); err != nil {
+			unknown = nil
+		}
+	} else {
+		var generic interface{}
+		if err := json.Unmarshal(body, &generic); err == nil {
+			findUnknownFields(generic, reflect.TypeOf(v), "", unknown)
+		}
+	}
+	for _, field := range sortedKeys(unknown) {
+		problems = append(problems, fmt.Sprintf("unknown field '%s'", field))
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+
+	if strictMode {
+		path := savePayload(body, label)
+		return fmt.Errorf("%w in %s response (payload saved to %s): %s", ErrSchemaDrift, label, path, strings.Join(problems, "; "))
+	}
+	for _, problem := range problems {
+		warnDriftOnce(label, problem)
+	}
+	return nil
+}
+
+// CheckEnum reports a value that isn't in the list of known values for a field.
+// In normal mode it logs once per (field, value); in strict mode it returns an error.
+func CheckEnum(label, field, value string, known []string) error {
+	if value == "" {
+		return nil
+	}
+	for _, k := range known {
+		if strings.EqualFold(k, value) {
+			return nil
+		}
+	}
+	problem := fmt.Sprintf("unknown value '%s' for field '%s'", value, field)
+	if strictMode {
+		return fmt.Errorf("%w in %s response: %s", ErrSchemaDrift, label, problem)
+	}
+	warnDriftOnce(label, problem)
+	return nil
+}
+
+// RawObjects splits a JSON array held under key (e.g. "items" or "modelVersions") into
+// its raw elements and indexes them by their "id" field. Missing keys yield an empty map.
+func RawObjects(body []byte, key string) map[int]json.RawMessage {
+	result := make(map[int]json.RawMessage)
+	var wrapper map[string]json.RawMessage
+	if err := json.Unmarshal(body, &wrapper); err != nil {
+		return result
+	}
+	var elements []json.RawMessage
+	if err := json.Unmarshal(wrapper[key], &elements); err != nil {
+		return result
+	}
+	for _, element := range elements {
+		var idOnly struct {
+			ID int `json:"id"`
+		}
+		if err := json.Unmarshal(element, &idOnly); err == nil && idOnly.ID != 0 {
+			result[idOnly.ID] = element
+		}
+	}
+	return result
+}
+
+func warnDriftOnce(label, problem string) {
+	key := label + "|" + problem
+	if _, loaded := seenDrift.LoadOrStore(key, struct{}{}); loaded {
+		return
+	}
+	log.Warnf("API schema drift (%s): %s. The raw value is kept in saved metadata; use --strict-api to fail instead.", label, problem)
+}
+
+// savePayload writes the offending body to the payload directory and returns the path.
+func savePayload(body []byte, label string) string {
+	dir := payloadDir
+	if dir == "" {
+		dir = "."
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.WithError(err).Errorf("Failed to create payload directory %s", dir)
+		return "(not saved)"
+	}
+	name := fmt.Sprintf("api-payload-%s-%s.json", label, time.Now().Format("20060102-150405.000"))
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, body, 0600); err != nil {
+		log.WithError(err).Errorf("Failed to save offending API payload to %s", path)
+		return "(not saved)"
+	}
+	return path
+}
+
+// findUnknownFields recursively compares a decoded JSON value against the Go type it
+// was unmarshalled into and records dotted paths of object keys with no matching field.
+func findUnknownFields(value interface{}, t reflect.Type, path string, unknown map[string]struct{}) {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil {
+		return
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		switch t.Kind() {
+		case reflect.Struct:
+			fields := jsonFields(t)
+			for key, child := range v {
+				fieldType, ok := fields[strings.ToLower(key)]
+				if !ok {
+					unknown[joinPath(path, key)] = struct{}{}
+					continue
+				}
+				findUnknownFields(child, fieldType, joinPath(path, key), unknown)
+			}
+		case reflect.Map:
+			for key, child := range v {
+				findUnknownFields(child, t.Elem(), joinPath(path, key), unknown)
+			}
+		}
+	case []interface{}:
+		if t.Kind() != reflect.Slice && t.Kind() != reflect.Array {
+			return
+		}
+		// Use "[]" rather than indexes so the same field in every element is reported once
+		for _, child := range v {
+			findUnknownFields(child, t.Elem(), path+"[]", unknown)
+		}
+	}
+}
+
+// findUnknownFieldsStream records what findUnknownFields does, reading the next JSON value
+// from dec token by token so only the path being walked is held in memory. A nil t skips
+// the value.
+func findUnknownFieldsStream(dec *json.Decoder, t reflect.Type, path string, unknown map[string]struct{}) error {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	switch token {
+	case json.Delim('{'):
+		var fields map[string]reflect.Type
+		if t != nil && t.Kind() == reflect.Struct {
+			fields = jsonFields(t)
+		}
+		for dec.More() {
+			keyToken, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			key, _ := keyToken.(string)
+			var child reflect.Type
+			switch {
+			case fields != nil:
+				fieldType, ok := fields[strings.ToLower(key)]
+				if !ok {
+					unknown[joinPath(path, key)] = struct{}{}
+				}
+				child = fieldType
+			case t != nil && t.Kind() == reflect.Map:
+				child = t.Elem()
+			}
+			if err := findUnknownFieldsStream(dec, child, joinPath(path, key), unknown); err != nil {
+				return err
+			}
+		}
+	case json.Delim('['):
+		var elem reflect.Type
+		if t != nil && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) {
+			elem = t.Elem()
+		}
+		for dec.More() {
+			if err := findUnknownFieldsStream(dec, elem, path+"[]", unknown); err != nil {
+				return err
+			}
+		}
+	default:
+		return nil // A scalar
+	}
+	_, err = dec.Token() // The closing delimiter
+	return err
+}
+
+// jsonFields maps lower-cased JSON names to field types, following encoding/json's
+// case-insensitive matching and flattening embedded structs.
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			for k, v := range jsonFields(f.Type) {
+				fields[k] = v
+			}
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[strings.ToLower(name)] = f.Type
+	}
+	return fields
+}
+
+// normalizeFieldPath turns encoding/json paths like "items.0.name" into "items[].name"
+// to match findUnknownFields and keep de-duplication per field rather than per element.
+func normalizeFieldPath(field string) string {
+	parts := strings.Split(field, ".")
+	var out []string
+	for _, part := range parts {
+		if _, err := strconv.Atoi(part); err == nil && len(out) > 0 {
+			out[len(out)-1] += "[]"
+			continue
+		}
+		out = append(out, part)
+	}
+	return strings.Join(out, ".")
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
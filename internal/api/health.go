@@ -0,0 +1,140 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RateLimit is the rate limit state the API reported in its response headers.
+type RateLimit struct {
+	Limit      int           // Requests allowed per window (-1 if not reported)
+	Remaining  int           // Requests left in the window (-1 if not reported)
+	ResetIn    time.Duration // Until the window resets (0 if not reported)
+	RetryAfter time.Duration // From a Retry-After header (rate limited responses)
+}
+
+// Health is the result of Ping.
+type Health struct {
+	Reachable bool
+	Status    int           // HTTP status of the listing probe
+	Latency   time.Duration // Round trip of the listing probe
+	RateLimit RateLimit
+
+	// AuthStatus is "none" (no API key), "ok", "rejected" or "unknown" (the API couldn't tell).
+	AuthStatus string
+	Username   string // Account of the API key, when AuthStatus is "ok"
+	Tier       string // Membership tier of the account, if reported
+
+	Err error // Why the API is not usable, if it isn't
+}
+
+// Ping checks the API without retries: it fetches a one-item model listing (reachability,
+// latency and rate limit headers) and, with an API key, the key's account (/me).
+func (c *Client) Ping(ctx context.Context) Health {
+	health := Health{AuthStatus: "none", RateLimit: RateLimit{Limit: -1, Remaining: -1}}
+
+	started := time.Now()
+	resp, err := c.probe(ctx, CivitaiApiBaseUrl+"/models?limit=1")
+	health.Latency = time.Since(started)
+	if err != nil {
+		health.Err = fmt.Errorf("API unreachable: %w", err)
+		return health
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	health.Reachable = true
+	health.Status = resp.StatusCode
+	health.RateLimit = parseRateLimit(resp.Header)
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		health.Err = ErrRateLimited
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		health.AuthStatus = "rejected"
+		health.Err = ErrUnauthorized
+		return health
+	case resp.StatusCode >= 500:
+		health.Err = fmt.Errorf("%w (status code %d)", ErrServerError, resp.StatusCode)
+	case resp.StatusCode != http.StatusOK:
+		health.Err = fmt.Errorf("model listing answered with status %d", resp.StatusCode)
+	}
+
+	if c.ApiKey == "" {
+		return health
+	}
+	health.AuthStatus = "unknown"
+	resp, err = c.probe(ctx, CivitaiApiBaseUrl+"/me")
+	if err != nil {
+		return health // The listing already told whether the API is reachable
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var me struct {
+			Username string `json:"username"`
+			Tier     string `json:"tier"`
+		}
+		if json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&me) == nil && me.Username != "" {
+			health.AuthStatus, health.Username, health.Tier = "ok", me.Username, me.Tier
+		}
+	case http.StatusUnauthorized, http.StatusForbidden:
+		health.AuthStatus = "rejected"
+		if health.Err == nil {
+			health.Err = ErrUnauthorized
+		}
+	}
+	return health
+}
+
+// probe sends one authenticated GET request.
+func (c *Client) probe(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.ApiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.ApiKey)
+	}
+	return c.HttpClient.Do(req)
+}
+
+// parseRateLimit reads the X-RateLimit-* (or IETF RateLimit-*) and Retry-After headers.
+func parseRateLimit(h http.Header) RateLimit {
+	rl := RateLimit{Limit: -1, Remaining: -1}
+	header := func(names ...string) string {
+		for _, name := range names {
+			if v := strings.TrimSpace(h.Get(name)); v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+	if v, err := strconv.Atoi(header("X-RateLimit-Limit", "RateLimit-Limit")); err == nil {
+		rl.Limit = v
+	}
+	if v, err := strconv.Atoi(header("X-RateLimit-Remaining", "RateLimit-Remaining")); err == nil {
+		rl.Remaining = v
+	}
+	if v, err := strconv.ParseInt(header("X-RateLimit-Reset", "RateLimit-Reset"), 10, 64); err == nil && v > 0 {
+		// Either seconds until the reset or a Unix timestamp
+		if v > 1_000_000_000 {
+			rl.ResetIn = time.Until(time.Unix(v, 0)).Round(time.Second)
+		} else {
+			rl.ResetIn = time.Duration(v) * time.Second
+		}
+	}
+	if v := header("Retry-After"); v != "" {
+		if secs, err := strconv.Atoi(v); err == nil {
+			rl.RetryAfter = time.Duration(secs) * time.Second
+		} else if at, err := http.ParseTime(v); err == nil {
+			rl.RetryAfter = time.Until(at).Round(time.Second)
+		}
+	}
+	return rl
+}
@@ -0,0 +1,99 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Settings is the subset of viper used to resolve effective values. *viper.Viper satisfies it.
+type Settings interface {
+	IsSet(key string) bool
+	GetString(key string) string
+	GetBool(key string) bool
+	GetInt(key string) int
+	GetStringSlice(key string) []string
+}
+
+// settingAliases maps config fields to the viper key of a flag that doesn't share the
+// field's (lower-cased) name.
+var settingAliases = map[string]string{
+	"Usernames": "users",
+}
+
+// Capture builds a models.Config from the effective settings, i.e. after viper has
+// applied flag > env > config file > default precedence. Every field of models.Config
+// with a toml tag is resolved through its lower-cased tag name (the viper key).
+func Capture(settings Settings, includeApiKey bool) models.Config {
+	var cfg models.Config
+	v := reflect.ValueOf(&cfg).Elem()
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := field.Tag.Get("toml")
+		if name == "" || name == "-" {
+			continue
+		}
+		if name == "ApiKey" && !includeApiKey {
+			continue
+		}
+		key := strings.ToLower(name)
+		if alias, ok := settingAliases[name]; ok && settings.IsSet(alias) {
+			key = alias
+		}
+
+		fv := v.Field(i)
+		switch fv.Kind() {
+		case reflect.String:
+			fv.SetString(settings.GetString(key))
+		case reflect.Bool:
+			fv.SetBool(settings.GetBool(key))
+		case reflect.Int, reflect.Int64:
+			fv.SetInt(int64(settings.GetInt(key)))
+		case reflect.Slice:
+			if fv.Type().Elem().Kind() == reflect.String {
+				fv.Set(reflect.ValueOf(settings.GetStringSlice(key)))
+			}
+		}
+	}
+	return cfg
+}
+
+// WriteProfile encodes cfg as TOML to path. Existing files are only replaced when overwrite is set.
+// The file is created 0600 because it may contain the API key.
+func WriteProfile(path string, cfg models.Config, header string, overwrite bool) error {
+	if _, err := os.Stat(path); err == nil && !overwrite {
+		return fmt.Errorf("profile %s already exists (use --force to overwrite)", path)
+	}
+
+	var buf bytes.Buffer
+	for _, line := range strings.Split(strings.TrimSpace(header), "\n") {
+		if line != "" {
+			fmt.Fprintf(&buf, "# %s\n", line)
+		}
+	}
+	if buf.Len() > 0 {
+		buf.WriteString("\n")
+	}
+	if err := toml.NewEncoder(&buf).Encode(cfg); err != nil {
+		return fmt.Errorf("failed to encode profile: %w", err)
+	}
+
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return fmt.Errorf("failed to create directory for profile %s: %w", path, err)
+		}
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		return fmt.Errorf("failed to write profile %s: %w", path, err)
+	}
+	return nil
+}
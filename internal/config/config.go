@@ -2,7 +2,7 @@ package config
 
 import (
 	"fmt"
-	"go-civitai-download/internal/models" // Import models for the Config struct
+	"github.com/dreamfast/go-civitai-downloader/internal/models" // Import models for the Config struct
 
 	"github.com/BurntSushi/toml"
 	log "github.com/sirupsen/logrus" // Use logrus
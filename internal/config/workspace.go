@@ -0,0 +1,71 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+)
+
+// Workspace layout (relative to the workspace root):
+//
+//	config.toml          - workspace configuration
+//	civitai_download_db  - download tracking database
+//	civitai.bleve        - search index
+//	cache/               - scratch data (saved API payloads, etc.)
+//	logs/                - api.log and other log output
+//	downloads/           - default SavePath if the workspace config doesn't set one
+const (
+	WorkspaceConfigFile   = "config.toml"
+	WorkspaceDatabaseDir  = "civitai_download_db"
+	WorkspaceIndexDir     = "civitai.bleve"
+	WorkspaceCacheDir     = "cache"
+	WorkspaceLogsDir      = "logs"
+	WorkspaceDownloadsDir = "downloads"
+)
+
+// WorkspaceRoot returns the base directory holding all workspaces,
+// e.g. ~/.config/civitai-downloader/workspaces on Linux.
+func WorkspaceRoot() (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("could not determine user config directory: %w", err)
+	}
+	return filepath.Join(configDir, "civitai-downloader", "workspaces"), nil
+}
+
+// WorkspaceDir resolves a workspace name to its root directory and makes sure
+// the directory (plus cache/ and logs/) exists.
+func WorkspaceDir(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("invalid workspace name %q", name)
+	}
+	root, err := WorkspaceRoot()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(root, name)
+	for _, sub := range []string{"", WorkspaceCacheDir, WorkspaceLogsDir} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return "", fmt.Errorf("failed to create workspace directory %s: %w", filepath.Join(dir, sub), err)
+		}
+	}
+	return dir, nil
+}
+
+// ApplyWorkspaceDefaults fills any unset paths in cfg so they live inside the workspace.
+// Values explicitly set in the workspace config file are left untouched.
+func ApplyWorkspaceDefaults(cfg *models.Config, workspaceDir string) {
+	if cfg.SavePath == "" {
+		cfg.SavePath = filepath.Join(workspaceDir, WorkspaceDownloadsDir)
+	}
+	if cfg.DatabasePath == "" {
+		cfg.DatabasePath = filepath.Join(workspaceDir, WorkspaceDatabaseDir)
+	}
+	if cfg.BleveIndexPath == "" {
+		cfg.BleveIndexPath = filepath.Join(workspaceDir, WorkspaceIndexDir)
+	}
+}
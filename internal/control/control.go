@@ -0,0 +1,234 @@
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrUnknownCommand is returned to clients for commands no handler is registered for.
+var ErrUnknownCommand = errors.New("unknown control command")
+
+// Request is a single command sent over the control socket (one JSON object per line).
+type Request struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+}
+
+// Response is the server's reply to a Request.
+type Response struct {
+	OK      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// HandlerFunc handles a control command and returns a human-readable result.
+type HandlerFunc func(args []string) (string, error)
+
+// Server accepts control commands for a running process on a local unix socket.
+// Every command received is appended to the audit log.
+type Server struct {
+	socketPath string
+	auditPath  string
+	listener   net.Listener
+	mu         sync.RWMutex
+	handlers   map[string]HandlerFunc
+	streams    map[string]StreamFunc
+	done       chan struct{} // Closed by Close, ending streams
+	auditMu    sync.Mutex
+	connsMu    sync.Mutex
+	conns      map[net.Conn]struct{}
+	wg         sync.WaitGroup
+}
+
+// NewServer creates a control server. auditPath may be empty to disable the audit log.
+func NewServer(socketPath, auditPath string) *Server {
+	return &Server{
+		socketPath: socketPath,
+		auditPath:  auditPath,
+		handlers:   make(map[string]HandlerFunc),
+		streams:    make(map[string]StreamFunc),
+		done:       make(chan struct{}),
+		conns:      make(map[net.Conn]struct{}),
+	}
+}
+
+// Handle registers a handler for a command name. Registering the same name twice replaces the handler.
+func (s *Server) Handle(command string, handler HandlerFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[command] = handler
+}
+
+// Start begins listening on the socket. A stale socket file from a crashed run is removed
+// first, but a socket with a live listener is left alone and reported as an error.
+func (s *Server) Start() error {
+	if _, err := os.Stat(s.socketPath); err == nil {
+		if conn, dialErr := net.DialTimeout("unix", s.socketPath, time.Second); dialErr == nil {
+			conn.Close()
+			return fmt.Errorf("control socket %s is already in use by another process", s.socketPath)
+		}
+		if err := os.Remove(s.socketPath); err != nil {
+			return fmt.Errorf("failed to remove stale control socket %s: %w", s.socketPath, err)
+		}
+	}
+
+	listener, err := net.Listen("unix", s.socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to listen on control socket %s: %w", s.socketPath, err)
+	}
+	if err := os.Chmod(s.socketPath, 0600); err != nil {
+		log.WithError(err).Warnf("Failed to restrict permissions on control socket %s", s.socketPath)
+	}
+	s.listener = listener
+
+	s.wg.Add(1)
+	go s.acceptLoop()
+	log.Infof("Control interface listening on %s", s.socketPath)
+	return nil
+}
+
+// Close stops the listener, waits for in-flight commands and removes the socket file.
+func (s *Server) Close() error {
+	if s.listener == nil {
+		return nil
+	}
+	err := s.listener.Close()
+	close(s.done)
+	// Drop idle client connections so their handlers return
+	s.connsMu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.connsMu.Unlock()
+	s.wg.Wait()
+	os.Remove(s.socketPath)
+	return err
+}
+
+func (s *Server) acceptLoop() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.WithError(err).Warn("Control interface: accept failed")
+			continue
+		}
+		s.wg.Add(1)
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer s.wg.Done()
+	s.connsMu.Lock()
+	s.conns[conn] = struct{}{}
+	s.connsMu.Unlock()
+	defer func() {
+		s.connsMu.Lock()
+		delete(s.conns, conn)
+		s.connsMu.Unlock()
+		conn.Close()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	encoder := json.NewEncoder(conn)
+	for scanner.Scan() {
+		var req Request
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			encoder.Encode(Response{Error: fmt.Sprintf("invalid request: %v", err)})
+			continue
+		}
+		s.mu.RLock()
+		stream, ok := s.streams[req.Command]
+		s.mu.RUnlock()
+		if ok {
+			s.serveStream(conn, encoder, req, stream) // The stream takes the connection over
+			return
+		}
+		encoder.Encode(s.dispatch(req))
+	}
+}
+
+func (s *Server) dispatch(req Request) Response {
+	s.mu.RLock()
+	handler, ok := s.handlers[req.Command]
+	s.mu.RUnlock()
+	if !ok {
+		return Response{Error: fmt.Sprintf("%v: %s (available: %s)", ErrUnknownCommand, req.Command, strings.Join(s.commands(), ", "))}
+	}
+
+	message, err := handler(req.Args)
+	s.audit(req, message, err)
+	if err != nil {
+		return Response{Error: err.Error()}
+	}
+	return Response{OK: true, Message: message}
+}
+
+func (s *Server) commands() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, 0, len(s.handlers)+len(s.streams))
+	for name := range s.handlers {
+		names = append(names, name)
+	}
+	for name := range s.streams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// audit appends one line per command: timestamp, command, args and outcome.
+func (s *Server) audit(req Request, message string, handlerErr error) {
+	if s.auditPath == "" {
+		return
+	}
+	s.auditMu.Lock()
+	defer s.auditMu.Unlock()
+
+	f, err := os.OpenFile(s.auditPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.WithError(err).Warnf("Failed to open control audit log %s", s.auditPath)
+		return
+	}
+	defer f.Close()
+
+	outcome := "ok: " + message
+	if handlerErr != nil {
+		outcome = "error: " + handlerErr.Error()
+	}
+	fmt.Fprintf(f, "%s\t%s %s\t%s\n", time.Now().Format(time.RFC3339), req.Command, strings.Join(req.Args, " "), outcome)
+}
+
+// Send connects to a control socket, sends one command and returns the response.
+func Send(socketPath, command string, args []string) (Response, error) {
+	conn, err := net.DialTimeout("unix", socketPath, 5*time.Second)
+	if err != nil {
+		return Response{}, fmt.Errorf("could not connect to control socket %s (is a download running?): %w", socketPath, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	if err := json.NewEncoder(conn).Encode(Request{Command: command, Args: args}); err != nil {
+		return Response{}, fmt.Errorf("failed to send control command: %w", err)
+	}
+	var resp Response
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return Response{}, fmt.Errorf("failed to read control response: %w", err)
+	}
+	return resp, nil
+}
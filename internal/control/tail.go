@@ -0,0 +1,170 @@
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// EventField is the structured log field naming an event (download-started,
+// download-finished, ...). Log entries carrying it are events to tail; the rest are logs.
+const EventField = "event"
+
+// Event is a log entry or event as streamed to tail clients.
+type Event struct {
+	Time    time.Time              `json:"time"`
+	Level   string                 `json:"level"`
+	Event   string                 `json:"event,omitempty"` // Set for events, empty for plain logs
+	Message string                 `json:"message"`
+	Fields  map[string]interface{} `json:"fields,omitempty"`
+}
+
+// Hub is a logrus hook that keeps the last entries and hands new ones to subscribers.
+// Slow subscribers lose entries rather than holding up the process.
+type Hub struct {
+	mu      sync.Mutex
+	history []Event
+	size    int
+	next    int
+	subs    map[chan Event]struct{}
+}
+
+// NewHub creates a hub that keeps the last size entries.
+func NewHub(size int) *Hub {
+	return &Hub{size: size, subs: make(map[chan Event]struct{})}
+}
+
+// Levels implements logrus.Hook.
+func (h *Hub) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire implements logrus.Hook.
+func (h *Hub) Fire(entry *log.Entry) error {
+	event := Event{Time: entry.Time, Level: entry.Level.String(), Message: entry.Message}
+	for k, v := range entry.Data {
+		if k == EventField {
+			event.Event = fmt.Sprint(v)
+			continue
+		}
+		if event.Fields == nil {
+			event.Fields = make(map[string]interface{}, len(entry.Data))
+		}
+		switch v.(type) {
+		case string, bool, int, int64, uint64, float64:
+		default:
+			v = fmt.Sprint(v) // Errors and other values don't all marshal to something useful
+		}
+		event.Fields[k] = v
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.history) < h.size {
+		h.history = append(h.history, event)
+	} else if h.size > 0 {
+		h.history[h.next] = event
+		h.next = (h.next + 1) % h.size
+	}
+	for ch := range h.subs {
+		select {
+		case ch <- event:
+		default: // Dropped for a subscriber that can't keep up
+		}
+	}
+	return nil
+}
+
+// Subscribe returns the last n kept entries and a channel receiving every new one until
+// cancel is called.
+func (h *Hub) Subscribe(n int) (recent []Event, events <-chan Event, cancel func()) {
+	ch := make(chan Event, 256)
+	h.mu.Lock()
+	ordered := append(append([]Event{}, h.history[h.next:]...), h.history[:h.next]...)
+	if n < len(ordered) {
+		ordered = ordered[len(ordered)-n:]
+	}
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+	return ordered, ch, func() {
+		h.mu.Lock()
+		delete(h.subs, ch)
+		h.mu.Unlock()
+	}
+}
+
+// StreamFunc handles a streaming command: it sends values until send fails (the client
+// went away), done is closed (the server is closing) or it has nothing more to send.
+type StreamFunc func(args []string, send func(v interface{}) error, done <-chan struct{}) error
+
+// HandleStream registers a streaming handler. The client gets a Response first (an error
+// ends the stream), then one JSON value per line.
+func (s *Server) HandleStream(command string, handler StreamFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.streams[command] = handler
+}
+
+// serveStream answers a streaming command on conn; it returns when the stream ends.
+func (s *Server) serveStream(conn net.Conn, encoder *json.Encoder, req Request, handler StreamFunc) {
+	s.audit(req, "streaming", nil)
+	if err := encoder.Encode(Response{OK: true, Message: "streaming"}); err != nil {
+		return
+	}
+	// The stream also ends when the client hangs up, even if there is nothing to send
+	stop := make(chan struct{})
+	gone := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, conn)
+		close(gone)
+	}()
+	go func() {
+		select {
+		case <-s.done:
+		case <-gone:
+		}
+		close(stop)
+	}()
+	err := handler(req.Args, func(v interface{}) error { return encoder.Encode(v) }, stop)
+	if err != nil {
+		log.WithError(err).Debugf("Control interface: %s stream ended", req.Command)
+	}
+}
+
+// Stream connects to a control socket, sends a streaming command and calls fn with every
+// value received until the server ends the stream or fn returns an error.
+func Stream(socketPath, command string, args []string, fn func(json.RawMessage) error) error {
+	conn, err := net.DialTimeout("unix", socketPath, 5*time.Second)
+	if err != nil {
+		return fmt.Errorf("could not connect to control socket %s (is a download running?): %w", socketPath, err)
+	}
+	defer conn.Close()
+
+	if err := json.NewEncoder(conn).Encode(Request{Command: command, Args: args}); err != nil {
+		return fmt.Errorf("failed to send control command: %w", err)
+	}
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	if !scanner.Scan() {
+		return fmt.Errorf("failed to read control response: %v", scanner.Err())
+	}
+	var resp Response
+	if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+		return fmt.Errorf("failed to read control response: %w", err)
+	}
+	if !resp.OK {
+		return fmt.Errorf("command failed: %s", resp.Error)
+	}
+	for scanner.Scan() {
+		if err := fn(json.RawMessage(scanner.Bytes())); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
@@ -3,11 +3,13 @@ package database
 import (
 	"bytes" // For buffer operations
 	"compress/gzip"
+	"context"
 	"errors"
 	"fmt"
 	"io" // For io.ReadAll
 	"os"
 	"path/filepath"
+	"runtime/trace"
 	"strconv"
 	"sync"
 
@@ -30,6 +32,9 @@ type DB struct {
 	closeOnce    sync.Once
 	closed       bool
 	closeErr     error // Store the error from the first Close call
+
+	historyPaused bool // Entry writes don't add history events (while Upgrade migrates entries)
+	readOnly      bool // Writes are discarded (see SetReadOnly)
 }
 
 // Open initializes and returns a DB instance.
@@ -47,7 +52,18 @@ func Open(path string) (*DB, error) {
 		return nil, fmt.Errorf("failed to open bitcask database at %s: %w", path, err)
 	}
 	log.Infof("Database opened successfully at %s", path)
-	return &DB{db: dbInstance}, nil
+	d := &DB{db: dbInstance}
+	d.CheckLayout(path) // Warn about entries left behind by older releases
+	return d, nil
+}
+
+// SetReadOnly turns the DB into a read-only view: from then on Put, Delete and history
+// events succeed without changing anything, so a dry run can go through the code paths of
+// a real run and leave the database as it was.
+func (d *DB) SetReadOnly() {
+	d.Lock()
+	defer d.Unlock()
+	d.readOnly = true
 }
 
 // Lock acquires a write lock.
@@ -101,6 +117,7 @@ func (d *DB) Has(key []byte) bool {
 
 // Get retrieves the value associated with a key and decompresses it if necessary.
 func (d *DB) Get(key []byte) ([]byte, error) {
+	defer trace.StartRegion(context.Background(), "db get").End()
 	d.RLock()
 	value, err := d.db.Get(key)
 	d.RUnlock()
@@ -118,7 +135,9 @@ func (d *DB) Get(key []byte) ([]byte, error) {
 }
 
 // Put compresses and stores a key-value pair in the database.
+// Putting a v_ entry also updates its secondary index keys (see index.go).
 func (d *DB) Put(key []byte, value []byte) error {
+	defer trace.StartRegion(context.Background(), "db put").End()
 	compressedValue, err := compressGzip(value, gzip.BestCompression) // Level 9
 	if err != nil {
 		return fmt.Errorf("error compressing value for key %s: %w", string(key), err)
@@ -126,7 +145,16 @@ func (d *DB) Put(key []byte, value []byte) error {
 
 	// Store the compressed value
 	d.Lock()
-	err = d.db.Put(key, compressedValue)
+	if d.readOnly {
+		d.Unlock()
+		log.Debugf("Read-only database: not writing key %s", string(key))
+		return nil
+	}
+	if isEntryKey(string(key)) {
+		err = d.putIndexed(key, value, compressedValue)
+	} else {
+		err = d.db.Put(key, compressedValue)
+	}
 	d.Unlock()
 	if err != nil {
 		return fmt.Errorf("error putting compressed key %s: %w", string(key), err)
@@ -134,10 +162,20 @@ func (d *DB) Put(key []byte, value []byte) error {
 	return nil
 }
 
-// Delete removes a key from the database.
+// Delete removes a key (and, for a v_ entry, its secondary index keys) from the database.
 func (d *DB) Delete(key []byte) error {
 	d.Lock()
-	err := d.db.Delete(key)
+	if d.readOnly {
+		d.Unlock()
+		log.Debugf("Read-only database: not deleting key %s", string(key))
+		return nil
+	}
+	var err error
+	if isEntryKey(string(key)) {
+		err = d.deleteIndexed(key)
+	} else {
+		err = d.db.Delete(key)
+	}
 	d.Unlock() // Unlock *after* potential error check
 	if err != nil {
 		// Wrap error, check for KeyNotFound if deletion of non-existent key is an error
@@ -153,6 +191,7 @@ func (d *DB) Delete(key []byte) error {
 // Fold iterates over all key-value pairs, decompresses the value,
 // and calls the provided function.
 func (d *DB) Fold(fn func(key []byte, value []byte) error) error {
+	defer trace.StartRegion(context.Background(), "db fold").End()
 	d.RLock()
 	defer d.RUnlock()
 
@@ -325,4 +364,52 @@ func (d *DB) DeletePageState(queryHash string) error {
 	return nil // Treat KeyNotFound as success
 }
 
+// pathOverrideKeyPrefix starts the keys of per-model path overrides, "path_<modelID>".
+const pathOverrideKeyPrefix = "path_"
+
+// GetPathOverride returns the directory (relative to SavePath) a model's files are kept
+// in instead of where PathTemplate puts them, or "" if the model has none.
+func (d *DB) GetPathOverride(modelID int) (string, error) {
+	value, err := d.Get([]byte(pathOverrideKeyPrefix + strconv.Itoa(modelID)))
+	if errors.Is(err, ErrNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("error reading path override of model %d: %w", modelID, err)
+	}
+	return string(value), nil
+}
+
+// SetPathOverride keeps a model's files in dir (relative to SavePath).
+func (d *DB) SetPathOverride(modelID int, dir string) error {
+	return d.Put([]byte(pathOverrideKeyPrefix+strconv.Itoa(modelID)), []byte(dir))
+}
+
+// DeletePathOverride removes a model's path override, if it has one.
+func (d *DB) DeletePathOverride(modelID int) error {
+	err := d.Delete([]byte(pathOverrideKeyPrefix + strconv.Itoa(modelID)))
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return fmt.Errorf("error deleting path override of model %d: %w", modelID, err)
+	}
+	return nil
+}
+
+// PathOverrides returns every path override, by model ID.
+func (d *DB) PathOverrides() (map[int]string, error) {
+	overrides := make(map[int]string)
+	err := d.Fold(func(key []byte, value []byte) error {
+		if !bytes.HasPrefix(key, []byte(pathOverrideKeyPrefix)) {
+			return nil
+		}
+		if modelID, err := strconv.Atoi(string(key[len(pathOverrideKeyPrefix):])); err == nil {
+			overrides[modelID] = string(value)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading path overrides: %w", err)
+	}
+	return overrides, nil
+}
+
 // TODO: Add functions for CLI features like ListModels, GetModelInfo, etc.
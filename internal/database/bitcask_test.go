@@ -0,0 +1,73 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+)
+
+// openTestDB opens a database in a temporary directory, closed when the test ends.
+func openTestDB(t *testing.T) *DB {
+	t.Helper()
+	return openTestDBAt(t, filepath.Join(t.TempDir(), "db"))
+}
+
+// openTestDBAt opens the database at path, closed when the test ends.
+func openTestDBAt(t *testing.T, path string) *DB {
+	t.Helper()
+	db, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// putTestEntry stores entry under key.
+func putTestEntry(t *testing.T, db *DB, key string, entry models.DatabaseEntry) {
+	t.Helper()
+	value, err := json.Marshal(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte(key), value); err != nil {
+		t.Fatalf("Put(%s): %v", key, err)
+	}
+}
+
+func TestSetReadOnly(t *testing.T) {
+	db := openTestDB(t)
+	putTestEntry(t, db, "v_1", models.DatabaseEntry{ModelName: "Kept", Status: models.StatusDownloaded})
+	db.SetReadOnly()
+
+	putTestEntry(t, db, "v_2", models.DatabaseEntry{ModelName: "Planned", Status: models.StatusPending})
+	putTestEntry(t, db, "v_1", models.DatabaseEntry{ModelName: "Changed", Status: models.StatusPending})
+	if err := db.Delete([]byte("v_1")); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	db.RecordEvent(NewHistoryEvent("verify-failed", "v_1", models.DatabaseEntry{}, "test"))
+
+	if _, err := db.Get([]byte("v_2")); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get(v_2) after a read-only Put: err = %v, want ErrNotFound", err)
+	}
+	value, err := db.Get([]byte("v_1"))
+	if err != nil {
+		t.Fatalf("Get(v_1): %v", err)
+	}
+	var entry models.DatabaseEntry
+	if err := json.Unmarshal(value, &entry); err != nil || entry.ModelName != "Kept" {
+		t.Errorf("v_1 = %q (%v), want the entry from before SetReadOnly", entry.ModelName, err)
+	}
+	events, err := db.History(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, event := range events {
+		if event.Event == "verify-failed" {
+			t.Errorf("read-only database recorded a %s event", event.Event)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package database
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// historyKeyPrefix starts the keys of the event log: "hx_<unix nanoseconds><seq>_<entry key>".
+// Events are only ever added, so the log tells what the library held at any past time.
+const historyKeyPrefix = "hx_"
+
+// Kinds of library event.
+const (
+	EventAdded        = "added"         // The entry's file was downloaded (or adopted)
+	EventReplaced     = "replaced"      // A downloaded entry got a different file (new hashes)
+	EventMoved        = "moved"         // A downloaded entry's file moved to another directory or name
+	EventPruned       = "pruned"        // The file was deleted by a policy (status Pruned)
+	EventRemoved      = "removed"       // The entry stopped being downloaded otherwise, or was deleted
+	EventVerifyFailed = "verify-failed" // db verify found the file missing or mismatched
+)
+
+// HistoryEvent is one change of the library, as stored in the event log. It names the file
+// as the entry did at the time, so the log still tells where a file was after the entry
+// changed or disappeared.
+type HistoryEvent struct {
+	Time        time.Time `json:"time"`
+	Key         string    `json:"key"`
+	Event       string    `json:"event"`
+	ModelID     int       `json:"modelId"`
+	ModelName   string    `json:"modelName"`
+	ModelType   string    `json:"modelType,omitempty"`
+	VersionID   int       `json:"versionId"`
+	VersionName string    `json:"versionName,omitempty"`
+	Dir         string    `json:"dir,omitempty"` // Version directory relative to SavePath, or the entry's folder
+	File        string    `json:"file,omitempty"`
+	SHA256      string    `json:"sha256,omitempty"`
+	SizeKB      float64   `json:"sizeKB,omitempty"`
+	Status      string    `json:"status"`
+	Detail      string    `json:"detail,omitempty"`
+	From        string    `json:"from,omitempty"`       // moved: the path before
+	PrevSHA256  string    `json:"prevSha256,omitempty"` // replaced: the SHA256 before
+}
+
+// Path returns the event's file relative to SavePath (or as the entry's folder had it).
+func (e HistoryEvent) Path() string {
+	return filepath.Join(e.Dir, e.File)
+}
+
+// NewHistoryEvent describes an event of the entry stored under key.
+func NewHistoryEvent(kind, key string, entry models.DatabaseEntry, detail string) HistoryEvent {
+	dir := entry.VersionDir
+	if dir == "" {
+		dir = entry.Folder
+	}
+	return HistoryEvent{
+		Time:        time.Now(),
+		Key:         key,
+		Event:       kind,
+		ModelID:     entry.Version.ModelId,
+		ModelName:   entry.ModelName,
+		ModelType:   entry.ModelType,
+		VersionID:   entry.Version.ID,
+		VersionName: entry.Version.Name,
+		Dir:         dir,
+		File:        entry.Filename,
+		SHA256:      strings.ToLower(entry.File.Hashes.SHA256),
+		SizeKB:      entry.File.SizeKB,
+		Status:      entry.Status,
+		Detail:      detail,
+	}
+}
+
+// historySeq keeps the keys of events recorded in the same nanosecond apart.
+var historySeq atomic.Uint32
+
+// historyKey returns the log key of an event.
+func historyKey(event HistoryEvent) string {
+	return fmt.Sprintf("%s%020d%03d_%s", historyKeyPrefix, event.Time.UnixNano(), historySeq.Add(1)%1000, event.Key)
+}
+
+// entryEvents returns the events a write from old to new makes of an entry (old is nil for
+// a new entry, new nil for a deleted one). Only changes of a downloaded file count; the
+// states of downloads that never finished aren't part of the library.
+func entryEvents(key string, old, new *models.DatabaseEntry) []HistoryEvent {
+	wasDownloaded := old != nil && old.Status == models.StatusDownloaded
+	isDownloaded := new != nil && new.Status == models.StatusDownloaded
+	switch {
+	case !wasDownloaded && isDownloaded:
+		return []HistoryEvent{NewHistoryEvent(EventAdded, key, *new, "")}
+	case wasDownloaded && new == nil:
+		return []HistoryEvent{NewHistoryEvent(EventRemoved, key, *old, "entry deleted")}
+	case wasDownloaded && new.Status == models.StatusPruned:
+		return []HistoryEvent{NewHistoryEvent(EventPruned, key, *new, new.ErrorDetails)}
+	case wasDownloaded && !isDownloaded:
+		return []HistoryEvent{NewHistoryEvent(EventRemoved, key, *new, "status "+new.Status)}
+	case !isDownloaded:
+		return nil
+	}
+	before, after := NewHistoryEvent("", key, *old, ""), NewHistoryEvent("", key, *new, "")
+	switch {
+	case before.SHA256 != "" && after.SHA256 != "" && before.SHA256 != after.SHA256:
+		after.Event, after.PrevSHA256 = EventReplaced, before.SHA256
+	case before.Path() != after.Path():
+		after.Event, after.From = EventMoved, before.Path()
+	default:
+		return nil
+	}
+	return []HistoryEvent{after}
+}
+
+// putHistory stores events. The caller must hold the write lock.
+func (d *DB) putHistory(events []HistoryEvent) {
+	if d.historyPaused || d.readOnly {
+		return
+	}
+	for _, event := range events {
+		value, err := json.Marshal(event)
+		if err == nil {
+			var stored []byte
+			if stored, err = compressGzip(value, gzip.BestCompression); err == nil {
+				err = d.db.Put([]byte(historyKey(event)), stored)
+			}
+		}
+		if err != nil {
+			log.WithError(err).Warnf("Failed to record the %s event of %s in the history", event.Event, event.Key)
+		}
+	}
+}
+
+// RecordEvent adds an event that no entry write shows (such as a failed verification) to
+// the history.
+func (d *DB) RecordEvent(event HistoryEvent) {
+	d.Lock()
+	defer d.Unlock()
+	d.putHistory([]HistoryEvent{event})
+}
+
+// History returns the recorded events that match (nil: all), oldest first.
+func (d *DB) History(match func(HistoryEvent) bool) ([]HistoryEvent, error) {
+	type keyed struct {
+		key   string
+		event HistoryEvent
+	}
+	var found []keyed
+	err := d.Fold(func(key []byte, value []byte) error {
+		if !strings.HasPrefix(string(key), historyKeyPrefix) {
+			return nil
+		}
+		var event HistoryEvent
+		if err := json.Unmarshal(value, &event); err != nil {
+			log.WithError(err).Debugf("Skipping unreadable history event %s", key)
+			return nil
+		}
+		if match == nil || match(event) {
+			found = append(found, keyed{string(key), event})
+		}
+		return nil
+	})
+	sort.Slice(found, func(i, j int) bool { return found[i].key < found[j].key }) // Keys start with the time
+	events := make([]HistoryEvent, len(found))
+	for i, f := range found {
+		events[i] = f.event
+	}
+	return events, err
+}
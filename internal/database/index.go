@@ -0,0 +1,261 @@
+package database
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Index names a secondary index over the v_ entries.
+type Index string
+
+// Secondary indexes maintained for every entry.
+const (
+	IndexHash      Index = "h" // Any of the file's hashes (AutoV2, SHA256, CRC32, BLAKE3), published or computed locally
+	IndexCreator   Index = "c" // Creator username
+	IndexType      Index = "t" // Model type, and the detected type if one was inferred
+	IndexBaseModel Index = "b" // Base model of the version
+	IndexTraining  Index = "f" // Training fingerprint of the embedded safetensors metadata
+	IndexTrigger   Index = "w" // Trigger words/phrases, and the activation token of embeddings
+)
+
+// indexKeyPrefix starts every secondary index key. An index key is
+// "ix_<index>_<digest of value>_<entry key>" with an empty value, so a lookup is a prefix
+// scan over keys and never reads entries it doesn't need. The value is stored as a digest
+// to stay within bitcask's 64 byte key limit.
+const indexKeyPrefix = "ix_"
+
+// entryKeyPrefix starts the key of every download entry.
+const entryKeyPrefix = "v_"
+
+// isEntryKey reports whether key holds a DatabaseEntry.
+func isEntryKey(key string) bool {
+	return strings.HasPrefix(key, entryKeyPrefix)
+}
+
+// indexValuePrefix returns the key prefix shared by all index keys for value in idx.
+func indexValuePrefix(idx Index, value string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(value))))
+	return indexKeyPrefix + string(idx) + "_" + hex.EncodeToString(sum[:8]) + "_"
+}
+
+// entryIndexKeys returns the index keys an entry should be reachable under.
+func entryIndexKeys(entryKey string, entry models.DatabaseEntry) map[string]struct{} {
+	keys := make(map[string]struct{})
+	add := func(idx Index, value string) {
+		if strings.TrimSpace(value) != "" {
+			keys[indexValuePrefix(idx, value)+entryKey] = struct{}{}
+		}
+	}
+	hashes := entry.File.Hashes
+	for _, hash := range []string{hashes.AutoV2, hashes.SHA256, hashes.CRC32, hashes.BLAKE3} {
+		add(IndexHash, hash)
+	}
+	for _, hash := range entry.LocalHashes {
+		add(IndexHash, hash)
+	}
+	add(IndexCreator, entry.Creator.Username)
+	add(IndexType, entry.ModelType)
+	add(IndexType, entry.InferredType)
+	add(IndexBaseModel, entry.Version.BaseModel)
+	add(IndexTraining, helpers.TrainingFingerprint(entry.Training))
+	for _, word := range helpers.TriggerPhrases(entry.Version.TrainedWords) {
+		add(IndexTrigger, word)
+	}
+	add(IndexTrigger, helpers.EntryEmbeddingToken(entry))
+	return keys
+}
+
+// storedIndexKeys returns the index keys for the entry currently stored under entryKey.
+// The caller must hold the write lock.
+func (d *DB) storedIndexKeys(entryKey string) map[string]struct{} {
+	entry := d.storedEntry(entryKey)
+	if entry == nil {
+		return nil
+	}
+	return entryIndexKeys(entryKey, *entry)
+}
+
+// storedEntry returns the entry currently stored under entryKey, or nil if there is none
+// that can be read. The caller must hold the write lock.
+func (d *DB) storedEntry(entryKey string) *models.DatabaseEntry {
+	raw, err := d.db.Get([]byte(entryKey))
+	if err != nil {
+		return nil
+	}
+	value, err := decompressIfGzipped(raw)
+	if err != nil {
+		return nil
+	}
+	var entry models.DatabaseEntry
+	if err := json.Unmarshal(value, &entry); err != nil {
+		return nil
+	}
+	return &entry
+}
+
+// putIndexed stores an entry together with its index keys. The caller must hold the write
+// lock. New index keys are written before the entry and stale ones removed after it, so an
+// interrupted write can only leave extra index keys behind (lookups re-check the entry),
+// never an entry that its indexes don't find.
+func (d *DB) putIndexed(key []byte, value []byte, stored []byte) error {
+	var entry models.DatabaseEntry
+	if err := json.Unmarshal(value, &entry); err != nil {
+		// Not an entry we can index; store it as-is
+		return d.db.Put(key, stored)
+	}
+	old := d.storedEntry(string(key))
+	var oldKeys map[string]struct{}
+	if old != nil {
+		oldKeys = entryIndexKeys(string(key), *old)
+	}
+	newKeys := entryIndexKeys(string(key), entry)
+
+	for indexKey := range newKeys {
+		if _, ok := oldKeys[indexKey]; ok {
+			continue
+		}
+		if err := d.db.Put([]byte(indexKey), []byte{}); err != nil {
+			return fmt.Errorf("error writing index key for %s: %w", string(key), err)
+		}
+	}
+	if err := d.db.Put(key, stored); err != nil {
+		return err
+	}
+	d.putHistory(entryEvents(string(key), old, &entry))
+	for indexKey := range oldKeys {
+		if _, ok := newKeys[indexKey]; ok {
+			continue
+		}
+		if err := d.db.Delete([]byte(indexKey)); err != nil {
+			log.WithError(err).Debugf("Failed to remove stale index key for %s", string(key))
+		}
+	}
+	return nil
+}
+
+// deleteIndexed removes an entry and then its index keys. The caller must hold the write lock.
+func (d *DB) deleteIndexed(key []byte) error {
+	old := d.storedEntry(string(key))
+	var oldKeys map[string]struct{}
+	if old != nil {
+		oldKeys = entryIndexKeys(string(key), *old)
+	}
+	if err := d.db.Delete(key); err != nil {
+		return err
+	}
+	d.putHistory(entryEvents(string(key), old, nil))
+	for indexKey := range oldKeys {
+		if err := d.db.Delete([]byte(indexKey)); err != nil {
+			log.WithError(err).Debugf("Failed to remove index key for %s", string(key))
+		}
+	}
+	return nil
+}
+
+// IndexesReady reports whether the secondary indexes cover every entry. They are built when
+// a database is first opened by a release that maintains them (or by `db upgrade`); until
+// then lookups would be incomplete and callers should scan instead.
+func (d *DB) IndexesReady() bool {
+	return d.SchemaVersion() >= CurrentSchemaVersion
+}
+
+// Lookup returns the keys of the entries indexed under value in idx (case-insensitive),
+// ordered by key. Index keys may outlive a change to their entry, so callers should check
+// the field on the entries they load.
+func (d *DB) Lookup(idx Index, value string) ([]string, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	prefix := indexValuePrefix(idx, value)
+	var keys []string
+	d.RLock()
+	err := d.db.Scan([]byte(prefix), func(key []byte) error {
+		keys = append(keys, strings.TrimPrefix(string(key), prefix))
+		return nil
+	})
+	d.RUnlock()
+	if err != nil {
+		return nil, fmt.Errorf("error scanning index %s: %w", idx, err)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// IndexGroups returns the entry keys of every value in idx that at least minSize entries
+// share, e.g. the files with the same training fingerprint. Only index keys are read.
+func (d *DB) IndexGroups(idx Index, minSize int) ([][]string, error) {
+	prefix := indexKeyPrefix + string(idx) + "_"
+	groups := make(map[string][]string)
+	d.RLock()
+	err := d.db.Scan([]byte(prefix), func(key []byte) error {
+		// <prefix><16 hex digits>_<entry key>
+		rest := strings.TrimPrefix(string(key), prefix)
+		digest, entryKey, ok := strings.Cut(rest, "_")
+		if ok {
+			groups[digest] = append(groups[digest], entryKey)
+		}
+		return nil
+	})
+	d.RUnlock()
+	if err != nil {
+		return nil, fmt.Errorf("error scanning index %s: %w", idx, err)
+	}
+
+	var result [][]string
+	for _, keys := range groups {
+		if len(keys) >= minSize {
+			sort.Strings(keys)
+			result = append(result, keys)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i][0] < result[j][0] })
+	return result, nil
+}
+
+// RebuildIndexes drops every secondary index key and re-creates them from the entries.
+// It returns the number of entries indexed.
+func (d *DB) RebuildIndexes() (int, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	var stale [][]byte
+	if err := d.db.Scan([]byte(indexKeyPrefix), func(key []byte) error {
+		stale = append(stale, append([]byte(nil), key...))
+		return nil
+	}); err != nil {
+		return 0, fmt.Errorf("error scanning index keys: %w", err)
+	}
+	for _, key := range stale {
+		if err := d.db.Delete(key); err != nil {
+			return 0, fmt.Errorf("error removing index key %s: %w", string(key), err)
+		}
+	}
+
+	var entryKeys [][]byte
+	if err := d.db.Scan([]byte(entryKeyPrefix), func(key []byte) error {
+		entryKeys = append(entryKeys, append([]byte(nil), key...))
+		return nil
+	}); err != nil {
+		return 0, fmt.Errorf("error scanning entries: %w", err)
+	}
+	indexed := 0
+	for _, key := range entryKeys {
+		for indexKey := range d.storedIndexKeys(string(key)) {
+			if err := d.db.Put([]byte(indexKey), []byte{}); err != nil {
+				return indexed, fmt.Errorf("error writing index key for %s: %w", string(key), err)
+			}
+		}
+		indexed++
+	}
+	log.Debugf("Rebuilt secondary indexes: %d stale keys removed, %d entries indexed", len(stale), indexed)
+	return indexed, nil
+}
@@ -0,0 +1,156 @@
+package database
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+)
+
+// testEntry returns a downloaded entry of version id by creator.
+func testEntry(id int, creator, modelType, sha256 string) models.DatabaseEntry {
+	entry := models.DatabaseEntry{
+		ModelName: "Model",
+		ModelType: modelType,
+		Creator:   models.Creator{Username: creator},
+		Filename:  "model.safetensors",
+		Status:    models.StatusDownloaded,
+	}
+	entry.Version.ID = id
+	entry.Version.BaseModel = "SDXL 1.0"
+	entry.File.Hashes.SHA256 = sha256
+	return entry
+}
+
+// storedIndexKeyList returns every index key in the database, sorted.
+func storedIndexKeyList(t *testing.T, db *DB) []string {
+	t.Helper()
+	var keys []string
+	db.RLock()
+	err := db.db.Scan([]byte(indexKeyPrefix), func(key []byte) error {
+		keys = append(keys, string(key))
+		return nil
+	})
+	db.RUnlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// expectedIndexKeyList returns the index keys of the entries, sorted.
+func expectedIndexKeyList(entries map[string]models.DatabaseEntry) []string {
+	var keys []string
+	for key, entry := range entries {
+		for indexKey := range entryIndexKeys(key, entry) {
+			keys = append(keys, indexKey)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func assertLookup(t *testing.T, db *DB, idx Index, value string, want ...string) {
+	t.Helper()
+	got, err := db.Lookup(idx, value)
+	if err != nil {
+		t.Fatalf("Lookup(%s, %q): %v", idx, value, err)
+	}
+	if len(got) == 0 && len(want) == 0 {
+		return
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Lookup(%s, %q) = %v, want %v", idx, value, got, want)
+	}
+}
+
+func TestIndexedPutUpdateDelete(t *testing.T) {
+	db := openTestDB(t)
+	first := testEntry(1, "alice", "LORA", "AAAA1111")
+	first.LocalHashes = map[string]string{"blake3": "bbbb2222"}
+	second := testEntry(2, "alice", "Checkpoint", "CCCC3333")
+	putTestEntry(t, db, "v_1", first)
+	putTestEntry(t, db, "v_2", second)
+
+	assertLookup(t, db, IndexCreator, "Alice", "v_1", "v_2")
+	assertLookup(t, db, IndexHash, "aaaa1111", "v_1")
+	assertLookup(t, db, IndexHash, "BBBB2222", "v_1")
+	assertLookup(t, db, IndexType, "lora", "v_1")
+	assertLookup(t, db, IndexBaseModel, "SDXL 1.0", "v_1", "v_2")
+	groups, err := db.IndexGroups(IndexCreator, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]string{{"v_1", "v_2"}}; !reflect.DeepEqual(groups, want) {
+		t.Errorf("IndexGroups(creator, 2) = %v, want %v", groups, want)
+	}
+
+	// An update moves the entry to its new index keys and drops the old ones
+	first.Creator.Username = "bob"
+	first.File.Hashes.SHA256 = "DDDD4444"
+	putTestEntry(t, db, "v_1", first)
+	assertLookup(t, db, IndexCreator, "alice", "v_2")
+	assertLookup(t, db, IndexCreator, "bob", "v_1")
+	assertLookup(t, db, IndexHash, "AAAA1111")
+	assertLookup(t, db, IndexHash, "DDDD4444", "v_1")
+	if got, want := storedIndexKeyList(t, db), expectedIndexKeyList(map[string]models.DatabaseEntry{"v_1": first, "v_2": second}); !reflect.DeepEqual(got, want) {
+		t.Errorf("index keys after update = %v, want %v", got, want)
+	}
+
+	// A delete takes the entry's index keys with it
+	if err := db.Delete([]byte("v_1")); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	assertLookup(t, db, IndexCreator, "bob")
+	assertLookup(t, db, IndexHash, "DDDD4444")
+	assertLookup(t, db, IndexHash, "bbbb2222")
+	if got, want := storedIndexKeyList(t, db), expectedIndexKeyList(map[string]models.DatabaseEntry{"v_2": second}); !reflect.DeepEqual(got, want) {
+		t.Errorf("index keys after delete = %v, want %v", got, want)
+	}
+}
+
+func TestRebuildIndexes(t *testing.T) {
+	db := openTestDB(t)
+	entries := map[string]models.DatabaseEntry{
+		"v_1": testEntry(1, "alice", "LORA", "AAAA1111"),
+		"v_2": testEntry(2, "bob", "Checkpoint", "CCCC3333"),
+	}
+	for key, entry := range entries {
+		putTestEntry(t, db, key, entry)
+	}
+	if err := db.Put([]byte("current_page_abc"), []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Lose an index key and leave a dangling one behind, as an interrupted write could
+	missing := indexValuePrefix(IndexCreator, "alice") + "v_1"
+	dangling := indexValuePrefix(IndexCreator, "ghost") + "v_9"
+	db.Lock()
+	if err := db.db.Delete([]byte(missing)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.db.Put([]byte(dangling), []byte{}); err != nil {
+		t.Fatal(err)
+	}
+	db.Unlock()
+	assertLookup(t, db, IndexCreator, "alice")
+	assertLookup(t, db, IndexCreator, "ghost", "v_9")
+
+	indexed, err := db.RebuildIndexes()
+	if err != nil {
+		t.Fatalf("RebuildIndexes: %v", err)
+	}
+	if indexed != len(entries) {
+		t.Errorf("RebuildIndexes indexed %d entries, want %d", indexed, len(entries))
+	}
+	if got, want := storedIndexKeyList(t, db), expectedIndexKeyList(entries); !reflect.DeepEqual(got, want) {
+		t.Errorf("index keys after rebuild = %v, want %v", got, want)
+	}
+	assertLookup(t, db, IndexCreator, "alice", "v_1")
+	assertLookup(t, db, IndexCreator, "ghost")
+	if page, err := db.GetPageState("abc"); err != nil || page != 3 {
+		t.Errorf("page state after rebuild = %d (%v), want 3", page, err)
+	}
+}
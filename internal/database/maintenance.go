@@ -0,0 +1,278 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Stats describes the size of the store on disk.
+type Stats struct {
+	Keys        int
+	Datafiles   int
+	Size        int64 // Bytes on disk
+	Reclaimable int64 // Bytes held by overwritten and deleted records
+}
+
+// Stats returns the size of the store on disk.
+func (d *DB) Stats() (Stats, error) {
+	d.RLock()
+	defer d.RUnlock()
+	stats, err := d.db.Stats()
+	if err != nil {
+		return Stats{}, fmt.Errorf("error reading database stats: %w", err)
+	}
+	return Stats{Keys: stats.Keys, Datafiles: stats.Datafiles, Size: stats.Size, Reclaimable: d.db.Reclaimable()}, nil
+}
+
+// Compact rewrites the store with only the current value of every key. Bitcask appends
+// every write, so a database that is updated often grows far beyond its content until it
+// is compacted. It returns the stats before and after.
+func (d *DB) Compact() (before, after Stats, err error) {
+	if before, err = d.Stats(); err != nil {
+		return before, after, err
+	}
+	d.Lock()
+	err = d.db.Merge()
+	d.Unlock()
+	if err != nil {
+		return before, after, fmt.Errorf("error compacting database: %w", err)
+	}
+	after, err = d.Stats()
+	return before, after, err
+}
+
+// Fsck problem kinds.
+const (
+	FsckUnreadable    = "unreadable"     // The record fails its checksum or cannot be decompressed
+	FsckInvalidJSON   = "invalid-json"   // An entry that isn't a DatabaseEntry
+	FsckKeyMismatch   = "key-mismatch"   // The entry's version ID doesn't match its key
+	FsckMissingStatus = "missing-status" // An entry without a status (older release)
+	FsckUnknownStatus = "unknown-status" // A status this release doesn't know
+	FsckNoFilename    = "no-filename"    // A Downloaded entry without a file name
+	FsckStaleError    = "stale-error"    // An error category or reason without error details
+	FsckIndex         = "index"          // Missing or dangling secondary index keys
+	FsckInternal      = "internal"       // A bookkeeping key with an invalid value
+	FsckLegacyKey     = "legacy-key"     // An entry under an old-style key (see Upgrade)
+	FsckUnknownKey    = "unknown-key"    // A key that is neither an entry nor bookkeeping
+)
+
+// FsckIssue is one problem found by Fsck.
+type FsckIssue struct {
+	Key     string
+	Kind    string
+	Detail  string
+	Fixable bool // Repair fixes it
+	Fixed   bool
+}
+
+// FsckReport is the result of Fsck.
+type FsckReport struct {
+	Keys       int
+	Entries    int
+	BackupPath string // Set when Repair took a backup
+	Issues     []FsckIssue
+}
+
+// Unfixed returns the issues that are still there after the check (all of them without
+// repair).
+func (r FsckReport) Unfixed() []FsckIssue {
+	var unfixed []FsckIssue
+	for _, issue := range r.Issues {
+		if !issue.Fixed {
+			unfixed = append(unfixed, issue)
+		}
+	}
+	return unfixed
+}
+
+var knownStatuses = map[string]bool{
+	models.StatusPending: true, models.StatusDownloading: true, models.StatusDownloaded: true, models.StatusError: true,
+	models.StatusCataloged: true, models.StatusDeferred: true, models.StatusPruned: true,
+}
+
+// Fsck reads every record and checks that it decodes and that entries, indexes and
+// bookkeeping keys are consistent. With repair it first backs the database up to dbPath's
+// backup location, then fixes what can be fixed without guessing: missing version IDs and
+// statuses are filled in from the key and the old default, stale error fields cleared,
+// invalid page states and schema stamps rewritten and the indexes rebuilt. Unreadable
+// records and entries whose contents contradict their key are only reported.
+func (d *DB) Fsck(dbPath string, repair bool) (FsckReport, error) {
+	var report FsckReport
+
+	d.RLock()
+	var keys []string
+	err := d.db.Fold(func(key []byte) error {
+		keys = append(keys, string(key))
+		return nil
+	})
+	d.RUnlock()
+	if err != nil {
+		return report, fmt.Errorf("error listing database keys: %w", err)
+	}
+	report.Keys = len(keys)
+
+	type fix struct {
+		issue int
+		apply func() error
+	}
+	var fixes []fix
+	add := func(key, kind, detail string, apply func() error) {
+		report.Issues = append(report.Issues, FsckIssue{Key: key, Kind: kind, Detail: detail, Fixable: apply != nil})
+		if apply != nil {
+			fixes = append(fixes, fix{issue: len(report.Issues) - 1, apply: apply})
+		}
+	}
+
+	entries := make(map[string]models.DatabaseEntry)
+	var indexKeys []string
+	for _, key := range keys {
+		if strings.HasPrefix(key, indexKeyPrefix) {
+			indexKeys = append(indexKeys, key)
+			continue
+		}
+		d.RLock()
+		raw, err := d.db.Get([]byte(key))
+		d.RUnlock()
+		if err != nil {
+			add(key, FsckUnreadable, err.Error(), nil)
+			continue
+		}
+		value, err := decompressIfGzipped(raw)
+		if err != nil {
+			add(key, FsckUnreadable, err.Error(), nil)
+			continue
+		}
+
+		switch {
+		case key == SchemaVersionKey:
+			if _, err := strconv.Atoi(string(value)); err != nil {
+				add(key, FsckInternal, fmt.Sprintf("schema version %q is not a number", value), func() error {
+					return d.Put([]byte(SchemaVersionKey), []byte(strconv.Itoa(CurrentSchemaVersion)))
+				})
+			}
+			continue
+		case strings.HasPrefix(key, "current_page_"):
+			if _, err := strconv.Atoi(string(value)); err != nil {
+				// A lost page state only means the next run starts at page 1
+				add(key, FsckInternal, fmt.Sprintf("page state %q is not a number", value), func() error { return d.Delete([]byte(key)) })
+			}
+			continue
+		case strings.HasPrefix(key, pathOverrideKeyPrefix):
+			_, idErr := strconv.Atoi(strings.TrimPrefix(key, pathOverrideKeyPrefix))
+			dir := string(value)
+			if idErr != nil || dir == "" || !filepath.IsLocal(dir) {
+				add(key, FsckInternal, fmt.Sprintf("invalid path override %q; check it with 'db set-path'", dir), nil)
+			}
+			continue
+		case isInternalKey(key):
+			continue
+		}
+
+		var entry models.DatabaseEntry
+		if err := json.Unmarshal(value, &entry); err != nil {
+			kind := FsckInvalidJSON
+			if !isEntryKey(key) {
+				kind = FsckUnknownKey
+			}
+			add(key, kind, err.Error(), nil)
+			continue
+		}
+		if !isEntryKey(key) {
+			add(key, FsckLegacyKey, "entry under an old-style key; run 'db upgrade'", nil)
+			continue
+		}
+		report.Entries++
+		entries[key] = entry
+		d.checkEntry(key, entry, add)
+	}
+
+	// Every entry must be reachable through its index keys, and every index key must point
+	// at an entry that has it
+	expected := make(map[string]bool)
+	missingIndex := 0
+	for key, entry := range entries {
+		for indexKey := range entryIndexKeys(key, entry) {
+			expected[indexKey] = true
+			if !d.Has([]byte(indexKey)) {
+				missingIndex++
+			}
+		}
+	}
+	dangling := 0
+	for _, key := range indexKeys {
+		if !expected[key] {
+			dangling++
+		}
+	}
+	if missingIndex > 0 || dangling > 0 {
+		add(indexKeyPrefix+"*", FsckIndex, fmt.Sprintf("%d missing and %d dangling index keys", missingIndex, dangling), func() error {
+			_, err := d.RebuildIndexes()
+			return err
+		})
+	}
+
+	if !repair || len(fixes) == 0 {
+		return report, nil
+	}
+	report.BackupPath, err = d.Backup(dbPath)
+	if err != nil {
+		return report, err
+	}
+	log.Infof("Database backed up to %s", report.BackupPath)
+	for _, f := range fixes {
+		if err := f.apply(); err != nil {
+			issue := report.Issues[f.issue]
+			return report, fmt.Errorf("failed to repair %s (%s): %w", issue.Key, issue.Kind, err)
+		}
+		report.Issues[f.issue].Fixed = true
+	}
+	return report, nil
+}
+
+// checkEntry checks the fields of an entry that other code relies on.
+func (d *DB) checkEntry(key string, entry models.DatabaseEntry, add func(key, kind, detail string, apply func() error)) {
+	// Repairs re-read the entry, so fixes of the same entry build on each other
+	update := func(change func(*models.DatabaseEntry)) func() error {
+		return func() error {
+			current, err := d.getEntry(key)
+			if err != nil {
+				return err
+			}
+			change(&current)
+			return d.putEntry(key, current)
+		}
+	}
+
+	if id, err := strconv.Atoi(strings.TrimPrefix(key, entryKeyPrefix)); err != nil {
+		add(key, FsckKeyMismatch, "the key holds no version ID", nil)
+	} else if entry.Version.ID == 0 {
+		add(key, FsckKeyMismatch, "the entry has no version ID", update(func(e *models.DatabaseEntry) { e.Version.ID = id }))
+	} else if entry.Version.ID != id {
+		add(key, FsckKeyMismatch, fmt.Sprintf("the entry is for version %d", entry.Version.ID), nil)
+	}
+
+	switch {
+	case entry.Status == "":
+		// Older releases only recorded completed downloads (as Upgrade assumes)
+		add(key, FsckMissingStatus, "no status", update(func(e *models.DatabaseEntry) { e.Status = models.StatusDownloaded }))
+	case !knownStatuses[entry.Status]:
+		add(key, FsckUnknownStatus, fmt.Sprintf("status %q", entry.Status), nil)
+	case entry.Status == models.StatusDownloaded && entry.Filename == "":
+		add(key, FsckNoFilename, "Downloaded without a file name; 'db redownload' it", nil)
+	}
+
+	if entry.ErrorDetails == "" && (entry.ErrorCategory != "" || entry.ErrorReason != "") {
+		add(key, FsckStaleError, "error category without error details", update(func(e *models.DatabaseEntry) {
+			if e.ErrorDetails == "" {
+				e.ErrorCategory, e.ErrorReason = "", ""
+			}
+		}))
+	}
+}
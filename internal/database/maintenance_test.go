@@ -0,0 +1,139 @@
+package database
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+)
+
+// fsckIssues lists the issues of report as "<key> <kind>", marked "(fixable)" or
+// "(fixed)", sorted.
+func fsckIssues(report FsckReport) []string {
+	var issues []string
+	for _, issue := range report.Issues {
+		state := ""
+		switch {
+		case issue.Fixed:
+			state = " (fixed)"
+		case issue.Fixable:
+			state = " (fixable)"
+		}
+		issues = append(issues, fmt.Sprintf("%s %s%s", issue.Key, issue.Kind, state))
+	}
+	sort.Strings(issues)
+	return issues
+}
+
+func TestFsck(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db := openTestDBAt(t, path)
+
+	putTestEntry(t, db, "v_1", testEntry(1, "alice", "LORA", "AAAA1111"))
+	noID := testEntry(0, "alice", "LORA", "BBBB2222")
+	putTestEntry(t, db, "v_2", noID)
+	putTestEntry(t, db, "v_3", testEntry(4, "alice", "LORA", "CCCC3333"))
+	noStatus := testEntry(5, "alice", "LORA", "")
+	noStatus.Status = ""
+	putTestEntry(t, db, "v_5", noStatus)
+	unknown := testEntry(6, "alice", "LORA", "")
+	unknown.Status = "Paused"
+	putTestEntry(t, db, "v_6", unknown)
+	noFilename := testEntry(7, "alice", "LORA", "")
+	noFilename.Filename = ""
+	putTestEntry(t, db, "v_7", noFilename)
+	staleError := testEntry(8, "alice", "LORA", "")
+	staleError.Status = models.StatusError
+	staleError.ErrorCategory = "network"
+	putTestEntry(t, db, "v_8", staleError)
+	for key, value := range map[string]string{
+		"v_9":              "not json",
+		"junk":             "not json either",
+		"current_page_abc": "three",
+		"path_12":          "../outside",
+	} {
+		if err := db.Put([]byte(key), []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	putTestEntry(t, db, "ABCD1234", testEntry(10, "carol", "LORA", ""))
+	db.Lock()
+	if err := db.db.Put([]byte(indexValuePrefix(IndexCreator, "ghost")+"v_99"), []byte{}); err != nil {
+		t.Fatal(err)
+	}
+	db.Unlock()
+
+	report, err := db.Fsck(path, false)
+	if err != nil {
+		t.Fatalf("Fsck: %v", err)
+	}
+	want := []string{
+		"ABCD1234 " + FsckLegacyKey,
+		"current_page_abc " + FsckInternal + " (fixable)",
+		"ix_* " + FsckIndex + " (fixable)",
+		"junk " + FsckUnknownKey,
+		"path_12 " + FsckInternal,
+		"v_2 " + FsckKeyMismatch + " (fixable)",
+		"v_3 " + FsckKeyMismatch,
+		"v_5 " + FsckMissingStatus + " (fixable)",
+		"v_6 " + FsckUnknownStatus,
+		"v_7 " + FsckNoFilename,
+		"v_8 " + FsckStaleError + " (fixable)",
+		"v_9 " + FsckInvalidJSON,
+	}
+	if got := fsckIssues(report); !reflect.DeepEqual(got, want) {
+		t.Errorf("issues =\n%q\nwant\n%q", got, want)
+	}
+	if report.Entries != 7 || report.BackupPath != "" {
+		t.Errorf("report checked %d entries (backup %q), want 7 and no backup", report.Entries, report.BackupPath)
+	}
+	if len(report.Unfixed()) != len(report.Issues) {
+		t.Errorf("Unfixed() = %d issues without repair, want all %d", len(report.Unfixed()), len(report.Issues))
+	}
+
+	repaired, err := db.Fsck(path, true)
+	if err != nil {
+		t.Fatalf("Fsck with repair: %v", err)
+	}
+	if repaired.BackupPath == "" {
+		t.Error("repair took no backup")
+	}
+	for _, issue := range repaired.Issues {
+		if issue.Fixed != issue.Fixable {
+			t.Errorf("%s %s: fixed = %v, fixable = %v", issue.Key, issue.Kind, issue.Fixed, issue.Fixable)
+		}
+	}
+	if entry, err := db.getEntry("v_2"); err != nil || entry.Version.ID != 2 {
+		t.Errorf("v_2 version ID after repair = %d (%v), want 2", entry.Version.ID, err)
+	}
+	if entry, err := db.getEntry("v_5"); err != nil || entry.Status != models.StatusDownloaded {
+		t.Errorf("v_5 status after repair = %q (%v), want %s", entry.Status, err, models.StatusDownloaded)
+	}
+	if entry, err := db.getEntry("v_8"); err != nil || entry.ErrorCategory != "" || entry.Status != models.StatusError {
+		t.Errorf("v_8 after repair = %+v (%v), want the error category cleared", entry, err)
+	}
+	if db.Has([]byte("current_page_abc")) {
+		t.Error("invalid page state survived the repair")
+	}
+
+	// What is left needs a person (or 'db upgrade')
+	after, err := db.Fsck(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []string{
+		"ABCD1234 " + FsckLegacyKey,
+		"junk " + FsckUnknownKey,
+		"path_12 " + FsckInternal,
+		"v_3 " + FsckKeyMismatch,
+		"v_6 " + FsckUnknownStatus,
+		"v_7 " + FsckNoFilename,
+		"v_9 " + FsckInvalidJSON,
+	}
+	if got := fsckIssues(after); !reflect.DeepEqual(got, want) {
+		t.Errorf("issues after repair =\n%q\nwant\n%q", got, want)
+	}
+}
@@ -0,0 +1,251 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SchemaVersionKey stores the layout version of the database.
+const SchemaVersionKey = "schema_version"
+
+// CurrentSchemaVersion is the layout written by this release:
+//
+//	1 - (older releases) entries keyed by the upper-case CRC32 of the file, no status field
+//	2 - entries keyed by "v_<modelVersionID>" with a status, page state under "current_page_<hash>"
+//	3 - as 2, plus secondary index keys under "ix_" (by hash, creator, type, base model, training)
+//	4 - as 3, plus the trigger index (trigger words and embedding tokens)
+//	5 - as 4, with the locally computed hashes (localHashes) in the hash index
+const CurrentSchemaVersion = 5
+
+// LegacyReport describes data found in a database that predates CurrentSchemaVersion.
+type LegacyReport struct {
+	SchemaVersion   int      // Stored schema version (0 if never stamped)
+	LegacyKeys      []string // Entries stored under old-style (CRC32) keys
+	MissingStatus   []string // v_ entries written before the status field existed
+	UnreadableKeys  []string // Keys that hold neither a known internal value nor an entry
+	VersionedChecks int      // Number of v_ entries inspected
+}
+
+// NeedsUpgrade reports whether `db upgrade` has anything to do.
+func (r LegacyReport) NeedsUpgrade() bool {
+	return len(r.LegacyKeys) > 0 || len(r.MissingStatus) > 0 || r.SchemaVersion < CurrentSchemaVersion
+}
+
+// UpgradeResult summarises a completed migration.
+type UpgradeResult struct {
+	BackupPath     string
+	Migrated       int // Legacy keys moved to v_<id>
+	AlreadyPresent int // Legacy keys dropped because a v_<id> entry already existed
+	StatusFilled   int // Entries that had their missing status set
+	Skipped        []string
+}
+
+// SchemaVersion returns the stored schema version, or 0 if the database was never stamped.
+func (d *DB) SchemaVersion() int {
+	value, err := d.Get([]byte(SchemaVersionKey))
+	if err != nil {
+		return 0
+	}
+	version, err := strconv.Atoi(string(value))
+	if err != nil {
+		return 0
+	}
+	return version
+}
+
+// isInternalKey reports whether a key is bookkeeping rather than a download entry.
+func isInternalKey(key string) bool {
+	return key == SchemaVersionKey || strings.HasPrefix(key, "current_page_") || strings.HasPrefix(key, indexKeyPrefix) ||
+		strings.HasPrefix(key, pathOverrideKeyPrefix) || strings.HasPrefix(key, historyKeyPrefix)
+}
+
+// DetectLegacy scans the database for entries written by older releases.
+func (d *DB) DetectLegacy() (LegacyReport, error) {
+	report := LegacyReport{SchemaVersion: d.SchemaVersion()}
+
+	err := d.Fold(func(key []byte, value []byte) error {
+		keyStr := string(key)
+		if isInternalKey(keyStr) {
+			return nil
+		}
+
+		var entry models.DatabaseEntry
+		if err := json.Unmarshal(value, &entry); err != nil {
+			report.UnreadableKeys = append(report.UnreadableKeys, keyStr)
+			return nil
+		}
+
+		if strings.HasPrefix(keyStr, "v_") {
+			report.VersionedChecks++
+			if entry.Status == "" {
+				report.MissingStatus = append(report.MissingStatus, keyStr)
+			}
+			return nil
+		}
+		// Anything else holding a DatabaseEntry is from the old CRC32-keyed layout
+		report.LegacyKeys = append(report.LegacyKeys, keyStr)
+		return nil
+	})
+	if err != nil {
+		return report, fmt.Errorf("error scanning database for legacy entries: %w", err)
+	}
+	return report, nil
+}
+
+// CheckLayout is called after opening a database. Fresh and already-stamped databases are
+// left alone; an older database is scanned and, if it has nothing to migrate, its secondary
+// indexes are built and it is stamped. Otherwise a warning points the user at `db upgrade`.
+func (d *DB) CheckLayout(path string) {
+	if d.SchemaVersion() >= CurrentSchemaVersion {
+		return
+	}
+	d.RLock()
+	empty := d.db.Len() == 0
+	d.RUnlock()
+	if empty {
+		d.stampSchemaVersion()
+		return
+	}
+
+	report, err := d.DetectLegacy()
+	if err != nil {
+		log.WithError(err).Warn("Could not check database layout")
+		return
+	}
+	if len(report.LegacyKeys) == 0 && len(report.MissingStatus) == 0 {
+		log.Infof("Building secondary indexes for %d database entries (one-time)...", report.VersionedChecks)
+		if _, err := d.RebuildIndexes(); err != nil {
+			log.WithError(err).Warn("Could not build database indexes; commands will scan the whole database")
+			return
+		}
+		d.stampSchemaVersion()
+		return
+	}
+	log.Warnf("Database at %s was written by an older release: %d entries use legacy keys and %d have no status.",
+		path, len(report.LegacyKeys), len(report.MissingStatus))
+	log.Warn("These files may not be recognised as downloaded and could be fetched again. Run 'civitai-downloader db upgrade' to migrate them in place (a backup is taken first).")
+}
+
+func (d *DB) stampSchemaVersion() {
+	if err := d.Put([]byte(SchemaVersionKey), []byte(strconv.Itoa(CurrentSchemaVersion))); err != nil {
+		log.WithError(err).Warn("Failed to record database schema version")
+	}
+}
+
+// Backup copies the database to a timestamped directory next to it and returns the path.
+func (d *DB) Backup(dbPath string) (string, error) {
+	backupPath := fmt.Sprintf("%s.backup-%s", filepath.Clean(dbPath), time.Now().Format("20060102-150405"))
+	if _, err := os.Stat(backupPath); err == nil {
+		return "", fmt.Errorf("backup destination %s already exists", backupPath)
+	}
+	if err := d.db.Backup(backupPath); err != nil {
+		return "", fmt.Errorf("failed to back up database to %s: %w", backupPath, err)
+	}
+	return backupPath, nil
+}
+
+// Upgrade migrates legacy entries in place after taking a backup:
+// CRC32-keyed entries are moved to v_<modelVersionID>, entries without a status are marked
+// Downloaded (older releases only recorded completed downloads), the secondary indexes are
+// rebuilt and the schema version is stamped.
+func (d *DB) Upgrade(dbPath string) (UpgradeResult, error) {
+	var result UpgradeResult
+
+	report, err := d.DetectLegacy()
+	if err != nil {
+		return result, err
+	}
+
+	result.BackupPath, err = d.Backup(dbPath)
+	if err != nil {
+		return result, err
+	}
+	log.Infof("Database backed up to %s", result.BackupPath)
+	// Migrated entries were downloaded long ago, not now
+	d.Lock()
+	d.historyPaused = true
+	d.Unlock()
+	defer func() {
+		d.Lock()
+		d.historyPaused = false
+		d.Unlock()
+	}()
+
+	for _, key := range report.LegacyKeys {
+		entry, err := d.getEntry(key)
+		if err != nil {
+			result.Skipped = append(result.Skipped, fmt.Sprintf("%s (%v)", key, err))
+			continue
+		}
+		if entry.Version.ID == 0 {
+			result.Skipped = append(result.Skipped, fmt.Sprintf("%s (no model version ID in entry)", key))
+			continue
+		}
+
+		newKey := fmt.Sprintf("v_%d", entry.Version.ID)
+		if d.Has([]byte(newKey)) {
+			// A newer release already tracked this version; its entry wins
+			result.AlreadyPresent++
+		} else {
+			if entry.Status == "" {
+				entry.Status = models.StatusDownloaded
+			}
+			if err := d.putEntry(newKey, entry); err != nil {
+				return result, fmt.Errorf("failed migrating %s to %s: %w", key, newKey, err)
+			}
+			result.Migrated++
+			log.Debugf("Migrated legacy key %s -> %s", key, newKey)
+		}
+		if err := d.Delete([]byte(key)); err != nil {
+			return result, fmt.Errorf("failed removing legacy key %s: %w", key, err)
+		}
+	}
+
+	for _, key := range report.MissingStatus {
+		entry, err := d.getEntry(key)
+		if err != nil {
+			result.Skipped = append(result.Skipped, fmt.Sprintf("%s (%v)", key, err))
+			continue
+		}
+		entry.Status = models.StatusDownloaded
+		if err := d.putEntry(key, entry); err != nil {
+			return result, fmt.Errorf("failed updating status for %s: %w", key, err)
+		}
+		result.StatusFilled++
+	}
+
+	if _, err := d.RebuildIndexes(); err != nil {
+		return result, err
+	}
+	d.stampSchemaVersion()
+	return result, nil
+}
+
+func (d *DB) getEntry(key string) (models.DatabaseEntry, error) {
+	var entry models.DatabaseEntry
+	value, err := d.Get([]byte(key))
+	if err != nil {
+		return entry, err
+	}
+	if err := json.Unmarshal(value, &entry); err != nil {
+		return entry, fmt.Errorf("invalid entry JSON: %w", err)
+	}
+	return entry, nil
+}
+
+func (d *DB) putEntry(key string, entry models.DatabaseEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("error marshalling entry: %w", err)
+	}
+	return d.Put([]byte(key), data)
+}
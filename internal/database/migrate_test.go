@@ -0,0 +1,160 @@
+package database
+
+import (
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+)
+
+// unstamp makes db look like one written by an older release: no schema version and no
+// secondary indexes.
+func unstamp(t *testing.T, db *DB) {
+	t.Helper()
+	if err := db.Delete([]byte(SchemaVersionKey)); err != nil {
+		t.Fatal(err)
+	}
+	db.Lock()
+	defer db.Unlock()
+	var keys [][]byte
+	if err := db.db.Scan([]byte(indexKeyPrefix), func(key []byte) error {
+		keys = append(keys, append([]byte(nil), key...))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if err := db.db.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCheckLayoutIndexesCurrentEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db := openTestDBAt(t, path)
+	if got := db.SchemaVersion(); got != CurrentSchemaVersion {
+		t.Errorf("new database schema version = %d, want %d", got, CurrentSchemaVersion)
+	}
+	entries := map[string]models.DatabaseEntry{
+		"v_1": testEntry(1, "alice", "LORA", "AAAA1111"),
+		"v_2": testEntry(2, "bob", "Checkpoint", "CCCC3333"),
+	}
+	for key, entry := range entries {
+		putTestEntry(t, db, key, entry)
+	}
+	unstamp(t, db)
+	db.Close()
+
+	db = openTestDBAt(t, path)
+	if !db.IndexesReady() {
+		t.Errorf("schema version after reopening = %d, want %d", db.SchemaVersion(), CurrentSchemaVersion)
+	}
+	if got, want := storedIndexKeyList(t, db), expectedIndexKeyList(entries); !reflect.DeepEqual(got, want) {
+		t.Errorf("index keys after reopening = %v, want %v", got, want)
+	}
+}
+
+func TestUpgradeLegacyDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db")
+	db := openTestDBAt(t, path)
+
+	current := testEntry(2, "alice", "LORA", "CCCC3333")
+	putTestEntry(t, db, "v_2", current)
+	noStatus := testEntry(3, "alice", "LORA", "DDDD4444")
+	noStatus.Status = ""
+	putTestEntry(t, db, "v_3", noStatus)
+	// CRC32-keyed entries of the first layout, which had no status
+	legacy := testEntry(10, "carol", "LORA", "AAAA1111")
+	legacy.Status = ""
+	putTestEntry(t, db, "ABCD1234", legacy)
+	duplicate := testEntry(2, "someone", "LORA", "CCCC3333")
+	duplicate.Status = ""
+	putTestEntry(t, db, "EEEE5555", duplicate)
+	putTestEntry(t, db, "FFFF6666", models.DatabaseEntry{ModelName: "No version"})
+	if err := db.Put([]byte("junk"), []byte("not an entry")); err != nil {
+		t.Fatal(err)
+	}
+	unstamp(t, db)
+	db.Close()
+
+	// Legacy entries keep the layout from being stamped when it is opened
+	db = openTestDBAt(t, path)
+	if db.IndexesReady() {
+		t.Fatal("database with legacy entries was stamped when opened")
+	}
+	report, err := db.DetectLegacy()
+	if err != nil {
+		t.Fatalf("DetectLegacy: %v", err)
+	}
+	sort.Strings(report.LegacyKeys)
+	if want := []string{"ABCD1234", "EEEE5555", "FFFF6666"}; !reflect.DeepEqual(report.LegacyKeys, want) {
+		t.Errorf("legacy keys = %v, want %v", report.LegacyKeys, want)
+	}
+	if want := []string{"v_3"}; !reflect.DeepEqual(report.MissingStatus, want) {
+		t.Errorf("entries missing a status = %v, want %v", report.MissingStatus, want)
+	}
+	if want := []string{"junk"}; !reflect.DeepEqual(report.UnreadableKeys, want) {
+		t.Errorf("unreadable keys = %v, want %v", report.UnreadableKeys, want)
+	}
+	if report.VersionedChecks != 2 || report.SchemaVersion != 0 || !report.NeedsUpgrade() {
+		t.Errorf("report = %+v, want 2 versioned entries, schema 0 and an upgrade needed", report)
+	}
+
+	result, err := db.Upgrade(path)
+	if err != nil {
+		t.Fatalf("Upgrade: %v", err)
+	}
+	if result.Migrated != 1 || result.AlreadyPresent != 1 || result.StatusFilled != 1 || len(result.Skipped) != 1 || !strings.HasPrefix(result.Skipped[0], "FFFF6666") {
+		t.Errorf("result = %+v, want 1 migrated, 1 already present, 1 status filled and FFFF6666 skipped", result)
+	}
+	if !db.IndexesReady() {
+		t.Errorf("schema version after Upgrade = %d, want %d", db.SchemaVersion(), CurrentSchemaVersion)
+	}
+
+	migrated, err := db.getEntry("v_10")
+	if err != nil {
+		t.Fatalf("migrated entry: %v", err)
+	}
+	if migrated.Status != models.StatusDownloaded || migrated.Creator.Username != "carol" {
+		t.Errorf("migrated entry = %+v, want carol's entry marked Downloaded", migrated)
+	}
+	if kept, err := db.getEntry("v_2"); err != nil || kept.Creator.Username != "alice" {
+		t.Errorf("v_2 = %q (%v), want the entry that was already there", kept.Creator.Username, err)
+	}
+	if filled, err := db.getEntry("v_3"); err != nil || filled.Status != models.StatusDownloaded {
+		t.Errorf("v_3 status = %q (%v), want %s", filled.Status, err, models.StatusDownloaded)
+	}
+	for _, key := range []string{"ABCD1234", "EEEE5555"} {
+		if db.Has([]byte(key)) {
+			t.Errorf("legacy key %s is still there", key)
+		}
+	}
+	assertLookup(t, db, IndexHash, "AAAA1111", "v_10")
+	assertLookup(t, db, IndexCreator, "alice", "v_2", "v_3")
+	events, err := db.History(func(e HistoryEvent) bool { return e.Key == "v_10" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) > 0 {
+		t.Errorf("Upgrade recorded %d history events for the migrated entry, want none", len(events))
+	}
+
+	after, err := db.DetectLegacy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(after.LegacyKeys, []string{"FFFF6666"}) || len(after.MissingStatus) > 0 {
+		t.Errorf("after Upgrade: legacy keys %v, missing status %v; want only the skipped key", after.LegacyKeys, after.MissingStatus)
+	}
+
+	// The backup is the database as it was before
+	db.Close()
+	backup := openTestDBAt(t, result.BackupPath)
+	if !backup.Has([]byte("ABCD1234")) || backup.Has([]byte("v_10")) {
+		t.Error("backup doesn't hold the database from before the upgrade")
+	}
+}
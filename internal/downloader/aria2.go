@@ -0,0 +1,329 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/failure"
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// aria2PollInterval is how often the status of a download handed to aria2 is asked for.
+var aria2PollInterval = time.Second
+
+// aria2PartSuffix is appended to the staging path of a file downloaded by aria2. It differs
+// from the built-in downloader's .part, whose checkpoints aria2 can't read (and aria2's
+// .aria2 control file the other way round).
+const aria2PartSuffix = ".aria2.part"
+
+// Aria2 is a running aria2c reached over its JSON-RPC interface (aria2c --enable-rpc).
+// Downloads handed to it (see SetAria2) are transferred by aria2 with its own connections,
+// splitting and resume, then verified and moved into place as usual.
+type Aria2 struct {
+	endpoint string // e.g. http://localhost:6800/jsonrpc
+	secret   string // --rpc-secret, if aria2c was started with one
+	client   *http.Client
+}
+
+// NewAria2 returns the aria2c RPC interface at endpoint. A nil client is a plain one with a
+// short timeout; RPC calls are small.
+func NewAria2(endpoint, secret string, client *http.Client) *Aria2 {
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	return &Aria2{endpoint: endpoint, secret: secret, client: client}
+}
+
+// SetAria2 makes the downloader hand transfers to aria2 instead of making them itself. The
+// file is staged by aria2 in the temp dir (or next to the target), so aria2c must see the
+// same paths as this process. A nil a goes back to the built-in transfers.
+func (d *Downloader) SetAria2(a *Aria2) {
+	d.aria2 = a
+}
+
+// aria2Status is the part of aria2.tellStatus the downloader reads.
+type aria2Status struct {
+	Status          string `json:"status"` // active, waiting, paused, error, complete or removed
+	TotalLength     string `json:"totalLength"`
+	CompletedLength string `json:"completedLength"`
+	Connections     string `json:"connections"`
+	ErrorCode       string `json:"errorCode"`
+	ErrorMessage    string `json:"errorMessage"`
+}
+
+// aria2Error is an error answered by aria2's RPC interface.
+type aria2Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *aria2Error) Error() string { return fmt.Sprintf("aria2 error %d: %s", e.Code, e.Message) }
+
+// call invokes an aria2 RPC method, with the secret token first if one is set.
+func (a *Aria2) call(ctx context.Context, method string, params []interface{}, result interface{}) error {
+	if a.secret != "" {
+		params = append([]interface{}{"token:" + a.secret}, params...)
+	}
+	body, err := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": "civitai-downloader", "method": method, "params": params})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating aria2 request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return failure.Wrap(failure.Network, fmt.Errorf("calling %s on aria2 at %s: %w", method, a.endpoint, err))
+	}
+	defer resp.Body.Close()
+	var reply struct {
+		Result json.RawMessage `json:"result"`
+		Error  *aria2Error     `json:"error"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&reply); err != nil {
+		return fmt.Errorf("decoding aria2 reply to %s (status %d): %w", method, resp.StatusCode, err)
+	}
+	if reply.Error != nil {
+		return fmt.Errorf("%s: %w", method, reply.Error)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(reply.Result, result)
+}
+
+// Version asks aria2c for its version, to check it can be reached.
+func (a *Aria2) Version(ctx context.Context) (string, error) {
+	var result struct {
+		Version string `json:"version"`
+	}
+	if err := a.call(ctx, "aria2.getVersion", nil, &result); err != nil {
+		return "", err
+	}
+	return result.Version, nil
+}
+
+// addURI starts a download of uri into dir/out with the options and returns its GID.
+func (a *Aria2) addURI(ctx context.Context, uri, dir, out string, options map[string]string) (string, error) {
+	opts := map[string]string{"dir": dir, "out": out}
+	for k, v := range options {
+		opts[k] = v
+	}
+	var gid string
+	err := a.call(ctx, "aria2.addUri", []interface{}{[]string{uri}, opts}, &gid)
+	return gid, err
+}
+
+// tellStatus returns the status of the download gid.
+func (a *Aria2) tellStatus(ctx context.Context, gid string) (*aria2Status, error) {
+	var status aria2Status
+	keys := []string{"status", "totalLength", "completedLength", "connections", "errorCode", "errorMessage"}
+	if err := a.call(ctx, "aria2.tellStatus", []interface{}{gid, keys}, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// remove stops the download gid and forgets it. aria2 keeps the partial file and its
+// control file, so the next attempt resumes it.
+func (a *Aria2) remove(gid string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := a.call(ctx, "aria2.forceRemove", []interface{}{gid}, nil); err != nil {
+		log.WithError(err).Debugf("Failed to remove aria2 download %s", gid)
+	}
+	a.forget(gid)
+}
+
+// forget removes the result of the stopped download gid from aria2's list.
+func (a *Aria2) forget(gid string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := a.call(ctx, "aria2.removeDownloadResult", []interface{}{gid}, nil); err != nil {
+		log.WithError(err).Debugf("Failed to remove the aria2 result of %s", gid)
+	}
+}
+
+// downloadWithAria2 does the work of downloadFile through aria2: the file is fetched under
+// the API's name (aria2 isn't asked to follow Content-Disposition) into a staging file,
+// then hashed, verified and moved into place like a built-in download.
+func (d *Downloader) downloadWithAria2(ctx context.Context, targetFilepath, url string, hashes models.Hashes, modelVersionID int, receipt *Receipt) (string, error) {
+	finalFilepath := targetFilepath
+	if modelVersionID > 0 {
+		finalFilepath = filepath.Join(filepath.Dir(targetFilepath), fmt.Sprintf("%d_%s", modelVersionID, filepath.Base(targetFilepath)))
+		if foundPath, exists, err := findExistingFileWithMatchingBaseAndHash(filepath.Dir(finalFilepath), trimExt(filepath.Base(finalFilepath)), filepath.Ext(finalFilepath), hashes); err != nil {
+			return "", fmt.Errorf("%w: final check for existing file: %v", ErrFileSystem, err)
+		} else if exists {
+			log.Infof("Found valid existing file %s. Download not needed.", foundPath)
+			receipt.Verification = VerificationExistingFile
+			return foundPath, nil
+		}
+		if err := helpers.CheckNotInUse(finalFilepath); err != nil {
+			return "", err
+		}
+	}
+
+	staging := d.partialBase(targetFilepath) + aria2PartSuffix
+	if err := os.MkdirAll(filepath.Dir(staging), 0700); err != nil {
+		return "", fmt.Errorf("%w: creating staging directory for %s: %v", ErrFileSystem, staging, err)
+	}
+	stagingDir, err := filepath.Abs(filepath.Dir(staging))
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrFileSystem, err)
+	}
+	options := map[string]string{
+		"continue":           "true", // Resume from the control file an earlier attempt left
+		"allow-overwrite":    "true",
+		"auto-file-renaming": "false",
+	}
+	if d.segments > 1 {
+		options["split"] = strconv.Itoa(d.segments)
+		options["max-connection-per-server"] = strconv.Itoa(min(d.segments, 16))
+	}
+	if d.stallTimeout > 0 {
+		options["timeout"] = strconv.Itoa(int(d.stallTimeout / time.Second))
+	}
+	// The key goes in the query rather than a header, which aria2 would also send to the
+	// storage host Civitai redirects to. Mirrors don't get it at all.
+	apiKey := d.apiKey
+	if !sendCredentials(ctx) {
+		apiKey = ""
+	}
+	gid, err := d.aria2.addURI(ctx, withToken(d.hostOverrides.RewriteURL(url), apiKey), stagingDir, filepath.Base(staging), options)
+	if err != nil {
+		return "", fmt.Errorf("%w: handing %s to aria2: %v", ErrHttpRequest, url, err)
+	}
+	log.Infof("Downloading to %s with aria2 (GID %s, Target: %s)...", staging, gid, finalFilepath)
+
+	status, err := d.waitForAria2(ctx, gid)
+	if status != nil {
+		completed, _ := strconv.ParseUint(status.CompletedLength, 10, 64)
+		receipt.BytesWritten = completed
+		receipt.ContentLength, _ = strconv.ParseInt(status.TotalLength, 10, 64)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("download of %s cancelled: %w", url, ctx.Err())
+		}
+		log.WithError(err).Errorf("aria2 failed to download %s", url)
+		return "", err
+	}
+	if d.segments > 1 {
+		receipt.Segments = d.segments
+	}
+	log.Infof("Finished writing %s.", staging)
+
+	var sums map[string]string
+	if algorithms := helpers.HashesToVerify(d.hashAlgorithms, hashes); len(algorithms) > 0 {
+		if sums, err = helpers.HashFile(staging, algorithms); err != nil {
+			return "", fmt.Errorf("%w: %v", ErrFileSystem, err)
+		}
+		receipt.ComputedHashes = sums
+	}
+	moved, err := d.verifyDownload(staging, finalFilepath, url, hashes, modelVersionID, sums, receipt)
+	if err != nil {
+		if !moved {
+			os.Remove(staging)
+		}
+		return "", err
+	}
+	if err := helpers.CheckNotInUse(finalFilepath); err != nil {
+		return "", err // The verified file stays staged; aria2 finds it complete next time
+	}
+	if err := helpers.MoveFile(staging, finalFilepath); err != nil {
+		return "", fmt.Errorf("%w: renaming partial file %s to %s: %v", ErrFileSystem, staging, finalFilepath, err)
+	}
+	log.Infof("Successfully downloaded and verified %s", finalFilepath)
+	return finalFilepath, nil
+}
+
+// waitForAria2 polls the download gid until aria2 stops it, and removes it from aria2's
+// list. It is stopped (keeping its partial file) if ctx is cancelled or aria2 can't be
+// asked about it; aria2's error code decides the category of a failed download's error.
+func (d *Downloader) waitForAria2(ctx context.Context, gid string) (*aria2Status, error) {
+	ticker := time.NewTicker(aria2PollInterval)
+	defer ticker.Stop()
+	var last *aria2Status
+	var completed uint64
+	for {
+		select {
+		case <-ctx.Done():
+			d.aria2.remove(gid)
+			return last, ctx.Err()
+		case <-ticker.C:
+		}
+		status, err := d.aria2.tellStatus(ctx, gid)
+		if err != nil {
+			if ctx.Err() != nil {
+				continue
+			}
+			d.aria2.remove(gid)
+			return last, fmt.Errorf("%w: asking aria2 about %s: %v", ErrHttpRequest, gid, err)
+		}
+		last = status
+		if n, err := strconv.ParseUint(status.CompletedLength, 10, 64); err == nil && n > completed {
+			totalWritten.Add(n - completed)
+			completed = n
+		}
+		switch status.Status {
+		case "complete":
+			d.aria2.forget(gid)
+			return status, nil
+		case "error", "removed":
+			d.aria2.forget(gid)
+			return status, aria2Failure(status)
+		}
+	}
+}
+
+// aria2Failure turns the error code of a failed aria2 download into an error of the
+// matching category (see aria2c's EXIT STATUS).
+func aria2Failure(status *aria2Status) error {
+	code, _ := strconv.Atoi(status.ErrorCode)
+	err := fmt.Errorf("aria2 download %s (code %d): %s", status.Status, code, status.ErrorMessage)
+	switch code {
+	case 3: // Resource not found
+		return failure.Wrap(failure.NotFound, err)
+	case 24: // HTTP authorization failed
+		return failure.Wrap(failure.Auth, err)
+	case 9, 15, 16, 17, 18: // Not enough disk space, file I/O
+		return failure.Wrap(failure.Disk, err)
+	case 0:
+		return failure.Wrap(failure.Unknown, err) // Removed from aria2 by hand
+	}
+	return failure.Wrap(failure.Network, err)
+}
+
+// withToken adds the API key to a download URL as Civitai's token parameter.
+func withToken(rawURL, apiKey string) string {
+	if apiKey == "" {
+		return rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	q := u.Query()
+	q.Set("token", apiKey)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// trimExt returns name without its extension.
+func trimExt(name string) string {
+	return name[:len(name)-len(filepath.Ext(name))]
+}
@@ -0,0 +1,60 @@
+package downloader
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+)
+
+// BandwidthTransport limits how fast response bodies are read, with a separate budget
+// per bandwidth class (metadata JSON, previews, model binaries; see helpers.ClassifyTransfer),
+// so a saturated binary budget doesn't slow API calls down. The helpers.BandwidthTotal
+// limit, if any, caps all of them together on top.
+type BandwidthTransport struct {
+	Base   http.RoundTripper
+	Limits map[string]*helpers.BandwidthLimiter // By class and BandwidthTotal; missing or nil means unlimited
+}
+
+// NewBandwidthTransport wraps base with the limits, or returns base if none are set.
+func NewBandwidthTransport(base http.RoundTripper, limits map[string]*helpers.BandwidthLimiter) http.RoundTripper {
+	for _, l := range limits {
+		if l != nil {
+			return &BandwidthTransport{Base: base, Limits: limits}
+		}
+	}
+	return base
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *BandwidthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	resp, err := base.RoundTrip(req)
+	if err != nil || resp.Body == nil {
+		return resp, err
+	}
+	// Downloads redirect to the CDN, so the first request of a redirect chain counts too
+	class := helpers.ClassifyTransfer(req.URL, resp.Header.Get("Content-Type"))
+	origin := req
+	for origin.Response != nil && origin.Response.Request != nil {
+		origin = origin.Response.Request
+	}
+	if helpers.ClassifyTransfer(origin.URL, "") == helpers.BandwidthBinaries {
+		class = helpers.BandwidthBinaries
+	}
+	for _, limiter := range []*helpers.BandwidthLimiter{t.Limits[class], t.Limits[helpers.BandwidthTotal]} {
+		if limiter != nil {
+			resp.Body = &limitedBody{Reader: helpers.LimitReader(resp.Body, limiter), Closer: resp.Body}
+		}
+	}
+	return resp, nil
+}
+
+// limitedBody is a rate-limited response body.
+type limitedBody struct {
+	io.Reader
+	io.Closer
+}
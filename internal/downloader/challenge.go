@@ -0,0 +1,166 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/failure"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxChallengeBackoff caps how many times the cool-down doubles on repeated challenges.
+const maxChallengeBackoff = 4
+
+// ChallengeGuard holds back every request for a cool-down once Cloudflare answers one with
+// a bot challenge, so concurrent workers back off together instead of each one hammering
+// on. The cool-down doubles with each challenge in a row, and resets when a request gets
+// through. A nil guard doesn't hold anything back.
+type ChallengeGuard struct {
+	mu         sync.Mutex
+	cooldown   time.Duration
+	until      time.Time
+	inARow     int
+	challenges int
+	paused     time.Duration
+}
+
+// NewChallengeGuard returns a guard with the cool-down, or nil for 0 (no cool-down).
+func NewChallengeGuard(cooldown time.Duration) *ChallengeGuard {
+	if cooldown <= 0 {
+		return nil
+	}
+	return &ChallengeGuard{cooldown: cooldown}
+}
+
+// Stats returns how many challenges were seen and how long the cool-downs lasted in total.
+func (g *ChallengeGuard) Stats() (challenges int, paused time.Duration) {
+	if g == nil {
+		return 0, 0
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.challenges, g.paused
+}
+
+// ResetStats starts the counts Stats returns over, e.g. for the next run of a watch loop.
+// A cool-down in progress and its backoff are kept.
+func (g *ChallengeGuard) ResetStats() {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.challenges, g.paused = 0, 0
+}
+
+// Until returns when the current cool-down ends (zero or in the past if there is none).
+func (g *ChallengeGuard) Until() time.Time {
+	if g == nil {
+		return time.Time{}
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.until
+}
+
+// Hold extends the cool-down to until, e.g. to carry one over a restart.
+func (g *ChallengeGuard) Hold(until time.Time) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if until.After(g.until) {
+		g.until = until
+	}
+}
+
+// wait blocks until the current cool-down is over or ctx is done.
+func (g *ChallengeGuard) wait(ctx context.Context) error {
+	g.mu.Lock()
+	d := time.Until(g.until)
+	g.mu.Unlock()
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// observe records the outcome of a request, starting a cool-down after a challenge.
+func (g *ChallengeGuard) observe(challenged bool, url string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !challenged {
+		g.inARow = 0
+		return
+	}
+	g.challenges++
+	if time.Now().Before(g.until) {
+		return // Sent before the cool-down started
+	}
+	g.inARow++
+	d := g.cooldown << min(g.inARow-1, maxChallengeBackoff)
+	g.until = time.Now().Add(d)
+	g.paused += d
+	log.WithField(failure.ReasonField, failure.Challenge).Warnf("Cloudflare challenged the request for %s; pausing all requests for %s", url, d)
+}
+
+// ChallengeTransport watches responses for Cloudflare challenges and holds requests back
+// while the guard's cool-down lasts.
+type ChallengeTransport struct {
+	Base  http.RoundTripper
+	Guard *ChallengeGuard
+}
+
+// NewChallengeTransport wraps base with the guard, or returns base if the guard is nil.
+func NewChallengeTransport(base http.RoundTripper, guard *ChallengeGuard) http.RoundTripper {
+	if guard == nil {
+		return base
+	}
+	return &ChallengeTransport{Base: base, Guard: guard}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *ChallengeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if err := t.Guard.wait(req.Context()); err != nil {
+		return nil, err
+	}
+	resp, err := base.RoundTrip(req)
+	if err != nil || resp.Body == nil {
+		return resp, err
+	}
+	challenged := false
+	switch resp.StatusCode {
+	case http.StatusForbidden, http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		// Challenges are small pages; peek at the start and hand the whole body on
+		start, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		resp.Body = &peekedBody{Reader: io.MultiReader(bytes.NewReader(start), resp.Body), Closer: resp.Body}
+		challenged = failure.IsChallenge(failure.Response{Status: resp.StatusCode, Header: resp.Header, Body: start})
+	default:
+		challenged = failure.IsChallenge(failure.Response{Status: resp.StatusCode, Header: resp.Header})
+	}
+	t.Guard.observe(challenged, req.URL.Redacted())
+	return resp, nil
+}
+
+// peekedBody is a response body whose start has already been read.
+type peekedBody struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,47 @@
+package downloader
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestChallengeGuardResetStats(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cf-Mitigated", "challenge")
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer srv.Close()
+	guard := NewChallengeGuard(time.Millisecond)
+	client := &http.Client{Transport: NewChallengeTransport(http.DefaultTransport, guard)}
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		time.Sleep(5 * time.Millisecond) // Past the cool-down, so the next challenge starts one
+	}
+	if challenges, paused := guard.Stats(); challenges != 2 || paused != 3*time.Millisecond {
+		t.Errorf("Stats() = %d, %v; want 2 challenges and 3ms paused (1ms, then doubled)", challenges, paused)
+	}
+
+	guard.ResetStats()
+	if challenges, paused := guard.Stats(); challenges != 0 || paused != 0 {
+		t.Errorf("Stats() after ResetStats = %d, %v; want 0, 0", challenges, paused)
+	}
+	// The backoff carries on: the next cool-down is doubled again
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if challenges, paused := guard.Stats(); challenges != 1 || paused != 4*time.Millisecond {
+		t.Errorf("Stats() = %d, %v; want 1 challenge and 4ms paused", challenges, paused)
+	}
+
+	var none *ChallengeGuard // No cool-down configured
+	none.ResetStats()
+}
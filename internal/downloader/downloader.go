@@ -1,6 +1,8 @@
 package downloader
 
 import (
+	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -12,24 +14,56 @@ import (
 	"strings"
 	"time"
 
-	"go-civitai-download/internal/helpers"
-	"go-civitai-download/internal/models"
+	"github.com/dreamfast/go-civitai-downloader/internal/failure"
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
 
 	log "github.com/sirupsen/logrus"
 )
 
 // Custom Downloader Errors
 var (
-	ErrHashMismatch = errors.New("downloaded file hash mismatch")
-	ErrHttpStatus   = errors.New("unexpected HTTP status code")
-	ErrFileSystem   = errors.New("filesystem error") // Covers create, remove, rename
-	ErrHttpRequest  = errors.New("HTTP request creation/execution error")
+	ErrHashMismatch = failure.New(failure.Verification, "downloaded file hash mismatch")
+	ErrHttpStatus   = failure.New(failure.Network, "unexpected HTTP status code") // Wrapped with the status's own category
+	ErrFileSystem   = failure.New(failure.Disk, "filesystem error")               // Covers create, remove, rename
+	ErrHttpRequest  = failure.New(failure.Network, "HTTP request creation/execution error")
+	ErrQuarantined  = failure.New(failure.Verification, "quarantined") // Wraps a mismatch whose file was moved to the quarantine directory
+	ErrHtmlPage     = failure.New(failure.Auth, "received a web page instead of the file")
 )
 
+// MaxTransferResumes is how often a transfer that breaks off (connection reset, timeout)
+// is continued with a Range request before the download fails; the partial file is kept
+// for a later run either way. Each resume waits transferResumeDelay longer than the last.
+const MaxTransferResumes = 5
+
+var transferResumeDelay = 2 * time.Second
+
 // Downloader handles downloading files with progress and hash checks.
 type Downloader struct {
-	client *http.Client
-	apiKey string // Add field to store API key
+	client   *http.Client
+	apiKey   string // Add field to store API key
+	tempDir  string // Where partial files are staged; empty means next to the target
+	segments int    // Connections per file (see SetSegments); 0 or 1 means one
+
+	retries     int           // Times a failed download is tried again (see SetRetries)
+	retryDelay  time.Duration // Wait before the first retry
+	retryPolicy *RetryPolicy  // Statuses worth a retry; nil is the built-in policy
+
+	stallTimeout time.Duration // Give up on connections that receive nothing this long (see SetStallTimeout)
+
+	hashAlgorithms []string // Hashes computed of each file (see SetHashAlgorithms)
+	keepMismatched bool     // Keep files that fail verification as <target>.mismatch (see SetKeepMismatched)
+
+	quarantineDir   string // Where files that fail verification are moved (see SetQuarantineDir)
+	mismatchRetries int    // Times a file that fails verification is fetched again (see SetMismatchRetries)
+
+	aria2 *Aria2 // Hands transfers to aria2c instead of making them (see SetAria2)
+
+	mirrors []string // URL templates tried when the primary URL is refused (see SetMirrors)
+
+	hostOverrides *HostOverrides // Where URLs handed to aria2 really go (see SetHostOverrides)
+
+	preallocateFiles bool // Reserve each file's full size before writing (see SetPreallocate)
 }
 
 // NewDownloader creates a new Downloader instance.
@@ -41,11 +75,46 @@ func NewDownloader(client *http.Client, apiKey string) *Downloader {
 		}
 	}
 	return &Downloader{
-		client: client,
-		apiKey: apiKey, // Store the API key
+		client:          client,
+		apiKey:          apiKey, // Store the API key
+		mismatchRetries: 1,
 	}
 }
 
+// SetTempDir makes the downloader stage partial files (and their checkpoints) in dir
+// instead of next to the target. Finished files are moved into place afterwards,
+// falling back to a copy when dir is on another filesystem.
+func (d *Downloader) SetTempDir(dir string) {
+	d.tempDir = dir
+}
+
+// SetHashAlgorithms makes the downloader compute the hashes of the algorithms (see
+// helpers.ParseHashAlgorithms) of every file it downloads, recorded in the receipt's
+// ComputedHashes. They come from the same pass that verifies the expected hashes: as the
+// file streams in (a resumed one's prefix is hashed while its checkpoints are verified),
+// or from one read of the finished file if it was segmented.
+func (d *Downloader) SetHashAlgorithms(algorithms []string) {
+	d.hashAlgorithms = algorithms
+}
+
+// SetKeepMismatched makes the downloader keep a file whose hashes don't match the expected
+// ones as <target>.mismatch, for a look at what was received, instead of deleting it. The
+// download fails either way.
+func (d *Downloader) SetKeepMismatched(keep bool) {
+	d.keepMismatched = keep
+}
+
+// SetPreallocate makes the downloader reserve the full size of each file on disk (see
+// helpers.Preallocate) before writing to it, once the server has said how large it is. A
+// file that doesn't fit fails before it is transferred; where the platform or filesystem
+// can't preallocate, files are written as usual.
+func (d *Downloader) SetPreallocate(on bool) {
+	d.preallocateFiles = on
+}
+
+// MismatchSuffix is appended to the target path of a file kept by SetKeepMismatched.
+const MismatchSuffix = ".mismatch"
+
 // Helper function to check for existing file by base name and hash.
 // Now requires the expected file extension to avoid checking hashes on mismatched file types (e.g., .json vs .safetensors).
 func findExistingFileWithMatchingBaseAndHash(dirPath string, baseNameWithoutExt string, expectedExt string, hashes models.Hashes) (foundPath string, exists bool, err error) {
@@ -98,12 +167,129 @@ func findExistingFileWithMatchingBaseAndHash(dirPath string, baseNameWithoutExt
 	return "", false, nil // No matching file found
 }
 
+// Receipt verification outcomes.
+const (
+	VerificationHashMatch    = "hash-match"          // Downloaded file matched an expected hash (see VerifiedWith)
+	VerificationNoHashes     = "not-verified"        // No expected hashes were available
+	VerificationExistingFile = "existing-file-match" // A valid file was already on disk; nothing was downloaded
+)
+
+// Receipt records the provenance of a download: what was requested, what the server
+// answered and how the result was verified. It is written into metadata sidecars.
+type Receipt struct {
+	URL            string            `json:"url"`
+	FinalURL       string            `json:"finalUrl,omitempty"` // After redirects (e.g. the CDN URL)
+	RequestedAt    time.Time         `json:"requestedAt"`
+	CompletedAt    time.Time         `json:"completedAt"`
+	StatusCode     int               `json:"statusCode,omitempty"`
+	ETag           string            `json:"etag,omitempty"`
+	LastModified   string            `json:"lastModified,omitempty"`
+	ContentLength  int64             `json:"contentLength,omitempty"`
+	BytesWritten   uint64            `json:"bytesWritten"`             // Bytes transferred by this request
+	ResumedFrom    int64             `json:"resumedFrom,omitempty"`    // Verified bytes reused from an earlier partial download
+	Resumes        int               `json:"resumes,omitempty"`        // Times the transfer broke off and was continued with a Range request
+	Segments       int               `json:"segments,omitempty"`       // Connections the file was downloaded over, if more than one
+	Retries        int               `json:"retries,omitempty"`        // Failed attempts before this one (see SetRetries)
+	ComputedHashes map[string]string `json:"computedHashes,omitempty"` // Hashes of the file as written, by algorithm (see SetHashAlgorithms)
+	ExpectedHashes models.Hashes     `json:"expectedHashes"`
+	Verification   string            `json:"verification"`
+	VerifiedWith   string            `json:"verifiedWith,omitempty"` // Algorithm of the expected hash the file matched (sha256 whenever the API lists one)
+	FinalPath      string            `json:"finalPath"`
+	Mirror         string            `json:"mirror,omitempty"` // Mirror the file came from when the primary URL failed (see SetMirrors)
+
+	failedStatus int // Status that failed the attempt, if a response did
+}
+
 // DownloadFile downloads a file from the specified URL to the target filepath.
 // It checks for existing files, verifies hashes, and attempts to use the
 // Content-Disposition header for the filename.
 // It also now accepts a modelVersionID to prepend to the final filename.
 // Returns the final filepath used (or empty string on failure) and an error if one occurred.
 func (d *Downloader) DownloadFile(targetFilepath string, url string, hashes models.Hashes, modelVersionID int) (string, error) {
+	finalPath, _, err := d.DownloadFileWithReceipt(targetFilepath, url, hashes, modelVersionID)
+	return finalPath, err
+}
+
+// DownloadFileWithReceipt behaves like DownloadFile and additionally returns a Receipt
+// describing the transfer. The receipt is nil when the download failed.
+func (d *Downloader) DownloadFileWithReceipt(targetFilepath string, url string, hashes models.Hashes, modelVersionID int) (string, *Receipt, error) {
+	return d.DownloadFileContext(context.Background(), targetFilepath, url, hashes, modelVersionID)
+}
+
+// DownloadFileContext behaves like DownloadFileWithReceipt, aborting the transfer when ctx
+// is cancelled. An aborted transfer keeps its partial file for a later resume.
+func (d *Downloader) DownloadFileContext(ctx context.Context, targetFilepath string, url string, hashes models.Hashes, modelVersionID int) (string, *Receipt, error) {
+	requestedAt := time.Now().UTC()
+	finalPath, receipt, err := d.downloadWithRetries(ctx, targetFilepath, url, hashes, modelVersionID, requestedAt)
+	if err != nil && ctx.Err() == nil && len(d.mirrors) > 0 && mirrorStatus(receipt.failedStatus) {
+		if hashes.SHA256 == "" {
+			log.Warnf("Download of %s failed with status %d; not trying mirrors for a file without a SHA256 to check them against", url, receipt.failedStatus)
+		}
+		for _, mirror := range d.mirrorURLs(url, targetFilepath, hashes.SHA256, modelVersionID) {
+			if hashes.SHA256 == "" {
+				break
+			}
+			log.WithError(err).Warnf("Download of %s failed; trying mirror %s", url, mirror)
+			var mirrorReceipt *Receipt
+			var mirrorErr error
+			finalPath, mirrorReceipt, mirrorErr = d.downloadWithRetries(withoutCredentials(ctx), targetFilepath, mirror, hashes, modelVersionID, requestedAt)
+			if mirrorErr == nil {
+				receipt, err = mirrorReceipt, nil
+				receipt.URL, receipt.Mirror = url, mirror
+				break
+			}
+			log.WithError(mirrorErr).Warnf("Mirror %s failed for %s", mirror, url)
+			if ctx.Err() != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	receipt.CompletedAt = time.Now().UTC()
+	receipt.FinalPath = finalPath
+	return finalPath, receipt, nil
+}
+
+// downloadWithRetries downloads url with the retry policy, returning the receipt of the
+// last attempt even when it failed.
+func (d *Downloader) downloadWithRetries(ctx context.Context, targetFilepath string, url string, hashes models.Hashes, modelVersionID int, requestedAt time.Time) (string, *Receipt, error) {
+	var receipt *Receipt
+	var finalPath string
+	var err error
+	mismatches := 0
+	for retry := 0; ; retry++ {
+		receipt = &Receipt{URL: url, ExpectedHashes: hashes, RequestedAt: requestedAt, Retries: retry}
+		finalPath, err = d.downloadFile(ctx, targetFilepath, url, hashes, modelVersionID, receipt)
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+		// A file that arrived corrupted is fetched again from the start, up to mismatchRetries
+		// times whatever the retry budget for failed transfers
+		if errors.Is(err, ErrHashMismatch) {
+			if mismatches++; mismatches > d.mismatchRetries {
+				break
+			}
+			log.WithError(err).Warnf("Download of %s failed verification; fetching it again (attempt %d/%d)", url, mismatches+1, d.mismatchRetries+1)
+			continue
+		}
+		if retry >= d.retries || !d.retryable(err, receipt.failedStatus) {
+			break
+		}
+		wait := d.retryBackoff(retry+1, receipt.failedStatus)
+		log.WithError(err).Warnf("Download of %s failed; trying again in %v (retry %d/%d)", url, wait.Round(time.Millisecond), retry+1, d.retries)
+		select {
+		case <-ctx.Done():
+			return "", receipt, fmt.Errorf("download of %s cancelled: %w", url, ctx.Err())
+		case <-time.After(wait):
+		}
+	}
+	return finalPath, receipt, err
+}
+
+// downloadFile does the work for DownloadFile, filling in receipt as it goes.
+func (d *Downloader) downloadFile(ctx context.Context, targetFilepath string, url string, hashes models.Hashes, modelVersionID int, receipt *Receipt) (string, error) {
 	initialFinalFilepath := targetFilepath // Store the initially constructed path
 	targetDir := filepath.Dir(initialFinalFilepath)
 	initialBaseName := filepath.Base(initialFinalFilepath)
@@ -119,66 +305,127 @@ func (d *Downloader) DownloadFile(targetFilepath string, url string, hashes mode
 	}
 	if exists {
 		log.Infof("Found valid existing file matching base name '%s' and extension '%s': %s. Skipping download.", initialBaseNameWithoutExt, initialExt, foundPath)
+		receipt.Verification = VerificationExistingFile
 		return foundPath, nil // Success, return the path of the valid existing file
 	}
 	log.Infof("No valid file matching base name '%s' and extension '%s' found initially. Proceeding with download process.", initialBaseNameWithoutExt, initialExt)
 	// --- End Initial Check ---
 
+	// A stale or damaged file at the target isn't replaced while a running UI has it loaded
+	if err := helpers.CheckNotInUse(initialFinalFilepath); err != nil {
+		return "", err
+	}
+
 	// Ensure target directory exists before creating temp file
 	if !helpers.CheckAndMakeDir(targetDir) {
 		return "", fmt.Errorf("%w: failed to create target directory %s", ErrFileSystem, targetDir)
 	}
+	if d.aria2 != nil {
+		return d.downloadWithAria2(ctx, targetFilepath, url, hashes, modelVersionID, receipt)
+	}
 
-	// Create a temporary file in the target directory
-	baseName := filepath.Base(targetFilepath)
-	tempFile, err := os.CreateTemp(targetDir, baseName+".*.tmp") // Use targetDir here
+	// Open the partial file (<target>.part). A partial left by an interrupted attempt is
+	// verified against its checkpoints and resumed from the last good chunk.
+	algorithms := helpers.HashesToVerify(d.hashAlgorithms, hashes)
+	partial, err := openPartial(d.partialBase(targetFilepath), url, algorithms)
 	if err != nil {
-		return "", fmt.Errorf("%w: creating temporary file %s: %w", ErrFileSystem, targetFilepath, err)
+		return "", fmt.Errorf("%w: %v", ErrFileSystem, err)
 	}
-	// Use a flag to track if we should remove the temp file on error exit
+	// On failure the partial is either discarded (bad data) or kept for a later resume (transfer error)
+	keepPartial := false
 	shouldCleanupTemp := true
 	defer func() {
-		if shouldCleanupTemp {
-			// If tempFile wasn't closed explicitly due to an early error *before* the explicit close,
-			// or if it was closed but we still need to cleanup (e.g., hash mismatch),
-			// we might need to close it here, but the explicit close should handle most cases.
-			// The main goal here is the os.Remove.
-			log.Debugf("Cleaning up temporary file via defer: %s", tempFile.Name())
-			if removeErr := os.Remove(tempFile.Name()); removeErr != nil {
-				log.WithError(removeErr).Warnf("Failed to remove temporary file %s during defer cleanup", tempFile.Name())
-			}
+		if !shouldCleanupTemp {
+			return
+		}
+		if keepPartial {
+			partial.keepForResume()
+		} else {
+			log.Debugf("Cleaning up partial file via defer: %s", partial.path)
+			partial.discard()
 		}
 	}()
 
-	log.Info("Starting download process...") // Log before creating temp file
+	log.Info("Starting download process...")
 
 	log.Infof("Attempting to download from URL: %s", url)
 
-	// Create request
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return "", fmt.Errorf("%w: creating download request for %s: %w", ErrHttpRequest, url, err)
-	}
+	var resp *http.Response
+	for attempt := 0; ; attempt++ {
+		if partial.offset > 0 {
+			log.Infof("Resuming download of %s from byte %d", filepath.Base(targetFilepath), partial.offset)
+		}
+		resp, err = d.get(ctx, url, partial.offset, partial.ckpt.ETag)
+		if err != nil {
+			keepPartial = true
+			if ctx.Err() != nil {
+				return "", fmt.Errorf("download of %s cancelled: %w", url, ctx.Err())
+			}
+			log.WithError(err).Errorf("Error performing download request from %s", url)
+			return "", fmt.Errorf("%w: performing request for %s: %v", ErrHttpRequest, url, err)
+		}
 
-	// Add authentication header if API key is present
-	log.Debugf("Downloader stored API Key: %s", d.apiKey) // Added Debug Log
-	if d.apiKey != "" {
-		log.Debug("Adding Authorization header to download request.") // Added Debug Log
-		req.Header.Set("Authorization", "Bearer "+d.apiKey)
-	} else {
-		log.Debug("No API Key found, skipping Authorization header for download.") // Added Debug Log
+		if partial.offset > 0 && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && attempt == 0 {
+			// The partial no longer fits the remote file; start over without a Range
+			resp.Body.Close()
+			log.Warnf("Server rejected resume range for %s, restarting from byte 0", url)
+			if err := partial.restart(); err != nil {
+				return "", fmt.Errorf("%w: %v", ErrFileSystem, err)
+			}
+			continue
+		}
+		if partial.offset > 0 && resp.StatusCode == http.StatusPartialContent && attempt == 0 {
+			if start, _, ok := parseContentRange(resp.Header.Get("Content-Range")); !ok || start != partial.offset {
+				// Appending a range that starts elsewhere would corrupt the file
+				resp.Body.Close()
+				log.Warnf("Server answered the resume of %s with range %q, restarting from byte 0", url, resp.Header.Get("Content-Range"))
+				if err := partial.restart(); err != nil {
+					return "", fmt.Errorf("%w: %v", ErrFileSystem, err)
+				}
+				continue
+			}
+		}
+		break
 	}
-
-	resp, err := d.client.Do(req)
-	if err != nil {
-		log.WithError(err).Errorf("Error performing download request from %s", url)
-		return "", fmt.Errorf("%w: performing request for %s: %v", ErrHttpRequest, url, err)
+	defer func() { resp.Body.Close() }() // resp is replaced when the transfer is resumed
+
+	// Civitai answers some downloads it refuses (login required, early access) and
+	// Cloudflare its challenges with a page; sniff the body too, the type can be missing
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent {
+		sniffed := bufio.NewReader(resp.Body)
+		start, _ := sniffed.Peek(512)
+		resp.Body = &peekedBody{Reader: sniffed, Closer: resp.Body}
+		if failure.IsHTML(resp.Header, start) {
+			keepPartial = true
+			return "", d.interpret(fmt.Errorf("%w: %s", ErrHtmlPage, url), resp)
+		}
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && partial.offset > 0:
+		receipt.ResumedFrom = partial.offset
+	case resp.StatusCode == http.StatusOK:
+		if partial.offset > 0 {
+			log.Warnf("Server ignored the resume range for %s (or the file changed), restarting from byte 0", url)
+			if err := partial.restart(); err != nil {
+				return "", fmt.Errorf("%w: %v", ErrFileSystem, err)
+			}
+		}
+		partial.ckpt.ETag = resp.Header.Get("ETag")
+	default:
 		log.Errorf("Error downloading file: Received status code %d from %s", resp.StatusCode, url)
-		return "", fmt.Errorf("%w: received status %d from %s", ErrHttpStatus, resp.StatusCode, url)
+		receipt.failedStatus = resp.StatusCode
+		keepPartial = true // A transient error shouldn't throw away verified progress
+		err := failure.Wrap(failure.ForHTTPStatus(resp.StatusCode), fmt.Errorf("%w: received status %d from %s", ErrHttpStatus, resp.StatusCode, url))
+		return "", d.interpret(err, resp)
+	}
+
+	receipt.StatusCode = resp.StatusCode
+	receipt.ETag = resp.Header.Get("ETag")
+	receipt.LastModified = resp.Header.Get("Last-Modified")
+	receipt.ContentLength = resp.ContentLength
+	if resp.Request != nil && resp.Request.URL != nil && resp.Request.URL.String() != url {
+		receipt.FinalURL = resp.Request.URL.String()
 	}
 
 	// --- Filename Handling from Content-Disposition ---
@@ -237,56 +484,145 @@ func (d *Downloader) DownloadFile(targetFilepath string, url string, hashes mode
 	}
 	if existsFinal {
 		log.Infof("Found valid existing file matching final base name '%s' and extension '%s': %s. Download not needed.", finalBaseNameWithoutExt, finalExt, foundPathFinal)
-		shouldCleanupTemp = true   // Ensure any temp file created before this check is removed
+		receipt.Verification = VerificationExistingFile
 		return foundPathFinal, nil // Success, return the path of the valid existing file
 	}
 	log.Debugf("Final target file base name '%s' with extension '%s' does not exist with valid hash. Proceeding with network download to temp file.", finalBaseNameWithoutExt, finalExt)
+	if finalFilepath != initialFinalFilepath {
+		if err := helpers.CheckNotInUse(finalFilepath); err != nil {
+			return "", err
+		}
+	}
 	// --- End Final Path Check ---
 
 	// Get the size of the file
 	size, _ := strconv.ParseUint(resp.Header.Get("Content-Length"), 10, 64)
+	if err := d.preallocate(partial, resp); err != nil {
+		keepPartial = true // The verified part is still good once there is room
+		return "", err
+	}
 
-	// Create a CounterWriter
+	// Create a CounterWriter. The hashes are computed as the file streams in, carrying on
+	// from the resumed prefix; only a segmented download, whose parts arrive out of order,
+	// is read once more for them when it's finished.
+	writer := partial.writer()
 	counter := &helpers.CounterWriter{
-		Writer: tempFile,
+		Writer: writer,
 		Total:  0,
 	}
 
-	// Write the body to temporary file, showing progress
-	log.Infof("Downloading to %s (Target: %s, Size: %s)...", tempFile.Name(), finalFilepath, helpers.BytesToSize(size))
-	_, err = io.Copy(counter, resp.Body)
+	// Write the body to the partial file, showing progress. A body that breaks off is
+	// continued with a Range request from the last byte written. With segments, the rest
+	// of the file comes over several connections at once, each resuming on its own.
+	segments := d.segmentsFor(resp, partial)
+	if len(segments) > 1 {
+		validator := partial.ckpt.ETag
+		if validator == "" {
+			validator = receipt.LastModified
+		}
+		log.Infof("Downloading to %s (Target: %s, Size: %s) over %d connections...", partial.path, finalFilepath, helpers.BytesToSize(size), len(segments))
+		receipt.Segments = len(segments)
+		var written int64
+		written, err = d.copySegments(ctx, url, resp, partial, segments, validator, receipt)
+		counter.Total = uint64(written)
+	} else {
+		log.Infof("Downloading to %s (Target: %s, Size: %s)...", partial.path, finalFilepath, helpers.BytesToSize(size))
+		_, err = helpers.Copy(counter, resp.Body)
+	}
+	for err != nil && len(segments) < 2 && ctx.Err() == nil && failure.CategoryOf(err) != failure.Disk && receipt.Resumes < MaxTransferResumes {
+		receipt.Resumes++
+		log.WithError(err).Warnf("Download of %s broke off at byte %d; resuming (%d/%d)", filepath.Base(finalFilepath), writer.pos, receipt.Resumes, MaxTransferResumes)
+		resp.Body.Close()
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			continue
+		case <-time.After(time.Duration(receipt.Resumes) * transferResumeDelay):
+		}
+		validator := partial.ckpt.ETag
+		if validator == "" {
+			validator = receipt.LastModified
+		}
+		var next *http.Response
+		if next, err = d.get(ctx, url, writer.pos, validator); err != nil {
+			continue
+		}
+		resp = next
+		switch start, _, ok := parseContentRange(resp.Header.Get("Content-Range")); {
+		case resp.StatusCode == http.StatusPartialContent && ok && start == writer.pos:
+		case resp.StatusCode == http.StatusOK:
+			// The file changed upstream (If-Range) or the server ignores ranges: start over
+			log.Warnf("Server sent all of %s again, restarting from byte 0", url)
+			if restartErr := partial.restart(); restartErr != nil {
+				err = fmt.Errorf("%w: %v", ErrFileSystem, restartErr)
+				continue
+			}
+			writer.reset()
+			partial.ckpt.ETag = resp.Header.Get("ETag")
+		default:
+			receipt.failedStatus = resp.StatusCode
+			err = failure.Wrap(failure.ForHTTPStatus(resp.StatusCode), fmt.Errorf("%w: received status %d (range %q) resuming %s", ErrHttpStatus, resp.StatusCode, resp.Header.Get("Content-Range"), url))
+			continue
+		}
+		_, err = helpers.Copy(counter, resp.Body)
+	}
+	receipt.BytesWritten = counter.Total
 	if err != nil {
-		log.WithError(err).Errorf("Error writing temporary file %s", tempFile.Name())
-		return "", fmt.Errorf("%w: writing temporary file %s: %v", ErrFileSystem, tempFile.Name(), err)
+		keepPartial = true
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("download of %s cancelled: %w", url, ctx.Err())
+		}
+		if errors.Is(err, ErrHttpStatus) {
+			return "", err // A resume was refused
+		}
+		if failure.CategoryOf(err) != failure.Disk {
+			// The body read failed (connection dropped, timeout), not the local write
+			log.WithError(err).Errorf("Error reading response body from %s", url)
+			return "", fmt.Errorf("%w: reading response body from %s: %v", ErrHttpRequest, url, err)
+		}
+		log.WithError(err).Errorf("Error writing partial file %s", partial.path)
+		return "", fmt.Errorf("%w: writing partial file %s: %v", ErrFileSystem, partial.path, err)
 	}
-	log.Infof("Finished writing %s.", tempFile.Name())
+	log.Infof("Finished writing %s.", partial.path)
 
 	// --- Explicitly close the file BEFORE hash check and rename ---
-	if err := tempFile.Close(); err != nil {
-		// Log the error, but try to continue with hash check/rename if closing failed?
-		// Or maybe return error here? Returning error seems safer.
-		log.WithError(err).Errorf("Failed to explicitly close temp file %s before hash/rename", tempFile.Name())
-		return "", fmt.Errorf("%w: closing temp file %s: %w", ErrFileSystem, tempFile.Name(), err)
+	if err := partial.close(); err != nil {
+		log.WithError(err).Errorf("Failed to explicitly close partial file %s before hash/rename", partial.path)
+		return "", fmt.Errorf("%w: closing partial file %s: %w", ErrFileSystem, partial.path, err)
 	}
 
-	// Verify the hash of the downloaded temporary file ONLY if hashes were provided
-	hashesProvided := hashes.SHA256 != "" || hashes.BLAKE3 != "" || hashes.CRC32 != "" || hashes.AutoV2 != ""
-	if hashesProvided {
-		log.Debugf("Verifying hash for temp file: %s", tempFile.Name())
-		if !helpers.CheckHash(tempFile.Name(), hashes) {
-			log.Errorf("Hash mismatch for downloaded file: %s", tempFile.Name())
-			return "", ErrHashMismatch
+	// Verify the hash of the downloaded file ONLY if hashes were provided
+	var sums map[string]string
+	if len(algorithms) > 0 {
+		if writer.whole != nil && len(segments) < 2 {
+			sums = writer.whole.Sums()
+		} else if sums, err = helpers.HashFile(partial.path, algorithms); err != nil {
+			log.WithError(err).Errorf("Failed to hash partial file %s", partial.path)
+			return "", fmt.Errorf("%w: %v", ErrFileSystem, err)
 		}
-		log.Infof("Hash verified for %s.", tempFile.Name())
-	} else {
-		log.Debugf("Skipping hash verification for %s (no expected hashes provided).", tempFile.Name())
+		receipt.ComputedHashes = sums
+	}
+	moved, err := d.verifyDownload(partial.path, finalFilepath, url, hashes, modelVersionID, sums, receipt)
+	if moved {
+		shouldCleanupTemp = false
+		os.Remove(partial.ckptPath)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// The file may have been loaded while this one was downloading; keep the verified
+	// partial for a later run instead of replacing the file under the process
+	if err := helpers.CheckNotInUse(finalFilepath); err != nil {
+		keepPartial = true
+		return "", err
 	}
 
-	// Rename the temporary file to the final path
-	log.Debugf("Renaming temp file %s to %s", tempFile.Name(), finalFilepath)
-	if err = os.Rename(tempFile.Name(), finalFilepath); err != nil {
-		log.WithError(err).Errorf("Error renaming temporary file %s to %s", tempFile.Name(), finalFilepath)
-		return "", fmt.Errorf("%w: renaming temporary file %s to %s: %v", ErrFileSystem, tempFile.Name(), finalFilepath, err)
+	// Rename the partial file to the final path
+	log.Debugf("Renaming partial file %s to %s", partial.path, finalFilepath)
+	if err = partial.finish(finalFilepath); err != nil {
+		log.WithError(err).Errorf("Error renaming partial file %s to %s", partial.path, finalFilepath)
+		return "", fmt.Errorf("%w: renaming partial file %s to %s: %v", ErrFileSystem, partial.path, finalFilepath, err)
 	}
 
 	// If rename was successful, we don't want the defer to remove the temp file (which is now the final file)
@@ -295,3 +631,177 @@ func (d *Downloader) DownloadFile(targetFilepath string, url string, hashes mode
 
 	return finalFilepath, nil
 }
+
+// preallocate reserves the full size of the file being downloaded into partial, if
+// SetPreallocate is on and resp says how large it is.
+func (d *Downloader) preallocate(partial *partialDownload, resp *http.Response) error {
+	if !d.preallocateFiles {
+		return nil
+	}
+	size := resp.ContentLength
+	if resp.StatusCode == http.StatusPartialContent {
+		_, size, _ = parseContentRange(resp.Header.Get("Content-Range"))
+	}
+	if size <= partial.offset {
+		return nil
+	}
+	err := helpers.Preallocate(partial.file, size)
+	switch {
+	case err == nil:
+		log.Debugf("Preallocated %s for %s", helpers.BytesToSize(uint64(size)), partial.path)
+		return nil
+	case errors.Is(err, helpers.ErrNoSpace):
+		// Give back whatever was reserved beyond the data written so far
+		partial.file.Truncate(partial.offset)
+		return fmt.Errorf("%w: %w", ErrFileSystem, err)
+	case errors.Is(err, errors.ErrUnsupported):
+		log.WithError(err).Debug("Preallocation not supported here, writing without it")
+	default:
+		log.WithError(err).Warnf("Failed to preallocate %s, writing without it", partial.path)
+	}
+	return nil
+}
+
+// verifyDownload checks the sums of the downloaded file at path against the expected
+// hashes, filling in the receipt's verification. A file that fails is quarantined or kept
+// by the target if the downloader is set up to (moved reports whether it left path), and
+// the mismatch is returned.
+func (d *Downloader) verifyDownload(path, finalFilepath, url string, hashes models.Hashes, modelVersionID int, sums map[string]string, receipt *Receipt) (moved bool, err error) {
+	hashesProvided := hashes.SHA256 != "" || hashes.BLAKE3 != "" || hashes.CRC32 != "" || hashes.AutoV2 != ""
+	if !hashesProvided {
+		log.Debugf("Skipping hash verification for %s (no expected hashes provided).", path)
+		receipt.Verification = VerificationNoHashes
+		return false, nil
+	}
+	log.Debugf("Verifying hash for partial file: %s", path)
+	verifiedWith := helpers.VerifiedBy(sums, hashes)
+	if verifiedWith != "" {
+		log.Infof("Hash verified for %s (%s).", path, verifiedWith)
+		receipt.Verification = VerificationHashMatch
+		receipt.VerifiedWith = verifiedWith
+		return false, nil
+	}
+	mismatch := fmt.Errorf("%w: %s has SHA256 %s, expected %s", ErrHashMismatch, filepath.Base(finalFilepath), sums[helpers.HashSHA256], expectedHashesString(hashes))
+	if d.quarantineDir != "" {
+		quarantined, err := QuarantineFile(d.quarantineDir, path, QuarantineReason{
+			Reason:         mismatch.Error(),
+			OriginalPath:   finalFilepath,
+			URL:            url,
+			ModelVersionID: modelVersionID,
+			Attempt:        receipt.Retries + 1,
+			ExpectedHashes: hashes,
+			ComputedHashes: sums,
+		})
+		if quarantined != "" {
+			moved = true
+			mismatch = fmt.Errorf("%w (%w as %s)", mismatch, ErrQuarantined, quarantined)
+		}
+		if err != nil {
+			log.WithError(err).Errorf("Failed to quarantine the mismatched file %s", path)
+		}
+	} else if d.keepMismatched {
+		kept := finalFilepath + MismatchSuffix
+		if err := helpers.MoveFile(path, kept); err != nil {
+			log.WithError(err).Errorf("Failed to keep the mismatched file %s as %s", path, kept)
+		} else {
+			moved = true
+			mismatch = fmt.Errorf("%w (kept as %s)", mismatch, kept)
+		}
+	}
+	log.Errorf("Hash mismatch for downloaded file: %v", mismatch)
+	return moved, mismatch
+}
+
+// get sends the download request, for the bytes from offset on if offset is above 0.
+// validator (an ETag or Last-Modified date) goes into If-Range, so a file that changed
+// upstream comes back whole instead of as a range of the new one.
+func (d *Downloader) get(ctx context.Context, url string, offset int64, validator string) (*http.Response, error) {
+	return d.getRange(ctx, url, offset, -1, validator)
+}
+
+// getRange is get for the bytes from offset to end (inclusive; -1 for the rest of the file).
+func (d *Downloader) getRange(ctx context.Context, url string, offset, end int64, validator string) (*http.Response, error) {
+	ctx, stall := d.watchStalls(ctx)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		if stall != nil {
+			stall.stop()
+		}
+		return nil, fmt.Errorf("%w: creating download request for %s: %w", ErrHttpRequest, url, err)
+	}
+
+	// Add authentication header if API key is present
+	log.Debugf("Downloader stored API Key: %s", d.apiKey) // Added Debug Log
+	if d.apiKey != "" && sendCredentials(ctx) {
+		log.Debug("Adding Authorization header to download request.") // Added Debug Log
+		req.Header.Set("Authorization", "Bearer "+d.apiKey)
+	} else {
+		log.Debug("No API Key found, skipping Authorization header for download.") // Added Debug Log
+	}
+
+	if offset > 0 || end >= 0 {
+		if end >= 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, end))
+		} else {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+		if validator != "" {
+			req.Header.Set("If-Range", validator) // Full body if the file changed upstream
+		}
+	}
+	resp, err := d.client.Do(req)
+	if stall == nil {
+		return resp, err
+	}
+	if err != nil {
+		stall.stop()
+		return nil, stall.err(err, url)
+	}
+	resp.Body = &stallBody{ReadCloser: resp.Body, watch: stall, url: url}
+	return resp, nil
+}
+
+// parseContentRange reads a Content-Range header ("bytes 100-199/200"); total is -1 if
+// the server doesn't know it ("bytes 100-199/*").
+func parseContentRange(value string) (start, total int64, ok bool) {
+	spec, found := strings.CutPrefix(strings.TrimSpace(value), "bytes ")
+	if !found {
+		return 0, 0, false
+	}
+	span, size, found := strings.Cut(spec, "/")
+	first, _, found2 := strings.Cut(span, "-")
+	if !found || !found2 {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(strings.TrimSpace(first), 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false
+	}
+	total = -1
+	if size = strings.TrimSpace(size); size != "*" {
+		if total, err = strconv.ParseInt(size, 10, 64); err != nil {
+			return 0, 0, false
+		}
+	}
+	return start, total, true
+}
+
+// interpret attaches the reason of a refused download to err (see failure.Interpret),
+// reading the start of the response body to recognise it.
+func (d *Downloader) interpret(err error, resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	return failure.Interpret(err, failure.Response{Status: resp.StatusCode, Header: resp.Header, Body: body, WithAPIKey: d.apiKey != ""})
+}
+
+// expectedHashesString lists the expected hashes for a mismatch error, SHA256 first.
+func expectedHashesString(hashes models.Hashes) string {
+	var parts []string
+	for _, pair := range []struct{ name, value string }{
+		{"SHA256", hashes.SHA256}, {"BLAKE3", hashes.BLAKE3}, {"CRC32", hashes.CRC32}, {"AutoV2", hashes.AutoV2},
+	} {
+		if pair.value != "" {
+			parts = append(parts, pair.name+" "+strings.ToLower(pair.value))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
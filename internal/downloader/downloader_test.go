@@ -0,0 +1,458 @@
+package downloader
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/failure"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+)
+
+// testContent returns size bytes of a repeating pattern that doesn't look like a web page.
+func testContent(size int) []byte {
+	b := make([]byte, size)
+	for i := range b {
+		b[i] = byte(i*7 + i/251)
+	}
+	return b
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// testServer serves content under any path with Range support (http.ServeContent) and
+// records the Range and If-Range of each request. handle, if set, answers a request
+// instead; it gets the number of the request, from 0.
+type testServer struct {
+	*httptest.Server
+	content []byte
+	etag    string
+	handle  func(w http.ResponseWriter, r *http.Request, n int) bool // false: serve content as usual
+
+	mu       sync.Mutex
+	ranges   []string
+	ifRanges []string
+}
+
+func newTestServer(t *testing.T, content []byte) *testServer {
+	t.Helper()
+	s := &testServer{content: content, etag: `"` + sha256Hex(content)[:16] + `"`}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		n := len(s.ranges)
+		s.ranges = append(s.ranges, r.Header.Get("Range"))
+		s.ifRanges = append(s.ifRanges, r.Header.Get("If-Range"))
+		s.mu.Unlock()
+		if s.handle != nil && s.handle(w, r, n) {
+			return
+		}
+		w.Header().Set("ETag", s.etag)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(s.content))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// requests returns the Range headers of the requests so far.
+func (s *testServer) requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.ranges...)
+}
+
+// newTestDownloader returns a downloader staging partial files in a temp dir of its own,
+// and the path of the file to download.
+func newTestDownloader(t *testing.T) (d *Downloader, target, tempDir string) {
+	t.Helper()
+	tempDir = t.TempDir()
+	d = NewDownloader(nil, "")
+	d.SetTempDir(tempDir)
+	return d, filepath.Join(t.TempDir(), "model.safetensors"), tempDir
+}
+
+// assertStagingEmpty fails the test if a partial file or checkpoint is left in dir.
+func assertStagingEmpty(t *testing.T, dir string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		t.Errorf("%s left in the staging directory", entry.Name())
+	}
+}
+
+func assertFileContent(t *testing.T, path string, want []byte) {
+	t.Helper()
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading %s: %v", path, err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s has %d bytes (SHA256 %s), want %d bytes (SHA256 %s)", filepath.Base(path), len(got), sha256Hex(got), len(want), sha256Hex(want))
+	}
+}
+
+func TestDownloadStagesPartialFile(t *testing.T) {
+	content := testContent(5000)
+	srv := newTestServer(t, content)
+	d, target, tempDir := newTestDownloader(t)
+
+	// The target must not appear before the whole file is there and verified
+	var targetSeen bool
+	srv.handle = func(w http.ResponseWriter, r *http.Request, n int) bool {
+		_, err := os.Stat(target)
+		targetSeen = err == nil
+		return false
+	}
+
+	finalPath, receipt, err := d.DownloadFileWithReceipt(target, srv.URL+"/file", models.Hashes{SHA256: strings.ToUpper(sha256Hex(content))}, 0)
+	if err != nil {
+		t.Fatalf("DownloadFileWithReceipt: %v", err)
+	}
+	if finalPath != target {
+		t.Errorf("final path = %s, want %s", finalPath, target)
+	}
+	if targetSeen {
+		t.Error("the target existed while the file was downloading")
+	}
+	if receipt.Verification != VerificationHashMatch || receipt.VerifiedWith == "" {
+		t.Errorf("verification = %q (with %q), want %q", receipt.Verification, receipt.VerifiedWith, VerificationHashMatch)
+	}
+	assertFileContent(t, target, content)
+	assertStagingEmpty(t, tempDir)
+
+	// A second download finds the verified file and transfers nothing
+	_, receipt, err = d.DownloadFileWithReceipt(target, srv.URL+"/file", models.Hashes{SHA256: sha256Hex(content)}, 0)
+	if err != nil {
+		t.Fatalf("second DownloadFileWithReceipt: %v", err)
+	}
+	if receipt.Verification != VerificationExistingFile {
+		t.Errorf("second download verification = %q, want %q", receipt.Verification, VerificationExistingFile)
+	}
+	if got := len(srv.requests()); got != 1 {
+		t.Errorf("server got %d requests, want 1", got)
+	}
+}
+
+func TestDownloadMismatchKeepsExistingTarget(t *testing.T) {
+	content := testContent(3000)
+	srv := newTestServer(t, content)
+	d, target, tempDir := newTestDownloader(t)
+	old := []byte("the previous copy")
+	if err := os.WriteFile(target, old, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := d.DownloadFile(target, srv.URL+"/file", models.Hashes{SHA256: sha256Hex([]byte("something else"))}, 0)
+	if !errors.Is(err, ErrHashMismatch) {
+		t.Fatalf("err = %v, want ErrHashMismatch", err)
+	}
+	if failure.CategoryOf(err) != failure.Verification {
+		t.Errorf("category = %v, want %v", failure.CategoryOf(err), failure.Verification)
+	}
+	// Fetched again once (the default SetMismatchRetries) before failing
+	if got := len(srv.requests()); got != 2 {
+		t.Errorf("server got %d requests, want 2", got)
+	}
+	assertFileContent(t, target, old)
+	assertStagingEmpty(t, tempDir)
+	if _, err := os.Stat(target + MismatchSuffix); !os.IsNotExist(err) {
+		t.Errorf("mismatched file kept without SetKeepMismatched (stat: %v)", err)
+	}
+}
+
+func TestDownloadQuarantinesMismatch(t *testing.T) {
+	content := testContent(3000)
+	srv := newTestServer(t, content)
+	d, target, tempDir := newTestDownloader(t)
+	quarantine := filepath.Join(t.TempDir(), "quarantine")
+	d.SetQuarantineDir(quarantine)
+	d.SetMismatchRetries(0)
+	expected := models.Hashes{SHA256: sha256Hex([]byte("something else"))}
+
+	_, err := d.DownloadFile(target, srv.URL+"/file", expected, 0)
+	if !errors.Is(err, ErrQuarantined) || !errors.Is(err, ErrHashMismatch) {
+		t.Fatalf("err = %v, want ErrQuarantined wrapping ErrHashMismatch", err)
+	}
+	if _, err := os.Stat(target); !os.IsNotExist(err) {
+		t.Errorf("mismatched file reached the target (stat: %v)", err)
+	}
+	assertStagingEmpty(t, tempDir)
+
+	entries, err := os.ReadDir(quarantine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("quarantine has %d entries, want the file and its reason", len(entries))
+	}
+	var file, reasonFile string
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), QuarantineReasonSuffix) {
+			reasonFile = filepath.Join(quarantine, entry.Name())
+		} else {
+			file = filepath.Join(quarantine, entry.Name())
+		}
+	}
+	if file == "" || reasonFile != file+QuarantineReasonSuffix {
+		t.Fatalf("quarantine entries %v, want <name> and <name>%s", entries, QuarantineReasonSuffix)
+	}
+	if !strings.HasSuffix(file, "_model.safetensors") {
+		t.Errorf("quarantined file %s isn't named after the target", filepath.Base(file))
+	}
+	assertFileContent(t, file, content)
+
+	data, err := os.ReadFile(reasonFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reason QuarantineReason
+	if err := json.Unmarshal(data, &reason); err != nil {
+		t.Fatalf("decoding %s: %v", reasonFile, err)
+	}
+	if reason.OriginalPath != target || reason.URL != srv.URL+"/file" || reason.Attempt != 1 {
+		t.Errorf("reason = %+v, want the target, URL and attempt 1", reason)
+	}
+	if reason.ExpectedHashes != expected || reason.ComputedHashes["sha256"] != sha256Hex(content) {
+		t.Errorf("reason hashes = %v / %v, want %v / %s", reason.ExpectedHashes, reason.ComputedHashes, expected, sha256Hex(content))
+	}
+	if reason.QuarantinedAt.IsZero() || !strings.Contains(reason.Reason, "hash mismatch") {
+		t.Errorf("reason = %q at %v", reason.Reason, reason.QuarantinedAt)
+	}
+}
+
+func TestNewRetryPolicy(t *testing.T) {
+	tests := []struct {
+		name        string
+		extra       []int
+		multipliers map[string]float64
+		wantErr     bool
+	}{
+		{"Defaults", nil, nil, false},
+		{"Extra status", []int{403}, nil, false},
+		{"Extra status not an error", []int{302}, nil, true},
+		{"Multiplier", nil, map[string]float64{" 503 ": 3}, false},
+		{"Multiplier for an extra status", []int{403}, map[string]float64{"403": 2}, false},
+		{"Multiplier for a status that isn't retried", nil, map[string]float64{"404": 2}, true},
+		{"Multiplier key not a status", nil, map[string]float64{"5xx": 2}, true},
+		{"Multiplier zero", nil, map[string]float64{"503": 0}, true},
+		{"Multiplier too large", nil, map[string]float64{"503": maxBackoffMultiplier + 1}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewRetryPolicy(tt.extra, tt.multipliers)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewRetryPolicy(%v, %v) error = %v, wantErr %v", tt.extra, tt.multipliers, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	extra403, err := NewRetryPolicy([]int{403}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge := failure.Interpret(fmt.Errorf("%w: received status 403", ErrHttpStatus), failure.Response{
+		Status: http.StatusForbidden,
+		Header: http.Header{"Cf-Mitigated": {"challenge"}},
+	})
+	statusErr := func(status int) error {
+		return failure.Wrap(failure.ForHTTPStatus(status), fmt.Errorf("%w: received status %d", ErrHttpStatus, status))
+	}
+
+	tests := []struct {
+		name   string
+		policy *RetryPolicy
+		err    error
+		status int
+		want   bool
+	}{
+		{"Server error", nil, statusErr(503), 503, true},
+		{"Origin error", nil, statusErr(522), 522, true},
+		{"Rate limited", nil, statusErr(429), 429, true},
+		{"Request timeout", nil, statusErr(408), 408, true},
+		{"Not found", nil, statusErr(404), 404, false},
+		{"Forbidden", nil, statusErr(403), 403, false},
+		{"Forbidden with a policy retrying it", extra403, statusErr(403), 403, true},
+		{"Cloudflare challenge", extra403, challenge, 403, false},
+		{"Connection failed", nil, fmt.Errorf("%w: connection reset", ErrHttpRequest), 0, true},
+		{"Stalled", nil, fmt.Errorf("%w: nothing received", ErrStalled), 0, true},
+		{"Hash mismatch", nil, fmt.Errorf("%w: bad data", ErrHashMismatch), 0, false},
+		{"Disk error", nil, fmt.Errorf("%w: disk full", ErrFileSystem), 0, false},
+		{"Web page instead of the file", nil, fmt.Errorf("%w: login", ErrHtmlPage), 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDownloader(nil, "")
+			d.SetRetries(3, time.Second, tt.policy)
+			if got := d.retryable(tt.err, tt.status); got != tt.want {
+				t.Errorf("retryable(%v, %d) = %v, want %v", tt.err, tt.status, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	tests := []struct {
+		name     string
+		delay    time.Duration
+		retry    int
+		status   int
+		min, max time.Duration
+	}{
+		{"First retry", time.Second, 1, 503, 500 * time.Millisecond, time.Second},
+		{"Doubles per retry", time.Second, 3, 503, 2 * time.Second, 4 * time.Second},
+		{"Origin error waits longer", time.Second, 1, 522, time.Second, 2 * time.Second},
+		{"No response", time.Second, 2, 0, time.Second, 2 * time.Second},
+		{"Capped", time.Second, 30, 503, maxRetryBackoff / 2, maxRetryBackoff},
+		{"Capped with multiplier", time.Minute, 4, 522, maxRetryBackoff / 2, maxRetryBackoff},
+		{"No delay", 0, 2, 503, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDownloader(nil, "")
+			d.SetRetries(5, tt.delay, nil)
+			for i := 0; i < 50; i++ {
+				if got := d.retryBackoff(tt.retry, tt.status); got < tt.min || got > tt.max {
+					t.Fatalf("retryBackoff(%d, %d) = %v, want %v-%v", tt.retry, tt.status, got, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
+
+func TestDownloadRetries(t *testing.T) {
+	content := testContent(2000)
+	tests := []struct {
+		name         string
+		failures     int // Requests answered with status before the file is served
+		status       int
+		retries      int
+		wantErr      error
+		wantRequests int
+		wantRetries  int
+	}{
+		{"Recovers from server errors", 2, http.StatusServiceUnavailable, 3, nil, 3, 2},
+		{"Gives up after the retries", 5, http.StatusServiceUnavailable, 2, ErrHttpStatus, 3, 0},
+		{"Doesn't retry not found", 5, http.StatusNotFound, 3, ErrHttpStatus, 1, 0},
+		{"No retries", 1, http.StatusBadGateway, 0, ErrHttpStatus, 1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t, content)
+			srv.handle = func(w http.ResponseWriter, r *http.Request, n int) bool {
+				if n >= tt.failures {
+					return false
+				}
+				http.Error(w, "unavailable", tt.status)
+				return true
+			}
+			d, target, tempDir := newTestDownloader(t)
+			d.SetRetries(tt.retries, time.Millisecond, nil)
+
+			_, receipt, err := d.DownloadFileWithReceipt(target, srv.URL+"/file", models.Hashes{SHA256: sha256Hex(content)}, 0)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("err = %v, want %v", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("DownloadFileWithReceipt: %v", err)
+			} else {
+				if receipt.Retries != tt.wantRetries {
+					t.Errorf("receipt retries = %d, want %d", receipt.Retries, tt.wantRetries)
+				}
+				assertFileContent(t, target, content)
+			}
+			if got := len(srv.requests()); got != tt.wantRequests {
+				t.Errorf("server got %d requests, want %d", got, tt.wantRequests)
+			}
+			assertStagingEmpty(t, tempDir)
+		})
+	}
+}
+
+func TestDownloadResumesStalledTransfer(t *testing.T) {
+	delay := transferResumeDelay
+	transferResumeDelay = time.Millisecond
+	t.Cleanup(func() { transferResumeDelay = delay })
+
+	content := testContent(4000)
+	srv := newTestServer(t, content)
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) }) // Runs before the server is closed
+	srv.handle = func(w http.ResponseWriter, r *http.Request, n int) bool {
+		if n > 0 {
+			return false
+		}
+		// Send half the file, then nothing
+		w.Header().Set("ETag", srv.etag)
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		w.Write(content[:len(content)/2])
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+		return true
+	}
+	d, target, tempDir := newTestDownloader(t)
+	d.SetStallTimeout(100 * time.Millisecond)
+
+	_, receipt, err := d.DownloadFileWithReceipt(target, srv.URL+"/file", models.Hashes{SHA256: sha256Hex(content)}, 0)
+	if err != nil {
+		t.Fatalf("DownloadFileWithReceipt: %v", err)
+	}
+	if receipt.Resumes != 1 {
+		t.Errorf("receipt resumes = %d, want 1", receipt.Resumes)
+	}
+	want := []string{"", fmt.Sprintf("bytes=%d-", len(content)/2)}
+	if got := srv.requests(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("ranges requested = %q, want %q", got, want)
+	}
+	if srv.ifRanges[1] != srv.etag {
+		t.Errorf("resume If-Range = %q, want the ETag %q", srv.ifRanges[1], srv.etag)
+	}
+	assertFileContent(t, target, content)
+	assertStagingEmpty(t, tempDir)
+}
+
+func TestStalledRequestFails(t *testing.T) {
+	srv := newTestServer(t, nil)
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	srv.handle = func(w http.ResponseWriter, r *http.Request, n int) bool {
+		// No headers at all
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+		return true
+	}
+	d, target, _ := newTestDownloader(t)
+	d.SetStallTimeout(100 * time.Millisecond)
+
+	start := time.Now()
+	_, err := d.DownloadFile(target, srv.URL+"/file", models.Hashes{}, 0)
+	if !errors.Is(err, ErrHttpRequest) || !strings.Contains(err.Error(), ErrStalled.Error()) {
+		t.Fatalf("err = %v, want a stalled request", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("gave up after %v, want about the stall timeout", elapsed)
+	}
+}
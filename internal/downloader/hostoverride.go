@@ -0,0 +1,182 @@
+package downloader
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// civitaiAPIHost and civitaiAPIPath are where the Civitai API lives, the URLs ApiBaseUrl
+// replaces.
+const (
+	civitaiAPIHost = "civitai.com"
+	civitaiAPIPath = "/api/v1"
+)
+
+// HostOverrides points requests meant for Civitai somewhere else: an API-compatible mirror,
+// a caching proxy, a test server or a corporate gateway. API requests
+// (https://civitai.com/api/v1/...) go to the API base URL, and requests to the hosts of
+// the host overrides (download redirects and CDN images included) go to their
+// replacement, keeping the path and query.
+type HostOverrides struct {
+	api   *url.URL       // Replaces https://civitai.com/api/v1 (nil: unchanged)
+	hosts []hostOverride // In match order: exact hosts, then wildcards, longest first
+}
+
+// hostOverride replaces the scheme and host of the hosts matching Pattern: an exact host
+// name, or *.example.com for every host below example.com (and example.com itself).
+type hostOverride struct {
+	Pattern string
+	To      *url.URL // Scheme and host (with port) only
+}
+
+// ParseHostOverrides reads ApiBaseUrl and CdnHostOverrides. apiBase is a URL such as
+// "https://civitai-mirror.example.com/api/v1" ("" keeps the Civitai API). hosts maps a
+// host or *.domain pattern to a replacement host ("cdn.example.com", "gateway:8443") or,
+// to change the scheme too, a URL ("http://localhost:8080"). It returns nil if neither
+// is set.
+func ParseHostOverrides(apiBase string, hosts map[string]string) (*HostOverrides, error) {
+	o := &HostOverrides{}
+	if apiBase = strings.TrimSpace(apiBase); apiBase != "" {
+		u, err := url.Parse(strings.TrimRight(apiBase, "/"))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid API base URL %q: use an http(s) URL such as https://civitai.example.com/api/v1", apiBase)
+		}
+		o.api = u
+	}
+	for pattern, to := range hosts {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		to = strings.TrimSpace(to)
+		if pattern == "" || to == "" || strings.Contains(pattern, "/") {
+			return nil, fmt.Errorf("invalid host override %q = %q: use <host or *.domain> = <host[:port] or scheme://host[:port]>", pattern, to)
+		}
+		if !strings.Contains(to, "://") {
+			to = "https://" + to
+		}
+		u, err := url.Parse(to)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.Trim(u.Path, "/") != "" {
+			return nil, fmt.Errorf("invalid host override %q = %q: the replacement must be a host[:port] or scheme://host[:port], without a path", pattern, to)
+		}
+		o.hosts = append(o.hosts, hostOverride{Pattern: pattern, To: &url.URL{Scheme: u.Scheme, Host: u.Host}})
+	}
+	if o.api == nil && len(o.hosts) == 0 {
+		return nil, nil
+	}
+	// Exact hosts win over wildcards, and narrower wildcards over wider ones
+	sort.Slice(o.hosts, func(i, j int) bool {
+		wi, wj := strings.HasPrefix(o.hosts[i].Pattern, "*."), strings.HasPrefix(o.hosts[j].Pattern, "*.")
+		if wi != wj {
+			return wj
+		}
+		if len(o.hosts[i].Pattern) != len(o.hosts[j].Pattern) {
+			return len(o.hosts[i].Pattern) > len(o.hosts[j].Pattern)
+		}
+		return o.hosts[i].Pattern < o.hosts[j].Pattern
+	})
+	return o, nil
+}
+
+// APIBase returns the API base URL requests go to.
+func (o *HostOverrides) APIBase() string {
+	if o == nil || o.api == nil {
+		return "https://" + civitaiAPIHost + civitaiAPIPath
+	}
+	return o.api.String()
+}
+
+// Hosts returns the host overrides as "pattern -> replacement", for the log.
+func (o *HostOverrides) Hosts() []string {
+	if o == nil {
+		return nil
+	}
+	var hosts []string
+	for _, h := range o.hosts {
+		hosts = append(hosts, h.Pattern+" -> "+h.To.String())
+	}
+	return hosts
+}
+
+// matches reports whether pattern applies to host.
+func (h hostOverride) matches(host string) bool {
+	if suffix, ok := strings.CutPrefix(h.Pattern, "*."); ok {
+		return host == suffix || strings.HasSuffix(host, "."+suffix)
+	}
+	return host == h.Pattern
+}
+
+// Rewrite points u at its override, if it has one, and reports whether it changed. A nil
+// HostOverrides changes nothing.
+func (o *HostOverrides) Rewrite(u *url.URL) bool {
+	if o == nil || u == nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	if o.api != nil && host == civitaiAPIHost && (u.Path == civitaiAPIPath || strings.HasPrefix(u.Path, civitaiAPIPath+"/")) {
+		u.Scheme = o.api.Scheme
+		u.Host = o.api.Host
+		u.Path = strings.TrimRight(o.api.Path, "/") + strings.TrimPrefix(u.Path, civitaiAPIPath)
+		u.RawPath = ""
+		return true
+	}
+	for _, h := range o.hosts {
+		if h.matches(host) {
+			u.Scheme = h.To.Scheme
+			u.Host = h.To.Host
+			return true
+		}
+	}
+	return false
+}
+
+// RewriteURL is Rewrite for a URL string. Unparsable URLs are returned as they are.
+func (o *HostOverrides) RewriteURL(rawURL string) string {
+	if o == nil {
+		return rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || !o.Rewrite(u) {
+		return rawURL
+	}
+	return u.String()
+}
+
+// SetHostOverrides sets the overrides applied to the URLs handed to aria2c. The built-in
+// downloader's requests already go through a HostOverrideTransport; aria2c makes its own,
+// and follows redirects itself, so only the first URL is rewritten for it.
+func (d *Downloader) SetHostOverrides(o *HostOverrides) {
+	d.hostOverrides = o
+}
+
+// HostOverrideTransport sends each request to its HostOverrides replacement. Redirects are
+// separate requests, so a redirect to an overridden CDN host is rewritten too.
+type HostOverrideTransport struct {
+	Base      http.RoundTripper
+	Overrides *HostOverrides
+}
+
+// NewHostOverrideTransport wraps base with the overrides, or returns base if there are none.
+func NewHostOverrideTransport(base http.RoundTripper, overrides *HostOverrides) http.RoundTripper {
+	if overrides == nil {
+		return base
+	}
+	return &HostOverrideTransport{Base: base, Overrides: overrides}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *HostOverrideTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	u := *req.URL
+	if !t.Overrides.Rewrite(&u) {
+		return base.RoundTrip(req)
+	}
+	// A RoundTripper must not modify the request it is given
+	rewritten := req.Clone(req.Context())
+	rewritten.URL = &u
+	rewritten.Host = ""
+	return base.RoundTrip(rewritten)
+}
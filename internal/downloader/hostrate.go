@@ -0,0 +1,127 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HostRateLimit spaces out the requests to the hosts matching a pattern: an exact host
+// name, or *.example.com for every host below example.com (and example.com itself).
+type HostRateLimit struct {
+	Pattern  string
+	Interval time.Duration // Least time between the starts of two requests to one host
+
+	mu   sync.Mutex
+	next map[string]time.Time // By host
+}
+
+// ParseHostRateLimits parses HostRateLimits entries of the form <pattern>=<rate>, where
+// rate is a number of requests per second, minute or hour ("2/s", "30/m", "500/h").
+// The first matching entry applies to a host, so list specific hosts before wildcards.
+func ParseHostRateLimits(entries []string) ([]*HostRateLimit, error) {
+	var limits []*HostRateLimit
+	for _, entry := range entries {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		pattern, rate, ok := strings.Cut(entry, "=")
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if !ok || pattern == "" {
+			return nil, fmt.Errorf("invalid host rate limit %q: use <host>=<requests>/<s|m|h>, e.g. *.civitai.com=2/s", entry)
+		}
+		count, unit, ok := strings.Cut(strings.TrimSpace(rate), "/")
+		n, err := strconv.ParseFloat(strings.TrimSpace(count), 64)
+		if !ok || err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid rate %q for %s: use <requests>/<s|m|h>, e.g. 2/s", rate, pattern)
+		}
+		var per time.Duration
+		switch strings.ToLower(strings.TrimSpace(unit)) {
+		case "s", "sec", "second":
+			per = time.Second
+		case "m", "min", "minute":
+			per = time.Minute
+		case "h", "hour":
+			per = time.Hour
+		default:
+			return nil, fmt.Errorf("invalid rate %q for %s: the unit must be s, m or h", rate, pattern)
+		}
+		limits = append(limits, &HostRateLimit{Pattern: pattern, Interval: time.Duration(float64(per) / n)})
+	}
+	return limits, nil
+}
+
+// Matches reports whether the limit applies to host.
+func (l *HostRateLimit) Matches(host string) bool {
+	host = strings.ToLower(host)
+	if suffix, ok := strings.CutPrefix(l.Pattern, "*."); ok {
+		return host == suffix || strings.HasSuffix(host, "."+suffix)
+	}
+	return host == l.Pattern
+}
+
+// wait blocks until a request to host may start, or ctx is done.
+func (l *HostRateLimit) wait(ctx context.Context, host string) error {
+	l.mu.Lock()
+	if l.next == nil {
+		l.next = make(map[string]time.Time)
+	}
+	now := time.Now()
+	start := l.next[host]
+	if start.Before(now) {
+		start = now
+	}
+	l.next[host] = start.Add(l.Interval) // Reserved before waiting, so waiters queue up
+	l.mu.Unlock()
+
+	delay := time.Until(start)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// HostRateTransport holds requests back so the hosts of HostRateLimits (e.g. the download
+// CDN) are asked no more often than their rate, independently of ApiDelayMs. Each hop of
+// a redirect counts for its own host.
+type HostRateTransport struct {
+	Base   http.RoundTripper
+	Limits []*HostRateLimit
+}
+
+// NewHostRateTransport wraps base with the limits, or returns base if there are none.
+func NewHostRateTransport(base http.RoundTripper, limits []*HostRateLimit) http.RoundTripper {
+	if len(limits) == 0 {
+		return base
+	}
+	return &HostRateTransport{Base: base, Limits: limits}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *HostRateTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	host := req.URL.Hostname()
+	for _, l := range t.Limits {
+		if l.Matches(host) {
+			if err := l.wait(req.Context(), strings.ToLower(host)); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	return base.RoundTrip(req)
+}
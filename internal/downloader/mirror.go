@@ -0,0 +1,88 @@
+package downloader
+
+import (
+	"context"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// mirrorStatus reports whether a failed response from the primary download URL sends the
+// download on to the mirrors: Civitai answers 403, 404 or 410 for versions it no longer serves.
+func mirrorStatus(status int) bool {
+	return status == 403 || status == 404 || status == 410 || status >= 500
+}
+
+// downloadVersionPattern finds the model version ID in a Civitai download URL.
+var downloadVersionPattern = regexp.MustCompile(`/api/download/models/(\d+)`)
+
+// noCredentialsKey marks a context whose requests go to a mirror, so the API key isn't sent.
+type noCredentialsKey struct{}
+
+func withoutCredentials(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noCredentialsKey{}, true)
+}
+
+func sendCredentials(ctx context.Context) bool {
+	return ctx.Value(noCredentialsKey{}) == nil
+}
+
+// SetMirrors sets URL templates tried in order when the primary download URL answers
+// 403, 404, 410 or 5xx. A template can use {url} (the primary URL, query-escaped),
+// {versionId}, {fileName}, {sha256} and {autov2}; a mirror whose placeholders can't be
+// filled for a file is skipped. Mirrors are only used for files with an expected SHA256,
+// which the download must match as usual, and are never sent the API key.
+func (d *Downloader) SetMirrors(templates []string) {
+	d.mirrors = nil
+	for _, t := range templates {
+		if t = strings.TrimSpace(t); t != "" {
+			d.mirrors = append(d.mirrors, t)
+		}
+	}
+}
+
+// mirrorURLs fills in the mirror templates for a file, skipping those that need a value
+// the file doesn't have.
+func (d *Downloader) mirrorURLs(primary, targetFilepath, sha256 string, modelVersionID int) []string {
+	versionID := ""
+	if m := downloadVersionPattern.FindStringSubmatch(primary); m != nil {
+		versionID = m[1]
+	} else if modelVersionID > 0 {
+		versionID = strconv.Itoa(modelVersionID)
+	}
+	autov2 := ""
+	if len(sha256) >= 10 {
+		autov2 = strings.ToUpper(sha256[:10])
+	}
+	values := map[string]string{
+		"{url}":       url.QueryEscape(primary),
+		"{versionId}": versionID,
+		"{fileName}":  url.PathEscape(filepath.Base(targetFilepath)),
+		"{sha256}":    strings.ToLower(sha256),
+		"{autov2}":    autov2,
+	}
+
+	var urls []string
+	for _, template := range d.mirrors {
+		mirror, complete := template, true
+		for placeholder, value := range values {
+			if strings.Contains(mirror, placeholder) {
+				if value == "" {
+					complete = false
+					break
+				}
+				mirror = strings.ReplaceAll(mirror, placeholder, value)
+			}
+		}
+		if !complete {
+			log.Debugf("Mirror %s has no value for one of its placeholders for %s; skipping it", template, targetFilepath)
+			continue
+		}
+		urls = append(urls, mirror)
+	}
+	return urls
+}
@@ -0,0 +1,13 @@
+package downloader
+
+import "sync/atomic"
+
+// totalWritten counts the bytes all downloaders of the process have written to files.
+var totalWritten atomic.Uint64
+
+// TotalWritten returns the bytes all downloaders of the process have written to files so
+// far, including those aria2 reports for its downloads. It only grows, so a value that
+// doesn't change tells that no transfer is moving.
+func TotalWritten() uint64 {
+	return totalWritten.Load()
+}
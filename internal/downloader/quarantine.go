@@ -0,0 +1,69 @@
+package downloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+)
+
+// QuarantineReasonSuffix is appended to the name of a quarantined file for the file that
+// says why it was quarantined.
+const QuarantineReasonSuffix = ".reason.json"
+
+// QuarantineReason is written next to a quarantined file: where it came from and what
+// its hashes were expected to be.
+type QuarantineReason struct {
+	Reason         string            `json:"reason"`
+	OriginalPath   string            `json:"originalPath"` // Where the file was, or would have been put
+	URL            string            `json:"url,omitempty"`
+	ModelVersionID int               `json:"modelVersionId,omitempty"`
+	Attempt        int               `json:"attempt,omitempty"` // Download attempt that received the file, from 1
+	ExpectedHashes models.Hashes     `json:"expectedHashes"`
+	ComputedHashes map[string]string `json:"computedHashes,omitempty"`
+	QuarantinedAt  time.Time         `json:"quarantinedAt"`
+}
+
+// SetQuarantineDir makes the downloader move a file whose hashes don't match the expected
+// ones into dir, with a QuarantineReason beside it, instead of deleting it (or keeping it by
+// the target with SetKeepMismatched). The download fails either way. Empty turns it off.
+func (d *Downloader) SetQuarantineDir(dir string) {
+	d.quarantineDir = dir
+}
+
+// SetMismatchRetries sets how often a download whose hashes don't match is fetched again
+// from the start before it fails; a file that keeps failing verification was most likely
+// changed upstream.
+func (d *Downloader) SetMismatchRetries(n int) {
+	d.mismatchRetries = max(n, 0)
+}
+
+// QuarantineFile moves path into dir, named after the time and its original name so
+// repeated attempts don't replace each other, and writes reason next to it as
+// <name>.reason.json. It returns the quarantined path.
+func QuarantineFile(dir, path string, reason QuarantineReason) (string, error) {
+	if err := helpers.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("creating quarantine directory %s: %w", dir, err)
+	}
+	if reason.QuarantinedAt.IsZero() {
+		reason.QuarantinedAt = time.Now().UTC()
+	}
+	name := reason.QuarantinedAt.Format("20060102T150405.000Z") + "_" + filepath.Base(reason.OriginalPath)
+	name = strings.Replace(name, ".", "", 1) // Drop the dot of the milliseconds
+	dest := filepath.Join(dir, name)
+	if err := helpers.MoveFile(path, dest); err != nil {
+		return "", fmt.Errorf("moving %s into quarantine: %w", path, err)
+	}
+	data, err := json.MarshalIndent(reason, "", "  ")
+	if err != nil {
+		return dest, fmt.Errorf("encoding quarantine reason: %w", err)
+	}
+	if err := helpers.WriteFile(dest+QuarantineReasonSuffix, data, 0600); err != nil {
+		return dest, fmt.Errorf("writing quarantine reason: %w", err)
+	}
+	return dest, nil
+}
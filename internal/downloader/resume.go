@@ -0,0 +1,281 @@
+package downloader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// CheckpointInterval is the number of bytes covered by each rolling checkpoint hash.
+// Only whole, verified checkpoints are kept when resuming a partial download.
+const CheckpointInterval int64 = 64 << 20 // 64 MiB
+
+// checkpoint is stored next to a partial download (<file>.part.ckpt) and holds the
+// SHA256 of every completed CheckpointInterval-sized chunk written so far.
+type checkpoint struct {
+	URL      string   `json:"url"`
+	ETag     string   `json:"etag,omitempty"`
+	Interval int64    `json:"interval"`
+	Chunks   []string `json:"chunks"`
+}
+
+// partialDownload is a resumable <target>.part file plus its checkpoint.
+type partialDownload struct {
+	path     string
+	ckptPath string
+	file     *os.File
+	ckpt     checkpoint
+	offset   int64 // Verified bytes already present; the transfer continues from here
+
+	// whole has the hashes of the bytes before offset, for the writer to carry on with (nil:
+	// no hashes wanted, or the prefix couldn't be hashed in the verifying pass)
+	whole *helpers.MultiHasher
+}
+
+// partialBase returns the path (without the .part suffix) used to stage targetFilepath.
+// In a temp dir the name carries a hash of the full target path, so files with the same
+// name in different model folders never collide and a resume finds the same partial.
+func (d *Downloader) partialBase(targetFilepath string) string {
+	if d.tempDir == "" {
+		return targetFilepath
+	}
+	sum := sha256.Sum256([]byte(filepath.Clean(targetFilepath)))
+	return filepath.Join(d.tempDir, hex.EncodeToString(sum[:6])+"-"+filepath.Base(targetFilepath))
+}
+
+// openPartial opens (or creates) the partial file for targetFilepath. If a partial from an
+// earlier attempt exists for the same URL, its prefix is verified chunk by chunk against the
+// stored checkpoints; the file is truncated to the last chunk that still matches, so a
+// corrupt or unverifiable tail is re-downloaded instead of being appended to. The hashes of
+// the algorithms are started over the kept prefix in the same pass, so the finished file
+// needn't be read again to verify it.
+func openPartial(targetFilepath, url string, algorithms []string) (*partialDownload, error) {
+	if err := os.MkdirAll(filepath.Dir(targetFilepath), 0700); err != nil {
+		return nil, fmt.Errorf("creating staging directory for %s: %w", targetFilepath, err)
+	}
+	p := &partialDownload{
+		path:     targetFilepath + ".part",
+		ckptPath: targetFilepath + ".part.ckpt",
+		ckpt:     checkpoint{URL: url, Interval: CheckpointInterval},
+	}
+	if len(algorithms) > 0 {
+		p.whole = helpers.NewMultiHasher(algorithms)
+	}
+
+	if stored, ok := loadCheckpoint(p.ckptPath); ok && stored.URL == url && stored.Interval > 0 {
+		if info, err := os.Stat(p.path); err == nil && info.Size() > 0 {
+			p.ckpt = stored
+			p.offset = p.verifyPrefix(info.Size())
+		}
+	}
+
+	file, err := os.OpenFile(p.path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("opening partial file %s: %w", p.path, err)
+	}
+	p.file = file
+	if err := p.truncate(p.offset); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// verifyPrefix hashes each checkpointed chunk of the existing partial file and returns the
+// byte offset up to which the file is known-good. Checkpoints beyond that point are dropped.
+// Each chunk read also goes into p.whole; a chunk that fails leaves it unusable, so it is
+// dropped then and the finished file is hashed on its own.
+func (p *partialDownload) verifyPrefix(size int64) int64 {
+	file, err := os.Open(p.path)
+	if err != nil {
+		log.WithError(err).Warnf("Resume: cannot read partial file %s, starting over", p.path)
+		p.ckpt.Chunks = nil
+		return 0
+	}
+	defer file.Close()
+
+	interval := p.ckpt.Interval
+	verified := 0
+	for i, expected := range p.ckpt.Chunks {
+		start := int64(i) * interval
+		if start+interval > size {
+			log.Infof("Resume: checkpoint %d (bytes %d-%d) is beyond the partial file's %d bytes, ignoring it", i, start, start+interval-1, size)
+			break
+		}
+		hasher := sha256.New()
+		var dst io.Writer = hasher
+		if p.whole != nil {
+			dst = io.MultiWriter(hasher, p.whole)
+		}
+		if _, err := io.CopyN(dst, io.NewSectionReader(file, start, interval), interval); err != nil {
+			log.WithError(err).Warnf("Resume: failed reading bytes %d-%d of %s", start, start+interval-1, p.path)
+			p.whole = nil
+			break
+		}
+		actual := hex.EncodeToString(hasher.Sum(nil))
+		if actual != expected {
+			p.whole = nil
+			log.Warnf("Resume: checkpoint %d (bytes %d-%d) of %s does not match (expected %s, got %s); discarding from byte %d",
+				i, start, start+interval-1, p.path, expected, actual, start)
+			break
+		}
+		log.Debugf("Resume: checkpoint %d (bytes %d-%d) verified", i, start, start+interval-1)
+		verified++
+	}
+
+	p.ckpt.Chunks = p.ckpt.Chunks[:verified]
+	offset := int64(verified) * interval
+	log.Infof("Resume: %s has %d bytes; %d checkpoint(s) verified, keeping %d bytes and discarding %d unverified bytes",
+		p.path, size, verified, offset, size-offset)
+	return offset
+}
+
+// truncate cuts the partial file to offset and positions writes there.
+func (p *partialDownload) truncate(offset int64) error {
+	if err := p.file.Truncate(offset); err != nil {
+		return fmt.Errorf("truncating partial file %s: %w", p.path, err)
+	}
+	if _, err := p.file.Seek(offset, io.SeekStart); err != nil {
+		return fmt.Errorf("seeking partial file %s: %w", p.path, err)
+	}
+	p.offset = offset
+	return nil
+}
+
+// restart discards everything written so far (e.g. the server ignored the Range request).
+func (p *partialDownload) restart() error {
+	if p.whole != nil {
+		p.whole.Reset()
+	}
+	p.ckpt.Chunks = nil
+	p.ckpt.ETag = ""
+	return p.truncate(0)
+}
+
+// writer returns a writer that appends to the partial file and records a checkpoint
+// after every completed chunk.
+func (p *partialDownload) writer() *checkpointWriter {
+	return &checkpointWriter{p: p, hasher: sha256.New(), whole: p.whole, pos: p.offset}
+}
+
+// keepForResume closes the partial file after a failed transfer. It is kept only if at
+// least one checkpoint was recorded, since nothing else could be verified on resume.
+func (p *partialDownload) keepForResume() {
+	p.file.Close()
+	if len(p.ckpt.Chunks) == 0 {
+		p.discard()
+		return
+	}
+	log.Infof("Keeping partial download %s (%d verified bytes) for resume", p.path, int64(len(p.ckpt.Chunks))*p.ckpt.Interval)
+}
+
+// discard closes and removes the partial file and its checkpoint.
+func (p *partialDownload) discard() {
+	p.file.Close()
+	if err := os.Remove(p.path); err != nil && !os.IsNotExist(err) {
+		log.WithError(err).Warnf("Failed to remove partial file %s", p.path)
+	}
+	os.Remove(p.ckptPath)
+}
+
+// close flushes the partial file to disk before verification and rename.
+func (p *partialDownload) close() error {
+	if err := p.file.Sync(); err != nil {
+		p.file.Close()
+		return err
+	}
+	return p.file.Close()
+}
+
+// finish moves the completed file into place and removes the checkpoint.
+func (p *partialDownload) finish(finalPath string) error {
+	if err := helpers.MoveFile(p.path, finalPath); err != nil {
+		return err
+	}
+	os.Remove(p.ckptPath)
+	return nil
+}
+
+func (p *partialDownload) saveCheckpoint() {
+	data, err := json.Marshal(p.ckpt)
+	if err != nil {
+		log.WithError(err).Warn("Failed to encode download checkpoint")
+		return
+	}
+	tmp := p.ckptPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		log.WithError(err).Warnf("Failed to write download checkpoint %s", p.ckptPath)
+		return
+	}
+	if err := os.Rename(tmp, p.ckptPath); err != nil {
+		log.WithError(err).Warnf("Failed to save download checkpoint %s", p.ckptPath)
+	}
+}
+
+func loadCheckpoint(path string) (checkpoint, bool) {
+	var ckpt checkpoint
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ckpt, false
+	}
+	if err := json.Unmarshal(data, &ckpt); err != nil {
+		log.WithError(err).Warnf("Ignoring unreadable download checkpoint %s", path)
+		return ckpt, false
+	}
+	return ckpt, true
+}
+
+// checkpointWriter writes to a partial file, hashing each chunk as it completes.
+type checkpointWriter struct {
+	p      *partialDownload
+	hasher hash.Hash
+	whole  *helpers.MultiHasher // Hashes of the whole file so far (nil: read it once finished)
+	pos    int64                // Absolute offset of the next byte
+}
+
+// reset starts the writer over at byte 0, after the partial file was restarted (which
+// restarted the whole-file hashes too).
+func (w *checkpointWriter) reset() {
+	w.hasher.Reset()
+	w.pos = 0
+}
+
+func (w *checkpointWriter) Write(b []byte) (int, error) {
+	interval := w.p.ckpt.Interval
+	written := 0
+	for len(b) > 0 {
+		// Never let one write straddle a chunk boundary
+		room := interval - w.pos%interval
+		n := int64(len(b))
+		if n > room {
+			n = room
+		}
+		m, err := w.p.file.Write(b[:n])
+		totalWritten.Add(uint64(m))
+		w.hasher.Write(b[:m])
+		if w.whole != nil {
+			w.whole.Write(b[:m])
+		}
+		w.pos += int64(m)
+		written += m
+		if err != nil {
+			return written, err
+		}
+		if w.pos%interval == 0 {
+			w.p.ckpt.Chunks = append(w.p.ckpt.Chunks, hex.EncodeToString(w.hasher.Sum(nil)))
+			w.hasher.Reset()
+			w.p.saveCheckpoint()
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
@@ -0,0 +1,288 @@
+package downloader
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+)
+
+// testInterval is the checkpoint interval of the partial files the tests set up, so a few
+// KB make several chunks.
+const testInterval = 1024
+
+// chunkSums returns the checkpoint hashes of the first n chunks of content.
+func chunkSums(content []byte, n int) []string {
+	sums := make([]string, n)
+	for i := range sums {
+		sums[i] = sha256Hex(content[i*testInterval : (i+1)*testInterval])
+	}
+	return sums
+}
+
+// writePartial leaves data and ckpt as the partial download of target, like an earlier
+// attempt that broke off.
+func writePartial(t *testing.T, d *Downloader, target string, data []byte, ckpt checkpoint) {
+	t.Helper()
+	base := d.partialBase(target)
+	if err := os.WriteFile(base+".part", data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := json.Marshal(ckpt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(base+".part.ckpt", encoded, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// corrupt returns a copy of b with the byte at i changed.
+func corrupt(b []byte, i int) []byte {
+	out := append([]byte(nil), b...)
+	out[i] ^= 0xff
+	return out
+}
+
+func TestResumeVerifiesCheckpoints(t *testing.T) {
+	content := testContent(4500)
+	tests := []struct {
+		name        string
+		partial     []byte
+		chunks      int
+		wantRange   string
+		wantResumed int64
+	}{
+		{"Intact prefix", content[:3000], 2, "bytes=2048-", 2048},
+		{"Checkpoint beyond the partial file", content[:2000], 2, "bytes=1024-", 1024},
+		{"Corrupted second chunk", corrupt(content[:3000], 1500), 2, "bytes=1024-", 1024},
+		{"Corrupted first chunk", corrupt(content[:3000], 10), 2, "", 0},
+		{"No checkpoints", content[:1000], 0, "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t, content)
+			d, target, tempDir := newTestDownloader(t)
+			url := srv.URL + "/file"
+			writePartial(t, d, target, tt.partial, checkpoint{URL: url, ETag: srv.etag, Interval: testInterval, Chunks: chunkSums(content, tt.chunks)})
+
+			_, receipt, err := d.DownloadFileWithReceipt(target, url, models.Hashes{SHA256: sha256Hex(content)}, 0)
+			if err != nil {
+				t.Fatalf("DownloadFileWithReceipt: %v", err)
+			}
+			if got := srv.requests(); len(got) != 1 || got[0] != tt.wantRange {
+				t.Errorf("ranges requested = %q, want [%q]", got, tt.wantRange)
+			}
+			if tt.wantRange != "" && srv.ifRanges[0] != srv.etag {
+				t.Errorf("If-Range = %q, want the checkpoint's ETag %q", srv.ifRanges[0], srv.etag)
+			}
+			if receipt.ResumedFrom != tt.wantResumed {
+				t.Errorf("receipt resumed from %d, want %d", receipt.ResumedFrom, tt.wantResumed)
+			}
+			if receipt.Verification != VerificationHashMatch {
+				t.Errorf("verification = %q, want %q", receipt.Verification, VerificationHashMatch)
+			}
+			assertFileContent(t, target, content)
+			assertStagingEmpty(t, tempDir)
+		})
+	}
+}
+
+func TestResumeCheckpointOfAnotherURL(t *testing.T) {
+	content := testContent(3000)
+	srv := newTestServer(t, content)
+	d, target, _ := newTestDownloader(t)
+	writePartial(t, d, target, content[:2048], checkpoint{URL: srv.URL + "/other", Interval: testInterval, Chunks: chunkSums(content, 2)})
+
+	if _, err := d.DownloadFile(target, srv.URL+"/file", models.Hashes{SHA256: sha256Hex(content)}, 0); err != nil {
+		t.Fatalf("DownloadFile: %v", err)
+	}
+	if got := srv.requests(); len(got) != 1 || got[0] != "" {
+		t.Errorf("ranges requested = %q, want one request for the whole file", got)
+	}
+	assertFileContent(t, target, content)
+}
+
+func TestResumeRangeResponses(t *testing.T) {
+	content := testContent(4000)
+	changed := testContent(4100)[100:] // Same size, other bytes
+	tests := []struct {
+		name        string
+		server      []byte                                                   // What the server has now
+		sameETag    bool                                                     // The server still sends the checkpoint's ETag
+		handle      func(w http.ResponseWriter, r *http.Request, n int) bool // nil: http.ServeContent
+		wantRanges  []string
+		wantResumed int64
+	}{
+		{"Partial content", content, false, nil, []string{"bytes=2048-"}, 2048},
+		{
+			"Server ignores the range", content, false,
+			func(w http.ResponseWriter, r *http.Request, n int) bool {
+				w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+				w.Write(content)
+				return true
+			},
+			[]string{"bytes=2048-"}, 0,
+		},
+		{"File changed upstream", changed, false, nil, []string{"bytes=2048-"}, 0},
+		{"Range not satisfiable", content[:2000], true, nil, []string{"bytes=2048-", ""}, 0},
+		{
+			"Range starting elsewhere", content, false,
+			func(w http.ResponseWriter, r *http.Request, n int) bool {
+				if n > 0 {
+					return false
+				}
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(content)-1, len(content)))
+				w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write(content)
+				return true
+			},
+			[]string{"bytes=2048-", ""}, 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t, tt.server)
+			srv.handle = tt.handle
+			d, target, tempDir := newTestDownloader(t)
+			url := srv.URL + "/file"
+			// The partial was started against content; the checkpoint keeps its ETag
+			etag := `"` + sha256Hex(content)[:16] + `"`
+			if tt.sameETag {
+				srv.etag = etag
+			}
+			writePartial(t, d, target, content[:2500], checkpoint{URL: url, ETag: etag, Interval: testInterval, Chunks: chunkSums(content, 2)})
+
+			_, receipt, err := d.DownloadFileWithReceipt(target, url, models.Hashes{SHA256: sha256Hex(tt.server)}, 0)
+			if err != nil {
+				t.Fatalf("DownloadFileWithReceipt: %v", err)
+			}
+			if got := srv.requests(); !reflect.DeepEqual(got, tt.wantRanges) {
+				t.Errorf("ranges requested = %q, want %q", got, tt.wantRanges)
+			}
+			if receipt.ResumedFrom != tt.wantResumed {
+				t.Errorf("receipt resumed from %d, want %d", receipt.ResumedFrom, tt.wantResumed)
+			}
+			assertFileContent(t, target, tt.server)
+			assertStagingEmpty(t, tempDir)
+		})
+	}
+}
+
+func TestPlanSegments(t *testing.T) {
+	tests := []struct {
+		name     string
+		start    int64
+		size     int64
+		n        int
+		interval int64
+		want     [][2]int64 // start, end
+	}{
+		{"Even split", 0, 4096, 4, 1024, [][2]int64{{0, 1024}, {1024, 2048}, {2048, 3072}, {3072, 4096}}},
+		{"Short last chunk", 0, 3500, 2, 1024, [][2]int64{{0, 2048}, {2048, 3500}}},
+		{"Extra chunks go first", 0, 5120, 2, 1024, [][2]int64{{0, 3072}, {3072, 5120}}},
+		{"Fewer chunks than connections", 0, 2048, 8, 1024, [][2]int64{{0, 1024}, {1024, 2048}}},
+		{"Resumed", 1024, 4096, 4, 1024, [][2]int64{{1024, 2048}, {2048, 3072}, {3072, 4096}}},
+		{"One chunk", 0, 1000, 4, 1024, nil},
+		{"One connection", 0, 4096, 1, 1024, nil},
+		{"Start inside a chunk", 100, 4096, 4, 1024, nil},
+		{"Nothing left", 4096, 4096, 4, 1024, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got [][2]int64
+			for _, seg := range planSegments(tt.start, tt.size, tt.n, tt.interval) {
+				if seg.pos != seg.start {
+					t.Errorf("segment %d-%d starts at pos %d", seg.start, seg.end, seg.pos)
+				}
+				got = append(got, [2]int64{seg.start, seg.end})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("planSegments(%d, %d, %d, %d) = %v, want %v", tt.start, tt.size, tt.n, tt.interval, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCopySegmentsAssemblesFile(t *testing.T) {
+	content := testContent(4000)
+	srv := newTestServer(t, content)
+	d, target, _ := newTestDownloader(t)
+	url := srv.URL + "/file"
+
+	partial, err := openPartial(d.partialBase(target), url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer partial.discard()
+	partial.ckpt.Interval = testInterval
+	segments := planSegments(0, int64(len(content)), 4, testInterval)
+	resp, err := d.get(context.Background(), url, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	written, err := d.copySegments(context.Background(), url, resp, partial, segments, srv.etag, &Receipt{})
+	if err != nil {
+		t.Fatalf("copySegments: %v", err)
+	}
+	if written != int64(len(content)) {
+		t.Errorf("written = %d, want %d", written, len(content))
+	}
+	if err := partial.close(); err != nil {
+		t.Fatal(err)
+	}
+	assertFileContent(t, partial.path, content)
+
+	// The last chunk is short, so only the whole ones are checkpointed, in order
+	want := chunkSums(content, 3)
+	if !reflect.DeepEqual(partial.ckpt.Chunks, want) {
+		t.Errorf("checkpoint chunks = %v, want %v", partial.ckpt.Chunks, want)
+	}
+	if saved, ok := loadCheckpoint(partial.ckptPath); !ok || !reflect.DeepEqual(saved.Chunks, want) {
+		t.Errorf("saved checkpoint chunks = %v, want %v", saved.Chunks, want)
+	}
+	wantRanges := []string{"", "bytes=1024-2047", "bytes=2048-3071", "bytes=3072-3999"}
+	got := srv.requests()
+	if len(got) != len(wantRanges) || got[0] != "" {
+		t.Fatalf("ranges requested = %q, want %q in any order after the first", got, wantRanges)
+	}
+	for _, r := range wantRanges[1:] {
+		found := false
+		for _, g := range got[1:] {
+			found = found || g == r
+		}
+		if !found {
+			t.Errorf("range %q not requested (got %q)", r, got)
+		}
+	}
+}
+
+func TestSegmentedResume(t *testing.T) {
+	content := testContent(4000)
+	srv := newTestServer(t, content)
+	d, target, tempDir := newTestDownloader(t)
+	d.SetSegments(4)
+	url := srv.URL + "/file"
+	writePartial(t, d, target, content[:1024], checkpoint{URL: url, ETag: srv.etag, Interval: testInterval, Chunks: chunkSums(content, 1)})
+
+	_, receipt, err := d.DownloadFileWithReceipt(target, url, models.Hashes{SHA256: sha256Hex(content)}, 0)
+	if err != nil {
+		t.Fatalf("DownloadFileWithReceipt: %v", err)
+	}
+	if receipt.Segments != 3 || receipt.ResumedFrom != 1024 {
+		t.Errorf("receipt segments = %d, resumed from %d; want 3 from 1024", receipt.Segments, receipt.ResumedFrom)
+	}
+	if got := srv.requests(); len(got) != 3 || got[0] != "bytes=1024-" {
+		t.Errorf("ranges requested = %q, want the resume and two segments", got)
+	}
+	assertFileContent(t, target, content)
+	assertStagingEmpty(t, tempDir)
+}
@@ -0,0 +1,139 @@
+package downloader
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/failure"
+)
+
+// maxRetryBackoff caps the wait before a download is tried again, however many retries came before.
+const maxRetryBackoff = 5 * time.Minute
+
+// maxBackoffMultiplier caps the multiplier of a status, so a typo can't stall a run for hours.
+const maxBackoffMultiplier = 20
+
+// defaultBackoffMultipliers wait longer before retrying Cloudflare's origin errors (520-524),
+// which come in bursts while the origin behind the CDN is struggling.
+var defaultBackoffMultipliers = map[int]float64{520: 2, 521: 2, 522: 2, 523: 2, 524: 2}
+
+// RetryPolicy decides which HTTP statuses are worth retrying and how much longer than the
+// base backoff to wait before each retry. 408, 429 and every 5xx are always retryable; a
+// nil policy is the built-in one.
+type RetryPolicy struct {
+	extra       map[int]bool    // Retryable on top of the built-in statuses
+	multipliers map[int]float64 // Backoff multiplier per status (1 if missing)
+}
+
+// NewRetryPolicy returns the built-in policy with the extra retryable statuses and the
+// backoff multipliers, keyed by status ("520" = 3), over the defaults. Statuses must be
+// 400-599; a multiplier needs a retryable status and must be above 0 and at most 20.
+func NewRetryPolicy(extra []int, multipliers map[string]float64) (*RetryPolicy, error) {
+	p := &RetryPolicy{extra: make(map[int]bool), multipliers: make(map[int]float64)}
+	for status, m := range defaultBackoffMultipliers {
+		p.multipliers[status] = m
+	}
+	for _, status := range extra {
+		if status < 400 || status > 599 {
+			return nil, fmt.Errorf("retryable status %d is not an HTTP error status (400-599)", status)
+		}
+		p.extra[status] = true
+	}
+	for key, m := range multipliers {
+		status, err := strconv.Atoi(strings.TrimSpace(key))
+		if err != nil || status < 400 || status > 599 {
+			return nil, fmt.Errorf("backoff multiplier for %q: not an HTTP error status (400-599)", key)
+		}
+		if !p.Retryable(status) {
+			return nil, fmt.Errorf("backoff multiplier for %d: the status is not retried (add it to the retryable statuses)", status)
+		}
+		if m <= 0 || m > maxBackoffMultiplier {
+			return nil, fmt.Errorf("backoff multiplier for %d: %v is not above 0 and at most %d", status, m, maxBackoffMultiplier)
+		}
+		p.multipliers[status] = m
+	}
+	return p, nil
+}
+
+// Retryable reports whether a response with the status is worth retrying.
+func (p *RetryPolicy) Retryable(status int) bool {
+	if status >= 500 || status == http.StatusRequestTimeout || status == http.StatusTooManyRequests {
+		return true
+	}
+	return p != nil && p.extra[status]
+}
+
+// Backoff returns how long to wait before retrying a response with the status, given the
+// base backoff of the attempt.
+func (p *RetryPolicy) Backoff(status int, base time.Duration) time.Duration {
+	multipliers := defaultBackoffMultipliers
+	if p != nil {
+		multipliers = p.multipliers
+	}
+	if m, ok := multipliers[status]; ok {
+		return time.Duration(float64(base) * m)
+	}
+	return base
+}
+
+// String describes the policy, e.g. "408, 429, 5xx, 403; backoff 520x2, 522x3".
+func (p *RetryPolicy) String() string {
+	if p == nil {
+		return "built-in"
+	}
+	var extra, multipliers []string
+	for status := range p.extra {
+		extra = append(extra, strconv.Itoa(status))
+	}
+	for status, m := range p.multipliers {
+		multipliers = append(multipliers, fmt.Sprintf("%dx%g", status, m))
+	}
+	sort.Strings(extra)
+	sort.Strings(multipliers)
+	s := "408, 429, 5xx"
+	if len(extra) > 0 {
+		s += ", " + strings.Join(extra, ", ")
+	}
+	if len(multipliers) > 0 {
+		s += "; backoff " + strings.Join(multipliers, ", ")
+	}
+	return s
+}
+
+// SetRetries makes the downloader try a download that failed on a server error or a
+// connection problem again, up to n times, before it reports the failure. The first retry
+// waits about delay, and each one after it twice as long as the last, stretched for the
+// status by the policy and with jitter, so the workers don't come back all at once. The
+// partial file is picked up by each retry.
+func (d *Downloader) SetRetries(n int, delay time.Duration, policy *RetryPolicy) {
+	d.retries, d.retryDelay, d.retryPolicy = max(n, 0), delay, policy
+}
+
+// retryable reports whether a failed download attempt is worth another: one answered by
+// a status of the retry policy (but not a Cloudflare challenge, which has a cool-down of
+// its own), or one whose connection failed. Refusals, bad data and disk errors are not.
+func (d *Downloader) retryable(err error, status int) bool {
+	if status != 0 {
+		return d.retryPolicy.Retryable(status) && failure.ReasonOf(err) != failure.Challenge
+	}
+	return failure.CategoryOf(err) == failure.Network && failure.ReasonOf(err) == ""
+}
+
+// retryBackoff returns the wait before the given retry (from 1) of a download that last
+// failed with status (0 if there was no response): between half and all of the doubled delay.
+func (d *Downloader) retryBackoff(retry, status int) time.Duration {
+	backoff := d.retryDelay
+	for i := 1; i < retry && backoff < maxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	backoff = min(d.retryPolicy.Backoff(status, backoff), maxRetryBackoff)
+	if backoff <= 0 {
+		return 0
+	}
+	return backoff/2 + rand.N(backoff/2+1)
+}
@@ -0,0 +1,247 @@
+package downloader
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/failure"
+	"github.com/dreamfast/go-civitai-downloader/internal/helpers"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MaxSegments caps SetSegments; more connections per file mostly invite rate limits.
+const MaxSegments = 16
+
+// SetSegments makes the downloader fetch each file over n connections at once, each
+// downloading its own byte range into the partial file. Segments are whole checkpoint
+// chunks, so files of less than two chunks, and servers that don't take Range requests,
+// still use one connection. n of 1 or less turns segmenting off.
+func (d *Downloader) SetSegments(n int) {
+	d.segments = min(n, MaxSegments)
+}
+
+// segment is a byte range of a segmented download: [start, end), written up to pos.
+type segment struct {
+	start, pos, end int64
+}
+
+// planSegments splits the rest of a download, from start to size, into up to n segments
+// of whole chunks (the last one ends at size). It returns nil if that gives fewer than two.
+func planSegments(start, size int64, n int, interval int64) []*segment {
+	if n < 2 || interval <= 0 || start%interval != 0 || size <= start {
+		return nil
+	}
+	chunks := (size - start + interval - 1) / interval
+	if n = int(min(int64(n), chunks)); n < 2 {
+		return nil
+	}
+	per, extra := chunks/int64(n), chunks%int64(n)
+	segments := make([]*segment, 0, n)
+	pos := start
+	for i := 0; i < n; i++ {
+		count := per
+		if int64(i) < extra {
+			count++
+		}
+		end := min(pos+count*interval, size)
+		segments = append(segments, &segment{start: pos, pos: pos, end: end})
+		pos = end
+	}
+	return segments
+}
+
+// segmentsFor plans a segmented download from the first response, or returns nil if the
+// file is to come over that response alone.
+func (d *Downloader) segmentsFor(resp *http.Response, partial *partialDownload) []*segment {
+	if d.segments < 2 {
+		return nil
+	}
+	size := resp.ContentLength
+	if resp.StatusCode == http.StatusPartialContent {
+		_, size, _ = parseContentRange(resp.Header.Get("Content-Range"))
+	} else if resp.Header.Get("Accept-Ranges") != "bytes" {
+		log.Debug("The server doesn't advertise Range support; downloading over one connection")
+		return nil
+	}
+	if size <= 0 {
+		return nil
+	}
+	return planSegments(partial.offset, size, d.segments, partial.ckpt.Interval)
+}
+
+// segmentedTransfer is the shared state of the connections of a segmented download.
+type segmentedTransfer struct {
+	d         *Downloader
+	url       string
+	validator string // If-Range for the segment requests
+	partial   *partialDownload
+	receipt   *Receipt
+
+	mu      sync.Mutex
+	sums    map[int]string // Hashes of chunks finished out of order, by index
+	written int64
+}
+
+// copySegments downloads the segments concurrently: the first from the body of resp, the
+// others with Range requests of their own. Each chunk's hash is kept as it completes, and
+// the checkpoint grows as far as the chunks are finished without a gap, so a later run
+// resumes from there. A segment that breaks off is continued like a single transfer,
+// from the same MaxTransferResumes. It returns the number of bytes written.
+func (d *Downloader) copySegments(ctx context.Context, url string, resp *http.Response, partial *partialDownload, segments []*segment, validator string, receipt *Receipt) (int64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	t := &segmentedTransfer{d: d, url: url, validator: validator, partial: partial, receipt: receipt, sums: make(map[int]string)}
+
+	errs := make([]error, len(segments))
+	var wg sync.WaitGroup
+	for i, seg := range segments {
+		var body io.ReadCloser
+		if i == 0 {
+			body = resp.Body
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if errs[i] = t.fetch(ctx, seg, body); errs[i] != nil {
+				cancel() // The file can't be finished without this segment
+			}
+		}()
+	}
+	wg.Wait()
+
+	// The first error is the cause; the others are mostly the cancellation it led to
+	var err error
+	for _, segErr := range errs {
+		if segErr != nil && (err == nil || errors.Is(err, context.Canceled) && !errors.Is(segErr, context.Canceled)) {
+			err = segErr
+		}
+	}
+	return t.written, err
+}
+
+// fetch downloads one segment, starting with body if given (the first response, whose
+// remainder is dropped once the segment is complete).
+func (t *segmentedTransfer) fetch(ctx context.Context, seg *segment, body io.ReadCloser) error {
+	w := &segmentWriter{t: t, seg: seg, hasher: sha256.New()}
+	for {
+		if body == nil {
+			resp, err := t.d.getRange(ctx, t.url, seg.pos, seg.end-1, t.validator)
+			if err != nil {
+				if !t.retry(ctx, seg, err) {
+					return err
+				}
+				continue
+			}
+			if start, _, ok := parseContentRange(resp.Header.Get("Content-Range")); resp.StatusCode != http.StatusPartialContent || !ok || start != seg.pos {
+				// A whole file (If-Range saw it change upstream) or another range can't go into this segment
+				resp.Body.Close()
+				return failure.Wrap(failure.ForHTTPStatus(resp.StatusCode), fmt.Errorf("%w: received status %d (range %q) for bytes %d-%d of %s",
+					ErrHttpStatus, resp.StatusCode, resp.Header.Get("Content-Range"), seg.pos, seg.end-1, t.url))
+			}
+			body = resp.Body
+		}
+		_, err := helpers.Copy(w, io.LimitReader(body, seg.end-seg.pos))
+		body.Close()
+		body = nil
+		if err == nil && seg.pos < seg.end {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if failure.CategoryOf(err) == failure.Disk || !t.retry(ctx, seg, err) {
+			return err
+		}
+	}
+}
+
+// retry takes one of the transfer's resumes for a broken-off segment and waits before it.
+// It returns false if none are left or ctx ended.
+func (t *segmentedTransfer) retry(ctx context.Context, seg *segment, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	t.mu.Lock()
+	if t.receipt.Resumes >= MaxTransferResumes {
+		t.mu.Unlock()
+		return false
+	}
+	t.receipt.Resumes++
+	resumes := t.receipt.Resumes
+	t.mu.Unlock()
+	log.WithError(err).Warnf("Segment %d-%d of %s broke off at byte %d; resuming (%d/%d)", seg.start, seg.end-1, t.url, seg.pos, resumes, MaxTransferResumes)
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(time.Duration(resumes) * transferResumeDelay):
+		return true
+	}
+}
+
+// chunkDone records the hash of a finished chunk and extends the checkpoint over the
+// chunks finished without a gap.
+func (t *segmentedTransfer) chunkDone(index int, sum string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sums[index] = sum
+	ckpt := &t.partial.ckpt
+	extended := false
+	for {
+		next, ok := t.sums[len(ckpt.Chunks)]
+		if !ok {
+			break
+		}
+		delete(t.sums, len(ckpt.Chunks))
+		ckpt.Chunks = append(ckpt.Chunks, next)
+		extended = true
+	}
+	if extended {
+		t.partial.saveCheckpoint()
+	}
+}
+
+// segmentWriter writes a segment at its place in the partial file, hashing each chunk
+// as it completes.
+type segmentWriter struct {
+	t      *segmentedTransfer
+	seg    *segment
+	hasher hash.Hash
+}
+
+func (w *segmentWriter) Write(b []byte) (int, error) {
+	interval := w.t.partial.ckpt.Interval
+	written := 0
+	for len(b) > 0 {
+		// Never let one write straddle a chunk boundary
+		n := min(int64(len(b)), interval-w.seg.pos%interval)
+		m, err := w.t.partial.file.WriteAt(b[:n], w.seg.pos)
+		totalWritten.Add(uint64(m))
+		w.hasher.Write(b[:m])
+		w.seg.pos += int64(m)
+		written += m
+		w.t.mu.Lock()
+		w.t.written += int64(m)
+		w.t.mu.Unlock()
+		if err != nil {
+			return written, err
+		}
+		if w.seg.pos%interval == 0 {
+			w.t.chunkDone(int(w.seg.pos/interval)-1, hex.EncodeToString(w.hasher.Sum(nil)))
+			w.hasher.Reset()
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
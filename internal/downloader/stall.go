@@ -0,0 +1,90 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http/httptrace"
+	"sync/atomic"
+	"time"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/failure"
+)
+
+// ErrStalled is the error of a transfer that received nothing for the stall timeout.
+var ErrStalled = failure.New(failure.Network, "download stalled")
+
+// SetStallTimeout makes the downloader give up on a connection that receives no bytes for
+// timeout, while waiting for the response or between reads of the body. The transfer is
+// then resumed (or the download retried) like one whose connection broke off. It doesn't
+// limit how long a transfer may take as a whole, so large files can take as long as they
+// need. 0 turns it off.
+func (d *Downloader) SetStallTimeout(timeout time.Duration) {
+	d.stallTimeout = max(timeout, 0)
+}
+
+// stallWatch cancels a request once it has received nothing for its timeout. The clock
+// starts when the request asks for a connection, so waiting for a challenge cool-down
+// before it is sent doesn't count.
+type stallWatch struct {
+	timeout time.Duration
+	timer   *time.Timer
+	cancel  context.CancelFunc
+	stalled atomic.Bool
+}
+
+// watchStalls returns ctx for a request watched for stalls, and the watch (nil if the
+// downloader has no stall timeout).
+func (d *Downloader) watchStalls(ctx context.Context) (context.Context, *stallWatch) {
+	if d.stallTimeout <= 0 {
+		return ctx, nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	w := &stallWatch{timeout: d.stallTimeout, cancel: cancel}
+	w.timer = time.AfterFunc(time.Hour, func() {
+		w.stalled.Store(true)
+		cancel()
+	})
+	w.timer.Stop()
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GetConn: func(string) { w.timer.Reset(w.timeout) },
+	})
+	return ctx, w
+}
+
+// stop ends the watch and releases its request.
+func (w *stallWatch) stop() {
+	w.timer.Stop()
+	w.cancel()
+}
+
+// err turns the error of a stalled request into ErrStalled.
+func (w *stallWatch) err(err error, url string) error {
+	if err == nil || errors.Is(err, io.EOF) || !w.stalled.Load() {
+		return err
+	}
+	return fmt.Errorf("%w: nothing received from %s for %v", ErrStalled, url, w.timeout)
+}
+
+// stallBody is a response body watched for stalls: each read that receives bytes restarts
+// the clock.
+type stallBody struct {
+	io.ReadCloser
+	watch *stallWatch
+	url   string
+}
+
+func (b *stallBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && !b.watch.stalled.Load() {
+		b.watch.timer.Reset(b.watch.timeout)
+	}
+	return n, b.watch.err(err, b.url)
+}
+
+func (b *stallBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.watch.stop()
+	return err
+}
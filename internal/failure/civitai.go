@@ -0,0 +1,117 @@
+package failure
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Reason is a recognised Civitai failure pattern. Unlike a Category it says what to do
+// about the failure; the values are part of the JSON output and the database.
+type Reason string
+
+const (
+	LoginRequired  Reason = "login-required"       // The download needs a logged-in account and no API key was sent
+	APIKeyRejected Reason = "api-key-rejected"     // An API key was sent but not accepted
+	EarlyAccess    Reason = "early-access"         // The version is in early access
+	Challenge      Reason = "cloudflare-challenge" // Cloudflare answered with a bot challenge
+	RegionBlocked  Reason = "region-blocked"       // Unavailable in the region the request came from
+	Removed        Reason = "removed"              // Deleted or hidden upstream
+	Throttled      Reason = "rate-limited"         // Civitai's rate limit
+)
+
+// ReasonField is the structured log field carrying the reason of a logged error.
+const ReasonField = "errorReason"
+
+// interpreted is an error recognised as a Civitai failure pattern.
+type interpreted struct {
+	category Category
+	reason   Reason
+	guidance string
+	err      error
+}
+
+func (e *interpreted) Error() string      { return fmt.Sprintf("%s: %s (%v)", e.reason, e.guidance, e.err) }
+func (e *interpreted) Unwrap() error      { return e.err }
+func (e *interpreted) Category() Category { return e.category }
+
+// Response is what is known about a failed Civitai response.
+type Response struct {
+	Status     int
+	Header     http.Header
+	Body       []byte // The start of the body is enough
+	WithAPIKey bool   // Whether the request was sent with an API key
+}
+
+// Interpret recognises the Civitai failure patterns in resp (login pages served instead
+// of the file, early access, Cloudflare challenges, ...) and returns err with the reason
+// and what to do about it. Responses it doesn't recognise leave err unchanged.
+func Interpret(err error, resp Response) error {
+	if err == nil {
+		return nil
+	}
+	category, reason, guidance := recognize(resp)
+	if reason == "" {
+		return err
+	}
+	return &interpreted{category: category, reason: reason, guidance: guidance, err: err}
+}
+
+// ReasonOf returns the reason of err if Interpret recognised it, otherwise "".
+func ReasonOf(err error) Reason {
+	var e *interpreted
+	if errors.As(err, &e) {
+		return e.reason
+	}
+	return ""
+}
+
+// IsHTML reports whether a response is an HTML page.
+func IsHTML(header http.Header, body []byte) bool {
+	if strings.HasPrefix(strings.ToLower(header.Get("Content-Type")), "text/html") {
+		return true
+	}
+	start := strings.ToLower(strings.TrimSpace(string(body[:min(len(body), 512)])))
+	return strings.HasPrefix(start, "<!doctype html") || strings.HasPrefix(start, "<html")
+}
+
+// IsChallenge reports whether a response is a Cloudflare bot challenge rather than the
+// answer of Civitai itself.
+func IsChallenge(resp Response) bool {
+	if strings.EqualFold(resp.Header.Get("Cf-Mitigated"), "challenge") {
+		return true
+	}
+	if !strings.Contains(strings.ToLower(resp.Header.Get("Server")), "cloudflare") || !IsHTML(resp.Header, resp.Body) {
+		return false
+	}
+	body := strings.ToLower(string(resp.Body))
+	return strings.Contains(body, "just a moment") || strings.Contains(body, "challenge-platform") || strings.Contains(body, "cf-chl")
+}
+
+// recognize returns the category, reason and guidance of a failed response, or an empty
+// reason if it isn't a known pattern.
+func recognize(resp Response) (Category, Reason, string) {
+	body := strings.ToLower(string(resp.Body))
+	html := IsHTML(resp.Header, resp.Body)
+
+	switch {
+	case IsChallenge(resp):
+		return RateLimit, Challenge, "Cloudflare is challenging the requests as automated traffic; lower the concurrency, raise ApiDelayMs and try again later"
+	case resp.Status == http.StatusUnavailableForLegalReasons:
+		return NotFound, RegionBlocked, "Civitai doesn't offer this file in the region the request came from"
+	case strings.Contains(body, "early access"), strings.Contains(body, "earlyaccess"), strings.Contains(body, "early-access"):
+		return Auth, EarlyAccess, "the version is in early access; it can be downloaded once early access ends, or with the API key of an account that has bought access"
+	case resp.Status == http.StatusNotFound, resp.Status == http.StatusGone:
+		return NotFound, Removed, "it was deleted or hidden on Civitai; retrying won't help"
+	case resp.Status == http.StatusTooManyRequests:
+		return RateLimit, Throttled, "Civitai's rate limit was hit; lower the concurrency or raise ApiDelayMs"
+	case resp.Status == http.StatusUnauthorized && resp.WithAPIKey,
+		html && resp.WithAPIKey && (resp.Status == http.StatusOK || resp.Status == http.StatusForbidden):
+		return Auth, APIKeyRejected, "the API key was not accepted; it may have been revoked or expired, create a new one at https://civitai.com/user/account"
+	case resp.Status == http.StatusUnauthorized,
+		!resp.WithAPIKey && (resp.Status == http.StatusForbidden || html && resp.Status == http.StatusOK):
+		return Auth, LoginRequired, "Civitai only allows this download when logged in; set ApiKey (or --api-key) to an API key from https://civitai.com/user/account"
+	}
+	return "", "", ""
+}
@@ -0,0 +1,128 @@
+// Package failure classifies errors into a small, stable set of categories so that
+// JSON logs and database reports can be aggregated without matching on message text.
+package failure
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Category is a machine-readable failure class. The values are part of the JSON output.
+type Category string
+
+const (
+	Network      Category = "network"      // Connection, DNS, timeout or server-side (5xx) failures
+	RateLimit    Category = "rate-limit"   // HTTP 429 or an API rate limit response
+	Auth         Category = "auth"         // Missing or rejected API key (HTTP 401/403)
+	NotFound     Category = "not-found"    // The model, version or file no longer exists
+	Disk         Category = "disk"         // Local filesystem errors (permissions, space, rename)
+	Verification Category = "verification" // Hash mismatch or a changed hash pin
+	Filtered     Category = "filtered"     // Skipped on purpose by a filter
+	Unknown      Category = "unknown"      // Anything not covered above
+)
+
+// LogField is the structured log field carrying the category of a logged error.
+const LogField = "errorCategory"
+
+// categorized is implemented by errors that know their own category.
+type categorized interface {
+	Category() Category
+}
+
+type sentinel struct {
+	category Category
+	msg      string
+}
+
+func (e *sentinel) Error() string      { return e.msg }
+func (e *sentinel) Category() Category { return e.category }
+
+// New returns a sentinel error with a fixed category, for use in package-level
+// `var ErrX = failure.New(...)` declarations. Match it with errors.Is as usual.
+func New(category Category, msg string) error {
+	return &sentinel{category: category, msg: msg}
+}
+
+type wrapped struct {
+	category Category
+	err      error
+}
+
+func (e *wrapped) Error() string      { return e.err.Error() }
+func (e *wrapped) Unwrap() error      { return e.err }
+func (e *wrapped) Category() Category { return e.category }
+
+// Wrap attaches a category to err without changing its message. It returns nil for a nil err.
+func Wrap(category Category, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &wrapped{category: category, err: err}
+}
+
+// ForHTTPStatus maps an unexpected HTTP status code to a category.
+func ForHTTPStatus(code int) Category {
+	switch code {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return Auth
+	case http.StatusNotFound, http.StatusGone:
+		return NotFound
+	case http.StatusTooManyRequests:
+		return RateLimit
+	}
+	return Network
+}
+
+// CategoryOf returns the category of err: the outermost explicit category in its chain,
+// otherwise a best guess from well-known standard library errors. It returns "" for nil.
+func CategoryOf(err error) Category {
+	if err == nil {
+		return ""
+	}
+	var c categorized
+	if errors.As(err, &c) {
+		return c.Category()
+	}
+
+	// Checked before net.Error: syscall.Errno also satisfies that interface
+	var pathErr *fs.PathError
+	var linkErr *os.LinkError
+	if errors.Is(err, syscall.ENOSPC) || errors.As(err, &pathErr) || errors.As(err, &linkErr) {
+		return Disk
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return Network
+	}
+	return Unknown
+}
+
+// Hook is a logrus hook that adds LogField (and ReasonField, if known) to every entry
+// logged with WithError.
+type Hook struct{}
+
+// Levels implements log.Hook.
+func (Hook) Levels() []log.Level { return log.AllLevels }
+
+// Fire implements log.Hook.
+func (Hook) Fire(entry *log.Entry) error {
+	if err, ok := entry.Data[log.ErrorKey].(error); ok {
+		if _, set := entry.Data[LogField]; !set {
+			entry.Data[LogField] = CategoryOf(err)
+		}
+		if _, set := entry.Data[ReasonField]; !set {
+			if reason := ReasonOf(err); reason != "" {
+				entry.Data[ReasonField] = reason
+			}
+		}
+	}
+	return nil
+}
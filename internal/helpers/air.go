@@ -0,0 +1,143 @@
+package helpers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// AIR is an AI Resource identifier, urn:air:{ecosystem}:{type}:{source}:{id}[@{version}],
+// e.g. urn:air:sdxl:lora:civitai:328553@368189. Only Civitai resources are supported.
+type AIR struct {
+	Ecosystem string // sd1, sd2, sdxl, flux1, ... ("" if left out)
+	Type      string // checkpoint, lora, embedding, ... ("" if left out)
+	ModelID   int
+	VersionID int // 0 without @version
+}
+
+// airSource is the source segment of the resources Civitai hosts.
+const airSource = "civitai"
+
+// airTypes maps Civitai's model types to their AIR type where the two differ; the others
+// are lower-cased.
+var airTypes = map[string]string{
+	"textualinversion":  "embedding",
+	"hypernetwork":      "hypernet",
+	"aestheticgradient": "ag",
+	"locon":             "lycoris",
+	"motionmodule":      "motion",
+}
+
+// AIRType returns the AIR type of a Civitai model type ("LORA" -> "lora").
+func AIRType(modelType string) string {
+	t := strings.ToLower(strings.ReplaceAll(modelType, " ", ""))
+	if mapped, ok := airTypes[t]; ok {
+		return mapped
+	}
+	if t == "" {
+		return "other"
+	}
+	return t
+}
+
+// AIREcosystem returns the AIR ecosystem of a Civitai base model ("SDXL 1.0" -> "sdxl",
+// "SD 1.5" -> "sd1", "Flux.1 D" -> "flux1"). Base models it doesn't know are lower-cased
+// with everything but letters and digits dropped.
+func AIREcosystem(baseModel string) string {
+	b := strings.ToLower(strings.TrimSpace(baseModel))
+	switch {
+	case b == "":
+		return "unknown"
+	case strings.HasPrefix(b, "sdxl"):
+		return "sdxl"
+	case strings.HasPrefix(b, "sd 1"):
+		return "sd1"
+	case strings.HasPrefix(b, "sd 2"):
+		return "sd2"
+	case strings.HasPrefix(b, "sd 3"):
+		return "sd3"
+	case strings.HasPrefix(b, "flux.1"), strings.HasPrefix(b, "flux1"):
+		return "flux1"
+	case strings.HasPrefix(b, "pony"):
+		return "pony"
+	}
+	var out strings.Builder
+	for _, r := range b {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			out.WriteRune(r)
+		}
+	}
+	return out.String()
+}
+
+// NewAIR returns the AIR of a Civitai model version (versionID 0 for the model).
+func NewAIR(modelType, baseModel string, modelID, versionID int) AIR {
+	return AIR{Ecosystem: AIREcosystem(baseModel), Type: AIRType(modelType), ModelID: modelID, VersionID: versionID}
+}
+
+// String formats the AIR as a URN; left-out ecosystem and type become "unknown" and "other".
+func (a AIR) String() string {
+	ecosystem, t := a.Ecosystem, a.Type
+	if ecosystem == "" {
+		ecosystem = "unknown"
+	}
+	if t == "" {
+		t = "other"
+	}
+	s := fmt.Sprintf("urn:air:%s:%s:%s:%d", ecosystem, t, airSource, a.ModelID)
+	if a.VersionID > 0 {
+		s += "@" + strconv.Itoa(a.VersionID)
+	}
+	return s
+}
+
+// IsAIR reports whether s looks like an AIR (starts with "urn:air:").
+func IsAIR(s string) bool {
+	return len(s) >= 8 && strings.EqualFold(s[:8], "urn:air:")
+}
+
+// ParseAIR reads an AIR. The urn:air: prefix, the ecosystem and the type may be left out
+// ("civitai:328553@368189"); a layer (":..."), format (".safetensors") or other suffix
+// after the ID is ignored.
+func ParseAIR(s string) (AIR, error) {
+	var a AIR
+	rest := strings.TrimSpace(s)
+	if IsAIR(rest) {
+		rest = rest[8:]
+	}
+	parts := strings.Split(rest, ":")
+	source := -1
+	for i, part := range parts {
+		if strings.EqualFold(part, airSource) {
+			source = i
+			break
+		}
+	}
+	switch {
+	case source < 0:
+		return a, fmt.Errorf("AIR %q: not a Civitai resource (no %q source)", s, airSource)
+	case source > 2 || source+1 >= len(parts):
+		return a, fmt.Errorf("AIR %q: expected urn:air:{ecosystem}:{type}:civitai:{id}[@{version}]", s)
+	}
+	if source == 2 {
+		a.Ecosystem, a.Type = strings.ToLower(parts[0]), strings.ToLower(parts[1])
+	} else if source == 1 {
+		a.Type = strings.ToLower(parts[0])
+	}
+
+	id := parts[source+1]
+	if dot := strings.IndexByte(id, '.'); dot >= 0 {
+		id = id[:dot] // Format
+	}
+	model, version, hasVersion := strings.Cut(id, "@")
+	var err error
+	if a.ModelID, err = strconv.Atoi(model); err != nil || a.ModelID <= 0 {
+		return AIR{}, fmt.Errorf("AIR %q: invalid model ID %q", s, model)
+	}
+	if hasVersion {
+		if a.VersionID, err = strconv.Atoi(version); err != nil || a.VersionID <= 0 {
+			return AIR{}, fmt.Errorf("AIR %q: invalid version ID %q", s, version)
+		}
+	}
+	return a, nil
+}
@@ -0,0 +1,114 @@
+package helpers
+
+import (
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bandwidth classes, each with its own budget.
+const (
+	BandwidthMetadata = "metadata" // API JSON
+	BandwidthPreviews = "previews" // Preview and gallery images and videos
+	BandwidthBinaries = "binaries" // Model files
+
+	// BandwidthTotal is the key of the limit on all classes together (LimitRate).
+	BandwidthTotal = "total"
+)
+
+// ClassifyTransfer returns the bandwidth class of a response by its URL and Content-Type.
+func ClassifyTransfer(u *url.URL, contentType string) string {
+	contentType = strings.ToLower(contentType)
+	switch {
+	case u != nil && strings.Contains(u.Path, "/api/download/"), strings.HasPrefix(contentType, "application/octet-stream"):
+		return BandwidthBinaries
+	case strings.HasPrefix(contentType, "image/"), strings.HasPrefix(contentType, "video/"),
+		u != nil && strings.HasPrefix(strings.ToLower(u.Hostname()), "image."):
+		return BandwidthPreviews
+	}
+	return BandwidthMetadata
+}
+
+// BandwidthLimiter is a token bucket of bytes shared by all transfers of a class. A nil
+// limiter doesn't limit.
+type BandwidthLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // Bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewBandwidthLimiter returns a limiter for bytesPerSecond, or nil for 0 (unlimited).
+func NewBandwidthLimiter(bytesPerSecond uint64) *BandwidthLimiter {
+	if bytesPerSecond == 0 {
+		return nil
+	}
+	rate := float64(bytesPerSecond)
+	// A quarter second of transfer, at least 16KB, keeps reads reasonably sized
+	burst := rate / 4
+	if burst < 16*1024 {
+		burst = 16 * 1024
+	}
+	return &BandwidthLimiter{rate: rate, burst: burst, tokens: burst}
+}
+
+// Chunk is the largest read the limiter should be asked for at once.
+func (l *BandwidthLimiter) Chunk() int {
+	if l == nil {
+		return 0
+	}
+	return int(l.burst)
+}
+
+// Wait blocks until n more bytes fit in the budget.
+func (l *BandwidthLimiter) Wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	if d := l.reserve(n, time.Now()); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// reserve takes n bytes from the bucket and returns how long to wait for them.
+func (l *BandwidthLimiter) reserve(n int, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// LimitReader returns r, reading no faster than l allows.
+func LimitReader(r io.Reader, l *BandwidthLimiter) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &limitedReader{r: r, l: l}
+}
+
+type limitedReader struct {
+	r io.Reader
+	l *BandwidthLimiter
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if chunk := lr.l.Chunk(); len(p) > chunk {
+		p = p[:chunk]
+	}
+	n, err := lr.r.Read(p)
+	lr.l.Wait(n)
+	return n, err
+}
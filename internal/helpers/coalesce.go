@@ -0,0 +1,47 @@
+package helpers
+
+import "sync"
+
+// Coalescer runs one call per key at a time and hands its result to every caller that
+// asked for the same key while it ran, like golang.org/x/sync/singleflight. Results are
+// not kept once the call returns. The zero value is ready to use.
+type Coalescer struct {
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+// coalescedCall is a call in progress and, once done is closed, its result.
+type coalescedCall struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+	waits int
+}
+
+// Do runs fn for key, or waits for the call already running for key and returns its
+// result. shared reports whether the result went to more than one caller.
+func (c *Coalescer) Do(key string, fn func() (interface{}, error)) (value interface{}, err error, shared bool) {
+	c.mu.Lock()
+	if c.calls == nil {
+		c.calls = make(map[string]*coalescedCall)
+	}
+	if call, ok := c.calls[key]; ok {
+		call.waits++
+		c.mu.Unlock()
+		<-call.done
+		return call.value, call.err, true
+	}
+	call := &coalescedCall{done: make(chan struct{})}
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.calls, key)
+		shared = call.waits > 0
+		c.mu.Unlock()
+		close(call.done)
+	}()
+	call.value, call.err = fn()
+	return call.value, call.err, false
+}
@@ -0,0 +1,13 @@
+package helpers
+
+import "strings"
+
+// CollateLess orders names the same way on every machine, whatever the locale: by their
+// lower-case form, and names that differ only in case by their bytes, so the order is
+// total and sorting is stable across runs.
+func CollateLess(a, b string) bool {
+	if la, lb := strings.ToLower(a), strings.ToLower(b); la != lb {
+		return la < lb
+	}
+	return a < b
+}
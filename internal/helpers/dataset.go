@@ -0,0 +1,79 @@
+package helpers
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// annexMaxExtensionLength is git-annex's default annex.maxextensionlength: longer
+// extensions (such as .safetensors) are not part of SHA256E keys.
+const annexMaxExtensionLength = 4
+
+// AnnexKey returns the git-annex SHA256E key of a file with the given SHA256 (hex), size and
+// name, as `git annex add` would compute it with the default backend.
+func AnnexKey(sha256Hex string, size int64, name string) string {
+	key := fmt.Sprintf("SHA256E-s%d--%s", size, strings.ToLower(sha256Hex))
+	ext := filepath.Ext(name)
+	if n := len(ext) - 1; n < 1 || n > annexMaxExtensionLength {
+		return key
+	}
+	for _, r := range ext[1:] {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			return key
+		}
+	}
+	return key + ext
+}
+
+// FileMD5 returns the MD5 (hex) of a file, the hash DVC tracks outputs by.
+func FileMD5(path string) (string, error) {
+	return calculateHash(path, md5.New())
+}
+
+// FileSHA256 returns the SHA256 (hex) of a file, for AnnexKey.
+func FileSHA256(path string) (string, error) {
+	return calculateHash(path, sha256.New())
+}
+
+// DVCFile returns the contents of the .dvc file `dvc add` writes for a file with the given
+// MD5 (hex), size and name (relative to the .dvc file).
+func DVCFile(md5Hex string, size int64, name string) []byte {
+	return []byte(fmt.Sprintf("outs:\n- md5: %s\n  size: %d\n  hash: md5\n  path: %s\n", strings.ToLower(md5Hex), size, name))
+}
+
+// AddGitignoreEntry adds "/name" to the .gitignore in dir, as `dvc add` does, unless it is
+// already listed.
+func AddGitignoreEntry(dir, name string) error {
+	path := filepath.Join(dir, ".gitignore")
+	entry := "/" + name
+	existing, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, line := range strings.Split(string(existing), "\n") {
+		if strings.TrimSpace(line) == entry {
+			return nil
+		}
+	}
+	if len(existing) > 0 && existing[len(existing)-1] != '\n' {
+		entry = "\n" + entry
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(f, entry); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	ApplyFileMode(path)
+	return nil
+}
@@ -0,0 +1,28 @@
+package helpers
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// FreeSpace returns the bytes available to this process on the filesystem path is on, and
+// an ID of that filesystem (paths with the same ID share the free space). path need not
+// exist yet: its nearest existing parent is checked. Platforms without a check return an
+// error.
+func FreeSpace(path string) (free uint64, device string, err error) {
+	dir, err := filepath.Abs(path)
+	if err != nil {
+		return 0, "", err
+	}
+	for {
+		if _, statErr := os.Stat(dir); statErr == nil {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+	return freeSpace(dir)
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package helpers
+
+import (
+	"errors"
+	"fmt"
+)
+
+// freeSpace has no check on this platform.
+func freeSpace(dir string) (uint64, string, error) {
+	return 0, "", fmt.Errorf("checking free space of %s: %w", dir, errors.ErrUnsupported)
+}
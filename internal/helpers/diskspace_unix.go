@@ -0,0 +1,22 @@
+//go:build linux || darwin || freebsd
+
+package helpers
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// freeSpace asks statfs for the blocks available to unprivileged users (those reserved
+// for root don't count), and identifies the filesystem by its device number.
+func freeSpace(dir string) (uint64, string, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(dir, &fs); err != nil {
+		return 0, "", fmt.Errorf("checking free space of %s: %w", dir, err)
+	}
+	var st syscall.Stat_t
+	if err := syscall.Stat(dir, &st); err != nil {
+		return 0, "", fmt.Errorf("checking free space of %s: %w", dir, err)
+	}
+	return uint64(fs.Bavail) * uint64(fs.Bsize), fmt.Sprint(st.Dev), nil
+}
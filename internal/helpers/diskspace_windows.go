@@ -0,0 +1,25 @@
+package helpers
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+var procGetDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// freeSpace asks GetDiskFreeSpaceEx for the bytes available to the caller (which respects
+// disk quotas), and identifies the filesystem by its volume name.
+func freeSpace(dir string) (uint64, string, error) {
+	name, err := syscall.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, "", err
+	}
+	var available uint64
+	if ok, _, callErr := procGetDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(name)), uintptr(unsafe.Pointer(&available)), 0, 0); ok == 0 {
+		return 0, "", fmt.Errorf("checking free space of %s: %w", dir, callErr)
+	}
+	return available, strings.ToUpper(filepath.VolumeName(dir)), nil
+}
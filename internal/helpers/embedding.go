@@ -0,0 +1,79 @@
+package helpers
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+)
+
+// IsEmbeddingType reports whether modelType is an embedding (TextualInversion).
+func IsEmbeddingType(modelType string) bool {
+	return strings.EqualFold(modelType, "TextualInversion")
+}
+
+// EmbeddingToken returns the activation token of an embedding file: UIs like A1111 and
+// ComfyUI invoke an embedding by its file name without extension, so that is the token.
+func EmbeddingToken(fileName string) string {
+	return strings.TrimSpace(strings.TrimSuffix(fileName, filepath.Ext(fileName)))
+}
+
+// EmbeddingFileName returns the name an embedding file is saved under: its original name,
+// so the activation token stays the one its creator published (case included), with
+// characters that can't be in a file name replaced by '_'. The extension follows the
+// format (.safetensors, .pt).
+func EmbeddingFileName(file models.File) string {
+	name := strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, EmbeddingToken(file.Name))
+	if name = strings.Trim(name, ". "); name == "" {
+		name = "embedding"
+	}
+	ext := strings.ToLower(filepath.Ext(file.Name))
+	switch {
+	case strings.EqualFold(file.Metadata.Format, "SafeTensor"):
+		ext = ".safetensors"
+	case ext == "" && strings.EqualFold(file.Metadata.Format, "PickleTensor"):
+		ext = ".pt"
+	case ext == "":
+		ext = ".bin"
+	}
+	return name + ext
+}
+
+// EntryEmbeddingToken returns the activation token of an embedding entry: the recorded
+// token, or for entries written before tokens were recorded the one of the original file
+// name. It returns "" for other model types.
+func EntryEmbeddingToken(entry models.DatabaseEntry) string {
+	if entry.EmbeddingToken != "" {
+		return entry.EmbeddingToken
+	}
+	if !IsEmbeddingType(entry.ModelType) && !IsEmbeddingType(entry.InferredType) {
+		return ""
+	}
+	name := entry.File.Name
+	if name == "" {
+		// Fall back to the local name minus the "<versionID>_" prefix the downloader adds
+		name = strings.TrimPrefix(entry.Filename, fmt.Sprintf("%d_", entry.Version.ID))
+	}
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+// TriggerPhrases returns the individual trigger words/phrases of a version's trained
+// words. Civitai often packs several phrases into one trained word separated by commas.
+func TriggerPhrases(trainedWords []string) []string {
+	var words []string
+	for _, trained := range trainedWords {
+		for _, part := range strings.Split(trained, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				words = append(words, part)
+			}
+		}
+	}
+	return words
+}
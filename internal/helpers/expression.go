@@ -0,0 +1,691 @@
+package helpers
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Expression is a compiled filter expression such as
+//
+//	model.Stats.DownloadCount > 1000 && !("anime" in model.Tags)
+//
+// It supports the literals true, false, null, numbers, 'single' or "double" quoted strings
+// and [lists]; field access with dots (matched case-insensitively, so both Go and JSON
+// field names work); the operators || && ! == != < <= > >= + - * / and `in` (list
+// membership, substring, or map key), with `not in` and the word forms and/or/not; and the
+// functions lower(s), upper(s), len(x) and matches(s, regexp). A missing field is null.
+type Expression struct {
+	source string
+	root   exprNode
+}
+
+// CompileExpression parses an expression.
+func CompileExpression(source string) (*Expression, error) {
+	tokens, err := tokenizeExpression(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %q at position %d", tok.text, tok.pos)
+	}
+	return &Expression{source: source, root: root}, nil
+}
+
+// String returns the expression's source.
+func (e *Expression) String() string {
+	return e.source
+}
+
+// Eval evaluates the expression against env, whose values are what encoding/json
+// produces when decoding into an interface{} (maps, slices, float64, string, bool, nil).
+func (e *Expression) Eval(env map[string]interface{}) (interface{}, error) {
+	return e.root.eval(env)
+}
+
+// Match evaluates the expression and requires a boolean result.
+func (e *Expression) Match(env map[string]interface{}) (bool, error) {
+	value, err := e.Eval(env)
+	if err != nil {
+		return false, err
+	}
+	result, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("expression evaluated to %s, not true or false", describeExprValue(value))
+	}
+	return result, nil
+}
+
+// --- Tokenizer ---
+
+type exprTokenKind int
+
+const (
+	tokEOF exprTokenKind = iota
+	tokNumber
+	tokString
+	tokIdent
+	tokOp
+)
+
+type exprToken struct {
+	kind exprTokenKind
+	text string
+	num  float64
+	pos  int
+}
+
+// exprOperators are matched longest first.
+var exprOperators = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "+", "-", "*", "/", "(", ")", "[", "]", ",", "."}
+
+func tokenizeExpression(source string) ([]exprToken, error) {
+	var tokens []exprToken
+	runes := []rune(source)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case unicode.IsDigit(r):
+			start := i
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.' || runes[i] == '_') {
+				i++
+			}
+			text := strings.ReplaceAll(string(runes[start:i]), "_", "")
+			num, err := strconv.ParseFloat(text, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %q at position %d", string(runes[start:i]), start)
+			}
+			tokens = append(tokens, exprToken{kind: tokNumber, text: string(runes[start:i]), num: num, pos: start})
+		case r == '"' || r == '\'':
+			start := i
+			var sb strings.Builder
+			i++
+			for ; i < len(runes) && runes[i] != r; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				sb.WriteRune(runes[i])
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("unterminated string starting at position %d", start)
+			}
+			i++
+			tokens = append(tokens, exprToken{kind: tokString, text: sb.String(), pos: start})
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_') {
+				i++
+			}
+			tokens = append(tokens, exprToken{kind: tokIdent, text: string(runes[start:i]), pos: start})
+		default:
+			matched := false
+			for _, op := range exprOperators {
+				if strings.HasPrefix(string(runes[i:]), op) {
+					tokens = append(tokens, exprToken{kind: tokOp, text: op, pos: i})
+					i += len([]rune(op))
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unexpected character %q at position %d", r, i)
+			}
+		}
+	}
+	return append(tokens, exprToken{kind: tokEOF, text: "end of expression", pos: len(runes)}), nil
+}
+
+// --- Parser ---
+
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() exprToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// accept consumes the next token if it is one of the given operators or keywords.
+func (p *exprParser) accept(texts ...string) (string, bool) {
+	tok := p.peek()
+	if tok.kind != tokOp && tok.kind != tokIdent {
+		return "", false
+	}
+	for _, text := range texts {
+		if tok.text == text {
+			p.pos++
+			return text, true
+		}
+	}
+	return "", false
+}
+
+func (p *exprParser) expect(text string) error {
+	if _, ok := p.accept(text); !ok {
+		tok := p.peek()
+		return fmt.Errorf("expected %q at position %d, found %q", text, tok.pos, tok.text)
+	}
+	return nil
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.accept("||", "or"); !ok {
+			return left, nil
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &exprLogical{or: true, left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.accept("&&", "and"); !ok {
+			return left, nil
+		}
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &exprLogical{left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseNot() (exprNode, error) {
+	if _, ok := p.accept("!", "not"); ok {
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &exprNot{operand: operand}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *exprParser) parseComparison() (exprNode, error) {
+	left, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	op, ok := p.accept("==", "!=", "<", "<=", ">", ">=", "in")
+	if !ok {
+		// "not in" (a bare "not" here can only start that)
+		if next := p.peek(); next.kind == tokIdent && next.text == "not" && p.tokens[p.pos+1].text == "in" {
+			p.pos += 2
+			op = "not in"
+		} else {
+			return left, nil
+		}
+	}
+	right, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	return &exprBinary{op: op, left: left, right: right}, nil
+}
+
+func (p *exprParser) parseAdditive() (exprNode, error) {
+	left, err := p.parseMultiplicative()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.accept("+", "-")
+		if !ok {
+			return left, nil
+		}
+		right, err := p.parseMultiplicative()
+		if err != nil {
+			return nil, err
+		}
+		left = &exprBinary{op: op, left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseMultiplicative() (exprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.accept("*", "/")
+		if !ok {
+			return left, nil
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &exprBinary{op: op, left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if _, ok := p.accept("-"); ok {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &exprBinary{op: "-", left: &exprLiteral{value: float64(0)}, right: operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokNumber:
+		return &exprLiteral{value: tok.num}, nil
+	case tokString:
+		return &exprLiteral{value: tok.text}, nil
+	case tokOp:
+		switch tok.text {
+		case "(":
+			inner, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			return inner, p.expect(")")
+		case "[":
+			list := &exprList{}
+			if _, ok := p.accept("]"); ok {
+				return list, nil
+			}
+			for {
+				item, err := p.parseOr()
+				if err != nil {
+					return nil, err
+				}
+				list.items = append(list.items, item)
+				if _, ok := p.accept(","); !ok {
+					return list, p.expect("]")
+				}
+			}
+		}
+	case tokIdent:
+		switch strings.ToLower(tok.text) {
+		case "true":
+			return &exprLiteral{value: true}, nil
+		case "false":
+			return &exprLiteral{value: false}, nil
+		case "null", "nil":
+			return &exprLiteral{value: nil}, nil
+		}
+		if _, ok := p.accept("("); ok {
+			return p.parseCall(tok)
+		}
+		path := []string{tok.text}
+		for {
+			if _, ok := p.accept("."); !ok {
+				return &exprField{path: path}, nil
+			}
+			field := p.next()
+			if field.kind != tokIdent {
+				return nil, fmt.Errorf("expected a field name at position %d, found %q", field.pos, field.text)
+			}
+			path = append(path, field.text)
+		}
+	}
+	return nil, fmt.Errorf("unexpected %q at position %d", tok.text, tok.pos)
+}
+
+// exprFunctions maps function names to their number of arguments.
+var exprFunctions = map[string]int{"lower": 1, "upper": 1, "len": 1, "matches": 2}
+
+func (p *exprParser) parseCall(name exprToken) (exprNode, error) {
+	arity, known := exprFunctions[strings.ToLower(name.text)]
+	if !known {
+		return nil, fmt.Errorf("unknown function %q at position %d", name.text, name.pos)
+	}
+	call := &exprCall{name: strings.ToLower(name.text)}
+	if _, ok := p.accept(")"); !ok {
+		for {
+			arg, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			call.args = append(call.args, arg)
+			if _, ok := p.accept(","); !ok {
+				break
+			}
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+	}
+	if len(call.args) != arity {
+		return nil, fmt.Errorf("%s() takes %d argument(s), got %d", call.name, arity, len(call.args))
+	}
+	if call.name == "matches" {
+		// Compile a literal pattern once
+		if lit, ok := call.args[1].(*exprLiteral); ok {
+			pattern, isString := lit.value.(string)
+			if !isString {
+				return nil, fmt.Errorf("matches() needs a string pattern")
+			}
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern in matches(): %w", err)
+			}
+			call.re = re
+		}
+	}
+	return call, nil
+}
+
+// --- Evaluation ---
+
+type exprNode interface {
+	eval(env map[string]interface{}) (interface{}, error)
+}
+
+type exprLiteral struct{ value interface{} }
+
+func (n *exprLiteral) eval(map[string]interface{}) (interface{}, error) { return n.value, nil }
+
+type exprList struct{ items []exprNode }
+
+func (n *exprList) eval(env map[string]interface{}) (interface{}, error) {
+	values := make([]interface{}, 0, len(n.items))
+	for _, item := range n.items {
+		value, err := item.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+type exprField struct{ path []string }
+
+func (n *exprField) eval(env map[string]interface{}) (interface{}, error) {
+	var current interface{} = env
+	for i, name := range n.path {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			if current == nil {
+				return nil, nil // Fields of a missing value are missing too
+			}
+			return nil, fmt.Errorf("cannot read field %s of %s (%s)", name, strings.Join(n.path[:i], "."), describeExprValue(current))
+		}
+		current = lookupFold(m, name)
+	}
+	return current, nil
+}
+
+// lookupFold returns m[name], matching the key case-insensitively if there is no exact match.
+func lookupFold(m map[string]interface{}, name string) interface{} {
+	if value, ok := m[name]; ok {
+		return value
+	}
+	for key, value := range m {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return nil
+}
+
+type exprNot struct{ operand exprNode }
+
+func (n *exprNot) eval(env map[string]interface{}) (interface{}, error) {
+	value, err := n.operand.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := value.(bool)
+	if !ok {
+		return nil, fmt.Errorf("! needs true or false, got %s", describeExprValue(value))
+	}
+	return !b, nil
+}
+
+type exprLogical struct {
+	or          bool
+	left, right exprNode
+}
+
+func (n *exprLogical) eval(env map[string]interface{}) (interface{}, error) {
+	for i, operand := range []exprNode{n.left, n.right} {
+		value, err := operand.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		b, ok := value.(bool)
+		if !ok {
+			op := "&&"
+			if n.or {
+				op = "||"
+			}
+			return nil, fmt.Errorf("%s needs true or false, got %s", op, describeExprValue(value))
+		}
+		if i == 0 && b == n.or {
+			return b, nil // Short-circuit
+		}
+		if i == 1 {
+			return b, nil
+		}
+	}
+	return false, nil
+}
+
+type exprBinary struct {
+	op          string
+	left, right exprNode
+}
+
+func (n *exprBinary) eval(env map[string]interface{}) (interface{}, error) {
+	left, err := n.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "==":
+		return exprEqual(left, right), nil
+	case "!=":
+		return !exprEqual(left, right), nil
+	case "in", "not in":
+		found, err := exprContains(right, left)
+		if err != nil {
+			return nil, err
+		}
+		return found == (n.op == "in"), nil
+	case "+":
+		if ls, ok := left.(string); ok {
+			if rs, ok := right.(string); ok {
+				return ls + rs, nil
+			}
+		}
+	}
+
+	lf, lok := left.(float64)
+	rf, rok := right.(float64)
+	if lok && rok {
+		switch n.op {
+		case "<":
+			return lf < rf, nil
+		case "<=":
+			return lf <= rf, nil
+		case ">":
+			return lf > rf, nil
+		case ">=":
+			return lf >= rf, nil
+		case "+":
+			return lf + rf, nil
+		case "-":
+			return lf - rf, nil
+		case "*":
+			return lf * rf, nil
+		case "/":
+			if rf == 0 {
+				return nil, fmt.Errorf("division by zero")
+			}
+			return lf / rf, nil
+		}
+	}
+	ls, lok := left.(string)
+	rs, rok := right.(string)
+	if lok && rok {
+		switch n.op {
+		case "<":
+			return ls < rs, nil
+		case "<=":
+			return ls <= rs, nil
+		case ">":
+			return ls > rs, nil
+		case ">=":
+			return ls >= rs, nil
+		}
+	}
+	return nil, fmt.Errorf("cannot apply %s to %s and %s", n.op, describeExprValue(left), describeExprValue(right))
+}
+
+func exprEqual(a, b interface{}) bool {
+	return reflect.DeepEqual(a, b)
+}
+
+// exprContains implements `needle in haystack`.
+func exprContains(haystack, needle interface{}) (bool, error) {
+	switch h := haystack.(type) {
+	case []interface{}:
+		for _, item := range h {
+			if exprEqual(item, needle) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case string:
+		s, ok := needle.(string)
+		if !ok {
+			return false, fmt.Errorf("cannot look for %s in a string", describeExprValue(needle))
+		}
+		return strings.Contains(h, s), nil
+	case map[string]interface{}:
+		s, ok := needle.(string)
+		if !ok {
+			return false, fmt.Errorf("cannot look for %s among field names", describeExprValue(needle))
+		}
+		return lookupFold(h, s) != nil, nil
+	case nil:
+		return false, nil // A missing list contains nothing
+	}
+	return false, fmt.Errorf("cannot look inside %s", describeExprValue(haystack))
+}
+
+type exprCall struct {
+	name string
+	args []exprNode
+	re   *regexp.Regexp // Precompiled literal pattern of matches()
+}
+
+func (n *exprCall) eval(env map[string]interface{}) (interface{}, error) {
+	args := make([]interface{}, len(n.args))
+	for i, arg := range n.args {
+		value, err := arg.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = value
+	}
+
+	switch n.name {
+	case "lower", "upper":
+		s, ok := args[0].(string)
+		if !ok {
+			if args[0] == nil {
+				return "", nil
+			}
+			return nil, fmt.Errorf("%s() needs a string, got %s", n.name, describeExprValue(args[0]))
+		}
+		if n.name == "lower" {
+			return strings.ToLower(s), nil
+		}
+		return strings.ToUpper(s), nil
+	case "len":
+		switch v := args[0].(type) {
+		case string:
+			return float64(len([]rune(v))), nil
+		case []interface{}:
+			return float64(len(v)), nil
+		case map[string]interface{}:
+			return float64(len(v)), nil
+		case nil:
+			return float64(0), nil
+		}
+		return nil, fmt.Errorf("len() needs a string, list or object, got %s", describeExprValue(args[0]))
+	case "matches":
+		s, ok := args[0].(string)
+		if !ok {
+			if args[0] == nil {
+				return false, nil
+			}
+			return nil, fmt.Errorf("matches() needs a string, got %s", describeExprValue(args[0]))
+		}
+		re := n.re
+		if re == nil {
+			pattern, ok := args[1].(string)
+			if !ok {
+				return nil, fmt.Errorf("matches() needs a string pattern, got %s", describeExprValue(args[1]))
+			}
+			var err error
+			if re, err = regexp.Compile(pattern); err != nil {
+				return nil, fmt.Errorf("invalid pattern in matches(): %w", err)
+			}
+		}
+		return re.MatchString(s), nil
+	}
+	return nil, fmt.Errorf("unknown function %s", n.name)
+}
+
+func describeExprValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return "number " + strconv.FormatFloat(v, 'g', -1, 64)
+	case string:
+		return strconv.Quote(v)
+	case []interface{}:
+		return "a list"
+	case map[string]interface{}:
+		return "an object"
+	}
+	return fmt.Sprintf("%T", value)
+}
@@ -0,0 +1,264 @@
+package helpers
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"os"
+	"runtime/trace"
+	"slices"
+	"strings"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+
+	"github.com/zeebo/blake3"
+)
+
+// Hash algorithms a MultiHasher computes, by the names HashAlgorithms uses.
+const (
+	HashSHA256 = "sha256"
+	HashAutoV2 = "autov2" // The first 10 hex digits of the SHA256, as the WebUIs show it
+	HashBLAKE3 = "blake3"
+	HashCRC32  = "crc32" // Castagnoli, as Civitai reports it
+	HashMD5    = "md5"
+	HashSHA1   = "sha1"
+)
+
+// HashAlgorithm is a hash a MultiHasher can compute. An algorithm derived from another's
+// state (AutoV2 from SHA256) names that one as its Base, and MultiHasher feeds a base
+// only once however many algorithms read it.
+type HashAlgorithm interface {
+	Name() string             // Lower-case name, as HashAlgorithms and the receipts use it
+	Base() string             // Name of the hash whose state it reads; its own name if none
+	New() hash.Hash           // A new hash of the Base algorithm
+	Digest(sum []byte) string // The stored form of the Base hash's sum
+}
+
+// plainHash is a HashAlgorithm that stores its sum as lower-case hex.
+type plainHash struct {
+	name    string
+	newHash func() hash.Hash
+}
+
+func (a plainHash) Name() string             { return a.name }
+func (a plainHash) Base() string             { return a.name }
+func (a plainHash) New() hash.Hash           { return a.newHash() }
+func (a plainHash) Digest(sum []byte) string { return hex.EncodeToString(sum) }
+
+// autoV2Hash is Civitai's and the WebUIs' short hash: the start of the SHA256.
+type autoV2Hash struct{}
+
+func (autoV2Hash) Name() string             { return HashAutoV2 }
+func (autoV2Hash) Base() string             { return HashSHA256 }
+func (autoV2Hash) New() hash.Hash           { return sha256.New() }
+func (autoV2Hash) Digest(sum []byte) string { return AutoV2(hex.EncodeToString(sum)) }
+
+// hashAlgorithms are the known algorithms by name (see RegisterHashAlgorithm).
+var hashAlgorithms = map[string]HashAlgorithm{}
+
+func init() {
+	for _, a := range []HashAlgorithm{
+		plainHash{HashSHA256, sha256.New},
+		autoV2Hash{},
+		plainHash{HashBLAKE3, func() hash.Hash { return blake3.New() }},
+		plainHash{HashCRC32, func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) }},
+		plainHash{HashMD5, md5.New},
+		plainHash{HashSHA1, sha1.New},
+	} {
+		RegisterHashAlgorithm(a)
+	}
+}
+
+// RegisterHashAlgorithm makes an algorithm available to HashAlgorithms, MultiHasher and
+// HashFile under its name, replacing one registered under the same name. Register
+// algorithms before the configuration is read.
+func RegisterHashAlgorithm(a HashAlgorithm) {
+	hashAlgorithms[strings.ToLower(a.Name())] = a
+}
+
+// HashAlgorithmNames returns the names of the known algorithms, sorted.
+func HashAlgorithmNames() []string {
+	names := make([]string, 0, len(hashAlgorithms))
+	for name := range hashAlgorithms {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// AutoV2 returns the AutoV2 hash of a file from its hex SHA256.
+func AutoV2(sha256Hex string) string {
+	if len(sha256Hex) < 10 {
+		return ""
+	}
+	return strings.ToLower(sha256Hex[:10])
+}
+
+// ParseHashAlgorithms checks a list of algorithm names (case-insensitive) and returns
+// them lower-cased without duplicates, SHA256 first: it is always computed, since local
+// files are identified by it.
+func ParseHashAlgorithms(names []string) ([]string, error) {
+	algorithms := []string{HashSHA256}
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if _, ok := hashAlgorithms[name]; !ok {
+			return nil, fmt.Errorf("unknown hash algorithm %q (use %s)", name, strings.Join(HashAlgorithmNames(), ", "))
+		}
+		if !slices.Contains(algorithms, name) {
+			algorithms = append(algorithms, name)
+		}
+	}
+	return algorithms, nil
+}
+
+// HashesToVerify adds the algorithms of the expected hashes to algorithms, so they can be
+// checked from the same sums.
+func HashesToVerify(algorithms []string, expected models.Hashes) []string {
+	out := append([]string(nil), algorithms...)
+	for _, name := range VerifyAlgorithms {
+		if want, _ := publishedHash(expected, name); want != "" && !slices.Contains(out, name) {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+// MultiHasher computes several hashes of the same data in one pass.
+type MultiHasher struct {
+	algorithms []HashAlgorithm
+	bases      map[string]hash.Hash // Base name -> hash, shared by the algorithms deriving from it
+}
+
+// NewMultiHasher returns a MultiHasher for the algorithms, which must be known (see
+// ParseHashAlgorithms); unknown names are skipped.
+func NewMultiHasher(algorithms []string) *MultiHasher {
+	m := &MultiHasher{bases: make(map[string]hash.Hash)}
+	for _, name := range algorithms {
+		a, ok := hashAlgorithms[name]
+		if !ok {
+			continue
+		}
+		m.algorithms = append(m.algorithms, a)
+		if _, ok := m.bases[a.Base()]; !ok {
+			m.bases[a.Base()] = a.New()
+		}
+	}
+	return m
+}
+
+// Write feeds p to every hash. It never fails.
+func (m *MultiHasher) Write(p []byte) (int, error) {
+	for _, h := range m.bases {
+		h.Write(p)
+	}
+	return len(p), nil
+}
+
+// Reset starts all hashes over.
+func (m *MultiHasher) Reset() {
+	for _, h := range m.bases {
+		h.Reset()
+	}
+}
+
+// Sums returns the digest of each algorithm, keyed by its name.
+func (m *MultiHasher) Sums() map[string]string {
+	sums := make(map[string]string, len(m.algorithms))
+	baseSums := make(map[string][]byte, len(m.bases))
+	for base, h := range m.bases {
+		baseSums[base] = h.Sum(nil)
+	}
+	for _, a := range m.algorithms {
+		sums[a.Name()] = a.Digest(baseSums[a.Base()])
+	}
+	return sums
+}
+
+// HashFile reads a file once and returns its digest for each of the algorithms.
+func HashFile(path string, algorithms []string) (map[string]string, error) {
+	defer trace.StartRegion(context.Background(), "hash file").End()
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening file %s for hashing: %w", path, err)
+	}
+	defer file.Close()
+	m := NewMultiHasher(algorithms)
+	if _, err := Copy(m, file); err != nil {
+		return nil, fmt.Errorf("hashing file %s: %w", path, err)
+	}
+	return m.Sums(), nil
+}
+
+// publishedAlgorithms are the algorithms Civitai publishes file hashes for, most trusted first.
+var publishedAlgorithms = []string{HashSHA256, HashBLAKE3, HashCRC32, HashAutoV2}
+
+// VerifyAlgorithms are the published hashes verification checks, in order (see
+// VerifiedBy); set from VerifyHashes.
+var VerifyAlgorithms = slices.Clone(publishedAlgorithms)
+
+// ParseVerifyAlgorithms checks a VerifyHashes list: algorithms Civitai publishes hashes
+// for, returned lower-cased without duplicates. An empty list is the default order.
+func ParseVerifyAlgorithms(names []string) ([]string, error) {
+	if len(names) == 0 {
+		return slices.Clone(publishedAlgorithms), nil
+	}
+	var algorithms []string
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if _, ok := publishedHash(models.Hashes{}, name); !ok {
+			return nil, fmt.Errorf("can't verify by %q: Civitai publishes hashes for %s", name, strings.Join(publishedAlgorithms, ", "))
+		}
+		if !slices.Contains(algorithms, name) {
+			algorithms = append(algorithms, name)
+		}
+	}
+	return algorithms, nil
+}
+
+// publishedHash returns the expected hash of an algorithm; ok is false for an algorithm
+// Civitai doesn't publish.
+func publishedHash(expected models.Hashes, name string) (value string, ok bool) {
+	switch name {
+	case HashSHA256:
+		return expected.SHA256, true
+	case HashAutoV2:
+		return expected.AutoV2, true
+	case HashBLAKE3:
+		return expected.BLAKE3, true
+	case HashCRC32:
+		return expected.CRC32, true
+	}
+	return "", false
+}
+
+// SumsMatch reports whether sums verify a file with the expected hashes (see VerifiedBy).
+func SumsMatch(sums map[string]string, expected models.Hashes) bool {
+	return VerifiedBy(sums, expected) != ""
+}
+
+// VerifiedBy returns the algorithm by which sums verify a file with the expected hashes, or
+// "" if they don't. The first of VerifyAlgorithms with both a published hash and a sum
+// decides on its own: a match of a weaker hash can't make up for a file whose SHA256
+// differs. AutoV2 is taken from the SHA256 if there is no sum of its own.
+func VerifiedBy(sums map[string]string, expected models.Hashes) string {
+	for _, name := range VerifyAlgorithms {
+		want, _ := publishedHash(expected, name)
+		got := sums[name]
+		if name == HashAutoV2 && got == "" {
+			got = AutoV2(sums[HashSHA256])
+		}
+		if want == "" || got == "" {
+			continue
+		}
+		if strings.EqualFold(got, want) {
+			return name
+		}
+		return ""
+	}
+	return ""
+}
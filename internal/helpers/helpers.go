@@ -1,6 +1,7 @@
 package helpers
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
@@ -11,9 +12,10 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
-	"go-civitai-download/internal/models" // Import the models package
+	"github.com/dreamfast/go-civitai-downloader/internal/models" // Import the models package
 
 	log "github.com/sirupsen/logrus"
 	"github.com/zeebo/blake3"
@@ -94,6 +96,164 @@ func CheckHash(filePath string, hashes models.Hashes) bool {
 	return false
 }
 
+// HashChange compares a pinned set of hashes with a newly reported one and returns the
+// name of the first algorithm present in both whose values differ, or "" if they agree.
+// Algorithms missing from either side are ignored.
+func HashChange(pinned, current models.Hashes) string {
+	pairs := []struct {
+		name     string
+		was, now string
+	}{
+		{"SHA256", pinned.SHA256, current.SHA256},
+		{"BLAKE3", pinned.BLAKE3, current.BLAKE3},
+		{"CRC32", pinned.CRC32, current.CRC32},
+		{"AutoV2", pinned.AutoV2, current.AutoV2},
+	}
+	for _, p := range pairs {
+		if p.was != "" && p.now != "" && !strings.EqualFold(p.was, p.now) {
+			return p.name
+		}
+	}
+	return ""
+}
+
+// MoveFile renames src to dst, copying and removing src when they are on different
+// filesystems (e.g. a TempDir on a scratch disk). dst gets the configured FileMode and owner.
+func MoveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		ApplyFileMode(dst)
+		return nil
+	} else if _, ok := err.(*os.LinkError); !ok {
+		return err
+	}
+	if err := CopyFile(src, dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// copyBufferSize is the buffer Copy streams through (see SetCopyBufferSize).
+var copyBufferSize = 32 << 10
+
+// SetCopyBufferSize sets the buffer downloads and hashing stream through
+// (32 KiB by default, as io.Copy's); --low-memory makes it smaller.
+func SetCopyBufferSize(size int) {
+	if size > 0 {
+		copyBufferSize = size
+	}
+}
+
+// Copy is io.Copy through a buffer of the configured size. The source is hidden behind a
+// plain reader so files can't bring in buffers of their own.
+func Copy(dst io.Writer, src io.Reader) (int64, error) {
+	return io.CopyBuffer(dst, struct{ io.Reader }{src}, make([]byte, copyBufferSize))
+}
+
+// CopyFile copies src to dst, keeping its permissions unless a FileMode is configured. The
+// copy is written under a temp name in the destination dir, so dst never appears half-written.
+func CopyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmp := dst + ".moving"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	ApplyFileMode(dst)
+	return nil
+}
+
+// LinkDuplicate replaces dup with a hard link to keep when both files have the same
+// contents, so they are stored once. It reports whether dup was replaced: files that
+// differ, or are already the same file, are left alone.
+func LinkDuplicate(keep, dup string) (bool, error) {
+	keepInfo, err := os.Stat(keep)
+	if err != nil {
+		return false, err
+	}
+	dupInfo, err := os.Stat(dup)
+	if err != nil {
+		return false, err
+	}
+	if os.SameFile(keepInfo, dupInfo) || keepInfo.Size() != dupInfo.Size() {
+		return false, nil
+	}
+	same, err := sameContents(keep, dup)
+	if err != nil || !same {
+		return false, err
+	}
+
+	// Link under a temp name first so dup is never missing
+	tmp := dup + ".linking"
+	os.Remove(tmp)
+	if err := os.Link(keep, tmp); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmp, dup); err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+	return true, nil
+}
+
+// sameContents compares two files byte by byte.
+func sameContents(a, b string) (bool, error) {
+	fa, err := os.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer fa.Close()
+	fb, err := os.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer fb.Close()
+
+	bufA, bufB := make([]byte, 2*copyBufferSize), make([]byte, 2*copyBufferSize)
+	for {
+		na, errA := io.ReadFull(fa, bufA)
+		nb, errB := io.ReadFull(fb, bufB)
+		if !bytes.Equal(bufA[:na], bufB[:nb]) {
+			return false, nil
+		}
+		if errA == io.EOF || errA == io.ErrUnexpectedEOF {
+			return errB == io.EOF || errB == io.ErrUnexpectedEOF, nil
+		}
+		if errA != nil {
+			return false, errA
+		}
+		if errB != nil {
+			return false, errB
+		}
+	}
+}
+
 // CounterWriter tracks the number of bytes written to the underlying writer.
 // It's used to display download progress.
 // Note: Consider moving this to the 'downloader' package later.
@@ -124,6 +284,41 @@ func BytesToSize(bytes uint64) string {
 	return fmt.Sprintf("%.2f%s", float64(bytes)/math.Pow(1024, float64(i)), sizes[i])
 }
 
+// ParseByteSize parses a human-readable size such as "4GB", "500 MB", "1.5G" or "1024"
+// into bytes. Units are binary (1KB = 1024 bytes) to match BytesToSize. Negative sizes,
+// NaN, infinities and sizes that don't fit in a uint64 are rejected.
+func ParseByteSize(s string) (uint64, error) {
+	str := strings.ToUpper(strings.TrimSpace(s))
+	if str == "" {
+		return 0, fmt.Errorf("empty size")
+	}
+	multipliers := []struct {
+		suffix string
+		factor float64
+	}{
+		{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10},
+		{"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1},
+	}
+	factor := 1.0
+	for _, m := range multipliers {
+		if strings.HasSuffix(str, m.suffix) {
+			factor = m.factor
+			str = strings.TrimSpace(strings.TrimSuffix(str, m.suffix))
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(str, 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) || value < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	// float64(math.MaxUint64) rounds up to 2^64, so anything at or above it overflows
+	size := value * factor
+	if size >= math.MaxUint64 {
+		return 0, fmt.Errorf("size %q is too large", s)
+	}
+	return uint64(size), nil
+}
+
 // ConvertToSlug converts a string into a filesystem-friendly slug.
 func ConvertToSlug(str string) string {
 	str = strings.ReplaceAll(str, " ", "_")
@@ -140,15 +335,13 @@ func ConvertToSlug(str string) string {
 	}
 	str = filteredDescription.String()
 
-	// Simplify repeated separators
-	for strings.Contains(str, "--") {
+	// Simplify repeated separators (loop until stable, collapsing "-_" can create a new "--")
+	for strings.Contains(str, "--") || strings.Contains(str, "__") || strings.Contains(str, "-_") || strings.Contains(str, "_-") {
 		str = strings.ReplaceAll(str, "--", "-")
-	}
-	for strings.Contains(str, "__") {
 		str = strings.ReplaceAll(str, "__", "_")
+		str = strings.ReplaceAll(str, "-_", "-")
+		str = strings.ReplaceAll(str, "_-", "-")
 	}
-	str = strings.ReplaceAll(str, "-_", "-")
-	str = strings.ReplaceAll(str, "_-", "-")
 
 	// Remove leading/trailing separators
 	str = strings.Trim(str, "_-")
@@ -157,10 +350,10 @@ func ConvertToSlug(str string) string {
 }
 
 // CheckAndMakeDir ensures a directory exists, creating it if necessary.
-// Uses standard directory permissions (0700).
+// Uses standard directory permissions (0700) unless a DirMode is configured.
 func CheckAndMakeDir(dir string) bool {
 	// Use MkdirAll to create parent directories if they don't exist
-	err := os.MkdirAll(dir, 0700)
+	err := MkdirAll(dir, 0700)
 	if err != nil {
 		log.WithError(err).Errorf("Error creating directory %s", dir) // Use logrus
 		return false
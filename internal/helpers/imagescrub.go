@@ -0,0 +1,814 @@
+package helpers
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// ScrubFields selects the image metadata ScrubImageMetadata and ScrubImageJSON remove.
+// The generation parameters themselves (prompt, negative prompt, sampler, steps, CFG,
+// size, model, ...) are kept unless named in Params.
+type ScrubFields struct {
+	Usernames bool     // Author, artist and copyright text, XMP and IPTC blocks, "username" of Civitai images
+	Seeds     bool     // Seed and variation seed; ComfyUI workflows, whose seeds can't be told apart
+	Comments  bool     // Text chunks and comments that aren't generation parameters
+	Params    []string // Further generation parameters to remove by name, e.g. "Model hash"
+}
+
+// ParseScrubFields reads scrub selectors: "usernames", "seeds", "comments", or the name
+// of a generation parameter as A1111 writes it ("Model hash", "Lora hashes", ...).
+func ParseScrubFields(specs []string) (ScrubFields, error) {
+	var fields ScrubFields
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		switch strings.ToLower(spec) {
+		case "":
+			continue
+		case "usernames", "username":
+			fields.Usernames = true
+		case "seeds", "seed":
+			fields.Seeds = true
+		case "comments", "comment":
+			fields.Comments = true
+		default:
+			if strings.ContainsAny(spec, ":,\n") {
+				return ScrubFields{}, fmt.Errorf("invalid scrub field %q: use usernames, seeds, comments or a parameter name", spec)
+			}
+			fields.Params = append(fields.Params, spec)
+		}
+	}
+	return fields, nil
+}
+
+// Empty reports whether no field is selected.
+func (f ScrubFields) Empty() bool {
+	return !f.Usernames && !f.Seeds && !f.Comments && len(f.Params) == 0
+}
+
+// scrubsParam reports whether the generation parameter name is removed.
+func (f ScrubFields) scrubsParam(name string) bool {
+	name = strings.TrimSpace(name)
+	if f.Seeds && (strings.EqualFold(name, "Seed") || strings.EqualFold(name, "Variation seed")) {
+		return true
+	}
+	for _, p := range f.Params {
+		if strings.EqualFold(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// looksLikeParameters reports whether text is an A1111-style generation parameters block.
+func looksLikeParameters(text string) bool {
+	return strings.Contains(text, "Steps: ") || strings.Contains(text, "Negative prompt:")
+}
+
+// ScrubGenerationParameters removes the selected fields from A1111-style generation
+// parameters: the prompt, an optional "Negative prompt:" line, and a last line of
+// "Key: value" pairs separated by commas (values may be quoted).
+func ScrubGenerationParameters(text string, fields ScrubFields) string {
+	lines := strings.Split(text, "\n")
+	last := len(lines) - 1
+	for last >= 0 && strings.TrimSpace(lines[last]) == "" {
+		last--
+	}
+	if last < 0 || !strings.Contains(lines[last], ": ") {
+		return text
+	}
+	var kept []string
+	for _, pair := range splitParameterPairs(lines[last]) {
+		name, _, found := strings.Cut(pair, ":")
+		if found && fields.scrubsParam(name) {
+			continue
+		}
+		kept = append(kept, pair)
+	}
+	lines[last] = strings.Join(kept, ", ")
+	return strings.Join(lines, "\n")
+}
+
+// splitParameterPairs splits a parameters line at the commas outside double quotes.
+func splitParameterPairs(line string) []string {
+	var pairs []string
+	quoted, start := false, 0
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++ // Escaped character inside a quoted value
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				pairs = append(pairs, strings.TrimSpace(line[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	if rest := strings.TrimSpace(line[start:]); rest != "" {
+		pairs = append(pairs, rest)
+	}
+	return pairs
+}
+
+// ScrubImageMetadata removes the selected metadata from a PNG, JPEG or WebP image and
+// reports whether anything was removed. Other formats (videos, GIFs) are returned as they
+// are. Pixel data is never decoded or touched.
+func ScrubImageMetadata(data []byte, fields ScrubFields) ([]byte, bool, error) {
+	if fields.Empty() {
+		return data, false, nil
+	}
+	switch {
+	case bytes.HasPrefix(data, pngSignature):
+		return scrubPNG(data, fields)
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8}):
+		return scrubJPEG(data, fields)
+	case len(data) >= 12 && string(data[0:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return scrubWebP(data, fields)
+	}
+	return data, false, nil
+}
+
+// --- PNG ---
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// scrubPNG rewrites the text chunks (tEXt, zTXt, iTXt) and drops eXIf chunks as selected.
+func scrubPNG(data []byte, fields ScrubFields) ([]byte, bool, error) {
+	var out bytes.Buffer
+	out.Write(pngSignature)
+	changed := false
+	for pos := len(pngSignature); pos < len(data); {
+		if pos+12 > len(data) {
+			return nil, false, errors.New("truncated PNG chunk")
+		}
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		end := pos + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, false, errors.New("truncated PNG chunk")
+		}
+		chunkType := string(data[pos+4 : pos+8])
+		body := data[pos+8 : pos+8+length]
+		raw := data[pos:end]
+		pos = end
+
+		switch chunkType {
+		case "tEXt", "zTXt", "iTXt":
+			keyword, text, err := decodePNGText(chunkType, body)
+			if err != nil {
+				return nil, false, fmt.Errorf("PNG %s chunk: %w", chunkType, err)
+			}
+			scrubbed, keep := scrubTextField(keyword, text, fields)
+			if !keep {
+				changed = true
+				continue
+			}
+			if scrubbed != text {
+				newType, newBody := encodePNGText(chunkType, keyword, scrubbed)
+				writePNGChunk(&out, newType, newBody)
+				changed = true
+				continue
+			}
+		case "eXIf":
+			tiff, keep, exifChanged := scrubExif(body, fields)
+			if !keep {
+				changed = true
+				continue
+			}
+			if exifChanged {
+				writePNGChunk(&out, "eXIf", tiff)
+				changed = true
+				continue
+			}
+		}
+		out.Write(raw)
+	}
+	if !changed {
+		return data, false, nil
+	}
+	return out.Bytes(), true, nil
+}
+
+// scrubTextField scrubs a named text field of an image (a PNG text chunk keyword). It
+// returns the new text and false if the field is removed altogether.
+func scrubTextField(keyword, text string, fields ScrubFields) (string, bool) {
+	switch strings.ToLower(keyword) {
+	case "parameters":
+		return ScrubGenerationParameters(text, fields), true
+	case "prompt": // ComfyUI's API-format graph
+		if fields.Seeds {
+			if scrubbed, ok := scrubJSONSeeds(text); ok {
+				return scrubbed, true
+			}
+		}
+		return text, true
+	case "workflow": // ComfyUI's editor graph: seeds are unnamed widget values
+		return text, !fields.Seeds
+	case "author", "artist", "copyright", "creator", "owner":
+		return text, !fields.Usernames
+	}
+	if looksLikeParameters(text) {
+		return ScrubGenerationParameters(text, fields), true
+	}
+	return text, !fields.Comments
+}
+
+// scrubJSONSeeds removes "seed" and "noise_seed" inputs from a ComfyUI graph.
+func scrubJSONSeeds(text string) (string, bool) {
+	decoder := json.NewDecoder(strings.NewReader(text))
+	decoder.UseNumber()
+	var graph interface{}
+	if err := decoder.Decode(&graph); err != nil {
+		return text, false
+	}
+	if !removeJSONKeys(graph, isSeedKey) {
+		return text, true
+	}
+	encoded, err := json.Marshal(graph)
+	if err != nil {
+		return text, false
+	}
+	return string(encoded), true
+}
+
+// isSeedKey reports whether a JSON key holds a seed.
+func isSeedKey(key string) bool {
+	switch strings.ToLower(key) {
+	case "seed", "noise_seed", "variation seed", "subseed":
+		return true
+	}
+	return false
+}
+
+// removeJSONKeys deletes the keys matched by drop from every object in v, recursively,
+// and reports whether it deleted any.
+func removeJSONKeys(v interface{}, drop func(string) bool) bool {
+	removed := false
+	switch node := v.(type) {
+	case map[string]interface{}:
+		for key, child := range node {
+			if drop(key) {
+				delete(node, key)
+				removed = true
+			} else if removeJSONKeys(child, drop) {
+				removed = true
+			}
+		}
+	case []interface{}:
+		for _, child := range node {
+			if removeJSONKeys(child, drop) {
+				removed = true
+			}
+		}
+	}
+	return removed
+}
+
+// decodePNGText returns the keyword and text of a tEXt, zTXt or iTXt chunk.
+func decodePNGText(chunkType string, body []byte) (string, string, error) {
+	keyword, rest, found := bytes.Cut(body, []byte{0})
+	if !found {
+		return "", "", errors.New("missing keyword separator")
+	}
+	switch chunkType {
+	case "tEXt":
+		return string(keyword), latin1ToString(rest), nil
+	case "zTXt":
+		if len(rest) < 1 {
+			return "", "", errors.New("missing compression method")
+		}
+		text, err := inflate(rest[1:])
+		return string(keyword), latin1ToString(text), err
+	}
+	// iTXt: compression flag, method, language tag, translated keyword, text
+	if len(rest) < 2 {
+		return "", "", errors.New("missing compression flag")
+	}
+	compressed := rest[0] == 1
+	rest = rest[2:]
+	for i := 0; i < 2; i++ {
+		_, after, found := bytes.Cut(rest, []byte{0})
+		if !found {
+			return "", "", errors.New("truncated iTXt chunk")
+		}
+		rest = after
+	}
+	if compressed {
+		text, err := inflate(rest)
+		return string(keyword), string(text), err
+	}
+	return string(keyword), string(rest), nil
+}
+
+// encodePNGText returns the body of a text chunk of the same kind holding text. Text that
+// Latin-1 can't hold is written as an uncompressed iTXt chunk instead of tEXt.
+func encodePNGText(chunkType, keyword, text string) (string, []byte) {
+	var body bytes.Buffer
+	body.WriteString(keyword)
+	body.WriteByte(0)
+	latin1, ok := stringToLatin1(text)
+	switch {
+	case chunkType == "zTXt" && ok:
+		body.WriteByte(0) // Deflate
+		w := zlib.NewWriter(&body)
+		w.Write(latin1)
+		w.Close()
+		return "zTXt", body.Bytes()
+	case chunkType == "tEXt" && ok:
+		body.Write(latin1)
+		return "tEXt", body.Bytes()
+	}
+	body.Write([]byte{0, 0, 0, 0}) // Uncompressed, no language tag or translated keyword
+	body.WriteString(text)
+	return "iTXt", body.Bytes()
+}
+
+// writePNGChunk writes a chunk with its length and CRC.
+func writePNGChunk(out *bytes.Buffer, chunkType string, body []byte) {
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[0:], uint32(len(body)))
+	copy(header[4:], chunkType)
+	out.Write(header[:])
+	out.Write(body)
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(body)
+	binary.Write(out, binary.BigEndian, crc.Sum32())
+}
+
+func inflate(data []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func latin1ToString(b []byte) string {
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return string(runes)
+}
+
+func stringToLatin1(s string) ([]byte, bool) {
+	b := make([]byte, 0, len(s))
+	for _, r := range s {
+		if r > 0xFF {
+			return nil, false
+		}
+		b = append(b, byte(r))
+	}
+	return b, true
+}
+
+// --- JPEG ---
+
+// scrubJPEG rewrites the EXIF segment and drops XMP, IPTC and comment segments as selected.
+// Everything from the start of scan on is copied unchanged.
+func scrubJPEG(data []byte, fields ScrubFields) ([]byte, bool, error) {
+	var out bytes.Buffer
+	out.Write(data[:2])
+	changed := false
+	pos := 2
+	for pos < len(data) {
+		if pos+4 > len(data) || data[pos] != 0xFF {
+			return nil, false, errors.New("malformed JPEG segment")
+		}
+		marker := data[pos+1]
+		if marker == 0xDA || marker == 0xD9 { // Start of scan, end of image
+			break
+		}
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) || marker == 0xFF {
+			out.Write(data[pos : pos+2]) // Markers without a length
+			pos += 2
+			continue
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		end := pos + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, false, errors.New("truncated JPEG segment")
+		}
+		payload := data[pos+4 : end]
+		raw := data[pos:end]
+		pos = end
+
+		switch {
+		case marker == 0xE1 && bytes.HasPrefix(payload, exifHeader):
+			tiff, keep, exifChanged := scrubExif(payload[len(exifHeader):], fields)
+			if !keep {
+				changed = true
+				continue
+			}
+			if exifChanged {
+				segment := append(append([]byte{}, exifHeader...), tiff...)
+				if len(segment)+2 > 0xFFFF {
+					return nil, false, errors.New("scrubbed EXIF too large for a JPEG segment")
+				}
+				out.Write([]byte{0xFF, 0xE1})
+				binary.Write(&out, binary.BigEndian, uint16(len(segment)+2))
+				out.Write(segment)
+				changed = true
+				continue
+			}
+		case marker == 0xE1 || marker == 0xED: // XMP (or other APP1 data), Photoshop IPTC
+			if fields.Usernames || fields.Comments {
+				changed = true
+				continue
+			}
+		case marker == 0xFE: // Comment
+			text, keep := scrubTextField("comment", string(payload), fields)
+			if !keep {
+				changed = true
+				continue
+			}
+			if text != string(payload) {
+				out.Write([]byte{0xFF, 0xFE})
+				binary.Write(&out, binary.BigEndian, uint16(len(text)+2))
+				out.WriteString(text)
+				changed = true
+				continue
+			}
+		}
+		out.Write(raw)
+	}
+	if !changed {
+		return data, false, nil
+	}
+	out.Write(data[pos:])
+	return out.Bytes(), true, nil
+}
+
+// --- WebP ---
+
+// WebP VP8X flags of the metadata chunks.
+const (
+	webpFlagEXIF = 0x08
+	webpFlagXMP  = 0x04
+)
+
+// scrubWebP rewrites the EXIF chunk and drops the XMP chunk as selected, keeping the VP8X
+// flags and the RIFF size in step.
+func scrubWebP(data []byte, fields ScrubFields) ([]byte, bool, error) {
+	type chunk struct {
+		fourCC string
+		body   []byte
+	}
+	var chunks []chunk
+	changed := false
+	for pos := 12; pos < len(data); {
+		if pos+8 > len(data) {
+			return nil, false, errors.New("truncated WebP chunk")
+		}
+		fourCC := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		end := pos + 8 + size
+		if size < 0 || end > len(data) {
+			return nil, false, errors.New("truncated WebP chunk")
+		}
+		body := data[pos+8 : end]
+		pos = end + size%2
+
+		switch fourCC {
+		case "EXIF":
+			tiff := bytes.TrimPrefix(body, exifHeader)
+			scrubbed, keep, exifChanged := scrubExif(tiff, fields)
+			if !keep {
+				changed = true
+				continue
+			}
+			if exifChanged {
+				body = scrubbed
+				changed = true
+			}
+		case "XMP ":
+			if fields.Usernames || fields.Comments {
+				changed = true
+				continue
+			}
+		}
+		chunks = append(chunks, chunk{fourCC, body})
+	}
+	if !changed {
+		return data, false, nil
+	}
+
+	var flags byte
+	for _, c := range chunks {
+		switch c.fourCC {
+		case "EXIF":
+			flags |= webpFlagEXIF
+		case "XMP ":
+			flags |= webpFlagXMP
+		}
+	}
+	var out bytes.Buffer
+	out.WriteString("RIFF\x00\x00\x00\x00WEBP")
+	for _, c := range chunks {
+		body := c.body
+		if c.fourCC == "VP8X" && len(body) > 0 {
+			body = append([]byte{}, body...)
+			body[0] = body[0]&^(webpFlagEXIF|webpFlagXMP) | flags
+		}
+		out.WriteString(c.fourCC)
+		binary.Write(&out, binary.LittleEndian, uint32(len(body)))
+		out.Write(body)
+		if len(body)%2 == 1 {
+			out.WriteByte(0)
+		}
+	}
+	result := out.Bytes()
+	binary.LittleEndian.PutUint32(result[4:], uint32(len(result)-8))
+	return result, true, nil
+}
+
+// --- EXIF ---
+
+var exifHeader = []byte("Exif\x00\x00")
+
+// EXIF tags kept or read by scrubExif.
+const (
+	exifTagOrientation = 0x0112
+	exifTagExifIFD     = 0x8769
+	exifTagUserComment = 0x9286
+)
+
+// exifComment is the UserComment of an EXIF block.
+type exifComment struct {
+	text    string
+	charset string           // "ASCII", "UNICODE" or "" (undefined)
+	order   binary.ByteOrder // Of UNICODE text
+}
+
+// scrubExif scrubs an EXIF (TIFF) block. The UserComment, where A1111 and others keep
+// the generation parameters of JPEG and WebP images, is scrubbed like a parameters
+// text; with usernames or comments selected every other tag but the orientation is
+// dropped (artist, copyright, descriptions, XP tags, GPS, ...). A block that can't be read
+// is dropped whatever is selected, since it may hold any of them. It returns the new
+// block, whether to keep one at all, and whether it changed.
+func scrubExif(tiff []byte, fields ScrubFields) ([]byte, bool, bool) {
+	orientation, comment, err := readExif(tiff)
+	if err != nil {
+		return nil, false, true
+	}
+
+	rebuild := fields.Usernames || fields.Comments
+	if comment != nil {
+		scrubbed, keep := scrubTextField("usercomment", comment.text, fields)
+		switch {
+		case !keep:
+			comment = nil
+			rebuild = true
+		case scrubbed != comment.text:
+			comment.text = scrubbed
+			rebuild = true
+		}
+	}
+	if !rebuild {
+		return tiff, true, false
+	}
+	if orientation == 0 && comment == nil {
+		return nil, false, true
+	}
+	return buildExif(orientation, comment), true, true
+}
+
+// readExif reads the orientation (0 if absent) and the UserComment (nil if absent) of
+// an EXIF block.
+func readExif(tiff []byte) (uint16, *exifComment, error) {
+	if len(tiff) < 8 {
+		return 0, nil, errors.New("short TIFF header")
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0, nil, errors.New("unknown TIFF byte order")
+	}
+	type ifdEntry struct {
+		typ   uint16
+		count uint32
+		value []byte // The 4 value/offset bytes
+	}
+	readIFD := func(offset uint32) (map[uint16]ifdEntry, error) {
+		if int(offset)+2 > len(tiff) {
+			return nil, errors.New("IFD out of range")
+		}
+		n := int(order.Uint16(tiff[offset:]))
+		if int(offset)+2+12*n > len(tiff) {
+			return nil, errors.New("IFD out of range")
+		}
+		entries := make(map[uint16]ifdEntry, n)
+		for i := 0; i < n; i++ {
+			e := tiff[int(offset)+2+12*i:]
+			entries[order.Uint16(e)] = ifdEntry{typ: order.Uint16(e[2:]), count: order.Uint32(e[4:]), value: e[8:12]}
+		}
+		return entries, nil
+	}
+
+	ifd0, err := readIFD(order.Uint32(tiff[4:]))
+	if err != nil {
+		return 0, nil, err
+	}
+	var orientation uint16
+	if e, ok := ifd0[exifTagOrientation]; ok && e.typ == 3 {
+		orientation = order.Uint16(e.value)
+	}
+	pointer, ok := ifd0[exifTagExifIFD]
+	if !ok {
+		return orientation, nil, nil
+	}
+	exifIFD, err := readIFD(order.Uint32(pointer.value))
+	if err != nil {
+		return orientation, nil, err
+	}
+	e, ok := exifIFD[exifTagUserComment]
+	if !ok || e.count < 8 {
+		return orientation, nil, nil
+	}
+	value := e.value[:min(int(e.count), 4)]
+	if e.count > 4 {
+		start := order.Uint32(e.value)
+		if uint64(start)+uint64(e.count) > uint64(len(tiff)) {
+			return orientation, nil, errors.New("UserComment out of range")
+		}
+		value = tiff[start : start+e.count]
+	}
+	comment := &exifComment{charset: strings.TrimRight(string(value[:8]), "\x00 ")}
+	text := value[8:]
+	switch comment.charset {
+	case "UNICODE":
+		comment.order = unicodeOrder(text, order)
+		units := make([]uint16, len(text)/2)
+		for i := range units {
+			units[i] = comment.order.Uint16(text[2*i:])
+		}
+		comment.text = string(utf16.Decode(units))
+	default:
+		comment.text = string(text)
+		if !utf8.ValidString(comment.text) {
+			comment.text = latin1ToString(text)
+		}
+	}
+	comment.text = strings.TrimRight(comment.text, "\x00")
+	return orientation, comment, nil
+}
+
+// unicodeOrder guesses the byte order of UTF-16 UserComment text: writers disagree on
+// whether it follows the TIFF header (piexif, and so A1111, always writes big-endian).
+// Mostly-ASCII text has its zero bytes on the high side of each unit.
+func unicodeOrder(text []byte, tiffOrder binary.ByteOrder) binary.ByteOrder {
+	var evenZeros, oddZeros int
+	for i := 0; i+1 < len(text); i += 2 {
+		if text[i] == 0 {
+			evenZeros++
+		}
+		if text[i+1] == 0 {
+			oddZeros++
+		}
+	}
+	switch {
+	case evenZeros > oddZeros:
+		return binary.BigEndian
+	case oddZeros > evenZeros:
+		return binary.LittleEndian
+	}
+	return tiffOrder
+}
+
+// buildExif writes a big-endian EXIF block holding only the orientation (if not 0) and
+// the UserComment (if not nil).
+func buildExif(orientation uint16, comment *exifComment) []byte {
+	order := binary.BigEndian
+	var commentBytes []byte
+	if comment != nil {
+		switch comment.charset {
+		case "UNICODE":
+			commentBytes = append([]byte("UNICODE\x00"), encodeUTF16(comment.text, comment.order)...)
+		case "ASCII":
+			commentBytes = append([]byte("ASCII\x00\x00\x00"), comment.text...)
+		default:
+			commentBytes = append(make([]byte, 8), comment.text...)
+		}
+	}
+
+	type entry struct {
+		tag, typ uint16
+		count    uint32
+		value    uint32
+	}
+	var entries []entry
+	if orientation != 0 {
+		entries = append(entries, entry{exifTagOrientation, 3, 1, uint32(orientation) << 16})
+	}
+	ifd0Size := 2 + 12*(len(entries)+boolInt(comment != nil)) + 4
+	exifIFDOffset := uint32(8 + ifd0Size)
+	if comment != nil {
+		entries = append(entries, entry{exifTagExifIFD, 4, 1, exifIFDOffset})
+	}
+
+	var out bytes.Buffer
+	out.WriteString("MM\x00\x2a\x00\x00\x00\x08")
+	writeIFD := func(entries []entry) {
+		binary.Write(&out, order, uint16(len(entries)))
+		for _, e := range entries {
+			binary.Write(&out, order, e.tag)
+			binary.Write(&out, order, e.typ)
+			binary.Write(&out, order, e.count)
+			binary.Write(&out, order, e.value)
+		}
+		binary.Write(&out, order, uint32(0)) // No next IFD
+	}
+	writeIFD(entries)
+	if comment != nil {
+		dataOffset := exifIFDOffset + 2 + 12 + 4
+		writeIFD([]entry{{exifTagUserComment, 7, uint32(len(commentBytes)), dataOffset}})
+		out.Write(commentBytes)
+	}
+	return out.Bytes()
+}
+
+func encodeUTF16(text string, order binary.ByteOrder) []byte {
+	units := utf16.Encode([]rune(text))
+	b := make([]byte, 2*len(units))
+	for i, u := range units {
+		order.PutUint16(b[2*i:], u)
+	}
+	return b
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// --- Civitai image JSON ---
+
+// ScrubImageJSON removes the selected fields from the Civitai image objects in a JSON
+// document (a metadata sidecar with its "images", or an image's own sidecar): any object
+// with a "meta" object is taken for an image. Usernames drops its "username", and seeds
+// and parameters are dropped from "meta" (seeds take the embedded ComfyUI graph, "comfy",
+// with them). The document is only re-encoded if something was removed.
+func ScrubImageJSON(data []byte, fields ScrubFields) ([]byte, bool, error) {
+	if fields.Empty() {
+		return data, false, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, false, err
+	}
+	if !scrubImageObjects(doc, fields) {
+		return data, false, nil
+	}
+	scrubbed, err := json.MarshalIndent(doc, "", "  ")
+	return scrubbed, err == nil, err
+}
+
+// scrubImageObjects scrubs the image objects in v and reports whether it removed anything.
+func scrubImageObjects(v interface{}, fields ScrubFields) bool {
+	removed := false
+	switch node := v.(type) {
+	case map[string]interface{}:
+		if meta, ok := node["meta"].(map[string]interface{}); ok {
+			if _, has := node["username"]; has && fields.Usernames {
+				delete(node, "username")
+				removed = true
+			}
+			if removeJSONKeys(meta, func(key string) bool {
+				return fields.scrubsParam(key) || (fields.Seeds && (isSeedKey(key) || strings.EqualFold(key, "comfy")))
+			}) {
+				removed = true
+			}
+		}
+		for _, child := range node {
+			if scrubImageObjects(child, fields) {
+				removed = true
+			}
+		}
+	case []interface{}:
+		for _, child := range node {
+			if scrubImageObjects(child, fields) {
+				removed = true
+			}
+		}
+	}
+	return removed
+}
@@ -0,0 +1,27 @@
+package helpers
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestScrubUnreadableExif(t *testing.T) {
+	exif := []byte("Exif\x00\x00XX garbage with Seed: 42")
+	jpeg := []byte{0xFF, 0xD8, 0xFF, 0xE1, 0x00, byte(len(exif) + 2)}
+	jpeg = append(jpeg, exif...)
+	jpeg = append(jpeg, 0xFF, 0xDA, 0x00, 0x02, 0xFF, 0xD9) // Start of scan, end of image
+
+	for _, spec := range [][]string{{"seeds"}, {"Model hash"}, {"usernames"}} {
+		fields, err := ParseScrubFields(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scrubbed, changed, err := ScrubImageMetadata(jpeg, fields)
+		if err != nil {
+			t.Fatalf("%v: %v", spec, err)
+		}
+		if !changed || bytes.Contains(scrubbed, []byte("Exif")) {
+			t.Errorf("%v: unreadable EXIF block kept: %q", spec, scrubbed)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package helpers
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/failure"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrFileInUse is returned for a file left alone because another process has it open.
+var ErrFileInUse = failure.New(failure.Disk, "file is in use by another process")
+
+// FileInUse reports whether another process has path open or mapped into memory (as UIs
+// like ComfyUI do with a loaded safetensors file), and which one if that is known. The
+// check is best effort: processes of other users are only seen with enough privileges,
+// and platforms without a check report false.
+func FileInUse(path string) (bool, string) {
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return false, ""
+	}
+	inUse, holder := fileInUse(path, info)
+	if inUse && holder == "" {
+		holder = "another process"
+	}
+	return inUse, holder
+}
+
+// CheckNotInUse returns ErrFileInUse if another process has path open, so a file loaded by
+// a running UI isn't replaced or deleted under it. The caller defers the operation.
+func CheckNotInUse(path string) error {
+	if inUse, holder := FileInUse(path); inUse {
+		log.Warnf("%s is in use by %s; leaving it alone until a later run", path, holder)
+		return fmt.Errorf("%w: %s (%s)", ErrFileInUse, path, holder)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package helpers
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// fileInUse scans /proc for a process with path among its open file descriptors or its
+// memory mappings.
+func fileInUse(path string, info os.FileInfo) (bool, string) {
+	procs, err := os.ReadDir("/proc")
+	if err != nil {
+		return false, ""
+	}
+	var inode uint64
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		inode = st.Ino
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		resolved = path
+	}
+	if abs, err := filepath.Abs(resolved); err == nil {
+		resolved = abs
+	}
+	self := os.Getpid()
+	for _, proc := range procs {
+		pid, err := strconv.Atoi(proc.Name())
+		if err != nil || pid == self {
+			continue
+		}
+		dir := filepath.Join("/proc", proc.Name())
+		if hasOpenFile(dir, info) || hasMapping(dir, resolved, inode) {
+			return true, processName(pid, dir)
+		}
+	}
+	return false, ""
+}
+
+// hasOpenFile reports whether one of the process's file descriptors is the file.
+func hasOpenFile(dir string, info os.FileInfo) bool {
+	fds, err := os.ReadDir(filepath.Join(dir, "fd"))
+	if err != nil {
+		return false
+	}
+	for _, fd := range fds {
+		if fdInfo, err := os.Stat(filepath.Join(dir, "fd", fd.Name())); err == nil && os.SameFile(info, fdInfo) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasMapping reports whether the process has the file mapped into memory. A file stays
+// mapped after its descriptor is closed, which is how safetensors files are loaded.
+func hasMapping(dir, path string, inode uint64) bool {
+	f, err := os.Open(filepath.Join(dir, "maps"))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// address perms offset dev inode pathname
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || fields[5] != path {
+			continue
+		}
+		if ino, err := strconv.ParseUint(fields[4], 10, 64); err == nil && (inode == 0 || ino == inode) {
+			return true
+		}
+	}
+	return false
+}
+
+// processName describes a process as "pid 1234 (python3)".
+func processName(pid int, dir string) string {
+	comm, err := os.ReadFile(filepath.Join(dir, "comm"))
+	if err != nil {
+		return fmt.Sprintf("pid %d", pid)
+	}
+	return fmt.Sprintf("pid %d (%s)", pid, strings.TrimSpace(string(comm)))
+}
@@ -0,0 +1,27 @@
+//go:build !linux && !windows
+
+package helpers
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// fileInUse asks lsof for the processes that have path open; without lsof nothing is
+// reported.
+func fileInUse(path string, _ os.FileInfo) (bool, string) {
+	lsof, err := exec.LookPath("lsof")
+	if err != nil {
+		return false, ""
+	}
+	out, _ := exec.Command(lsof, "-t", "--", path).Output() // Exits 1 when nothing has it open
+	self := fmt.Sprint(os.Getpid())
+	for _, pid := range strings.Fields(string(out)) {
+		if pid != self {
+			return true, "pid " + pid
+		}
+	}
+	return false, ""
+}
@@ -0,0 +1,27 @@
+package helpers
+
+import (
+	"os"
+	"syscall"
+)
+
+// errorSharingViolation is ERROR_SHARING_VIOLATION: another process has the file open
+// without sharing it.
+const errorSharingViolation = syscall.Errno(32)
+
+// fileInUse tries to open path without sharing it; that fails while another process has
+// it open (or mapped). Windows doesn't say which process it is.
+func fileInUse(path string, _ os.FileInfo) (bool, string) {
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return false, ""
+	}
+	h, err := syscall.CreateFile(name, syscall.GENERIC_READ, 0, nil, syscall.OPEN_EXISTING, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err == errorSharingViolation {
+		return true, ""
+	}
+	if err == nil {
+		syscall.CloseHandle(h)
+	}
+	return false, ""
+}
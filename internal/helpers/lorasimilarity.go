@@ -0,0 +1,364 @@
+package helpers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Weights of the signals LoraSimilarity combines. Only the signals both LoRAs carry count,
+// and the tensor shapes count only next to one of the others: most LoRAs of a base model
+// trained with the same settings have the same shapes.
+const (
+	loraWeightTags     = 0.55
+	loraWeightDatasets = 0.2
+	loraWeightName     = 0.15
+	loraWeightShape    = 0.1
+)
+
+// loraCandidateTags is the number of a LoRA's most distinctive training tags that find the
+// others it is compared with.
+const loraCandidateTags = 10
+
+// LoraProfile is what the similarity report compares of a LoRA, all read from its
+// safetensors header: the training run, the training data (tags and dataset folders), the
+// name it was saved under and the shape of its weights.
+type LoraProfile struct {
+	Fingerprint string   // TrainingFingerprint: same weights or training run
+	OutputName  string   // ss_output_name without version, epoch and step suffixes
+	Datasets    []string // Dataset folders (ss_dataset_dirs, ss_datasets) without the repeat count, sorted
+	Shape       string   // Hash of the tensor names and shapes, not their dtypes
+	TagCount    int      // Distinct training tags
+
+	counts map[string]float64 // ss_tag_frequency, summed over the datasets
+	tags   []weightedTag      // counts weighted by WeighLoraTags, by tag
+}
+
+// weightedTag is a training tag with its weight in a unit-length tag vector.
+type weightedTag struct {
+	tag    string
+	weight float64
+}
+
+// loraNameSuffix matches the version, epoch and step suffixes trainers and uploaders add to
+// LoRA names ("_v2", "-000010", "_e12", "-step3000").
+var loraNameSuffix = regexp.MustCompile(`[-_. ]*(v\d+(\.\d+)*|e\d+|ep\d+|epoch\d+|step\d+|\d+)$`)
+
+// loraRepeatPrefix is kohya's repeat count in front of a dataset folder name ("10_").
+var loraRepeatPrefix = regexp.MustCompile(`^\d+_`)
+
+// NewLoraProfile reads the profile of a LoRA from its safetensors header. Call
+// WeighLoraTags on all the profiles to compare before LoraSimilarity.
+func NewLoraProfile(header SafetensorsHeader) LoraProfile {
+	meta := header.Metadata
+	p := LoraProfile{
+		Fingerprint: TrainingFingerprint(ExtractTrainingMetadata(header)),
+		OutputName:  normalizeLoraName(meta["ss_output_name"]),
+		counts:      make(map[string]float64),
+	}
+
+	var datasets map[string]map[string]int
+	if json.Unmarshal([]byte(meta["ss_tag_frequency"]), &datasets) == nil {
+		for _, tags := range datasets {
+			for tag, count := range tags {
+				if tag = strings.ToLower(strings.TrimSpace(tag)); tag != "" && count > 0 {
+					p.counts[tag] += float64(count)
+				}
+			}
+		}
+	}
+	p.TagCount = len(p.counts)
+
+	folders := make(map[string]bool)
+	var dirs map[string]json.RawMessage
+	if json.Unmarshal([]byte(meta["ss_dataset_dirs"]), &dirs) == nil {
+		for dir := range dirs {
+			folders[normalizeLoraDataset(dir)] = true
+		}
+	}
+	var sets []struct {
+		Subsets []struct {
+			ImageDir string `json:"image_dir"`
+		} `json:"subsets"`
+	}
+	if json.Unmarshal([]byte(meta["ss_datasets"]), &sets) == nil {
+		for _, set := range sets {
+			for _, subset := range set.Subsets {
+				if subset.ImageDir != "" {
+					folders[normalizeLoraDataset(subset.ImageDir)] = true
+				}
+			}
+		}
+	}
+	delete(folders, "")
+	for folder := range folders {
+		p.Datasets = append(p.Datasets, folder)
+	}
+	sort.Strings(p.Datasets)
+
+	if len(header.Tensors) > 0 {
+		names := make([]string, 0, len(header.Tensors))
+		for name := range header.Tensors {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		h := sha256.New()
+		for _, name := range names {
+			fmt.Fprintf(h, "%s%v\n", name, header.Tensors[name].Shape)
+		}
+		p.Shape = hex.EncodeToString(h.Sum(nil)[:8])
+	}
+	return p
+}
+
+// normalizeLoraName returns a LoRA's output name without its version, epoch and step
+// suffixes, lower-cased.
+func normalizeLoraName(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for {
+		trimmed := loraNameSuffix.ReplaceAllString(name, "")
+		if trimmed == name || trimmed == "" {
+			return name
+		}
+		name = trimmed
+	}
+}
+
+// normalizeLoraDataset returns the name of a dataset folder without its path and kohya's
+// repeat count, lower-cased.
+func normalizeLoraDataset(dir string) string {
+	dir = path.Base(strings.ReplaceAll(strings.TrimSpace(dir), `\`, "/"))
+	if dir == "." || dir == "/" {
+		return ""
+	}
+	return strings.ToLower(loraRepeatPrefix.ReplaceAllString(dir, ""))
+}
+
+// WeighLoraTags weighs the training tags of the profiles against each other: a tag counts
+// more the fewer of them use it (inverse document frequency), so tags every character
+// LoRA has ("1girl", "solo") hardly make two of them alike, and the frequent ones of a
+// LoRA count more, if less than in proportion.
+func WeighLoraTags(profiles []LoraProfile) {
+	used := make(map[string]int)
+	for _, p := range profiles {
+		for tag := range p.counts {
+			used[tag]++
+		}
+	}
+	n := float64(len(profiles))
+	for i := range profiles {
+		p := &profiles[i]
+		p.tags = make([]weightedTag, 0, len(p.counts))
+		var norm float64
+		for tag, count := range p.counts {
+			weight := math.Log1p(count) * (1 + math.Log((1+n)/(1+float64(used[tag]))))
+			p.tags = append(p.tags, weightedTag{tag, weight})
+			norm += weight * weight
+		}
+		norm = math.Sqrt(norm)
+		for j := range p.tags {
+			p.tags[j].weight /= norm
+		}
+		sort.Slice(p.tags, func(a, b int) bool { return p.tags[a].tag < p.tags[b].tag })
+	}
+}
+
+// LoraSimilarity returns how alike two LoRAs are, from 0 to 1, and why: the same training
+// run or weights make them 1; otherwise their training tags, dataset folders, output
+// names and tensor shapes are compared, as far as both carry them. Two LoRAs with none of
+// the first three in common are 0.
+func LoraSimilarity(a, b LoraProfile) (float64, []string) {
+	if a.Fingerprint != "" && a.Fingerprint == b.Fingerprint {
+		if strings.HasPrefix(a.Fingerprint, "hash:") {
+			return 1, []string{"same weights"}
+		}
+		return 1, []string{"same training run"}
+	}
+
+	var score, total float64
+	var reasons []string
+	if len(a.tags) > 0 && len(b.tags) > 0 {
+		cosine := tagCosine(a.tags, b.tags)
+		score += loraWeightTags * cosine
+		total += loraWeightTags
+		if cosine >= 0.5 {
+			reasons = append(reasons, fmt.Sprintf("training tags %.0f%% alike", cosine*100))
+		}
+	}
+	if len(a.Datasets) > 0 && len(b.Datasets) > 0 {
+		shared := sortedIntersection(a.Datasets, b.Datasets)
+		score += loraWeightDatasets * float64(len(shared)) / float64(len(a.Datasets)+len(b.Datasets)-len(shared))
+		total += loraWeightDatasets
+		if len(shared) > 0 {
+			reasons = append(reasons, "dataset "+strings.Join(shared, ", "))
+		}
+	}
+	if a.OutputName != "" && b.OutputName != "" {
+		total += loraWeightName
+		if a.OutputName == b.OutputName {
+			score += loraWeightName
+			reasons = append(reasons, "output name "+a.OutputName)
+		}
+	}
+	if total == 0 {
+		return 0, nil
+	}
+	if a.Shape != "" && b.Shape != "" {
+		total += loraWeightShape
+		if a.Shape == b.Shape {
+			score += loraWeightShape
+			reasons = append(reasons, "same tensor shapes")
+		}
+	}
+	return score / total, reasons
+}
+
+// tagCosine returns the cosine similarity of two unit-length tag vectors sorted by tag.
+func tagCosine(a, b []weightedTag) float64 {
+	var dot float64
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i].tag < b[j].tag:
+			i++
+		case a[i].tag > b[j].tag:
+			j++
+		default:
+			dot += a[i].weight * b[j].weight
+			i++
+			j++
+		}
+	}
+	return math.Min(dot, 1)
+}
+
+// sortedIntersection returns the strings both sorted slices hold.
+func sortedIntersection(a, b []string) []string {
+	var shared []string
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			shared = append(shared, a[i])
+			i++
+			j++
+		}
+	}
+	return shared
+}
+
+// LoraLink is a pair of similar LoRAs, by their index in the profiles.
+type LoraLink struct {
+	A, B    int
+	Score   float64
+	Reasons []string
+}
+
+// LoraCluster is a group of LoRAs each of which is similar to another one of the group.
+type LoraCluster struct {
+	Members []int      // Indexes in the profiles, ascending
+	Links   []LoraLink // The similar pairs that joined them, most similar first
+}
+
+// ClusterLoras weighs the tags of the profiles (WeighLoraTags) and groups the LoRAs that
+// are at least threshold alike, directly or through others, largest group first. Only pairs
+// with a training run, dataset folder, output name or distinctive training tag in common
+// are compared, so a large collection doesn't take quadratic time.
+func ClusterLoras(profiles []LoraProfile, threshold float64) []LoraCluster {
+	WeighLoraTags(profiles)
+
+	// Candidate pairs share a key of the inverted index
+	index := make(map[string][]int)
+	for i, p := range profiles {
+		var keys []string
+		if p.Fingerprint != "" {
+			keys = append(keys, "f:"+p.Fingerprint)
+		}
+		if p.OutputName != "" {
+			keys = append(keys, "n:"+p.OutputName)
+		}
+		for _, dataset := range p.Datasets {
+			keys = append(keys, "d:"+dataset)
+		}
+		top := append([]weightedTag(nil), p.tags...)
+		sort.Slice(top, func(a, b int) bool { return top[a].weight > top[b].weight })
+		for _, t := range top[:min(len(top), loraCandidateTags)] {
+			keys = append(keys, "t:"+t.tag)
+		}
+		for _, key := range keys {
+			index[key] = append(index[key], i)
+		}
+	}
+	compared := make(map[[2]int]bool)
+	parent := make([]int, len(profiles))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	var links []LoraLink
+	for _, members := range index {
+		for x := 0; x < len(members); x++ {
+			for y := x + 1; y < len(members); y++ {
+				pair := [2]int{members[x], members[y]}
+				if compared[pair] {
+					continue
+				}
+				compared[pair] = true
+				score, reasons := LoraSimilarity(profiles[pair[0]], profiles[pair[1]])
+				if score < threshold {
+					continue
+				}
+				links = append(links, LoraLink{A: pair[0], B: pair[1], Score: score, Reasons: reasons})
+				parent[find(pair[0])] = find(pair[1])
+			}
+		}
+	}
+
+	byRoot := make(map[int]*LoraCluster)
+	for i := range profiles {
+		root := find(i)
+		if c := byRoot[root]; c != nil {
+			c.Members = append(c.Members, i)
+		} else {
+			byRoot[root] = &LoraCluster{Members: []int{i}}
+		}
+	}
+	for _, link := range links {
+		c := byRoot[find(link.A)]
+		c.Links = append(c.Links, link)
+	}
+	var clusters []LoraCluster
+	for _, c := range byRoot {
+		if len(c.Members) < 2 {
+			continue
+		}
+		sort.Slice(c.Links, func(i, j int) bool {
+			if c.Links[i].Score != c.Links[j].Score {
+				return c.Links[i].Score > c.Links[j].Score
+			}
+			return c.Links[i].A < c.Links[j].A || c.Links[i].A == c.Links[j].A && c.Links[i].B < c.Links[j].B
+		})
+		clusters = append(clusters, *c)
+	}
+	sort.Slice(clusters, func(i, j int) bool {
+		if len(clusters[i].Members) != len(clusters[j].Members) {
+			return len(clusters[i].Members) > len(clusters[j].Members)
+		}
+		return clusters[i].Members[0] < clusters[j].Members[0]
+	})
+	return clusters
+}
@@ -0,0 +1,173 @@
+package helpers
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DefaultPathTemplate is the layout of version directories below the save path.
+const DefaultPathTemplate = "{type}/{model}/{baseModel}/{versionId}-{file}"
+
+// PathValues are what a path template can refer to.
+type PathValues struct {
+	Type      string
+	Model     string
+	ModelID   int
+	BaseModel string
+	Creator   string
+	Version   string
+	VersionID int
+	File      string // File name as the API lists it; {file} is its slugged stem
+	Nsfw      bool   // The model's NSFW flag
+	NsfwLevel int    // The model's nsfwLevel bit mask (see NsfwLevelName); 0 if unknown
+}
+
+// Civitai's NSFW level bits, as combined in a model's nsfwLevel.
+const (
+	NsfwLevelPG   = 1
+	NsfwLevelPG13 = 2
+	NsfwLevelR    = 4
+	NsfwLevelX    = 8
+	NsfwLevelXXX  = 16
+)
+
+// NsfwRating returns the {rating} of a model: "nsfw" if it is flagged NSFW or rated R or
+// above, otherwise "sfw".
+func NsfwRating(nsfw bool, level int) string {
+	if nsfw || level >= NsfwLevelR {
+		return "nsfw"
+	}
+	return "sfw"
+}
+
+// NsfwLevelName returns the {nsfwLevel} of a model: its highest level ("pg", "pg13", "r",
+// "x" or "xxx"), or its NsfwRating if the level is unknown.
+func NsfwLevelName(nsfw bool, level int) string {
+	switch {
+	case level >= NsfwLevelXXX:
+		return "xxx"
+	case level >= NsfwLevelX:
+		return "x"
+	case level >= NsfwLevelR:
+		return "r"
+	case level >= NsfwLevelPG13:
+		return "pg13"
+	case level >= NsfwLevelPG:
+		return "pg"
+	}
+	return NsfwRating(nsfw, level)
+}
+
+// pathPlaceholders maps the (lower-case) placeholder names to their slugged values.
+var pathPlaceholders = map[string]func(v PathValues) string{
+	"type":  func(v PathValues) string { return ConvertToSlug(v.Type) },
+	"model": func(v PathValues) string { return ConvertToSlug(v.Model) },
+	"modelid": func(v PathValues) string {
+		return strconv.Itoa(v.ModelID)
+	},
+	"basemodel": func(v PathValues) string {
+		if v.BaseModel == "" {
+			return "unknown-base"
+		}
+		return ConvertToSlug(v.BaseModel)
+	},
+	"creator": func(v PathValues) string {
+		if v.Creator == "" {
+			return "unknown-creator"
+		}
+		return ConvertToSlug(v.Creator)
+	},
+	"version": func(v PathValues) string { return ConvertToSlug(v.Version) },
+	"versionid": func(v PathValues) string {
+		return strconv.Itoa(v.VersionID)
+	},
+	"file": func(v PathValues) string {
+		return ConvertToSlug(strings.TrimSuffix(v.File, filepath.Ext(v.File)))
+	},
+	"rating":    func(v PathValues) string { return NsfwRating(v.Nsfw, v.NsfwLevel) },
+	"nsfwlevel": func(v PathValues) string { return NsfwLevelName(v.Nsfw, v.NsfwLevel) },
+}
+
+// RenderPathTemplate returns the directory tmpl describes for v, relative to the save path.
+// Segments are separated by "/"; {name} placeholders (case-insensitive: type, model,
+// modelId, baseModel, creator, version, versionId, file, rating, nsfwLevel) are replaced
+// by slugged values and other text is kept; segments that render empty are dropped. An
+// empty tmpl is DefaultPathTemplate.
+func RenderPathTemplate(tmpl string, v PathValues) (string, error) {
+	if strings.TrimSpace(tmpl) == "" {
+		tmpl = DefaultPathTemplate
+	}
+	if strings.HasPrefix(tmpl, "/") || filepath.IsAbs(tmpl) {
+		return "", fmt.Errorf("path template %q must be relative to the save path", tmpl)
+	}
+
+	var segments []string
+	for _, segment := range strings.Split(strings.ReplaceAll(tmpl, "\\", "/"), "/") {
+		var b strings.Builder
+		rest := segment
+		for {
+			open := strings.IndexByte(rest, '{')
+			if open < 0 {
+				b.WriteString(rest)
+				break
+			}
+			end := strings.IndexByte(rest[open:], '}')
+			if end < 0 {
+				return "", fmt.Errorf("path template %q: unclosed {", tmpl)
+			}
+			name := rest[open+1 : open+end]
+			value, ok := pathPlaceholders[strings.ToLower(name)]
+			if !ok {
+				return "", fmt.Errorf("path template %q: unknown placeholder {%s}", tmpl, name)
+			}
+			b.WriteString(rest[:open])
+			b.WriteString(value(v))
+			rest = rest[open+end+1:]
+		}
+		switch rendered := b.String(); rendered {
+		case "":
+			// Dropped, like an empty model type in the default layout
+		case ".", "..":
+			return "", fmt.Errorf("path template %q: segment %q is not a directory name", tmpl, segment)
+		default:
+			segments = append(segments, rendered)
+		}
+	}
+	if len(segments) == 0 {
+		return "", fmt.Errorf("path template %q renders to an empty path", tmpl)
+	}
+	return filepath.Join(segments...), nil
+}
+
+// Name placeholders and the ID placeholders that tell apart what shares a name.
+var (
+	modelPlaceholder     = regexp.MustCompile(`(?i)\{model\}`)
+	modelIDPlaceholder   = regexp.MustCompile(`(?i)\{modelId\}`)
+	versionPlaceholder   = regexp.MustCompile(`(?i)\{version\}`)
+	versionIDPlaceholder = regexp.MustCompile(`(?i)\{versionId\}`)
+)
+
+// DisambiguatePathTemplate returns tmpl with {model} followed by "-{modelId}" and {version}
+// by "-{versionId}", so distinct models (or versions) with the same name render to distinct
+// directories. A template that already uses {modelId} (or {versionId}) keeps that name as it is.
+func DisambiguatePathTemplate(tmpl string) string {
+	if strings.TrimSpace(tmpl) == "" {
+		tmpl = DefaultPathTemplate
+	}
+	if !modelIDPlaceholder.MatchString(tmpl) {
+		tmpl = modelPlaceholder.ReplaceAllLiteralString(tmpl, "{model}-{modelId}")
+	}
+	if !versionIDPlaceholder.MatchString(tmpl) {
+		tmpl = versionPlaceholder.ReplaceAllLiteralString(tmpl, "{version}-{versionId}")
+	}
+	return tmpl
+}
+
+// ValidatePathTemplate reports whether tmpl can be rendered.
+func ValidatePathTemplate(tmpl string) error {
+	_, err := RenderPathTemplate(tmpl, PathValues{Type: "t", Model: "m", Creator: "c", Version: "v", File: "f"})
+	return err
+}
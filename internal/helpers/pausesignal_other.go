@@ -0,0 +1,11 @@
+//go:build !unix
+
+package helpers
+
+import "os"
+
+// PauseSignals has no signals on this platform; downloads are paused over the control
+// socket only.
+func PauseSignals() (pause, resume os.Signal, ok bool) {
+	return nil, nil, false
+}
@@ -0,0 +1,14 @@
+//go:build unix
+
+package helpers
+
+import (
+	"os"
+	"syscall"
+)
+
+// PauseSignals returns the signals that pause and resume a running download: SIGUSR1 and
+// SIGUSR2.
+func PauseSignals() (pause, resume os.Signal, ok bool) {
+	return syscall.SIGUSR1, syscall.SIGUSR2, true
+}
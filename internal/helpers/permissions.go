@@ -0,0 +1,160 @@
+package helpers
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// outputPermissions are the FileMode, DirMode and Chown settings given to everything the
+// tool writes below SavePath. Zero modes keep the mode each writer picks; -1 keeps the owner.
+var outputPermissions = struct {
+	sync.RWMutex
+	fileMode, dirMode os.FileMode
+	uid, gid          int
+}{uid: -1, gid: -1}
+
+// SetOutputPermissions configures the modes and owner of written files and directories.
+func SetOutputPermissions(fileMode, dirMode os.FileMode, uid, gid int) {
+	outputPermissions.Lock()
+	defer outputPermissions.Unlock()
+	outputPermissions.fileMode, outputPermissions.dirMode = fileMode, dirMode
+	outputPermissions.uid, outputPermissions.gid = uid, gid
+}
+
+// ParseFileMode parses an octal permission string such as "0640"; "" returns 0.
+func ParseFileMode(s string) (os.FileMode, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0o777 {
+		return 0, fmt.Errorf("invalid mode %q (use octal, e.g. \"0640\")", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// ParseOwner parses a Chown value, "uid:gid", "uid" or ":gid", where either side is a
+// number or a user/group name. Missing sides come back as -1; "" returns -1, -1.
+func ParseOwner(spec string) (uid, gid int, err error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return -1, -1, nil
+	}
+	owner, group, _ := strings.Cut(spec, ":")
+	uid, gid = -1, -1
+	if owner != "" {
+		if uid, err = strconv.Atoi(owner); err != nil {
+			u, lookupErr := user.Lookup(owner)
+			if lookupErr != nil {
+				return -1, -1, fmt.Errorf("unknown user %q", owner)
+			}
+			uid, _ = strconv.Atoi(u.Uid)
+		}
+	}
+	if group != "" {
+		if gid, err = strconv.Atoi(group); err != nil {
+			g, lookupErr := user.LookupGroup(group)
+			if lookupErr != nil {
+				return -1, -1, fmt.Errorf("unknown group %q", group)
+			}
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+	}
+	if uid < -1 || gid < -1 {
+		return -1, -1, fmt.Errorf("invalid owner %q", spec)
+	}
+	return uid, gid, nil
+}
+
+// ApplyFileMode gives a written file the configured FileMode and owner. Failures are
+// logged; the file itself is kept.
+func ApplyFileMode(path string) {
+	outputPermissions.RLock()
+	mode := outputPermissions.fileMode
+	outputPermissions.RUnlock()
+	applyOutputPermissions(path, mode)
+}
+
+// ApplyDirMode gives a created directory the configured DirMode and owner.
+func ApplyDirMode(path string) {
+	outputPermissions.RLock()
+	mode := outputPermissions.dirMode
+	outputPermissions.RUnlock()
+	applyOutputPermissions(path, mode)
+}
+
+func applyOutputPermissions(path string, mode os.FileMode) {
+	outputPermissions.RLock()
+	uid, gid := outputPermissions.uid, outputPermissions.gid
+	outputPermissions.RUnlock()
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			log.WithError(err).Warnf("Failed to set the permissions of %s", path)
+		}
+	}
+	if uid != -1 || gid != -1 {
+		if err := os.Lchown(path, uid, gid); err != nil {
+			log.WithError(err).Warnf("Failed to set the owner of %s", path)
+		}
+	}
+}
+
+// MkdirAll is os.MkdirAll that gives the directories it creates the configured DirMode
+// (perm without one) and owner. Directories that already exist are left alone.
+func MkdirAll(path string, perm os.FileMode) error {
+	var created []string
+	for dir := filepath.Clean(path); ; dir = filepath.Dir(dir) {
+		if _, err := os.Lstat(dir); err == nil || filepath.Dir(dir) == dir {
+			break
+		}
+		created = append(created, dir)
+	}
+	outputPermissions.RLock()
+	if outputPermissions.dirMode != 0 {
+		perm = outputPermissions.dirMode
+	}
+	outputPermissions.RUnlock()
+	if err := os.MkdirAll(path, perm); err != nil {
+		return err
+	}
+	// Outermost first, so the owner can be taken over before descending
+	for i := len(created) - 1; i >= 0; i-- {
+		ApplyDirMode(created[i])
+	}
+	return nil
+}
+
+// WriteFile is os.WriteFile that gives the file the configured FileMode and owner. The
+// data is written to <path>.tmp, flushed to disk and renamed over path, so a crash leaves
+// the old file or the new one, never a truncated one.
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	ApplyFileMode(path)
+	return nil
+}
@@ -0,0 +1,21 @@
+package helpers
+
+import (
+	"errors"
+	"os"
+)
+
+// ErrNoSpace is returned by Preallocate when the filesystem can't hold the file.
+var ErrNoSpace = errors.New("not enough free disk space")
+
+// Preallocate reserves size bytes of disk space for f without changing its size or
+// contents, so the data written into it later lands in as few extents as the filesystem
+// can manage (less fragmentation on HDD-backed storage) and a file that can't fit fails
+// up front with ErrNoSpace instead of part way through. Platforms and filesystems without
+// support return an error wrapping errors.ErrUnsupported.
+func Preallocate(f *os.File, size int64) error {
+	if size <= 0 {
+		return nil
+	}
+	return preallocate(f, size)
+}
@@ -0,0 +1,26 @@
+package helpers
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// fallocKeepSize is FALLOC_FL_KEEP_SIZE: allocate the blocks but leave the file size alone,
+// so a partial download still resumes from its real length.
+const fallocKeepSize = 0x1
+
+// preallocate asks fallocate for the blocks.
+func preallocate(f *os.File, size int64) error {
+	err := syscall.Fallocate(int(f.Fd()), fallocKeepSize, 0, size)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EDQUOT), errors.Is(err, syscall.EFBIG):
+		return fmt.Errorf("preallocating %d bytes for %s: %w", size, f.Name(), ErrNoSpace)
+	case errors.Is(err, syscall.EOPNOTSUPP), errors.Is(err, syscall.ENOSYS):
+		return fmt.Errorf("preallocating %s: %w", f.Name(), errors.ErrUnsupported)
+	}
+	return fmt.Errorf("preallocating %d bytes for %s: %w", size, f.Name(), err)
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !windows
+
+package helpers
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// preallocate has no implementation on this platform.
+func preallocate(f *os.File, size int64) error {
+	return fmt.Errorf("preallocating %s: %w", f.Name(), errors.ErrUnsupported)
+}
@@ -0,0 +1,42 @@
+package helpers
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var procSetFileInformationByHandle = syscall.NewLazyDLL("kernel32.dll").NewProc("SetFileInformationByHandle")
+
+const (
+	fileAllocationInfo = 5 // FILE_INFO_BY_HANDLE_CLASS FileAllocationInfo
+
+	errorInvalidFunction  = 1   // ERROR_INVALID_FUNCTION, from filesystems without allocation support
+	errorHandleDiskFull   = 39  // ERROR_HANDLE_DISK_FULL
+	errorNotSupported     = 50  // ERROR_NOT_SUPPORTED
+	errorInvalidParameter = 87  // ERROR_INVALID_PARAMETER
+	errorDiskFull         = 112 // ERROR_DISK_FULL
+)
+
+// preallocate sets the allocation size of the file (FileAllocationInfo). Unlike
+// SetFileValidData it needs no privilege and never exposes the old contents of the disk;
+// the end of the file stays where it is.
+func preallocate(f *os.File, size int64) error {
+	info := struct{ AllocationSize int64 }{size}
+	ok, _, callErr := procSetFileInformationByHandle.Call(f.Fd(), fileAllocationInfo, uintptr(unsafe.Pointer(&info)), unsafe.Sizeof(info))
+	if ok != 0 {
+		return nil
+	}
+	var errno syscall.Errno
+	if errors.As(callErr, &errno) {
+		switch errno {
+		case errorDiskFull, errorHandleDiskFull:
+			return fmt.Errorf("preallocating %d bytes for %s: %w", size, f.Name(), ErrNoSpace)
+		case errorInvalidFunction, errorNotSupported, errorInvalidParameter:
+			return fmt.Errorf("preallocating %s: %w", f.Name(), errors.ErrUnsupported)
+		}
+	}
+	return fmt.Errorf("preallocating %d bytes for %s: %w", size, f.Name(), callErr)
+}
@@ -0,0 +1,102 @@
+package helpers
+
+import (
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+)
+
+// Preview selection reasons, recorded in the sidecar.
+const (
+	PreviewReasonCreatorCover = "creator-cover"  // First image in the creator's order
+	PreviewReasonReactions    = "most-reactions" // Cover unusable; highest reaction count wins
+)
+
+// PreviewChoice describes which version image was chosen as the preview and why.
+type PreviewChoice struct {
+	ImageID   int    `json:"imageId"`
+	URL       string `json:"url"`
+	Index     int    `json:"index"` // Position in the creator's image order
+	Reason    string `json:"reason"`
+	Reactions int    `json:"reactions"`
+	File      string `json:"file,omitempty"` // Local preview file, filled in once saved
+}
+
+// IsVideoImage reports whether a version "image" is actually a video clip.
+func IsVideoImage(img models.ModelImage) bool {
+	if strings.EqualFold(img.Type, "video") {
+		return true
+	}
+	path := img.URL
+	if u, err := url.Parse(img.URL); err == nil {
+		path = u.Path
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".mp4", ".webm", ".mov", ".mkv":
+		return true
+	}
+	return false
+}
+
+// IsNsfwImage reports whether an image is flagged NSFW, via the boolean flag or a
+// numeric (>1) or named (anything but "None") nsfwLevel.
+func IsNsfwImage(img models.ModelImage) bool {
+	if img.Nsfw {
+		return true
+	}
+	switch level := img.NsfwLevel.(type) {
+	case float64:
+		return level > 1
+	case string:
+		return level != "" && !strings.EqualFold(level, "None")
+	}
+	return false
+}
+
+// ImageReactions sums the reaction counts of an image (comments excluded).
+func ImageReactions(img models.ModelImage) int {
+	s := img.Stats
+	return s.LikeCount + s.HeartCount + s.LaughCount + s.CryCount
+}
+
+// SelectPreviewImage picks the preview for a version deterministically. The creator's
+// cover (the first image in their order) is preferred; if it is a video or filtered out
+// by allowNsfw, the remaining still images are ranked by reaction count, ties broken by
+// the creator's order. Returns false if no usable image exists.
+func SelectPreviewImage(images []models.ModelImage, allowNsfw bool) (PreviewChoice, bool) {
+	usable := func(img models.ModelImage) bool {
+		return img.URL != "" && !IsVideoImage(img) && (allowNsfw || !IsNsfwImage(img))
+	}
+
+	if len(images) > 0 && usable(images[0]) {
+		return newPreviewChoice(images[0], 0, PreviewReasonCreatorCover), true
+	}
+
+	var candidates []int
+	for i, img := range images {
+		if usable(img) {
+			candidates = append(candidates, i)
+		}
+	}
+	if len(candidates) == 0 {
+		return PreviewChoice{}, false
+	}
+	sort.SliceStable(candidates, func(a, b int) bool {
+		return ImageReactions(images[candidates[a]]) > ImageReactions(images[candidates[b]])
+	})
+	best := candidates[0]
+	return newPreviewChoice(images[best], best, PreviewReasonReactions), true
+}
+
+func newPreviewChoice(img models.ModelImage, index int, reason string) PreviewChoice {
+	return PreviewChoice{
+		ImageID:   img.ID,
+		URL:       img.URL,
+		Index:     index,
+		Reason:    reason,
+		Reactions: ImageReactions(img),
+	}
+}
@@ -0,0 +1,223 @@
+package helpers
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/models"
+)
+
+// maxSafetensorsHeader bounds the JSON header we are willing to read (the format allows up to 100MB).
+const maxSafetensorsHeader = 100 << 20
+
+// SafetensorsTensor is one tensor entry of a safetensors header.
+type SafetensorsTensor struct {
+	DType string  `json:"dtype"`
+	Shape []int64 `json:"shape"`
+}
+
+// SafetensorsHeader is the parsed JSON header of a .safetensors file.
+type SafetensorsHeader struct {
+	Metadata map[string]string // The optional "__metadata__" string map
+	Tensors  map[string]SafetensorsTensor
+}
+
+// ReadSafetensorsHeader reads the header of the safetensors file at path without reading the tensor data.
+func ReadSafetensorsHeader(path string) (SafetensorsHeader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return SafetensorsHeader{}, err
+	}
+	defer f.Close()
+	return ParseSafetensorsHeader(f)
+}
+
+// ParseSafetensorsHeader parses a safetensors header: a little-endian uint64 length followed
+// by that many bytes of JSON mapping tensor names to dtype/shape/offsets.
+func ParseSafetensorsHeader(r io.Reader) (SafetensorsHeader, error) {
+	var header SafetensorsHeader
+	var length uint64
+	if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+		return header, fmt.Errorf("reading safetensors header length: %w", err)
+	}
+	if length == 0 || length > maxSafetensorsHeader {
+		return header, fmt.Errorf("invalid safetensors header length %d", length)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return header, fmt.Errorf("reading safetensors header: %w", err)
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return header, fmt.Errorf("decoding safetensors header: %w", err)
+	}
+	header.Tensors = make(map[string]SafetensorsTensor, len(raw))
+	for name, value := range raw {
+		if name == "__metadata__" {
+			// Values are meant to be strings; skip the map rather than fail if a tool wrote otherwise
+			if err := json.Unmarshal(value, &header.Metadata); err != nil {
+				header.Metadata = nil
+			}
+			continue
+		}
+		var tensor SafetensorsTensor
+		if err := json.Unmarshal(value, &tensor); err != nil {
+			return header, fmt.Errorf("decoding tensor %q: %w", name, err)
+		}
+		header.Tensors[name] = tensor
+	}
+	return header, nil
+}
+
+// checkpointMinSize is the file size above which an unrecognised safetensors file is assumed
+// to be a full checkpoint.
+const checkpointMinSize = 1 << 30
+
+// InferModelType guesses the Civitai model type (LORA, LoCon, DoRA, TextualInversion,
+// Controlnet, VAE or Checkpoint) of a safetensors file from its tensor names and size.
+// It returns "" if nothing matched, together with a short reason for logs and sidecars.
+func InferModelType(header SafetensorsHeader, fileSize int64) (modelType string, reason string) {
+	var lora, lycoris, dora, embedding, controlnet, diffusion, vaeOnly bool
+	vaeOnly = len(header.Tensors) > 0
+	for name := range header.Tensors {
+		switch {
+		case strings.Contains(name, "hada_w1") || strings.Contains(name, "lokr_w1"):
+			lycoris = true
+		case strings.Contains(name, "dora_scale"):
+			dora = true
+		case strings.HasPrefix(name, "lora_unet_") || strings.HasPrefix(name, "lora_te") ||
+			strings.Contains(name, ".lora_down.") || strings.Contains(name, ".lora_up.") ||
+			strings.Contains(name, ".lora_A.") || strings.Contains(name, ".lora_B."):
+			lora = true
+		case name == "emb_params" || name == "string_to_param" || name == "clip_l" || name == "clip_g":
+			embedding = true
+		case strings.HasPrefix(name, "control_model.") || strings.Contains(name, "input_hint_block"):
+			controlnet = true
+		case strings.HasPrefix(name, "model.diffusion_model."):
+			diffusion = true
+		}
+		if !strings.HasPrefix(name, "encoder.") && !strings.HasPrefix(name, "decoder.") &&
+			!strings.HasPrefix(name, "quant_conv.") && !strings.HasPrefix(name, "post_quant_conv.") {
+			vaeOnly = false
+		}
+	}
+
+	switch {
+	case lycoris:
+		return "LoCon", "LyCORIS (LoHa/LoKr) tensors"
+	case dora:
+		return "DoRA", "LoRA tensors with dora_scale"
+	case lora:
+		return "LORA", "LoRA up/down tensors"
+	case embedding && len(header.Tensors) <= 2:
+		return "TextualInversion", "embedding vectors only"
+	case controlnet:
+		return "Controlnet", "ControlNet tensors"
+	case diffusion:
+		return "Checkpoint", "full diffusion model weights"
+	case vaeOnly:
+		return "VAE", "autoencoder weights only"
+	case fileSize >= checkpointMinSize:
+		return "Checkpoint", "unrecognised tensors, file size " + BytesToSize(uint64(fileSize))
+	}
+	return "", ""
+}
+
+// maxTrainingTags is the number of most frequent training tags kept from ss_tag_frequency.
+const maxTrainingTags = 20
+
+// ExtractTrainingMetadata returns the training metadata embedded in a safetensors header by
+// kohya sd-scripts and compatible trainers, or nil if the file carries none. When the header
+// does not state the network dim, the rank of the LoRA down tensors is used instead.
+func ExtractTrainingMetadata(header SafetensorsHeader) *models.TrainingMetadata {
+	meta := header.Metadata
+	training := &models.TrainingMetadata{
+		NetworkModule: meta["ss_network_module"],
+		OutputName:    meta["ss_output_name"],
+		SessionID:     meta["ss_session_id"],
+		ModelHash:     meta["sshs_model_hash"],
+		Tags:          topTrainingTags(meta["ss_tag_frequency"], maxTrainingTags),
+	}
+	for _, key := range []string{"ss_base_model", "ss_base_model_version", "ss_sd_model_name"} {
+		if value := strings.TrimSpace(meta[key]); value != "" {
+			training.BaseModel = value
+			break
+		}
+	}
+	if dim, err := strconv.Atoi(meta["ss_network_dim"]); err == nil {
+		training.NetworkDim = dim
+	}
+	if alpha, err := strconv.ParseFloat(meta["ss_network_alpha"], 64); err == nil {
+		training.NetworkAlpha = alpha
+	}
+	if training.NetworkDim == 0 {
+		// Values like "Dynamic" or a missing key: fall back to the rank of the tensors
+		for name, tensor := range header.Tensors {
+			if strings.HasSuffix(name, ".lora_down.weight") && len(tensor.Shape) > 0 && int(tensor.Shape[0]) > training.NetworkDim {
+				training.NetworkDim = int(tensor.Shape[0])
+			}
+		}
+	}
+
+	if training.BaseModel == "" && training.NetworkModule == "" && training.OutputName == "" &&
+		training.SessionID == "" && training.ModelHash == "" && len(training.Tags) == 0 {
+		return nil // Only a dim derived from the tensors; nothing was embedded
+	}
+	return training
+}
+
+// topTrainingTags decodes ss_tag_frequency ({"dataset": {"tag": count}}) and returns up to
+// limit tags, most frequent first across all datasets.
+func topTrainingTags(tagFrequency string, limit int) []string {
+	if tagFrequency == "" {
+		return nil
+	}
+	var datasets map[string]map[string]int
+	if err := json.Unmarshal([]byte(tagFrequency), &datasets); err != nil {
+		return nil
+	}
+	counts := make(map[string]int)
+	for _, tags := range datasets {
+		for tag, count := range tags {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				counts[tag] += count
+			}
+		}
+	}
+	tags := make([]string, 0, len(counts))
+	for tag := range counts {
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		if counts[tags[i]] != counts[tags[j]] {
+			return counts[tags[i]] > counts[tags[j]]
+		}
+		return tags[i] < tags[j]
+	})
+	if len(tags) > limit {
+		tags = tags[:limit]
+	}
+	return tags
+}
+
+// TrainingFingerprint identifies the training run behind a file, so re-uploads of the same
+// weights under another model or version can be recognised. It prefers the tensor hash and
+// falls back to the training session ID; "" means the file carries neither.
+func TrainingFingerprint(training *models.TrainingMetadata) string {
+	switch {
+	case training == nil:
+		return ""
+	case training.ModelHash != "":
+		return "hash:" + strings.ToLower(training.ModelHash)
+	case training.SessionID != "":
+		return "session:" + training.SessionID
+	}
+	return ""
+}
@@ -0,0 +1,46 @@
+package helpers
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// SdNotify sends state to the service manager the way sd_notify(3) does: as one datagram
+// to the unix socket named by $NOTIFY_SOCKET (a name starting with @ is in the abstract
+// namespace). States are newline-separated assignments such as "READY=1",
+// "STATUS=Downloading x.safetensors" or "WATCHDOG=1". It reports false, and does nothing,
+// if the process wasn't started by systemd as a Type=notify service.
+func SdNotify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+	addr := &net.UnixAddr{Name: socket, Net: "unixgram"}
+	if socket[0] == '@' {
+		addr.Name = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, addr)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// SdWatchdog returns how often systemd expects "WATCHDOG=1" from this process (the unit's
+// WatchdogSec=, from $WATCHDOG_USEC), or 0 if it doesn't watch it.
+func SdWatchdog() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0 // Meant for another process (e.g. the shell that started this one)
+	}
+	return time.Duration(usec) * time.Microsecond
+}
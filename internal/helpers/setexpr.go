@@ -0,0 +1,189 @@
+package helpers
+
+import (
+	"fmt"
+	"slices"
+	"unicode"
+)
+
+// SetExpression combines named sets of IDs: "a | b" is the union, "a & b" the intersection
+// and "a - b" the difference, grouped with parentheses. & binds tighter than | and -, which
+// apply from left to right, so "a | b - c" is "(a | b) - c". Names are letters, digits,
+// underscores and dots.
+type SetExpression struct {
+	root  setNode
+	names []string
+}
+
+// setNode is a name (op 0) or an operation on two nodes.
+type setNode struct {
+	op          byte
+	name        string
+	left, right *setNode
+}
+
+// ParseSetExpression parses a set expression such as "top_sdxl_loras - (disliked | nsfw)".
+func ParseSetExpression(expr string) (*SetExpression, error) {
+	p := &setParser{input: expr}
+	root, err := p.union()
+	if err != nil {
+		return nil, err
+	}
+	if p.skipSpace(); p.pos < len(p.input) {
+		return nil, fmt.Errorf("unexpected %q at position %d of %q", p.input[p.pos:], p.pos+1, expr)
+	}
+	return &SetExpression{root: *root, names: p.names}, nil
+}
+
+// Names returns the names the expression refers to, each once, in the order they appear.
+func (e *SetExpression) Names() []string {
+	return e.names
+}
+
+// String returns the expression with every operation in parentheses.
+func (e *SetExpression) String() string {
+	return e.root.String()
+}
+
+func (n *setNode) String() string {
+	if n.op == 0 {
+		return n.name
+	}
+	return "(" + n.left.String() + " " + string(n.op) + " " + n.right.String() + ")"
+}
+
+// Eval evaluates the expression on sets, by name (a missing name is the empty set). The
+// result keeps the order of the sets: each ID where it first appears, from left to right.
+func (e *SetExpression) Eval(sets map[string][]int) []int {
+	return e.root.eval(sets)
+}
+
+func (n *setNode) eval(sets map[string][]int) []int {
+	if n.op == 0 {
+		seen := make(map[int]bool, len(sets[n.name]))
+		var ids []int
+		for _, id := range sets[n.name] {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+		return ids
+	}
+	left, right := n.left.eval(sets), n.right.eval(sets)
+	inRight := make(map[int]bool, len(right))
+	for _, id := range right {
+		inRight[id] = true
+	}
+	var result []int
+	switch n.op {
+	case '|':
+		result = append(result, left...)
+		inLeft := make(map[int]bool, len(left))
+		for _, id := range left {
+			inLeft[id] = true
+		}
+		for _, id := range right {
+			if !inLeft[id] {
+				result = append(result, id)
+			}
+		}
+	case '&', '-':
+		for _, id := range left {
+			if inRight[id] == (n.op == '&') {
+				result = append(result, id)
+			}
+		}
+	}
+	return result
+}
+
+// setParser is a recursive descent parser of set expressions.
+type setParser struct {
+	input string
+	pos   int
+	names []string
+}
+
+func (p *setParser) skipSpace() {
+	for p.pos < len(p.input) && unicode.IsSpace(rune(p.input[p.pos])) {
+		p.pos++
+	}
+}
+
+// union parses terms joined by | and -.
+func (p *setParser) union() (*setNode, error) {
+	left, err := p.intersection()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.input) || (p.input[p.pos] != '|' && p.input[p.pos] != '-') {
+			return left, nil
+		}
+		op := p.input[p.pos]
+		p.pos++
+		right, err := p.intersection()
+		if err != nil {
+			return nil, err
+		}
+		left = &setNode{op: op, left: left, right: right}
+	}
+}
+
+// intersection parses operands joined by &.
+func (p *setParser) intersection() (*setNode, error) {
+	left, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.input) || p.input[p.pos] != '&' {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+		left = &setNode{op: '&', left: left, right: right}
+	}
+}
+
+// operand parses a name or a parenthesized expression.
+func (p *setParser) operand() (*setNode, error) {
+	p.skipSpace()
+	if p.pos >= len(p.input) {
+		return nil, fmt.Errorf("%q ends where a name or ( was expected", p.input)
+	}
+	if p.input[p.pos] == '(' {
+		p.pos++
+		node, err := p.union()
+		if err != nil {
+			return nil, err
+		}
+		if p.skipSpace(); p.pos >= len(p.input) || p.input[p.pos] != ')' {
+			return nil, fmt.Errorf("missing ) in %q", p.input)
+		}
+		p.pos++
+		return node, nil
+	}
+	start := p.pos
+	for p.pos < len(p.input) && isSetNameChar(rune(p.input[p.pos])) {
+		p.pos++
+	}
+	if p.pos == start {
+		return nil, fmt.Errorf("unexpected %q at position %d of %q: expected a name or (", p.input[p.pos:p.pos+1], p.pos+1, p.input)
+	}
+	name := p.input[start:p.pos]
+	if !slices.Contains(p.names, name) {
+		p.names = append(p.names, name)
+	}
+	return &setNode{name: name}, nil
+}
+
+func isSetNameChar(r rune) bool {
+	return r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '.')
+}
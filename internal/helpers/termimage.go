@@ -0,0 +1,224 @@
+package helpers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"strings"
+)
+
+// Terminal image protocols.
+const (
+	TermGraphicsKitty = "kitty" // Kitty graphics protocol (kitty, WezTerm, Ghostty, Konsole)
+	TermGraphicsSixel = "sixel" // DEC sixel (foot, mlterm, xterm -ti vt340, WezTerm, iTerm2, ...)
+)
+
+// kittyChunk is the most base64 data the kitty protocol takes per escape sequence.
+const kittyChunk = 4096
+
+// DetectTermGraphics guesses the image protocol of the terminal from its environment
+// (which also reaches SSH sessions through TERM), or returns "" if it knows none.
+func DetectTermGraphics() string {
+	term := strings.ToLower(os.Getenv("TERM"))
+	program := strings.ToLower(os.Getenv("TERM_PROGRAM"))
+	switch {
+	case os.Getenv("KITTY_WINDOW_ID") != "", strings.Contains(term, "kitty"), strings.Contains(term, "ghostty"),
+		program == "wezterm", program == "ghostty", os.Getenv("KONSOLE_VERSION") != "":
+		return TermGraphicsKitty
+	case strings.Contains(term, "sixel"), strings.HasPrefix(term, "foot"), strings.HasPrefix(term, "mlterm"),
+		program == "iterm.app", os.Getenv("WT_SESSION") != "":
+		return TermGraphicsSixel
+	}
+	return ""
+}
+
+// ParseTermGraphics validates a protocol setting: "auto" detects it, "" or "off" disables
+// images, and "kitty" or "sixel" force one.
+func ParseTermGraphics(value string) (string, error) {
+	switch v := strings.ToLower(strings.TrimSpace(value)); v {
+	case "", "off", "none", "false":
+		return "", nil
+	case "auto", "true":
+		return DetectTermGraphics(), nil
+	case TermGraphicsKitty, TermGraphicsSixel:
+		return v, nil
+	}
+	return "", fmt.Errorf("unknown terminal image protocol %q (use auto, kitty, sixel or off)", value)
+}
+
+// IsTerminal reports whether f is a terminal rather than a file or pipe.
+func IsTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// FitImage scales img down (box filter) to fit within width x height pixels and centres
+// it on a canvas of that size filled with bg.
+func FitImage(img image.Image, width, height int, bg color.Color) *image.RGBA {
+	canvas := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			canvas.Set(x, y, bg)
+		}
+	}
+	if img == nil {
+		return canvas
+	}
+	src := img.Bounds()
+	if src.Dx() == 0 || src.Dy() == 0 {
+		return canvas
+	}
+	scale := min(float64(width)/float64(src.Dx()), float64(height)/float64(src.Dy()), 1)
+	w, h := max(1, int(float64(src.Dx())*scale)), max(1, int(float64(src.Dy())*scale))
+	offX, offY := (width-w)/2, (height-h)/2
+	for y := 0; y < h; y++ {
+		y0 := src.Min.Y + y*src.Dy()/h
+		y1 := max(y0+1, src.Min.Y+(y+1)*src.Dy()/h)
+		for x := 0; x < w; x++ {
+			x0 := src.Min.X + x*src.Dx()/w
+			x1 := max(x0+1, src.Min.X+(x+1)*src.Dx()/w)
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r, g, b, a, n = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+			// Blend the (premultiplied) average over the background
+			br, bgc, bb, ba := bg.RGBA()
+			alpha := a / n
+			canvas.Set(offX+x, offY+y, color.RGBA64{
+				R: uint16(r/n + uint64(br)*(0xffff-alpha)/0xffff),
+				G: uint16(g/n + uint64(bgc)*(0xffff-alpha)/0xffff),
+				B: uint16(b/n + uint64(bb)*(0xffff-alpha)/0xffff),
+				A: uint16(alpha + uint64(ba)*(0xffff-alpha)/0xffff),
+			})
+		}
+	}
+	return canvas
+}
+
+// WriteTermImage writes img to w in the protocol, sized to cols x rows terminal cells
+// where the protocol lets the terminal scale it (kitty); sixel images keep their pixels.
+// The cursor ends up on the line below the image.
+func WriteTermImage(w io.Writer, protocol string, img image.Image, cols, rows int) error {
+	switch protocol {
+	case TermGraphicsKitty:
+		return writeKitty(w, img, cols, rows)
+	case TermGraphicsSixel:
+		return writeSixel(w, img)
+	}
+	return fmt.Errorf("unknown terminal image protocol %q", protocol)
+}
+
+// writeKitty transmits img as PNG and displays it at the cursor (a=T), in chunks.
+func writeKitty(w io.Writer, img image.Image, cols, rows int) error {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return err
+	}
+	data := base64.StdEncoding.EncodeToString(buf.Bytes())
+	first := true
+	for len(data) > 0 {
+		chunk := data
+		if len(chunk) > kittyChunk {
+			chunk = chunk[:kittyChunk]
+		}
+		data = data[len(chunk):]
+		more := 0
+		if len(data) > 0 {
+			more = 1
+		}
+		var err error
+		if first {
+			_, err = fmt.Fprintf(w, "\x1b_Ga=T,f=100,q=2,c=%d,r=%d,m=%d;%s\x1b\\", cols, rows, more, chunk)
+			first = false
+		} else {
+			_, err = fmt.Fprintf(w, "\x1b_Gm=%d;%s\x1b\\", more, chunk)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// writeSixel encodes img as sixels with a fixed 6x6x6 colour cube, which keeps thumbnails
+// recognisable without a quantizer.
+func writeSixel(w io.Writer, img image.Image) error {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	var b strings.Builder
+	fmt.Fprintf(&b, "\x1bPq\"1;1;%d;%d", width, height)
+	for i := 0; i < 216; i++ {
+		fmt.Fprintf(&b, "#%d;2;%d;%d;%d", i, (i/36)*20, (i/6%6)*20, (i%6)*20)
+	}
+	index := make([]uint8, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			r, g, bl, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			index[y*width+x] = uint8(cubeLevel(r)*36 + cubeLevel(g)*6 + cubeLevel(bl))
+		}
+	}
+	row := make([]byte, width)
+	for band := 0; band < height; band += 6 {
+		var used [216]bool
+		for y := band; y < band+6 && y < height; y++ {
+			for x := 0; x < width; x++ {
+				used[index[y*width+x]] = true
+			}
+		}
+		firstColour := true
+		for c := 0; c < 216; c++ {
+			if !used[c] {
+				continue
+			}
+			for x := 0; x < width; x++ {
+				var bits byte
+				for dy := 0; dy < 6 && band+dy < height; dy++ {
+					if index[(band+dy)*width+x] == uint8(c) {
+						bits |= 1 << dy
+					}
+				}
+				row[x] = '?' + bits
+			}
+			if !firstColour {
+				b.WriteByte('$') // Back to the start of the band for the next colour
+			}
+			firstColour = false
+			fmt.Fprintf(&b, "#%d", c)
+			writeSixelRun(&b, row)
+		}
+		b.WriteByte('-')
+	}
+	b.WriteString("\x1b\\\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// cubeLevel maps a 16-bit channel to one of the six levels of the colour cube.
+func cubeLevel(v uint32) int {
+	return int((v*5 + 0x7fff) / 0xffff)
+}
+
+// writeSixelRun writes a row of sixels with repeats run-length encoded ("!<n><char>").
+func writeSixelRun(b *strings.Builder, row []byte) {
+	for i := 0; i < len(row); {
+		j := i
+		for j < len(row) && row[j] == row[i] {
+			j++
+		}
+		if n := j - i; n > 3 {
+			fmt.Fprintf(b, "!%d%c", n, row[i])
+		} else {
+			b.Write(row[i:j])
+		}
+		i = j
+	}
+}
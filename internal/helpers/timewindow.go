@@ -0,0 +1,195 @@
+package helpers
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TimeWindow is a recurring window of local time on some days of the week, such as
+// "Mon-Fri 18:00-08:00". A window whose end is before its start runs overnight into the
+// next day; the days name the day it starts on.
+type TimeWindow struct {
+	Days  [7]bool // Indexed by time.Weekday
+	Start int     // Minutes after midnight
+	End   int     // Minutes after midnight, up to 24*60
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// ParseTimeWindow parses "[DAYS ]HH:MM-HH:MM". DAYS is a comma-separated list of day names
+// or ranges ("Mon-Fri", "Sat,Sun", "Mon-Wed,Fri"); without it the window applies every day.
+// "24:00" is accepted as an end time.
+func ParseTimeWindow(s string) (TimeWindow, error) {
+	var w TimeWindow
+	fields := strings.Fields(s)
+	var daysSpec, timeSpec string
+	switch len(fields) {
+	case 1:
+		timeSpec = fields[0]
+	case 2:
+		daysSpec, timeSpec = fields[0], fields[1]
+	default:
+		return w, fmt.Errorf("invalid time window %q: expected \"[days ]HH:MM-HH:MM\"", s)
+	}
+
+	if daysSpec == "" {
+		for i := range w.Days {
+			w.Days[i] = true
+		}
+	} else {
+		for _, part := range strings.Split(daysSpec, ",") {
+			first, last, isRange := strings.Cut(strings.ToLower(strings.TrimSpace(part)), "-")
+			from, ok := weekdayNames[truncateDay(first)]
+			if !ok {
+				return w, fmt.Errorf("invalid day %q in time window %q", first, s)
+			}
+			to := from
+			if isRange {
+				if to, ok = weekdayNames[truncateDay(last)]; !ok {
+					return w, fmt.Errorf("invalid day %q in time window %q", last, s)
+				}
+			}
+			for day := from; ; day = (day + 1) % 7 {
+				w.Days[day] = true
+				if day == to {
+					break
+				}
+			}
+		}
+	}
+
+	startSpec, endSpec, ok := strings.Cut(timeSpec, "-")
+	if !ok {
+		return w, fmt.Errorf("invalid time range %q in time window %q", timeSpec, s)
+	}
+	var err error
+	if w.Start, err = parseClock(startSpec); err != nil || w.Start == 24*60 {
+		return w, fmt.Errorf("invalid start time %q in time window %q", startSpec, s)
+	}
+	if w.End, err = parseClock(endSpec); err != nil {
+		return w, fmt.Errorf("invalid end time %q in time window %q", endSpec, s)
+	}
+	if w.Start == w.End {
+		return w, fmt.Errorf("time window %q is empty", s)
+	}
+	return w, nil
+}
+
+// truncateDay accepts full day names ("monday") as well as abbreviations.
+func truncateDay(day string) string {
+	if len(day) > 3 {
+		return day[:3]
+	}
+	return day
+}
+
+// parseClock parses HH:MM into minutes after midnight.
+func parseClock(s string) (int, error) {
+	hours, minutes, ok := strings.Cut(strings.TrimSpace(s), ":")
+	if !ok {
+		return 0, fmt.Errorf("expected HH:MM")
+	}
+	h, err := strconv.Atoi(hours)
+	if err != nil {
+		return 0, err
+	}
+	m, err := strconv.Atoi(minutes)
+	if err != nil {
+		return 0, err
+	}
+	if h < 0 || m < 0 || m > 59 || h > 24 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("out of range")
+	}
+	return h*60 + m, nil
+}
+
+// Contains reports whether t (in the location the window applies to) falls inside the window.
+func (w TimeWindow) Contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	today := t.Weekday()
+	yesterday := (today + 6) % 7
+	if w.End > w.Start {
+		return w.Days[today] && minute >= w.Start && minute < w.End
+	}
+	// Overnight: the evening part belongs to today, the morning part to the day before
+	return (w.Days[today] && minute >= w.Start) || (w.Days[yesterday] && minute < w.End)
+}
+
+// InTimeWindows reports whether t falls inside any of the windows. No windows means always.
+func InTimeWindows(windows []TimeWindow, t time.Time) bool {
+	if len(windows) == 0 {
+		return true
+	}
+	for _, w := range windows {
+		if w.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// NextTimeWindowStart returns t if it is inside a window, otherwise the time the next window
+// opens (in t's location). It returns the zero time if there are no windows.
+func NextTimeWindowStart(windows []TimeWindow, t time.Time) time.Time {
+	if len(windows) == 0 || InTimeWindows(windows, t) {
+		return t
+	}
+	var next time.Time
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	for offset := 0; offset <= 7; offset++ {
+		day := midnight.AddDate(0, 0, offset)
+		for _, w := range windows {
+			if !w.Days[day.Weekday()] {
+				continue
+			}
+			start := time.Date(day.Year(), day.Month(), day.Day(), w.Start/60, w.Start%60, 0, 0, t.Location())
+			if start.After(t) && (next.IsZero() || start.Before(next)) {
+				next = start
+			}
+		}
+	}
+	return next
+}
+
+// NextTimeWindowEnd returns when the windows t is inside stop covering it: the end of
+// its window, or of the windows that follow on from it without a gap. It returns t if t is
+// outside all windows, and the zero time if the windows never end (none given, or all
+// week covered).
+func NextTimeWindowEnd(windows []TimeWindow, t time.Time) time.Time {
+	if len(windows) == 0 {
+		return time.Time{}
+	}
+	if !InTimeWindows(windows, t) {
+		return t
+	}
+	var ends []time.Time
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	for offset := -1; offset <= 8; offset++ {
+		day := midnight.AddDate(0, 0, offset)
+		for _, w := range windows {
+			if !w.Days[day.Weekday()] {
+				continue
+			}
+			end := time.Date(day.Year(), day.Month(), day.Day(), w.End/60, w.End%60, 0, 0, t.Location())
+			if w.End <= w.Start {
+				end = end.AddDate(0, 0, 1) // Overnight
+			}
+			if end.After(t) {
+				ends = append(ends, end)
+			}
+		}
+	}
+	sort.Slice(ends, func(i, j int) bool { return ends[i].Before(ends[j]) })
+	for _, end := range ends {
+		if !InTimeWindows(windows, end) {
+			return end
+		}
+	}
+	return time.Time{}
+}
@@ -14,6 +14,19 @@ type (
 		SavePath       string `toml:"SavePath"`
 		DatabasePath   string `toml:"DatabasePath"`
 		BleveIndexPath string `toml:"BleveIndexPath"` // New field for Bleve index path
+		TempDir        string `toml:"TempDir"`        // Staging dir for partial downloads and conversions
+		PathTemplate   string `toml:"PathTemplate"`   // Layout of version directories below SavePath ("" = default)
+		// NsfwPartition keeps models below a top-level directory per rating ("rating": sfw,
+		// nsfw) or NSFW level ("level": pg, pg13, r, x, xxx); "" = off.
+		NsfwPartition      string            `toml:"NsfwPartition"`
+		NsfwPartitionModes map[string]string `toml:"NsfwPartitionModes"` // Partition -> octal permissions, e.g. sfw = "0755"
+		// DisambiguateNames puts the model ID after {model} and the version ID after {version}
+		// (and in model directories), so models and versions sharing a name get their own.
+		DisambiguateNames bool `toml:"DisambiguateNames"`
+		// Permissions and owner of the files and directories written below SavePath
+		FileMode string `toml:"FileMode"` // Octal, e.g. "0640" ("" = the defaults, mostly 0600)
+		DirMode  string `toml:"DirMode"`  // Octal, e.g. "0750" ("" = the defaults, mostly 0700)
+		Chown    string `toml:"Chown"`    // "uid:gid", "uid" or ":gid"; numbers or names ("" = unchanged)
 
 		// Filtering - Model/Version Level
 		Query               string   `toml:"Query"`
@@ -25,12 +38,29 @@ type (
 		Nsfw                bool     `toml:"Nsfw"`                // Renamed from GetNsfw
 		ModelVersionID      int      `toml:"ModelVersionID"`      // New
 		DownloadAllVersions bool     `toml:"DownloadAllVersions"` // New
+		// Queries are named listings QueryCompose combines, e.g. [Queries.top_sdxl_loras]
+		Queries map[string]QueryBlock `toml:"Queries"`
+		// QueryCompose combines Queries with | (union), & (intersection) and - (difference),
+		// e.g. "top_sdxl_loras - disliked_style"; it replaces the run's own query
+		QueryCompose string `toml:"QueryCompose"`
 
 		// Filtering - File Level
 		PrimaryOnly           bool     `toml:"PrimaryOnly"` // Renamed from GetOnlyPrimaryModel
 		Pruned                bool     `toml:"Pruned"`      // Renamed from GetPruned
 		Fp16                  bool     `toml:"Fp16"`        // Renamed from GetFp16
 		IgnoreFileNameStrings []string `toml:"IgnoreFileNameStrings"`
+		// File formats to accept for other types than embeddings, most preferred first
+		// (default SafeTensor only); of a file shipped in several formats only the
+		// preferred one is downloaded
+		FileFormats []string `toml:"FileFormats"`
+		// Embedding (TextualInversion) file formats to accept, most preferred first; of
+		// several formats of the same embedding only the preferred one is downloaded
+		EmbeddingFormats []string `toml:"EmbeddingFormats"`
+		FilterExpression string   `toml:"FilterExpression"` // Plugin: only files this expression accepts
+		FilterCommand    string   `toml:"FilterCommand"`    // Plugin: program deciding on each file (JSON on stdin)
+		// Restricted model categories (poi, minor) that are never downloaded, whatever
+		// the other filters say
+		ExcludeRestricted []string `toml:"ExcludeRestricted"`
 
 		// API Query Behavior
 		Sort     string `toml:"Sort"`
@@ -39,18 +69,142 @@ type (
 		MaxPages int    `toml:"MaxPages"` // New
 
 		// Downloader Behavior
-		Concurrency         int  `toml:"Concurrency"` // Renamed from DefaultConcurrency
+		Concurrency         int  `toml:"Concurrency"`      // Renamed from DefaultConcurrency
+		DownloadSegments    int  `toml:"DownloadSegments"` // Connections per large file, each downloading a byte range (0/1 = one)
 		SaveMetadata        bool `toml:"SaveMetadata"`
 		DownloadMetaOnly    bool `toml:"DownloadMetaOnly"`  // New
 		SaveModelInfo       bool `toml:"SaveModelInfo"`     // New
 		SaveVersionImages   bool `toml:"SaveVersionImages"` // New
 		SaveModelImages     bool `toml:"SaveModelImages"`   // New
+		SavePreview         bool `toml:"SavePreview"`       // Save <model>.preview.png next to downloads
+		DedupeImages        bool `toml:"DedupeImages"`      // Fetch an image once for preview and gallery, hard-linking copies
+		DetectOtherTypes    bool `toml:"DetectOtherTypes"`  // Detect the real type of "Other" safetensors files
+		AllowDowngrade      bool `toml:"AllowDowngrade"`    // Download a model's latest upstream version even if a newer one is stored
+		LatestLink          bool `toml:"LatestLink"`        // Keep a "latest" symlink to the newest stored version in each model directory
 		SkipConfirmation    bool `toml:"SkipConfirmation"`  // New (for --yes flag)
 		ApiDelayMs          int  `toml:"ApiDelayMs"`
 		ApiClientTimeoutSec int  `toml:"ApiClientTimeoutSec"`
 
+		// Preset for ApiDelayMs, Concurrency, DownloadSegments, MaxRetries and RetryDelay:
+		// "conservative", "default" or "aggressive"; explicit settings override it
+		EtiquetteProfile string `toml:"EtiquetteProfile"`
+		// JSON-RPC endpoint of a running aria2c to hand model downloads to (empty = built-in
+		// downloader), and its --rpc-secret
+		Aria2RpcUrl    string `toml:"Aria2RpcUrl"`
+		Aria2RpcSecret string `toml:"Aria2RpcSecret"`
+		// URL templates tried in order when Civitai refuses a file (403/404/410/5xx), with
+		// {url}, {versionId}, {fileName}, {sha256} and {autov2} filled in
+		MirrorUrls []string `toml:"MirrorUrls"`
+		// Hashes computed of every downloaded model file, recorded in the receipt and the entry
+		// (sha256, autov2, blake3, crc32, md5, sha1; SHA256 is always among them)
+		HashAlgorithms []string `toml:"HashAlgorithms"`
+		// Published hashes downloads are verified by; the first the API lists decides
+		VerifyHashes []string `toml:"VerifyHashes"`
+		// What happens to a download that fails verification: "delete" (default), "keep"
+		// (left as <target>.mismatch) or "quarantine" (moved to [SavePath]/quarantine)
+		HashMismatchPolicy string `toml:"HashMismatchPolicy"`
+		// Times a download that fails verification is fetched again from the start
+		MismatchRetries int `toml:"MismatchRetries"`
+		// Give up on a download connection that receives nothing this long (0 = never); the
+		// transfer is resumed or retried
+		StallTimeoutSec int `toml:"StallTimeoutSec"`
+		// Reserve the full size of each model file on disk before writing it (fallocate on
+		// Linux, the allocation size on Windows): less fragmentation, and no room fails early
+		Preallocate bool `toml:"Preallocate"`
+		// Pause all requests this long after a Cloudflare challenge (doubling while they repeat; 0 = no pause)
+		ChallengeCooldownSec int `toml:"ChallengeCooldownSec"`
+		// Times a failed API request or download is tried again, and the wait before the first
+		// retry (doubling for each one after it), e.g. "2s"
+		MaxRetries int    `toml:"MaxRetries"`
+		RetryDelay string `toml:"RetryDelay"`
+		// HTTP statuses retried on top of 408, 429 and 5xx, and backoff multipliers per status ("520" = 3)
+		RetryStatusCodes        []int              `toml:"RetryStatusCodes"`
+		RetryBackoffMultipliers map[string]float64 `toml:"RetryBackoffMultipliers"`
+
+		// Bandwidth budgets per second for each transfer class ("" = unlimited), e.g. "2MB"
+		BandwidthMetadata string `toml:"BandwidthMetadata"` // API JSON
+		BandwidthPreviews string `toml:"BandwidthPreviews"` // Preview and gallery images
+		BandwidthBinaries string `toml:"BandwidthBinaries"` // Model files
+		LimitRate         string `toml:"LimitRate"`         // All downloads together, e.g. "10MB/s"
+		// Request rates per host, "<host or *.domain>=<n>/<s|m|h>", e.g. "*.cloudflarestorage.com=1/s"
+		HostRateLimits []string `toml:"HostRateLimits"`
+		// Where requests really go: a Civitai-compatible API instead of https://civitai.com/api/v1,
+		// and host -> replacement host for the hosts of downloads and images ("" / {} = Civitai)
+		ApiBaseUrl       string            `toml:"ApiBaseUrl"`
+		CdnHostOverrides map[string]string `toml:"CdnHostOverrides"`
+
+		// Watch mode - repeat the download run every WatchInterval ("" runs once)
+		WatchInterval   string   `toml:"WatchInterval"`   // e.g. "6h"
+		DownloadWindows []string `toml:"DownloadWindows"` // Local-time windows for file downloads, e.g. "Mon-Fri 22:00-06:00"
+		WatchTimezone   string   `toml:"WatchTimezone"`   // IANA zone for DownloadWindows (default: system local time)
+		DigestInterval  string   `toml:"DigestInterval"`  // Watch mode: write a digest this often ("daily", "weekly", "14d", "72h"; "" = never)
+		DigestDir       string   `toml:"DigestDir"`       // Where digests are written (default: {SavePath}/digests)
+		DigestFormat    string   `toml:"DigestFormat"`    // "markdown" (default), "html" or "both"
+		DigestWebhook   string   `toml:"DigestWebhook"`   // Chat webhook URL (Discord, Slack, Mattermost) the digest is also posted to
+		// Under systemd with WatchdogSec=: how long nothing may move before the watchdog pings
+		// stop and the service is restarted (default "15m", "0" = never)
+		WatchdogHangTimeout string `toml:"WatchdogHangTimeout"`
+		// WatchJobs are maintenance jobs the watch loop runs between download cycles, by name
+		WatchJobs map[string]WatchJob `toml:"WatchJobs"`
+
+		// Dataset repositories - write the pointer/metadata files git-annex or DVC track downloads with
+		DatasetMode string `toml:"DatasetMode"` // "" (off), "dvc" or "git-annex"
+
+		// NSFW drift - downloaded models reclassified as NSFW (or retagged) upstream
+		NsfwDriftPolicy string `toml:"NsfwDriftPolicy"` // "report" (default), "move" or "prune"
+		NsfwDriftDir    string `toml:"NsfwDriftDir"`    // Where "move" puts them (default: {SavePath}/nsfw)
+
+		// Upstream removal - downloaded versions Civitai answers 404 for (often only hidden during a review)
+		RemovalGracePeriod string `toml:"RemovalGracePeriod"` // How long a version must stay missing to count as removed (default "72h")
+		RemovalChecks      int    `toml:"RemovalChecks"`      // Checks, the first 404 included, that must find it missing (default 3)
+		RemovalPolicy      string `toml:"RemovalPolicy"`      // "report" (default), "move" or "prune"
+		RemovalDir         string `toml:"RemovalDir"`         // Where "move" puts them (default: {SavePath}/removed)
+
+		// TypeOverrides maps a model ID or model version ID to the type to file it under
+		TypeOverrides map[string]string `toml:"TypeOverrides"`
+
+		// Quotas - soft limits on the archive share of one creator or model type (0/"" = none)
+		MaxBytesPerCreator string            `toml:"MaxBytesPerCreator"` // e.g. "50GB"
+		MaxFilesPerCreator int               `toml:"MaxFilesPerCreator"`
+		MaxBytesPerType    map[string]string `toml:"MaxBytesPerType"` // Model type -> size, e.g. checkpoint = "500GB"
+		MaxFilesPerType    map[string]int    `toml:"MaxFilesPerType"` // Model type -> file count
+
+		// Disk space - downloads are checked against the free space before they are queued
+		DiskSpacePolicy  string `toml:"DiskSpacePolicy"`  // "trim" (default: skip what doesn't fit), "abort" or "off"
+		DiskSpaceReserve string `toml:"DiskSpaceReserve"` // Space to leave free (default "1GB")
+
+		// MaxTotalSize caps the total size of the files one run queues, e.g. "50GB" ("" = none)
+		MaxTotalSize string `toml:"MaxTotalSize"`
+
+		// QueueOrder is the order files are downloaded in: api, newest, smallest, largest or
+		// popular ("" = api, the order the API lists them in)
+		QueueOrder string `toml:"QueueOrder"`
+
+		// RunSummaryFile is where the summary printed at the end of each run is also written
+		// as JSON ("" = printed only)
+		RunSummaryFile string `toml:"RunSummaryFile"`
+
+		// FailedListFile is where the downloads that failed (with URL, error and attempts)
+		// are listed as JSON after each run ("" = failed.json in SavePath)
+		FailedListFile string `toml:"FailedListFile"`
+
+		// Training data - the datasets creators attach to versions, downloaded into a tree
+		// of their own (below TrainingDataDir, "" = training-data in SavePath) with the
+		// version's model file
+		IncludeTrainingData  bool   `toml:"IncludeTrainingData"`
+		TrainingDataDir      string `toml:"TrainingDataDir"`
+		MaxTrainingDataSize  string `toml:"MaxTrainingDataSize"`  // Skip larger attachments, e.g. "2GB" ("" = no limit)
+		MaxTrainingDataTotal string `toml:"MaxTrainingDataTotal"` // Per run, e.g. "20GB" ("" = no limit)
+
+		// Conflicts - what to do when a download runs into an existing file, a downgrade or a
+		// changed upstream file
+		InteractiveConflicts bool              `toml:"InteractiveConflicts"` // Ask about each conflict (needs a terminal)
+		ConflictPolicies     map[string]string `toml:"ConflictPolicies"`     // Conflict kind -> action or "ask", e.g. collision = "keep"
+
 		// Other
 		LogApiRequests bool `toml:"LogApiRequests"`
+		StrictApi      bool `toml:"StrictApi"` // Fail on API schema drift instead of tolerating it
+		LowMemory      bool `toml:"LowMemory"` // Small buffers and pages, one download at a time, no raw JSON kept
 	}
 
 	// Api Calls and Responses
@@ -81,8 +235,10 @@ type (
 		Name                  string         `json:"name"`
 		Description           string         `json:"description"`
 		Type                  string         `json:"type"`
-		Poi                   bool           `json:"poi"`
+		Poi                   bool           `json:"poi"`   // Depicts a real person (person of interest, e.g. a celebrity)
+		Minor                 bool           `json:"minor"` // Flagged by Civitai's moderation as depicting minors
 		Nsfw                  bool           `json:"nsfw"`
+		NsfwLevel             int            `json:"nsfwLevel"` // Bit mask of the levels of its content (1 PG, 2 PG-13, 4 R, 8 X, 16 XXX)
 		AllowNoCredit         bool           `json:"allowNoCredit"`
 		AllowCommercialUse    []string       `json:"allowCommercialUse"`
 		AllowDerivatives      bool           `json:"allowDerivatives"`
@@ -109,11 +265,12 @@ type (
 
 	// --- NEW: Struct for nested 'model' field in /model-versions/{id} response ---
 	BaseModelInfo struct {
-		Name string `json:"name"`
-		Type string `json:"type"`
-		Nsfw bool   `json:"nsfw"`
-		Poi  bool   `json:"poi"`
-		Mode string `json:"mode"` // Can be null, "Archived", "TakenDown"
+		Name  string `json:"name"`
+		Type  string `json:"type"`
+		Nsfw  bool   `json:"nsfw"`
+		Poi   bool   `json:"poi"`
+		Minor bool   `json:"minor"`
+		Mode  string `json:"mode"` // Can be null, "Archived", "TakenDown"
 	}
 
 	ModelVersion struct {
@@ -166,6 +323,7 @@ type (
 		ID        int         `json:"id"`
 		URL       string      `json:"url"`
 		Hash      string      `json:"hash"` // Blurhash
+		Type      string      `json:"type"` // "image" or "video"
 		Width     int         `json:"width"`
 		Height    int         `json:"height"`
 		Nsfw      bool        `json:"nsfw"`      // Keep boolean for simplicity, align with Model struct Nsfw
@@ -213,6 +371,92 @@ type (
 		Folder       string       `json:"folder"`
 		Status       string       `json:"status"`
 		ErrorDetails string       `json:"errorDetails,omitempty"`
+		// VersionDir is the version's directory relative to SavePath, rendered from PathTemplate.
+		// Entries written before path templates existed leave it empty (default layout).
+		VersionDir string `json:"versionDir,omitempty"`
+		// ErrorCategory classifies ErrorDetails (network, rate-limit, auth, not-found, disk,
+		// verification, filtered or unknown); see the failure package.
+		ErrorCategory string `json:"errorCategory,omitempty"`
+		// ErrorReason is the recognised Civitai failure behind ErrorDetails (login-required,
+		// early-access, cloudflare-challenge, ...), if any; see failure.Reason.
+		ErrorReason string `json:"errorReason,omitempty"`
+		// FailedAt is when ErrorDetails was recorded.
+		FailedAt int64 `json:"failedAt,omitempty"`
+		// FailedAttempts counts the downloads of the file that failed in a row. A successful
+		// download clears it.
+		FailedAttempts int `json:"failedAttempts,omitempty"`
+		// InferredType is the model type detected from the file itself when the API said "Other".
+		InferredType string `json:"inferredType,omitempty"`
+		// EmbeddingToken is the word that invokes an embedding (TextualInversion) in a prompt:
+		// the name its file is saved under, without extension.
+		EmbeddingToken string `json:"embeddingToken,omitempty"`
+		// Training is the kohya-style training metadata embedded in the safetensors header, if any.
+		Training *TrainingMetadata `json:"training,omitempty"`
+		// Hashes of the local file computed when it was downloaded, by algorithm ("sha256",
+		// "autov2", "blake3", ...; see HashAlgorithms).
+		LocalHashes map[string]string `json:"localHashes,omitempty"`
+		// Trust-on-first-use pin: the hashes first seen for this version's file.
+		// A later download of the same file with different hashes is refused unless accepted.
+		PinnedHashes *Hashes `json:"pinnedHashes,omitempty"`
+		PinnedFileID int     `json:"pinnedFileId,omitempty"`
+		PinnedAt     int64   `json:"pinnedAt,omitempty"`
+		// The model's NSFW flag and tags as last seen upstream, to notice reclassification.
+		// Entries recorded before drift detection leave them empty until the next refresh.
+		ModelNsfw      *bool    `json:"modelNsfw,omitempty"`
+		ModelNsfwLevel int      `json:"modelNsfwLevel,omitempty"`
+		ModelTags      []string `json:"modelTags,omitempty"`
+		// NsfwMovedAt is when NsfwDriftPolicy "move" took the files out of the PathTemplate layout.
+		NsfwMovedAt int64 `json:"nsfwMovedAt,omitempty"`
+		// RolledBackAt is set on the version `rollback` made the model's current one; the
+		// model's "latest" link stays on it until the rollback is released.
+		RolledBackAt int64 `json:"rolledBackAt,omitempty"`
+		// VerifiedAt is when db verify last hash-checked the file; --sample favours old ones.
+		VerifiedAt int64 `json:"verifiedAt,omitempty"`
+		// Upstream removal: MissingSince is when Civitai first answered 404 for the version and
+		// MissingChecks how many checks found it missing since (the last at MissingCheckedAt).
+		// RemovedAt is set once RemovalGracePeriod confirmed the removal, and RemovalAction
+		// records what RemovalPolicy did then (reported, moved or pruned).
+		MissingSince     int64  `json:"missingSince,omitempty"`
+		MissingChecks    int    `json:"missingChecks,omitempty"`
+		MissingCheckedAt int64  `json:"missingCheckedAt,omitempty"`
+		RemovedAt        int64  `json:"removedAt,omitempty"`
+		RemovalAction    string `json:"removalAction,omitempty"`
+		// Permissions are the model's license terms. Entries recorded before they were kept,
+		// or from a version lookup (which doesn't list them), leave them nil until db backfill.
+		Permissions *ModelPermissions `json:"permissions,omitempty"`
+		// BackfilledAt is when db backfill last looked the entry up to fill in missing fields.
+		BackfilledAt int64 `json:"backfilledAt,omitempty"`
+		// QueuedAt is when the entry was handed to the download workers. It is cleared once
+		// the download ends, so a Pending or Downloading entry that still has it was cut off
+		// by a crash and is resumed by the next run.
+		QueuedAt int64 `json:"queuedAt,omitempty"`
+		// QueuePosition is the entry's place in the download queue (1 first) set by 'queue
+		// import'; queued entries without one follow. It is cleared with QueuedAt.
+		QueuePosition int `json:"queuePosition,omitempty"`
+		// QuarantinedAt is when the file failed verification and was moved to the quarantine
+		// directory. It is cleared with the error, once a download of the file succeeds.
+		QuarantinedAt int64 `json:"quarantinedAt,omitempty"`
+	}
+
+	// ModelPermissions are the license terms of a model, as the API lists them.
+	ModelPermissions struct {
+		AllowNoCredit         bool     `json:"allowNoCredit"`
+		AllowCommercialUse    []string `json:"allowCommercialUse"`
+		AllowDerivatives      bool     `json:"allowDerivatives"`
+		AllowDifferentLicense bool     `json:"allowDifferentLicense"`
+	}
+
+	// TrainingMetadata is the training information trainers (kohya sd-scripts and compatible)
+	// embed in the "__metadata__" of a safetensors file.
+	TrainingMetadata struct {
+		BaseModel     string   `json:"baseModel,omitempty"`     // ss_base_model_version or ss_sd_model_name
+		NetworkModule string   `json:"networkModule,omitempty"` // ss_network_module
+		NetworkDim    int      `json:"networkDim,omitempty"`    // ss_network_dim, or the rank of the LoRA tensors
+		NetworkAlpha  float64  `json:"networkAlpha,omitempty"`  // ss_network_alpha
+		OutputName    string   `json:"outputName,omitempty"`    // ss_output_name
+		SessionID     string   `json:"sessionId,omitempty"`     // ss_session_id
+		ModelHash     string   `json:"modelHash,omitempty"`     // sshs_model_hash: hash of the tensors, unaffected by metadata edits
+		Tags          []string `json:"tags,omitempty"`          // Most frequent training tags (ss_tag_frequency)
 	}
 
 	// --- Start: /api/v1/images Endpoint Structures ---
@@ -250,16 +494,55 @@ type (
 		PreviousPage string `json:"previousPage,omitempty"`
 	}
 	// --- End: /api/v1/images Endpoint Structures ---
+
+	// QueryBlock is one of the Queries: the filters of a /models listing. Sort defaults to
+	// "Most Downloaded", Period to "AllTime", and Nsfw and MaxPages to the run's settings.
+	QueryBlock struct {
+		Query      string   `toml:"Query"`
+		Tag        string   `toml:"Tag"`
+		Username   string   `toml:"Username"`
+		ModelTypes []string `toml:"ModelTypes"`
+		BaseModels []string `toml:"BaseModels"`
+		Sort       string   `toml:"Sort"`
+		Period     string   `toml:"Period"`
+		Nsfw       *bool    `toml:"Nsfw"`     // nil: the run's Nsfw
+		MaxPages   int      `toml:"MaxPages"` // 0: the run's MaxPages
+	}
+
+	// WatchJob is a command the watch loop runs every Interval. Jobs named verify, stats,
+	// prune, compact, check-removed or report have a default Command.
+	WatchJob struct {
+		Interval   string   `toml:"Interval"`   // e.g. "24h" or "7d"
+		Command    []string `toml:"Command"`    // civitai-downloader arguments, e.g. ["db", "verify", "--sample", "5%"]
+		Windows    []string `toml:"Windows"`    // Local-time windows the job may start in (default: any time)
+		Timeout    string   `toml:"Timeout"`    // Stop the job after this long ("" = no limit)
+		Output     string   `toml:"Output"`     // File (relative to SavePath) for the job's standard output ("" = the log)
+		Concurrent []string `toml:"Concurrent"` // Jobs this one may run alongside ("*" = any; default: none, one job at a time)
+	}
 )
 
 // Database Status Constants
 const (
-	StatusPending    = "Pending"
-	StatusDownloaded = "Downloaded"
-	StatusError      = "Error"
+	StatusPending     = "Pending"
+	StatusDownloading = "Downloading" // A worker is downloading the file; left behind if the run died mid-download
+	StatusDownloaded  = "Downloaded"
+	StatusError       = "Error"
+	StatusCataloged   = "Cataloged" // Metadata saved by --metadata-only; the model file was never downloaded
+	StatusDeferred    = "Deferred"  // Found in watch mode outside the download windows; downloaded in the next one
+	StatusPruned      = "Pruned"    // Deleted by NsfwDriftPolicy or RemovalPolicy "prune", or dropped by 'queue import --prune-dropped'; not downloaded again
 )
 
 // ConstructApiUrl builds the Civitai API URL from query parameters.
+// Permissions returns the model's license terms.
+func (m Model) Permissions() *ModelPermissions {
+	return &ModelPermissions{
+		AllowNoCredit:         m.AllowNoCredit,
+		AllowCommercialUse:    m.AllowCommercialUse,
+		AllowDerivatives:      m.AllowDerivatives,
+		AllowDifferentLicense: m.AllowDifferentLicense,
+	}
+}
+
 func ConstructApiUrl(params QueryParameters) string {
 	base := "https://civitai.com/api/v1/models"
 	values := url.Values{}
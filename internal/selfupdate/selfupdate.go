@@ -0,0 +1,296 @@
+package selfupdate
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/dreamfast/go-civitai-downloader/internal/failure"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ChecksumsAssetName is the release asset holding sha256sum-style checksums for all binaries.
+// It is not signed: it comes from the same release as the binaries, so it catches a
+// corrupted or truncated download, but someone who can publish releases to the repository
+// can publish matching checksums too. The authenticity of an update rests on HTTPS and the
+// GitHub account alone.
+const ChecksumsAssetName = "checksums.txt"
+
+var (
+	// ErrNoAsset is returned when a release has no binary for the running OS/arch.
+	ErrNoAsset = failure.New(failure.NotFound, "no release asset for this platform")
+	// ErrChecksumMismatch is returned when the downloaded binary doesn't match the published checksum.
+	ErrChecksumMismatch = failure.New(failure.Verification, "checksum mismatch")
+	// ErrNoChecksum is returned when the release doesn't publish a checksum for the binary.
+	ErrNoChecksum = failure.New(failure.Verification, "release has no checksum for asset")
+)
+
+// Asset is a downloadable file attached to a GitHub release.
+type Asset struct {
+	Name               string `json:"name"`
+	BrowserDownloadURL string `json:"browser_download_url"`
+	Size               int64  `json:"size"`
+}
+
+// Release is the subset of the GitHub release API we use.
+type Release struct {
+	TagName     string  `json:"tag_name"`
+	Name        string  `json:"name"`
+	HTMLURL     string  `json:"html_url"`
+	PublishedAt string  `json:"published_at"`
+	Assets      []Asset `json:"assets"`
+}
+
+// Updater checks GitHub releases for a repository and replaces the running binary.
+type Updater struct {
+	Repo       string // "owner/name"
+	BinaryName string // Asset prefix, e.g. "civitai-downloader"
+	Client     *http.Client
+}
+
+// LatestRelease fetches the latest published release.
+func (u *Updater) LatestRelease() (Release, error) {
+	url := fmt.Sprintf("https://api.github.com/repos/%s/releases/latest", u.Repo)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return Release{}, fmt.Errorf("failed to create release request: %w", err)
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+
+	resp, err := u.Client.Do(req)
+	if err != nil {
+		return Release{}, fmt.Errorf("failed to query releases for %s: %w", u.Repo, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Release{}, fmt.Errorf("release query for %s returned status %s", u.Repo, resp.Status)
+	}
+
+	var release Release
+	if err := json.NewDecoder(resp.Body).Decode(&release); err != nil {
+		return Release{}, fmt.Errorf("failed to decode release response: %w", err)
+	}
+	return release, nil
+}
+
+// AssetName returns the release asset name for the running platform,
+// matching the names produced by `make release`.
+func (u *Updater) AssetName() string {
+	name := fmt.Sprintf("%s-%s-%s", u.BinaryName, runtime.GOOS, runtime.GOARCH)
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+// FindAsset returns the named asset from a release.
+func FindAsset(release Release, name string) (Asset, bool) {
+	for _, asset := range release.Assets {
+		if asset.Name == name {
+			return asset, true
+		}
+	}
+	return Asset{}, false
+}
+
+// Apply downloads the platform binary from the release, verifies it against the
+// published (unsigned, see ChecksumsAssetName) checksums and swaps it in place of the
+// executable at exePath.
+func (u *Updater) Apply(release Release, exePath string) error {
+	assetName := u.AssetName()
+	asset, ok := FindAsset(release, assetName)
+	if !ok {
+		return fmt.Errorf("%w: %s in release %s", ErrNoAsset, assetName, release.TagName)
+	}
+	checksumAsset, ok := FindAsset(release, ChecksumsAssetName)
+	if !ok {
+		return fmt.Errorf("%w: release %s has no %s", ErrNoChecksum, release.TagName, ChecksumsAssetName)
+	}
+
+	expected, err := u.fetchChecksum(checksumAsset.BrowserDownloadURL, assetName)
+	if err != nil {
+		return err
+	}
+
+	// Stage the new binary next to the current one so the final rename stays on one filesystem
+	exeDir := filepath.Dir(exePath)
+	tmpFile, err := os.CreateTemp(exeDir, filepath.Base(exePath)+".*.new")
+	if err != nil {
+		return fmt.Errorf("failed to create staging file in %s: %w", exeDir, err)
+	}
+	tmpPath := tmpFile.Name()
+	defer os.Remove(tmpPath) // No-op after a successful rename
+
+	log.Infof("Downloading %s (%d bytes)...", asset.Name, asset.Size)
+	resp, err := u.Client.Get(asset.BrowserDownloadURL)
+	if err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("failed to download %s: %w", asset.Name, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		tmpFile.Close()
+		return fmt.Errorf("download of %s returned status %s", asset.Name, resp.Status)
+	}
+
+	hasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmpFile, hasher), resp.Body); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("failed to write %s: %w", tmpPath, err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %w", tmpPath, err)
+	}
+
+	actual := hex.EncodeToString(hasher.Sum(nil))
+	if !strings.EqualFold(actual, expected) {
+		return fmt.Errorf("%w for %s: expected %s, got %s", ErrChecksumMismatch, asset.Name, expected, actual)
+	}
+	log.Infof("Checksum verified (SHA256 %s)", actual)
+
+	if err := os.Chmod(tmpPath, 0755); err != nil {
+		return fmt.Errorf("failed to make %s executable: %w", tmpPath, err)
+	}
+
+	// Move the running binary aside first: Windows can't overwrite a running executable,
+	// but it can rename it.
+	oldPath := exePath + ".old"
+	os.Remove(oldPath)
+	if err := os.Rename(exePath, oldPath); err != nil {
+		return fmt.Errorf("failed to move current binary aside: %w", err)
+	}
+	if err := os.Rename(tmpPath, exePath); err != nil {
+		// Put the original back so the install isn't left without a binary
+		if restoreErr := os.Rename(oldPath, exePath); restoreErr != nil {
+			log.WithError(restoreErr).Errorf("Failed to restore original binary from %s", oldPath)
+		}
+		return fmt.Errorf("failed to install new binary: %w", err)
+	}
+	if runtime.GOOS != "windows" {
+		os.Remove(oldPath)
+	}
+	return nil
+}
+
+// fetchChecksum downloads a sha256sum-format file and returns the checksum for assetName.
+func (u *Updater) fetchChecksum(url, assetName string) (string, error) {
+	resp, err := u.Client.Get(url)
+	if err != nil {
+		return "", fmt.Errorf("failed to download checksums: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("checksum download returned status %s", resp.Status)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		// sha256sum prefixes the name with '*' in binary mode
+		if strings.TrimPrefix(fields[1], "*") == assetName {
+			return fields[0], nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("failed to read checksums: %w", err)
+	}
+	return "", fmt.Errorf("%w: %s", ErrNoChecksum, assetName)
+}
+
+// CompareVersions compares two version strings like "v1.2.3" and "1.10.0-rc1".
+// It returns -1 if a < b, 0 if equal and 1 if a > b. Missing components count as 0, so
+// "1.10" equals "1.10.0". A pre-release (the part after the first "-") ranks below the
+// release itself, so "1.2.3-rc1" < "1.2.3" < "1.2.10-rc1"; build metadata after "+" is
+// ignored.
+func CompareVersions(a, b string) int {
+	coreA, preA := splitVersion(a)
+	coreB, preB := splitVersion(b)
+	if c := compareComponents(strings.Split(coreA, "."), strings.Split(coreB, ".")); c != 0 {
+		return c
+	}
+	switch {
+	case preA == preB:
+		return 0
+	case preA == "":
+		return 1
+	case preB == "":
+		return -1
+	}
+	return compareComponents(strings.Split(preA, "."), strings.Split(preB, "."))
+}
+
+// splitVersion trims v and returns its dotted release part and its pre-release ("" for a
+// release).
+func splitVersion(v string) (core, pre string) {
+	v = strings.TrimPrefix(strings.TrimSpace(v), "v")
+	v, _, _ = strings.Cut(v, "+")
+	core, pre, _ = strings.Cut(v, "-")
+	return core, pre
+}
+
+// compareComponents compares two lists of version components one by one; a missing
+// component counts as "0".
+func compareComponents(pa, pb []string) int {
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		sa, sb := "0", "0"
+		if i < len(pa) {
+			sa = pa[i]
+		}
+		if i < len(pb) {
+			sb = pb[i]
+		}
+		if c := compareComponent(sa, sb); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// compareComponent compares the leading numbers of two components numerically (none counts
+// as 0), then whatever follows them: nothing ranks above a suffix ("3" > "3rc1"), and two
+// suffixes compare as strings.
+func compareComponent(a, b string) int {
+	numA, restA := splitNumber(a)
+	numB, restB := splitNumber(b)
+	// Without leading zeros, the longer number is the larger one; equal lengths compare as
+	// strings. This needs no integer parsing, so any number of digits works.
+	if len(numA) != len(numB) {
+		if len(numA) < len(numB) {
+			return -1
+		}
+		return 1
+	}
+	if c := strings.Compare(numA, numB); c != 0 {
+		return c
+	}
+	switch {
+	case restA == restB:
+		return 0
+	case restA == "":
+		return 1
+	case restB == "":
+		return -1
+	}
+	return strings.Compare(restA, restB)
+}
+
+// splitNumber splits s into its leading digits, without leading zeros, and the rest.
+func splitNumber(s string) (digits, rest string) {
+	end := 0
+	for end < len(s) && s[end] >= '0' && s[end] <= '9' {
+		end++
+	}
+	return strings.TrimLeft(s[:end], "0"), s[end:]
+}
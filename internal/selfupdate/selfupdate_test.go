@@ -0,0 +1,131 @@
+package selfupdate
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want int
+	}{
+		{"Equal", "1.2.3", "1.2.3", 0},
+		{"Leading v", "v1.2.3", "1.2.3", 0},
+		{"Missing patch", "1.10", "1.10.0", 0},
+		{"Missing minor and patch", "v2", "2.0.0", 0},
+		{"Missing patch is older", "1.10", "1.10.1", -1},
+		{"Longer is newer", "1.10.0.1", "1.10", 1},
+		{"Numeric, not lexical", "1.9.0", "1.10.0", -1},
+		{"Major wins", "2.0.0", "1.99.99", 1},
+		{"Whitespace", " v1.2.3\n", "1.2.3", 0},
+		{"Non-numeric part", "1.2.rc1", "1.2.rc2", -1},
+		{"Pre-release of a later patch", "v1.2.10-rc1", "v1.2.9", 1},
+		{"Pre-release before the release", "v1.2.3-rc1", "v1.2.3", -1},
+		{"Pre-release after the previous release", "v1.2.3-rc1", "v1.2.2", 1},
+		{"Pre-releases", "1.2.3-rc1", "1.2.3-rc2", -1},
+		{"Numeric pre-release identifiers", "1.2.3-rc.2", "1.2.3-rc.10", -1},
+		{"Number with a suffix", "1.2.10rc1", "1.2.9", 1},
+		{"Suffix before the bare number", "1.2.3rc1", "1.2.3", -1},
+		{"Build metadata ignored", "1.2.3+abc", "1.2.3", 0},
+		{"Leading zeros", "1.02.3", "1.2.3", 0},
+		{"Long numbers", "1.99999999999999999999", "1.100000000000000000000", -1},
+		{"Dev build", "dev", "v1.0.0", -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CompareVersions(tt.a, tt.b); got != tt.want {
+				t.Errorf("CompareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+			}
+			if got := CompareVersions(tt.b, tt.a); got != -tt.want {
+				t.Errorf("CompareVersions(%q, %q) = %d, want %d", tt.b, tt.a, got, -tt.want)
+			}
+		})
+	}
+}
+
+func TestApply(t *testing.T) {
+	binary := []byte("new binary")
+	sum := sha256.Sum256(binary)
+	u := &Updater{BinaryName: "civitai-downloader", Client: http.DefaultClient}
+	assetName := u.AssetName()
+
+	tests := []struct {
+		name      string
+		checksums string // Served as checksums.txt; "" leaves the asset out of the release
+		wantErr   error
+	}{
+		{"Verified", fmt.Sprintf("%s  other-binary\n%s  %s\n", hex.EncodeToString(make([]byte, 32)), hex.EncodeToString(sum[:]), assetName), nil},
+		{"Binary mode name", fmt.Sprintf("%s *%s\n", hex.EncodeToString(sum[:]), assetName), nil},
+		{"Checksum mismatch", fmt.Sprintf("%s  %s\n", hex.EncodeToString(make([]byte, 32)), assetName), ErrChecksumMismatch},
+		{"No checksum for the binary", fmt.Sprintf("%s  other-binary\n", hex.EncodeToString(sum[:])), ErrNoChecksum},
+		{"No checksums file", "", ErrNoChecksum},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/" + assetName:
+					w.Write(binary)
+				case "/" + ChecksumsAssetName:
+					fmt.Fprint(w, tt.checksums)
+				default:
+					http.NotFound(w, r)
+				}
+			}))
+			defer srv.Close()
+			release := Release{TagName: "v9.9.9", Assets: []Asset{{Name: assetName, BrowserDownloadURL: srv.URL + "/" + assetName, Size: int64(len(binary))}}}
+			if tt.checksums != "" {
+				release.Assets = append(release.Assets, Asset{Name: ChecksumsAssetName, BrowserDownloadURL: srv.URL + "/" + ChecksumsAssetName})
+			}
+
+			dir := t.TempDir()
+			exePath := filepath.Join(dir, "civitai-downloader")
+			if err := os.WriteFile(exePath, []byte("old binary"), 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			err := u.Apply(release, exePath)
+			want := binary
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Apply: err = %v, want %v", err, tt.wantErr)
+				}
+				want = []byte("old binary")
+			} else if err != nil {
+				t.Fatalf("Apply: %v", err)
+			}
+			got, err := os.ReadFile(exePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != string(want) {
+				t.Errorf("executable = %q, want %q", got, want)
+			}
+			// Nothing staged is left behind
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 {
+				t.Errorf("%d files next to the executable, want only the executable", len(entries))
+			}
+		})
+	}
+}
+
+func TestApplyNoAsset(t *testing.T) {
+	u := &Updater{BinaryName: "civitai-downloader", Client: http.DefaultClient}
+	err := u.Apply(Release{TagName: "v9.9.9", Assets: []Asset{{Name: "civitai-downloader-plan9-mips"}}}, filepath.Join(t.TempDir(), "civitai-downloader"))
+	if !errors.Is(err, ErrNoAsset) {
+		t.Errorf("Apply: err = %v, want ErrNoAsset", err)
+	}
+}